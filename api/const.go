@@ -1,10 +1,29 @@
 package api
 
 const (
-	// API_VERSION is the API version of Convoy daemon
+	// API_VERSION is the stable API version of Convoy daemon, used by the
+	// client
 	API_VERSION = "1"
+	// API_VERSION_V2 runs long operations as jobs unless asked otherwise
+	API_VERSION_V2 = "2"
 
 	KEY_NAME       = "name"
 	KEY_BACKUP_URL = "backup"
 	KEY_DEST_URL   = "dest"
+	KEY_ASYNC      = "async"
+	KEY_WATCH      = "watch"
+	KEY_FOLLOW     = "follow"
+
+	// REQUEST_ID_HEADER identifies a request in the logs of daemon. The
+	// daemon responds the ID of every request in it, and uses the one of
+	// request if specified.
+	REQUEST_ID_HEADER = "X-Request-ID"
+
+	// ERROR_TRAILER is the HTTP trailer reporting the failure of a streamed
+	// response, which cannot change the status once it's started
+	ERROR_TRAILER = "Convoy-Error"
+
+	JOB_STATUS_RUNNING   = "running"
+	JOB_STATUS_SUCCEEDED = "succeeded"
+	JOB_STATUS_FAILED    = "failed"
 )
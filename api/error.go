@@ -0,0 +1,87 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Codes of Error, which tell clients the kind of failure without parsing
+// the message
+const (
+	ERROR_CODE_NOT_FOUND          = "NotFound"
+	ERROR_CODE_CONFLICT           = "Conflict"
+	ERROR_CODE_IN_USE             = "InUse"
+	ERROR_CODE_DRIVER_UNSUPPORTED = "DriverUnsupported"
+	ERROR_CODE_BUSY               = "Busy"
+	ERROR_CODE_INVALID_REQUEST    = "InvalidRequest"
+	ERROR_CODE_UNAUTHORIZED       = "Unauthorized"
+	// The operation or command was killed at its timeout
+	ERROR_CODE_TIMEOUT = "Timeout"
+	// Errors of any other kind
+	ERROR_CODE_UNKNOWN = "Unknown"
+)
+
+var errorCodeStatus = map[string]int{
+	ERROR_CODE_NOT_FOUND:          http.StatusNotFound,
+	ERROR_CODE_CONFLICT:           http.StatusConflict,
+	ERROR_CODE_IN_USE:             http.StatusConflict,
+	ERROR_CODE_DRIVER_UNSUPPORTED: http.StatusNotImplemented,
+	ERROR_CODE_BUSY:               http.StatusServiceUnavailable,
+	ERROR_CODE_INVALID_REQUEST:    http.StatusBadRequest,
+	ERROR_CODE_UNAUTHORIZED:       http.StatusUnauthorized,
+	ERROR_CODE_TIMEOUT:            http.StatusGatewayTimeout,
+	// Errors were always responded with 400 before they had codes
+	ERROR_CODE_UNKNOWN: http.StatusBadRequest,
+}
+
+// Error is the response of daemon for a failed request, in JSON as
+// {"code": ..., "message": ..., "details": {...}}
+type Error struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// StatusCode is the HTTP status of the error
+func (e *Error) StatusCode() int {
+	if status, exists := errorCodeStatus[e.Code]; exists {
+		return status
+	}
+	return http.StatusBadRequest
+}
+
+func NewError(code string, format string, a ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// WithDetail adds detail key of the error, e.g. the name of volume
+func (e *Error) WithDetail(key, value string) *Error {
+	if e.Details == nil {
+		e.Details = map[string]string{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+// ErrorCode returns the code of err if it's an Error or wraps one, otherwise
+// ERROR_CODE_UNKNOWN
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ERROR_CODE_UNKNOWN
+}
+
+// IsErrorCode returns true if err is an Error of code
+func IsErrorCode(err error, code string) bool {
+	return ErrorCode(err) == code
+}
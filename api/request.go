@@ -3,6 +3,8 @@ package api
 type VolumeMountRequest struct {
 	VolumeName string
 	MountPoint string
+	Timeout    string
+	ReadOnly   bool
 	Verbose    bool
 }
 
@@ -10,32 +12,167 @@ type VolumeUmountRequest struct {
 	VolumeName string
 }
 
+// VolumeForceUmountRequest umounts a volume lazily, even if it's in use or its
+// umount hangs, killing the processes using it if Kill is true
+type VolumeForceUmountRequest struct {
+	VolumeName string
+	Kill       bool
+}
+
+// VolumeFenceRequest force umounts a volume, detaches it from the host by
+// force, and keeps the host from mounting it until VolumeUnfenceRequest
+type VolumeFenceRequest struct {
+	VolumeName string
+	Kill       bool
+}
+
+type VolumeUnfenceRequest struct {
+	VolumeName string
+}
+
+type VolumeStatsRequest struct {
+	VolumeName string
+}
+
+type VolumeResizeRequest struct {
+	VolumeName string
+	Size       string
+}
+
+type VolumeRefreshRequest struct {
+	VolumeName string
+	Verbose    bool
+}
+
+/*
+SnapshotRetention is the retention of snapshots of a volume, enforced after
+every snapshot of it is created. It keeps the latest KeepLast snapshots, the
+latest snapshot of each of the last KeepDaily days, and the latest snapshot
+of each of the last KeepWeekly weeks. The others are deleted.
+*/
+type SnapshotRetention struct {
+	KeepLast   int `json:",omitempty"`
+	KeepDaily  int `json:",omitempty"`
+	KeepWeekly int `json:",omitempty"`
+}
+
+// VolumeRetentionRequest sets the snapshot retention of volume, or removes
+// it if every count is zero
+type VolumeRetentionRequest struct {
+	VolumeName string
+	KeepLast   int
+	KeepDaily  int
+	KeepWeekly int
+}
+
 type VolumeCreateRequest struct {
 	Name           string
 	DriverName     string
 	Size           int64
 	BackupURL      string
+	SnapshotName   string
 	DriverVolumeID string
 	Type           string
 	FSType         string
 	IOPS           int64
+	Throughput     int64
 	PrepareForVM   bool
-	Verbose        bool
+	Labels         map[string]string
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Key to decrypt the backup in base64, if it's encrypted by a key
+	// unknown to the daemon
+	EncryptionKey string
+	// Tags of the resource created by driver, e.g. EBS volume
+	Tags map[string]string
+	// Encrypt the volume in the backend, e.g. by the KMS key of KmsKeyID
+	Encrypted bool
+	KmsKeyID  string
+	// Numeric owner and octal permission of the root directory of volume,
+	// e.g. "1000", "1000" and "2775", so non-root containers can write
+	UID  string
+	GID  string
+	Mode string
+	// Profile of options in daemon config, which fills the options not
+	// specified by the request
+	Profile string
+	Verbose bool
+}
+
+type VolumeImportRequest struct {
+	Name       string
+	DriverName string
+	// Existing data adopted by the volume, e.g. directory of VFS or volume ID
+	// of EBS
+	Source string
+	Labels map[string]string
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	Verbose  bool
+}
+
+type VolumeCloneRequest struct {
+	// Name of the new volume
+	Name string
+	// Volume to be copied, the new volume is created by its driver
+	VolumeName string
+	Labels     map[string]string
+	Verbose    bool
+}
+
+type VolumeMigrateRequest struct {
+	VolumeName string
+	// Driver the volume is moved to
+	DriverName string
+	// Size of the new volume, the size of the volume by default
+	Size       int64
+	Type       string
+	FSType     string
+	IOPS       int64
+	Throughput int64
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Tags of the resource created by driver, e.g. EBS volume
+	Tags      map[string]string
+	Encrypted bool
+	KmsKeyID  string
+	Verbose   bool
+}
+
+type VolumeExportRequest struct {
+	VolumeName string
+	// Compression of the tarball, see util.COMPRESSION_*
+	Compression string
 }
 
 type VolumeDeleteRequest struct {
 	VolumeName    string
 	ReferenceOnly bool
+	// Delete right away rather than moving the volume to trash
+	Purge bool
 }
 
 type VolumeInspectRequest struct {
 	VolumeName string
 }
 
+type VolumeBackupsRequest struct {
+	VolumeName string
+}
+
 type SnapshotCreateRequest struct {
 	Name       string
 	VolumeName string
-	Verbose    bool
+	Labels     map[string]string
+	// Compression of snapshot, if supported by driver
+	Compression string
+	// Tags of the resource created by driver, e.g. EBS snapshot
+	Tags    map[string]string
+	Verbose bool
 }
 
 type SnapshotDeleteRequest struct {
@@ -46,18 +183,158 @@ type SnapshotInspectRequest struct {
 	SnapshotName string
 }
 
+// SnapshotDiffRequest asks for the change from the snapshot of
+// CompareSnapshotName to the later snapshot of SnapshotName
+type SnapshotDiffRequest struct {
+	SnapshotName        string
+	CompareSnapshotName string
+}
+
+// RestoreEstimateRequest asks what restoring the backup of URL by driver
+// DriverName would take, the default driver if it's empty
+type RestoreEstimateRequest struct {
+	URL           string
+	DriverName    string
+	EncryptionKey string
+}
+
 type BackupListRequest struct {
 	URL          string
 	VolumeName   string
 	SnapshotName string
+	// Backups created in [CreatedSince, CreatedUntil), in RFC3339 format
+	CreatedSince string
+	CreatedUntil string
+	// At most Limit backups after the one with URL Marker
+	Marker string
+	Limit  int
+	// Read every backup config from the destination, rather than the
+	// cached ones which haven't changed
+	NoCache bool
 }
 
 type BackupCreateRequest struct {
 	URL          string
 	SnapshotName string
-	Verbose      bool
+	Retain       int
+	Options      map[string]string
+	// Content of key file in base64, or KMS key to generate the key by
+	EncryptionKey      string
+	EncryptionKMSKeyID string
+	Compression        string
+	Verbose            bool
+}
+
+/*
+BackupNowRequest creates a snapshot of volume and backs it up to URL, while
+the volume is locked throughout. The snapshot is deleted if the backup fails,
+or after it succeeds if DeleteSnapshot. The other options are the ones of
+SnapshotCreateRequest and BackupCreateRequest.
+*/
+type BackupNowRequest struct {
+	VolumeName string
+	URL        string
+	// Name of the snapshot, generated if empty
+	SnapshotName   string
+	Labels         map[string]string
+	DeleteSnapshot bool
+	Retain         int
+	Options        map[string]string
+	// Content of key file in base64, or KMS key to generate the key by
+	EncryptionKey      string
+	EncryptionKMSKeyID string
+	Compression        string
+	Verbose            bool
 }
 
 type BackupDeleteRequest struct {
 	URL string
+	// Delete right away rather than moving the backup to trash
+	Purge bool
+}
+
+type BackupArchiveRequest struct {
+	URL          string
+	StorageClass string
+}
+
+type BackupRestoreArchiveRequest struct {
+	URL  string
+	Days int64
+	Tier string
+}
+
+// BackupCopyRequest copies the backup of URL to objectstore DestURL, with
+// destination Options like BackupCreateRequest
+type BackupCopyRequest struct {
+	URL     string
+	DestURL string
+	Options map[string]string
+	Verbose bool
+}
+
+// BackupGCRequest removes the shared blocks of destination URL which no
+// backup refers to, or only counts them if DryRun
+type BackupGCRequest struct {
+	URL    string
+	DryRun bool
+}
+
+// ObjectStoreGCRequest removes the objects of destination URL no backup
+// refers to, which haven't been modified for MinAge, e.g. "24h"
+type ObjectStoreGCRequest struct {
+	URL    string
+	MinAge string
+	DryRun bool
+}
+
+// BackupRestoreFileRequest restores Paths, relative to the root of volume,
+// from backup of URL to the same paths in directory To of the daemon host
+type BackupRestoreFileRequest struct {
+	URL   string
+	Paths []string
+	To    string
+}
+
+type PolicyCreateRequest struct {
+	Name     string
+	Selector map[string]string
+	Cron     string
+	URL      string
+	Retain   int
+}
+
+type PolicyDeleteRequest struct {
+	Name string
+}
+
+type ScheduleCreateRequest struct {
+	Name       string
+	VolumeName string
+	Cron       string
+	Retain     int
+}
+
+type ScheduleDeleteRequest struct {
+	Name string
+}
+
+// Either VolumeName or BackupURL of the trash entry
+type TrashRestoreRequest struct {
+	VolumeName string
+	BackupURL  string
+}
+
+type TrashPurgeRequest struct {
+	VolumeName string
+	BackupURL  string
+	// Purge every entry in trash, expired or not
+	All bool
+}
+
+// LogLevelRequest sets the log level of Package, or the global level if
+// Package is empty. Level "default" makes Package use the global level again.
+type LogLevelRequest struct {
+	Package string
+	Level   string
 }
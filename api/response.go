@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime"
 	"runtime/debug"
@@ -12,6 +13,9 @@ import (
 
 type ErrorResponse struct {
 	Error string
+	// Code and details of Error, if the error is typed
+	Code    string            `json:",omitempty"`
+	Details map[string]string `json:",omitempty"`
 }
 
 type VolumeResponse struct {
@@ -19,8 +23,51 @@ type VolumeResponse struct {
 	Driver      string
 	MountPoint  string
 	CreatedTime string
-	DriverInfo  map[string]string
-	Snapshots   map[string]SnapshotResponse
+	// Bytes used by and reserved for the volume, if the driver reports them
+	UsedSize      string            `json:",omitempty"`
+	AllocatedSize string            `json:",omitempty"`
+	Labels        map[string]string `json:",omitempty"`
+	// In cluster mode, the host reporting the volume, and the host it's
+	// attached to if it's not on shared storage
+	Host         string `json:",omitempty"`
+	AttachedHost string `json:",omitempty"`
+	DriverInfo   map[string]string
+	Snapshots    map[string]SnapshotResponse
+	// Retention of snapshots, see VolumeRetentionRequest
+	SnapshotRetention *SnapshotRetention `json:",omitempty"`
+	// Set if the volume is fenced, see VolumeFenceRequest
+	Fence *VolumeFence `json:",omitempty"`
+}
+
+// VolumeFence is the host a volume is fenced on, and when
+type VolumeFence struct {
+	Host string `json:",omitempty"`
+	Time string
+}
+
+/*
+VolumeStatsResponse is the IO of the block device of a volume since the
+device is created, as counted by the kernel. Times are in milliseconds, and
+the latencies are the averages of reads and writes.
+*/
+type VolumeStatsResponse struct {
+	Volume string
+	// Name of the device, e.g. dm-3, and its major:minor
+	Device       string
+	DeviceNumber string
+	// The device isn't dedicated to the volume, e.g. the filesystem of vfs
+	// volumes, so its IO includes the one of others
+	Shared       bool `json:",omitempty"`
+	ReadBytes    uint64
+	WrittenBytes uint64
+	Reads        uint64
+	Writes       uint64
+	ReadTime     uint64
+	WriteTime    uint64
+	ReadLatency  float64
+	WriteLatency float64
+	InProgress   uint64
+	IOTime       uint64
 }
 
 type SnapshotResponse struct {
@@ -28,17 +75,246 @@ type SnapshotResponse struct {
 	VolumeName      string `json:",omitempty"`
 	VolumeCreatedAt string `json:",omitempty"`
 	CreatedTime     string
+	Labels          map[string]string `json:",omitempty"`
 	DriverInfo      map[string]string
+	// Snapshots of the volume deleted by its retention after the snapshot
+	// was created
+	Pruned []string `json:",omitempty"`
+}
+
+type FileChangeResponse struct {
+	Path   string
+	Change string
+	Size   int64
+}
+
+type ExtentResponse struct {
+	Offset int64
+	Length int64
+}
+
+// SnapshotDiffResponse has either Files or Extents, depending on whether the
+// driver stores files or blocks
+type SnapshotDiffResponse struct {
+	VolumeName      string
+	Snapshot        string
+	CompareSnapshot string
+	Files           []FileChangeResponse `json:",omitempty"`
+	Extents         []ExtentResponse     `json:",omitempty"`
+	ChangedBytes    int64
 }
 
 type BackupURLResponse struct {
 	URL string
 }
 
+// BackupNowResponse is the backup created by BackupNowRequest, and the
+// snapshot it's created from, unless the snapshot is deleted
+type BackupNowResponse struct {
+	URL             string
+	SnapshotName    string
+	SnapshotDeleted bool
+}
+
+// RestoreEstimateResponse is the size of a backup to restore, the time it
+// would take and whether the driver has space for it. Sizes are in bytes,
+// and -1 if they're unknown.
+type RestoreEstimateResponse struct {
+	URL        string
+	Driver     string
+	VolumeSize int64
+	// Bytes written by restore, e.g. unknown for compressed files backups
+	DataSize int64
+	// Blocks of block backups, or files of files and stream backups,
+	// including the ones of the backups it's incremental to
+	Blocks int `json:",omitempty"`
+	Files  int `json:",omitempty"`
+	// Estimated by the size of the first block for block backups
+	DownloadSize int64
+	// Bytes per second of a single read from the objectstore, 0 if nothing
+	// has been read from it, and the reads restore does in parallel
+	Bandwidth   int64
+	Concurrency int
+	// Empty if the bandwidth or download size is unknown
+	EstimatedDuration string `json:",omitempty"`
+	FreeSpace         int64
+	RequiredSpace     int64
+	// Why the backup cannot be restored now, empty if it can
+	Problems []string `json:",omitempty"`
+}
+
+// MountPointChange is a recorded mount point corrected by the actual one
+type MountPointChange struct {
+	Volume   string
+	Recorded string
+	Actual   string
+}
+
+type DoctorResponse struct {
+	MountPoints  []MountPointChange `json:",omitempty"`
+	OrphanMounts []string           `json:",omitempty"`
+	// Volumes no longer attached to this host in cluster mode
+	ReleasedAttachments []string `json:",omitempty"`
+	Errors              []string `json:",omitempty"`
+}
+
+// BackupGCResponse reports the garbage collection of shared blocks
+type BackupGCResponse struct {
+	// Backups referring to shared blocks
+	Backups            int
+	Blocks             int
+	UnreferencedBlocks int
+	RemovedBlocks      int
+}
+
+// ObjectStoreGCResponse reports the orphans found in the destination, and
+// how many of them and empty volumes are removed
+type ObjectStoreGCResponse struct {
+	OrphanBlocks  int
+	OrphanFiles   []string
+	EmptyVolumes  []string
+	RecentOrphans int
+	Removed       int
+}
+
+// RescanResponse reports the indexes rebuilt from the volumes and snapshots
+// reported by the drivers
+type RescanResponse struct {
+	Volumes   int
+	Snapshots int
+	// Snapshots in the indexes which are no longer reported by drivers
+	StaleSnapshots []string `json:",omitempty"`
+	// Volume configs failed to parse, which are moved to the listed keys of
+	// metadata store, i.e. files in the root directory by default
+	CorruptedConfigs []string `json:",omitempty"`
+	Errors           []string `json:",omitempty"`
+}
+
+const (
+	HEALTH_STATUS_HEALTHY   = "healthy"
+	HEALTH_STATUS_UNHEALTHY = "unhealthy"
+)
+
+type HealthResponse struct {
+	Status       string
+	Drivers      map[string]DriverHealthResponse
+	ObjectStores []HealthCheckResponse `json:",omitempty"`
+}
+
+type DriverHealthResponse struct {
+	Status string
+	Checks []HealthCheckResponse
+}
+
+type HealthCheckResponse struct {
+	Name   string
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+type JobResponse struct {
+	ID           string
+	Operation    string
+	Status       string
+	CreatedTime  string
+	FinishedTime string `json:",omitempty"`
+	Result       string `json:",omitempty"`
+	Error        string `json:",omitempty"`
+	// Code of Error, if it's typed
+	ErrorCode string `json:",omitempty"`
+}
+
+// LogLevelsResponse is the global log level, and the levels of packages
+// overriding it
+type LogLevelsResponse struct {
+	Level    string
+	Packages map[string]string
+}
+
+// EventResponse is sent to hooks and the event stream of daemon when volumes,
+// snapshots or backups change
+type EventResponse struct {
+	Event      string
+	Time       string
+	Host       string
+	Volume     string `json:",omitempty"`
+	Snapshot   string `json:",omitempty"`
+	MountPoint string `json:",omitempty"`
+	DestURL    string `json:",omitempty"`
+	BackupURL  string `json:",omitempty"`
+	Error      string `json:",omitempty"`
+	// Events are numbered in order since the daemon started
+	ID int64 `json:",omitempty"`
+}
+
+// OperationsResponse is the activity of daemon at Time
+type OperationsResponse struct {
+	Time       string
+	Operations []OperationResponse
+	Backups    []BackupProgressResponse
+	Locks      []VolumeLockResponse
+}
+
+// OperationResponse is an API request, a job, or a run of schedule or policy
+// in progress
+type OperationResponse struct {
+	ID        string
+	Operation string
+	// Volume, snapshot or backup the operation is on, if it's known
+	Target    string `json:",omitempty"`
+	Requester string `json:",omitempty"`
+	JobID     string `json:",omitempty"`
+	// Time when the operation started, and the time it has taken
+	StartedTime string
+	Duration    string
+}
+
+// BackupProgressResponse is a backup being created or copied
+type BackupProgressResponse struct {
+	Name        string
+	Volume      string
+	DestURL     string
+	StartedTime string
+	Duration    string
+	// Blocks of delta block backup to back up and the ones done
+	TotalBlocks int64 `json:",omitempty"`
+	DoneBlocks  int64 `json:",omitempty"`
+	// Bytes uploaded, and the bytes uploaded per second since the previous
+	// update of the stream, or since the backup started
+	UploadedBytes int64
+	Throughput    int64
+}
+
+// VolumeLockResponse is a volume with operations holding or waiting for its
+// lock
+type VolumeLockResponse struct {
+	Volume string
+	// Time when the lock was taken and how long it has been held, empty if
+	// it's being passed to a waiter
+	HeldSince string `json:",omitempty"`
+	Duration  string `json:",omitempty"`
+	Waiters   int
+}
+
 // ResponseError would generate a error information in JSON format for output
 func ResponseError(format string, a ...interface{}) {
-	response := ErrorResponse{Error: fmt.Sprintf(format, a...)}
-	j, err := json.MarshalIndent(&response, "", "\t")
+	printErrorResponse(&ErrorResponse{Error: fmt.Sprintf(format, a...)})
+}
+
+// ResponseErrorOf is ResponseError of err, with the code and details if err
+// is or wraps an Error
+func ResponseErrorOf(err error) {
+	response := &ErrorResponse{Error: err.Error()}
+	var e *Error
+	if errors.As(err, &e) {
+		response.Code = e.Code
+		response.Details = e.Details
+	}
+	printErrorResponse(response)
+}
+
+func printErrorResponse(response *ErrorResponse) {
+	j, err := json.MarshalIndent(response, "", "\t")
 	if err != nil {
 		panic(fmt.Sprintf("Failed to generate response for error:", err))
 	}
@@ -64,7 +340,7 @@ func ResponseLogAndError(v interface{}) {
 		_, isRuntimeErr := e.(runtime.Error)
 		if isErr && !isRuntimeErr {
 			logrus.Errorf(fmt.Sprint(e))
-			ResponseError(fmt.Sprint(e))
+			ResponseErrorOf(e)
 		} else {
 			logrus.Errorf("Caught FATAL error: %s", v)
 			debug.PrintStack()
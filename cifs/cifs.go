@@ -0,0 +1,550 @@
+package cifs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+const (
+	DRIVER_NAME        = "cifs"
+	DRIVER_CONFIG_FILE = "cifs.cfg"
+
+	VOLUME_CFG_PREFIX = "volume_"
+	DRIVER_CFG_PREFIX = DRIVER_NAME + "_"
+	CFG_POSTFIX       = ".json"
+
+	MOUNTS_DIR = "mounts"
+
+	CIFS_SERVER                = "cifs.server"
+	CIFS_CREDENTIALS           = "cifs.credentials"
+	CIFS_DEFAULT_MOUNT_OPTIONS = "cifs.defaultmountoptions"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "cifs"})
+)
+
+type Driver struct {
+	mutex *sync.RWMutex
+	Device
+}
+
+func init() {
+	if err := Register(DRIVER_NAME, Init); err != nil {
+		panic(err)
+	}
+}
+
+func (d *Driver) Name() string {
+	return DRIVER_NAME
+}
+
+type Device struct {
+	Root string
+	// Server of the shares specified without one, e.g. "projects/vol1"
+	Server string
+	// File of username, password and domain, see mount.cifs(8)
+	CredentialsFile string
+	// Comma separated options used when mounting every volume
+	DefaultMountOptions string
+}
+
+func (dev *Device) ConfigFile() (string, error) {
+	if dev.Root == "" {
+		return "", fmt.Errorf("BUG: Invalid empty device config path")
+	}
+	return filepath.Join(dev.Root, DRIVER_CONFIG_FILE), nil
+}
+
+type Volume struct {
+	Name string
+	// UNC path of the share, e.g. //server/share/path
+	Share       string
+	MountPoint  string
+	CreatedTime string
+	// Comma separated options used when mounting the volume, after the
+	// default ones of driver
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Whether the current mount is read-only
+	MountedReadOnly bool
+
+	configPath          string
+	credentialsFile     string
+	defaultMountOptions string
+}
+
+func (v *Volume) ConfigFile() (string, error) {
+	if v.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume name")
+	}
+	if v.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume config path")
+	}
+	return filepath.Join(v.configPath, DRIVER_CFG_PREFIX+VOLUME_CFG_PREFIX+v.Name+CFG_POSTFIX), nil
+}
+
+func (v *Volume) GetDevice() (string, error) {
+	return v.Share, nil
+}
+
+func (v *Volume) GetMountOpts() []string {
+	options := util.ReadOnlyMountOptions(v.mountOptions(), v.MountedReadOnly)
+	return append([]string{"-t", "cifs"}, util.MountOptionsArgs(options)...)
+}
+
+func (v *Volume) GenerateDefaultMountPoint() string {
+	return filepath.Join(v.configPath, MOUNTS_DIR, v.Name)
+}
+
+// mountOptions returns the credentials file of driver unless the volume has
+// its own, followed by the default options of driver and the ones of volume
+func (v *Volume) mountOptions() string {
+	opts := []string{}
+	if v.credentialsFile != "" && !hasMountOption(v.MountOptions, "credentials") {
+		opts = append(opts, "credentials="+v.credentialsFile)
+	}
+	for _, options := range []string{v.defaultMountOptions, v.MountOptions} {
+		if options != "" {
+			opts = append(opts, options)
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+func hasMountOption(options, name string) bool {
+	for _, opt := range strings.Split(options, ",") {
+		if strings.SplitN(opt, "=", 2)[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMountOptions rejects passwords, which would be saved in the config of
+// volume and shown by inspect, rather than kept in the credentials file
+func checkMountOptions(options string) error {
+	if hasMountOption(options, "password") || hasMountOption(options, "pass") ||
+		hasMountOption(options, "password2") {
+		return fmt.Errorf("Password cannot be specified in mount options, put it in the credentials file of %v instead", CIFS_CREDENTIALS)
+	}
+	return nil
+}
+
+/*
+parseShare returns the UNC path of share, e.g. "//server/share/path". The
+share can be specified in the Windows form "\\server\share\path" as well,
+or as "share/path" on the server of driver.
+*/
+func parseShare(share, server string) (string, error) {
+	unc := strings.Replace(share, `\`, "/", -1)
+	if !strings.HasPrefix(unc, "//") {
+		if server == "" {
+			return "", fmt.Errorf("Invalid share %v, must be like //server/share/path since %v is not specified", share, CIFS_SERVER)
+		}
+		unc = "//" + server + "/" + strings.TrimPrefix(unc, "/")
+	}
+	parts := strings.Split(strings.TrimPrefix(unc, "//"), "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("Invalid share %v, must be like //server/share/path", share)
+	}
+	for _, part := range parts {
+		if part == ".." {
+			return "", fmt.Errorf("Invalid share %v, cannot contain ..", share)
+		}
+	}
+	return "/" + path.Clean("/"+strings.Join(parts, "/")), nil
+}
+
+func (device *Device) listVolumeNames() ([]string, error) {
+	return util.ListConfigIDs(device.Root, DRIVER_CFG_PREFIX+VOLUME_CFG_PREFIX, CFG_POSTFIX)
+}
+
+// parseConfig sets the options of dev by config, keeping the current ones if
+// they're not specified
+func parseConfig(dev *Device, config map[string]string) error {
+	if value, exists := config[CIFS_SERVER]; exists {
+		if strings.ContainsAny(value, `/\`) {
+			return fmt.Errorf("Invalid %v %v, must be a host name or IP address", CIFS_SERVER, value)
+		}
+		dev.Server = value
+	}
+	if value, exists := config[CIFS_CREDENTIALS]; exists {
+		if value != "" && !filepath.IsAbs(value) {
+			return fmt.Errorf("Invalid %v %v, must be an absolute path", CIFS_CREDENTIALS, value)
+		}
+		dev.CredentialsFile = value
+	}
+	if value, exists := config[CIFS_DEFAULT_MOUNT_OPTIONS]; exists {
+		if err := util.ValidateMountOptions(value); err != nil {
+			return err
+		}
+		if err := checkMountOptions(value); err != nil {
+			return err
+		}
+		dev.DefaultMountOptions = value
+	}
+	return nil
+}
+
+// checkCredentialsFile fails if the credentials file cannot be read, and
+// warns if it can be read by other users
+func checkCredentialsFile(file string) error {
+	if file == "" {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("Cannot read credentials file: %v", err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Mode().Perm()&0077 != 0 {
+		log.Warnf("Credentials file %v is accessible by other users, its permission should be 0600", file)
+	}
+	return nil
+}
+
+func Init(root string, config map[string]string) (ConvoyDriver, error) {
+	dev := &Device{
+		Root: root,
+	}
+	exists, err := util.ObjectExists(dev)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if err := util.ObjectLoad(dev); err != nil {
+			return nil, err
+		}
+	} else if err := util.MkdirIfNotExists(root); err != nil {
+		return nil, err
+	}
+	if err := parseConfig(dev, config); err != nil {
+		return nil, err
+	}
+	if err := checkCredentialsFile(dev.CredentialsFile); err != nil {
+		return nil, err
+	}
+	if err := util.ObjectSave(dev); err != nil {
+		return nil, err
+	}
+
+	d := &Driver{
+		mutex:  &sync.RWMutex{},
+		Device: *dev,
+	}
+	d.remountVolumes()
+	return d, nil
+}
+
+/*
+remountVolumes mounts the volumes recorded as mounted again, e.g. after the
+host rebooted. Shares which cannot be mounted are only logged, so one
+unreachable server doesn't stop the daemon, and the mount points would be
+corrected by refreshing.
+*/
+func (d *Driver) remountVolumes() {
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		log.Errorf("Failed to list volumes to remount: %v", err)
+		return
+	}
+	for _, id := range volumeIDs {
+		volume := d.blankVolume(id)
+		if err := util.ObjectLoad(volume); err != nil {
+			log.Errorf("Failed to load volume %v to remount: %v", id, err)
+			continue
+		}
+		if volume.MountPoint == "" {
+			continue
+		}
+		if _, err := util.VolumeMount(volume, volume.MountPoint, false); err != nil {
+			log.Warnf("Failed to remount volume %v at %v: %v", id, volume.MountPoint, err)
+		}
+	}
+}
+
+func (d *Driver) Info() (map[string]string, error) {
+	return map[string]string{
+		"Root":                d.Root,
+		"Server":              d.Server,
+		"CredentialsFile":     d.CredentialsFile,
+		"DefaultMountOptions": d.DefaultMountOptions,
+	}, nil
+}
+
+func (d *Driver) CheckHealth() []HealthCheck {
+	if d.CredentialsFile == "" {
+		return []HealthCheck{}
+	}
+	return []HealthCheck{{
+		Name:  "credentials",
+		Error: checkCredentialsFile(d.CredentialsFile),
+	}}
+}
+
+func (d *Driver) VolumeOps() (VolumeOperations, error) {
+	return d, nil
+}
+
+func (d *Driver) blankVolume(name string) *Volume {
+	return &Volume{
+		configPath:          d.Root,
+		credentialsFile:     d.CredentialsFile,
+		defaultMountOptions: d.DefaultMountOptions,
+		Name:                name,
+	}
+}
+
+// CreateVolume records the share of opts[OPT_VOLUME_DRIVER_ID] as the volume,
+// which is mounted on demand. Shares are managed on the server, so it has to
+// exist already.
+func (d *Driver) CreateVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	share := req.Options[OPT_VOLUME_DRIVER_ID]
+	if share == "" {
+		return fmt.Errorf("Share of volume is required by %v, specify it by --id", d.Name())
+	}
+	return d.createVolume(req, share)
+}
+
+// ImportVolume is the same as CreateVolume, with the share of
+// opts[OPT_IMPORT_SOURCE]
+func (d *Driver) ImportVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.createVolume(req, req.Options[OPT_IMPORT_SOURCE])
+}
+
+func (d *Driver) createVolume(req Request, share string) error {
+	id := req.Name
+	opts := req.Options
+
+	if opts[OPT_BACKUP_URL] != "" || opts[OPT_SNAPSHOT_NAME] != "" {
+		return fmt.Errorf("Creating volume from backup or snapshot is not supported by %v", d.Name())
+	}
+	if opts[OPT_UID] != "" || opts[OPT_GID] != "" || opts[OPT_MODE] != "" {
+		return fmt.Errorf("Owner and permission of volume are not supported by %v, use uid, gid, file_mode and dir_mode of mount options instead", d.Name())
+	}
+	if err := checkMountOptions(opts[OPT_MOUNT_OPTIONS]); err != nil {
+		return err
+	}
+	unc, err := parseShare(share, d.Server)
+	if err != nil {
+		return err
+	}
+
+	volume := d.blankVolume(id)
+	exists, err := util.ObjectExists(volume)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Volume %v already exists", id)
+	}
+	volume.Share = unc
+	volume.CreatedTime = util.Now()
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	volume.ReadOnly = opts[OPT_READ_ONLY] == "true"
+	return util.ObjectSave(volume)
+}
+
+// DeleteVolume only removes the reference of volume, since the share is
+// managed on the server and may be used by others
+func (d *Driver) DeleteVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if volume.MountPoint != "" {
+		return fmt.Errorf("Cannot delete volume %v. It is still mounted", req.Name)
+	}
+	return util.ObjectDelete(volume)
+}
+
+func (d *Driver) MountVolume(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	opts := req.Options
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+
+	ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	readOnly := volume.ReadOnly || opts[OPT_READ_ONLY] == "true"
+	if err := util.CheckMountMode(id, volume.MountPoint, volume.MountedReadOnly, readOnly); err != nil {
+		return "", err
+	}
+	volume.MountedReadOnly = readOnly
+
+	mountPoint, err := util.VolumeMountWithContext(ctx, volume, opts[OPT_MOUNT_POINT], false)
+	if err != nil {
+		return "", err
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+func (d *Driver) UmountVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeUmountWithContext(req.Context(), volume); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) ForceUmountVolume(req Request) error {
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeForceUmount(req.Context(), volume, req.Options[OPT_KILL] == "true"); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) MountPoint(req Request) (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	return volume.MountPoint, nil
+}
+
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	mountPoint, err := util.VolumeMountRefresh(volume)
+	if err != nil {
+		return "", err
+	}
+	if mountPoint == "" {
+		volume.MountedReadOnly = false
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, id := range volumeIDs {
+		volume := d.blankVolume(id)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, MOUNTS_DIR), mountPoints)
+}
+
+func (d *Driver) ListVolume(opts map[string]string) (map[string]map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]string{}
+	for _, id := range volumeIDs {
+		result[id], err = d.getVolumeInfo(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.getVolumeInfo(id)
+}
+
+func (d *Driver) getVolumeInfo(id string) (map[string]string, error) {
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		OPT_VOLUME_NAME:         volume.Name,
+		"Share":                 volume.Share,
+		OPT_MOUNT_POINT:         volume.MountPoint,
+		OPT_VOLUME_CREATED_TIME: volume.CreatedTime,
+		OPT_MOUNT_OPTIONS:       volume.MountOptions,
+		OPT_READ_ONLY:           strconv.FormatBool(volume.ReadOnly),
+		"MountedReadOnly":       strconv.FormatBool(volume.MountedReadOnly),
+	}, nil
+}
+
+func (d *Driver) ResizeVolume(req Request) error {
+	return fmt.Errorf("Doesn't support resize volume")
+}
+
+func (d *Driver) SnapshotOps() (SnapshotOperations, error) {
+	return nil, fmt.Errorf("Doesn't support snapshot operations")
+}
+
+func (d *Driver) BackupOps() (BackupOperations, error) {
+	return nil, fmt.Errorf("Doesn't support backup operations")
+}
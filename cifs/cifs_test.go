@@ -0,0 +1,142 @@
+package cifs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	root string
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.root, err = ioutil.TempDir("", "convoy-cifs")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	c.Assert(os.RemoveAll(s.root), IsNil)
+}
+
+func (s *TestSuite) TestParseShare(c *C) {
+	for share, expected := range map[string]string{
+		"//netapp1/projects":         "//netapp1/projects",
+		"//netapp1/projects/vol1/":   "//netapp1/projects/vol1",
+		`\\netapp1\projects\vol1`:    "//netapp1/projects/vol1",
+		"projects/vol1":              "//filer/projects/vol1",
+		"/projects//vol1":            "//filer/projects/vol1",
+		"//10.0.0.5/projects/./vol1": "//10.0.0.5/projects/vol1",
+	} {
+		unc, err := parseShare(share, "filer")
+		c.Assert(err, IsNil)
+		c.Assert(unc, Equals, expected)
+	}
+
+	_, err := parseShare("projects/vol1", "")
+	c.Assert(err, ErrorMatches, "Invalid share projects/vol1, must be like //server/share/path since cifs.server is not specified")
+	for _, share := range []string{"//netapp1", "//netapp1/", "///projects", "//netapp1/projects/../other"} {
+		_, err = parseShare(share, "filer")
+		c.Assert(err, NotNil, Commentf("share %v", share))
+	}
+}
+
+func (s *TestSuite) TestMountOptions(c *C) {
+	volume := &Volume{
+		MountOptions:        "uid=1000,gid=1000",
+		credentialsFile:     "/etc/convoy/cifs.cred",
+		defaultMountOptions: "vers=3.0",
+	}
+	c.Assert(volume.GetMountOpts(), DeepEquals, []string{"-t", "cifs", "-o",
+		"credentials=/etc/convoy/cifs.cred,vers=3.0,uid=1000,gid=1000"})
+
+	volume.MountedReadOnly = true
+	c.Assert(volume.GetMountOpts(), DeepEquals, []string{"-t", "cifs", "-o",
+		"credentials=/etc/convoy/cifs.cred,vers=3.0,uid=1000,gid=1000,ro"})
+
+	// Credentials of volume take place of the ones of driver
+	volume = &Volume{
+		MountOptions:    "credentials=/etc/convoy/vol1.cred",
+		credentialsFile: "/etc/convoy/cifs.cred",
+	}
+	c.Assert(volume.GetMountOpts(), DeepEquals, []string{"-t", "cifs", "-o", "credentials=/etc/convoy/vol1.cred"})
+
+	c.Assert((&Volume{}).GetMountOpts(), DeepEquals, []string{"-t", "cifs"})
+
+	c.Assert(checkMountOptions("vers=3.0,username=convoy"), IsNil)
+	c.Assert(checkMountOptions("username=convoy,password=secret"), ErrorMatches, "Password cannot be specified in mount options.*")
+}
+
+func (s *TestSuite) TestInit(c *C) {
+	root := filepath.Join(s.root, "root")
+	_, err := Init(root, map[string]string{CIFS_CREDENTIALS: "cifs.cred"})
+	c.Assert(err, ErrorMatches, "Invalid cifs.credentials cifs.cred, must be an absolute path")
+	credentials := filepath.Join(s.root, "cifs.cred")
+	_, err = Init(root, map[string]string{CIFS_CREDENTIALS: credentials})
+	c.Assert(err, ErrorMatches, "Cannot read credentials file.*")
+	_, err = Init(root, map[string]string{CIFS_DEFAULT_MOUNT_OPTIONS: "pass=secret"})
+	c.Assert(err, ErrorMatches, "Password cannot be specified in mount options.*")
+
+	c.Assert(ioutil.WriteFile(credentials, []byte("username=convoy\npassword=secret\n"), 0600), IsNil)
+	driver, err := Init(root, map[string]string{
+		CIFS_SERVER:                "filer",
+		CIFS_CREDENTIALS:           credentials,
+		CIFS_DEFAULT_MOUNT_OPTIONS: "vers=3.0",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(driver.(*Driver).CheckHealth(), DeepEquals, []HealthCheck{{Name: "credentials"}})
+
+	// Options are kept unless they're specified again
+	driver, err = Init(root, map[string]string{CIFS_DEFAULT_MOUNT_OPTIONS: ""})
+	c.Assert(err, IsNil)
+	info, err := driver.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info["Server"], Equals, "filer")
+	c.Assert(info["CredentialsFile"], Equals, credentials)
+	c.Assert(info["DefaultMountOptions"], Equals, "")
+}
+
+func (s *TestSuite) TestCreateVolume(c *C) {
+	driver, err := Init(filepath.Join(s.root, "root"), map[string]string{CIFS_SERVER: "filer"})
+	c.Assert(err, IsNil)
+	d := driver.(*Driver)
+
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{}}), ErrorMatches,
+		"Share of volume is required by cifs, specify it by --id")
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{
+		OPT_VOLUME_DRIVER_ID: "projects/vol1",
+		OPT_MOUNT_OPTIONS:    "password=secret",
+	}}), ErrorMatches, "Password cannot be specified in mount options.*")
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{
+		OPT_VOLUME_DRIVER_ID: "projects/vol1",
+		OPT_MOUNT_OPTIONS:    "uid=1000",
+		OPT_READ_ONLY:        "true",
+	}}), IsNil)
+	c.Assert(d.ImportVolume(Request{Name: "vol1", Options: map[string]string{
+		OPT_IMPORT_SOURCE: "//netapp1/legacy",
+	}}), ErrorMatches, "Volume vol1 already exists")
+	c.Assert(d.ImportVolume(Request{Name: "vol2", Options: map[string]string{
+		OPT_IMPORT_SOURCE: "//netapp1/legacy",
+	}}), IsNil)
+
+	volumes, err := d.ListVolume(map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(volumes, HasLen, 2)
+	c.Assert(volumes["vol1"]["Share"], Equals, "//filer/projects/vol1")
+	c.Assert(volumes["vol1"][OPT_MOUNT_OPTIONS], Equals, "uid=1000")
+	c.Assert(volumes["vol1"][OPT_READ_ONLY], Equals, "true")
+	c.Assert(volumes["vol2"]["Share"], Equals, "//netapp1/legacy")
+
+	c.Assert(d.DeleteVolume(Request{Name: "vol1", Options: map[string]string{}}), IsNil)
+	_, err = d.GetVolumeInfo("vol1")
+	c.Assert(err, NotNil)
+}
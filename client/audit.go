@@ -0,0 +1,63 @@
+package client
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+var (
+	auditListCmd = cli.Command{
+		Name:  "list",
+		Usage: "list audit records of mutating requests: list [--since <time>]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "since",
+				Usage: "only list records since the time, either in RFC3339 format e.g. 2016-01-02T15:04:05Z, or a duration ago e.g. 24h",
+			},
+		},
+		Action: cmdAuditList,
+	}
+
+	auditCmd = cli.Command{
+		Name:  "audit",
+		Usage: "audit log related operations",
+		Subcommands: []cli.Command{
+			auditListCmd,
+		},
+	}
+)
+
+// parseSince accepts either absolute time or duration relative to now
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, usageError{fmt.Errorf("Invalid time %v, must be in RFC3339 format or a duration", value)}
+	}
+	return t, nil
+}
+
+func cmdAuditList(c *cli.Context) {
+	if err := doAuditList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doAuditList(c *cli.Context) error {
+	v := url.Values{}
+	if value := c.String("since"); value != "" {
+		since, err := parseSince(value, time.Now())
+		if err != nil {
+			return err
+		}
+		v.Set("since", since.UTC().Format(time.RFC3339Nano))
+	}
+
+	url := "/audit/list?" + v.Encode()
+	return sendRequestAndPrint("GET", url, nil)
+}
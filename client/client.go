@@ -1,12 +1,14 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -18,7 +20,10 @@ import (
 type convoyClient struct {
 	addr      string
 	scheme    string
+	token     string
 	transport *http.Transport
+	// Limit of each request, none if zero
+	timeout time.Duration
 }
 
 var (
@@ -47,7 +52,7 @@ func (c *convoyClient) call(method, path string, data interface{}, headers map[s
 }
 
 func (c *convoyClient) httpClient() *http.Client {
-	return &http.Client{Transport: c.transport}
+	return &http.Client{Transport: c.transport, Timeout: c.timeout}
 }
 
 func getRequestPath(path string) string {
@@ -60,6 +65,9 @@ func (c *convoyClient) clientRequest(method, path string, in io.Reader, headers
 		return nil, "", -1, err
 	}
 	req.Header.Set("User-Agent", "Convoy-Client/"+api.API_VERSION)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
 	req.URL.Host = c.addr
 	req.URL.Scheme = c.scheme
 
@@ -79,9 +87,43 @@ func (c *convoyClient) clientRequest(method, path string, in io.Reader, headers
 		if len(body) == 0 {
 			return nil, "", statusCode, fmt.Errorf("Incompatable version")
 		}
-		return nil, "", statusCode, fmt.Errorf("Error response from server, %v", string(body))
+		return nil, "", statusCode, responseError(body, resp.Header.Get(api.REQUEST_ID_HEADER))
+	}
+	return &responseBody{resp}, resp.Header.Get("Context-Type"), statusCode, nil
+}
+
+// responseError returns the error responded by daemon, which wraps the
+// api.Error unless the daemon is too old to respond one. The ID of request is
+// added to the details, so the logs of daemon for it can be found.
+func responseError(body []byte, requestID string) error {
+	apiErr := &api.Error{}
+	if err := json.Unmarshal(body, apiErr); err == nil && apiErr.Code != "" {
+		if requestID != "" {
+			apiErr.WithDetail("request_id", requestID)
+		}
+		return fmt.Errorf("Error response from server, %w", apiErr)
+	}
+	return fmt.Errorf("Error response from server, %v", string(body))
+}
+
+// responseBody fails at the end of a streamed response, if the daemon
+// reported a failure by trailer after the response was started
+type responseBody struct {
+	*http.Response
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	n, err := b.Body.Read(p)
+	if err == io.EOF {
+		if message := b.Trailer.Get(api.ERROR_TRAILER); message != "" {
+			return n, fmt.Errorf("Error response from server, %v", message)
+		}
 	}
-	return resp.Body, resp.Header.Get("Context-Type"), statusCode, nil
+	return n, err
+}
+
+func (b *responseBody) Close() error {
+	return b.Body.Close()
 }
 
 func sendRequest(method, request string, data interface{}) (io.ReadCloser, error) {
@@ -107,12 +149,11 @@ func sendRequestAndPrint(method, request string, data interface{}) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(b))
-	return nil
+	return printOutput(b)
 }
 
 func cmdNotFound(c *cli.Context, command string) {
-	panic(fmt.Errorf("Unrecognized command: %s", command))
+	panic(usageError{fmt.Errorf("Unrecognized command: %s", command)})
 }
 
 // NewCli would generate Convoy CLI
@@ -128,6 +169,26 @@ func NewCli(version string) *cli.App {
 			Value: "/var/run/convoy/convoy.sock",
 			Usage: "Specify unix domain socket for communication between server and client",
 		},
+		cli.StringFlag{
+			Name:  "host",
+			Usage: "Specify TCP address of daemon in host:port format, instead of unix domain socket",
+		},
+		cli.StringFlag{
+			Name:  "tlscacert",
+			Usage: "Verify certificate of daemon with the CA certificates in the file, implies TLS",
+		},
+		cli.StringFlag{
+			Name:  "tlscert",
+			Usage: "Client certificate used to authenticate with daemon, implies TLS",
+		},
+		cli.StringFlag{
+			Name:  "tlskey",
+			Usage: "Client key used to authenticate with daemon, implies TLS",
+		},
+		cli.StringFlag{
+			Name:  "auth-token-file",
+			Usage: "File contains the bearer token used to authenticate with daemon",
+		},
 		cli.BoolFlag{
 			Name:  "debug, d",
 			Usage: "Enable debug level log with client or not",
@@ -136,20 +197,43 @@ func NewCli(version string) *cli.App {
 			Name:  "verbose",
 			Usage: "Verbose level output for client, for create volume/snapshot etc",
 		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "Output format: json, table, or a Go template like '{{.Name}}'. Implies --verbose. Print the response as it is if not specified",
+		},
 	}
 	app.CommandNotFound = cmdNotFound
 	app.Before = initClient
 	app.Commands = []cli.Command{
 		daemonCmd,
 		infoCmd,
+		healthCmd,
+		doctorCmd,
+		rescanCmd,
 		volumeCreateCmd,
+		volumeImportCmd,
+		volumeCloneCmd,
+		volumeMigrateCmd,
+		volumeExportCmd,
 		volumeDeleteCmd,
 		volumeMountCmd,
 		volumeUmountCmd,
+		volumeResizeCmd,
 		volumeListCmd,
 		volumeInspectCmd,
+		volumeStatsCmd,
+		volumeCmd,
 		snapshotCmd,
 		backupCmd,
+		objectStoreCmd,
+		policyCmd,
+		scheduleCmd,
+		trashCmd,
+		jobCmd,
+		topCmd,
+		eventsCmd,
+		auditCmd,
+		completionCmd,
 	}
 	return app
 }
@@ -164,14 +248,53 @@ func initClient(c *cli.Context) error {
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-	client.addr = sockFile
+	if err := initOutputFormat(c.GlobalString(formatFlag)); err != nil {
+		return err
+	}
+	host := c.GlobalString("host")
+	if host == "" {
+		client.addr = sockFile
+		client.scheme = "http"
+		client.transport = &http.Transport{
+			DisableCompression: true,
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.DialTimeout("unix", sockFile, 10*time.Second)
+			},
+		}
+		return nil
+	}
+	return initTCPClient(c, strings.TrimPrefix(host, "tcp://"))
+}
+
+func initTCPClient(c *cli.Context, host string) error {
+	client.addr = host
 	client.scheme = "http"
 	client.transport = &http.Transport{
 		DisableCompression: true,
-		Dial: func(_, _ string) (net.Conn, error) {
-			return net.DialTimeout("unix", sockFile, 10*time.Second)
+		Dial: func(_, addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, 10*time.Second)
 		},
 	}
+
+	caFile := c.GlobalString("tlscacert")
+	certFile := c.GlobalString("tlscert")
+	keyFile := c.GlobalString("tlskey")
+	if caFile != "" || certFile != "" || keyFile != "" {
+		tlsConfig, err := util.NewClientTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		client.scheme = "https"
+		client.transport.TLSClientConfig = tlsConfig
+	}
+
+	if tokenFile := c.GlobalString("auth-token-file"); tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		client.token = strings.TrimSpace(string(data))
+	}
 	return nil
 }
 
@@ -0,0 +1,422 @@
+package client
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+)
+
+const (
+	// Hidden mode of completion command called by the completion scripts
+	COMPLETE_ARG = "__complete"
+
+	// Completion must not hang the shell if the daemon is unresponsive
+	COMPLETION_TIMEOUT = 3 * time.Second
+
+	COMPLETE_VOLUME   = "volume"
+	COMPLETE_SNAPSHOT = "snapshot"
+	COMPLETE_BACKUP   = "backup"
+)
+
+var (
+	completionCmd = cli.Command{
+		Name:  "completion",
+		Usage: "generate script for shell completion of commands, flags and names of volumes, snapshots and backups: completion bash|zsh|fish",
+		// Words to complete are passed as they're typed
+		SkipFlagParsing: true,
+		Action:          cmdCompletion,
+	}
+
+	// Names completed for arguments of commands, the last one is completed
+	// for the rest arguments of the commands taking multiple names
+	completionArgs = map[string][]string{
+		"delete":                 {COMPLETE_VOLUME},
+		"mount":                  {COMPLETE_VOLUME},
+		"umount":                 {COMPLETE_VOLUME},
+		"resize":                 {COMPLETE_VOLUME},
+		"inspect":                {COMPLETE_VOLUME},
+		"stats":                  {COMPLETE_VOLUME},
+		"clone":                  {COMPLETE_VOLUME},
+		"migrate":                {COMPLETE_VOLUME},
+		"export":                 {COMPLETE_VOLUME},
+		"volume backups":         {COMPLETE_VOLUME},
+		"volume refresh":         {COMPLETE_VOLUME},
+		"volume retention":       {COMPLETE_VOLUME},
+		"volume force-umount":    {COMPLETE_VOLUME},
+		"volume fence":           {COMPLETE_VOLUME},
+		"volume unfence":         {COMPLETE_VOLUME},
+		"snapshot create":        {COMPLETE_VOLUME},
+		"snapshot delete":        {COMPLETE_SNAPSHOT},
+		"snapshot inspect":       {COMPLETE_SNAPSHOT},
+		"snapshot diff":          {COMPLETE_SNAPSHOT, COMPLETE_SNAPSHOT},
+		"backup create":          {COMPLETE_SNAPSHOT},
+		"backup now":             {COMPLETE_VOLUME},
+		"backup delete":          {COMPLETE_BACKUP},
+		"backup inspect":         {COMPLETE_BACKUP},
+		"backup estimate":        {COMPLETE_BACKUP},
+		"backup copy":            {COMPLETE_BACKUP},
+		"backup archive":         {COMPLETE_BACKUP},
+		"backup restore-archive": {COMPLETE_BACKUP},
+		"backup restore-file":    {COMPLETE_BACKUP},
+	}
+	completionVariadic = map[string]bool{
+		"delete": true,
+	}
+
+	// Names completed for values of flags
+	completionFlags = map[string]string{
+		"volume":      COMPLETE_VOLUME,
+		"volume-name": COMPLETE_VOLUME,
+		"snapshot":    COMPLETE_SNAPSHOT,
+		"backup":      COMPLETE_BACKUP,
+	}
+
+	completionScripts = map[string]string{
+		"bash": bashCompletion,
+		"zsh":  zshCompletion,
+		"fish": fishCompletion,
+	}
+)
+
+const bashCompletion = `# bash completion for convoy, load it by
+#   source <(convoy completion bash)
+_convoy() {
+    local line="${COMP_LINE:0:COMP_POINT}"
+    local -a words
+    # Escapes in the words are removed by read
+    read -a words <<< "$line"
+    local cur=""
+    if [[ "$line" != *[[:space:]] && ${#words[@]} -gt 1 ]]; then
+        cur="${words[${#words[@]}-1]}"
+        unset 'words[${#words[@]}-1]'
+    fi
+    # Readline only replaces the part of the word after ':' or '='
+    local part="${COMP_WORDS[COMP_CWORD]//\\/}"
+    local prefix="${cur%"$part"}"
+    local IFS=$'\n'
+    local -a candidates
+    candidates=($("${words[0]}" completion __complete "${words[@]:1}" "$cur" 2>/dev/null))
+    COMPREPLY=()
+    local c
+    for c in "${candidates[@]}"; do
+        c="${c#"$prefix"}"
+        if [[ "$cur" != [\"\']* ]]; then
+            c="$(printf '%q' "$c")"
+        fi
+        COMPREPLY+=("$c")
+    done
+}
+complete -o default -F _convoy convoy
+`
+
+const zshCompletion = `#compdef convoy
+# zsh completion for convoy, load it by
+#   source <(convoy completion zsh)
+_convoy() {
+    local -a candidates
+    candidates=("${(@f)$(${words[1]} completion __complete "${(@Q)words[2,CURRENT-1]}" "${(Q)words[CURRENT]}" 2>/dev/null)}")
+    if [[ -n "${candidates[1]}" ]]; then
+        compadd -- "${candidates[@]}"
+    else
+        _files
+    fi
+}
+compdef _convoy convoy
+`
+
+const fishCompletion = `# fish completion for convoy, load it by
+#   convoy completion fish | source
+function __convoy_complete
+    set -l tokens (commandline -opc)
+    $tokens[1] completion __complete $tokens[2..-1] (commandline -ct) 2>/dev/null
+end
+complete -c convoy -f -a '(__convoy_complete)'
+`
+
+func cmdCompletion(c *cli.Context) {
+	if err := doCompletion(c); err != nil {
+		panic(err)
+	}
+}
+
+func doCompletion(c *cli.Context) error {
+	args := c.Args()
+	if len(args) == 0 {
+		return usageError{fmt.Errorf("Require shell, must be bash, zsh or fish")}
+	}
+	if args[0] == COMPLETE_ARG {
+		// Nothing is completed rather than messing up the shell on errors
+		for _, candidate := range complete(c.App, args[1:]) {
+			fmt.Println(candidate)
+		}
+		return nil
+	}
+	script, exists := completionScripts[args[0]]
+	if !exists {
+		return usageError{fmt.Errorf("Invalid shell %v, must be bash, zsh or fish", args[0])}
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// completionState is the command line parsed up to the word to complete
+type completionState struct {
+	app *cli.App
+	// Names of the command and its subcommands, and the positional
+	// arguments of it
+	path []string
+	args []string
+	// Flags and subcommands of the command, or of the app if no command
+	flags    []cli.Flag
+	commands []cli.Command
+	// Global flags and their values before the command
+	globalArgs []string
+	// Flag of which the word to complete is the value
+	valueFlag string
+}
+
+func flagNames(f cli.Flag) []string {
+	names := []string{}
+	for _, name := range strings.Split(f.GetName(), ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
+
+func lookupFlag(flags []cli.Flag, name string) cli.Flag {
+	for _, f := range flags {
+		for _, n := range flagNames(f) {
+			if n == name {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+func flagTakesValue(f cli.Flag) bool {
+	switch f.(type) {
+	case cli.BoolFlag, cli.BoolTFlag:
+		return false
+	}
+	return true
+}
+
+func lookupCommand(commands []cli.Command, name string) *cli.Command {
+	for i := range commands {
+		if commands[i].HasName(name) {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func parseCompletionWords(app *cli.App, words []string) *completionState {
+	s := &completionState{
+		app:      app,
+		flags:    app.Flags,
+		commands: app.Commands,
+	}
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if strings.HasPrefix(word, "-") && len(word) > 1 {
+			if s.path == nil {
+				s.globalArgs = append(s.globalArgs, word)
+			}
+			if strings.Contains(word, "=") {
+				continue
+			}
+			f := lookupFlag(s.flags, strings.TrimLeft(word, "-"))
+			if f == nil || !flagTakesValue(f) {
+				continue
+			}
+			if i+1 == len(words) {
+				s.valueFlag = flagNames(f)[0]
+				continue
+			}
+			i++
+			if s.path == nil {
+				s.globalArgs = append(s.globalArgs, words[i])
+			}
+			continue
+		}
+		if len(s.args) == 0 {
+			if cmd := lookupCommand(s.commands, word); cmd != nil {
+				s.path = append(s.path, cmd.Name)
+				s.flags = cmd.Flags
+				s.commands = cmd.Subcommands
+				continue
+			}
+		}
+		s.args = append(s.args, word)
+	}
+	return s
+}
+
+// complete returns the candidates for the last word of words, which are the
+// arguments of the command line
+func complete(app *cli.App, words []string) []string {
+	if len(words) == 0 {
+		return nil
+	}
+	cur := words[len(words)-1]
+	s := parseCompletionWords(app, words[:len(words)-1])
+
+	candidates := []string{}
+	switch {
+	case s.valueFlag != "":
+		candidates = s.completeFlagValue(s.valueFlag, cur)
+	case strings.HasPrefix(cur, "-"):
+		if i := strings.Index(cur, "="); i != -1 {
+			f := lookupFlag(s.flags, strings.TrimLeft(cur[:i], "-"))
+			if f == nil {
+				break
+			}
+			for _, value := range s.completeFlagValue(flagNames(f)[0], cur[i+1:]) {
+				candidates = append(candidates, cur[:i+1]+value)
+			}
+			break
+		}
+		for _, f := range s.flags {
+			for _, name := range flagNames(f) {
+				if len(name) == 1 {
+					candidates = append(candidates, "-"+name)
+				} else {
+					candidates = append(candidates, "--"+name)
+				}
+			}
+		}
+	case len(s.commands) != 0 && len(s.args) == 0:
+		for _, cmd := range s.commands {
+			candidates = append(candidates, cmd.Name)
+		}
+	default:
+		path := strings.Join(s.path, " ")
+		kinds := completionArgs[path]
+		index := len(s.args)
+		if index >= len(kinds) && completionVariadic[path] {
+			index = len(kinds) - 1
+		}
+		if index < len(kinds) {
+			candidates = s.completeName(kinds[index], cur)
+		}
+	}
+	return filterCandidates(candidates, cur)
+}
+
+func filterCandidates(candidates []string, prefix string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, candidate := range candidates {
+		if !strings.HasPrefix(candidate, prefix) || seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+		result = append(result, candidate)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s *completionState) completeFlagValue(name, cur string) []string {
+	kind, exists := completionFlags[name]
+	if !exists {
+		return nil
+	}
+	return s.completeName(kind, cur)
+}
+
+// completeName returns the names of kind known to the daemon. Backups are
+// only completed once the destination is typed, since there can be too
+// many of them to list for all destinations.
+func (s *completionState) completeName(kind, cur string) []string {
+	if err := s.initClient(); err != nil {
+		log.Debugf("Cannot connect to daemon for completion: %v", err)
+		return nil
+	}
+	var (
+		names []string
+		err   error
+	)
+	switch kind {
+	case COMPLETE_VOLUME, COMPLETE_SNAPSHOT:
+		names, err = listCompletionNames(kind == COMPLETE_SNAPSHOT)
+	case COMPLETE_BACKUP:
+		if !strings.Contains(cur, "://") {
+			return nil
+		}
+		names, err = listCompletionBackups(strings.SplitN(cur, "?", 2)[0])
+	}
+	if err != nil {
+		log.Debugf("Cannot list %v names for completion: %v", kind, err)
+		return nil
+	}
+	return names
+}
+
+// initClient connects to the daemon by the global flags on the command line
+// being completed, rather than the ones of the completion command
+func (s *completionState) initClient() error {
+	set := flag.NewFlagSet(s.app.Name, flag.ContinueOnError)
+	set.SetOutput(ioutil.Discard)
+	for _, f := range s.app.Flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(s.globalArgs); err != nil {
+		return err
+	}
+	if err := initClient(cli.NewContext(s.app, set, nil)); err != nil {
+		return err
+	}
+	client.timeout = COMPLETION_TIMEOUT
+	return nil
+}
+
+func listCompletionNames(snapshots bool) ([]string, error) {
+	rc, err := sendRequest("GET", "/volumes/list", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	volumes := map[string]api.VolumeResponse{}
+	if err := json.NewDecoder(rc).Decode(&volumes); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name, volume := range volumes {
+		if !snapshots {
+			names = append(names, name)
+			continue
+		}
+		for snapshotName := range volume.Snapshots {
+			names = append(names, snapshotName)
+		}
+	}
+	return names, nil
+}
+
+func listCompletionBackups(destURL string) ([]string, error) {
+	rc, err := sendRequest("GET", "/backups/list", &api.BackupListRequest{
+		URL: destURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	backups := map[string]json.RawMessage{}
+	if err := json.NewDecoder(rc).Decode(&backups); err != nil {
+		return nil, err
+	}
+	urls := []string{}
+	for backupURL := range backups {
+		urls = append(urls, backupURL)
+	}
+	return urls, nil
+}
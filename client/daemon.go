@@ -1,12 +1,13 @@
 package client
 
 import (
-	"fmt"
 	"io/ioutil"
 
 	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
 	"github.com/rancher/convoy/client/flags"
 	"github.com/rancher/convoy/daemon"
+	"github.com/rancher/convoy/util"
 )
 
 var (
@@ -15,6 +16,32 @@ var (
 		Usage:  "start convoy daemon",
 		Flags:  flags.DaemonFlags,
 		Action: cmdStartDaemon,
+		Subcommands: []cli.Command{
+			daemonSetLogLevelCmd,
+			daemonGetLogLevelCmd,
+		},
+	}
+
+	daemonSetLogLevelCmd = cli.Command{
+		Name:  "set-log-level",
+		Usage: "set log level of the running daemon, or of one of its packages, until it restarts or reloads config file: set-log-level [--pkg <package>] --level <level>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "pkg",
+				Usage: "package to set the level of, i.e. the \"pkg\" field of logs, e.g. objectstore. The global level is set if not specified",
+			},
+			cli.StringFlag{
+				Name:  "level",
+				Usage: "log level, can be debug, info, warning, error, fatal or panic, or \"default\" to make the package use the global level again",
+			},
+		},
+		Action: cmdDaemonSetLogLevel,
+	}
+
+	daemonGetLogLevelCmd = cli.Command{
+		Name:   "get-log-level",
+		Usage:  "show log level of the running daemon, and the levels of packages overriding it",
+		Action: cmdDaemonGetLogLevel,
 	}
 
 	infoCmd = cli.Command{
@@ -22,6 +49,24 @@ var (
 		Usage:  "information about convoy",
 		Action: cmdInfo,
 	}
+
+	healthCmd = cli.Command{
+		Name:   "health",
+		Usage:  "check health of convoy daemon, drivers and backup destinations",
+		Action: cmdHealth,
+	}
+
+	doctorCmd = cli.Command{
+		Name:   "doctor",
+		Usage:  "correct mount points of volumes with the host, and umount orphan mounts",
+		Action: cmdDoctor,
+	}
+
+	rescanCmd = cli.Command{
+		Name:   "rescan",
+		Usage:  "rebuild indexes of volumes and snapshots from the drivers",
+		Action: cmdRescan,
+	}
 )
 
 func cmdInfo(c *cli.Context) {
@@ -41,16 +86,80 @@ func doInfo(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(b))
-	return nil
+	return printOutput(b)
+}
+
+func cmdHealth(c *cli.Context) {
+	if err := doHealth(c); err != nil {
+		panic(err)
+	}
+}
+
+func doHealth(c *cli.Context) error {
+	return sendRequestAndPrint("GET", "/health", nil)
+}
+
+func cmdDoctor(c *cli.Context) {
+	if err := doDoctor(c); err != nil {
+		panic(err)
+	}
+}
+
+func doDoctor(c *cli.Context) error {
+	return sendRequestAndPrint("POST", "/doctor", nil)
+}
+
+func cmdRescan(c *cli.Context) {
+	if err := doRescan(c); err != nil {
+		panic(err)
+	}
+}
+
+func doRescan(c *cli.Context) error {
+	return sendRequestAndPrint("POST", "/rescan", nil)
 }
 
 func cmdStartDaemon(c *cli.Context) {
+	// cli only checks --help of commands with subcommands among the global
+	// flags, which would start the daemon instead
+	if c.Bool("help") {
+		cli.ShowSubcommandHelp(c)
+		return
+	}
 	if err := startDaemon(c); err != nil {
 		panic(err)
 	}
 }
 
+func cmdDaemonSetLogLevel(c *cli.Context) {
+	if err := doDaemonSetLogLevel(c); err != nil {
+		panic(err)
+	}
+}
+
+func doDaemonSetLogLevel(c *cli.Context) error {
+	var err error
+	level, err := util.GetFlag(c, "level", true, err)
+	if err != nil {
+		return err
+	}
+	request := &api.LogLevelRequest{
+		Package: c.String("pkg"),
+		Level:   level,
+	}
+	return sendRequestAndPrint("POST", "/log/level", request)
+}
+
+func cmdDaemonGetLogLevel(c *cli.Context) {
+	if err := doDaemonGetLogLevel(c); err != nil {
+		panic(err)
+	}
+}
+
+func doDaemonGetLogLevel(c *cli.Context) error {
+	return sendRequestAndPrint("GET", "/log/levels", nil)
+}
+
 func startDaemon(c *cli.Context) error {
-	return daemon.Start(client.addr, c)
+	return daemon.Start(c.GlobalString("socket"), c)
 }
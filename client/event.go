@@ -0,0 +1,103 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+)
+
+var (
+	eventsCmd = cli.Command{
+		Name:  "events",
+		Usage: "list the latest events of volumes, snapshots and backups, or follow them: events [--follow] [options]",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "follow, f",
+				Usage: "keep printing events as they happen until interrupted",
+			},
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "only show events of the volume",
+			},
+			cli.StringSliceFlag{
+				Name:  "event",
+				Value: &cli.StringSlice{},
+				Usage: "only show events of the name, e.g. volume.create, can be specified multiple times",
+			},
+			cli.StringFlag{
+				Name:  "since",
+				Usage: "only show events after the event of the ID, e.g. the last one seen before reconnecting",
+			},
+		},
+		Action: cmdEvents,
+	}
+)
+
+func cmdEvents(c *cli.Context) {
+	if err := doEvents(c); err != nil {
+		panic(err)
+	}
+}
+
+func doEvents(c *cli.Context) error {
+	v := url.Values{}
+	if volumeName := c.String("volume"); volumeName != "" {
+		v.Set("volume", volumeName)
+	}
+	if events := c.StringSlice("event"); len(events) != 0 {
+		v.Set("event", strings.Join(events, ","))
+	}
+	if since := c.String("since"); since != "" {
+		if _, err := strconv.ParseInt(since, 10, 64); err != nil {
+			return usageError{fmt.Errorf("Invalid event ID %v", since)}
+		}
+		v.Set("since", since)
+	}
+	if !c.Bool("follow") {
+		return sendRequestAndPrint("GET", "/events?"+v.Encode(), nil)
+	}
+
+	v.Set(api.KEY_FOLLOW, "true")
+	rc, err := sendRequest("GET", "/events?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return readServerSentEvents(rc, func(data string) error {
+		return printOutput([]byte(data))
+	})
+}
+
+// readServerSentEvents calls f with the data of every event in r until the
+// stream ends. The data of event is the event in JSON, on a single line.
+func readServerSentEvents(r io.Reader, f func(data string) error) error {
+	reader := bufio.NewReader(r)
+	data := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if data != "" {
+				if err := f(data); err != nil {
+					return err
+				}
+			}
+			data = ""
+		case strings.HasPrefix(line, "data:"):
+			data = strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+}
@@ -2,6 +2,9 @@ package flags
 
 import (
 	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/logging"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
 )
 
 var (
@@ -14,6 +17,36 @@ var (
 			Name:  "log",
 			Usage: "specific output log file, otherwise output to stdout by default",
 		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Usage: "log level, can be debug, info, warning, error, fatal or panic. Debug by default",
+		},
+		cli.StringSliceFlag{
+			Name:  "log-package-levels",
+			Value: &cli.StringSlice{},
+			Usage: "log level of a package overriding --log-level, e.g. objectstore=info. The package is the \"pkg\" field of logs",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "log format, can be text or json. JSON for --log and text for stdout by default",
+		},
+		cli.StringFlag{
+			Name:  "log-max-size",
+			Usage: "rotate --log once it would grow beyond the size, e.g. 100M",
+		},
+		cli.StringFlag{
+			Name:  "log-max-age",
+			Usage: "rotate --log once it has been written for the duration, e.g. 24h",
+		},
+		cli.IntFlag{
+			Name:  "log-max-backups",
+			Value: logging.DEFAULT_LOG_MAX_BACKUPS,
+			Usage: "Number of rotated log files to keep, 0 keeps all of them",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "daemon configuration file in TOML, e.g. /etc/convoy/convoy.toml. Settings in it take precedence over command line options and the existing config, and some of them can be reloaded by SIGHUP",
+		},
 		cli.StringFlag{
 			Name:  "root",
 			Value: "/var/lib/rancher/convoy",
@@ -41,10 +74,120 @@ var (
 			Name:  "create-on-docker-mount",
 			Usage: "Create a volume if docker asks to do a mount and the volume doesn't exist.",
 		},
+		cli.BoolFlag{
+			Name:  "docker-volume-opts",
+			Usage: "Create volumes for Docker with the options of \"docker volume create --opt\", e.g. driver, size and backup. They're ignored by default",
+		},
 		cli.StringFlag{
 			Name:  "cmd-timeout",
 			Usage: "Set timeout value for executing each command. One minute (1m) by default and at least one minute.",
 		},
+		cli.IntFlag{
+			Name:  "cmd-retries",
+			Value: util.DEFAULT_CMD_RETRIES,
+			Usage: "Times to retry commands like mount, umount and mkfs failed by transient errors, e.g. device busy. Timed out commands are never retried",
+		},
+		cli.StringFlag{
+			Name:  "cmd-retry-backoff",
+			Value: util.DEFAULT_CMD_RETRY_BACKOFF.String(),
+			Usage: "Wait before the first retry of a command, doubled for every following retry",
+		},
+		cli.StringSliceFlag{
+			Name:  "cmd-retry-on",
+			Value: &cli.StringSlice{},
+			Usage: "Regular expression of errors worth retrying a command for, matched against the error and output of command. Replaces the default ones, e.g. \"device or resource busy\"",
+		},
+		cli.StringSliceFlag{
+			Name:  "cmd-timeouts",
+			Value: &cli.StringSlice{},
+			Usage: "Timeout of a specific command overriding --cmd-timeout, e.g. mount=30s",
+		},
+		cli.StringSliceFlag{
+			Name:  "operation-timeouts",
+			Value: &cli.StringSlice{},
+			Usage: "Timeout of a driver operation, after which the commands executed for it are killed, e.g. mount=2m. Operations are create, import, clone, delete, mount, umount, resize, snapshot_create and snapshot_delete",
+		},
+		cli.StringFlag{
+			Name:  "trash-grace-period",
+			Usage: "Move deleted volumes to trash and delete them after the duration, e.g. 72h, so they can be restored by \"convoy trash restore\" meanwhile. Volumes are deleted right away by default",
+		},
+		cli.BoolFlag{
+			Name:  "trash-backups",
+			Usage: "Move deleted backups to trash as well, requires --trash-grace-period",
+		},
+		cli.StringSliceFlag{
+			Name:  "objectstore-http",
+			Value: &cli.StringSlice{},
+			Usage: "HTTP option of S3 and GCS destinations, e.g. proxy=http://proxy:3128. Options are proxy, dial-timeout, response-timeout, max-idle-conns and keepalive, and can be overridden per destination, e.g. by --opt s3-proxy=<URL> of backup",
+		},
+		cli.StringFlag{
+			Name:  "driver-init-mode",
+			Value: "strict",
+			Usage: "Behavior when a driver fails to initialize. \"strict\" would abort daemon startup, \"besteffort\" would skip the failed driver and start with the others, unless it's the default driver, i.e. the first one",
+		},
+		cli.StringFlag{
+			Name:  "plugin-scope",
+			Value: "local",
+			Usage: "Scope of volumes reported to Docker. \"global\" tells Docker the volumes are available cluster wide, e.g. for EBS or NFS backed volumes",
+		},
+		cli.IntFlag{
+			Name:  "backup-concurrency",
+			Value: objectstore.DEFAULT_CONCURRENCY,
+			Usage: "Number of blocks to be uploaded or downloaded in parallel by backup and restore of Device Mapper volumes",
+		},
+		cli.BoolFlag{
+			Name:  "backup-shared-blocks",
+			Usage: "Store blocks of new backups of Device Mapper volumes in the block store shared by all volumes of the destination, so identical blocks of different volumes are stored once. Unused shared blocks are removed by \"convoy backup gc\"",
+		},
+		cli.StringFlag{
+			Name:  "backup-checksum",
+			Value: util.DEFAULT_CHECKSUM,
+			Usage: "Algorithm blocks of new backups of Device Mapper volumes are checksummed by, can be sha512, sha256, blake3 or xxh3. xxh3 is the fastest but not cryptographic, so it's only suitable for destinations written by trusted hosts",
+		},
+		cli.StringFlag{
+			Name:  "staging-dir",
+			Usage: "directory to stage archives of snapshots, backups and restores in, <root>/staging by default. Free space is checked before staging, and leftovers are removed on startup, so it must not be shared by other daemons",
+		},
+		cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "file to append audit log of all mutating API requests to, <root>/audit.log by default",
+		},
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "TCP address to serve the API on in addition to the unix socket, e.g. 0.0.0.0:9600. Requires --tlscacert or --auth-token-file",
+		},
+		cli.StringFlag{
+			Name:  "tlscacert",
+			Usage: "CA certificates to verify client certificates of TCP endpoint with",
+		},
+		cli.StringFlag{
+			Name:  "tlscert",
+			Usage: "TLS certificate of TCP endpoint",
+		},
+		cli.StringFlag{
+			Name:  "tlskey",
+			Usage: "TLS key of TCP endpoint",
+		},
+		cli.StringFlag{
+			Name:  "auth-token-file",
+			Usage: "file contains the bearer token required by TCP endpoint",
+		},
+		cli.StringFlag{
+			Name:  "csi-endpoint",
+			Usage: "unix socket to serve the CSI Identity, Controller and Node services on, e.g. unix:///var/run/convoy/csi.sock",
+		},
+		cli.StringFlag{
+			Name:  "metadata-store",
+			Usage: "Keep volume configs, policies and schedules in etcd://host:port/prefix (or etcds:// with ?cacert=&cert=&key= for TLS), so they can be shared by daemons on different hosts, bolt:///path, or file:// for files in root directory, instead of BoltDB metadata.db in root directory",
+		},
+		cli.StringFlag{
+			Name:  "cluster-host",
+			Usage: "Enable cluster mode with the name of this host, so volumes of all the hosts sharing --metadata-store are listed, and volumes not on shared storage cannot be mounted by two hosts at once",
+		},
+		cli.BoolFlag{
+			Name:  "rescan",
+			Usage: "Rebuild indexes of volumes and snapshots from the drivers on startup, dropping stale snapshots and moving aside corrupted volume configs, same as \"convoy rescan\"",
+		},
 		cli.BoolFlag{
 			Name:  "ignore-config-file",
 			Usage: "Avoid loading the existing config file when starting daemon, and use the command line options instead (not including driver options)",
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	JOB_WAIT_INTERVAL = time.Second
+)
+
+var (
+	asyncFlag = cli.BoolFlag{
+		Name:  "async",
+		Usage: "return a job immediately instead of waiting for the operation to complete, check the result by \"convoy job\"",
+	}
+
+	jobListCmd = cli.Command{
+		Name:   "list",
+		Usage:  "list running and recently finished jobs",
+		Action: cmdJobList,
+	}
+
+	jobInspectCmd = cli.Command{
+		Name:   "inspect",
+		Usage:  "inspect a job: job inspect <job>",
+		Action: cmdJobInspect,
+	}
+
+	jobWaitCmd = cli.Command{
+		Name:  "wait",
+		Usage: "wait for a job to finish and print the result: job wait <job>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "timeout",
+				Usage: "how long to wait before giving up, e.g. 30m. Wait forever if not specified",
+			},
+		},
+		Action: cmdJobWait,
+	}
+
+	jobCmd = cli.Command{
+		Name:  "job",
+		Usage: "asynchronous job related operations",
+		Subcommands: []cli.Command{
+			jobListCmd,
+			jobInspectCmd,
+			jobWaitCmd,
+		},
+	}
+)
+
+// requestURL asks the daemon to run the request as a job if --async is set
+func requestURL(c *cli.Context, path string) string {
+	if !c.Bool("async") {
+		return path
+	}
+	v := url.Values{}
+	v.Set(api.KEY_ASYNC, "true")
+	return path + "?" + v.Encode()
+}
+
+func cmdJobList(c *cli.Context) {
+	if err := doJobList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doJobList(c *cli.Context) error {
+	url := "/jobs"
+	return sendRequestAndPrint("GET", url, nil)
+}
+
+func cmdJobInspect(c *cli.Context) {
+	if err := doJobInspect(c); err != nil {
+		panic(err)
+	}
+}
+
+func doJobInspect(c *cli.Context) error {
+	var err error
+
+	jobID, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	url := "/jobs/" + jobID
+	return sendRequestAndPrint("GET", url, nil)
+}
+
+func cmdJobWait(c *cli.Context) {
+	if err := doJobWait(c); err != nil {
+		panic(err)
+	}
+}
+
+func getJob(jobID string) (*api.JobResponse, error) {
+	rc, err := sendRequest("GET", "/jobs/"+jobID, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	job := &api.JobResponse{}
+	if err := json.NewDecoder(rc).Decode(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func doJobWait(c *cli.Context) error {
+	var err error
+
+	jobID, err := util.GetFlag(c, "", true, err)
+	timeoutValue, err := util.GetFlag(c, "timeout", false, err)
+	if err != nil {
+		return err
+	}
+	var deadline time.Time
+	if timeoutValue != "" {
+		timeout, err := time.ParseDuration(timeoutValue)
+		if err != nil {
+			return err
+		}
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		job, err := getJob(jobID)
+		if err != nil {
+			return err
+		}
+		switch job.Status {
+		case api.JOB_STATUS_SUCCEEDED:
+			return printOutput([]byte(job.Result))
+		case api.JOB_STATUS_FAILED:
+			return fmt.Errorf("Job %v failed: %v", jobID, job.Error)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("Timeout waiting for job %v", jobID)
+		}
+		time.Sleep(JOB_WAIT_INTERVAL)
+	}
+}
@@ -1,27 +1,107 @@
 package client
 
 import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
 	"github.com/codegangsta/cli"
 	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
 	"github.com/rancher/convoy/util"
 )
 
 var (
+	encryptionKeyFileFlag = cli.StringFlag{
+		Name:  "encryption-key-file",
+		Usage: "file of 32 bytes key, in raw, hex or base64, to encrypt the backup with AES-256-GCM. The key is sent to the daemon and only kept in its memory, so it must be provided again to restore the backup after the daemon restarts. Support by objectstore backups",
+	}
+
+	encryptionKMSKeyIDFlag = cli.StringFlag{
+		Name:  "encryption-kms-key-id",
+		Usage: "ARN of AWS KMS key to generate the key to encrypt the backup with AES-256-GCM. The generated key is stored wrapped by the KMS key, and unwrapped by KMS to restore the backup. Support by objectstore backups",
+	}
+
+	compressionFlag = cli.StringFlag{
+		Name:  "compression",
+		Usage: "compression algorithm, can be gzip, zstd, lz4 or none. Default to the one of driver, or the one of snapshot for backup of vfs snapshot",
+	}
+
 	backupCreateCmd = cli.Command{
 		Name:  "create",
 		Usage: "create a backup in objectstore: create <snapshot>",
 		Flags: []cli.Flag{
 			cli.StringFlag{
 				Name:  "dest",
-				Usage: "destination of backup if driver supports, would be url like s3://bucket@region/path/ or vfs:///path/",
+				Usage: "destination of backup if driver supports, would be url like s3://bucket@region/path/, sftp://user@host/path/, vfs:///path/ or spool:///path/",
+			},
+			cli.IntFlag{
+				Name:  "retain",
+				Usage: "number of latest backups of the volume in destination to keep after backup, older ones would be deleted. 0 means keep all",
 			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "destination option in key=value format, can be specified multiple times. Supported options are s3-sse=<AES256|aws:kms> and s3-kms-key-id=<KMS key ID>",
+			},
+			encryptionKeyFileFlag,
+			encryptionKMSKeyIDFlag,
+			compressionFlag,
+			asyncFlag,
 		},
 		Action: cmdBackupCreate,
 	}
 
+	backupNowCmd = cli.Command{
+		Name:  "now",
+		Usage: "create a snapshot of volume and back it up in objectstore, the snapshot would be deleted if backup fails: now <volume>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "dest",
+				Usage: "destination of backup if driver supports, would be url like s3://bucket@region/path/, sftp://user@host/path/, vfs:///path/ or spool:///path/",
+			},
+			cli.StringFlag{
+				Name:  "name",
+				Usage: "name of snapshot, would be generated if not specified",
+			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Value: &cli.StringSlice{},
+				Usage: "label of snapshot in key=value format, can be specified multiple times",
+			},
+			cli.BoolFlag{
+				Name:  "delete-snapshot",
+				Usage: "delete the snapshot after backup. It's kept by default, so the next backup of volume can be incremental",
+			},
+			cli.IntFlag{
+				Name:  "retain",
+				Usage: "number of latest backups of the volume in destination to keep after backup, older ones would be deleted. 0 means keep all",
+			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "destination option in key=value format, can be specified multiple times. Supported options are s3-sse=<AES256|aws:kms> and s3-kms-key-id=<KMS key ID>",
+			},
+			encryptionKeyFileFlag,
+			encryptionKMSKeyIDFlag,
+			compressionFlag,
+			asyncFlag,
+		},
+		Action: cmdBackupNow,
+	}
+
 	backupDeleteCmd = cli.Command{
-		Name:   "delete",
-		Usage:  "delete a backup in objectstore: delete <backup>",
+		Name:  "delete",
+		Usage: "delete a backup in objectstore: delete <backup>",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "purge",
+				Usage: "delete the backup right away rather than moving it to trash, if trash of backups is enabled by daemon",
+			},
+			asyncFlag,
+		},
 		Action: cmdBackupDelete,
 	}
 
@@ -33,24 +113,174 @@ var (
 				Name:  "volume-name",
 				Usage: "name of volume",
 			},
+			cli.StringFlag{
+				Name:  "created-since",
+				Usage: "only list backups created since the time, either in RFC3339 format e.g. 2016-01-02T15:04:05Z, or a duration ago e.g. 24h",
+			},
+			cli.StringFlag{
+				Name:  "created-until",
+				Usage: "only list backups created before the time, either in RFC3339 format or a duration ago",
+			},
+			cli.IntFlag{
+				Name:  "limit",
+				Usage: "list at most the number of backups, 0 means no limit",
+			},
+			cli.StringFlag{
+				Name:  "marker",
+				Usage: "only list backups after the backup URL, which is the last one of previous page",
+			},
+			cli.BoolFlag{
+				Name:  "no-cache",
+				Usage: "read every backup config from the objectstore, rather than the ones cached by daemon",
+			},
 		},
 		Action: cmdBackupList,
 	}
 
+	backupCopyCmd = cli.Command{
+		Name:  "copy",
+		Usage: "copy a backup to another objectstore: copy <backup>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "dest",
+				Usage: "objectstore to copy the backup to, would be url like s3://bucket@region/path/, sftp://user@host/path/ or vfs:///path/",
+			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "destination option in key=value format, can be specified multiple times. Same as the ones of backup create",
+			},
+			asyncFlag,
+		},
+		Action: cmdBackupCopy,
+	}
+
+	backupArchiveCmd = cli.Command{
+		Name:  "archive",
+		Usage: "move data of a backup to another storage class of objectstore: archive <backup>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "storage-class",
+				Value: "GLACIER",
+				Usage: "storage class to move the backup to, e.g. STANDARD_IA, GLACIER or DEEP_ARCHIVE for S3. Backup in GLACIER or DEEP_ARCHIVE must be restored by restore-archive before being restored",
+			},
+			asyncFlag,
+		},
+		Action: cmdBackupArchive,
+	}
+
+	backupRestoreArchiveCmd = cli.Command{
+		Name:  "restore-archive",
+		Usage: "initiate the retrieval of an archived backup: restore-archive <backup>",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "days",
+				Value: objectstore.DEFAULT_ARCHIVE_RESTORE_DAYS,
+				Usage: "number of days to keep the retrieved copy",
+			},
+			cli.StringFlag{
+				Name:  "tier",
+				Usage: "retrieval tier, Standard, Bulk or Expedited for S3. Default to Standard",
+			},
+		},
+		Action: cmdBackupRestoreArchive,
+	}
+
+	backupRestoreFileCmd = cli.Command{
+		Name:  "restore-file",
+		Usage: "restore files or directories from a backup without restoring the volume: restore-file <backup> --path <path>",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "path",
+				Value: &cli.StringSlice{},
+				Usage: "path of file or directory relative to the root of volume, can be specified multiple times",
+			},
+			cli.StringFlag{
+				Name:  "to",
+				Value: ".",
+				Usage: "existing directory to restore the paths into, default to the current directory",
+			},
+			asyncFlag,
+		},
+		Action: cmdBackupRestoreFile,
+	}
+
 	backupInspectCmd = cli.Command{
 		Name:   "inspect",
 		Usage:  "inspect a backup: inspect <backup>",
 		Action: cmdBackupInspect,
 	}
 
+	backupEstimateCmd = cli.Command{
+		Name:  "estimate",
+		Usage: "estimate the size and duration of restoring a backup, and check whether it can be restored: estimate <backup>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "driver",
+				Usage: "driver to restore the backup by, other than default",
+			},
+			cli.StringFlag{
+				Name:  "encryption-key-file",
+				Usage: "file of key to decrypt the backup with, if it's not known by the daemon yet",
+			},
+		},
+		Action: cmdBackupEstimate,
+	}
+
+	backupGCCmd = cli.Command{
+		Name:  "gc",
+		Usage: "remove shared blocks no backup of the destination refers to: gc <dest>",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only count the blocks would be removed",
+			},
+			asyncFlag,
+		},
+		Action: cmdBackupGC,
+	}
+
+	objectStoreGCCmd = cli.Command{
+		Name:  "gc",
+		Usage: "remove objects left by failed backups in objectstore: gc <dest>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "min-age",
+				Value: "24h",
+				Usage: "only remove the objects not modified for the duration, in case they belong to backups being created",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only report the objects would be removed",
+			},
+			asyncFlag,
+		},
+		Action: cmdObjectStoreGC,
+	}
+
+	objectStoreCmd = cli.Command{
+		Name:  "objectstore",
+		Usage: "objectstore related operations",
+		Subcommands: []cli.Command{
+			objectStoreGCCmd,
+		},
+	}
+
 	backupCmd = cli.Command{
 		Name:  "backup",
 		Usage: "backup related operations",
 		Subcommands: []cli.Command{
 			backupCreateCmd,
+			backupNowCmd,
 			backupDeleteCmd,
 			backupListCmd,
 			backupInspectCmd,
+			backupEstimateCmd,
+			backupCopyCmd,
+			backupArchiveCmd,
+			backupRestoreArchiveCmd,
+			backupRestoreFileCmd,
+			backupGCCmd,
 		},
 	}
 )
@@ -73,6 +303,27 @@ func doBackupList(c *cli.Context) error {
 	request := &api.BackupListRequest{
 		URL:        destURL,
 		VolumeName: volumeName,
+		Limit:      c.Int("limit"),
+		Marker:     c.String("marker"),
+		NoCache:    c.Bool("no-cache"),
+	}
+	if request.Limit < 0 {
+		return usageError{fmt.Errorf("Invalid limit %v, must be a non-negative integer", request.Limit)}
+	}
+	now := time.Now()
+	if value := c.String("created-since"); value != "" {
+		since, err := parseSince(value, now)
+		if err != nil {
+			return err
+		}
+		request.CreatedSince = since.UTC().Format(time.RFC3339Nano)
+	}
+	if value := c.String("created-until"); value != "" {
+		until, err := parseSince(value, now)
+		if err != nil {
+			return err
+		}
+		request.CreatedUntil = until.UTC().Format(time.RFC3339Nano)
 	}
 	url := "/backups/list"
 	return sendRequestAndPrint("GET", url, request)
@@ -99,6 +350,34 @@ func doBackupInspect(c *cli.Context) error {
 	return sendRequestAndPrint("GET", url, request)
 }
 
+func cmdBackupEstimate(c *cli.Context) {
+	if err := doBackupEstimate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupEstimate(c *cli.Context) error {
+	var err error
+
+	backupURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	key, err := getEncryptionKey(c)
+	if err != nil {
+		return err
+	}
+
+	request := &api.RestoreEstimateRequest{
+		URL:           backupURL,
+		DriverName:    c.String("driver"),
+		EncryptionKey: key,
+	}
+	url := "/backups/estimate"
+	return sendRequestAndPrint("GET", url, request)
+}
+
 func cmdBackupCreate(c *cli.Context) {
 	if err := doBackupCreate(c); err != nil {
 		panic(err)
@@ -118,16 +397,96 @@ func doBackupCreate(c *cli.Context) error {
 		return err
 	}
 
+	opts := util.SliceToMap(c.StringSlice("opt"))
+	if opts == nil {
+		return fmt.Errorf("Invalid option, must be in key=value format")
+	}
+
+	key, err := getEncryptionKey(c)
+	if err != nil {
+		return err
+	}
+
 	request := &api.BackupCreateRequest{
-		URL:          destURL,
-		SnapshotName: snapshotName,
-		Verbose:      c.GlobalBool(verboseFlag),
+		URL:                destURL,
+		SnapshotName:       snapshotName,
+		Retain:             c.Int("retain"),
+		Options:            opts,
+		EncryptionKey:      key,
+		EncryptionKMSKeyID: c.String("encryption-kms-key-id"),
+		Compression:        c.String("compression"),
+		Verbose:            isVerbose(c),
+	}
+
+	url := requestURL(c, "/backups/create")
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdBackupNow(c *cli.Context) {
+	if err := doBackupNow(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupNow(c *cli.Context) error {
+	var err error
+
+	destURL, err := util.GetFlag(c, "dest", false, err)
+	if err != nil {
+		return err
+	}
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	labels := util.SliceToMap(c.StringSlice("label"))
+	if labels == nil {
+		return fmt.Errorf("Invalid label, must be in key=value format")
+	}
+	opts := util.SliceToMap(c.StringSlice("opt"))
+	if opts == nil {
+		return fmt.Errorf("Invalid option, must be in key=value format")
+	}
+
+	key, err := getEncryptionKey(c)
+	if err != nil {
+		return err
+	}
+
+	request := &api.BackupNowRequest{
+		VolumeName:         volumeName,
+		URL:                destURL,
+		SnapshotName:       c.String("name"),
+		Labels:             labels,
+		DeleteSnapshot:     c.Bool("delete-snapshot"),
+		Retain:             c.Int("retain"),
+		Options:            opts,
+		EncryptionKey:      key,
+		EncryptionKMSKeyID: c.String("encryption-kms-key-id"),
+		Compression:        c.String("compression"),
+		Verbose:            isVerbose(c),
 	}
 
-	url := "/backups/create"
+	url := requestURL(c, "/backups/now")
 	return sendRequestAndPrint("POST", url, request)
 }
 
+// getEncryptionKey returns content of the key file in base64, since the
+// daemon may not be able to read the file
+func getEncryptionKey(c *cli.Context) (string, error) {
+	keyFile := c.String("encryption-key-file")
+	if keyFile == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
 func cmdBackupDelete(c *cli.Context) {
 	if err := doBackupDelete(c); err != nil {
 		panic(err)
@@ -142,8 +501,158 @@ func doBackupDelete(c *cli.Context) error {
 	}
 
 	request := &api.BackupDeleteRequest{
-		URL: backupURL,
+		URL:   backupURL,
+		Purge: c.Bool("purge"),
 	}
-	url := "/backups"
+	url := requestURL(c, "/backups")
 	return sendRequestAndPrint("DELETE", url, request)
 }
+
+func cmdBackupCopy(c *cli.Context) {
+	if err := doBackupCopy(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupCopy(c *cli.Context) error {
+	var err error
+	backupURL, err := util.GetFlag(c, "", true, err)
+	destURL, err := util.GetFlag(c, "dest", true, err)
+	if err != nil {
+		return err
+	}
+	opts := util.SliceToMap(c.StringSlice("opt"))
+	if opts == nil {
+		return fmt.Errorf("Invalid option, must be in key=value format")
+	}
+
+	request := &api.BackupCopyRequest{
+		URL:     backupURL,
+		DestURL: destURL,
+		Options: opts,
+		Verbose: isVerbose(c),
+	}
+	url := requestURL(c, "/backups/copy")
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdBackupArchive(c *cli.Context) {
+	if err := doBackupArchive(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupArchive(c *cli.Context) error {
+	var err error
+	backupURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	request := &api.BackupArchiveRequest{
+		URL:          backupURL,
+		StorageClass: c.String("storage-class"),
+	}
+	url := requestURL(c, "/backups/archive")
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdBackupRestoreArchive(c *cli.Context) {
+	if err := doBackupRestoreArchive(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupRestoreArchive(c *cli.Context) error {
+	var err error
+	backupURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+	days := c.Int("days")
+	if days <= 0 {
+		return fmt.Errorf("Invalid days %v, must be a positive integer", days)
+	}
+
+	request := &api.BackupRestoreArchiveRequest{
+		URL:  backupURL,
+		Days: int64(days),
+		Tier: c.String("tier"),
+	}
+	url := "/backups/restore-archive"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdBackupGC(c *cli.Context) {
+	if err := doBackupGC(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupGC(c *cli.Context) error {
+	var err error
+	destURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	request := &api.BackupGCRequest{
+		URL:    destURL,
+		DryRun: c.Bool("dry-run"),
+	}
+	url := requestURL(c, "/backups/gc")
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdObjectStoreGC(c *cli.Context) {
+	if err := doObjectStoreGC(c); err != nil {
+		panic(err)
+	}
+}
+
+func doObjectStoreGC(c *cli.Context) error {
+	var err error
+	destURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	request := &api.ObjectStoreGCRequest{
+		URL:    destURL,
+		MinAge: c.String("min-age"),
+		DryRun: c.Bool("dry-run"),
+	}
+	url := requestURL(c, "/objectstore/gc")
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdBackupRestoreFile(c *cli.Context) {
+	if err := doBackupRestoreFile(c); err != nil {
+		panic(err)
+	}
+}
+
+func doBackupRestoreFile(c *cli.Context) error {
+	var err error
+	backupURL, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+	paths := c.StringSlice("path")
+	if len(paths) == 0 {
+		return util.RequiredMissingError("path")
+	}
+	// Paths are restored by the daemon, which has another working directory
+	to, err := filepath.Abs(c.String("to"))
+	if err != nil {
+		return err
+	}
+
+	request := &api.BackupRestoreFileRequest{
+		URL:   backupURL,
+		Paths: paths,
+		To:    to,
+	}
+	url := requestURL(c, "/backups/restore-file")
+	return sendRequestAndPrint("POST", url, request)
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+)
+
+const (
+	// Without --format, responses are printed as returned by the daemon
+	FORMAT_RAW   = ""
+	FORMAT_JSON  = "json"
+	FORMAT_TABLE = "table"
+
+	EXIT_CODE_ERROR = 1
+	// Invalid command or options
+	EXIT_CODE_USAGE = 2
+	// Errors of the codes responded by daemon
+	EXIT_CODE_NOT_FOUND          = 3
+	EXIT_CODE_CONFLICT           = 4
+	EXIT_CODE_IN_USE             = 5
+	EXIT_CODE_DRIVER_UNSUPPORTED = 6
+	EXIT_CODE_BUSY               = 7
+	EXIT_CODE_TIMEOUT            = 8
+)
+
+var (
+	formatFlag = "format"
+
+	errorCodeExitCodes = map[string]int{
+		api.ERROR_CODE_NOT_FOUND:          EXIT_CODE_NOT_FOUND,
+		api.ERROR_CODE_CONFLICT:           EXIT_CODE_CONFLICT,
+		api.ERROR_CODE_IN_USE:             EXIT_CODE_IN_USE,
+		api.ERROR_CODE_DRIVER_UNSUPPORTED: EXIT_CODE_DRIVER_UNSUPPORTED,
+		api.ERROR_CODE_BUSY:               EXIT_CODE_BUSY,
+		api.ERROR_CODE_TIMEOUT:            EXIT_CODE_TIMEOUT,
+	}
+
+	outputFormat   = FORMAT_RAW
+	outputTemplate *template.Template
+	output         io.Writer = os.Stdout
+	errOutput      io.Writer = os.Stderr
+)
+
+// usageError is an error caused by the command line rather than the
+// operation itself
+type usageError struct {
+	error
+}
+
+func initOutputFormat(format string) error {
+	outputFormat = format
+	outputTemplate = nil
+	switch format {
+	case FORMAT_RAW, FORMAT_JSON, FORMAT_TABLE:
+		return nil
+	}
+	tmpl, err := template.New("format").Parse(format)
+	if err != nil {
+		return usageError{fmt.Errorf("Invalid format %v, must be json, table or a Go template: %v", format, err)}
+	}
+	outputTemplate = tmpl
+	return nil
+}
+
+// isVerbose returns true if the response should be the whole object rather
+// than only the name, which is always the case for structured output
+func isVerbose(c *cli.Context) bool {
+	return c.GlobalBool(verboseFlag) || outputFormat != FORMAT_RAW
+}
+
+// printOutput prints response of daemon in the format specified by --format
+func printOutput(b []byte) error {
+	if outputFormat == FORMAT_RAW {
+		fmt.Fprintln(output, string(b))
+		return nil
+	}
+	data := bytes.TrimSpace(b)
+	if len(data) == 0 {
+		// Nothing returned, e.g. for delete
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		// Plain string response, e.g. name of the created volume
+		v = string(data)
+	}
+
+	switch {
+	case outputFormat == FORMAT_JSON:
+		j, err := json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(output, string(j))
+	case outputFormat == FORMAT_TABLE:
+		return printTable(v)
+	default:
+		if err := outputTemplate.Execute(output, v); err != nil {
+			return err
+		}
+		fmt.Fprintln(output)
+	}
+	return nil
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+func formatCell(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// tableColumns returns the scalar fields of rows, with name and ID first
+func tableColumns(rows []map[string]interface{}) []string {
+	keys := map[string]bool{}
+	for _, row := range rows {
+		for k, v := range row {
+			if isScalar(v) {
+				keys[k] = true
+			}
+		}
+	}
+	columns := []string{}
+	for _, k := range []string{"Name", "ID"} {
+		if keys[k] {
+			columns = append(columns, k)
+			delete(keys, k)
+		}
+	}
+	others := []string{}
+	for k := range keys {
+		others = append(others, k)
+	}
+	sort.Strings(others)
+	return append(columns, others...)
+}
+
+/*
+printTable prints a list, or a map keyed by name, of objects as rows, with
+their scalar fields as columns. A single object is printed as field and value
+pairs.
+*/
+func printTable(v interface{}) error {
+	w := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	rows := []map[string]interface{}{}
+	switch value := v.(type) {
+	case []interface{}:
+		for _, item := range value {
+			row, ok := item.(map[string]interface{})
+			if !ok {
+				fmt.Fprintln(w, formatCell(item))
+				continue
+			}
+			rows = append(rows, row)
+		}
+	case map[string]interface{}:
+		names := []string{}
+		for name, item := range value {
+			if _, ok := item.(map[string]interface{}); !ok {
+				names = nil
+				break
+			}
+			names = append(names, name)
+		}
+		if names == nil {
+			// Single object
+			fields := []string{}
+			for k := range value {
+				fields = append(fields, k)
+			}
+			sort.Strings(fields)
+			for _, k := range fields {
+				if isScalar(value[k]) {
+					fmt.Fprintf(w, "%v\t%v\n", k, formatCell(value[k]))
+					continue
+				}
+				j, err := json.Marshal(value[k])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%v\t%v\n", k, string(j))
+			}
+			return w.Flush()
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rows = append(rows, value[name].(map[string]interface{}))
+		}
+	default:
+		fmt.Fprintln(w, formatCell(v))
+	}
+
+	if len(rows) != 0 {
+		columns := tableColumns(rows)
+		header := []string{}
+		for _, column := range columns {
+			header = append(header, strings.ToUpper(column))
+		}
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+		for _, row := range rows {
+			cells := []string{}
+			for _, column := range columns {
+				cells = append(cells, formatCell(row[column]))
+			}
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+		}
+	}
+	return w.Flush()
+}
+
+// HandleError reports the error of command and returns the exit code.
+// Errors are printed in JSON to stdout as before without --format, otherwise
+// in JSON to stdout for json format, or plain text to stderr.
+func HandleError(v interface{}) int {
+	err, isErr := v.(error)
+	if _, isRuntimeErr := v.(runtime.Error); !isErr || isRuntimeErr || outputFormat == FORMAT_RAW {
+		api.ResponseLogAndError(v)
+	} else if outputFormat == FORMAT_JSON {
+		api.ResponseErrorOf(err)
+	} else {
+		fmt.Fprintf(errOutput, "Error: %v\n", err)
+	}
+
+	var uErr usageError
+	if isErr && errors.As(err, &uErr) {
+		return EXIT_CODE_USAGE
+	}
+	var apiErr *api.Error
+	if isErr && errors.As(err, &apiErr) {
+		if code, exists := errorCodeExitCodes[apiErr.Code]; exists {
+			return code
+		}
+	}
+	return EXIT_CODE_ERROR
+}
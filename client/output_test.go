@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	out    *bytes.Buffer
+	errOut *bytes.Buffer
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpTest(c *C) {
+	s.out = &bytes.Buffer{}
+	s.errOut = &bytes.Buffer{}
+	output = s.out
+	errOutput = s.errOut
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	output = os.Stdout
+	errOutput = os.Stderr
+	c.Assert(initOutputFormat(FORMAT_RAW), IsNil)
+}
+
+// captureStdout returns what f prints to stdout, where responses of api
+// are printed
+func captureStdout(c *C, f func()) string {
+	file := filepath.Join(c.MkDir(), "stdout")
+	out, err := os.Create(file)
+	c.Assert(err, IsNil)
+	stdout := os.Stdout
+	os.Stdout = out
+	f()
+	os.Stdout = stdout
+	c.Assert(out.Close(), IsNil)
+	b, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	return string(b)
+}
+
+const testVolumes = `{
+	"vol2": {"Name": "vol2", "Driver": "vfs", "Size": 1024, "Snapshots": {"snap1": {}}},
+	"vol1": {"Name": "vol1", "Driver": "devicemapper", "MountPoint": ""}
+}`
+
+func (s *TestSuite) TestRawOutput(c *C) {
+	c.Assert(initOutputFormat(FORMAT_RAW), IsNil)
+	c.Assert(printOutput([]byte(`{"Name":"vol1"}`)), IsNil)
+	c.Assert(s.out.String(), Equals, "{\"Name\":\"vol1\"}\n")
+}
+
+func (s *TestSuite) TestJSONOutput(c *C) {
+	c.Assert(initOutputFormat(FORMAT_JSON), IsNil)
+	c.Assert(printOutput([]byte(`{"Name":"vol1","Size":1024}`)), IsNil)
+	c.Assert(s.out.String(), Equals, "{\n\t\"Name\": \"vol1\",\n\t\"Size\": 1024\n}\n")
+
+	// Plain string response is quoted, and nothing is printed for empty one
+	s.out.Reset()
+	c.Assert(printOutput([]byte("vol1\n")), IsNil)
+	c.Assert(s.out.String(), Equals, "\"vol1\"\n")
+	s.out.Reset()
+	c.Assert(printOutput([]byte("\n")), IsNil)
+	c.Assert(s.out.String(), Equals, "")
+}
+
+func (s *TestSuite) TestTableOutput(c *C) {
+	c.Assert(initOutputFormat(FORMAT_TABLE), IsNil)
+
+	// Map keyed by name is sorted, with name first and scalar fields only
+	c.Assert(printOutput([]byte(testVolumes)), IsNil)
+	c.Assert(s.out.String(), Equals, ""+
+		"NAME  DRIVER        MOUNTPOINT  SIZE\n"+
+		"vol1  devicemapper              \n"+
+		"vol2  vfs                       1024\n")
+
+	s.out.Reset()
+	c.Assert(printOutput([]byte(`[{"ID":"1","Name":"job1"},{"Name":"job2","State":"done"}]`)), IsNil)
+	c.Assert(s.out.String(), Equals, ""+
+		"NAME  ID  STATE\n"+
+		"job1  1   \n"+
+		"job2      done\n")
+
+	// Single object is printed as fields, with the others in JSON
+	s.out.Reset()
+	c.Assert(printOutput([]byte(`{"Name":"vol1","Size":1024,"Labels":{"a":"b"}}`)), IsNil)
+	c.Assert(s.out.String(), Equals, ""+
+		"Labels  {\"a\":\"b\"}\n"+
+		"Name    vol1\n"+
+		"Size    1024\n")
+
+	s.out.Reset()
+	c.Assert(printOutput([]byte("vol1")), IsNil)
+	c.Assert(s.out.String(), Equals, "vol1\n")
+}
+
+func (s *TestSuite) TestTemplateOutput(c *C) {
+	c.Assert(initOutputFormat("{{range .}}{{.Name}} {{end}}"), IsNil)
+	c.Assert(printOutput([]byte(`[{"Name":"vol1"},{"Name":"vol2"}]`)), IsNil)
+	c.Assert(s.out.String(), Equals, "vol1 vol2 \n")
+
+	c.Assert(initOutputFormat("{{.Name.Missing}}"), IsNil)
+	c.Assert(printOutput([]byte(`{"Name":"vol1"}`)), NotNil)
+
+	err := initOutputFormat("{{.Name")
+	c.Assert(err, ErrorMatches, "Invalid format {{.Name, must be json, table or a Go template.*")
+	c.Assert(HandleError(err), Equals, EXIT_CODE_USAGE)
+}
+
+func (s *TestSuite) TestHandleError(c *C) {
+	c.Assert(initOutputFormat(FORMAT_TABLE), IsNil)
+	for code, exitCode := range errorCodeExitCodes {
+		err := api.NewError(code, "failed")
+		c.Assert(HandleError(err), Equals, exitCode, Commentf("code %v", code))
+		// Wrapped errors are recognized as well
+		c.Assert(HandleError(fmt.Errorf("cannot do it: %w", err)), Equals, exitCode)
+	}
+	c.Assert(HandleError(api.NewError("unknown", "failed")), Equals, EXIT_CODE_ERROR)
+	c.Assert(HandleError(errors.New("failed")), Equals, EXIT_CODE_ERROR)
+	c.Assert(HandleError(usageError{errors.New("bad option")}), Equals, EXIT_CODE_USAGE)
+
+	s.errOut.Reset()
+	HandleError(errors.New("failed"))
+	c.Assert(s.errOut.String(), Equals, "Error: failed\n")
+	c.Assert(s.out.String(), Equals, "")
+
+	// Errors are printed to stdout in JSON, with the code of daemon
+	c.Assert(initOutputFormat(FORMAT_JSON), IsNil)
+	s.errOut.Reset()
+	stdout := captureStdout(c, func() {
+		c.Assert(HandleError(api.NewError(api.ERROR_CODE_NOT_FOUND, "no vol1")), Equals, EXIT_CODE_NOT_FOUND)
+	})
+	c.Assert(stdout, Matches, `(?s)\{.*"Error": "no vol1".*"Code": "`+api.ERROR_CODE_NOT_FOUND+`".*\}\n`)
+	c.Assert(s.errOut.String(), Equals, "")
+
+	c.Assert(initOutputFormat(FORMAT_RAW), IsNil)
+	stdout = captureStdout(c, func() {
+		c.Assert(HandleError(api.NewError(api.ERROR_CODE_BUSY, "busy")), Equals, EXIT_CODE_BUSY)
+	})
+	c.Assert(stdout, Matches, `(?s)\{.*"Error": .*busy.*\}\n`)
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+var (
+	policyCreateCmd = cli.Command{
+		Name:  "create",
+		Usage: "create a policy to snapshot and backup volumes selected by labels: policy create <policy> [options]",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "selector",
+				Value: &cli.StringSlice{},
+				Usage: "label in key=value format that volumes must have, can be specified multiple times",
+			},
+			cli.StringFlag{
+				Name:  "cron",
+				Value: "@daily",
+				Usage: "when to back up the selected volumes in cron format of daemon's local time, e.g. \"0 2 * * *\" or @daily",
+			},
+			cli.StringFlag{
+				Name:  "dest",
+				Usage: "destination of backups, e.g. s3://backup-bucket@us-west-2/backupstore",
+			},
+			cli.IntFlag{
+				Name:  "retain",
+				Usage: "number of latest backups created by the policy to keep for each volume, 0 means keep all",
+			},
+		},
+		Action: cmdPolicyCreate,
+	}
+
+	policyListCmd = cli.Command{
+		Name:   "list",
+		Usage:  "list all backup policies",
+		Action: cmdPolicyList,
+	}
+
+	policyDeleteCmd = cli.Command{
+		Name:   "delete",
+		Usage:  "delete a policy, backups created by it would be kept: policy delete <policy>",
+		Action: cmdPolicyDelete,
+	}
+
+	policyCmd = cli.Command{
+		Name:  "policy",
+		Usage: "backup policy related operations",
+		Subcommands: []cli.Command{
+			policyCreateCmd,
+			policyListCmd,
+			policyDeleteCmd,
+		},
+	}
+)
+
+func cmdPolicyCreate(c *cli.Context) {
+	if err := doPolicyCreate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doPolicyCreate(c *cli.Context) error {
+	var err error
+
+	policyName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	selector := util.SliceToMap(c.StringSlice("selector"))
+	if len(selector) == 0 {
+		return fmt.Errorf("Missing or invalid selector, must be in key=value format")
+	}
+
+	request := &api.PolicyCreateRequest{
+		Name:     policyName,
+		Selector: selector,
+		Cron:     c.String("cron"),
+		URL:      c.String("dest"),
+		Retain:   c.Int("retain"),
+	}
+	url := "/policies/create"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdPolicyList(c *cli.Context) {
+	if err := doPolicyList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doPolicyList(c *cli.Context) error {
+	url := "/policies/list"
+	return sendRequestAndPrint("GET", url, nil)
+}
+
+func cmdPolicyDelete(c *cli.Context) {
+	if err := doPolicyDelete(c); err != nil {
+		panic(err)
+	}
+}
+
+func doPolicyDelete(c *cli.Context) error {
+	var err error
+
+	policyName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.PolicyDeleteRequest{
+		Name: policyName,
+	}
+	url := "/policies/"
+	return sendRequestAndPrint("DELETE", url, request)
+}
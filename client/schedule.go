@@ -0,0 +1,109 @@
+package client
+
+import (
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+var (
+	scheduleCreateCmd = cli.Command{
+		Name:  "create",
+		Usage: "create a schedule to snapshot a volume periodically: schedule create <schedule> [options]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "volume",
+				Usage: "volume to snapshot",
+			},
+			cli.StringFlag{
+				Name:  "cron",
+				Usage: "when to take snapshots in cron format of daemon's local time, e.g. \"0 */6 * * *\" or @daily",
+			},
+			cli.IntFlag{
+				Name:  "retain",
+				Usage: "number of latest snapshots created by the schedule to keep, 0 means keep all",
+			},
+		},
+		Action: cmdScheduleCreate,
+	}
+
+	scheduleListCmd = cli.Command{
+		Name:   "list",
+		Usage:  "list all snapshot schedules",
+		Action: cmdScheduleList,
+	}
+
+	scheduleDeleteCmd = cli.Command{
+		Name:   "delete",
+		Usage:  "delete a schedule, snapshots created by it would be kept: schedule delete <schedule>",
+		Action: cmdScheduleDelete,
+	}
+
+	scheduleCmd = cli.Command{
+		Name:  "schedule",
+		Usage: "snapshot schedule related operations",
+		Subcommands: []cli.Command{
+			scheduleCreateCmd,
+			scheduleListCmd,
+			scheduleDeleteCmd,
+		},
+	}
+)
+
+func cmdScheduleCreate(c *cli.Context) {
+	if err := doScheduleCreate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doScheduleCreate(c *cli.Context) error {
+	var err error
+
+	scheduleName, err := getName(c, "", true)
+	volumeName, err := util.GetFlag(c, "volume", true, err)
+	cron, err := util.GetFlag(c, "cron", true, err)
+	if err != nil {
+		return err
+	}
+
+	request := &api.ScheduleCreateRequest{
+		Name:       scheduleName,
+		VolumeName: volumeName,
+		Cron:       cron,
+		Retain:     c.Int("retain"),
+	}
+	url := "/schedules/create"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdScheduleList(c *cli.Context) {
+	if err := doScheduleList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doScheduleList(c *cli.Context) error {
+	url := "/schedules/list"
+	return sendRequestAndPrint("GET", url, nil)
+}
+
+func cmdScheduleDelete(c *cli.Context) {
+	if err := doScheduleDelete(c); err != nil {
+		panic(err)
+	}
+}
+
+func doScheduleDelete(c *cli.Context) error {
+	var err error
+
+	scheduleName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.ScheduleDeleteRequest{
+		Name: scheduleName,
+	}
+	url := "/schedules/"
+	return sendRequestAndPrint("DELETE", url, request)
+}
@@ -1,6 +1,9 @@
 package client
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/codegangsta/cli"
 	"github.com/rancher/convoy/api"
 	"github.com/rancher/convoy/util"
@@ -15,13 +18,28 @@ var (
 				Name:  "name",
 				Usage: "name of snapshot",
 			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Value: &cli.StringSlice{},
+				Usage: "label of snapshot in key=value format, can be specified multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "snapshot option in key=value format, can be specified multiple times. Supported option is tags=<key1=value1,key2=value2> to tag the EBS snapshot",
+			},
+			compressionFlag,
+			asyncFlag,
 		},
 		Action: cmdSnapshotCreate,
 	}
 
 	snapshotDeleteCmd = cli.Command{
-		Name:   "delete",
-		Usage:  "delete a snapshot: snapshot delete <snapshot>",
+		Name:  "delete",
+		Usage: "delete a snapshot: snapshot delete <snapshot>",
+		Flags: []cli.Flag{
+			asyncFlag,
+		},
 		Action: cmdSnapshotDelete,
 	}
 
@@ -31,6 +49,12 @@ var (
 		Action: cmdSnapshotInspect,
 	}
 
+	snapshotDiffCmd = cli.Command{
+		Name:   "diff",
+		Usage:  "list changes between snapshots of a volume: snapshot diff <earlier snapshot> <later snapshot>",
+		Action: cmdSnapshotDiff,
+	}
+
 	snapshotCmd = cli.Command{
 		Name:  "snapshot",
 		Usage: "snapshot related operations",
@@ -38,6 +62,7 @@ var (
 			snapshotCreateCmd,
 			snapshotDeleteCmd,
 			snapshotInspectCmd,
+			snapshotDiffCmd,
 		},
 	}
 )
@@ -57,13 +82,35 @@ func doSnapshotCreate(c *cli.Context) error {
 		return err
 	}
 
+	labels := util.SliceToMap(c.StringSlice("label"))
+	if labels == nil {
+		return fmt.Errorf("Invalid label, must be in key=value format")
+	}
+
+	var tags map[string]string
+	for _, opt := range c.StringSlice("opt") {
+		pair := strings.SplitN(opt, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("Invalid option %v, must be in key=value format", opt)
+		}
+		if pair[0] != "tags" {
+			return fmt.Errorf("Unsupported option %v", pair[0])
+		}
+		if tags, err = util.ParseTags(pair[1]); err != nil {
+			return err
+		}
+	}
+
 	request := &api.SnapshotCreateRequest{
-		Name:       snapshotName,
-		VolumeName: volumeName,
-		Verbose:    c.GlobalBool(verboseFlag),
+		Name:        snapshotName,
+		VolumeName:  volumeName,
+		Labels:      labels,
+		Compression: c.String("compression"),
+		Tags:        tags,
+		Verbose:     isVerbose(c),
 	}
 
-	url := "/snapshots/create"
+	url := requestURL(c, "/snapshots/create")
 
 	return sendRequestAndPrint("POST", url, request)
 }
@@ -84,7 +131,7 @@ func doSnapshotDelete(c *cli.Context) error {
 	request := &api.SnapshotDeleteRequest{
 		SnapshotName: snapshotName,
 	}
-	url := "/snapshots/"
+	url := requestURL(c, "/snapshots/")
 	return sendRequestAndPrint("DELETE", url, request)
 }
 
@@ -108,3 +155,26 @@ func doSnapshotInspect(c *cli.Context) error {
 	url := "/snapshots/"
 	return sendRequestAndPrint("GET", url, request)
 }
+
+func cmdSnapshotDiff(c *cli.Context) {
+	if err := doSnapshotDiff(c); err != nil {
+		panic(err)
+	}
+}
+
+func doSnapshotDiff(c *cli.Context) error {
+	names, err := getNames(c)
+	if err != nil {
+		return err
+	}
+	if len(names) != 2 {
+		return fmt.Errorf("Two snapshots are required, the earlier one first")
+	}
+
+	request := &api.SnapshotDiffRequest{
+		SnapshotName:        names[1],
+		CompareSnapshotName: names[0],
+	}
+	url := "/snapshots/diff"
+	return sendRequestAndPrint("GET", url, request)
+}
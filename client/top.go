@@ -0,0 +1,149 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+)
+
+const (
+	DEFAULT_TOP_INTERVAL = "2s"
+
+	// Moves the cursor to the top left and clears the terminal
+	CLEAR_SCREEN = "\033[H\033[2J"
+)
+
+var (
+	topCmd = cli.Command{
+		Name:  "top",
+		Usage: "show the operations in progress, backups being created and volume locks held by daemon, refreshed until interrupted",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "interval",
+				Value: DEFAULT_TOP_INTERVAL,
+				Usage: "how often to refresh, at least 1s",
+			},
+			cli.BoolFlag{
+				Name:  "once",
+				Usage: "show the activity once and exit",
+			},
+		},
+		Action: cmdTop,
+	}
+)
+
+func cmdTop(c *cli.Context) {
+	if err := doTop(c); err != nil {
+		panic(err)
+	}
+}
+
+func doTop(c *cli.Context) error {
+	path := "/operations"
+	if !c.Bool("once") {
+		interval := c.String("interval")
+		if _, err := time.ParseDuration(interval); err != nil {
+			return usageError{fmt.Errorf("Invalid interval %v: %v", interval, err)}
+		}
+		v := url.Values{}
+		v.Set(api.KEY_WATCH, interval)
+		path += "?" + v.Encode()
+	}
+	rc, err := sendRequest("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	clear := !c.Bool("once") && isTerminal(os.Stdout)
+	decoder := json.NewDecoder(rc)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if outputFormat != FORMAT_RAW {
+			if err := printOutput(raw); err != nil {
+				return err
+			}
+			continue
+		}
+		resp := &api.OperationsResponse{}
+		if err := json.Unmarshal(raw, resp); err != nil {
+			return err
+		}
+		if clear {
+			fmt.Fprint(output, CLEAR_SCREEN)
+		}
+		if err := printOperations(resp); err != nil {
+			return err
+		}
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+// formatBytes returns size in the largest binary unit it's at least one of
+func formatBytes(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[i])
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// printOperations prints the activity of daemon as tables of operations,
+// backups and volume locks
+func printOperations(resp *api.OperationsResponse) error {
+	tw := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Daemon activity at %v: %v operations, %v backups, %v volume locks\n",
+		resp.Time, len(resp.Operations), len(resp.Backups), len(resp.Locks))
+
+	fmt.Fprintln(tw, "\nOPERATION\tTARGET\tREQUESTER\tJOB\tDURATION")
+	for _, op := range resp.Operations {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", op.Operation, orDash(op.Target), orDash(op.Requester), orDash(op.JobID), op.Duration)
+	}
+
+	fmt.Fprintln(tw, "\nBACKUP\tVOLUME\tDESTINATION\tBLOCKS\tUPLOADED\tTHROUGHPUT\tDURATION")
+	for _, b := range resp.Backups {
+		blocks := "-"
+		if b.TotalBlocks != 0 {
+			blocks = fmt.Sprintf("%v/%v", b.DoneBlocks, b.TotalBlocks)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v/s\t%v\n", b.Name, b.Volume, b.DestURL, blocks,
+			formatBytes(b.UploadedBytes), formatBytes(b.Throughput), b.Duration)
+	}
+
+	fmt.Fprintln(tw, "\nVOLUME\tHELD FOR\tWAITERS")
+	for _, l := range resp.Locks {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", l.Volume, orDash(l.Duration), l.Waiters)
+	}
+	fmt.Fprintln(tw)
+	return tw.Flush()
+}
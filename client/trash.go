@@ -0,0 +1,113 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+var (
+	trashListCmd = cli.Command{
+		Name:   "list",
+		Usage:  "list volumes and backups in trash, with the time they would be deleted",
+		Action: cmdTrashList,
+	}
+
+	trashRestoreCmd = cli.Command{
+		Name:   "restore",
+		Usage:  "restore a volume or backup from trash: trash restore <volume|backup>",
+		Action: cmdTrashRestore,
+	}
+
+	trashPurgeCmd = cli.Command{
+		Name:  "purge",
+		Usage: "delete a volume or backup in trash right away: trash purge <volume|backup> [options]",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "all",
+				Usage: "delete everything in trash",
+			},
+			asyncFlag,
+		},
+		Action: cmdTrashPurge,
+	}
+
+	trashCmd = cli.Command{
+		Name:  "trash",
+		Usage: "trash of deleted volumes and backups related operations",
+		Subcommands: []cli.Command{
+			trashListCmd,
+			trashRestoreCmd,
+			trashPurgeCmd,
+		},
+	}
+)
+
+// trashTarget tells a backup URL from a volume name
+func trashTarget(name string) (string, string) {
+	if strings.Contains(name, "://") {
+		return "", name
+	}
+	return name, ""
+}
+
+func cmdTrashList(c *cli.Context) {
+	if err := doTrashList(c); err != nil {
+		panic(err)
+	}
+}
+
+func doTrashList(c *cli.Context) error {
+	url := "/trash/list"
+	return sendRequestAndPrint("GET", url, nil)
+}
+
+func cmdTrashRestore(c *cli.Context) {
+	if err := doTrashRestore(c); err != nil {
+		panic(err)
+	}
+}
+
+func doTrashRestore(c *cli.Context) error {
+	var err error
+
+	name, err := util.GetFlag(c, "", true, err)
+	if err != nil {
+		return err
+	}
+
+	volumeName, backupURL := trashTarget(name)
+	request := &api.TrashRestoreRequest{
+		VolumeName: volumeName,
+		BackupURL:  backupURL,
+	}
+	url := "/trash/restore"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdTrashPurge(c *cli.Context) {
+	if err := doTrashPurge(c); err != nil {
+		panic(err)
+	}
+}
+
+func doTrashPurge(c *cli.Context) error {
+	var err error
+
+	all := c.Bool("all")
+	name, err := util.GetFlag(c, "", !all, err)
+	if err != nil {
+		return err
+	}
+
+	volumeName, backupURL := trashTarget(name)
+	request := &api.TrashPurgeRequest{
+		VolumeName: volumeName,
+		BackupURL:  backupURL,
+		All:        all,
+	}
+	url := requestURL(c, "/trash")
+	return sendRequestAndPrint("DELETE", url, request)
+}
@@ -2,7 +2,11 @@ package client
 
 import (
 	"fmt"
+	"io"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/codegangsta/cli"
 	"github.com/rancher/convoy/api"
@@ -26,6 +30,10 @@ var (
 				Name:  "backup",
 				Usage: "create a volume of backup if driver supports",
 			},
+			cli.StringFlag{
+				Name:  "snapshot",
+				Usage: "create a volume of local snapshot if driver supports, the volume would be created by the driver of snapshot",
+			},
 			cli.StringFlag{
 				Name:  "id",
 				Usage: "driver specific volume ID if driver supports",
@@ -47,10 +55,119 @@ var (
 				Name:  "vm",
 				Usage: "Prepare volume for Rancher VM if driver supports",
 			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Value: &cli.StringSlice{},
+				Usage: "label of volume in key=value format, can be specified multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "volume option in key=value format, can be specified multiple times. Supported options are mountopts=<comma separated mount options>, iops=<IOPS>, throughput=<MiB/s>, ro=true to always mount the volume read-only, tags=<key1=value1,key2=value2> to tag the EBS volume, encrypted=true with optional kmskeyid=<KMS key> to encrypt the EBS volume, and uid=<uid>, gid=<gid> and mode=<octal mode> to set the owner and permission of the volume directory",
+			},
+			cli.StringFlag{
+				Name:  "encryption-key-file",
+				Usage: "key to decrypt the backup with, if it's not known by the daemon yet",
+			},
+			cli.StringFlag{
+				Name:  "profile",
+				Usage: "profile of options in daemon config, used for the options not specified",
+			},
+			asyncFlag,
 		},
 		Action: cmdVolumeCreate,
 	}
 
+	volumeImportCmd = cli.Command{
+		Name:  "import",
+		Usage: "adopt existing data as a volume without copying it: import <volume> --source <source> [options]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "driver",
+				Usage: "specify using driver other than default",
+			},
+			cli.StringFlag{
+				Name:  "source",
+				Usage: "existing data to import, absolute path of directory for VFS, volume ID for EBS, share for CIFS, or LUN for iSCSI",
+			},
+			cli.StringSliceFlag{
+				Name:  "label",
+				Value: &cli.StringSlice{},
+				Usage: "label of volume in key=value format, can be specified multiple times",
+			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "volume option in key=value format, can be specified multiple times. Supported options are mountopts=<comma separated mount options> and ro=true to always mount the volume read-only",
+			},
+			asyncFlag,
+		},
+		Action: cmdVolumeImport,
+	}
+
+	volumeCloneCmd = cli.Command{
+		Name:  "clone",
+		Usage: "create a writable copy of a volume, which may be in use: clone <source volume> <new volume> [options]",
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Name:  "label",
+				Value: &cli.StringSlice{},
+				Usage: "label of the new volume in key=value format, can be specified multiple times",
+			},
+			asyncFlag,
+		},
+		Action: cmdVolumeClone,
+	}
+
+	volumeMigrateCmd = cli.Command{
+		Name:  "migrate",
+		Usage: "move an unmounted volume to another driver, keeping its name: migrate <volume> --to-driver <driver> [options]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "to-driver",
+				Usage: "driver to move the volume to",
+			},
+			cli.StringFlag{
+				Name:  "size",
+				Usage: "size of the new volume if driver supports, in bytes, or end in either G or M or K. The size of the volume by default",
+			},
+			cli.StringFlag{
+				Name:  "type",
+				Usage: "driver specific volume type of the new volume if driver supports",
+			},
+			cli.StringFlag{
+				Name:  "fs",
+				Usage: "filesystem type to format the new volume with",
+				Value: "ext4",
+			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "option of the new volume in key=value format, can be specified multiple times. Supported options are mountopts=<comma separated mount options>, iops=<IOPS>, throughput=<MiB/s>, tags=<key1=value1,key2=value2> to tag the EBS volume, and encrypted=true with optional kmskeyid=<KMS key> to encrypt the EBS volume",
+			},
+			asyncFlag,
+		},
+		Action: cmdVolumeMigrate,
+	}
+
+	volumeExportCmd = cli.Command{
+		Name:  "export",
+		Usage: "write a tarball of the current content of a volume: export <volume> [options]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "file to write the tarball to, or \"-\" for stdout",
+				Value: "-",
+			},
+			cli.StringFlag{
+				Name:  "compression",
+				Usage: "compression algorithm of the tarball, can be gzip, zstd, lz4 or none",
+				Value: util.COMPRESSION_GZIP,
+			},
+		},
+		Action: cmdVolumeExport,
+	}
+
 	volumeDeleteCmd = cli.Command{
 		Name:  "delete",
 		Usage: "delete a volume: delete <volume> [options]",
@@ -59,6 +176,10 @@ var (
 				Name:  "reference, r",
 				Usage: "only delete the reference of volume if driver supports",
 			},
+			cli.BoolFlag{
+				Name:  "purge",
+				Usage: "delete the volume right away rather than moving it to trash, if trash is enabled by daemon",
+			},
 		},
 		Action: cmdVolumeDelete,
 	}
@@ -71,10 +192,31 @@ var (
 				Name:  "mountpoint",
 				Usage: "mountpoint of volume. If not specified, it would be automatic mounted to default directory",
 			},
+			cli.StringFlag{
+				Name:  "timeout",
+				Usage: "abort and cleanup the mount if it doesn't complete in time, e.g. 30s. Support by Device Mapper, EBS, DigitalOcean, CIFS, iSCSI, LVM, ZFS, GlusterFS and VFS with mount options",
+			},
+			cli.StringSliceFlag{
+				Name:  "opt",
+				Value: &cli.StringSlice{},
+				Usage: "mount option in key=value format, can be specified multiple times. Supported option is ro=true to mount the volume read-only. Support by Device Mapper, EBS, DigitalOcean, CIFS, iSCSI, LVM, ZFS and GlusterFS",
+			},
 		},
 		Action: cmdVolumeMount,
 	}
 
+	volumeResizeCmd = cli.Command{
+		Name:  "resize",
+		Usage: "grow a volume and its filesystem: resize <volume> --size <size>",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "size",
+				Usage: "new size of volume, must be larger than current size, e.g. 200G. Support by Device Mapper, EBS, LVM and ZFS",
+			},
+		},
+		Action: cmdVolumeResize,
+	}
+
 	volumeUmountCmd = cli.Command{
 		Name:   "umount",
 		Usage:  "umount a volume: umount <volume> [options]",
@@ -89,6 +231,11 @@ var (
 				Name:  "driver",
 				Usage: "Ask for driver specific info of volumes and snapshots",
 			},
+			cli.StringSliceFlag{
+				Name:  "filter",
+				Value: &cli.StringSlice{},
+				Usage: "only list volumes matching the filter, label=<key> or label=<key>=<value>, can be specified multiple times",
+			},
 		},
 		Action: cmdVolumeList,
 	}
@@ -98,6 +245,87 @@ var (
 		Usage:  "inspect a certain volume: inspect <volume>",
 		Action: cmdVolumeInspect,
 	}
+
+	volumeStatsCmd = cli.Command{
+		Name:   "stats",
+		Usage:  "show the IO of the block device of a volume, read and written bytes, operations and latency: stats <volume>",
+		Action: cmdVolumeStats,
+	}
+
+	volumeBackupsCmd = cli.Command{
+		Name:   "backups",
+		Usage:  "list backups of a volume in all destinations it was backed up to: backups <volume>",
+		Action: cmdVolumeBackups,
+	}
+
+	volumeRefreshCmd = cli.Command{
+		Name:   "refresh",
+		Usage:  "correct recorded mount point of a volume according to the actual mount state: refresh <volume>",
+		Action: cmdVolumeRefresh,
+	}
+
+	volumeRetentionCmd = cli.Command{
+		Name:  "retention",
+		Usage: "set the snapshots of a volume to keep, older ones would be deleted after each snapshot: retention <volume> [options]. All zero to keep every snapshot",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "keep-last",
+				Usage: "number of latest snapshots to keep",
+			},
+			cli.IntFlag{
+				Name:  "keep-daily",
+				Usage: "number of latest days to keep the latest snapshot of each day",
+			},
+			cli.IntFlag{
+				Name:  "keep-weekly",
+				Usage: "number of latest weeks to keep the latest snapshot of each week",
+			},
+		},
+		Action: cmdVolumeRetention,
+	}
+
+	volumeForceUmountCmd = cli.Command{
+		Name:  "force-umount",
+		Usage: "umount a volume lazily even if it's in use, when the normal umount hangs or fails: force-umount <volume> [options]",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "kill",
+				Usage: "kill the processes using the volume before umounting it",
+			},
+		},
+		Action: cmdVolumeForceUmount,
+	}
+
+	volumeFenceCmd = cli.Command{
+		Name:  "fence",
+		Usage: "force umount and detach a volume, and keep this host from mounting it until it's unfenced, e.g. when evacuating the host: fence <volume> [options]",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "kill",
+				Usage: "kill the processes using the volume before umounting it",
+			},
+		},
+		Action: cmdVolumeFence,
+	}
+
+	volumeUnfenceCmd = cli.Command{
+		Name:   "unfence",
+		Usage:  "allow this host to mount a fenced volume again: unfence <volume>",
+		Action: cmdVolumeUnfence,
+	}
+
+	volumeCmd = cli.Command{
+		Name:  "volume",
+		Usage: "volume related operations",
+		Subcommands: []cli.Command{
+			volumeBackupsCmd,
+			volumeRefreshCmd,
+			volumeRetentionCmd,
+			volumeForceUmountCmd,
+			volumeFenceCmd,
+			volumeUnfenceCmd,
+		},
+	}
 )
 
 func cmdVolumeCreate(c *cli.Context) {
@@ -121,6 +349,7 @@ func doVolumeCreate(c *cli.Context) error {
 	size, err := getSize(c, err)
 	driverName, err := util.GetFlag(c, "driver", false, err)
 	backupURL, err := util.GetFlag(c, "backup", false, err)
+	snapshotName, err := util.GetFlag(c, "snapshot", false, err)
 	if err != nil {
 		return err
 	}
@@ -131,26 +360,315 @@ func doVolumeCreate(c *cli.Context) error {
 		fsType         = c.String("fs")
 		iops           = c.Int("iops")
 		prepareForVM   = c.Bool("vm")
+		profile        = c.String("profile")
 	)
+	// Leave the filesystem to the profile unless it's specified
+	if profile != "" && !c.IsSet("fs") {
+		fsType = ""
+	}
+
+	labels := util.SliceToMap(c.StringSlice("label"))
+	if labels == nil {
+		return fmt.Errorf("Invalid label, must be in key=value format")
+	}
+
+	mountOptions := ""
+	throughput := int64(0)
+	readOnly := false
+	encrypted := false
+	kmsKeyID := ""
+	uid, gid, mode := "", "", ""
+	var tags map[string]string
+	for _, opt := range c.StringSlice("opt") {
+		// Value may contain "=" itself, e.g. mountopts=vers=4.1
+		pair := strings.SplitN(opt, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("Invalid option %v, must be in key=value format", opt)
+		}
+		switch pair[0] {
+		case "mountopts":
+			mountOptions = pair[1]
+		case "tags":
+			if tags, err = util.ParseTags(pair[1]); err != nil {
+				return err
+			}
+		case "iops", "throughput":
+			value, err := strconv.ParseInt(pair[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid %v %v: %v", pair[0], pair[1], err)
+			}
+			if pair[0] == "iops" {
+				iops = int(value)
+			} else {
+				throughput = value
+			}
+		case "ro":
+			if readOnly, err = parseReadOnly(pair[1]); err != nil {
+				return err
+			}
+		case "encrypted":
+			if encrypted, err = strconv.ParseBool(pair[1]); err != nil {
+				return fmt.Errorf("Invalid encrypted %v, must be true or false", pair[1])
+			}
+		case "kmskeyid":
+			kmsKeyID = pair[1]
+		case "uid":
+			uid = pair[1]
+		case "gid":
+			gid = pair[1]
+		case "mode":
+			mode = pair[1]
+		default:
+			return fmt.Errorf("Unsupported option %v", pair[0])
+		}
+	}
+
+	key, err := getEncryptionKey(c)
+	if err != nil {
+		return err
+	}
 
 	request := &api.VolumeCreateRequest{
 		Name:           name,
 		DriverName:     driverName,
 		Size:           size,
 		BackupURL:      backupURL,
+		SnapshotName:   snapshotName,
 		DriverVolumeID: driverVolumeID,
 		Type:           volumeType,
 		FSType:         fsType,
 		IOPS:           int64(iops),
+		Throughput:     throughput,
 		PrepareForVM:   prepareForVM,
-		Verbose:        c.GlobalBool(verboseFlag),
+		Labels:         labels,
+		MountOptions:   mountOptions,
+		ReadOnly:       readOnly,
+		EncryptionKey:  key,
+		Tags:           tags,
+		Encrypted:      encrypted,
+		KmsKeyID:       kmsKeyID,
+		UID:            uid,
+		GID:            gid,
+		Mode:           mode,
+		Profile:        profile,
+		Verbose:        isVerbose(c),
 	}
 
-	url := "/volumes/create"
+	url := requestURL(c, "/volumes/create")
 
 	return sendRequestAndPrint("POST", url, request)
 }
 
+func cmdVolumeImport(c *cli.Context) {
+	if err := doVolumeImport(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeImport(c *cli.Context) error {
+	var err error
+
+	name, err := getName(c, "", true)
+	driverName, err := util.GetFlag(c, "driver", false, err)
+	source, err := util.GetFlag(c, "source", true, err)
+	if err != nil {
+		return err
+	}
+
+	labels := util.SliceToMap(c.StringSlice("label"))
+	if labels == nil {
+		return fmt.Errorf("Invalid label, must be in key=value format")
+	}
+
+	mountOptions := ""
+	readOnly := false
+	for _, opt := range c.StringSlice("opt") {
+		pair := strings.SplitN(opt, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("Invalid option %v, must be in key=value format", opt)
+		}
+		switch pair[0] {
+		case "mountopts":
+			mountOptions = pair[1]
+		case "ro":
+			if readOnly, err = parseReadOnly(pair[1]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unsupported option %v", pair[0])
+		}
+	}
+
+	request := &api.VolumeImportRequest{
+		Name:         name,
+		DriverName:   driverName,
+		Source:       source,
+		Labels:       labels,
+		MountOptions: mountOptions,
+		ReadOnly:     readOnly,
+		Verbose:      isVerbose(c),
+	}
+
+	url := requestURL(c, "/volumes/import")
+
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdVolumeClone(c *cli.Context) {
+	if err := doVolumeClone(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeClone(c *cli.Context) error {
+	if len(c.Args()) != 2 {
+		return fmt.Errorf("Source volume and the name of new volume are required")
+	}
+	names, err := getNames(c)
+	if err != nil {
+		return err
+	}
+
+	labels := util.SliceToMap(c.StringSlice("label"))
+	if labels == nil {
+		return fmt.Errorf("Invalid label, must be in key=value format")
+	}
+
+	request := &api.VolumeCloneRequest{
+		Name:       names[1],
+		VolumeName: names[0],
+		Labels:     labels,
+		Verbose:    isVerbose(c),
+	}
+
+	url := requestURL(c, "/volumes/clone")
+
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdVolumeMigrate(c *cli.Context) {
+	if err := doVolumeMigrate(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeMigrate(c *cli.Context) error {
+	var err error
+
+	name, err := getName(c, "", true)
+	driverName, err := util.GetFlag(c, "to-driver", true, err)
+	size, err := getSize(c, err)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeMigrateRequest{
+		VolumeName: name,
+		DriverName: driverName,
+		Size:       size,
+		Type:       c.String("type"),
+		FSType:     c.String("fs"),
+	}
+	for _, opt := range c.StringSlice("opt") {
+		pair := strings.SplitN(opt, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("Invalid option %v, must be in key=value format", opt)
+		}
+		switch pair[0] {
+		case "mountopts":
+			request.MountOptions = pair[1]
+		case "tags":
+			if request.Tags, err = util.ParseTags(pair[1]); err != nil {
+				return err
+			}
+		case "iops", "throughput":
+			value, err := strconv.ParseInt(pair[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid %v %v: %v", pair[0], pair[1], err)
+			}
+			if pair[0] == "iops" {
+				request.IOPS = value
+			} else {
+				request.Throughput = value
+			}
+		case "encrypted":
+			if request.Encrypted, err = strconv.ParseBool(pair[1]); err != nil {
+				return fmt.Errorf("Invalid encrypted %v, must be true or false", pair[1])
+			}
+		case "kmskeyid":
+			request.KmsKeyID = pair[1]
+		default:
+			return fmt.Errorf("Unsupported option %v", pair[0])
+		}
+	}
+	request.Verbose = isVerbose(c)
+
+	url := requestURL(c, "/volumes/migrate")
+
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdVolumeExport(c *cli.Context) {
+	if err := doVolumeExport(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeExport(c *cli.Context) error {
+	name, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+	compression := c.String("compression")
+	if err := util.ValidateCompression(compression); err != nil {
+		return err
+	}
+
+	request := &api.VolumeExportRequest{
+		VolumeName:  name,
+		Compression: compression,
+	}
+	rc, err := sendRequest("GET", "/volumes/export", request)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	output := c.String("output")
+	if output == "-" {
+		_, err := io.Copy(os.Stdout, rc)
+		return err
+	}
+	// Incomplete tarball is never left at output
+	tmpFile := output + ".tmp"
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, rc); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, output)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
+
+func parseReadOnly(value string) (bool, error) {
+	readOnly, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid ro %v, must be true or false", value)
+	}
+	return readOnly, nil
+}
+
 func cmdVolumeDelete(c *cli.Context) {
 	if err := doVolumeDelete(c); err != nil {
 		panic(err)
@@ -169,6 +687,7 @@ func doVolumeDelete(c *cli.Context) error {
 		request := &api.VolumeDeleteRequest{
 			VolumeName:    name,
 			ReferenceOnly: c.Bool("reference"),
+			Purge:         c.Bool("purge"),
 		}
 
 		url := "/volumes/"
@@ -194,6 +713,9 @@ func doVolumeList(c *cli.Context) error {
 	if c.Bool("driver") {
 		v.Set("driver", "1")
 	}
+	for _, filter := range c.StringSlice("filter") {
+		v.Add("filter", filter)
+	}
 
 	url := "/volumes/list?" + v.Encode()
 	return sendRequestAndPrint("GET", url, nil)
@@ -231,20 +753,61 @@ func doVolumeMount(c *cli.Context) error {
 
 	volumeName, err := getName(c, "", true)
 	mountPoint, err := util.GetFlag(c, "mountpoint", false, err)
+	timeout, err := util.GetFlag(c, "timeout", false, err)
 	if err != nil {
 		return err
 	}
 
+	readOnly := false
+	for _, opt := range c.StringSlice("opt") {
+		pair := strings.SplitN(opt, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("Invalid option %v, must be in key=value format", opt)
+		}
+		if pair[0] != "ro" {
+			return fmt.Errorf("Unsupported option %v", pair[0])
+		}
+		if readOnly, err = parseReadOnly(pair[1]); err != nil {
+			return err
+		}
+	}
+
 	request := &api.VolumeMountRequest{
 		VolumeName: volumeName,
 		MountPoint: mountPoint,
-		Verbose:    c.GlobalBool(verboseFlag),
+		Timeout:    timeout,
+		ReadOnly:   readOnly,
+		Verbose:    isVerbose(c),
 	}
 
 	url := "/volumes/mount"
 	return sendRequestAndPrint("POST", url, request)
 }
 
+func cmdVolumeResize(c *cli.Context) {
+	if err := doVolumeResize(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeResize(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	size, err := util.GetFlag(c, "size", true, err)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeResizeRequest{
+		VolumeName: volumeName,
+		Size:       size,
+	}
+
+	url := "/volumes/resize"
+	return sendRequestAndPrint("POST", url, request)
+}
+
 func cmdVolumeUmount(c *cli.Context) {
 	if err := doVolumeUmount(c); err != nil {
 		panic(err)
@@ -265,3 +828,156 @@ func doVolumeUmount(c *cli.Context) error {
 	url := "/volumes/umount"
 	return sendRequestAndPrint("POST", url, request)
 }
+
+func cmdVolumeBackups(c *cli.Context) {
+	if err := doVolumeBackups(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeBackups(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeBackupsRequest{
+		VolumeName: volumeName,
+	}
+	url := "/volumes/backups"
+	return sendRequestAndPrint("GET", url, request)
+}
+
+func cmdVolumeRefresh(c *cli.Context) {
+	if err := doVolumeRefresh(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeRefresh(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeRefreshRequest{
+		VolumeName: volumeName,
+		Verbose:    isVerbose(c),
+	}
+	url := "/volumes/refresh"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdVolumeRetention(c *cli.Context) {
+	if err := doVolumeRetention(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeRetention(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeRetentionRequest{
+		VolumeName: volumeName,
+		KeepLast:   c.Int("keep-last"),
+		KeepDaily:  c.Int("keep-daily"),
+		KeepWeekly: c.Int("keep-weekly"),
+	}
+	url := "/volumes/retention"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdVolumeForceUmount(c *cli.Context) {
+	if err := doVolumeForceUmount(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeForceUmount(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeForceUmountRequest{
+		VolumeName: volumeName,
+		Kill:       c.Bool("kill"),
+	}
+	url := "/volumes/force-umount"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdVolumeFence(c *cli.Context) {
+	if err := doVolumeFence(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeFence(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeFenceRequest{
+		VolumeName: volumeName,
+		Kill:       c.Bool("kill"),
+	}
+	url := "/volumes/fence"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdVolumeUnfence(c *cli.Context) {
+	if err := doVolumeUnfence(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeUnfence(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeUnfenceRequest{
+		VolumeName: volumeName,
+	}
+	url := "/volumes/unfence"
+	return sendRequestAndPrint("POST", url, request)
+}
+
+func cmdVolumeStats(c *cli.Context) {
+	if err := doVolumeStats(c); err != nil {
+		panic(err)
+	}
+}
+
+func doVolumeStats(c *cli.Context) error {
+	var err error
+
+	volumeName, err := getName(c, "", true)
+	if err != nil {
+		return err
+	}
+
+	request := &api.VolumeStatsRequest{
+		VolumeName: volumeName,
+	}
+	url := "/volumes/stats"
+	return sendRequestAndPrint("GET", url, request)
+}
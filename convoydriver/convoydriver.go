@@ -1,6 +1,7 @@
 package convoydriver
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 
@@ -38,11 +39,31 @@ type ConvoyDriver interface {
 type Request struct {
 	Name    string
 	Options map[string]string
+	// Ctx is done once the operation times out, drivers should pass it to
+	// the commands they execute, see Context()
+	Ctx context.Context
+}
+
+// Context returns the context of request, which is never done if it's not
+// set
+func (r Request) Context() context.Context {
+	if r.Ctx == nil {
+		return context.Background()
+	}
+	return r.Ctx
 }
 
 /*
 VolumeOperations is Convoy Driver volume related operations interface. Any
 Convoy Driver must implement this interface.
+
+RefreshMountPoint() should compare the recorded mount point of the volume with
+the actual mount state of the host, correct the record if the volume has been
+mounted or umounted outside of Convoy, then return the corrected mount point.
+
+ResizeVolume() should grow the volume to the size specified by
+req.Options[OPT_SIZE], as well as the filesystem on it. Shrinking is not
+supported.
 */
 type VolumeOperations interface {
 	Name() string
@@ -51,6 +72,8 @@ type VolumeOperations interface {
 	MountVolume(req Request) (string, error)
 	UmountVolume(req Request) error
 	MountPoint(req Request) (string, error)
+	RefreshMountPoint(req Request) (string, error)
+	ResizeVolume(req Request) error
 	GetVolumeInfo(name string) (map[string]string, error)
 	ListVolume(opts map[string]string) (map[string]map[string]string, error)
 }
@@ -58,6 +81,9 @@ type VolumeOperations interface {
 /*
 SnapshotOperations is Convoy Driver snapshot related operations interface. Any
 Convoy Driver want to operate snapshots must implement this interface.
+Creating a volume from a local snapshot would need to be implemented in
+VolumeOperations.CreateVolume() with opts[OPT_SNAPSHOT_NAME] and
+opts[OPT_SNAPSHOT_VOLUME_NAME], drivers cannot do it should reject the request.
 */
 type SnapshotOperations interface {
 	Name() string
@@ -81,8 +107,134 @@ type BackupOperations interface {
 	ListBackup(destURL string, opts map[string]string) (map[string]map[string]string, error)
 }
 
+/*
+HealthChecker can be implemented by ConvoyDriver to report the health of its
+backend. CheckHealth() should only run lightweight checks, e.g. whether the
+storage is reachable and has free space, since it may be polled frequently by
+orchestrators.
+*/
+type HealthChecker interface {
+	CheckHealth() []HealthCheck
+}
+
+// HealthCheck is the result of one check, Error is nil if it passed
+type HealthCheck struct {
+	Name  string
+	Error error
+}
+
+/*
+SpaceReporter can be implemented by ConvoyDriver to report the bytes
+available for new volumes, so restoring a backup which doesn't fit can fail
+before writing anything.
+*/
+type SpaceReporter interface {
+	GetFreeSpace() (int64, error)
+}
+
+/*
+OrphanMountCleaner can be implemented by ConvoyDriver which mounts volumes at
+a directory of its own. CleanupOrphanMounts() should umount the filesystems
+left there which are not the recorded mount point of any volume, and return
+the umounted mount points. It's called after the mount points of volumes have
+been refreshed.
+*/
+type OrphanMountCleaner interface {
+	CleanupOrphanMounts() ([]string, error)
+}
+
+/*
+VolumeImporter can be implemented by VolumeOperations which can adopt data
+created outside of Convoy as a volume without copying it, e.g. an existing
+directory or device identified by req.Options[OPT_IMPORT_SOURCE]. The data
+should be left intact, and ImportVolume() should fail if it's not usable.
+*/
+type VolumeImporter interface {
+	ImportVolume(req Request) error
+}
+
+/*
+VolumeCloner can be implemented by VolumeOperations which can create a
+writable copy of a volume of the same driver, identified by
+req.Options[OPT_CLONE_SOURCE], while it may be in use. The copy should be a
+consistent point in time of the source, and share the data with it where the
+backend allows, e.g. by thin snapshot or reflink.
+*/
+type VolumeCloner interface {
+	CloneVolume(req Request) error
+}
+
+/*
+VolumeForceUmounter can be implemented by VolumeOperations to umount a volume
+when UmountVolume() hangs or fails, e.g. because its storage is unreachable
+or processes keep using it. ForceUmountVolume() should umount the filesystem
+lazily, after killing the processes using it if req.Options[OPT_KILL] is
+"true", and forget the mount point. It must not wait for the operations in
+progress on the volume, since they may be the ones hanging.
+*/
+type VolumeForceUmounter interface {
+	ForceUmountVolume(req Request) error
+}
+
+/*
+VolumeFencer can be implemented by VolumeOperations whose volumes are
+attached to the host by the backend, e.g. EBS volumes or iSCSI sessions.
+FenceVolume() is called after the volume is force umounted, and should
+detach it from the host by force, so another host can attach it safely. The
+volume is left the way the driver leaves a volume detached by UmountVolume()
+or DeleteVolume(), e.g. ebs forgets it, while iscsi logs in again to mount
+it.
+*/
+type VolumeFencer interface {
+	FenceVolume(req Request) error
+}
+
+const (
+	FILE_CHANGE_ADDED    = "added"
+	FILE_CHANGE_MODIFIED = "modified"
+	FILE_CHANGE_DELETED  = "deleted"
+)
+
+// FileChange is a file changed between snapshots, Path is relative to the
+// root of volume
+type FileChange struct {
+	Path   string
+	Change string
+	// Size of the file in the later snapshot, zero if it's deleted
+	Size int64
+}
+
+// Extent is a range of changed bytes of a block device
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+/*
+SnapshotDiff is the change from a snapshot to a later one of the same volume.
+Drivers storing files report Files, and drivers storing blocks report
+Extents. ChangedBytes is the amount of data an incremental backup would
+transfer, i.e. the size of added and modified files, or the length of
+extents.
+*/
+type SnapshotDiff struct {
+	Files        []FileChange
+	Extents      []Extent
+	ChangedBytes int64
+}
+
+/*
+SnapshotDiffer can be implemented by SnapshotOperations which can tell the
+change between snapshots, from the snapshot of
+req.Options[OPT_COMPARE_SNAPSHOT_NAME] to the snapshot of req.Name.
+*/
+type SnapshotDiffer interface {
+	DiffSnapshot(req Request) (*SnapshotDiff, error)
+}
+
 const (
 	OPT_MOUNT_POINT           = "MountPoint"
+	OPT_MOUNT_TIMEOUT         = "MountTimeout"
 	OPT_SIZE                  = "Size"
 	OPT_FORMAT                = "Format"
 	OPT_VOLUME_NAME           = "VolumeName"
@@ -90,13 +242,53 @@ const (
 	OPT_VOLUME_TYPE           = "VolumeType"
 	OPT_VOLUME_FS_TYPE        = "VolumeFSType"
 	OPT_VOLUME_IOPS           = "VolumeIOPS"
+	OPT_VOLUME_THROUGHPUT     = "VolumeThroughput"
 	OPT_VOLUME_CREATED_TIME   = "VolumeCreatedAt"
 	OPT_SNAPSHOT_NAME         = "SnapshotName"
 	OPT_SNAPSHOT_CREATED_TIME = "SnapshotCreatedAt"
+	OPT_SNAPSHOT_VOLUME_NAME  = "SnapshotVolumeName"
 	OPT_BACKUP_URL            = "BackupURL"
 	OPT_REFERENCE_ONLY        = "ReferenceOnly"
 	OPT_PREPARE_FOR_VM        = "PrepareForVM"
 	OPT_FILESYSTEM            = "Filesystem"
+	OPT_ENCRYPTION_KEY_ID     = "EncryptionKeyID"
+	OPT_MOUNT_OPTIONS         = "MountOptions"
+	// Mount read-only, always if it's specified when creating the volume
+	OPT_READ_ONLY = "ReadOnly"
+	// Algorithm to compress snapshot or backup with, see util.COMPRESSION_*
+	OPT_COMPRESSION = "Compression"
+	// Existing data to be imported as volume, see VolumeImporter
+	OPT_IMPORT_SOURCE = "ImportSource"
+	// Volume to be copied as the new volume, see VolumeCloner
+	OPT_CLONE_SOURCE = "CloneSource"
+	// Earlier snapshot to compare with, see SnapshotDiffer
+	OPT_COMPARE_SNAPSHOT_NAME = "CompareSnapshotName"
+	// Tags of the created volume or snapshot in the backend, see
+	// util.ParseTags()
+	OPT_TAGS = "Tags"
+	// Encrypt the volume in the backend, by the key of OPT_KMS_KEY_ID if
+	// it's specified. Not to be confused with the encryption of backups.
+	OPT_ENCRYPTED  = "Encrypted"
+	OPT_KMS_KEY_ID = "KmsKeyID"
+	// Numeric owner and octal permission of the root directory of volume,
+	// see util.ParseVolumeOwnership()
+	OPT_UID  = "UID"
+	OPT_GID  = "GID"
+	OPT_MODE = "Mode"
+	// Kill the processes using the volume, see VolumeForceUmounter
+	OPT_KILL = "Kill"
+
+	// Bytes of storage actually consumed by the volume, and bytes reserved
+	// for it, e.g. the virtual size of a thin provisioned device
+	OPT_USED_SIZE      = "UsedSize"
+	OPT_ALLOCATED_SIZE = "AllocatedSize"
+
+	// Options of ListBackup(), see objectstore.ListOptions
+	OPT_LIST_LIMIT    = "ListLimit"
+	OPT_LIST_MARKER   = "ListMarker"
+	OPT_LIST_NO_CACHE = "ListNoCache"
+	OPT_CREATED_SINCE = "CreatedSince"
+	OPT_CREATED_UNTIL = "CreatedUntil"
 )
 
 var (
@@ -0,0 +1,262 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rancher/convoy/api"
+)
+
+const (
+	AUDIT_LOG_FILE = "audit.log"
+
+	AUDIT_OUTCOME_SUCCESS = "success"
+	AUDIT_OUTCOME_FAILURE = "failure"
+
+	// Only the beginning of response is kept to find out the error
+	AUDIT_MAX_RESPONSE_SIZE = 4096
+)
+
+/*
+AuditRecord is one line of audit log, written after a mutating request has
+been handled. Asynchronous requests are recorded when the job is accepted,
+the result of the job can be found by "convoy job".
+*/
+type AuditRecord struct {
+	Time       string
+	Requester  string
+	RequestID  string `json:",omitempty"`
+	Method     string
+	Path       string
+	Route      string
+	Parameters json.RawMessage `json:",omitempty"`
+	Status     int
+	Outcome    string
+	Error      string `json:",omitempty"`
+}
+
+// auditLog appends records as JSON lines to the file
+type auditLog struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{
+		path: path,
+		file: file,
+	}, nil
+}
+
+func (a *auditLog) close() error {
+	return a.file.Close()
+}
+
+func (a *auditLog) append(record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+// list returns records logged at or after since
+func (a *auditLog) list(since time.Time) ([]AuditRecord, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Warnf("Skip invalid line in audit log %v: %v", a.path, err)
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, record.Time)
+		if err != nil || t.Before(since) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+type connContextKey struct{}
+
+// saveConnInContext is used as http.Server.ConnContext, so the peer of the
+// request can be found out later
+func saveConnInContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:     handler,
+		ConnContext: saveConnInContext,
+	}
+}
+
+// getRequester describes the peer of unix socket by its credentials, or the
+// peer of TCP endpoint by its address and client certificate
+func getRequester(r *http.Request) string {
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		if cred, err := getPeerCred(unixConn); err == nil {
+			return fmt.Sprintf("uid=%v gid=%v pid=%v", cred.Uid, cred.Gid, cred.Pid)
+		}
+		return "unix"
+	}
+	requester := r.RemoteAddr
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		requester += " cn=" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return requester
+}
+
+func getPeerCred(conn *net.UnixConn) (*syscall.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// auditResponseWriter keeps the status and the beginning of response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	if left := AUDIT_MAX_RESPONSE_SIZE - w.body.Len(); left > 0 {
+		if len(data) < left {
+			left = len(data)
+		}
+		w.body.Write(data[:left])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// responseError returns the error reported by the response, either by the
+// status code or by "Err" field of Docker plugin response
+func (w *auditResponseWriter) responseError() string {
+	if w.status >= http.StatusBadRequest {
+		return strings.TrimSpace(w.body.String())
+	}
+	resp := struct {
+		Err string
+	}{}
+	if err := json.Unmarshal(w.body.Bytes(), &resp); err == nil {
+		return resp.Err
+	}
+	return ""
+}
+
+// auditHandlerFunc records the request to route handled by next in audit log
+func (s *daemon) auditHandlerFunc(route string, next http.HandlerFunc) http.HandlerFunc {
+	if s.audit == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var params []byte
+		if r.Body != nil {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, api.NewError(api.ERROR_CODE_INVALID_REQUEST, "%v", err), 0)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(data))
+			params = data
+		}
+
+		aw := &auditResponseWriter{
+			ResponseWriter: w,
+			status:         http.StatusOK,
+		}
+		next(aw, r)
+
+		record := &AuditRecord{
+			Time:      time.Now().UTC().Format(time.RFC3339Nano),
+			Requester: getRequester(r),
+			RequestID: getRequestID(r),
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Route:     route,
+			Status:    aw.status,
+			Outcome:   AUDIT_OUTCOME_SUCCESS,
+			Error:     aw.responseError(),
+		}
+		if len(bytes.TrimSpace(params)) != 0 && json.Valid(params) {
+			record.Parameters = json.RawMessage(params)
+		}
+		if record.Error != "" {
+			record.Outcome = AUDIT_OUTCOME_FAILURE
+		}
+		if err := s.audit.append(record); err != nil {
+			log.Errorf("Failed to write audit log for %v %v: %v", r.Method, r.URL.Path, err)
+		}
+	}
+}
+
+func (s *daemon) doAuditList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	if s.audit == nil {
+		return fmt.Errorf("Audit log is not enabled")
+	}
+	since := time.Time{}
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return fmt.Errorf("Invalid time %v, must be in RFC3339 format: %v", value, err)
+		}
+	}
+	records, err := s.audit.list(since)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, records)
+}
@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestAuditLog(c *C) {
+	d := s.newVFSDaemon(c)
+	audit, err := openAuditLog(filepath.Join(s.root, AUDIT_LOG_FILE))
+	c.Assert(err, IsNil)
+	defer audit.close()
+	d.audit = audit
+
+	handler := d.auditHandlerFunc("/volumes/create", func(w http.ResponseWriter, r *http.Request) {
+		request := struct {
+			Name string
+		}{}
+		if err := decodeRequest(r, &request); err != nil || request.Name == "bad" {
+			http.Error(w, "invalid volume", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(request.Name))
+	})
+	pluginHandler := d.auditHandlerFunc("/VolumeDriver.Mount", func(w http.ResponseWriter, r *http.Request) {
+		dockerResponse(w, "", fmt.Errorf("Couldn't find volume."))
+	})
+
+	start := time.Now()
+	for _, name := range []string{"vol1", "bad"} {
+		req := httptest.NewRequest("POST", "/v1/volumes/create", bytes.NewBufferString(`{"Name":"`+name+`"}`))
+		handler(httptest.NewRecorder(), req)
+	}
+	pluginHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/VolumeDriver.Mount", bytes.NewBufferString(`{"Name":"vol2"}`)))
+
+	records, err := audit.list(time.Time{})
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+
+	c.Assert(records[0].Route, Equals, "/volumes/create")
+	c.Assert(records[0].Method, Equals, "POST")
+	c.Assert(string(records[0].Parameters), Equals, `{"Name":"vol1"}`)
+	c.Assert(records[0].Status, Equals, http.StatusOK)
+	c.Assert(records[0].Outcome, Equals, AUDIT_OUTCOME_SUCCESS)
+	c.Assert(records[0].Requester, Not(Equals), "")
+
+	c.Assert(records[1].Status, Equals, http.StatusBadRequest)
+	c.Assert(records[1].Outcome, Equals, AUDIT_OUTCOME_FAILURE)
+	c.Assert(records[1].Error, Equals, "invalid volume")
+
+	c.Assert(records[2].Route, Equals, "/VolumeDriver.Mount")
+	c.Assert(records[2].Outcome, Equals, AUDIT_OUTCOME_FAILURE)
+	c.Assert(records[2].Error, Equals, "Couldn't find volume.")
+
+	records, err = audit.list(start.Add(-time.Second))
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	records, err = audit.list(time.Now().Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+}
@@ -0,0 +1,97 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	AUTH_HEADER        = "Authorization"
+	AUTH_BEARER_PREFIX = "Bearer "
+)
+
+/*
+The unix socket is protected by its file permission, and it's the one used by
+Docker, so it never requires authentication. The optional TCP endpoint must
+verify client certificates, or require a bearer token, or both.
+*/
+
+func loadAuthToken(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Empty auth token in %v", file)
+	}
+	return token, nil
+}
+
+// tokenAuthHandler rejects requests without "Authorization: Bearer <token>"
+func tokenAuthHandler(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get(AUTH_HEADER)
+		if !strings.HasPrefix(auth, AUTH_BEARER_PREFIX) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, AUTH_BEARER_PREFIX)), []byte(token)) != 1 {
+			log.Warnf("Rejected unauthenticated request %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, api.NewError(api.ERROR_CODE_UNAUTHORIZED, "Unauthorized"), 0)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenTCP returns the listener and handler of TCP endpoint specified by
+// --listen, or nil listener if it's not specified
+func (s *daemon) listenTCP(c *cli.Context) (net.Listener, http.Handler, error) {
+	addr := c.String("listen")
+	if addr == "" {
+		return nil, nil, nil
+	}
+	caFile := c.String("tlscacert")
+	certFile := c.String("tlscert")
+	keyFile := c.String("tlskey")
+	tokenFile := c.String("auth-token-file")
+	if caFile == "" && tokenFile == "" {
+		return nil, nil, fmt.Errorf("Refuse to listen on %v without client certificate verification(--tlscacert) or token authentication(--auth-token-file)", addr)
+	}
+
+	var handler http.Handler = s.Router
+	if tokenFile != "" {
+		token, err := loadAuthToken(tokenFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		handler = tokenAuthHandler(token, handler)
+	}
+
+	var tlsConfig *tls.Config
+	if certFile != "" || keyFile != "" || caFile != "" {
+		var err error
+		if tlsConfig, err = util.NewServerTLSConfig(caFile, certFile, keyFile); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		log.Warnf("TLS is not enabled for %v, auth token would be sent in plain text", addr)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	return l, handler, nil
+}
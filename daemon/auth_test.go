@@ -0,0 +1,50 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestTokenAuthHandler(c *C) {
+	handler := tokenAuthHandler("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	for auth, code := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Bearer secre":  http.StatusUnauthorized,
+		"Basic secret":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/v1/info", nil)
+		if auth != "" {
+			req.Header.Set(AUTH_HEADER, auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, code, Commentf("Authorization: %v", auth))
+	}
+}
+
+func (s *TestSuite) TestLoadAuthToken(c *C) {
+	dir, err := ioutil.TempDir("", "convoy-auth")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "token")
+	c.Assert(ioutil.WriteFile(file, []byte("secret\n"), 0600), IsNil)
+	token, err := loadAuthToken(file)
+	c.Assert(err, IsNil)
+	c.Assert(token, Equals, "secret")
+
+	c.Assert(ioutil.WriteFile(file, []byte(" \n"), 0600), IsNil)
+	_, err = loadAuthToken(file)
+	c.Assert(err, ErrorMatches, "Empty auth token in .*")
+}
@@ -0,0 +1,360 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+const (
+	CLUSTER_HOST_CFG_PREFIX       = "host_"
+	CLUSTER_ATTACHMENT_CFG_PREFIX = "attachment_"
+)
+
+/*
+In cluster mode, enabled by --cluster-host, daemons on different hosts share
+the metadata store, so volume configs, policies and schedules are the same
+everywhere. Every daemon publishes the volumes its drivers report as a
+clusterHost, so volumes of all hosts are listed by any of them.
+
+Volumes of drivers not in sharedVolumeDrivers can only be used by one host
+at a time. Mounting one records a clusterAttachment with the host, and it's
+refused while another host holds the attachment.
+*/
+
+// sharedVolumeDrivers are the drivers whose volumes are on storage shared
+// by the hosts, e.g. NFS, so they can be mounted by several hosts at once
+var sharedVolumeDrivers = map[string]bool{
+	"vfs":       true,
+	"glusterfs": true,
+}
+
+type clusterVolume struct {
+	Driver      string
+	MountPoint  string
+	CreatedTime string
+}
+
+type clusterHost struct {
+	Name        string
+	UpdatedTime string
+	Volumes     map[string]clusterVolume
+
+	configPath string
+}
+
+func (h *clusterHost) ConfigFile() (string, error) {
+	if h.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty cluster host name")
+	}
+	if h.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty cluster host config path")
+	}
+	return filepath.Join(h.configPath, CLUSTER_HOST_CFG_PREFIX+h.Name+CFG_POSTFIX), nil
+}
+
+type clusterAttachment struct {
+	Volume       string
+	Host         string
+	AttachedTime string
+
+	configPath string
+}
+
+func (a *clusterAttachment) ConfigFile() (string, error) {
+	if a.Volume == "" {
+		return "", fmt.Errorf("BUG: Invalid empty attachment volume name")
+	}
+	if a.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty attachment config path")
+	}
+	return filepath.Join(a.configPath, CLUSTER_ATTACHMENT_CFG_PREFIX+a.Volume+CFG_POSTFIX), nil
+}
+
+func validateClusterHost(host, storeURL string) error {
+	if host == "" {
+		return nil
+	}
+	if !util.ValidateName(host) {
+		return fmt.Errorf("Invalid cluster host name %v", host)
+	}
+	if !isSharedStore(storeURL) {
+		return fmt.Errorf("Cluster mode requires a metadata store shared by the hosts, specified by --metadata-store etcd://host:port/prefix")
+	}
+	return nil
+}
+
+func (s *daemon) clusterMode() bool {
+	return s.ClusterHost != ""
+}
+
+func (s *daemon) needsAttachment(volume *Volume) bool {
+	return s.clusterMode() && !sharedVolumeDrivers[volume.DriverName]
+}
+
+// claimAttachment records volume is attached to this host, or fails if
+// it's attached to another one
+func (s *daemon) claimAttachment(volume *Volume) error {
+	if !s.needsAttachment(volume) {
+		return nil
+	}
+	attachment := &clusterAttachment{
+		Volume:     volume.Name,
+		configPath: s.Root,
+	}
+	key, err := objectKey(attachment)
+	if err != nil {
+		return err
+	}
+	return s.store.Update(key, func(value []byte) ([]byte, error) {
+		if value != nil {
+			current := &clusterAttachment{}
+			if err := json.Unmarshal(value, current); err != nil {
+				return nil, err
+			}
+			if current.Host == s.ClusterHost {
+				return nil, nil
+			}
+			if current.Host != "" {
+				return nil, api.NewError(api.ERROR_CODE_IN_USE, "Volume %v is attached to host %v since %v",
+					volume.Name, current.Host, current.AttachedTime).WithDetail("volume", volume.Name).WithDetail("host", current.Host)
+			}
+		}
+		attachment.Host = s.ClusterHost
+		attachment.AttachedTime = util.Now()
+		return encodeObject(attachment)
+	})
+}
+
+// releaseAttachment removes the attachment of volume if it's held by this
+// host
+func (s *daemon) releaseAttachment(volumeName string) error {
+	attachment, err := s.loadAttachment(volumeName)
+	if err != nil || attachment == nil || attachment.Host != s.ClusterHost {
+		return err
+	}
+	return s.deleteObject(attachment)
+}
+
+// releaseUnmountedAttachment releases the attachment claimed for a mount
+// which failed, unless volume is still mounted by an earlier one
+func (s *daemon) releaseUnmountedAttachment(volOps VolumeOperations, volume *Volume) {
+	if !s.needsAttachment(volume) {
+		return
+	}
+	mountPoint, err := volOps.MountPoint(Request{
+		Name:    volume.Name,
+		Options: map[string]string{},
+	})
+	if err != nil || mountPoint != "" {
+		return
+	}
+	if err := s.releaseAttachment(volume.Name); err != nil {
+		log.Errorf("Failed to release attachment of volume %v: %v", volume.Name, err)
+	}
+}
+
+// loadAttachment returns nil if volume isn't attached to any host
+func (s *daemon) loadAttachment(volumeName string) (*clusterAttachment, error) {
+	attachment := &clusterAttachment{
+		Volume:     volumeName,
+		configPath: s.Root,
+	}
+	if err := s.loadObject(attachment); err != nil {
+		if util.IsNotExistsError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// listAttachments returns the hosts attached volumes by volume names
+func (s *daemon) listAttachments() (map[string]string, error) {
+	names, err := s.listObjectNames(CLUSTER_ATTACHMENT_CFG_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	for _, name := range names {
+		attachment, err := s.loadAttachment(name)
+		if err != nil {
+			return nil, err
+		}
+		if attachment != nil {
+			result[name] = attachment.Host
+		}
+	}
+	return result, nil
+}
+
+// publishClusterHost saves the volumes of this host for the other hosts.
+// Failure only makes the view of others stale, so it's logged.
+func (s *daemon) publishClusterHost() {
+	if !s.clusterMode() {
+		return
+	}
+	host := &clusterHost{
+		Name:        s.ClusterHost,
+		UpdatedTime: util.Now(),
+		Volumes:     map[string]clusterVolume{},
+		configPath:  s.Root,
+	}
+	for name, info := range s.getVolumeList() {
+		host.Volumes[name] = clusterVolume{
+			Driver:      info["Driver"],
+			MountPoint:  info["MountPoint"],
+			CreatedTime: info[OPT_VOLUME_CREATED_TIME],
+		}
+	}
+	if err := s.saveObject(host); err != nil {
+		log.Errorf("Failed to publish volumes of host %v to cluster: %v", s.ClusterHost, err)
+	}
+}
+
+// listClusterHosts returns the hosts other than this one
+func (s *daemon) listClusterHosts() ([]*clusterHost, error) {
+	names, err := s.listObjectNames(CLUSTER_HOST_CFG_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []*clusterHost{}
+	for _, name := range names {
+		if name == s.ClusterHost {
+			continue
+		}
+		host := &clusterHost{
+			Name:       name,
+			configPath: s.Root,
+		}
+		if err := s.loadObject(host); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// checkClusterVolumeName fails if a volume of name not on shared storage is
+// reported by another host, since volume configs are shared by name
+func (s *daemon) checkClusterVolumeName(name, driverName string) error {
+	if !s.clusterMode() {
+		return nil
+	}
+	hosts, err := s.listClusterHosts()
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		volume, exists := host.Volumes[name]
+		if !exists {
+			continue
+		}
+		if !sharedVolumeDrivers[volume.Driver] || volume.Driver != driverName {
+			return api.NewError(api.ERROR_CODE_CONFLICT, "Volume %v of driver %v already exists on host %v",
+				name, volume.Driver, host.Name).WithDetail("volume", name).WithDetail("host", host.Name)
+		}
+	}
+	return nil
+}
+
+// addClusterVolumes sets the hosts of volumes in list, and adds the volumes
+// of other hosts matching filters which aren't on this host
+func (s *daemon) addClusterVolumes(list map[string]api.VolumeResponse, filters []labelFilter) error {
+	if !s.clusterMode() {
+		return nil
+	}
+	attachments, err := s.listAttachments()
+	if err != nil {
+		return err
+	}
+	for name, volume := range list {
+		volume.Host = s.ClusterHost
+		volume.AttachedHost = attachments[name]
+		list[name] = volume
+	}
+	hosts, err := s.listClusterHosts()
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		names := []string{}
+		for name := range host.Volumes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, exists := list[name]; exists {
+				continue
+			}
+			config, err := s.loadVolumeConfig(name)
+			if err != nil {
+				return err
+			}
+			if !labelsMatchFilters(config.Labels, filters) {
+				continue
+			}
+			volume := host.Volumes[name]
+			list[name] = api.VolumeResponse{
+				Name:         name,
+				Driver:       volume.Driver,
+				MountPoint:   volume.MountPoint,
+				CreatedTime:  volume.CreatedTime,
+				Labels:       config.Labels,
+				Host:         host.Name,
+				AttachedHost: attachments[name],
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileAttachments makes the attachments of this host match the mounts,
+// after the mount points are corrected. Errors are added to resp.
+func (s *daemon) reconcileAttachments(resp *api.DoctorResponse) {
+	if !s.clusterMode() {
+		return
+	}
+	defer s.publishClusterHost()
+
+	attachments, err := s.listAttachments()
+	if err != nil {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot list attachments of cluster: %v", err))
+		return
+	}
+	volumes := s.getVolumeList()
+	names := []string{}
+	for name := range volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		volume := &Volume{Name: name, DriverName: volumes[name]["Driver"]}
+		if !s.needsAttachment(volume) || volumes[name]["MountPoint"] == "" {
+			continue
+		}
+		if err := s.claimAttachment(volume); err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Volume %v is mounted but cannot be attached: %v", name, err))
+		}
+	}
+	for name, host := range attachments {
+		if host != s.ClusterHost {
+			continue
+		}
+		if volume, exists := volumes[name]; exists && volume["MountPoint"] != "" {
+			continue
+		}
+		if err := s.releaseAttachment(name); err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot release attachment of volume %v: %v", name, err))
+			continue
+		}
+		resp.ReleasedAttachments = append(resp.ReleasedAttachments, name)
+	}
+	sort.Strings(resp.ReleasedAttachments)
+}
@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/vfs"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) newClusterDaemon(c *C, store metadataStore, host string) *daemon {
+	root := filepath.Join(s.root, host)
+	c.Assert(os.Mkdir(root, 0700), IsNil)
+	d := s.newDaemon(DRIVER_INIT_MODE_STRICT, vfs.KIND)
+	d.Root = root
+	d.store = store
+	d.MetadataStore = "etcd://localhost:2379/convoy"
+	d.ClusterHost = host
+	c.Assert(d.initDrivers(map[string]string{
+		vfs.VFS_PATH: filepath.Join(root, "volumes"),
+	}), IsNil)
+	c.Assert(d.finializeInitialization(), IsNil)
+	return d
+}
+
+func (s *TestSuite) TestClusterMode(c *C) {
+	// Volumes of vfs are local ones here, which are not on shared storage
+	delete(sharedVolumeDrivers, vfs.KIND)
+	defer func() {
+		sharedVolumeDrivers[vfs.KIND] = true
+	}()
+
+	store, fake := s.newEtcdStore(c)
+	defer fake.server.Close()
+	d1 := s.newClusterDaemon(c, store, "host1")
+	d2 := s.newClusterDaemon(c, store, "host2")
+
+	_, err := d1.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:   "vol1",
+		Labels: map[string]string{"app": "db"},
+	})
+	c.Assert(err, IsNil)
+	_, err = d2.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, ErrorMatches, "Volume vol1 of driver vfs already exists on host host1")
+
+	// Volumes of other hosts are listed as well
+	data, err := d2.listVolume(nil)
+	c.Assert(err, IsNil)
+	list := map[string]api.VolumeResponse{}
+	c.Assert(json.Unmarshal(data, &list), IsNil)
+	c.Assert(list["vol1"].Host, Equals, "host1")
+	c.Assert(list["vol1"].Driver, Equals, vfs.KIND)
+	c.Assert(list["vol1"].Labels, DeepEquals, map[string]string{"app": "db"})
+	data, err = d2.listVolume([]labelFilter{{key: "app", value: "web"}})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "{}")
+
+	// Volume attached to a host cannot be attached to another one
+	volume := d1.getVolume("vol1")
+	_, err = d1.processVolumeMount(volume, &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(d2.claimAttachment(volume), ErrorMatches, "Volume vol1 is attached to host host1 since .*")
+	resp, err := d1.listVolumeInfo(volume)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Host, Equals, "host1")
+	c.Assert(resp.AttachedHost, Equals, "host1")
+
+	c.Assert(d1.processVolumeUmount(volume), IsNil)
+	c.Assert(d2.claimAttachment(volume), IsNil)
+	c.Assert(d1.claimAttachment(volume), ErrorMatches, "Volume vol1 is attached to host host2 since .*")
+
+	// Attachment of host2 is released since vol1 isn't mounted there
+	doctor := d2.reconcileMounts()
+	c.Assert(doctor.ReleasedAttachments, DeepEquals, []string{"vol1"})
+	c.Assert(doctor.Errors, HasLen, 0)
+	c.Assert(d1.claimAttachment(volume), IsNil)
+}
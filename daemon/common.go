@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/metrics"
 )
 
 func decodeRequest(r *http.Request, v interface{}) error {
@@ -55,6 +56,16 @@ func (s *daemon) doInfo(version string, w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return err
 	}
+	if _, err := w.Write([]byte(fmt.Sprint(",\n\"DriverStatus\": "))); err != nil {
+		return err
+	}
+	data, err = api.ResponseOutput(s.getDriverStatus())
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
 	for _, driver := range s.ConvoyDrivers {
 		if _, err := w.Write([]byte(fmt.Sprintf(",\n\"%v\": ", driver.Name()))); err != nil {
 			return err
@@ -80,3 +91,9 @@ func (s *daemon) doInfo(version string, w http.ResponseWriter, r *http.Request,
 
 	return nil
 }
+
+func (s *daemon) doMetrics(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	s.recordVolumeIOMetrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	return metrics.WriteText(w)
+}
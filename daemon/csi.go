@@ -0,0 +1,877 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/rancher/convoy/api"
+	. "github.com/rancher/convoy/convoydriver"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	CSI_PLUGIN_NAME = "convoy.rancher.io"
+
+	CSI_ENDPOINT_UNIX_PREFIX = "unix://"
+
+	// CSI_TOPOLOGY_NODE is the key of topology segment of the node ID,
+	// which volumes of node-local drivers are accessible from
+	CSI_TOPOLOGY_NODE = CSI_PLUGIN_NAME + "/node"
+)
+
+// nodeLocalVolumeDrivers are the drivers whose volumes are on storage of the
+// node they're created on, so they're only accessible from there. Volumes
+// of vfs are shared by the nodes in global plugin scope, e.g. on NFS.
+var nodeLocalVolumeDrivers = map[string]bool{
+	"devicemapper": true,
+	"lvm":          true,
+	"zfs":          true,
+	"vfs":          true,
+}
+
+/*
+csiServer serves the Identity, Controller and Node services of CSI, so
+container orchestrators like Kubernetes can use Convoy volumes. The Controller
+and Node services run in the same daemon, since volumes are attached by the
+driver when they're mounted on the node, like they are for Docker. ID of a
+volume or snapshot is its name in Convoy.
+*/
+type csiServer struct {
+	csi.UnimplementedIdentityServer
+	csi.UnimplementedControllerServer
+	csi.UnimplementedNodeServer
+
+	s       *daemon
+	version string
+}
+
+// parseCSIEndpoint returns the path of unix socket of endpoint, which is
+// unix:///path or the path itself
+func parseCSIEndpoint(endpoint string) (string, error) {
+	path := endpoint
+	if strings.Contains(endpoint, "://") {
+		if !strings.HasPrefix(endpoint, CSI_ENDPOINT_UNIX_PREFIX) {
+			return "", fmt.Errorf("Invalid CSI endpoint %v, only unix socket is supported, e.g. unix:///var/run/convoy/csi.sock", endpoint)
+		}
+		path = strings.TrimPrefix(endpoint, CSI_ENDPOINT_UNIX_PREFIX)
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("Invalid CSI endpoint %v, path of unix socket must be absolute", endpoint)
+	}
+	return path, nil
+}
+
+// listenCSI listens on the unix socket of endpoint, nil if CSI is not enabled
+func listenCSI(endpoint string) (net.Listener, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	sockFile, err := parseCSIEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := util.MkdirIfNotExists(filepath.Dir(sockFile)); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(sockFile); err == nil {
+		log.Warnf("Remove previous CSI sockfile at %v", sockFile)
+		if err := os.Remove(sockFile); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", sockFile)
+}
+
+// newCSIServer returns the gRPC server of CSI services of daemon, version is
+// reported as the version of plugin
+func newCSIServer(s *daemon, version string) *grpc.Server {
+	cs := &csiServer{
+		s:       s,
+		version: version,
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(s.csiInterceptor))
+	csi.RegisterIdentityServer(server, cs)
+	csi.RegisterControllerServer(server, cs)
+	csi.RegisterNodeServer(server, cs)
+	return server
+}
+
+// Calls of CSI which change volumes, tracked as operations and recorded in
+// audit log like the requests of API
+var auditedCSIMethods = map[string]bool{
+	"/csi.v1.Controller/CreateVolume":   true,
+	"/csi.v1.Controller/DeleteVolume":   true,
+	"/csi.v1.Controller/CreateSnapshot": true,
+	"/csi.v1.Controller/DeleteSnapshot": true,
+	"/csi.v1.Node/NodePublishVolume":    true,
+	"/csi.v1.Node/NodeUnpublishVolume":  true,
+}
+
+// csiRequestTarget returns the volume or snapshot the request is on
+func csiRequestTarget(req interface{}) string {
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		return r.GetVolumeId()
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		return r.GetSnapshotId()
+	}
+	if r, ok := req.(interface{ GetName() string }); ok {
+		return r.GetName()
+	}
+	return ""
+}
+
+func getCSIRequester(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "csi"
+	}
+	if p.Addr.Network() == "unix" {
+		return "csi unix"
+	}
+	return "csi " + p.Addr.String()
+}
+
+/*
+csiInterceptor logs the calls, and tracks the calls changing volumes as
+operations and records them in audit log. Parameters are not recorded, since
+requests of CSI may carry secrets.
+*/
+func (s *daemon) csiInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	log.Debugf("Handle CSI %v", info.FullMethod)
+	if !auditedCSIMethods[info.FullMethod] {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			log.Debugf("CSI %v failed: %v", info.FullMethod, err)
+		}
+		return resp, err
+	}
+
+	target := csiRequestTarget(req)
+	requester := getCSIRequester(ctx)
+	op := s.operations.start(strings.TrimPrefix(info.FullMethod, "/csi.v1."), target, requester)
+	resp, err := handler(ctx, req)
+	s.operations.finish(op)
+	if err != nil {
+		log.Errorf("CSI %v of %v failed: %v", info.FullMethod, target, err)
+	}
+
+	if s.audit != nil {
+		st, _ := status.FromError(err)
+		record := &AuditRecord{
+			Time:      time.Now().UTC().Format(time.RFC3339Nano),
+			Requester: requester,
+			Method:    "CSI",
+			Path:      info.FullMethod,
+			Route:     info.FullMethod,
+			// gRPC status code, which is 0 for OK
+			Status:  int(st.Code()),
+			Outcome: AUDIT_OUTCOME_SUCCESS,
+		}
+		if err != nil {
+			record.Outcome = AUDIT_OUTCOME_FAILURE
+			record.Error = st.Message()
+		}
+		if err := s.audit.append(record); err != nil {
+			log.Errorf("Failed to write audit log for CSI %v: %v", info.FullMethod, err)
+		}
+	}
+	return resp, err
+}
+
+// csiError returns err of daemon with the gRPC code of its error code
+func csiError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Internal
+	switch api.ErrorCode(err) {
+	case api.ERROR_CODE_NOT_FOUND:
+		code = codes.NotFound
+	case api.ERROR_CODE_CONFLICT:
+		code = codes.AlreadyExists
+	case api.ERROR_CODE_IN_USE:
+		code = codes.FailedPrecondition
+	case api.ERROR_CODE_BUSY:
+		code = codes.Aborted
+	case api.ERROR_CODE_INVALID_REQUEST, api.ERROR_CODE_DRIVER_UNSUPPORTED:
+		code = codes.InvalidArgument
+	case api.ERROR_CODE_UNAUTHORIZED:
+		code = codes.PermissionDenied
+	case api.ERROR_CODE_TIMEOUT:
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
+
+func (cs *csiServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{
+		Name:          CSI_PLUGIN_NAME,
+		VendorVersion: cs.version,
+	}, nil
+}
+
+func (cs *csiServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// getNodeID returns the cluster host of daemon as ID of the node, or the
+// hostname if it's not in cluster mode
+func (cs *csiServer) getNodeID() (string, error) {
+	if cs.s.ClusterHost != "" {
+		return cs.s.ClusterHost, nil
+	}
+	return os.Hostname()
+}
+
+// isNodeLocal tells if volumes of driverName are only accessible from the
+// node they're created on
+func (cs *csiServer) isNodeLocal(driverName string) bool {
+	if driverName == "vfs" && cs.s.PluginScope == PLUGIN_SCOPE_GLOBAL {
+		return false
+	}
+	return nodeLocalVolumeDrivers[driverName]
+}
+
+// csiNodeTopology returns the topology of node nodeID
+func csiNodeTopology(nodeID string) *csi.Topology {
+	return &csi.Topology{
+		Segments: map[string]string{
+			CSI_TOPOLOGY_NODE: nodeID,
+		},
+	}
+}
+
+// checkAccessibility returns an error if volumes on node nodeID are not
+// accessible from the topologies required by requirements
+func checkAccessibility(requirements *csi.TopologyRequirement, nodeID string) error {
+	requisite := requirements.GetRequisite()
+	if len(requisite) == 0 {
+		return nil
+	}
+	for _, topology := range requisite {
+		if topology.GetSegments()[CSI_TOPOLOGY_NODE] == nodeID {
+			return nil
+		}
+	}
+	return fmt.Errorf("Volume would only be accessible from node %v, which is not in the requisite topologies", nodeID)
+}
+
+// Probe reports the plugin is ready once any driver is initialized
+func (cs *csiServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if len(cs.s.ConvoyDrivers) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "No driver is initialized")
+	}
+	return &csi.ProbeResponse{
+		Ready: wrapperspb.Bool(true),
+	}, nil
+}
+
+// checkVolumeCapability returns an error if the volume cannot be used as
+// capability
+func (cs *csiServer) checkVolumeCapability(capability *csi.VolumeCapability) error {
+	if capability.GetMount() == nil {
+		return fmt.Errorf("Only mount access type is supported")
+	}
+	switch mode := capability.GetAccessMode().GetMode(); mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		// Volumes are shared by hosts only if the daemon is in global scope,
+		// e.g. on NFS
+		if cs.s.PluginScope != PLUGIN_SCOPE_GLOBAL {
+			return fmt.Errorf("Access mode %v requires plugin scope %v", mode, PLUGIN_SCOPE_GLOBAL)
+		}
+	default:
+		return fmt.Errorf("Unsupported access mode %v", mode)
+	}
+	return nil
+}
+
+func (cs *csiServer) checkVolumeCapabilities(capabilities []*csi.VolumeCapability) error {
+	if len(capabilities) == 0 {
+		return fmt.Errorf("Missing volume capabilities")
+	}
+	for _, capability := range capabilities {
+		if err := cs.checkVolumeCapability(capability); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getCSIVolumeSize returns the size of volume in bytes, 0 if it's unknown
+func (cs *csiServer) getCSIVolumeSize(volume *Volume) int64 {
+	info, err := cs.s.getVolumeDriverInfo(volume)
+	if err != nil {
+		return 0
+	}
+	size, err := strconv.ParseInt(info[OPT_SIZE], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+/*
+CreateVolume creates the volume of the name with the parameters, which are
+the same as the options of "docker volume create --opt", e.g. driver, size and
+type. Capacity required overrides size of parameters. Creating the volume
+again with the same request succeeds, like "convoy create". Volumes of
+node-local drivers are created on this node, so they're only accessible from
+it, and the requisite topology must include it.
+*/
+func (cs *csiServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing volume name")
+	}
+	if !util.ValidateName(name) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid volume name %s. Can only contain 0-9, a-z, dash(-), underscore(_) and dot(.)", name)
+	}
+	if err := cs.checkVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	createReq, err := parseVolumeCreateOpts(name, req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	required := req.GetCapacityRange().GetRequiredBytes()
+	limit := req.GetCapacityRange().GetLimitBytes()
+	if limit != 0 && required > limit {
+		return nil, status.Errorf(codes.OutOfRange, "Required capacity %v exceeds limit %v", required, limit)
+	}
+	if required != 0 {
+		createReq.Size = required
+	}
+	if limit != 0 && createReq.Size > limit {
+		return nil, status.Errorf(codes.OutOfRange, "Volume size %v exceeds limit %v", createReq.Size, limit)
+	}
+	if source := req.GetVolumeContentSource(); source != nil {
+		if source.GetSnapshot() == nil {
+			return nil, status.Error(codes.InvalidArgument, "Only snapshot is supported as volume content source")
+		}
+		createReq.SnapshotName = source.GetSnapshot().GetSnapshotId()
+	}
+
+	driverName := createReq.DriverName
+	if driverName == "" {
+		driverName = cs.s.DefaultDriver
+	}
+	var topology []*csi.Topology
+	if cs.isNodeLocal(driverName) {
+		nodeID, err := cs.getNodeID()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := checkAccessibility(req.GetAccessibilityRequirements(), nodeID); err != nil {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+		topology = []*csi.Topology{csiNodeTopology(nodeID)}
+	}
+
+	volume, err := cs.s.processVolumeCreate(createReq)
+	if err != nil {
+		return nil, csiError(err)
+	}
+	size := cs.getCSIVolumeSize(volume)
+	if size == 0 {
+		size = createReq.Size
+	}
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           volume.Name,
+			CapacityBytes:      size,
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: topology,
+		},
+	}, nil
+}
+
+// DeleteVolume deletes the volume, which succeeds if it doesn't exist
+func (cs *csiServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	name := req.GetVolumeId()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing volume ID")
+	}
+	if cs.s.getVolume(name) == nil {
+		log.Debugf("Volume %v for CSI doesn't exist, nothing to delete", name)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err := cs.s.processVolumeDelete(&api.VolumeDeleteRequest{
+		VolumeName: name,
+	}); err != nil && !api.IsErrorCode(err, api.ERROR_CODE_NOT_FOUND) {
+		return nil, csiError(err)
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (cs *csiServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	name := req.GetVolumeId()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing volume ID")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Missing volume capabilities")
+	}
+	if cs.s.getVolume(name) == nil {
+		return nil, status.Error(codes.NotFound, volumeNotFoundError(name).Error())
+	}
+	if err := cs.checkVolumeCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: err.Error(),
+		}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// paginate returns the range of count entries from startingToken, which is
+// the index of the first one, and the token of the next page
+func paginate(count int, startingToken string, maxEntries int32) (int, int, string, error) {
+	start := 0
+	if startingToken != "" {
+		var err error
+		if start, err = strconv.Atoi(startingToken); err != nil || start < 0 || start > count {
+			return 0, 0, "", status.Errorf(codes.Aborted, "Invalid starting token %v", startingToken)
+		}
+	}
+	if maxEntries < 0 {
+		return 0, 0, "", status.Errorf(codes.InvalidArgument, "Invalid max entries %v", maxEntries)
+	}
+	end := count
+	nextToken := ""
+	if maxEntries != 0 && start+int(maxEntries) < count {
+		end = start + int(maxEntries)
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+func (cs *csiServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	volumes := cs.s.getVolumeList()
+	names := []string{}
+	for name := range volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	start, end, nextToken, err := paginate(len(names), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	resp := &csi.ListVolumesResponse{
+		NextToken: nextToken,
+	}
+	for _, name := range names[start:end] {
+		size, _ := strconv.ParseInt(volumes[name][OPT_SIZE], 10, 64)
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      name,
+				CapacityBytes: size,
+			},
+		})
+	}
+	return resp, nil
+}
+
+func (cs *csiServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	resp := &csi.ControllerGetCapabilitiesResponse{}
+	for _, rpc := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	} {
+		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: rpc,
+				},
+			},
+		})
+	}
+	return resp, nil
+}
+
+// csiSnapshot returns the snapshot of CSI from the driver info of snapshot
+func csiSnapshot(snapshotName, volumeName string, info map[string]string) *csi.Snapshot {
+	snapshot := &csi.Snapshot{
+		SnapshotId:     snapshotName,
+		SourceVolumeId: volumeName,
+		ReadyToUse:     true,
+	}
+	if size, err := strconv.ParseInt(info[OPT_SIZE], 10, 64); err == nil {
+		snapshot.SizeBytes = size
+	}
+	if t, err := time.Parse(time.RubyDate, info[OPT_SNAPSHOT_CREATED_TIME]); err == nil {
+		snapshot.CreationTime = timestamppb.New(t)
+	}
+	return snapshot
+}
+
+func (cs *csiServer) getCSISnapshot(snapshotName, volumeName string) (*csi.Snapshot, error) {
+	volume := cs.s.getVolume(volumeName)
+	if volume == nil {
+		return nil, volumeNotFoundError(volumeName)
+	}
+	info, err := cs.s.getSnapshotDriverInfo(snapshotName, volume)
+	if err != nil {
+		return nil, err
+	}
+	return csiSnapshot(snapshotName, volumeName, info), nil
+}
+
+/*
+CreateSnapshot creates the snapshot of the name, the parameters can be
+compression and tags, like "convoy snapshot create". Creating the snapshot of
+the same volume again returns the existing one.
+*/
+func (cs *csiServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	snapshotName := req.GetName()
+	volumeName := req.GetSourceVolumeId()
+	if snapshotName == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing snapshot name")
+	}
+	if volumeName == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing source volume ID")
+	}
+	if err := util.CheckName(snapshotName); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if existing := cs.s.SnapshotVolumeIndex.Get(snapshotName); existing != "" {
+		if existing != volumeName {
+			return nil, status.Errorf(codes.AlreadyExists, "Snapshot %v already exists for volume %v", snapshotName, existing)
+		}
+		snapshot, err := cs.getCSISnapshot(snapshotName, volumeName)
+		if err != nil {
+			return nil, csiError(err)
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+	}
+
+	volume := cs.s.getVolume(volumeName)
+	if volume == nil {
+		return nil, status.Error(codes.NotFound, volumeNotFoundError(volumeName).Error())
+	}
+	tags, err := util.ParseTags(req.GetParameters()["tags"])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := cs.s.processSnapshotCreate(volume, snapshotName, nil, req.GetParameters()["compression"], tags); err != nil {
+		return nil, csiError(err)
+	}
+	snapshot, err := cs.getCSISnapshot(snapshotName, volumeName)
+	if err != nil {
+		return nil, csiError(err)
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+}
+
+// DeleteSnapshot deletes the snapshot, which succeeds if it doesn't exist
+func (cs *csiServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshotName := req.GetSnapshotId()
+	if snapshotName == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing snapshot ID")
+	}
+	if cs.s.SnapshotVolumeIndex.Get(snapshotName) == "" {
+		log.Debugf("Snapshot %v for CSI doesn't exist, nothing to delete", snapshotName)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	if err := cs.s.processSnapshotDelete(snapshotName); err != nil && !api.IsErrorCode(err, api.ERROR_CODE_NOT_FOUND) {
+		return nil, csiError(err)
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *csiServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	snapshots := []*csi.Snapshot{}
+	if snapshotName := req.GetSnapshotId(); snapshotName != "" {
+		volumeName := cs.s.SnapshotVolumeIndex.Get(snapshotName)
+		if volumeName != "" && (req.GetSourceVolumeId() == "" || req.GetSourceVolumeId() == volumeName) {
+			snapshot, err := cs.getCSISnapshot(snapshotName, volumeName)
+			if err != nil {
+				return nil, csiError(err)
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	} else {
+		volumeNames := []string{}
+		if req.GetSourceVolumeId() != "" {
+			if cs.s.getVolume(req.GetSourceVolumeId()) != nil {
+				volumeNames = append(volumeNames, req.GetSourceVolumeId())
+			}
+		} else {
+			for name := range cs.s.getVolumeList() {
+				volumeNames = append(volumeNames, name)
+			}
+		}
+		sort.Strings(volumeNames)
+		for _, volumeName := range volumeNames {
+			infos, err := cs.s.listSnapshotDriverInfos(cs.s.getVolume(volumeName))
+			if err != nil {
+				return nil, csiError(err)
+			}
+			names := []string{}
+			for name := range infos {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				snapshots = append(snapshots, csiSnapshot(name, volumeName, infos[name]))
+			}
+		}
+	}
+
+	start, end, nextToken, err := paginate(len(snapshots), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	resp := &csi.ListSnapshotsResponse{
+		NextToken: nextToken,
+	}
+	for _, snapshot := range snapshots[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshot,
+		})
+	}
+	return resp, nil
+}
+
+// addCSIPublishTarget records the path CSI published the volume to, see
+// addDockerMount()
+func (s *daemon) addCSIPublishTarget(name, target string) error {
+	return s.updateVolumeConfig(name, func(config *VolumeConfig) (bool, error) {
+		for _, t := range config.CSIPublishTargets {
+			if t == target {
+				return false, nil
+			}
+		}
+		config.CSIPublishTargets = append(config.CSIPublishTargets, target)
+		return true, nil
+	})
+}
+
+// removeCSIPublishTarget removes the path CSI published the volume to,
+// returns true if no target or Docker container is using the volume anymore,
+// so it can be unmounted
+func (s *daemon) removeCSIPublishTarget(name, target string) (bool, error) {
+	unused := false
+	if err := s.updateVolumeConfig(name, func(config *VolumeConfig) (bool, error) {
+		targets := []string{}
+		for _, t := range config.CSIPublishTargets {
+			if t != target {
+				targets = append(targets, t)
+			}
+		}
+		unused = len(targets) == 0 && len(config.DockerMountCallers) == 0
+		if len(targets) == len(config.CSIPublishTargets) {
+			return false, nil
+		}
+		if len(targets) == 0 {
+			targets = nil
+		}
+		config.CSIPublishTargets = targets
+		return true, nil
+	}); err != nil {
+		return false, err
+	}
+	return unused, nil
+}
+
+/*
+NodePublishVolume mounts the volume like Docker does, then bind mounts it at
+the target path. Mount flags of the capability are the options of the bind
+mount, e.g. nodev and nosuid, and the bind mount is read-only if the volume
+is published read-only, or the access mode is.
+*/
+func (cs *csiServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	name := req.GetVolumeId()
+	target := req.GetTargetPath()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing volume ID")
+	}
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing target path")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Missing volume capability")
+	}
+	if err := cs.checkVolumeCapability(req.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	options := strings.Join(req.GetVolumeCapability().GetMount().GetMountFlags(), ",")
+	if _, _, err := util.ParseBindMountOptions(options); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	mode := req.GetVolumeCapability().GetAccessMode().GetMode()
+	readOnly := req.GetReadonly() ||
+		mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+
+	volume := cs.s.getVolume(name)
+	if volume == nil {
+		return nil, status.Error(codes.NotFound, volumeNotFoundError(name).Error())
+	}
+	mounted, err := util.IsMountPoint(target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		log.Debugf("Volume %v is already published to %v for CSI", name, target)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	mountPoint, err := cs.s.processVolumeMount(volume, &api.VolumeMountRequest{})
+	if err != nil {
+		return nil, csiError(err)
+	}
+	if err := cs.s.addCSIPublishTarget(name, target); err != nil {
+		return nil, csiError(err)
+	}
+	if err := cs.bindMount(mountPoint, target, options, readOnly); err != nil {
+		if _, umountErr := cs.unpublish(volume, target); umountErr != nil {
+			log.Warnf("Cannot unpublish volume %v from %v after failed publish: %v", name, target, umountErr)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (cs *csiServer) bindMount(mountPoint, target, options string, readOnly bool) error {
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return err
+	}
+	ctx, cancel := cs.s.operationContext(OPERATION_MOUNT)
+	defer cancel()
+	if err := util.BindMountWithContext(ctx, mountPoint, target, options); err != nil {
+		return err
+	}
+	if readOnly {
+		if err := util.RemountBindReadOnlyWithContext(ctx, target); err != nil {
+			if umountErr := util.UmountWithContext(context.Background(), target); umountErr != nil {
+				log.Warnf("Cannot umount %v after failed read-only remount: %v", target, umountErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// unpublish forgets target of volume, and unmounts the volume if nothing else
+// uses it, returns true if the volume is unmounted
+func (cs *csiServer) unpublish(volume *Volume, target string) (bool, error) {
+	unused, err := cs.s.removeCSIPublishTarget(volume.Name, target)
+	if err != nil {
+		return false, err
+	}
+	if !unused {
+		log.Debugf("Volume %v is still used by others, skip unmount for %v", volume.Name, target)
+		return false, nil
+	}
+	if err := cs.s.processVolumeUmount(volume); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NodeUnpublishVolume unmounts the target path, then unmounts the volume if
+// no other target or Docker container is using it
+func (cs *csiServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	name := req.GetVolumeId()
+	target := req.GetTargetPath()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing volume ID")
+	}
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing target path")
+	}
+
+	mounted, err := util.IsMountPoint(target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if mounted {
+		umountCtx, cancel := cs.s.operationContext(OPERATION_UMOUNT)
+		err := util.UmountWithContext(umountCtx, target)
+		cancel()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	volume := cs.s.getVolume(name)
+	if volume == nil {
+		log.Debugf("Volume %v for CSI doesn't exist, nothing to unmount", name)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+	if _, err := cs.unpublish(volume, target); err != nil {
+		return nil, csiError(err)
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (cs *csiServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+// NodeGetInfo reports the cluster host of daemon as ID of the node, or the
+// hostname if it's not in cluster mode, which is also the topology of node
+func (cs *csiServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	nodeID, err := cs.getNodeID()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeGetInfoResponse{
+		NodeId:             nodeID,
+		AccessibleTopology: csiNodeTopology(nodeID),
+	}, nil
+}
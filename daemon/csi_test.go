@@ -0,0 +1,433 @@
+package daemon
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "gopkg.in/check.v1"
+)
+
+// serveCSI serves CSI of d on a unix socket in the test root, returns the
+// connection to it and the function to stop serving
+func (s *TestSuite) serveCSI(c *C, d *daemon) (*grpc.ClientConn, func()) {
+	l, err := listenCSI("unix://" + filepath.Join(s.root, "csi.sock"))
+	c.Assert(err, IsNil)
+	server := newCSIServer(d, "test")
+	go server.Serve(l)
+
+	conn, err := grpc.Dial("unix://"+filepath.Join(s.root, "csi.sock"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	c.Assert(err, IsNil)
+	return conn, func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func csiMountCapability(mode csi.VolumeCapability_AccessMode_Mode, flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				MountFlags: flags,
+			},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: mode,
+		},
+	}
+}
+
+func (s *TestSuite) csiCreateVolume(c *C, controller csi.ControllerClient, name string, params map[string]string) (*csi.CreateVolumeResponse, error) {
+	return controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: name,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			csiMountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		},
+		Parameters: params,
+	})
+}
+
+func (s *TestSuite) TestCSIEndpoint(c *C) {
+	path, err := parseCSIEndpoint("unix:///var/run/convoy/csi.sock")
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "/var/run/convoy/csi.sock")
+	path, err = parseCSIEndpoint("/var/run/convoy/csi.sock")
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "/var/run/convoy/csi.sock")
+	_, err = parseCSIEndpoint("tcp://0.0.0.0:9601")
+	c.Assert(err, ErrorMatches, "Invalid CSI endpoint.*only unix socket is supported.*")
+	_, err = parseCSIEndpoint("unix://csi.sock")
+	c.Assert(err, ErrorMatches, "Invalid CSI endpoint.*must be absolute")
+}
+
+func (s *TestSuite) TestCSIIdentity(c *C) {
+	d := s.newVFSDaemon(c)
+	conn, stop := s.serveCSI(c, d)
+	defer stop()
+	identity := csi.NewIdentityClient(conn)
+
+	info, err := identity.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(info.Name, Equals, CSI_PLUGIN_NAME)
+	c.Assert(info.VendorVersion, Equals, "test")
+
+	caps, err := identity.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(caps.Capabilities, HasLen, 2)
+	c.Assert(caps.Capabilities[0].GetService().GetType(), Equals, csi.PluginCapability_Service_CONTROLLER_SERVICE)
+	c.Assert(caps.Capabilities[1].GetService().GetType(), Equals, csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS)
+
+	probe, err := identity.Probe(context.Background(), &csi.ProbeRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(probe.GetReady().GetValue(), Equals, true)
+}
+
+func (s *TestSuite) TestCSIControllerVolumes(c *C) {
+	d := s.newVFSDaemon(c)
+	conn, stop := s.serveCSI(c, d)
+	defer stop()
+	controller := csi.NewControllerClient(conn)
+
+	caps, err := controller.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(caps.Capabilities, HasLen, 4)
+
+	resp, err := s.csiCreateVolume(c, controller, "pvc-1", map[string]string{"driver": "vfs", "mountopts": "nodev"})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Volume.VolumeId, Equals, "pvc-1")
+	c.Assert(d.getVolume("pvc-1"), NotNil)
+
+	// Retries succeed, while different options are rejected
+	_, err = s.csiCreateVolume(c, controller, "pvc-1", map[string]string{"driver": "vfs", "mountopts": "nodev"})
+	c.Assert(err, IsNil)
+	_, err = s.csiCreateVolume(c, controller, "pvc-1", map[string]string{"driver": "vfs", "mountopts": "nosuid"})
+	c.Assert(status.Code(err), Equals, codes.AlreadyExists)
+
+	_, err = s.csiCreateVolume(c, controller, "pvc/2", nil)
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = s.csiCreateVolume(c, controller, "pvc-2", map[string]string{"size": "huge"})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-2",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			csiMountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	_, err = controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-2",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		}},
+	})
+	c.Assert(status.Code(err), Equals, codes.InvalidArgument)
+	c.Assert(d.getVolume("pvc-2"), IsNil)
+
+	// Volumes of all hosts can be shared in global scope
+	d.PluginScope = PLUGIN_SCOPE_GLOBAL
+	validated, err := controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			csiMountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(validated.Confirmed, NotNil)
+	d.PluginScope = PLUGIN_SCOPE_LOCAL
+	validated, err = controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			csiMountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(validated.Confirmed, IsNil)
+	c.Assert(validated.Message, Matches, "Access mode .* requires plugin scope global")
+	_, err = controller.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "pvc-3",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			csiMountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		},
+	})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	_, err = s.csiCreateVolume(c, controller, "pvc-2", nil)
+	c.Assert(err, IsNil)
+	_, err = s.csiCreateVolume(c, controller, "pvc-3", nil)
+	c.Assert(err, IsNil)
+
+	list, err := controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2})
+	c.Assert(err, IsNil)
+	c.Assert(list.Entries, HasLen, 2)
+	c.Assert(list.Entries[0].Volume.VolumeId, Equals, "pvc-1")
+	c.Assert(list.Entries[1].Volume.VolumeId, Equals, "pvc-2")
+	c.Assert(list.NextToken, Equals, "2")
+	list, err = controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: list.NextToken})
+	c.Assert(err, IsNil)
+	c.Assert(list.Entries, HasLen, 1)
+	c.Assert(list.Entries[0].Volume.VolumeId, Equals, "pvc-3")
+	c.Assert(list.NextToken, Equals, "")
+	_, err = controller.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "10"})
+	c.Assert(status.Code(err), Equals, codes.Aborted)
+
+	// Deleting a volume which doesn't exist succeeds
+	for i := 0; i < 2; i++ {
+		_, err = controller.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-1"})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(d.getVolume("pvc-1"), IsNil)
+}
+
+func (s *TestSuite) TestCSITopology(c *C) {
+	d := s.newVFSDaemon(c)
+	d.ClusterHost = "host1"
+	conn, stop := s.serveCSI(c, d)
+	defer stop()
+	controller := csi.NewControllerClient(conn)
+	node := csi.NewNodeClient(conn)
+
+	info, err := node.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(info.AccessibleTopology.Segments, DeepEquals, map[string]string{CSI_TOPOLOGY_NODE: "host1"})
+
+	// Volumes of vfs are only on this node in local scope
+	resp, err := s.csiCreateVolume(c, controller, "pvc-1", nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Volume.AccessibleTopology, HasLen, 1)
+	c.Assert(resp.Volume.AccessibleTopology[0].Segments, DeepEquals, map[string]string{CSI_TOPOLOGY_NODE: "host1"})
+
+	createOnNodes := func(name string, nodes ...string) (*csi.CreateVolumeResponse, error) {
+		requisite := []*csi.Topology{}
+		for _, node := range nodes {
+			requisite = append(requisite, csiNodeTopology(node))
+		}
+		return controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				csiMountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			},
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Requisite: requisite,
+				Preferred: requisite,
+			},
+		})
+	}
+	_, err = createOnNodes("pvc-2", "host2")
+	c.Assert(status.Code(err), Equals, codes.ResourceExhausted)
+	c.Assert(d.getVolume("pvc-2"), IsNil)
+	resp, err = createOnNodes("pvc-2", "host2", "host1")
+	c.Assert(err, IsNil)
+	c.Assert(resp.Volume.AccessibleTopology[0].Segments[CSI_TOPOLOGY_NODE], Equals, "host1")
+
+	// Volumes of vfs are shared by all nodes in global scope
+	d.PluginScope = PLUGIN_SCOPE_GLOBAL
+	resp, err = createOnNodes("pvc-3", "host2")
+	c.Assert(err, IsNil)
+	c.Assert(resp.Volume.AccessibleTopology, HasLen, 0)
+}
+
+func (s *TestSuite) TestCSIControllerSnapshots(c *C) {
+	d := s.newVFSDaemon(c)
+	conn, stop := s.serveCSI(c, d)
+	defer stop()
+	controller := csi.NewControllerClient(conn)
+
+	_, err := s.csiCreateVolume(c, controller, "pvc-1", nil)
+	c.Assert(err, IsNil)
+	_, err = s.csiCreateVolume(c, controller, "pvc-2", nil)
+	c.Assert(err, IsNil)
+	mountPoint, err := d.processVolumeMount(d.getVolume("pvc-1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "data"), []byte("snapshot data"), 0644), IsNil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := controller.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+			SourceVolumeId: "pvc-1",
+			Name:           "snapshot-1",
+		})
+		c.Assert(err, IsNil)
+		c.Assert(resp.Snapshot.SnapshotId, Equals, "snapshot-1")
+		c.Assert(resp.Snapshot.SourceVolumeId, Equals, "pvc-1")
+		c.Assert(resp.Snapshot.ReadyToUse, Equals, true)
+		c.Assert(resp.Snapshot.CreationTime, NotNil)
+	}
+	_, err = controller.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		SourceVolumeId: "pvc-2",
+		Name:           "snapshot-1",
+	})
+	c.Assert(status.Code(err), Equals, codes.AlreadyExists)
+	_, err = controller.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		SourceVolumeId: "pvc-3",
+		Name:           "snapshot-3",
+	})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+	_, err = controller.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		SourceVolumeId: "pvc-2",
+		Name:           "snapshot-2",
+	})
+	c.Assert(err, IsNil)
+
+	list, err := controller.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(list.Entries, HasLen, 2)
+	c.Assert(list.Entries[0].Snapshot.SnapshotId, Equals, "snapshot-1")
+	c.Assert(list.Entries[1].Snapshot.SnapshotId, Equals, "snapshot-2")
+	list, err = controller.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SourceVolumeId: "pvc-2"})
+	c.Assert(err, IsNil)
+	c.Assert(list.Entries, HasLen, 1)
+	c.Assert(list.Entries[0].Snapshot.SnapshotId, Equals, "snapshot-2")
+	list, err = controller.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "snapshot-1"})
+	c.Assert(err, IsNil)
+	c.Assert(list.Entries, HasLen, 1)
+	c.Assert(list.Entries[0].Snapshot.SourceVolumeId, Equals, "pvc-1")
+	list, err = controller.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{SnapshotId: "snapshot-1", SourceVolumeId: "pvc-2"})
+	c.Assert(err, IsNil)
+	c.Assert(list.Entries, HasLen, 0)
+
+	// Volume is created with the data of snapshot
+	resp, err := controller.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-3",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			csiMountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: "snapshot-1",
+				},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Volume.ContentSource.GetSnapshot().GetSnapshotId(), Equals, "snapshot-1")
+	mountPoint, err = d.processVolumeMount(d.getVolume("pvc-3"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(mountPoint, "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "snapshot data")
+
+	for i := 0; i < 2; i++ {
+		_, err = controller.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "snapshot-1"})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(d.snapshotExists("pvc-1", "snapshot-1"), Equals, false)
+}
+
+func (s *TestSuite) TestCSINodePublish(c *C) {
+	var err error
+	d := s.newVFSDaemon(c)
+	d.audit, err = openAuditLog(filepath.Join(s.root, AUDIT_LOG_FILE))
+	c.Assert(err, IsNil)
+	defer d.audit.close()
+	d.ClusterHost = "host1"
+	conn, stop := s.serveCSI(c, d)
+	defer stop()
+	controller := csi.NewControllerClient(conn)
+	node := csi.NewNodeClient(conn)
+
+	info, err := node.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(info.NodeId, Equals, "host1")
+
+	_, err = s.csiCreateVolume(c, controller, "pvc-1", nil)
+	c.Assert(err, IsNil)
+	volume := d.getVolume("pvc-1")
+
+	target1 := filepath.Join(s.root, "pods", "pod1", "mount")
+	target2 := filepath.Join(s.root, "pods", "pod2", "mount")
+	publish := func(target string, readOnly bool, flags ...string) error {
+		_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         "pvc-1",
+			TargetPath:       target,
+			VolumeCapability: csiMountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER, flags...),
+			Readonly:         readOnly,
+		})
+		return err
+	}
+	unpublish := func(target string) error {
+		_, err := node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   "pvc-1",
+			TargetPath: target,
+		})
+		return err
+	}
+
+	c.Assert(status.Code(publish(target1, false, "noatime")), Equals, codes.InvalidArgument)
+	c.Assert(publish(target1, false, "nodev"), IsNil)
+	// Publishing again is a no-op
+	c.Assert(publish(target1, false, "nodev"), IsNil)
+	c.Assert(publish(target2, true), IsNil)
+	for _, target := range []string{target1, target2} {
+		mounted, err := util.IsMountPoint(target)
+		c.Assert(err, IsNil)
+		c.Assert(mounted, Equals, true)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(target1, "data"), []byte("data"), 0644), IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(target2, "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	c.Assert(ioutil.WriteFile(filepath.Join(target2, "data"), []byte("data"), 0644), NotNil)
+
+	config, err := d.loadVolumeConfig("pvc-1")
+	c.Assert(err, IsNil)
+	c.Assert(config.CSIPublishTargets, DeepEquals, []string{target1, target2})
+
+	// Volume stays mounted while any target or Docker container uses it
+	c.Assert(d.addDockerMount("pvc-1", "container1"), IsNil)
+	c.Assert(unpublish(target1), IsNil)
+	_, err = os.Stat(target1)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(unpublish(target2), IsNil)
+	mountPoint, err := d.getVolumeMountPoint(volume)
+	c.Assert(err, IsNil)
+	c.Assert(mountPoint, Not(Equals), "")
+	unused, err := d.removeDockerMount("pvc-1", "container1")
+	c.Assert(err, IsNil)
+	c.Assert(unused, Equals, true)
+
+	c.Assert(publish(target1, false), IsNil)
+	c.Assert(unpublish(target1), IsNil)
+	c.Assert(unpublish(target1), IsNil)
+	mountPoint, err = d.getVolumeMountPoint(volume)
+	c.Assert(err, IsNil)
+	c.Assert(mountPoint, Equals, "")
+	config, err = d.loadVolumeConfig("pvc-1")
+	c.Assert(err, IsNil)
+	c.Assert(config.CSIPublishTargets, IsNil)
+
+	c.Assert(status.Code(unpublish("")), Equals, codes.InvalidArgument)
+	_, err = node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "pvc-2",
+		TargetPath:       target1,
+		VolumeCapability: csiMountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	records, err := d.audit.list(time.Time{})
+	c.Assert(err, IsNil)
+	published := 0
+	for _, record := range records {
+		c.Assert(record.Parameters, IsNil)
+		if record.Route == "/csi.v1.Node/NodePublishVolume" && record.Outcome == AUDIT_OUTCOME_SUCCESS {
+			published++
+		}
+	}
+	c.Assert(published, Equals, 4)
+}
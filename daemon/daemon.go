@@ -8,12 +8,15 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
 	"github.com/gorilla/mux"
 	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
 	"github.com/rancher/convoy/util"
 
 	. "github.com/rancher/convoy/convoydriver"
@@ -27,19 +30,77 @@ type daemon struct {
 	NameUUIDIndex       *util.Index
 	SnapshotVolumeIndex *util.Index
 	daemonConfig
+
+	// store keeps the objects of daemon, like volume configs
+	store metadataStore
+
+	// driverInitErrors records drivers failed to initialize in besteffort mode
+	driverInitErrors map[string]error
+
+	// volumeLocks serializes operations on the same volume
+	volumeLocks lockManager
+	// indexLock protects reserving a name in NameUUIDIndex, since snapshot
+	// names are unique across volumes
+	indexLock sync.Mutex
+	// migrations maps the volumes being migrated to the driver owning them,
+	// since both drivers have the volume until the source is retired
+	migrations    map[string]string
+	migrationLock sync.RWMutex
+	// trashedVolumes are the volumes in trash, hidden from the daemon until
+	// they're restored or purged
+	trashedVolumes map[string]bool
+	trashLock      sync.RWMutex
+	// trashOpLock serializes the changes of trash entries
+	trashOpLock sync.Mutex
+
+	// encryptionKeysLock serializes generating the key of a KMS key
+	encryptionKeysLock sync.Mutex
+
+	policyLock   sync.Mutex
+	scheduleLock sync.Mutex
+
+	jobs *jobManager
+	// operations are the operations in progress, see doOperations
+	operations operationTracker
+
+	audit *auditLog
+
+	// settings is the config file specified by --config, nil if none
+	settings     *settingsFile
+	logLevelFlag string
+	// logPackageLevelsFlag are the package log levels of command line
+	logPackageLevelsFlag []string
+	// rescanOnStart rebuilds the indexes by rescanDrivers() on startup,
+	// instead of stopping at the first inconsistency
+	rescanOnStart bool
+	rateLimiter   rateLimiter
+	notifier      notifier
+	profiles      profileSet
+	// operationTimeouts are parsed from OperationTimeouts of config
+	operationTimeouts map[string]time.Duration
+	// trashGracePeriod is parsed from TrashGracePeriod of config, deleted
+	// volumes are moved to trash for it if it's not zero
+	trashGracePeriod time.Duration
 }
 
 const (
 	VOLUME_CFG_PREFIX = "volume_"
 	CFG_POSTFIX       = ".json"
 
-	CONFIGFILE = "convoy.cfg"
-	LOCKFILE   = "lock"
+	CONFIGFILE  = "convoy.cfg"
+	LOCKFILE    = "lock"
+	STAGING_DIR = "staging"
+
+	DRIVER_INIT_MODE_STRICT     = "strict"
+	DRIVER_INIT_MODE_BESTEFFORT = "besteffort"
+
+	DRIVER_STATUS_AVAILABLE   = "available"
+	DRIVER_STATUS_UNAVAILABLE = "unavailable"
 )
 
 var (
 	lockFile *os.File
-	logFile  *os.File
+	logFile  *RotatingFile
 
 	log = logrus.WithFields(logrus.Fields{"pkg": "daemon"})
 )
@@ -51,7 +112,45 @@ type daemonConfig struct {
 	MountNamespaceFD    string
 	IgnoreDockerDelete  bool
 	CreateOnDockerMount bool
+	DockerVolumeOpts    bool
 	CmdTimeout          string
+	DriverInitMode      string
+	PluginScope         string
+	BackupConcurrency   int
+	// BackupSharedBlocks stores blocks of new backups in the block store
+	// shared by all volumes of the destination
+	BackupSharedBlocks bool
+	// BackupChecksum is the algorithm blocks of new backups are checksummed
+	// by, empty for the default
+	BackupChecksum string
+	// StagingDir is where archives are staged for snapshots, backups and
+	// restores, <root>/staging if it's empty
+	StagingDir string
+	AuditLog   string
+	// MetadataStore is the URL of metadata store, empty for the files in
+	// root directory
+	MetadataStore string
+	// ClusterHost is the name of this host in cluster mode, empty if it's
+	// not enabled
+	ClusterHost string
+	// CmdRetries of commands failed by transient errors. Config saved by
+	// older version has none, so its commands are not retried.
+	CmdRetries      int
+	CmdRetryBackoff string
+	// CmdRetryOn are the patterns of retryable errors, empty for the default
+	CmdRetryOn []string
+	// CmdTimeouts are timeouts of specific commands, e.g. "mount=30s"
+	CmdTimeouts []string
+	// OperationTimeouts are timeouts of driver operations, e.g. "mount=2m"
+	OperationTimeouts []string
+	// TrashGracePeriod keeps deleted volumes in trash for the duration before
+	// deleting them, empty to delete them right away
+	TrashGracePeriod string
+	// TrashBackups moves deleted backups to trash as well
+	TrashBackups bool
+	// ObjectStoreHTTP are the HTTP options of objectstore destinations,
+	// e.g. "proxy=http://proxy:3128"
+	ObjectStoreHTTP []string
 }
 
 func (c *daemonConfig) ConfigFile() (string, error) {
@@ -61,34 +160,98 @@ func (c *daemonConfig) ConfigFile() (string, error) {
 	return filepath.Join(c.Root, CONFIGFILE), nil
 }
 
-func createRouter(s *daemon) *mux.Router {
-	router := mux.NewRouter()
-	m := map[string]map[string]requestHandler{
+// Plugin requests changing volumes, the others are queries
+var auditedPluginRoutes = map[string]bool{
+	"/VolumeDriver.Create":  true,
+	"/VolumeDriver.Remove":  true,
+	"/VolumeDriver.Mount":   true,
+	"/VolumeDriver.Unmount": true,
+}
+
+// apiRoutes are the handlers of API routes by method, which are the same in
+// every API version. Every route must be documented in apiRouteSpecs.
+func (s *daemon) apiRoutes() map[string]map[string]requestHandler {
+	return map[string]map[string]requestHandler{
 		"GET": {
-			"/info":            s.doInfo,
-			"/volumes/list":    s.doVolumeList,
-			"/volumes/":        s.doVolumeInspect,
-			"/snapshots/":      s.doSnapshotInspect,
-			"/backups/list":    s.doBackupList,
-			"/backups/inspect": s.doBackupInspect,
+			"/info":             s.doInfo,
+			"/metrics":          s.doMetrics,
+			"/health":           s.doHealth,
+			"/volumes/list":     s.doVolumeList,
+			"/volumes/":         s.doVolumeInspect,
+			"/snapshots/":       s.doSnapshotInspect,
+			"/snapshots/diff":   s.doSnapshotDiff,
+			"/volumes/backups":  s.doVolumeBackups,
+			"/volumes/export":   s.doVolumeExport,
+			"/volumes/stats":    s.doVolumeStats,
+			"/backups/list":     s.doBackupList,
+			"/backups/inspect":  s.doBackupInspect,
+			"/backups/estimate": s.doBackupEstimate,
+			"/policies/list":    s.doPolicyList,
+			"/schedules/list":   s.doScheduleList,
+			"/trash/list":       s.doTrashList,
+			"/jobs":             s.doJobList,
+			"/jobs/{id}":        s.doJobInspect,
+			"/operations":       s.doOperations,
+			"/events":           s.doEvents,
+			"/log/levels":       s.doLogLevels,
+			"/audit/list":       s.doAuditList,
+			"/schema":           s.doSchema,
 		},
 		"POST": {
-			"/volumes/create":   s.doVolumeCreate,
-			"/volumes/mount":    s.doVolumeMount,
-			"/volumes/umount":   s.doVolumeUmount,
-			"/snapshots/create": s.doSnapshotCreate,
-			"/backups/create":   s.doBackupCreate,
+			"/volumes/create":          s.asyncHandler("volume create", s.doVolumeCreate),
+			"/volumes/import":          s.asyncHandler("volume import", s.doVolumeImport),
+			"/volumes/clone":           s.asyncHandler("volume clone", s.doVolumeClone),
+			"/volumes/migrate":         s.asyncHandler("volume migrate", s.doVolumeMigrate),
+			"/volumes/mount":           s.doVolumeMount,
+			"/volumes/umount":          s.doVolumeUmount,
+			"/volumes/force-umount":    s.doVolumeForceUmount,
+			"/volumes/fence":           s.doVolumeFence,
+			"/volumes/unfence":         s.doVolumeUnfence,
+			"/volumes/refresh":         s.doVolumeRefresh,
+			"/volumes/resize":          s.doVolumeResize,
+			"/volumes/retention":       s.doVolumeRetention,
+			"/snapshots/create":        s.asyncHandler("snapshot create", s.doSnapshotCreate),
+			"/backups/create":          s.asyncHandler("backup create", s.doBackupCreate),
+			"/backups/now":             s.asyncHandler("backup now", s.doBackupNow),
+			"/backups/copy":            s.asyncHandler("backup copy", s.doBackupCopy),
+			"/backups/archive":         s.asyncHandler("backup archive", s.doBackupArchive),
+			"/backups/restore-archive": s.doBackupRestoreArchive,
+			"/backups/restore-file":    s.asyncHandler("backup restore-file", s.doBackupRestoreFile),
+			"/backups/gc":              s.asyncHandler("backup gc", s.doBackupGC),
+			"/objectstore/gc":          s.asyncHandler("objectstore gc", s.doObjectStoreGC),
+			"/policies/create":         s.doPolicyCreate,
+			"/schedules/create":        s.doScheduleCreate,
+			"/trash/restore":           s.doTrashRestore,
+			"/doctor":                  s.doDoctor,
+			"/rescan":                  s.doRescan,
+			"/log/level":               s.doLogLevelSet,
 		},
 		"DELETE": {
 			"/volumes/":   s.doVolumeDelete,
-			"/snapshots/": s.doSnapshotDelete,
-			"/backups":    s.doBackupDelete,
+			"/snapshots/": s.asyncHandler("snapshot delete", s.doSnapshotDelete),
+			"/backups":    s.asyncHandler("backup delete", s.doBackupDelete),
+			"/policies/":  s.doPolicyDelete,
+			"/schedules/": s.doScheduleDelete,
+			"/trash":      s.asyncHandler("trash purge", s.doTrashPurge),
 		},
 	}
+}
+
+func createRouter(s *daemon) *mux.Router {
+	router := mux.NewRouter()
+	m := s.apiRoutes()
 	for method, routes := range m {
 		for route, f := range routes {
 			log.Debugf("Registering %s, %s", method, route)
-			handler := makeHandlerFunc(method, route, api.API_VERSION, f)
+			handler := makeHandlerFunc(method, route, f)
+			if !untrackedRoutes[route] {
+				handler = s.operationHandlerFunc(method+" "+route, handler)
+			}
+			handler = s.rateLimitHandlerFunc(route, handler)
+			if method != "GET" {
+				handler = s.auditHandlerFunc(route, handler)
+			}
+			handler = requestIDHandlerFunc(handler)
 			router.Path("/v{version:[0-9.]+}" + route).Methods(method).HandlerFunc(handler)
 			router.Path(route).Methods(method).HandlerFunc(handler)
 		}
@@ -97,19 +260,25 @@ func createRouter(s *daemon) *mux.Router {
 
 	pluginMap := map[string]map[string]http.HandlerFunc{
 		"POST": {
-			"/Plugin.Activate":      s.dockerActivate,
-			"/VolumeDriver.Create":  s.dockerCreateVolume,
-			"/VolumeDriver.Remove":  s.dockerRemoveVolume,
-			"/VolumeDriver.Mount":   s.dockerMountVolume,
-			"/VolumeDriver.Unmount": s.dockerUnmountVolume,
-			"/VolumeDriver.Path":    s.dockerVolumePath,
-			"/VolumeDriver.Get":     s.dockerGetVolume,
-			"/VolumeDriver.List":    s.dockerListVolume,
+			"/Plugin.Activate":           s.dockerActivate,
+			"/VolumeDriver.Create":       s.dockerCreateVolume,
+			"/VolumeDriver.Remove":       s.dockerRemoveVolume,
+			"/VolumeDriver.Mount":        s.dockerMountVolume,
+			"/VolumeDriver.Unmount":      s.dockerUnmountVolume,
+			"/VolumeDriver.Path":         s.dockerVolumePath,
+			"/VolumeDriver.Get":          s.dockerGetVolume,
+			"/VolumeDriver.List":         s.dockerListVolume,
+			"/VolumeDriver.Capabilities": s.dockerCapabilities,
 		},
 	}
 	for method, routes := range pluginMap {
 		for route, f := range routes {
 			log.Debugf("Registering plugin handler %s, %s", method, route)
+			if auditedPluginRoutes[route] {
+				f = s.operationHandlerFunc(strings.TrimPrefix(route, "/"), f)
+				f = s.auditHandlerFunc(route, f)
+			}
+			f = requestIDHandlerFunc(f)
 			router.Path(route).Methods(method).HandlerFunc(f)
 		}
 	}
@@ -117,35 +286,56 @@ func createRouter(s *daemon) *mux.Router {
 }
 
 func (s *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	info := fmt.Sprintf("Handler not found: %v %v", r.Method, r.RequestURI)
-	log.Errorf(info)
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte(info))
+	err := api.NewError(api.ERROR_CODE_NOT_FOUND, "Handler not found: %v %v", r.Method, r.RequestURI)
+	log.Error(err)
+	writeError(w, err, 0)
 }
 
 type requestHandler func(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error
 
-func makeHandlerFunc(method string, route string, version string, f requestHandler) http.HandlerFunc {
+// supportedAPIVersions are the API versions served, routes without version
+// are served as API_VERSION
+var supportedAPIVersions = []string{api.API_VERSION, api.API_VERSION_V2}
+
+func isSupportedAPIVersion(version string) bool {
+	for _, v := range supportedAPIVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func makeHandlerFunc(method string, route string, f requestHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Don't record volume list API call since it may used for polling
 		if route != "/volumes/list" {
 			log.Debugf("Calling: %v, %v, request: %v, %v", method, route, r.Method, r.RequestURI)
 		}
 
+		version := mux.Vars(r)["version"]
+		if version == "" {
+			version = api.API_VERSION
+		}
+		if !isSupportedAPIVersion(version) {
+			writeError(w, api.NewError(api.ERROR_CODE_NOT_FOUND, "API version %v is not supported, supported versions are %v",
+				version, strings.Join(supportedAPIVersions, ", ")), 0)
+			return
+		}
 		if strings.Contains(r.Header.Get("User-Agent"), "Convoy-Client/") {
 			userAgent := strings.Split(r.Header.Get("User-Agent"), "/")
-			if len(userAgent) == 2 && userAgent[1] != version {
-				http.Error(w, fmt.Errorf("client version %v doesn't match with server %v", userAgent[1], version).Error(), http.StatusNotFound)
+			if len(userAgent) == 2 && !isSupportedAPIVersion(userAgent[1]) {
+				writeError(w, api.NewError(api.ERROR_CODE_NOT_FOUND, "client version %v is not supported by server, supported versions are %v",
+					userAgent[1], strings.Join(supportedAPIVersions, ", ")), 0)
 				return
 			}
 		}
 		if err := f(version, w, r, mux.Vars(r)); err != nil {
-			statusCode := checkForStatusCode(err)
-			if statusCode == 0 {
+			apiErr := toAPIError(err)
+			if apiErr.Code == api.ERROR_CODE_UNKNOWN {
 				log.Errorf("Handler for %s %s returned error: %s", method, route, err)
-				statusCode = http.StatusBadRequest
 			}
-			http.Error(w, err.Error(), statusCode)
+			writeError(w, apiErr, 0)
 		}
 	}
 }
@@ -172,10 +362,10 @@ func (s *daemon) updateIndex() error {
 	return nil
 }
 
-func daemonEnvironmentSetup(c *cli.Context) error {
+func daemonEnvironmentSetup(c *cli.Context, settings *settingsFile) error {
 	var err error
 
-	root := c.String("root")
+	root := getSetting(c, settings, "root")
 	if root == "" {
 		return fmt.Errorf("Have to specific root directory")
 	}
@@ -188,20 +378,7 @@ func daemonEnvironmentSetup(c *cli.Context) error {
 		return fmt.Errorf("Failed to lock the file at %v: %v", lockPath, err.Error())
 	}
 
-	logrus.SetLevel(logrus.DebugLevel)
-	logName := c.String("log")
-	if logName != "" {
-		logFile, err := os.OpenFile(logName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			return err
-		}
-		logrus.SetFormatter(&logrus.JSONFormatter{})
-		logrus.SetOutput(logFile)
-	} else {
-		logrus.SetOutput(os.Stdout)
-	}
-
-	return nil
+	return setupLog(c, settings)
 }
 
 func environmentCleanup() {
@@ -221,12 +398,26 @@ func environmentCleanup() {
 func (s *daemon) finializeInitialization() error {
 	s.NameUUIDIndex = util.NewIndex()
 	s.SnapshotVolumeIndex = util.NewIndex()
+	s.jobs = newJobManager()
 
+	if err := s.loadEncryptionKeys(); err != nil {
+		return err
+	}
+	s.recoverMigrations()
+	s.recoverSnapshotIntents()
+	if err := s.loadTrash(); err != nil {
+		return err
+	}
+	if s.rescanOnStart {
+		logRescan(s.rescanDrivers())
+		return nil
+	}
 	s.updateIndex()
 	return nil
 }
 
 func (s *daemon) initDrivers(driverOpts map[string]string) error {
+	s.driverInitErrors = make(map[string]error)
 	for _, driverName := range s.DriverList {
 		log.WithFields(logrus.Fields{
 			LOG_FIELD_REASON: LOG_REASON_PREPARE,
@@ -238,7 +429,16 @@ func (s *daemon) initDrivers(driverOpts map[string]string) error {
 
 		driver, err := GetDriver(driverName, s.Root, driverOpts)
 		if err != nil {
-			return err
+			if s.DriverInitMode != DRIVER_INIT_MODE_BESTEFFORT {
+				return err
+			}
+			log.WithFields(logrus.Fields{
+				LOG_FIELD_REASON: LOG_REASON_FAILURE,
+				LOG_FIELD_EVENT:  LOG_EVENT_INIT,
+				LOG_FIELD_DRIVER: driverName,
+			}).Errorf("Driver failed to initialize, skipping it: %v", err)
+			s.driverInitErrors[driverName] = err
+			continue
 		}
 
 		log.WithFields(logrus.Fields{
@@ -248,21 +448,65 @@ func (s *daemon) initDrivers(driverOpts map[string]string) error {
 		}).Debug()
 		s.ConvoyDrivers[driverName] = driver
 	}
+	if len(s.ConvoyDrivers) == 0 {
+		return fmt.Errorf("None of drivers %v was initialized successfully", s.DriverList)
+	}
+	// Volumes are created by the default driver unless another one is
+	// specified, so the daemon is of no use without it
+	if err, failed := s.driverInitErrors[s.DefaultDriver]; failed {
+		return fmt.Errorf("Default driver %v failed to initialize: %v", s.DefaultDriver, err)
+	}
 	return nil
 }
 
+func validateDriverInitMode(mode string) error {
+	if mode != DRIVER_INIT_MODE_STRICT && mode != DRIVER_INIT_MODE_BESTEFFORT {
+		return fmt.Errorf("Invalid driver init mode %v, must be %v or %v",
+			mode, DRIVER_INIT_MODE_STRICT, DRIVER_INIT_MODE_BESTEFFORT)
+	}
+	return nil
+}
+
+func (s *daemon) getDriverStatus() map[string]map[string]string {
+	status := make(map[string]map[string]string)
+	for _, driverName := range s.DriverList {
+		if err, failed := s.driverInitErrors[driverName]; failed {
+			status[driverName] = map[string]string{
+				"Status": DRIVER_STATUS_UNAVAILABLE,
+				"Error":  err.Error(),
+			}
+			continue
+		}
+		status[driverName] = map[string]string{
+			"Status": DRIVER_STATUS_AVAILABLE,
+		}
+	}
+	return status
+}
+
 // Start the daemon
 func Start(sockFile string, c *cli.Context) error {
 	var err error
 
-	if err = daemonEnvironmentSetup(c); err != nil {
+	var settings *settingsFile
+	if path := c.String("config"); path != "" {
+		if settings, err = loadSettingsFile(path); err != nil {
+			return err
+		}
+	}
+
+	if err = daemonEnvironmentSetup(c, settings); err != nil {
 		return err
 	}
 	defer environmentCleanup()
 
-	root := c.String("root")
+	root := getSetting(c, settings, "root")
 	s := &daemon{
-		ConvoyDrivers: make(map[string]ConvoyDriver),
+		ConvoyDrivers:        make(map[string]ConvoyDriver),
+		settings:             settings,
+		logLevelFlag:         c.String("log-level"),
+		logPackageLevelsFlag: c.StringSlice("log-package-levels"),
+		rescanOnStart:        c.Bool("rescan"),
 	}
 	config := &daemonConfig{
 		Root: root,
@@ -292,6 +536,9 @@ func Start(sockFile string, c *cli.Context) error {
 		}
 
 		driverList := c.StringSlice("drivers")
+		if settings != nil && settings.Daemon["drivers"] != "" {
+			driverList = parseList(settings.Daemon["drivers"])
+		}
 		if len(driverList) == 0 {
 			return fmt.Errorf("Missing or invalid parameters")
 		}
@@ -301,19 +548,117 @@ func Start(sockFile string, c *cli.Context) error {
 		config.DefaultDriver = driverList[0]
 		config.IgnoreDockerDelete = c.Bool("ignore-docker-delete")
 		config.CreateOnDockerMount = c.Bool("create-on-docker-mount")
+		config.DockerVolumeOpts = c.Bool("docker-volume-opts")
 		config.CmdTimeout = c.String("cmd-timeout")
+		config.DriverInitMode = c.String("driver-init-mode")
+		config.PluginScope = c.String("plugin-scope")
+		config.BackupConcurrency = c.Int("backup-concurrency")
+		config.BackupSharedBlocks = c.Bool("backup-shared-blocks")
+		config.BackupChecksum = c.String("backup-checksum")
+		config.StagingDir = c.String("staging-dir")
+		config.AuditLog = c.String("audit-log")
+		config.MetadataStore = c.String("metadata-store")
+		config.ClusterHost = c.String("cluster-host")
+		config.CmdRetries = c.Int("cmd-retries")
+		config.CmdRetryBackoff = c.String("cmd-retry-backoff")
+		config.CmdRetryOn = c.StringSlice("cmd-retry-on")
+		config.CmdTimeouts = c.StringSlice("cmd-timeouts")
+		config.OperationTimeouts = c.StringSlice("operation-timeouts")
+		config.TrashGracePeriod = c.String("trash-grace-period")
+		config.TrashBackups = c.Bool("trash-backups")
+		config.ObjectStoreHTTP = c.StringSlice("objectstore-http")
+	}
+	if settings != nil {
+		log.Debug("Applying settings of config file ", settings.Path)
+		if err := applyDaemonSettings(settings.Daemon, config); err != nil {
+			return err
+		}
+	}
+
+	// Config saved by older version doesn't have init mode
+	if config.DriverInitMode == "" {
+		config.DriverInitMode = DRIVER_INIT_MODE_STRICT
+	}
+	if err := validateDriverInitMode(config.DriverInitMode); err != nil {
+		return err
+	}
+	if config.PluginScope == "" {
+		config.PluginScope = PLUGIN_SCOPE_LOCAL
+	}
+	if err := validatePluginScope(config.PluginScope); err != nil {
+		return err
+	}
+	if config.BackupConcurrency == 0 {
+		config.BackupConcurrency = objectstore.DEFAULT_CONCURRENCY
+	}
+	if err := objectstore.SetConcurrency(config.BackupConcurrency); err != nil {
+		return err
+	}
+	objectstore.SetSharedBlocks(config.BackupSharedBlocks)
+	if err := objectstore.SetChecksumAlgorithm(config.BackupChecksum); err != nil {
+		return err
+	}
+	if err := objectstore.SetHTTPConfig(config.ObjectStoreHTTP); err != nil {
+		return err
+	}
+
+	if err := validateClusterHost(config.ClusterHost, config.MetadataStore); err != nil {
+		return err
+	}
+
+	if config.AuditLog == "" {
+		config.AuditLog = filepath.Join(root, AUDIT_LOG_FILE)
+	}
+	if config.StagingDir == "" {
+		config.StagingDir = filepath.Join(root, STAGING_DIR)
+	}
+	if err := util.SetStagingDir(config.StagingDir); err != nil {
+		return err
+	}
+	// Nothing is staged until drivers are initialized, the artifacts are
+	// left by the last run
+	removed, err := util.CleanupStaging()
+	if err != nil {
+		return fmt.Errorf("Failed to clean up staging directory %v: %v", config.StagingDir, err)
+	}
+	for _, path := range removed {
+		log.Warnf("Removed stale staging artifact %v", path)
 	}
 
 	s.daemonConfig = *config
 
+	if s.store, err = newMetadataStore(root, config.MetadataStore); err != nil {
+		return err
+	}
+	if config.MetadataStore != "" {
+		log.Infof("Using %v metadata store %v", s.store.Kind(), config.MetadataStore)
+	}
+
 	if err := util.InitMountNamespace(s.MountNamespaceFD); err != nil {
 		return err
 	}
 
 	util.InitTimeout(config.CmdTimeout)
+	if err := util.InitRetryPolicy(config.CmdRetries, config.CmdRetryBackoff, config.CmdRetryOn); err != nil {
+		return err
+	}
+	if err := util.InitCommandTimeouts(config.CmdTimeouts); err != nil {
+		return err
+	}
+	if s.operationTimeouts, err = parseOperationTimeouts(config.OperationTimeouts); err != nil {
+		return err
+	}
+	if s.trashGracePeriod, err = parseTrashGracePeriod(config.TrashGracePeriod); err != nil {
+		return err
+	}
 
 	// driverOpts would be ignored by Convoy Drivers if config already exists
 	driverOpts := util.SliceToMap(c.StringSlice("driver-opts"))
+	if settings != nil && driverOpts != nil {
+		for key, value := range settings.DriverOpts {
+			driverOpts[key] = value
+		}
+	}
 	if err := s.initDrivers(driverOpts); err != nil {
 		return err
 	}
@@ -324,7 +669,35 @@ func Start(sockFile string, c *cli.Context) error {
 		return err
 	}
 
+	// Nothing is served yet, so there is no race with mount requests
+	result := s.reconcileMounts()
+	for _, change := range result.MountPoints {
+		log.Warnf("Corrected mount point of volume %v from %q to %q", change.Volume, change.Recorded, change.Actual)
+	}
+	for _, mountPoint := range result.OrphanMounts {
+		log.Warnf("Umounted orphan mount %v", mountPoint)
+	}
+	for _, name := range result.ReleasedAttachments {
+		log.Warnf("Released attachment of volume %v no longer mounted", name)
+	}
+	for _, e := range result.Errors {
+		log.Errorf("Failed to reconcile mounts: %v", e)
+	}
+
+	if s.audit, err = openAuditLog(s.AuditLog); err != nil {
+		return err
+	}
+	defer s.audit.close()
+
+	if settings != nil {
+		if err := s.applySettings(settings); err != nil {
+			return err
+		}
+	}
+
 	s.Router = createRouter(s)
+	s.startScheduleRunner()
+	s.startTrashReaper()
 
 	if err := util.MkdirIfNotExists(filepath.Dir(sockFile)); err != nil {
 		return err
@@ -344,6 +717,21 @@ func Start(sockFile string, c *cli.Context) error {
 	}
 	defer l.Close()
 
+	tcpListener, tcpHandler, err := s.listenTCP(c)
+	if err != nil {
+		return err
+	}
+	if tcpListener != nil {
+		defer tcpListener.Close()
+	}
+	csiListener, err := listenCSI(c.String("csi-endpoint"))
+	if err != nil {
+		return err
+	}
+	if csiListener != nil {
+		defer csiListener.Close()
+	}
+
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
 	signal.Notify(sigs, os.Interrupt, os.Kill, syscall.SIGTERM)
@@ -353,14 +741,46 @@ func Start(sockFile string, c *cli.Context) error {
 		done <- true
 	}()
 
+	if s.settings != nil {
+		reloads := make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+		go func() {
+			for range reloads {
+				if err := s.reloadSettings(); err != nil {
+					log.Errorf("Failed to reload config file, keeping the current settings: %v", err)
+				}
+			}
+		}()
+	}
+
 	go func() {
-		err = http.Serve(l, s.Router)
+		err = newHTTPServer(s.Router).Serve(l)
 		if err != nil {
 			log.Error("http server error", err.Error())
 		}
 		done <- true
 	}()
 
+	if tcpListener != nil {
+		log.Infof("Listening on %v", tcpListener.Addr())
+		go func() {
+			if err := newHTTPServer(tcpHandler).Serve(tcpListener); err != nil {
+				log.Error("http server error", err.Error())
+			}
+			done <- true
+		}()
+	}
+
+	if csiListener != nil {
+		log.Infof("Serving CSI on %v", csiListener.Addr())
+		go func() {
+			if err := newCSIServer(s, c.App.Version).Serve(csiListener); err != nil {
+				log.Error("CSI server error", err.Error())
+			}
+			done <- true
+		}()
+	}
+
 	<-done
 	return nil
 }
@@ -368,7 +788,10 @@ func Start(sockFile string, c *cli.Context) error {
 func (s *daemon) getDriver(driverName string) (ConvoyDriver, error) {
 	driver, exists := s.ConvoyDrivers[driverName]
 	if !exists {
-		return nil, fmt.Errorf("Cannot find driver %s", driverName)
+		if err, failed := s.driverInitErrors[driverName]; failed {
+			return nil, fmt.Errorf("Driver %s is unavailable because it failed to initialize: %v", driverName, err)
+		}
+		return nil, api.NewError(api.ERROR_CODE_NOT_FOUND, "Cannot find driver %s", driverName).WithDetail("driver", driverName)
 	}
 	return driver, nil
 }
@@ -386,7 +809,11 @@ func (s *daemon) getSnapshotOpsForVolume(volume *Volume) (SnapshotOperations, er
 	if err != nil {
 		return nil, err
 	}
-	return driver.SnapshotOps()
+	snapOps, err := driver.SnapshotOps()
+	if err != nil {
+		return nil, driverUnsupportedError(volume.DriverName, "snapshot operations").WithDetail("reason", err.Error())
+	}
+	return snapOps, nil
 }
 
 func (s *daemon) getBackupOpsForVolume(volume *Volume) (BackupOperations, error) {
@@ -394,21 +821,19 @@ func (s *daemon) getBackupOpsForVolume(volume *Volume) (BackupOperations, error)
 	if err != nil {
 		return nil, err
 	}
-	return driver.BackupOps()
-}
-
-type APIError struct {
-	error      string
-	statusCode int
-}
-
-func (e APIError) Error() string {
-	return e.error
+	backupOps, err := driver.BackupOps()
+	if err != nil {
+		return nil, driverUnsupportedError(volume.DriverName, "backup operations").WithDetail("reason", err.Error())
+	}
+	return backupOps, nil
 }
 
+// checkForStatusCode returns the HTTP status of err, or zero if it's not
+// typed by code
 func checkForStatusCode(err error) int {
-	if apiError, ok := err.(APIError); ok {
-		return apiError.statusCode
+	e := toAPIError(err)
+	if e.Code == api.ERROR_CODE_UNKNOWN {
+		return 0
 	}
-	return 0
+	return e.StatusCode()
 }
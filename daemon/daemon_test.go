@@ -0,0 +1,163 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/metrics"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+const (
+	testHealthyDriver = "test-healthy"
+	testFailingDriver = "test-failing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	root string
+}
+
+var _ = Suite(&TestSuite{})
+
+type testDriver struct {
+	name string
+}
+
+func (d *testDriver) Name() string {
+	return d.name
+}
+
+func (d *testDriver) Info() (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (d *testDriver) VolumeOps() (VolumeOperations, error) {
+	return nil, fmt.Errorf("Not implemented")
+}
+
+func (d *testDriver) SnapshotOps() (SnapshotOperations, error) {
+	return nil, fmt.Errorf("Not implemented")
+}
+
+func (d *testDriver) BackupOps() (BackupOperations, error) {
+	return nil, fmt.Errorf("Not implemented")
+}
+
+func init() {
+	if err := Register(testHealthyDriver, func(root string, config map[string]string) (ConvoyDriver, error) {
+		return &testDriver{name: testHealthyDriver}, nil
+	}); err != nil {
+		panic(err)
+	}
+	if err := Register(testFailingDriver, func(root string, config map[string]string) (ConvoyDriver, error) {
+		return nil, fmt.Errorf("cannot reach storage")
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.root, err = ioutil.TempDir("", "convoy-daemon")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	c.Assert(os.RemoveAll(s.root), IsNil)
+}
+
+func (s *TestSuite) newDaemon(mode string, drivers ...string) *daemon {
+	return &daemon{
+		ConvoyDrivers: make(map[string]ConvoyDriver),
+		daemonConfig: daemonConfig{
+			Root:           s.root,
+			DriverList:     drivers,
+			DefaultDriver:  drivers[0],
+			DriverInitMode: mode,
+		},
+		store: &fileStore{root: s.root},
+	}
+}
+
+func (s *TestSuite) TestDriverInitStrict(c *C) {
+	d := s.newDaemon(DRIVER_INIT_MODE_STRICT, testHealthyDriver, testFailingDriver)
+	err := d.initDrivers(map[string]string{})
+	c.Assert(err, ErrorMatches, "cannot reach storage")
+}
+
+func (s *TestSuite) TestDriverInitBestEffort(c *C) {
+	d := s.newDaemon(DRIVER_INIT_MODE_BESTEFFORT, testHealthyDriver, testFailingDriver)
+	c.Assert(d.initDrivers(map[string]string{}), IsNil)
+	c.Assert(d.ConvoyDrivers, HasLen, 1)
+
+	_, err := d.getDriver(testHealthyDriver)
+	c.Assert(err, IsNil)
+	_, err = d.getDriver(testFailingDriver)
+	c.Assert(err, ErrorMatches, "Driver "+testFailingDriver+" is unavailable.*cannot reach storage")
+
+	status := d.getDriverStatus()
+	c.Assert(status[testHealthyDriver]["Status"], Equals, DRIVER_STATUS_AVAILABLE)
+	c.Assert(status[testFailingDriver]["Status"], Equals, DRIVER_STATUS_UNAVAILABLE)
+	c.Assert(status[testFailingDriver]["Error"], Equals, "cannot reach storage")
+}
+
+func (s *TestSuite) TestDriverInitBestEffortAllFailed(c *C) {
+	d := s.newDaemon(DRIVER_INIT_MODE_BESTEFFORT, testFailingDriver)
+	err := d.initDrivers(map[string]string{})
+	c.Assert(err, ErrorMatches, "None of drivers.*was initialized successfully")
+}
+
+func (s *TestSuite) TestDriverInitBestEffortDefaultFailed(c *C) {
+	d := s.newDaemon(DRIVER_INIT_MODE_BESTEFFORT, testFailingDriver, testHealthyDriver)
+	err := d.initDrivers(map[string]string{})
+	c.Assert(err, ErrorMatches, "Default driver "+testFailingDriver+" failed to initialize: cannot reach storage")
+}
+
+func (s *TestSuite) TestValidateDriverInitMode(c *C) {
+	c.Assert(validateDriverInitMode(DRIVER_INIT_MODE_STRICT), IsNil)
+	c.Assert(validateDriverInitMode(DRIVER_INIT_MODE_BESTEFFORT), IsNil)
+	c.Assert(validateDriverInitMode("lenient"), NotNil)
+}
+
+func (s *TestSuite) TestBackupMetrics(c *C) {
+	d := s.newVFSDaemon(c)
+	volume, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "metricsvol",
+	})
+	c.Assert(err, IsNil)
+	snapshotName, err := d.processSnapshotCreate(volume, "", nil, "", nil)
+	c.Assert(err, IsNil)
+
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	goodURL := "vfs://" + dest
+	badURL := "vfs://" + filepath.Join(s.root, "nonexistent")
+
+	_, err = d.processBackupCreate(snapshotName, badURL, "", "")
+	c.Assert(err, NotNil)
+	c.Assert(metrics.BackupFailures.Get("metricsvol", badURL), Equals, float64(1))
+	c.Assert(metrics.BackupLastSuccess.Get("metricsvol", badURL), Equals, float64(0))
+
+	_, err = d.processBackupCreate(snapshotName, goodURL, "", "")
+	c.Assert(err, IsNil)
+	c.Assert(metrics.BackupFailures.Get("metricsvol", goodURL), Equals, float64(0))
+	c.Assert(metrics.BackupSuccesses.Get("metricsvol", goodURL), Equals, float64(1))
+	c.Assert(metrics.BackupLastSuccess.Get("metricsvol", goodURL) > 0, Equals, true)
+	c.Assert(metrics.ObjectStoreRequestDuration.Count(goodURL, "upload") > 0, Equals, true)
+	c.Assert(metrics.ObjectStoreBytesUploaded.Get(goodURL) > 0, Equals, true)
+
+	w := httptest.NewRecorder()
+	c.Assert(d.doMetrics("", w, nil, nil), IsNil)
+	c.Assert(bytes.Contains(w.Body.Bytes(),
+		[]byte(`convoy_backup_failure_total{volume="metricsvol",destination="`+badURL+`"} 1`)), Equals, true)
+}
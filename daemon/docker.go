@@ -6,12 +6,18 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/rancher/convoy/api"
 	. "github.com/rancher/convoy/convoydriver"
 	"github.com/rancher/convoy/util"
 )
 
+const (
+	PLUGIN_SCOPE_LOCAL  = "local"
+	PLUGIN_SCOPE_GLOBAL = "global"
+)
+
 type pluginInfo struct {
 	Implements []string
 }
@@ -23,14 +29,77 @@ type pluginResponse struct {
 	Volume     *DockerVolume   `json:",omitempty"`
 }
 
+type pluginCapabilities struct {
+	Scope string
+}
+
+type pluginCapabilitiesResponse struct {
+	Capabilities pluginCapabilities
+}
+
 type DockerVolume struct {
 	Name       string `json:",omitempty"`
 	Mountpoint string `json:",omitempty"`
+	CreatedAt  string `json:",omitempty"`
 }
 
 type pluginRequest struct {
 	Name string
 	Opts map[string]string
+	// ID identifies the caller of mount and unmount, sent by Docker 1.13+
+	ID string
+}
+
+/*
+addDockerMount records a caller of the mount of volume, since Docker would send
+a mount request for every container using the volume, and an unmount request
+once each of them stops. Callers are saved in the config of volume, so they're
+still known after the daemon restarts.
+*/
+func (s *daemon) addDockerMount(name, id string) error {
+	return s.updateVolumeConfig(name, func(config *VolumeConfig) (bool, error) {
+		for _, caller := range config.DockerMountCallers {
+			if caller == id {
+				return false, nil
+			}
+		}
+		config.DockerMountCallers = append(config.DockerMountCallers, id)
+		return true, nil
+	})
+}
+
+// removeDockerMount removes a caller of the mount of volume, returns true if
+// no caller, including the targets CSI published the volume to, is using the
+// volume anymore, so it can be unmounted
+func (s *daemon) removeDockerMount(name, id string) (bool, error) {
+	unused := false
+	if err := s.updateVolumeConfig(name, func(config *VolumeConfig) (bool, error) {
+		callers := []string{}
+		for _, caller := range config.DockerMountCallers {
+			if caller != id {
+				callers = append(callers, caller)
+			}
+		}
+		unused = len(callers) == 0 && len(config.CSIPublishTargets) == 0
+		if len(callers) == len(config.DockerMountCallers) {
+			return false, nil
+		}
+		if len(callers) == 0 {
+			callers = nil
+		}
+		config.DockerMountCallers = callers
+		return true, nil
+	}); err != nil {
+		return false, err
+	}
+	return unused, nil
+}
+
+func validatePluginScope(scope string) error {
+	if scope != PLUGIN_SCOPE_LOCAL && scope != PLUGIN_SCOPE_GLOBAL {
+		return fmt.Errorf("Invalid plugin scope %v, must be %v or %v", scope, PLUGIN_SCOPE_LOCAL, PLUGIN_SCOPE_GLOBAL)
+	}
+	return nil
 }
 
 func (s *daemon) dockerActivate(w http.ResponseWriter, r *http.Request) {
@@ -41,6 +110,15 @@ func (s *daemon) dockerActivate(w http.ResponseWriter, r *http.Request) {
 	writeResponseOutput(w, info)
 }
 
+func (s *daemon) dockerCapabilities(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("Handle plugin capabilities: %v %v", r.Method, r.RequestURI)
+	writeResponseOutput(w, pluginCapabilitiesResponse{
+		Capabilities: pluginCapabilities{
+			Scope: s.PluginScope,
+		},
+	})
+}
+
 func convertToPluginRequest(r *http.Request) (*pluginRequest, error) {
 	request := &pluginRequest{}
 	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
@@ -58,35 +136,80 @@ func (s *daemon) createDockerVolume(request *pluginRequest) (*Volume, error) {
 		return nil, fmt.Errorf("Invalid volume name %s. Can only contain 0-9, a-z, dash(-), underscore(_) and dot(.)", name)
 	}
 
-	size, err := util.ParseSize(request.Opts["size"])
+	createReq, err := parseVolumeCreateOpts(name, request.Opts)
+	if err != nil {
+		return nil, err
+	}
+	return s.processVolumeCreate(createReq)
+}
+
+// parseVolumeCreateOpts returns the request to create volume name with the
+// options of Docker, which are also the parameters of CSI
+func parseVolumeCreateOpts(name string, opts map[string]string) (*api.VolumeCreateRequest, error) {
+	size, err := util.ParseSize(opts["size"])
 	if err != nil {
 		return nil, err
 	}
 	iops := 0
-	if request.Opts["iops"] != "" {
-		iops, err = strconv.Atoi(request.Opts["iops"])
+	if opts["iops"] != "" {
+		iops, err = strconv.Atoi(opts["iops"])
+		if err != nil {
+			return nil, err
+		}
+	}
+	throughput := 0
+	if opts["throughput"] != "" {
+		throughput, err = strconv.Atoi(opts["throughput"])
 		if err != nil {
 			return nil, err
 		}
 	}
 	prepareForVM := false
-	if request.Opts["vm"] != "" {
-		prepareForVM, err = strconv.ParseBool(request.Opts["vm"])
+	if opts["vm"] != "" {
+		prepareForVM, err = strconv.ParseBool(opts["vm"])
+		if err != nil {
+			return nil, err
+		}
+	}
+	readOnly := false
+	if opts["ro"] != "" {
+		readOnly, err = strconv.ParseBool(opts["ro"])
+		if err != nil {
+			return nil, err
+		}
+	}
+	tags, err := util.ParseTags(opts["tags"])
+	if err != nil {
+		return nil, err
+	}
+	encrypted := false
+	if opts["encrypted"] != "" {
+		encrypted, err = strconv.ParseBool(opts["encrypted"])
 		if err != nil {
 			return nil, err
 		}
 	}
 	createReq := &api.VolumeCreateRequest{
 		Name:           name,
-		DriverName:     request.Opts["driver"],
+		DriverName:     opts["driver"],
 		Size:           size,
-		BackupURL:      request.Opts["backup"],
-		DriverVolumeID: request.Opts["id"],
-		Type:           request.Opts["type"],
+		BackupURL:      opts["backup"],
+		DriverVolumeID: opts["id"],
+		Type:           opts["type"],
 		PrepareForVM:   prepareForVM,
 		IOPS:           int64(iops),
+		Throughput:     int64(throughput),
+		MountOptions:   opts["mountopts"],
+		ReadOnly:       readOnly,
+		Tags:           tags,
+		Encrypted:      encrypted,
+		KmsKeyID:       opts["kmskeyid"],
+		UID:            opts["uid"],
+		GID:            opts["gid"],
+		Mode:           opts["mode"],
+		Profile:        opts["profile"],
 	}
-	return s.processVolumeCreate(createReq)
+	return createReq, nil
 }
 
 func (s *daemon) getDockerVolume(r *http.Request) (*Volume, *pluginRequest, error) {
@@ -94,7 +217,11 @@ func (s *daemon) getDockerVolume(r *http.Request) (*Volume, *pluginRequest, erro
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to convert request to pluginRequest: %v", err)
 	}
-	request.Opts = make(map[string]string)
+	// Options of Docker are ignored unless enabled, so volumes created by
+	// Docker always get the default driver and options of daemon
+	if request.Opts == nil || !s.DockerVolumeOpts {
+		request.Opts = make(map[string]string)
+	}
 	log.Debugf("Request obj is %v. Name:%s - Opts:%v", request, request.Name, request.Opts)
 
 	//This check parses the name to check if there is a need to pick the size from the name.
@@ -133,14 +260,12 @@ func (s *daemon) dockerCreateVolume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Existing volume is checked against the options, so retries of the
+	// same request succeed while different options are rejected
 	if volume != nil {
 		log.Debugf("Found existing volume for docker %v", volume.Name)
-		dockerResponse(w, "", nil)
-		return
 	}
-
-	volume, err = s.createDockerVolume(request)
-	if err != nil {
+	if _, err := s.createDockerVolume(request); err != nil {
 		dockerResponse(w, "", err)
 		return
 	}
@@ -205,6 +330,7 @@ func (s *daemon) dockerMountVolume(w http.ResponseWriter, r *http.Request) {
 			request := &api.VolumeDeleteRequest{
 				VolumeName:    volume.Name,
 				ReferenceOnly: true,
+				Purge:         true,
 			}
 
 			// if a volume is not attached then processVolumeDelete() just updates the local state.
@@ -237,6 +363,12 @@ func (s *daemon) dockerMountVolume(w http.ResponseWriter, r *http.Request) {
 		dockerResponse(w, "", err)
 		return
 	}
+	if request.ID != "" {
+		if err := s.addDockerMount(volume.Name, request.ID); err != nil {
+			dockerResponse(w, "", err)
+			return
+		}
+	}
 
 	dockerResponse(w, mountPoint, nil)
 }
@@ -244,7 +376,7 @@ func (s *daemon) dockerMountVolume(w http.ResponseWriter, r *http.Request) {
 func (s *daemon) dockerUnmountVolume(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("Handle plugin unmount volume: %v %v", r.Method, r.RequestURI)
 
-	volume, _, err := s.getDockerVolume(r)
+	volume, request, err := s.getDockerVolume(r)
 	if err != nil {
 		dockerResponse(w, "", err)
 		return
@@ -256,6 +388,19 @@ func (s *daemon) dockerUnmountVolume(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if request.ID != "" {
+		unused, err := s.removeDockerMount(volume.Name, request.ID)
+		if err != nil {
+			dockerResponse(w, "", err)
+			return
+		}
+		if !unused {
+			log.Debugf("Volume %v is still used by other containers, skip unmount for %v", volume.Name, request.ID)
+			dockerResponse(w, "", nil)
+			return
+		}
+	}
+
 	log.Debugf("Unmount volume: %v for docker", volume.Name)
 
 	if err := s.processVolumeUmount(volume); err != nil {
@@ -316,6 +461,12 @@ func (s *daemon) dockerGetVolume(w http.ResponseWriter, r *http.Request) {
 			Mountpoint: mountPoint,
 		},
 	}
+	if driverInfo, err := s.getVolumeDriverInfo(volume); err == nil {
+		// Docker expects RFC 3339 format
+		if t, err := time.Parse(time.RubyDate, driverInfo[OPT_VOLUME_CREATED_TIME]); err == nil {
+			response.Volume.CreatedAt = t.Format(time.RFC3339)
+		}
+	}
 
 	log.Debugf("Found volume %v for docker", volume.Name)
 
@@ -0,0 +1,177 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) dockerRequest(c *C, router http.Handler, path string, request *pluginRequest) *pluginResponse {
+	w := s.serveRequest(c, router, "POST", path, request)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	response := &pluginResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), response), IsNil)
+	return response
+}
+
+func (s *TestSuite) TestDockerCapabilities(c *C) {
+	d := s.newVFSDaemon(c)
+	d.PluginScope = PLUGIN_SCOPE_GLOBAL
+	router := createRouter(d)
+
+	w := s.serveRequest(c, router, "POST", "/VolumeDriver.Capabilities", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	response := &pluginCapabilitiesResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), response), IsNil)
+	c.Assert(response.Capabilities.Scope, Equals, PLUGIN_SCOPE_GLOBAL)
+
+	c.Assert(validatePluginScope(PLUGIN_SCOPE_LOCAL), IsNil)
+	c.Assert(validatePluginScope("cluster"), NotNil)
+}
+
+func (s *TestSuite) TestDockerMountCallers(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	response := s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1",
+		Opts: map[string]string{"driver": "vfs"},
+	})
+	c.Assert(response.Err, Equals, "")
+
+	response = s.dockerRequest(c, router, "/VolumeDriver.Get", &pluginRequest{Name: "vol1"})
+	c.Assert(response.Err, Equals, "")
+	c.Assert(response.Volume.Name, Equals, "vol1")
+	c.Assert(response.Volume.Mountpoint, Equals, "")
+	_, err := time.Parse(time.RFC3339, response.Volume.CreatedAt)
+	c.Assert(err, IsNil)
+
+	response = s.dockerRequest(c, router, "/VolumeDriver.Mount", &pluginRequest{Name: "vol1", ID: "container1"})
+	c.Assert(response.Err, Equals, "")
+	mountPoint := response.Mountpoint
+	c.Assert(mountPoint, Not(Equals), "")
+	response = s.dockerRequest(c, router, "/VolumeDriver.Mount", &pluginRequest{Name: "vol1", ID: "container2"})
+	c.Assert(response.Err, Equals, "")
+
+	// Still used by container2, after the daemon restarts as well
+	d = s.newVFSDaemon(c)
+	router = createRouter(d)
+	response = s.dockerRequest(c, router, "/VolumeDriver.Unmount", &pluginRequest{Name: "vol1", ID: "container1"})
+	c.Assert(response.Err, Equals, "")
+	response = s.dockerRequest(c, router, "/VolumeDriver.Get", &pluginRequest{Name: "vol1"})
+	c.Assert(response.Volume.Mountpoint, Equals, mountPoint)
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.DockerMountCallers, DeepEquals, []string{"container2"})
+
+	response = s.dockerRequest(c, router, "/VolumeDriver.Unmount", &pluginRequest{Name: "vol1", ID: "container2"})
+	c.Assert(response.Err, Equals, "")
+	response = s.dockerRequest(c, router, "/VolumeDriver.Get", &pluginRequest{Name: "vol1"})
+	c.Assert(response.Volume.Mountpoint, Equals, "")
+	config, err = d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.DockerMountCallers, IsNil)
+
+	response = s.dockerRequest(c, router, "/VolumeDriver.Get", &pluginRequest{Name: "nonexistent"})
+	c.Assert(response.Err, Not(Equals), "")
+}
+
+func (s *TestSuite) TestDockerCreateRetry(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	for i := 0; i < 2; i++ {
+		response := s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+			Name: "vol1~10G",
+			Opts: map[string]string{"driver": "vfs"},
+		})
+		c.Assert(response.Err, Equals, "")
+	}
+	response := s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1~20G",
+	})
+	c.Assert(response.Err, Matches, "Volume vol1 already exists with different options: Size .*")
+}
+
+func (s *TestSuite) TestDockerVolumeOpts(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	// Options of Docker are ignored by default
+	response := s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1",
+		Opts: map[string]string{"mountopts": "nodev"},
+	})
+	c.Assert(response.Err, Equals, "")
+	info, err := d.getVolumeDriverInfo(d.getVolume("vol1"))
+	c.Assert(err, IsNil)
+	c.Assert(info["MountOptions"], Equals, "")
+
+	d.DockerVolumeOpts = true
+	response = s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol2",
+		Opts: map[string]string{"mountopts": "nodev"},
+	})
+	c.Assert(response.Err, Equals, "")
+	info, err = d.getVolumeDriverInfo(d.getVolume("vol2"))
+	c.Assert(err, IsNil)
+	c.Assert(info["MountOptions"], Equals, "nodev")
+}
+
+func (s *TestSuite) TestDockerCreateMountOptions(c *C) {
+	d := s.newVFSDaemon(c)
+	d.DockerVolumeOpts = true
+	router := createRouter(d)
+
+	response := s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1",
+		Opts: map[string]string{"mountopts": "noatime,,ro"},
+	})
+	c.Assert(response.Err, Matches, "Invalid mount options.*")
+
+	// VFS volumes are directories, which can only have the options of
+	// bind mount
+	response = s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1",
+		Opts: map[string]string{"mountopts": "noatime"},
+	})
+	c.Assert(response.Err, Matches, "Unsupported bind mount option noatime.*")
+	c.Assert(d.getVolume("vol1"), IsNil)
+
+	response = s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1",
+		Opts: map[string]string{"mountopts": "nodev,rshared"},
+	})
+	c.Assert(response.Err, Equals, "")
+	info, err := d.getVolumeDriverInfo(d.getVolume("vol1"))
+	c.Assert(err, IsNil)
+	c.Assert(info["MountOptions"], Equals, "nodev,rshared")
+}
+
+func (s *TestSuite) TestDockerCreateReadOnly(c *C) {
+	d := s.newVFSDaemon(c)
+	d.DockerVolumeOpts = true
+	router := createRouter(d)
+
+	response := s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1",
+		Opts: map[string]string{"ro": "maybe"},
+	})
+	c.Assert(response.Err, Not(Equals), "")
+
+	response = s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1",
+		Opts: map[string]string{"ro": "true"},
+	})
+	c.Assert(response.Err, Matches, "Read-only mount is not supported by vfs")
+	c.Assert(d.getVolume("vol1"), IsNil)
+
+	response = s.dockerRequest(c, router, "/VolumeDriver.Create", &pluginRequest{
+		Name: "vol1",
+		Opts: map[string]string{"ro": "false"},
+	})
+	c.Assert(response.Err, Equals, "")
+	c.Assert(d.getVolume("vol1"), NotNil)
+}
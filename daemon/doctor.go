@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/rancher/convoy/api"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+/*
+reconcileMounts brings the recorded state of volumes back in line with the
+host, which may have diverged after a crash of daemon or host. The mount
+point of every volume is corrected with the mount table first, then the
+mounts left in the directories of drivers which don't belong to any volume
+are umounted. In cluster mode, the attachments of this host are updated to
+match the mounts at last. It keeps going on errors, which are returned in the response.
+*/
+func (s *daemon) reconcileMounts() *api.DoctorResponse {
+	resp := &api.DoctorResponse{}
+
+	names := []string{}
+	for name := range s.getVolumeList() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		volume := s.getVolume(name)
+		if volume == nil {
+			continue
+		}
+		recorded, err := s.getVolumeMountPoint(volume)
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot get mount point of volume %v: %v", name, err))
+			continue
+		}
+		actual, err := s.processVolumeRefresh(volume)
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot refresh mount point of volume %v: %v", name, err))
+			continue
+		}
+		if actual != recorded {
+			resp.MountPoints = append(resp.MountPoints, api.MountPointChange{
+				Volume:   name,
+				Recorded: recorded,
+				Actual:   actual,
+			})
+		}
+	}
+
+	for _, driverName := range s.DriverList {
+		driver, exists := s.ConvoyDrivers[driverName]
+		if !exists {
+			continue
+		}
+		cleaner, ok := driver.(OrphanMountCleaner)
+		if !ok {
+			continue
+		}
+		mountPoints, err := cleaner.CleanupOrphanMounts()
+		resp.OrphanMounts = append(resp.OrphanMounts, mountPoints...)
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot cleanup orphan mounts of driver %v: %v", driverName, err))
+		}
+	}
+
+	s.reconcileAttachments(resp)
+	return resp
+}
+
+func (s *daemon) doDoctor(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	return writeResponseOutput(w, s.reconcileMounts())
+}
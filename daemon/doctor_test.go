@@ -0,0 +1,31 @@
+package daemon
+
+import (
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestReconcileMounts(c *C) {
+	d := s.newVFSDaemon(c)
+	for _, name := range []string{"vol1", "vol2"} {
+		_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+			Name: name,
+		})
+		c.Assert(err, IsNil)
+	}
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{
+		VolumeName: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	// VFS volumes are directories, their mount points are always in sync
+	resp := d.reconcileMounts()
+	c.Assert(resp.Errors, HasLen, 0)
+	c.Assert(resp.MountPoints, HasLen, 0)
+	c.Assert(resp.OrphanMounts, HasLen, 0)
+
+	recorded, err := d.getVolumeMountPoint(d.getVolume("vol1"))
+	c.Assert(err, IsNil)
+	c.Assert(recorded, Equals, mountPoint)
+}
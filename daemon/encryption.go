@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	// Keys provided by clients are only kept in memory, so they must be
+	// provided again to restore backups after the daemon restarts. Keys
+	// generated by KMS are kept wrapped by KMS, so later backups by the same
+	// KMS key use the same key and stay incremental.
+	ENCRYPTION_KEYS_DIRECTORY  = "encryption_keys"
+	ENCRYPTION_KMS_KEY_PREFIX  = "kms-"
+	ENCRYPTION_KMS_KEY_POSTFIX = ".json"
+)
+
+// kmsEncryptionKey is a key generated by KMS key KMSKeyID, wrapped in Blob
+type kmsEncryptionKey struct {
+	KMSKeyID string
+	KeyID    string
+	Blob     []byte
+}
+
+func (s *daemon) getEncryptionKeysDir() string {
+	return filepath.Join(s.Root, ENCRYPTION_KEYS_DIRECTORY)
+}
+
+func (s *daemon) getKMSEncryptionKeyFile(kmsKeyID string) string {
+	sum := sha256.Sum256([]byte(kmsKeyID))
+	return filepath.Join(s.getEncryptionKeysDir(), ENCRYPTION_KMS_KEY_PREFIX+hex.EncodeToString(sum[:])+ENCRYPTION_KMS_KEY_POSTFIX)
+}
+
+// addEncryptionKey loads the key from content of key file in base64, returns
+// the key ID. The key is not saved.
+func (s *daemon) addEncryptionKey(encoded string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("Invalid encryption key, must be in base64: %v", err)
+	}
+	key, err := objectstore.ParseEncryptionKey(data)
+	if err != nil {
+		return "", err
+	}
+	return objectstore.AddEncryptionKey(key)
+}
+
+/*
+addKMSEncryptionKey returns the ID of key generated by kmsKeyID for backups.
+The key is generated on the first use of kmsKeyID, and only the key wrapped
+by KMS is saved, which is unwrapped by KMS when the key is used again.
+*/
+func (s *daemon) addKMSEncryptionKey(kmsKeyID string) (string, error) {
+	s.encryptionKeysLock.Lock()
+	defer s.encryptionKeysLock.Unlock()
+
+	file := s.getKMSEncryptionKeyFile(kmsKeyID)
+	if _, err := os.Stat(file); err == nil {
+		k, err := loadKMSEncryptionKey(file)
+		if err != nil {
+			return "", err
+		}
+		return k.KeyID, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	keyID, blob, err := objectstore.GenerateKMSEncryptionKey(kmsKeyID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(s.getEncryptionKeysDir(), 0700); err != nil {
+		return "", err
+	}
+	k := &kmsEncryptionKey{
+		KMSKeyID: kmsKeyID,
+		KeyID:    keyID,
+		Blob:     blob,
+	}
+	data, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	if err := util.WriteFileAtomic(file, data); err != nil {
+		return "", err
+	}
+	return keyID, nil
+}
+
+func loadKMSEncryptionKey(file string) (*kmsEncryptionKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	k := &kmsEncryptionKey{}
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("Invalid KMS encryption key file %v: %v", file, err)
+	}
+	objectstore.AddWrappedEncryptionKey(k.KeyID, k.KMSKeyID, k.Blob)
+	return k, nil
+}
+
+// loadEncryptionKeys loads the wrapped keys generated by KMS, which are
+// unwrapped when they're used
+func (s *daemon) loadEncryptionKeys() error {
+	dir := s.getEncryptionKeysDir()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasPrefix(f.Name(), ENCRYPTION_KMS_KEY_PREFIX) ||
+			!strings.HasSuffix(f.Name(), ENCRYPTION_KMS_KEY_POSTFIX) {
+			continue
+		}
+		if _, err := loadKMSEncryptionKey(filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getBackupEncryptionKey returns the ID of key to encrypt a backup by, from
+// the key or KMS key of request, empty if the backup is not encrypted
+func (s *daemon) getBackupEncryptionKey(key, kmsKeyID string) (string, error) {
+	if key != "" && kmsKeyID != "" {
+		return "", fmt.Errorf("Cannot specify both encryption key and KMS key")
+	}
+	if kmsKeyID != "" {
+		return s.addKMSEncryptionKey(kmsKeyID)
+	}
+	if key != "" {
+		return s.addEncryptionKey(key)
+	}
+	return "", nil
+}
@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+// driverErrorCodes maps the codes of util.ConvoyDriverErr to the ones of API
+var driverErrorCodes = map[int]string{
+	util.ErrVolumeNotFoundCode:   api.ERROR_CODE_NOT_FOUND,
+	util.ErrSnapshotNotFoundCode: api.ERROR_CODE_NOT_FOUND,
+	util.ErrVolumeInUseCode:      api.ERROR_CODE_IN_USE,
+	util.ErrVolumeExistsCode:     api.ERROR_CODE_CONFLICT,
+	util.ErrVolumeTransitionCode: api.ERROR_CODE_BUSY,
+	util.ErrInvalidRequestCode:   api.ERROR_CODE_INVALID_REQUEST,
+}
+
+// toAPIError returns err as it's responded to clients, with the code of the
+// typed errors of drivers and util
+func toAPIError(err error) *api.Error {
+	if e, ok := err.(*api.Error); ok {
+		return e
+	}
+	code := api.ErrorCode(err)
+	if code == api.ERROR_CODE_UNKNOWN {
+		var execErr *util.ExecError
+		if errors.As(err, &execErr) && execErr.Timeout {
+			code = api.ERROR_CODE_TIMEOUT
+		} else if util.IsNotExistsError(err) || util.IsNotExistsInBackendError(err) {
+			code = api.ERROR_CODE_NOT_FOUND
+		} else if driverErr, ok := err.(*util.ConvoyDriverErr); ok {
+			if driverCode, exists := driverErrorCodes[driverErr.ErrorCode]; exists {
+				code = driverCode
+			}
+		}
+	}
+	return &api.Error{
+		Code:    code,
+		Message: err.Error(),
+	}
+}
+
+// writeError responds err in JSON, with status if it's not zero, otherwise
+// the status of its code
+func writeError(w http.ResponseWriter, err *api.Error, status int) {
+	if status == 0 {
+		status = err.StatusCode()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(err)
+}
+
+func volumeNotFoundError(name string) *api.Error {
+	return api.NewError(api.ERROR_CODE_NOT_FOUND, "volume %v doesn't exist", name).WithDetail("volume", name)
+}
+
+func snapshotNotFoundError(snapshotName, volumeName string) *api.Error {
+	return api.NewError(api.ERROR_CODE_NOT_FOUND, "snapshot %v of volume %v doesn't exist", snapshotName, volumeName).
+		WithDetail("snapshot", snapshotName).WithDetail("volume", volumeName)
+}
+
+// driverUnsupportedError is returned when driver doesn't support operation,
+// e.g. "snapshot diff"
+func driverUnsupportedError(driverName, operation string) *api.Error {
+	return api.NewError(api.ERROR_CODE_DRIVER_UNSUPPORTED, "Driver %v doesn't support %v", driverName, operation).
+		WithDetail("driver", driverName)
+}
@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestToAPIError(c *C) {
+	e := toAPIError(volumeNotFoundError("vol1"))
+	c.Assert(e.Code, Equals, api.ERROR_CODE_NOT_FOUND)
+	c.Assert(e.StatusCode(), Equals, http.StatusNotFound)
+	c.Assert(e.Details, DeepEquals, map[string]string{"volume": "vol1"})
+
+	e = toAPIError(fmt.Errorf("Failed to back up: %w", api.NewError(api.ERROR_CODE_BUSY, "busy")))
+	c.Assert(e.Code, Equals, api.ERROR_CODE_BUSY)
+	c.Assert(e.Message, Equals, "Failed to back up: busy")
+	c.Assert(e.StatusCode(), Equals, http.StatusServiceUnavailable)
+
+	e = toAPIError(util.NewConvoyDriverErr(fmt.Errorf("Volume=vol1 already exists"), util.ErrVolumeExistsCode))
+	c.Assert(e.Code, Equals, api.ERROR_CODE_CONFLICT)
+	c.Assert(e.StatusCode(), Equals, http.StatusConflict)
+	c.Assert(toAPIError(util.ErrorNotExists()).Code, Equals, api.ERROR_CODE_NOT_FOUND)
+
+	e = toAPIError(fmt.Errorf("something failed"))
+	c.Assert(e.Code, Equals, api.ERROR_CODE_UNKNOWN)
+	c.Assert(e.StatusCode(), Equals, http.StatusBadRequest)
+	c.Assert(checkForStatusCode(e), Equals, 0)
+}
+
+func (s *TestSuite) TestErrorResponse(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	w := s.serveRequest(c, router, "DELETE", "/volumes/", &api.VolumeDeleteRequest{VolumeName: "vol1"})
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	s.assertError(c, w, api.ERROR_CODE_NOT_FOUND, "volume vol1 doesn't exist")
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	w = s.serveRequest(c, router, "POST", "/volumes/import", &api.VolumeImportRequest{
+		Name:   "vol1",
+		Source: s.root,
+	})
+	c.Assert(w.Code, Equals, http.StatusConflict)
+	s.assertError(c, w, api.ERROR_CODE_CONFLICT, "Volume vol1 already exists")
+
+	w = s.serveRequest(c, router, "GET", "/jobs/nonexistent", nil)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	s.assertError(c, w, api.ERROR_CODE_NOT_FOUND, "Job nonexistent doesn't exist")
+}
+
+func (s *TestSuite) TestTimeoutError(c *C) {
+	_, err := util.ExecuteWithContext(canceledContext(), "true", []string{})
+	e := toAPIError(fmt.Errorf("Failed to mount: %w", err))
+	c.Assert(e.Code, Equals, api.ERROR_CODE_TIMEOUT)
+	c.Assert(e.StatusCode(), Equals, http.StatusGatewayTimeout)
+
+	_, err = util.ExecuteWithContext(context.Background(), "false", []string{})
+	c.Assert(toAPIError(err).Code, Equals, api.ERROR_CODE_UNKNOWN)
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
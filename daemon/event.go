@@ -0,0 +1,226 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/api"
+)
+
+const (
+	// Events are kept in memory for clients to catch up with the ones
+	// missed while reconnecting, only the latest ones would be kept
+	EVENT_HISTORY_LIMIT = 1000
+	// Events queued for a subscriber reading slowly. The subscriber is
+	// dropped once it's full, so operations are never blocked by it.
+	EVENT_SUBSCRIBER_BUFFER = 100
+	// Comments are sent to idle streams, so proxies keep them open and
+	// clients can tell the daemon is alive
+	EVENT_KEEPALIVE_INTERVAL = 30 * time.Second
+)
+
+/*
+eventStream keeps the latest events and sends new ones to subscribers, for
+clients to follow changes of volumes, snapshots and backups instead of
+polling. Events are numbered from 1 since the daemon started, so clients can
+resume after the last event they got. The zero value is ready to use.
+*/
+type eventStream struct {
+	mutex       sync.Mutex
+	lastID      int64
+	history     []api.EventResponse
+	subscribers map[*eventSubscriber]bool
+}
+
+type eventSubscriber struct {
+	filter eventFilter
+	// Closed once the subscriber is dropped
+	events chan api.EventResponse
+}
+
+// eventFilter selects events of Volume and of Events, all of them if empty
+type eventFilter struct {
+	Volume string
+	Events map[string]bool
+}
+
+func (f eventFilter) matches(event *api.EventResponse) bool {
+	if f.Volume != "" && f.Volume != event.Volume {
+		return false
+	}
+	return len(f.Events) == 0 || f.Events[event.Event]
+}
+
+// publish numbers event and sends it to the subscribers
+func (s *eventStream) publish(event *api.EventResponse) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastID++
+	event.ID = s.lastID
+	s.history = append(s.history, *event)
+	if len(s.history) > EVENT_HISTORY_LIMIT {
+		s.history = s.history[len(s.history)-EVENT_HISTORY_LIMIT:]
+	}
+	for sub := range s.subscribers {
+		if !sub.filter.matches(event) {
+			continue
+		}
+		select {
+		case sub.events <- *event:
+		default:
+			log.Warnf("Dropped event subscriber falling behind at event %v", event.ID)
+			delete(s.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// list returns the events kept after the event of ID after, oldest first
+func (s *eventStream) list(after int64, filter eventFilter) []api.EventResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.listLocked(after, filter)
+}
+
+func (s *eventStream) listLocked(after int64, filter eventFilter) []api.EventResponse {
+	result := []api.EventResponse{}
+	for i := range s.history {
+		if s.history[i].ID > after && filter.matches(&s.history[i]) {
+			result = append(result, s.history[i])
+		}
+	}
+	return result
+}
+
+// subscribe returns the events kept after the event of ID after, and a
+// subscriber receiving the ones published later, so none is missed in
+// between
+func (s *eventStream) subscribe(after int64, filter eventFilter) ([]api.EventResponse, *eventSubscriber) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sub := &eventSubscriber{
+		filter: filter,
+		events: make(chan api.EventResponse, EVENT_SUBSCRIBER_BUFFER),
+	}
+	if s.subscribers == nil {
+		s.subscribers = make(map[*eventSubscriber]bool)
+	}
+	s.subscribers[sub] = true
+	return s.listLocked(after, filter), sub
+}
+
+func (s *eventStream) unsubscribe(sub *eventSubscriber) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.subscribers[sub] {
+		delete(s.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// parseEventsQuery returns the ID of the last event client has got, and the
+// filter of events asked by query
+func parseEventsQuery(r *http.Request) (int64, eventFilter, error) {
+	query := r.URL.Query()
+	filter := eventFilter{
+		Volume: query.Get("volume"),
+		Events: map[string]bool{},
+	}
+	for _, value := range query["event"] {
+		for _, event := range parseList(value) {
+			if !hookEvents[event] {
+				return 0, filter, api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Unknown event %v", event)
+			}
+			filter.Events[event] = true
+		}
+	}
+
+	// Browsers and other clients of server-sent events resume by the
+	// header when reconnecting
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = query.Get("since")
+	}
+	if value == "" {
+		return 0, filter, nil
+	}
+	after, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || after < 0 {
+		return 0, filter, api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Invalid event ID %v", value)
+	}
+	return after, filter, nil
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event *api.EventResponse) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, data)
+	return err
+}
+
+/*
+doEvents responds the events kept by daemon. With "follow=true", it keeps
+streaming them as server-sent events until the client goes away, starting
+with the ones kept after "since" or Last-Event-ID. A client falling too far
+behind is disconnected, and can resume by reconnecting.
+*/
+func (s *daemon) doEvents(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	after, filter, err := parseEventsQuery(r)
+	if err != nil {
+		return err
+	}
+	follow, _ := strconv.ParseBool(r.URL.Query().Get(api.KEY_FOLLOW))
+	if !follow {
+		return writeResponseOutput(w, s.notifier.events.list(after, filter))
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("Streaming events is not supported by the connection")
+	}
+	events, sub := s.notifier.events.subscribe(after, filter)
+	defer s.notifier.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for i := range events {
+		if err := writeServerSentEvent(w, &events[i]); err != nil {
+			// Client has gone away
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				// Dropped for falling behind
+				return nil
+			}
+			if err := writeServerSentEvent(w, &event); err != nil {
+				return nil
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+		case <-r.Context().Done():
+			return nil
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,157 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) listEvents(c *C, router http.Handler, query string) []api.EventResponse {
+	w := s.serveRequest(c, router, "GET", "/events?"+query, nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	events := []api.EventResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &events), IsNil)
+	return events
+}
+
+func (s *TestSuite) TestEvents(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol2",
+	})
+	c.Assert(err, IsNil)
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	_, err = d.processSnapshotCreate(d.getVolume("vol1"), "snap1", nil, "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(d.processSnapshotDelete("snap1"), IsNil)
+	c.Assert(d.processVolumeUmount(d.getVolume("vol1")), IsNil)
+
+	events := s.listEvents(c, router, "")
+	c.Assert(events, HasLen, 6)
+	names := []string{}
+	for i, event := range events {
+		c.Assert(event.ID, Equals, int64(i+1))
+		c.Assert(event.Time, Not(Equals), "")
+		names = append(names, event.Event)
+	}
+	c.Assert(names, DeepEquals, []string{EVENT_VOLUME_CREATE, EVENT_VOLUME_CREATE, EVENT_VOLUME_MOUNT,
+		EVENT_SNAPSHOT_CREATE, EVENT_SNAPSHOT_DELETE, EVENT_VOLUME_UMOUNT})
+	c.Assert(events[2].MountPoint, Equals, mountPoint)
+	c.Assert(events[4].Snapshot, Equals, "snap1")
+
+	events = s.listEvents(c, router, "since=3")
+	c.Assert(events, HasLen, 3)
+	c.Assert(events[0].ID, Equals, int64(4))
+
+	events = s.listEvents(c, router, "volume=vol2")
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].Volume, Equals, "vol2")
+
+	events = s.listEvents(c, router, "volume=vol1&event=volume.mount,volume.umount")
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].Event, Equals, EVENT_VOLUME_MOUNT)
+	c.Assert(events[1].Event, Equals, EVENT_VOLUME_UMOUNT)
+
+	w := s.serveRequest(c, router, "GET", "/events?event=volume.explode", nil)
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, "Unknown event volume.explode")
+	w = s.serveRequest(c, router, "GET", "/events?since=yesterday", nil)
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, "Invalid event ID yesterday")
+}
+
+// readServerSentEvent returns the ID, name and data of the next event from
+// reader, skipping comments
+func readServerSentEvent(c *C, reader *bufio.Reader) (string, string, string) {
+	var id, name, data string
+	for {
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data != "" {
+				return id, name, data
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func (s *TestSuite) TestEventsFollow(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol2",
+	})
+	c.Assert(err, IsNil)
+
+	// Resumed after the first event, with events of vol1 only
+	r, err := http.NewRequest("GET", server.URL+"/v1/events?follow=true&volume=vol1", nil)
+	c.Assert(err, IsNil)
+	r.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(r)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/event-stream")
+	reader := bufio.NewReader(resp.Body)
+
+	id, name, data := readServerSentEvent(c, reader)
+	c.Assert(id, Equals, "1")
+	c.Assert(name, Equals, EVENT_VOLUME_CREATE)
+	event := &api.EventResponse{}
+	c.Assert(json.Unmarshal([]byte(data), event), IsNil)
+	c.Assert(event.Volume, Equals, "vol1")
+
+	_, err = d.processVolumeMount(d.getVolume("vol2"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	_, err = d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	id, name, _ = readServerSentEvent(c, reader)
+	c.Assert(id, Equals, "4")
+	c.Assert(name, Equals, EVENT_VOLUME_MOUNT)
+}
+
+func (s *TestSuite) TestEventStreamDropsSlowSubscriber(c *C) {
+	stream := &eventStream{}
+	_, slow := stream.subscribe(0, eventFilter{})
+	_, filtered := stream.subscribe(0, eventFilter{Volume: "vol2"})
+	for i := 0; i < EVENT_SUBSCRIBER_BUFFER+1; i++ {
+		stream.publish(&api.EventResponse{Event: EVENT_VOLUME_CREATE, Volume: "vol1"})
+	}
+	c.Assert(stream.subscribers[slow], Equals, false)
+	c.Assert(stream.subscribers[filtered], Equals, true)
+	count := 0
+	for range slow.events {
+		count++
+	}
+	c.Assert(count, Equals, EVENT_SUBSCRIBER_BUFFER)
+
+	stream.unsubscribe(slow)
+	stream.unsubscribe(filtered)
+	c.Assert(stream.subscribers, HasLen, 0)
+}
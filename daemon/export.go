@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	EXPORT_CONTENT_TYPE = "application/octet-stream"
+)
+
+// countingWriter counts the bytes written, to tell whether a response has
+// been started
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.Writer.Write(data)
+	w.n += int64(n)
+	return n, err
+}
+
+/*
+doVolumeExport streams the tarball of the current content of volume, without
+snapshot or backup. The volume is mounted for the export if it isn't
+mounted, and it's locked until the export completes. Once the tarball is
+started, failure can only be reported by api.ERROR_TRAILER.
+*/
+func (s *daemon) doVolumeExport(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeExportRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
+	}
+	if err := util.ValidateCompression(request.Compression); err != nil {
+		return err
+	}
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	mountPoint, err := s.getVolumeMountPoint(volume)
+	if err != nil {
+		return err
+	}
+	if mountPoint == "" {
+		if mountPoint, err = s.mountVolume(volume, &api.VolumeMountRequest{}); err != nil {
+			return err
+		}
+		defer func() {
+			if err := s.umountVolume(volume); err != nil {
+				log.Errorf("Failed to umount volume %v after export: %v", volumeName, err)
+			}
+		}()
+	}
+
+	log.Debugf("Exporting volume %v at %v", volumeName, mountPoint)
+	w.Header().Set("Content-Type", EXPORT_CONTENT_TYPE)
+	w.Header().Set("Trailer", api.ERROR_TRAILER)
+	cw := &countingWriter{Writer: w}
+	if err := util.TarDirStream(cw, mountPoint, request.Compression); err != nil {
+		if cw.n == 0 {
+			w.Header().Del("Trailer")
+			return err
+		}
+		log.Errorf("Failed to export volume %v: %v", volumeName, err)
+		// Trailer cannot span lines
+		w.Header().Set(api.ERROR_TRAILER, strings.Replace(err.Error(), "\n", " ", -1))
+		return nil
+	}
+	log.Debugf("Exported volume %v, %v bytes", volumeName, cw.n)
+	return nil
+}
@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestVolumeExport(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	// Volume is mounted only for the export
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "data"), []byte("data"), 0600), IsNil)
+	c.Assert(d.processVolumeUmount(d.getVolume("vol1")), IsNil)
+
+	files := func(compression string) map[string]string {
+		w := s.serveRequest(c, router, "GET", "/v1/volumes/export", &api.VolumeExportRequest{
+			VolumeName:  "vol1",
+			Compression: compression,
+		})
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(w.Header().Get("Content-Type"), Equals, EXPORT_CONTENT_TYPE)
+		c.Assert(w.Header().Get(api.ERROR_TRAILER), Equals, "")
+
+		var b bytes.Buffer
+		c.Assert(util.DecompressStream(&b, w.Body, compression), IsNil)
+		files := map[string]string{}
+		r := tar.NewReader(&b)
+		for {
+			header, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			c.Assert(err, IsNil)
+			data, err := ioutil.ReadAll(r)
+			c.Assert(err, IsNil)
+			files[header.Name] = string(data)
+		}
+		return files
+	}
+	expected := map[string]string{"./": "", "./data": "data"}
+	c.Assert(files(""), DeepEquals, expected)
+	c.Assert(files(util.COMPRESSION_ZSTD), DeepEquals, expected)
+	c.Assert(files(util.COMPRESSION_NONE), DeepEquals, expected)
+	mountPoint, err = d.getVolumeMountPoint(d.getVolume("vol1"))
+	c.Assert(err, IsNil)
+	c.Assert(mountPoint, Equals, "")
+
+	w := s.serveRequest(c, router, "GET", "/v1/volumes/export", &api.VolumeExportRequest{
+		VolumeName:  "vol1",
+		Compression: "bzip2",
+	})
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	s.assertError(c, w, api.ERROR_CODE_UNKNOWN, "Invalid compression bzip2.*")
+	w = s.serveRequest(c, router, "GET", "/v1/volumes/export", &api.VolumeExportRequest{
+		VolumeName: "vol2",
+	})
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	s.assertError(c, w, api.ERROR_CODE_NOT_FOUND, "volume vol2 doesn't exist")
+}
@@ -0,0 +1,228 @@
+package daemon
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "github.com/rancher/convoy/logging"
+)
+
+// How long force umount and fence wait for the operation in progress on the
+// volume, before going on without its lock
+var forceLockTimeout = 10 * time.Second
+
+// lockVolumeForce locks volume for force umount or fence, and returns whether
+// it's locked. The operation holding the lock may be the umount which hangs,
+// so it's only waited for forceLockTimeout.
+func (s *daemon) lockVolumeForce(volumeName string) bool {
+	if s.volumeLocks.LockWithTimeout(volumeName, forceLockTimeout) {
+		return true
+	}
+	log.Warnf("Volume %v is still locked by another operation after %v, going on without the lock", volumeName, forceLockTimeout)
+	return false
+}
+
+func (s *daemon) doVolumeForceUmount(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeForceUmountRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
+	}
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+
+	return s.processVolumeForceUmount(volume, request.Kill)
+}
+
+func (s *daemon) processVolumeForceUmount(volume *Volume, kill bool) error {
+	if s.lockVolumeForce(volume.Name) {
+		defer s.volumeLocks.Unlock(volume.Name)
+	}
+
+	if err := s.forceUmountVolume(volume, kill); err != nil {
+		return err
+	}
+	if err := s.releaseAttachment(volume.Name); err != nil {
+		return err
+	}
+	s.publishClusterHost()
+	s.notifier.notify(&api.EventResponse{
+		Event:  EVENT_VOLUME_UMOUNT,
+		Volume: volume.Name,
+	})
+	return nil
+}
+
+// forceUmountVolume umounts the volume lazily by the driver, after killing
+// the processes using it if kill is true
+func (s *daemon) forceUmountVolume(volume *Volume, kill bool) error {
+	volOps, err := s.getVolumeOpsForVolume(volume)
+	if err != nil {
+		return err
+	}
+	umounter, ok := volOps.(VolumeForceUmounter)
+	if !ok {
+		return driverUnsupportedError(volOps.Name(), "force umount")
+	}
+
+	ctx, cancel := s.operationContext(OPERATION_UMOUNT)
+	defer cancel()
+	req := Request{
+		Name: volume.Name,
+		Options: map[string]string{
+			OPT_KILL: strconv.FormatBool(kill),
+		},
+		Ctx: ctx,
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:  LOG_EVENT_UMOUNT,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volume.Name,
+		LOG_FIELD_OPTS:   req.Options,
+	}).Debug("Force umounting volume")
+	if err := umounter.ForceUmountVolume(req); err != nil {
+		return operationError(ctx, OPERATION_UMOUNT, volume.Name, err)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_UMOUNT,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volume.Name,
+	}).Debug("Force umounted volume")
+	return nil
+}
+
+func (s *daemon) doVolumeFence(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeFenceRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
+	}
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+
+	return s.processVolumeFence(volume, request.Kill)
+}
+
+/*
+processVolumeFence makes the volume unavailable on this host, when the host
+is being evacuated and the normal umount hangs. The volume is marked fenced
+first, so nothing mounts it again meanwhile, then force umounted, and
+detached from the host by the driver if it attaches volumes, e.g. EBS
+volumes are force detached. Other hosts can mount the volume afterwards.
+*/
+func (s *daemon) processVolumeFence(volume *Volume, kill bool) error {
+	if s.lockVolumeForce(volume.Name) {
+		defer s.volumeLocks.Unlock(volume.Name)
+	}
+
+	volOps, err := s.getVolumeOpsForVolume(volume)
+	if err != nil {
+		return err
+	}
+	if _, ok := volOps.(VolumeForceUmounter); !ok {
+		return driverUnsupportedError(volOps.Name(), "fence")
+	}
+
+	if err := s.updateVolumeConfig(volume.Name, func(config *VolumeConfig) (bool, error) {
+		config.Fence = &api.VolumeFence{
+			Host: s.ClusterHost,
+			Time: util.Now(),
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	if err := s.forceUmountVolume(volume, kill); err != nil {
+		return err
+	}
+	if fencer, ok := volOps.(VolumeFencer); ok {
+		ctx, cancel := s.operationContext(OPERATION_UMOUNT)
+		defer cancel()
+		if err := fencer.FenceVolume(Request{
+			Name:    volume.Name,
+			Options: map[string]string{},
+			Ctx:     ctx,
+		}); err != nil {
+			return operationError(ctx, OPERATION_UMOUNT, volume.Name, err)
+		}
+	}
+	if err := s.releaseAttachment(volume.Name); err != nil {
+		return err
+	}
+	s.publishClusterHost()
+	log.Warnf("Volume %v is fenced, it cannot be mounted on this host until it's unfenced", volume.Name)
+	s.notifier.notify(&api.EventResponse{
+		Event:  EVENT_VOLUME_FENCE,
+		Volume: volume.Name,
+	})
+	return nil
+}
+
+func (s *daemon) doVolumeUnfence(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeUnfenceRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
+	}
+
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	if s.getVolume(volumeName) == nil {
+		return volumeNotFoundError(volumeName)
+	}
+	fenced := false
+	if err := s.updateVolumeConfig(volumeName, func(config *VolumeConfig) (bool, error) {
+		fenced = config.Fence != nil
+		config.Fence = nil
+		return fenced, nil
+	}); err != nil {
+		return err
+	}
+	if !fenced {
+		return api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Volume %v isn't fenced", volumeName).WithDetail("volume", volumeName)
+	}
+	log.Infof("Volume %v is unfenced", volumeName)
+	s.notifier.notify(&api.EventResponse{
+		Event:  EVENT_VOLUME_UNFENCE,
+		Volume: volumeName,
+	})
+	return nil
+}
+
+// checkFence fails if the volume is fenced on this host
+func (s *daemon) checkFence(volumeName string) error {
+	config, err := s.loadVolumeConfig(volumeName)
+	if err != nil {
+		return err
+	}
+	if config.Fence == nil || config.Fence.Host != s.ClusterHost {
+		return nil
+	}
+	return api.NewError(api.ERROR_CODE_CONFLICT, "Volume %v is fenced on this host since %v, unfence it first",
+		volumeName, config.Fence.Time).WithDetail("volume", volumeName)
+}
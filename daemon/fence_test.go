@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestVolumeForceUmount(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	volume := d.getVolume("vol1")
+	_, err = d.processVolumeMount(volume, &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+
+	// Force umount doesn't wait for the operation hanging with the lock
+	timeout := forceLockTimeout
+	forceLockTimeout = 10 * time.Millisecond
+	defer func() {
+		forceLockTimeout = timeout
+	}()
+	d.volumeLocks.Lock("vol1")
+	w := s.serveRequest(c, router, "POST", "/v1/volumes/force-umount", &api.VolumeForceUmountRequest{
+		VolumeName: "vol1",
+	})
+	d.volumeLocks.Unlock("vol1")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	resp, err := d.listVolumeInfo(volume)
+	c.Assert(err, IsNil)
+	c.Assert(resp.MountPoint, Equals, "")
+
+	events := s.listEvents(c, router, "volume=vol1")
+	c.Assert(events[len(events)-1].Event, Equals, EVENT_VOLUME_UMOUNT)
+
+	w = s.serveRequest(c, router, "POST", "/v1/volumes/force-umount", &api.VolumeForceUmountRequest{
+		VolumeName: "vol2",
+	})
+	s.assertError(c, w, api.ERROR_CODE_NOT_FOUND, "volume vol2 doesn't exist")
+}
+
+func (s *TestSuite) TestVolumeFence(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	volume := d.getVolume("vol1")
+	_, err = d.processVolumeMount(volume, &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/v1/volumes/fence", &api.VolumeFenceRequest{
+		VolumeName: "vol1",
+		Kill:       true,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	resp, err := d.listVolumeInfo(volume)
+	c.Assert(err, IsNil)
+	c.Assert(resp.MountPoint, Equals, "")
+	c.Assert(resp.Fence, NotNil)
+	c.Assert(resp.Fence.Time, Not(Equals), "")
+
+	// Fenced volume cannot be mounted until it's unfenced
+	_, err = d.processVolumeMount(volume, &api.VolumeMountRequest{})
+	c.Assert(err, ErrorMatches, "Volume vol1 is fenced on this host since .*, unfence it first")
+	c.Assert(api.IsErrorCode(err, api.ERROR_CODE_CONFLICT), Equals, true)
+
+	w = s.serveRequest(c, router, "POST", "/v1/volumes/unfence", &api.VolumeUnfenceRequest{
+		VolumeName: "vol1",
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	resp, err = d.listVolumeInfo(volume)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Fence, IsNil)
+	_, err = d.processVolumeMount(volume, &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+
+	w = s.serveRequest(c, router, "POST", "/v1/volumes/unfence", &api.VolumeUnfenceRequest{
+		VolumeName: "vol1",
+	})
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, "Volume vol1 isn't fenced")
+
+	names := []string{}
+	for _, event := range s.listEvents(c, router, "volume=vol1") {
+		names = append(names, event.Event)
+	}
+	c.Assert(names, DeepEquals, []string{EVENT_VOLUME_CREATE, EVENT_VOLUME_MOUNT, EVENT_VOLUME_FENCE,
+		EVENT_VOLUME_UNFENCE, EVENT_VOLUME_MOUNT})
+}
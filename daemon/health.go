@@ -0,0 +1,170 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+const (
+	// A check taking longer than this is failed, e.g. with a hung NFS mount
+	HEALTH_CHECK_TIMEOUT = 10 * time.Second
+)
+
+// runHealthCheck runs check with timeout. The check would be left running
+// in background if it times out, since most of them cannot be interrupted.
+func runHealthCheck(name string, check func() error) api.HealthCheckResponse {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- check()
+	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-time.After(HEALTH_CHECK_TIMEOUT):
+		err = fmt.Errorf("Timed out after %v", HEALTH_CHECK_TIMEOUT)
+	}
+	resp := api.HealthCheckResponse{
+		Name:   name,
+		Status: api.HEALTH_STATUS_HEALTHY,
+	}
+	if err != nil {
+		resp.Status = api.HEALTH_STATUS_UNHEALTHY
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func healthStatus(checks []api.HealthCheckResponse) string {
+	for _, check := range checks {
+		if check.Status != api.HEALTH_STATUS_HEALTHY {
+			return api.HEALTH_STATUS_UNHEALTHY
+		}
+	}
+	return api.HEALTH_STATUS_HEALTHY
+}
+
+func (s *daemon) checkDriverHealth(driverName string) api.DriverHealthResponse {
+	checks := []api.HealthCheckResponse{}
+	if err, failed := s.driverInitErrors[driverName]; failed {
+		checks = append(checks, api.HealthCheckResponse{
+			Name:   "init",
+			Status: api.HEALTH_STATUS_UNHEALTHY,
+			Error:  err.Error(),
+		})
+		return api.DriverHealthResponse{
+			Status: api.HEALTH_STATUS_UNHEALTHY,
+			Checks: checks,
+		}
+	}
+
+	driver := s.ConvoyDrivers[driverName]
+	checks = append(checks, runHealthCheck("info", func() error {
+		_, err := driver.Info()
+		return err
+	}))
+	if checker, ok := driver.(HealthChecker); ok {
+		var results []HealthCheck
+		resp := runHealthCheck("checks", func() error {
+			results = checker.CheckHealth()
+			return nil
+		})
+		if resp.Status != api.HEALTH_STATUS_HEALTHY {
+			checks = append(checks, resp)
+		}
+		for _, result := range results {
+			check := api.HealthCheckResponse{
+				Name:   result.Name,
+				Status: api.HEALTH_STATUS_HEALTHY,
+			}
+			if result.Error != nil {
+				check.Status = api.HEALTH_STATUS_UNHEALTHY
+				check.Error = result.Error.Error()
+			}
+			checks = append(checks, check)
+		}
+	}
+	return api.DriverHealthResponse{
+		Status: healthStatus(checks),
+		Checks: checks,
+	}
+}
+
+// checkObjectStoreHealth makes sure the destinations of backup policies are
+// reachable, which is checked by objectstore drivers when they're loaded
+func (s *daemon) checkObjectStoreHealth() ([]api.HealthCheckResponse, error) {
+	policies, err := s.listPolicies()
+	if err != nil {
+		return nil, err
+	}
+	urls := map[string]bool{}
+	for _, policy := range policies {
+		urls[policy.URL] = true
+	}
+	sorted := []string{}
+	for url := range urls {
+		sorted = append(sorted, url)
+	}
+	sort.Strings(sorted)
+
+	checks := []api.HealthCheckResponse{}
+	for _, url := range sorted {
+		destURL := url
+		checks = append(checks, runHealthCheck(destURL, func() error {
+			_, err := objectstore.GetObjectStoreDriver(destURL)
+			return err
+		}))
+	}
+	return checks, nil
+}
+
+func (s *daemon) getHealth() (*api.HealthResponse, error) {
+	resp := &api.HealthResponse{
+		Drivers: map[string]api.DriverHealthResponse{},
+	}
+	checks := []api.HealthCheckResponse{}
+	for _, driverName := range s.DriverList {
+		driverHealth := s.checkDriverHealth(driverName)
+		resp.Drivers[driverName] = driverHealth
+		checks = append(checks, api.HealthCheckResponse{Status: driverHealth.Status})
+	}
+
+	objectStores, err := s.checkObjectStoreHealth()
+	if err != nil {
+		return nil, err
+	}
+	resp.ObjectStores = objectStores
+	checks = append(checks, objectStores...)
+
+	resp.Status = healthStatus(checks)
+	return resp, nil
+}
+
+/*
+doHealth responds 200 if the daemon and all its drivers and backup
+destinations are healthy, or 503 otherwise. The result of every check is
+returned either way, so orchestrators can gate scheduling on the status code
+alone.
+*/
+func (s *daemon) doHealth(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	resp, err := s.getHealth()
+	if err != nil {
+		return err
+	}
+	output, err := api.ResponseOutput(resp)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != api.HEALTH_STATUS_HEALTHY {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, err = w.Write(output)
+	return err
+}
@@ -0,0 +1,52 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/vfs"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) getHealth(c *C, d *daemon) (int, *api.HealthResponse) {
+	w := httptest.NewRecorder()
+	c.Assert(d.doHealth("1", w, httptest.NewRequest("GET", "/v1/health", nil), nil), IsNil)
+	resp := &api.HealthResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), resp), IsNil)
+	return w.Code, resp
+}
+
+func (s *TestSuite) TestHealth(c *C) {
+	d := s.newVFSDaemon(c)
+
+	code, resp := s.getHealth(c, d)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(resp.Status, Equals, api.HEALTH_STATUS_HEALTHY)
+	c.Assert(resp.Drivers[vfs.KIND].Status, Equals, api.HEALTH_STATUS_HEALTHY)
+	c.Assert(resp.Drivers[vfs.KIND].Checks, HasLen, 2)
+	c.Assert(resp.ObjectStores, HasLen, 0)
+
+	dest := s.createPolicy(c, d, "daily", map[string]string{"backup": "daily"}, 0)
+	code, resp = s.getHealth(c, d)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(resp.ObjectStores, HasLen, 1)
+	c.Assert(resp.ObjectStores[0].Name, Equals, dest)
+	c.Assert(resp.ObjectStores[0].Status, Equals, api.HEALTH_STATUS_HEALTHY)
+
+	c.Assert(os.RemoveAll(filepath.Join(s.root, "backups-daily")), IsNil)
+	code, resp = s.getHealth(c, d)
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Status, Equals, api.HEALTH_STATUS_UNHEALTHY)
+	c.Assert(resp.Drivers[vfs.KIND].Status, Equals, api.HEALTH_STATUS_HEALTHY)
+	c.Assert(resp.ObjectStores[0].Status, Equals, api.HEALTH_STATUS_UNHEALTHY)
+	c.Assert(resp.ObjectStores[0].Error, Matches, "VFS path .* doesn't exist or is not a directory")
+
+	c.Assert(os.RemoveAll(filepath.Join(s.root, "volumes")), IsNil)
+	_, resp = s.getHealth(c, d)
+	c.Assert(resp.Drivers[vfs.KIND].Status, Equals, api.HEALTH_STATUS_UNHEALTHY)
+}
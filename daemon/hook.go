@@ -0,0 +1,265 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	EVENT_VOLUME_CREATE   = "volume.create"
+	EVENT_VOLUME_DELETE   = "volume.delete"
+	EVENT_VOLUME_MOUNT    = "volume.mount"
+	EVENT_VOLUME_UMOUNT   = "volume.umount"
+	EVENT_VOLUME_FENCE    = "volume.fence"
+	EVENT_VOLUME_UNFENCE  = "volume.unfence"
+	EVENT_SNAPSHOT_CREATE = "snapshot.create"
+	EVENT_SNAPSHOT_DELETE = "snapshot.delete"
+	EVENT_BACKUP_COMPLETE = "backup.complete"
+	EVENT_BACKUP_FAILED   = "backup.failed"
+	EVENT_BACKUP_DELETE   = "backup.delete"
+
+	HOOK_FORMAT_JSON  = "json"
+	HOOK_FORMAT_SLACK = "slack"
+
+	DEFAULT_HOOK_RETRIES = 3
+	HOOK_TIMEOUT         = 10 * time.Second
+)
+
+var (
+	hookEvents = map[string]bool{
+		EVENT_VOLUME_CREATE:   true,
+		EVENT_VOLUME_DELETE:   true,
+		EVENT_VOLUME_MOUNT:    true,
+		EVENT_VOLUME_UMOUNT:   true,
+		EVENT_VOLUME_FENCE:    true,
+		EVENT_VOLUME_UNFENCE:  true,
+		EVENT_SNAPSHOT_CREATE: true,
+		EVENT_SNAPSHOT_DELETE: true,
+		EVENT_BACKUP_COMPLETE: true,
+		EVENT_BACKUP_FAILED:   true,
+		EVENT_BACKUP_DELETE:   true,
+	}
+
+	// Doubled after every failed attempt
+	hookRetryInterval = 5 * time.Second
+)
+
+/*
+hook notifies an event either by posting it to URL, or by running Command
+with the event on its stdin, in the JSON format of api.EventResponse. Slack
+format posts a message of the event instead, which is accepted by incoming
+webhooks of Slack. Failed notifications are retried Retries times.
+*/
+type hook struct {
+	Name    string
+	URL     string
+	Command string
+	Format  string
+	// Events to be notified, all events if empty
+	Events  map[string]bool
+	Retries int
+}
+
+func (h *hook) validate() error {
+	if (h.URL == "") == (h.Command == "") {
+		return fmt.Errorf("hook %v must have either url or command", h.Name)
+	}
+	if h.Format != HOOK_FORMAT_JSON && h.Format != HOOK_FORMAT_SLACK {
+		return fmt.Errorf("invalid format %v of hook %v, must be %v or %v", h.Format, h.Name, HOOK_FORMAT_JSON, HOOK_FORMAT_SLACK)
+	}
+	if h.Format == HOOK_FORMAT_SLACK && h.URL == "" {
+		return fmt.Errorf("hook %v in %v format must have url", h.Name, HOOK_FORMAT_SLACK)
+	}
+	for event := range h.Events {
+		if !hookEvents[event] {
+			return fmt.Errorf("unknown event %v of hook %v", event, h.Name)
+		}
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("invalid retries %v of hook %v", h.Retries, h.Name)
+	}
+	return nil
+}
+
+func parseHookSettings(name string, values map[string]string) (*hook, error) {
+	if name == "" || !util.ValidateName(name) {
+		return nil, fmt.Errorf("invalid hook name %q", name)
+	}
+	h := &hook{
+		Name:    name,
+		Format:  HOOK_FORMAT_JSON,
+		Events:  map[string]bool{},
+		Retries: DEFAULT_HOOK_RETRIES,
+	}
+	for key, value := range values {
+		switch key {
+		case "url":
+			h.URL = value
+		case "command":
+			h.Command = value
+		case "format":
+			h.Format = value
+		case "events":
+			for _, event := range parseList(value) {
+				h.Events[event] = true
+			}
+		case "retries":
+			retries, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retries %v of hook %v", value, name)
+			}
+			h.Retries = retries
+		default:
+			return nil, fmt.Errorf("unknown setting %v of hook %v", key, name)
+		}
+	}
+	return h, h.validate()
+}
+
+func (h *hook) wants(event string) bool {
+	return len(h.Events) == 0 || h.Events[event]
+}
+
+func slackMessage(event *api.EventResponse) string {
+	message := fmt.Sprintf("[convoy@%v] %v: volume %v", event.Host, event.Event, event.Volume)
+	if event.Snapshot != "" {
+		message += ", snapshot " + event.Snapshot
+	}
+	if event.MountPoint != "" {
+		message += ", mount point " + event.MountPoint
+	}
+	if event.BackupURL != "" {
+		message += ", backup " + event.BackupURL
+	} else if event.DestURL != "" {
+		message += ", destination " + event.DestURL
+	}
+	if event.Error != "" {
+		message += ", error: " + event.Error
+	}
+	return message
+}
+
+func (h *hook) payload(event *api.EventResponse) ([]byte, error) {
+	if h.Format == HOOK_FORMAT_SLACK {
+		return json.Marshal(map[string]string{"text": slackMessage(event)})
+	}
+	return json.Marshal(event)
+}
+
+func (h *hook) post(payload []byte) error {
+	client := &http.Client{Timeout: HOOK_TIMEOUT}
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%v responded %v", h.URL, resp.Status)
+	}
+	return nil
+}
+
+// run executes Command by shell, with the event in environment variable
+// CONVOY_EVENT as well as in stdin
+func (h *hook) run(event string, payload []byte) error {
+	var output bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", h.Command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(), "CONVOY_EVENT="+event)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("%v failed: %v, output %v", h.Command, err, strings.TrimSpace(output.String()))
+		}
+		return nil
+	case <-time.After(HOOK_TIMEOUT):
+		cmd.Process.Kill()
+		<-errCh
+		return fmt.Errorf("%v timed out after %v", h.Command, HOOK_TIMEOUT)
+	}
+}
+
+func (h *hook) notify(event *api.EventResponse) error {
+	payload, err := h.payload(event)
+	if err != nil {
+		return err
+	}
+	interval := hookRetryInterval
+	for attempt := 0; ; attempt++ {
+		if h.URL != "" {
+			err = h.post(payload)
+		} else {
+			err = h.run(event.Event, payload)
+		}
+		if err == nil || attempt >= h.Retries {
+			return err
+		}
+		log.Warnf("Failed to notify hook %v of %v, retrying in %v: %v", h.Name, event.Event, interval, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// notifier sends events to hooks in background, so operations are never
+// blocked or failed by them, and to the clients following the event stream
+type notifier struct {
+	mutex  sync.RWMutex
+	hooks  []*hook
+	events eventStream
+	// wg tracks notifications in flight, for tests
+	wg sync.WaitGroup
+}
+
+func (n *notifier) setHooks(hooks []*hook) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.hooks = hooks
+}
+
+func (n *notifier) notify(event *api.EventResponse) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	if event.Time == "" {
+		event.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	if event.Host == "" {
+		event.Host, _ = os.Hostname()
+	}
+	n.events.publish(event)
+	for _, h := range n.hooks {
+		if !h.wants(event.Event) {
+			continue
+		}
+		n.wg.Add(1)
+		h := h
+		GoWithRequestID(func() {
+			defer n.wg.Done()
+			if err := h.notify(event); err != nil {
+				log.Errorf("Failed to notify hook %v of %v: %v", h.Name, event.Event, err)
+			}
+		})
+	}
+}
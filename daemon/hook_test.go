@@ -0,0 +1,139 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+// hookServer records the events posted to it, failing the first failures
+// requests
+type hookServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	events   []api.EventResponse
+	bodies   []string
+	failures int
+}
+
+func newHookServer(failures int) *hookServer {
+	h := &hookServer{failures: failures}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if h.failures > 0 {
+			h.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		h.bodies = append(h.bodies, string(body))
+		event := api.EventResponse{}
+		if json.Unmarshal(body, &event) == nil {
+			h.events = append(h.events, event)
+		}
+	}))
+	return h
+}
+
+func (s *TestSuite) TestHookEvents(c *C) {
+	server := newHookServer(0)
+	defer server.Close()
+	d := s.newVFSDaemon(c)
+	d.notifier.setHooks([]*hook{
+		{Name: "all", URL: server.URL, Format: HOOK_FORMAT_JSON},
+	})
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	snapshotName, err := d.processSnapshotCreate(d.getVolume("vol1"), "snap1", nil, "", nil)
+	c.Assert(err, IsNil)
+	_, err = d.processBackupCreate(snapshotName, "vfs://"+filepath.Join(s.root, "missing"), "", "")
+	c.Assert(err, NotNil)
+	c.Assert(d.processVolumeDelete(&api.VolumeDeleteRequest{VolumeName: "vol1"}), IsNil)
+	d.notifier.wg.Wait()
+
+	// Events are notified concurrently
+	events := map[string]api.EventResponse{}
+	for _, event := range server.events {
+		events[event.Event] = event
+	}
+	c.Assert(events, HasLen, 4)
+	c.Assert(events[EVENT_VOLUME_CREATE].Volume, Equals, "vol1")
+	c.Assert(events[EVENT_VOLUME_CREATE].Host, Not(Equals), "")
+	c.Assert(events[EVENT_SNAPSHOT_CREATE].Snapshot, Equals, "snap1")
+	c.Assert(events[EVENT_BACKUP_FAILED].Volume, Equals, "vol1")
+	c.Assert(events[EVENT_BACKUP_FAILED].Error, Not(Equals), "")
+	c.Assert(events[EVENT_VOLUME_DELETE].Volume, Equals, "vol1")
+}
+
+func (s *TestSuite) TestHookRetryAndFilter(c *C) {
+	defer func(interval time.Duration) { hookRetryInterval = interval }(hookRetryInterval)
+	hookRetryInterval = time.Millisecond
+
+	server := newHookServer(2)
+	defer server.Close()
+	output := filepath.Join(s.root, "event")
+	n := &notifier{}
+	n.setHooks([]*hook{
+		{Name: "slack", URL: server.URL, Format: HOOK_FORMAT_SLACK, Retries: 2,
+			Events: map[string]bool{EVENT_BACKUP_FAILED: true}},
+		{Name: "exec", Command: "cat > " + output + ".$CONVOY_EVENT", Format: HOOK_FORMAT_JSON},
+	})
+	n.notify(&api.EventResponse{Event: EVENT_VOLUME_CREATE, Volume: "vol1", Host: "host1"})
+	n.notify(&api.EventResponse{Event: EVENT_BACKUP_FAILED, Volume: "vol1", Host: "host1",
+		DestURL: "s3://bucket@us-west-2/", Error: "access denied"})
+	n.wg.Wait()
+
+	c.Assert(server.bodies, DeepEquals, []string{
+		`{"text":"[convoy@host1] backup.failed: volume vol1, destination s3://bucket@us-west-2/, error: access denied"}`,
+	})
+	for _, event := range []string{EVENT_VOLUME_CREATE, EVENT_BACKUP_FAILED} {
+		data, err := ioutil.ReadFile(output + "." + event)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Matches, `\{"Event":"`+event+`".*`)
+	}
+
+	// Give up after retries
+	server.mutex.Lock()
+	server.failures = 3
+	server.mutex.Unlock()
+	c.Assert(n.hooks[0].notify(&api.EventResponse{Event: EVENT_BACKUP_FAILED}), ErrorMatches, ".* responded 503 Service Unavailable")
+}
+
+func (s *TestSuite) TestParseHookSettings(c *C) {
+	h, err := parseHookSettings("pager", map[string]string{
+		"command": "/usr/local/bin/page",
+		"events":  `["backup.failed", "volume.delete"]`,
+		"retries": "0",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(h.wants(EVENT_BACKUP_FAILED), Equals, true)
+	c.Assert(h.wants(EVENT_VOLUME_CREATE), Equals, false)
+	c.Assert(h.Retries, Equals, 0)
+
+	for _, t := range []struct {
+		values  map[string]string
+		message string
+	}{
+		{map[string]string{}, "hook bad must have either url or command"},
+		{map[string]string{"url": "http://a", "command": "b"}, "hook bad must have either url or command"},
+		{map[string]string{"command": "b", "format": "slack"}, "hook bad in slack format must have url"},
+		{map[string]string{"url": "http://a", "format": "xml"}, "invalid format xml of hook bad.*"},
+		{map[string]string{"url": "http://a", "events": "backup.start"}, "unknown event backup.start of hook bad"},
+		{map[string]string{"url": "http://a", "timeout": "1s"}, "unknown setting timeout of hook bad"},
+	} {
+		_, err := parseHookSettings("bad", t.values)
+		c.Assert(err, ErrorMatches, t.message)
+	}
+}
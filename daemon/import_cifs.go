@@ -0,0 +1,8 @@
+// +build linux
+
+package daemon
+
+import (
+	// Involve cifs driver for registeration
+	_ "github.com/rancher/convoy/cifs"
+)
@@ -0,0 +1,8 @@
+// +build linux
+
+package daemon
+
+import (
+	// Involve iscsi driver for registeration
+	_ "github.com/rancher/convoy/iscsi"
+)
@@ -0,0 +1,8 @@
+// +build linux
+
+package daemon
+
+import (
+	// Involve lvm driver for registeration
+	_ "github.com/rancher/convoy/lvm"
+)
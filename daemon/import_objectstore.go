@@ -1,8 +1,14 @@
 package daemon
 
 import (
+	// Involve GCS objecstore drivers for registeration
+	_ "github.com/rancher/convoy/gcs"
+	// Involve SFTP objectstore driver for registeration
+	_ "github.com/rancher/convoy/sftp"
 	// Involve S3 objecstore drivers for registeration
 	_ "github.com/rancher/convoy/s3"
+	// Involve spool objectstore driver for registeration
+	_ "github.com/rancher/convoy/spool"
 	// Involve VFS convoy driver/objectstore driver for registeration
 	_ "github.com/rancher/convoy/vfs"
 )
@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+const (
+	INTENT_CFG_PREFIX = "intent_"
+
+	INTENT_SNAPSHOT_CREATE = "snapshot-create"
+	INTENT_SNAPSHOT_DELETE = "snapshot-delete"
+)
+
+/*
+snapshotIntent is written before a snapshot is created or deleted, and removed
+once the driver, the indexes and the labels in the volume config all agree.
+An intent left by a crash is resolved on startup by removing whatever is left
+of the snapshot: a create never reported success to the client, and a delete
+has already started removing it in the driver. There is at most one intent per
+snapshot, since operations on it are serialized by the lock of its volume.
+*/
+type snapshotIntent struct {
+	Op          string
+	Volume      string
+	Snapshot    string
+	CreatedTime string
+
+	configPath string
+}
+
+func (i *snapshotIntent) ConfigFile() (string, error) {
+	if i.Snapshot == "" {
+		return "", fmt.Errorf("BUG: Invalid empty snapshot name of intent")
+	}
+	if i.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty intent config path")
+	}
+	return filepath.Join(i.configPath, INTENT_CFG_PREFIX+i.Snapshot+CFG_POSTFIX), nil
+}
+
+func (s *daemon) beginSnapshotIntent(op, volumeName, snapshotName string) (*snapshotIntent, error) {
+	intent := &snapshotIntent{
+		Op:          op,
+		Volume:      volumeName,
+		Snapshot:    snapshotName,
+		CreatedTime: util.Now(),
+		configPath:  s.Root,
+	}
+	if err := s.saveObject(intent); err != nil {
+		return nil, fmt.Errorf("Failed to record %v of snapshot %v: %v", op, snapshotName, err)
+	}
+	return intent, nil
+}
+
+func (s *daemon) endSnapshotIntent(intent *snapshotIntent) error {
+	if err := s.deleteObject(intent); err != nil {
+		return fmt.Errorf("Failed to complete %v of snapshot %v: %v", intent.Op, intent.Snapshot, err)
+	}
+	return nil
+}
+
+// forgetSnapshot removes the snapshot from the indexes and its labels from
+// the volume config, after it's removed in the driver. Caller must hold the
+// lock of volume.
+func (s *daemon) forgetSnapshot(volumeName, snapshotName string) error {
+	if err := s.SnapshotVolumeIndex.Delete(snapshotName); err != nil {
+		return err
+	}
+	if err := s.NameUUIDIndex.Delete(snapshotName); err != nil {
+		return err
+	}
+	return s.setSnapshotLabels(volumeName, snapshotName, nil)
+}
+
+// purgeSnapshot removes the snapshot in the driver if it's still there, then
+// forgets it. Caller must hold the lock of volume.
+func (s *daemon) purgeSnapshot(volumeName, snapshotName string) error {
+	volume := s.getVolume(volumeName)
+	if volume != nil && s.snapshotExists(volumeName, snapshotName) {
+		snapOps, err := s.getSnapshotOpsForVolume(volume)
+		if err != nil {
+			return err
+		}
+		if err := snapOps.DeleteSnapshot(Request{
+			Name: snapshotName,
+			Options: map[string]string{
+				OPT_VOLUME_NAME: volumeName,
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return s.forgetSnapshot(volumeName, snapshotName)
+}
+
+// abortSnapshotCreate rolls back the snapshot created in the driver but not
+// completely recorded. The intent is kept for the next startup if it fails.
+func (s *daemon) abortSnapshotCreate(intent *snapshotIntent) {
+	if err := s.purgeSnapshot(intent.Volume, intent.Snapshot); err != nil {
+		log.Errorf("Failed to roll back creating snapshot %v of volume %v, would retry on startup: %v",
+			intent.Snapshot, intent.Volume, err)
+		return
+	}
+	if err := s.endSnapshotIntent(intent); err != nil {
+		log.Error(err)
+	}
+}
+
+// recoverSnapshotIntents resolves the intents left by a crash. It's called
+// before the indexes are built from the drivers. Failed ones are kept and
+// retried on the next startup, rather than blocking the daemon.
+func (s *daemon) recoverSnapshotIntents() {
+	names, err := s.listObjectNames(INTENT_CFG_PREFIX)
+	if err != nil {
+		log.Errorf("Failed to list snapshot intents: %v", err)
+		return
+	}
+	for _, name := range names {
+		intent := &snapshotIntent{
+			Snapshot:   name,
+			configPath: s.Root,
+		}
+		if err := s.loadObject(intent); err != nil {
+			log.Errorf("Failed to load intent of snapshot %v: %v", name, err)
+			continue
+		}
+		if s.getVolume(intent.Volume) == nil && len(s.driverInitErrors) != 0 {
+			log.Warnf("Cannot find volume %v of interrupted %v of snapshot %v, it may belong to an unavailable driver, would retry on next startup",
+				intent.Volume, intent.Op, intent.Snapshot)
+			continue
+		}
+		log.Warnf("Removing snapshot %v of volume %v left by interrupted %v since %v",
+			intent.Snapshot, intent.Volume, intent.Op, intent.CreatedTime)
+		s.volumeLocks.Lock(intent.Volume)
+		err := s.purgeSnapshot(intent.Volume, intent.Snapshot)
+		s.volumeLocks.Unlock(intent.Volume)
+		if err != nil {
+			log.Errorf("Failed to remove snapshot %v of volume %v, would retry on next startup: %v",
+				intent.Snapshot, intent.Volume, err)
+			continue
+		}
+		if err := s.endSnapshotIntent(intent); err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	// Finished jobs are kept in memory for clients to check the result,
+	// only the latest ones would be kept
+	JOB_HISTORY_LIMIT = 100
+)
+
+/*
+jobManager tracks operations running in background for requests with
+"async=true" in query. Jobs are only kept in memory, so they would be lost
+if the daemon restarts.
+*/
+type jobManager struct {
+	mutex sync.Mutex
+	jobs  map[string]*api.JobResponse
+	// IDs of finished jobs, oldest first
+	finished []string
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{
+		jobs: make(map[string]*api.JobResponse),
+	}
+}
+
+func (m *jobManager) start(operation string, f func() (string, error)) *api.JobResponse {
+	job := &api.JobResponse{
+		ID:          util.NewUUID(),
+		Operation:   operation,
+		Status:      api.JOB_STATUS_RUNNING,
+		CreatedTime: util.Now(),
+	}
+	m.mutex.Lock()
+	m.jobs[job.ID] = job
+	started := *job
+	m.mutex.Unlock()
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_OBJECT: LOG_OBJECT_JOB,
+		LOG_FIELD_JOB:    job.ID,
+	}).Debugf("Started job for %v", operation)
+	GoWithRequestID(func() {
+		result, err := f()
+		m.finish(job.ID, result, err)
+	})
+	return &started
+}
+
+func (m *jobManager) finish(id, result string, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job := m.jobs[id]
+	job.FinishedTime = util.Now()
+	if err != nil {
+		job.Status = api.JOB_STATUS_FAILED
+		job.Error = err.Error()
+		if code := toAPIError(err).Code; code != api.ERROR_CODE_UNKNOWN {
+			job.ErrorCode = code
+		}
+	} else {
+		job.Status = api.JOB_STATUS_SUCCEEDED
+		job.Result = result
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_JOB,
+		LOG_FIELD_JOB:    job.ID,
+	}).Debugf("Job for %v %v", job.Operation, job.Status)
+
+	m.finished = append(m.finished, id)
+	for len(m.finished) > JOB_HISTORY_LIMIT {
+		delete(m.jobs, m.finished[0])
+		m.finished = m.finished[1:]
+	}
+}
+
+func (m *jobManager) get(id string) *api.JobResponse {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return nil
+	}
+	result := *job
+	return &result
+}
+
+func (m *jobManager) list() []*api.JobResponse {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := []*api.JobResponse{}
+	for _, job := range m.jobs {
+		j := *job
+		result = append(result, &j)
+	}
+	sort.Sort(jobsByTime(result))
+	return result
+}
+
+type jobsByTime []*api.JobResponse
+
+func (j jobsByTime) Len() int {
+	return len(j)
+}
+
+func (j jobsByTime) Swap(a, b int) {
+	j[a], j[b] = j[b], j[a]
+}
+
+func (j jobsByTime) Less(a, b int) bool {
+	ta, erra := time.Parse(time.RubyDate, j[a].CreatedTime)
+	tb, errb := time.Parse(time.RubyDate, j[b].CreatedTime)
+	if erra != nil || errb != nil || ta.Equal(tb) {
+		return j[a].ID < j[b].ID
+	}
+	return ta.Before(tb)
+}
+
+// jobResponseWriter collects the response of a handler running as a job
+type jobResponseWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *jobResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *jobResponseWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *jobResponseWriter) WriteHeader(statusCode int) {
+}
+
+// isAsyncRequest returns true if the request should run as a job, which is
+// asked by "async=true" in API v1, and is the default of API v2 unless
+// "async=false" is asked
+func isAsyncRequest(version string, r *http.Request) bool {
+	async := r.URL.Query().Get(api.KEY_ASYNC)
+	if version == api.API_VERSION {
+		return async == "true"
+	}
+	return async != "false"
+}
+
+// asyncHandler makes f run as a job if the request asks for it, and respond
+// with the job immediately. The result of f would be available through the
+// job API once it's done. API v2 responds 202 with the location of the job.
+func (s *daemon) asyncHandler(operation string, f requestHandler) requestHandler {
+	return func(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+		if !isAsyncRequest(version, r) {
+			return f(version, w, r, objs)
+		}
+		// Request body would be gone once the response has been sent
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		jobRequest := r.WithContext(context.Background())
+		jobRequest.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		op := s.operations.start(operation, requestTarget(body), getRequester(r))
+		job := s.jobs.start(operation, func() (string, error) {
+			defer s.operations.finish(op)
+			jw := &jobResponseWriter{
+				header: make(http.Header),
+			}
+			err := f(version, jw, jobRequest, objs)
+			return jw.body.String(), err
+		})
+		s.operations.setJobID(op, job.ID)
+		if version != api.API_VERSION {
+			w.Header().Set("Location", "/v"+version+"/jobs/"+job.ID)
+			w.WriteHeader(http.StatusAccepted)
+		}
+		return writeResponseOutput(w, job)
+	}
+}
+
+func (s *daemon) doJobList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	return writeResponseOutput(w, s.jobs.list())
+}
+
+func (s *daemon) doJobInspect(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	job := s.jobs.get(objs["id"])
+	if job == nil {
+		return api.NewError(api.ERROR_CODE_NOT_FOUND, "Job %v doesn't exist", objs["id"]).WithDetail("job", objs["id"])
+	}
+	return writeResponseOutput(w, job)
+}
@@ -0,0 +1,123 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) serveRequest(c *C, router http.Handler, method, path string, data interface{}) *httptest.ResponseRecorder {
+	body, err := json.Marshal(data)
+	c.Assert(err, IsNil)
+	r, err := http.NewRequest(method, path, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// assertError checks w is the error response of code, with message matching
+// pattern
+func (s *TestSuite) assertError(c *C, w *httptest.ResponseRecorder, code, pattern string) {
+	c.Assert(w.Header().Get("Content-Type"), Equals, "application/json")
+	e := &api.Error{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), e), IsNil)
+	c.Assert(e.Code, Equals, code)
+	c.Assert(e.Message, Matches, pattern)
+}
+
+func (s *TestSuite) waitJob(c *C, router http.Handler, id string) *api.JobResponse {
+	for i := 0; i < 100; i++ {
+		w := s.serveRequest(c, router, "GET", "/jobs/"+id, nil)
+		c.Assert(w.Code, Equals, http.StatusOK)
+		job := &api.JobResponse{}
+		c.Assert(json.Unmarshal(w.Body.Bytes(), job), IsNil)
+		if job.Status != api.JOB_STATUS_RUNNING {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("Timeout waiting for job %v", id)
+	return nil
+}
+
+func (s *TestSuite) TestAsyncJob(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/snapshots/create?async=true", &api.SnapshotCreateRequest{
+		Name:       "snap1",
+		VolumeName: "vol1",
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	job := &api.JobResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), job), IsNil)
+	c.Assert(job.ID, Not(Equals), "")
+	c.Assert(job.Operation, Equals, "snapshot create")
+
+	job = s.waitJob(c, router, job.ID)
+	c.Assert(job.Status, Equals, api.JOB_STATUS_SUCCEEDED)
+	c.Assert(job.Result, Equals, "snap1")
+	c.Assert(d.SnapshotVolumeIndex.Get("snap1"), Equals, "vol1")
+
+	// Failure would be recorded in the job instead of the response
+	w = s.serveRequest(c, router, "POST", "/v1/snapshots/create?async=true", &api.SnapshotCreateRequest{
+		Name:       "snap2",
+		VolumeName: "nonexistent",
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(w.Body.Bytes(), job), IsNil)
+	job = s.waitJob(c, router, job.ID)
+	c.Assert(job.Status, Equals, api.JOB_STATUS_FAILED)
+	c.Assert(job.Error, Not(Equals), "")
+
+	w = s.serveRequest(c, router, "GET", "/jobs", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	jobs := []*api.JobResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &jobs), IsNil)
+	c.Assert(jobs, HasLen, 2)
+
+	w = s.serveRequest(c, router, "GET", "/jobs/nonexistent", nil)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+}
+
+func (s *TestSuite) TestJobHistoryLimit(c *C) {
+	m := newJobManager()
+	done := make(chan struct{})
+	running := m.start("running", func() (string, error) {
+		<-done
+		return "", nil
+	})
+	for i := 0; i < JOB_HISTORY_LIMIT+1; i++ {
+		m.start("test", func() (string, error) {
+			return "", nil
+		})
+	}
+	finished := func() int {
+		count := 0
+		for _, job := range m.list() {
+			if job.Status == api.JOB_STATUS_SUCCEEDED {
+				count++
+			}
+		}
+		return count
+	}
+	for i := 0; i < 100 && (finished() != JOB_HISTORY_LIMIT || len(m.list()) != JOB_HISTORY_LIMIT+1); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Only the latest finished jobs are kept, running job is never dropped
+	c.Assert(finished(), Equals, JOB_HISTORY_LIMIT)
+	c.Assert(m.list(), HasLen, JOB_HISTORY_LIMIT+1)
+	c.Assert(m.get(running.ID).Status, Equals, api.JOB_STATUS_RUNNING)
+	close(done)
+}
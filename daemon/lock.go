@@ -0,0 +1,113 @@
+package daemon
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/api"
+)
+
+/*
+lockManager serializes operations on the same volume, while operations on
+different volumes can run concurrently. Locks are keyed by volume name, and
+dropped once nobody is holding or waiting for them. The zero value is ready
+to use.
+*/
+type lockManager struct {
+	mutex sync.Mutex
+	locks map[string]*volumeLock
+}
+
+type volumeLock struct {
+	sync.Mutex
+	// Number of holder and waiters, and since when it's held, protected by
+	// lockManager.mutex
+	refs      int
+	heldSince time.Time
+}
+
+func (m *lockManager) Lock(name string) {
+	m.mutex.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*volumeLock)
+	}
+	l, exists := m.locks[name]
+	if !exists {
+		l = &volumeLock{}
+		m.locks[name] = l
+	}
+	l.refs++
+	m.mutex.Unlock()
+
+	l.Lock()
+
+	m.mutex.Lock()
+	l.heldSince = time.Now()
+	m.mutex.Unlock()
+}
+
+/*
+LockWithTimeout is Lock giving up after timeout, and returns whether the lock
+is held. It's for the operations which must go on even if another one hangs
+with the lock, e.g. force umount. The lock is released by itself once it's
+acquired after timeout.
+*/
+func (m *lockManager) LockWithTimeout(name string, timeout time.Duration) bool {
+	acquired := make(chan struct{})
+	go func() {
+		m.Lock(name)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return true
+	case <-time.After(timeout):
+		go func() {
+			<-acquired
+			m.Unlock(name)
+		}()
+		return false
+	}
+}
+
+func (m *lockManager) Unlock(name string) {
+	m.mutex.Lock()
+	l, exists := m.locks[name]
+	if !exists {
+		m.mutex.Unlock()
+		panic("BUG: unlock of unlocked volume " + name)
+	}
+	l.refs--
+	l.heldSince = time.Time{}
+	if l.refs == 0 {
+		delete(m.locks, name)
+	}
+	m.mutex.Unlock()
+
+	l.Unlock()
+}
+
+// list returns the volumes locked or being waited for by volume name
+func (m *lockManager) list(now time.Time) []api.VolumeLockResponse {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := []api.VolumeLockResponse{}
+	for name, l := range m.locks {
+		resp := api.VolumeLockResponse{
+			Volume:  name,
+			Waiters: l.refs,
+		}
+		if !l.heldSince.IsZero() {
+			resp.HeldSince = l.heldSince.Format(time.RubyDate)
+			resp.Duration = formatDuration(now.Sub(l.heldSince))
+			resp.Waiters--
+		}
+		result = append(result, resp)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Volume < result[j].Volume
+	})
+	return result
+}
@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestLockManager(c *C) {
+	m := &lockManager{}
+
+	m.Lock("vol1")
+	// Other volumes are not blocked
+	m.Lock("vol2")
+	m.Unlock("vol2")
+
+	locked := make(chan struct{})
+	go func() {
+		m.Lock("vol1")
+		close(locked)
+		m.Unlock("vol1")
+	}()
+	select {
+	case <-locked:
+		c.Fatal("Lock of the same volume should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	m.Unlock("vol1")
+	<-locked
+
+	count := func() int {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		return len(m.locks)
+	}
+	for i := 0; i < 100 && count() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(count(), Equals, 0)
+	c.Assert(func() { m.Unlock("vol1") }, PanicMatches, "BUG: unlock of unlocked volume vol1")
+}
+
+func (s *TestSuite) TestLockWithTimeout(c *C) {
+	m := &lockManager{}
+
+	c.Assert(m.LockWithTimeout("vol1", time.Second), Equals, true)
+	c.Assert(m.LockWithTimeout("vol1", 10*time.Millisecond), Equals, false)
+	m.Unlock("vol1")
+
+	// The lock given up is released once it's acquired
+	locked := make(chan struct{})
+	go func() {
+		m.Lock("vol1")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		c.Fatal("Lock given up by timeout is still held")
+	}
+	m.Unlock("vol1")
+}
+
+func (s *TestSuite) TestConcurrentSnapshotName(c *C) {
+	d := s.newVFSDaemon(c)
+	volumes := []*Volume{}
+	for _, name := range []string{"vol1", "vol2"} {
+		volume, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+			Name: name,
+		})
+		c.Assert(err, IsNil)
+		volumes = append(volumes, volume)
+	}
+
+	// Snapshot names are unique across volumes
+	var wg sync.WaitGroup
+	errs := make([]error, len(volumes))
+	for i, volume := range volumes {
+		wg.Add(1)
+		go func(i int, volume *Volume) {
+			defer wg.Done()
+			_, errs[i] = d.processSnapshotCreate(volume, "snap", nil, "", nil)
+		}(i, volume)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+		} else {
+			c.Assert(err, ErrorMatches, "Snapshot name snap already exists")
+		}
+	}
+	c.Assert(succeeded, Equals, 1)
+	c.Assert(d.SnapshotVolumeIndex.Get("snap"), Not(Equals), "")
+}
@@ -0,0 +1,203 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+
+	// Level of LogLevelRequest making a package use the global level
+	LOG_LEVEL_DEFAULT = "default"
+)
+
+// Names of packages, which are the "pkg" field of logs
+var validLogPackage = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+func validateLogFormat(format string) error {
+	if format != "" && format != LOG_FORMAT_TEXT && format != LOG_FORMAT_JSON {
+		return fmt.Errorf("log format must be %v or %v", LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+	return nil
+}
+
+// parsePackageLevels parses the levels of packages in <package>=<level>,
+// e.g. objectstore=debug
+func parsePackageLevels(list []string) (map[string]logrus.Level, error) {
+	levels := map[string]logrus.Level{}
+	for _, item := range list {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || !validLogPackage.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid package log level %v, must be <package>=<level>", item)
+		}
+		level, err := logrus.ParseLevel(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid package log level %v: %v", item, err)
+		}
+		levels[parts[0]] = level
+	}
+	return levels, nil
+}
+
+func parseLogMaxSize(value string) (int64, error) {
+	size, err := util.ParseSize(value)
+	if err == nil && size < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return size, err
+}
+
+func parseLogMaxAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err == nil && age < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return age, err
+}
+
+func parseLogMaxBackups(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	backups, err := strconv.Atoi(value)
+	if err == nil && backups < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return backups, err
+}
+
+// getListSetting is getSetting for the settings of string arrays
+func getListSetting(c *cli.Context, settings *settingsFile, key string) []string {
+	if settings != nil {
+		if value, exists := settings.Daemon[key]; exists {
+			return parseList(value)
+		}
+	}
+	return c.StringSlice(daemonSettingFlags[key])
+}
+
+/*
+setupLog sets the levels, format and output of the daemon log. The log is
+written to stdout in text, or to the file of "log" setting in JSON by
+default. The file is rotated if "log_max_size" or "log_max_age" is set.
+*/
+func setupLog(c *cli.Context, settings *settingsFile) error {
+	if err := setLogLevel(getSetting(c, settings, "log_level")); err != nil {
+		return err
+	}
+	levels, err := parsePackageLevels(getListSetting(c, settings, "log_package_levels"))
+	if err != nil {
+		return err
+	}
+	SetPackageLevels(levels)
+
+	logName := getSetting(c, settings, "log")
+	format := getSetting(c, settings, "log_format")
+	if err := validateLogFormat(format); err != nil {
+		return err
+	}
+	if format == "" {
+		format = LOG_FORMAT_TEXT
+		if logName != "" {
+			format = LOG_FORMAT_JSON
+		}
+	}
+	var formatter logrus.Formatter = &logrus.TextFormatter{}
+	if format == LOG_FORMAT_JSON {
+		formatter = &logrus.JSONFormatter{}
+	}
+
+	if logName != "" {
+		file := &RotatingFile{
+			Path: logName,
+		}
+		if file.MaxSize, err = parseLogMaxSize(getSetting(c, settings, "log_max_size")); err != nil {
+			return fmt.Errorf("Invalid log max size: %v", err)
+		}
+		if file.MaxAge, err = parseLogMaxAge(getSetting(c, settings, "log_max_age")); err != nil {
+			return fmt.Errorf("Invalid log max age: %v", err)
+		}
+		if file.MaxBackups, err = parseLogMaxBackups(getSetting(c, settings, "log_max_backups")); err != nil {
+			return fmt.Errorf("Invalid log max backups: %v", err)
+		}
+		if logFile, err = OpenRotatingFile(file); err != nil {
+			return err
+		}
+		logrus.SetOutput(logFile)
+	} else {
+		logrus.SetOutput(os.Stdout)
+	}
+	logrus.SetFormatter(LevelFormatter{Formatter: RequestIDFormatter{Formatter: formatter}})
+	return nil
+}
+
+func getLogLevels() *api.LogLevelsResponse {
+	level, levels := GetLevels()
+	resp := &api.LogLevelsResponse{
+		Level:    level.String(),
+		Packages: map[string]string{},
+	}
+	for pkg, l := range levels {
+		resp.Packages[pkg] = l.String()
+	}
+	return resp
+}
+
+func (s *daemon) doLogLevels(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	return writeResponseOutput(w, getLogLevels())
+}
+
+/*
+doLogLevelSet changes the global log level, or the level of a package, until
+the daemon restarts or reloads the config file. It's for debugging a
+running daemon, e.g. the objectstore only, without restarting it with debug
+logs of everything.
+*/
+func (s *daemon) doLogLevelSet(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.LogLevelRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	pkg := request.Package
+	if pkg != "" && !validLogPackage.MatchString(pkg) {
+		return api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Invalid package name %v", pkg)
+	}
+	if request.Level == LOG_LEVEL_DEFAULT {
+		if pkg == "" {
+			return api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Only the level of a package can be %v", LOG_LEVEL_DEFAULT)
+		}
+		ResetPackageLevel(pkg)
+		log.Infof("Log level of package %v is reset to the global one", pkg)
+		return writeResponseOutput(w, getLogLevels())
+	}
+	level, err := logrus.ParseLevel(request.Level)
+	if err != nil {
+		return api.NewError(api.ERROR_CODE_INVALID_REQUEST, "%v", err)
+	}
+	if pkg == "" {
+		SetLevel(level)
+		log.Infof("Log level is set to %v", level)
+	} else {
+		SetPackageLevel(pkg, level)
+		log.Infof("Log level of package %v is set to %v", pkg, level)
+	}
+	return writeResponseOutput(w, getLogLevels())
+}
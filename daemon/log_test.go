@@ -0,0 +1,88 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+
+	. "github.com/rancher/convoy/logging"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) setLogLevel(c *C, router http.Handler, request *api.LogLevelRequest) *api.LogLevelsResponse {
+	w := s.serveRequest(c, router, "POST", "/log/level", request)
+	c.Assert(w.Code, Equals, http.StatusOK, Commentf("%s", w.Body.String()))
+	resp := &api.LogLevelsResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), resp), IsNil)
+	return resp
+}
+
+func (s *TestSuite) TestLogLevels(c *C) {
+	defer SetLevel(logrus.DebugLevel)
+	defer SetPackageLevels(nil)
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	SetLevel(logrus.InfoLevel)
+
+	resp := s.setLogLevel(c, router, &api.LogLevelRequest{Package: "objectstore", Level: "debug"})
+	c.Assert(resp.Level, Equals, "info")
+	c.Assert(resp.Packages, DeepEquals, map[string]string{"objectstore": "debug"})
+	resp = s.setLogLevel(c, router, &api.LogLevelRequest{Level: "warn"})
+	c.Assert(resp.Level, Equals, "warning")
+	c.Assert(logrus.GetLevel(), Equals, logrus.DebugLevel)
+
+	w := s.serveRequest(c, router, "GET", "/log/levels", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	resp = &api.LogLevelsResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), resp), IsNil)
+	c.Assert(resp.Level, Equals, "warning")
+	c.Assert(resp.Packages, DeepEquals, map[string]string{"objectstore": "debug"})
+
+	resp = s.setLogLevel(c, router, &api.LogLevelRequest{Package: "objectstore", Level: LOG_LEVEL_DEFAULT})
+	c.Assert(resp.Packages, HasLen, 0)
+	c.Assert(logrus.GetLevel(), Equals, logrus.WarnLevel)
+
+	w = s.serveRequest(c, router, "POST", "/log/level", &api.LogLevelRequest{Level: "loud"})
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, ".*not a valid logrus Level.*")
+	w = s.serveRequest(c, router, "POST", "/log/level", &api.LogLevelRequest{Package: "Object Store", Level: "info"})
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, "Invalid package name Object Store")
+	w = s.serveRequest(c, router, "POST", "/log/level", &api.LogLevelRequest{Level: LOG_LEVEL_DEFAULT})
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, "Only the level of a package can be default")
+}
+
+func (s *TestSuite) TestLevelFormatter(c *C) {
+	var buf bytes.Buffer
+	logger := logrus.StandardLogger()
+	formatter, out := logger.Formatter, logger.Out
+	defer func() {
+		logrus.SetFormatter(formatter)
+		logrus.SetOutput(out)
+		SetLevel(logrus.DebugLevel)
+		SetPackageLevels(nil)
+	}()
+	logrus.SetFormatter(LevelFormatter{Formatter: &logrus.JSONFormatter{}})
+	logrus.SetOutput(&buf)
+	SetLevel(logrus.InfoLevel)
+	SetPackageLevel("objectstore", logrus.DebugLevel)
+	SetPackageLevel("vfs", logrus.ErrorLevel)
+
+	objectstoreLog := logrus.WithFields(logrus.Fields{"pkg": "objectstore"})
+	vfsLog := logrus.WithFields(logrus.Fields{"pkg": "vfs"})
+	log.Debug("daemon debug")
+	log.Info("daemon info")
+	objectstoreLog.WithFields(logrus.Fields{LOG_FIELD_VOLUME: "vol1"}).Debug("objectstore debug")
+	vfsLog.Warn("vfs warning")
+	vfsLog.Error("vfs error")
+
+	messages := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		entry := map[string]interface{}{}
+		c.Assert(json.Unmarshal([]byte(line), &entry), IsNil)
+		messages = append(messages, entry["msg"].(string))
+	}
+	c.Assert(messages, DeepEquals, []string{"daemon info", "objectstore debug", "vfs error"})
+}
@@ -0,0 +1,505 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	MIGRATE_CFG_PREFIX = "migrate_"
+
+	MIGRATE_PHASE_COPY   = "copy"
+	MIGRATE_PHASE_RETIRE = "retire"
+
+	// Label of the snapshot taken before migrating, valued the destination
+	// driver
+	MIGRATE_SNAPSHOT_LABEL = "convoy.migrate"
+)
+
+/*
+migrateIntent records a volume being migrated from driver From to driver To.
+Both drivers have the volume until the source is retired, so the driver owning
+it is decided by the phase rather than by asking the drivers. In the copy
+phase the volume is still the one of From, and an interrupted migration is
+rolled back by deleting the copy in To. Switching to the retire phase is the
+point the volume becomes the one of To, after which an interrupted migration
+is completed by deleting the source.
+*/
+type migrateIntent struct {
+	Volume string
+	From   string
+	To     string
+	Phase  string
+	// Snapshot of the source taken before copying, if its driver supports
+	// snapshots
+	Snapshot    string
+	CreatedTime string
+
+	configPath string
+}
+
+func (i *migrateIntent) ConfigFile() (string, error) {
+	if i.Volume == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume name of migration")
+	}
+	if i.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty migration config path")
+	}
+	return filepath.Join(i.configPath, MIGRATE_CFG_PREFIX+i.Volume+CFG_POSTFIX), nil
+}
+
+// owner returns the driver the volume belongs to in the current phase
+func (i *migrateIntent) owner() string {
+	if i.Phase == MIGRATE_PHASE_RETIRE {
+		return i.To
+	}
+	return i.From
+}
+
+// migrationOwner returns the driver of volume if it's being migrated, or
+// empty if the drivers should be asked
+func (s *daemon) migrationOwner(volumeName string) string {
+	s.migrationLock.RLock()
+	defer s.migrationLock.RUnlock()
+	return s.migrations[volumeName]
+}
+
+// setMigrationOwner makes the volume belong to driverName regardless of the
+// other drivers having it, until it's set to empty
+func (s *daemon) setMigrationOwner(volumeName, driverName string) {
+	s.migrationLock.Lock()
+	defer s.migrationLock.Unlock()
+	if driverName == "" {
+		delete(s.migrations, volumeName)
+		return
+	}
+	if s.migrations == nil {
+		s.migrations = make(map[string]string)
+	}
+	s.migrations[volumeName] = driverName
+}
+
+func (s *daemon) doVolumeMigrate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeMigrateRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volume, err := s.processVolumeMigrate(request)
+	if err != nil {
+		return err
+	}
+
+	if request.Verbose {
+		driverInfo, err := s.getVolumeDriverInfo(volume)
+		if err != nil {
+			return err
+		}
+		return writeResponseOutput(w, api.VolumeResponse{
+			Name:        volume.Name,
+			Driver:      volume.DriverName,
+			CreatedTime: driverInfo[OPT_VOLUME_CREATED_TIME],
+			DriverInfo:  driverInfo,
+			Snapshots:   map[string]api.SnapshotResponse{},
+		})
+	}
+	return writeStringResponse(w, volume.Name)
+}
+
+/*
+processVolumeMigrate moves the volume to another driver under the same name.
+The source must not be mounted, so the data doesn't change while it's copied.
+It's snapshotted first if its driver supports snapshots, then the new volume is
+created and the data copied, block by block if both drivers expose devices,
+otherwise file by file. The new volume takes over the name once the data is
+copied, and the source is deleted along with its snapshots.
+*/
+func (s *daemon) processVolumeMigrate(request *api.VolumeMigrateRequest) (*Volume, error) {
+	volumeName := request.VolumeName
+	driverName := request.DriverName
+	if err := util.CheckName(volumeName); err != nil {
+		return nil, err
+	}
+	if driverName == "" {
+		return nil, fmt.Errorf("Driver to migrate volume %v to is required", volumeName)
+	}
+	if err := util.ValidateMountOptions(request.MountOptions); err != nil {
+		return nil, err
+	}
+
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	source := s.getVolume(volumeName)
+	if source == nil {
+		return nil, volumeNotFoundError(volumeName)
+	}
+	if source.DriverName == driverName {
+		return nil, fmt.Errorf("Volume %v is already of driver %v", volumeName, driverName)
+	}
+	fromOps, err := s.getVolumeOpsForVolume(source)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := s.getDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+	toOps, err := driver.VolumeOps()
+	if err != nil {
+		return nil, err
+	}
+	mountPoint, err := fromOps.MountPoint(Request{
+		Name:    volumeName,
+		Options: map[string]string{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mountPoint != "" {
+		return nil, api.NewError(api.ERROR_CODE_IN_USE, "Volume %v is mounted at %v, umount it before migrating",
+			volumeName, mountPoint).WithDetail("volume", volumeName)
+	}
+	if info, _ := toOps.GetVolumeInfo(volumeName); info != nil {
+		return nil, api.NewError(api.ERROR_CODE_CONFLICT, "Volume %v already exists in driver %v",
+			volumeName, driverName).WithDetail("volume", volumeName).WithDetail("driver", driverName)
+	}
+	if err := s.checkClusterVolumeName(volumeName, driverName); err != nil {
+		return nil, err
+	}
+
+	createRequest := &api.VolumeCreateRequest{
+		Name:         volumeName,
+		DriverName:   driverName,
+		Size:         request.Size,
+		Type:         request.Type,
+		FSType:       request.FSType,
+		IOPS:         request.IOPS,
+		Throughput:   request.Throughput,
+		MountOptions: request.MountOptions,
+		Tags:         request.Tags,
+		Encrypted:    request.Encrypted,
+		KmsKeyID:     request.KmsKeyID,
+	}
+	if createRequest.Size == 0 {
+		info, err := fromOps.GetVolumeInfo(volumeName)
+		if err != nil {
+			return nil, err
+		}
+		if size, err := strconv.ParseInt(info[OPT_SIZE], 10, 64); err == nil {
+			createRequest.Size = size
+		}
+	}
+
+	intent := &migrateIntent{
+		Volume:      volumeName,
+		From:        source.DriverName,
+		To:          driverName,
+		Phase:       MIGRATE_PHASE_COPY,
+		CreatedTime: util.Now(),
+		configPath:  s.Root,
+	}
+	if err := s.saveObject(intent); err != nil {
+		return nil, fmt.Errorf("Failed to record migration of volume %v: %v", volumeName, err)
+	}
+	s.setMigrationOwner(volumeName, intent.From)
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:  LOG_EVENT_MIGRATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volumeName,
+		LOG_FIELD_DRIVER: driverName,
+	}).Debug("Migrating volume")
+	if err := s.copyMigration(intent, source, fromOps, toOps, createRequest); err != nil {
+		s.abortMigration(intent)
+		return nil, err
+	}
+
+	// The volume is the one of destination from now on
+	intent.Phase = MIGRATE_PHASE_RETIRE
+	if err := s.saveObject(intent); err != nil {
+		intent.Phase = MIGRATE_PHASE_COPY
+		s.abortMigration(intent)
+		return nil, fmt.Errorf("Failed to record migration of volume %v: %v", volumeName, err)
+	}
+	s.setMigrationOwner(volumeName, intent.To)
+	if err := s.updateVolumeConfig(volumeName, func(config *VolumeConfig) (bool, error) {
+		config.CreateOptions = volumeCreateOptions(createRequest)
+		config.SnapshotLabels = nil
+		return true, nil
+	}); err != nil {
+		log.Errorf("Failed to update config of volume %v migrated to driver %v: %v", volumeName, driverName, err)
+	}
+	s.publishClusterHost()
+	if err := s.retireMigrationSource(intent); err != nil {
+		return nil, fmt.Errorf("Volume %v is migrated to driver %v, but failed to delete it in driver %v, would retry on next startup: %v",
+			volumeName, driverName, intent.From, err)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_MIGRATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volumeName,
+		LOG_FIELD_DRIVER: driverName,
+	}).Debug("Migrated volume")
+
+	return &Volume{
+		Name:       volumeName,
+		DriverName: driverName,
+	}, nil
+}
+
+// copyMigration snapshots the source, then creates the volume in the
+// destination and copies the data to it. Caller must hold the lock of volume.
+func (s *daemon) copyMigration(intent *migrateIntent, source *Volume, fromOps, toOps VolumeOperations, createRequest *api.VolumeCreateRequest) error {
+	volumeName := intent.Volume
+	if _, err := s.getSnapshotOpsForVolume(source); err == nil {
+		snapshotName, err := s.createSnapshot(source, "", map[string]string{
+			MIGRATE_SNAPSHOT_LABEL: intent.To,
+		}, "", nil)
+		if err != nil {
+			return fmt.Errorf("Failed to snapshot volume %v before migrating: %v", volumeName, err)
+		}
+		intent.Snapshot = snapshotName
+		if err := s.saveObject(intent); err != nil {
+			return fmt.Errorf("Failed to record migration of volume %v: %v", volumeName, err)
+		}
+	}
+
+	req := Request{
+		Name: volumeName,
+		Options: map[string]string{
+			OPT_SIZE:              strconv.FormatInt(createRequest.Size, 10),
+			OPT_VOLUME_NAME:       volumeName,
+			OPT_VOLUME_TYPE:       createRequest.Type,
+			OPT_VOLUME_FS_TYPE:    createRequest.FSType,
+			OPT_VOLUME_IOPS:       strconv.FormatInt(createRequest.IOPS, 10),
+			OPT_VOLUME_THROUGHPUT: strconv.FormatInt(createRequest.Throughput, 10),
+			OPT_PREPARE_FOR_VM:    "false",
+			OPT_MOUNT_OPTIONS:     createRequest.MountOptions,
+			OPT_TAGS:              util.FormatTags(createRequest.Tags),
+			OPT_ENCRYPTED:         strconv.FormatBool(createRequest.Encrypted),
+			OPT_KMS_KEY_ID:        createRequest.KmsKeyID,
+		},
+	}
+	ctx, cancel := s.operationContext(OPERATION_CREATE)
+	defer cancel()
+	req.Ctx = ctx
+	if err := toOps.CreateVolume(req); err != nil {
+		return operationError(ctx, OPERATION_CREATE, volumeName, err)
+	}
+	return s.copyVolumeData(volumeName, fromOps, toOps)
+}
+
+// copyVolumeData copies the data of volume from the source to the
+// destination, by dd if both are devices and the destination is large enough,
+// otherwise by cp with both mounted. It's limited by the timeouts of the
+// commands, like the copies done by drivers.
+func (s *daemon) copyVolumeData(volumeName string, fromOps, toOps VolumeOperations) error {
+	srcInfo, err := fromOps.GetVolumeInfo(volumeName)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := toOps.GetVolumeInfo(volumeName)
+	if err != nil {
+		return err
+	}
+	dstSize, _ := strconv.ParseInt(dstInfo[OPT_SIZE], 10, 64)
+
+	srcDev, dstDev := srcInfo["Device"], dstInfo["Device"]
+	if isDevice(srcDev) && isDevice(dstDev) {
+		srcSize, err := strconv.ParseInt(srcInfo[OPT_SIZE], 10, 64)
+		if err == nil && srcSize > 0 && dstSize >= srcSize {
+			log.Debugf("Copying device %v of volume %v to device %v", srcDev, volumeName, dstDev)
+			_, err := util.Execute("dd", []string{
+				"if=" + srcDev,
+				"of=" + dstDev,
+				"bs=4M",
+				"conv=notrunc,fsync",
+			})
+			return err
+		}
+	}
+
+	if used, err := strconv.ParseInt(srcInfo[OPT_USED_SIZE], 10, 64); err == nil && dstSize > 0 && used > dstSize {
+		return fmt.Errorf("Volume %v uses %v bytes, more than the size %v of the destination", volumeName, used, dstSize)
+	}
+	srcPath, err := s.mountForMigration(fromOps, volumeName)
+	if err != nil {
+		return err
+	}
+	defer s.umountForMigration(fromOps, volumeName)
+	dstPath, err := s.mountForMigration(toOps, volumeName)
+	if err != nil {
+		return err
+	}
+	defer s.umountForMigration(toOps, volumeName)
+
+	log.Debugf("Copying files of volume %v from %v to %v", volumeName, srcPath, dstPath)
+	_, err = util.Execute("cp", []string{"-a", srcPath + "/.", dstPath})
+	return err
+}
+
+func isDevice(path string) bool {
+	if path == "" {
+		return false
+	}
+	st, err := os.Stat(path)
+	return err == nil && st.Mode()&os.ModeDevice != 0
+}
+
+func (s *daemon) mountForMigration(volOps VolumeOperations, volumeName string) (string, error) {
+	ctx, cancel := s.operationContext(OPERATION_MOUNT)
+	defer cancel()
+	mountPoint, err := volOps.MountVolume(Request{
+		Name:    volumeName,
+		Options: map[string]string{},
+		Ctx:     ctx,
+	})
+	return mountPoint, operationError(ctx, OPERATION_MOUNT, volumeName, err)
+}
+
+func (s *daemon) umountForMigration(volOps VolumeOperations, volumeName string) {
+	ctx, cancel := s.operationContext(OPERATION_UMOUNT)
+	defer cancel()
+	if err := volOps.UmountVolume(Request{
+		Name:    volumeName,
+		Options: map[string]string{},
+		Ctx:     ctx,
+	}); err != nil {
+		log.Errorf("Failed to umount volume %v of driver %v after copying it: %v", volumeName, volOps.Name(), err)
+	}
+}
+
+// abortMigration rolls back a migration in the copy phase, by deleting the
+// volume in the destination and the snapshot taken for it. The intent is kept
+// for the next startup if it fails.
+func (s *daemon) abortMigration(intent *migrateIntent) {
+	if err := s.rollbackMigration(intent); err != nil {
+		log.Errorf("Failed to roll back migrating volume %v to driver %v, would retry on next startup: %v",
+			intent.Volume, intent.To, err)
+	}
+}
+
+func (s *daemon) rollbackMigration(intent *migrateIntent) error {
+	if err := s.deleteMigratedVolume(intent.Volume, intent.To); err != nil {
+		return err
+	}
+	if intent.Snapshot != "" {
+		if err := s.purgeSnapshot(intent.Volume, intent.Snapshot); err != nil {
+			return err
+		}
+	}
+	return s.endMigration(intent)
+}
+
+// retireMigrationSource deletes the volume in the source driver along with its
+// snapshots, and completes the migration
+func (s *daemon) retireMigrationSource(intent *migrateIntent) error {
+	driver, err := s.getDriver(intent.From)
+	if err != nil {
+		return err
+	}
+	snapshots := map[string]map[string]string{}
+	if snapOps, err := driver.SnapshotOps(); err == nil {
+		if snapshots, err = snapOps.ListSnapshot(map[string]string{
+			OPT_VOLUME_NAME: intent.Volume,
+		}); err != nil && !util.IsNotExistsError(err) {
+			return err
+		}
+	}
+	if err := s.deleteMigratedVolume(intent.Volume, intent.From); err != nil {
+		return err
+	}
+	for snapshotName := range snapshots {
+		if err := s.SnapshotVolumeIndex.Delete(snapshotName); err != nil {
+			return err
+		}
+		if err := s.NameUUIDIndex.Delete(snapshotName); err != nil {
+			return err
+		}
+	}
+	return s.endMigration(intent)
+}
+
+// deleteMigratedVolume deletes the volume in driverName if it's there
+func (s *daemon) deleteMigratedVolume(volumeName, driverName string) error {
+	driver, err := s.getDriver(driverName)
+	if err != nil {
+		return err
+	}
+	volOps, err := driver.VolumeOps()
+	if err != nil {
+		return err
+	}
+	if info, _ := volOps.GetVolumeInfo(volumeName); info == nil {
+		return nil
+	}
+	ctx, cancel := s.operationContext(OPERATION_DELETE)
+	defer cancel()
+	if err := volOps.DeleteVolume(Request{
+		Name:    volumeName,
+		Options: map[string]string{},
+		Ctx:     ctx,
+	}); err != nil {
+		return operationError(ctx, OPERATION_DELETE, volumeName, err)
+	}
+	return nil
+}
+
+func (s *daemon) endMigration(intent *migrateIntent) error {
+	if err := s.deleteObject(intent); err != nil {
+		return fmt.Errorf("Failed to complete migration of volume %v: %v", intent.Volume, err)
+	}
+	s.setMigrationOwner(intent.Volume, "")
+	return nil
+}
+
+// recoverMigrations resolves the migrations interrupted by a crash, before the
+// indexes are built from the drivers. The ones cannot be resolved, e.g. as a
+// driver is unavailable, keep the volume with the driver owning it in their
+// phase, and are retried on the next startup.
+func (s *daemon) recoverMigrations() {
+	names, err := s.listObjectNames(MIGRATE_CFG_PREFIX)
+	if err != nil {
+		log.Errorf("Failed to list migrations: %v", err)
+		return
+	}
+	for _, name := range names {
+		intent := &migrateIntent{
+			Volume:     name,
+			configPath: s.Root,
+		}
+		if err := s.loadObject(intent); err != nil {
+			log.Errorf("Failed to load migration of volume %v: %v", name, err)
+			continue
+		}
+		s.setMigrationOwner(intent.Volume, intent.owner())
+
+		s.volumeLocks.Lock(intent.Volume)
+		if intent.Phase == MIGRATE_PHASE_RETIRE {
+			log.Warnf("Completing migration of volume %v to driver %v interrupted since %v",
+				intent.Volume, intent.To, intent.CreatedTime)
+			err = s.retireMigrationSource(intent)
+		} else {
+			log.Warnf("Rolling back migration of volume %v to driver %v interrupted since %v",
+				intent.Volume, intent.To, intent.CreatedTime)
+			err = s.rollbackMigration(intent)
+		}
+		s.volumeLocks.Unlock(intent.Volume)
+		if err != nil {
+			log.Errorf("Failed to recover migration of volume %v, would retry on next startup: %v", intent.Volume, err)
+		}
+	}
+}
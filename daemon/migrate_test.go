@@ -0,0 +1,182 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+	"github.com/rancher/convoy/vfs"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+// testOtherVFSDriver is another VFS driver with volumes in "volumes2" next to
+// its root, so volumes can be migrated between the two
+const testOtherVFSDriver = "test-vfs2"
+
+type renamedDriver struct {
+	ConvoyDriver
+	name string
+}
+
+func (d *renamedDriver) Name() string {
+	return d.name
+}
+
+func init() {
+	if err := Register(testOtherVFSDriver, func(root string, config map[string]string) (ConvoyDriver, error) {
+		driver, err := vfs.Init(root, map[string]string{
+			vfs.VFS_PATH: filepath.Join(filepath.Dir(root), "volumes2"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &renamedDriver{ConvoyDriver: driver, name: testOtherVFSDriver}, nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func (s *TestSuite) newMigrateDaemon(c *C) *daemon {
+	d := s.newDaemon(DRIVER_INIT_MODE_STRICT, vfs.KIND, testOtherVFSDriver)
+	c.Assert(d.initDrivers(map[string]string{
+		vfs.VFS_PATH: filepath.Join(s.root, "volumes"),
+	}), IsNil)
+	c.Assert(d.finializeInitialization(), IsNil)
+	return d
+}
+
+func (s *TestSuite) TestVolumeMigrate(c *C) {
+	d := s.newMigrateDaemon(c)
+	router := createRouter(d)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:   "vol1",
+		Labels: map[string]string{"team": "web"},
+	})
+	c.Assert(err, IsNil)
+	source := filepath.Join(s.root, "volumes", "vol1")
+	c.Assert(os.Mkdir(filepath.Join(source, "dir"), 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(source, "dir", "data"), []byte("data"), 0600), IsNil)
+	_, err = d.processSnapshotCreate(d.getVolume("vol1"), "snap1", map[string]string{"kept": "no"}, "", nil)
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/v1/volumes/migrate", &api.VolumeMigrateRequest{
+		VolumeName: "vol1",
+		DriverName: testOtherVFSDriver,
+		Verbose:    true,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	volume := &api.VolumeResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), volume), IsNil)
+	c.Assert(volume.Name, Equals, "vol1")
+	c.Assert(volume.Driver, Equals, testOtherVFSDriver)
+
+	// Data is copied with its permission, and the source is retired
+	dest := filepath.Join(s.root, "volumes2", "vol1")
+	c.Assert(volume.DriverInfo["Path"], Equals, dest)
+	data, err := ioutil.ReadFile(filepath.Join(dest, "dir", "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	st, err := os.Stat(filepath.Join(dest, "dir", "data"))
+	c.Assert(err, IsNil)
+	c.Assert(st.Mode().Perm(), Equals, os.FileMode(0600))
+	_, err = os.Stat(source)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(d.getVolume("vol1").DriverName, Equals, testOtherVFSDriver)
+	c.Assert(d.getVolumeList()["vol1"]["Driver"], Equals, testOtherVFSDriver)
+	c.Assert(d.migrationOwner("vol1"), Equals, "")
+	names, err := d.listObjectNames(MIGRATE_CFG_PREFIX)
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+
+	// Snapshots are retired with the source, labels of volume are kept
+	c.Assert(d.SnapshotVolumeIndex.Get("snap1"), Equals, "")
+	c.Assert(d.NameUUIDIndex.Get("snap1"), Equals, "")
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.Labels, DeepEquals, map[string]string{"team": "web"})
+	c.Assert(config.SnapshotLabels, HasLen, 0)
+	c.Assert(config.CreateOptions, HasLen, 0)
+
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol2"})
+	c.Assert(err, IsNil)
+	_, err = d.processVolumeMount(d.getVolume("vol2"), &api.VolumeMountRequest{VolumeName: "vol2"})
+	c.Assert(err, IsNil)
+	for _, t := range []struct {
+		request *api.VolumeMigrateRequest
+		message string
+	}{
+		{&api.VolumeMigrateRequest{VolumeName: "vol1"}, "Driver to migrate volume vol1 to is required"},
+		{&api.VolumeMigrateRequest{VolumeName: "vol3", DriverName: testOtherVFSDriver}, "volume vol3 doesn't exist"},
+		{&api.VolumeMigrateRequest{VolumeName: "vol1", DriverName: testOtherVFSDriver}, "Volume vol1 is already of driver " + testOtherVFSDriver},
+		{&api.VolumeMigrateRequest{VolumeName: "vol1", DriverName: "lvm"}, "Cannot find driver lvm"},
+		{&api.VolumeMigrateRequest{VolumeName: "vol2", DriverName: testOtherVFSDriver}, "Volume vol2 is mounted at .*, umount it before migrating"},
+	} {
+		_, err := d.processVolumeMigrate(t.request)
+		c.Assert(err, ErrorMatches, t.message)
+	}
+	c.Assert(d.getVolume("vol2").DriverName, Equals, vfs.KIND)
+}
+
+func (s *TestSuite) TestVolumeMigrateRecovery(c *C) {
+	d := s.newMigrateDaemon(c)
+
+	for _, name := range []string{"vol1", "vol2"} {
+		_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: name})
+		c.Assert(err, IsNil)
+		driver, err := d.getDriver(testOtherVFSDriver)
+		c.Assert(err, IsNil)
+		volOps, err := driver.VolumeOps()
+		c.Assert(err, IsNil)
+		c.Assert(volOps.CreateVolume(Request{
+			Name: name,
+			Options: map[string]string{
+				OPT_PREPARE_FOR_VM: "false",
+			},
+		}), IsNil)
+	}
+	_, err := d.processSnapshotCreate(d.getVolume("vol1"), "snap1", nil, "", nil)
+	c.Assert(err, IsNil)
+
+	// Interrupted while copying vol1, and while retiring the source of vol2
+	c.Assert(d.saveObject(&migrateIntent{
+		Volume:      "vol1",
+		From:        vfs.KIND,
+		To:          testOtherVFSDriver,
+		Phase:       MIGRATE_PHASE_COPY,
+		Snapshot:    "snap1",
+		CreatedTime: util.Now(),
+		configPath:  s.root,
+	}), IsNil)
+	c.Assert(d.saveObject(&migrateIntent{
+		Volume:      "vol2",
+		From:        vfs.KIND,
+		To:          testOtherVFSDriver,
+		Phase:       MIGRATE_PHASE_RETIRE,
+		CreatedTime: util.Now(),
+		configPath:  s.root,
+	}), IsNil)
+
+	d = s.newMigrateDaemon(c)
+	c.Assert(d.getVolume("vol1").DriverName, Equals, vfs.KIND)
+	c.Assert(d.getVolume("vol2").DriverName, Equals, testOtherVFSDriver)
+	c.Assert(d.snapshotExists("vol1", "snap1"), Equals, false)
+	for _, dir := range []string{
+		filepath.Join(s.root, "volumes2", "vol1"),
+		filepath.Join(s.root, "volumes", "vol2"),
+	} {
+		_, err := os.Stat(dir)
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
+	c.Assert(d.migrationOwner("vol1"), Equals, "")
+	c.Assert(d.migrationOwner("vol2"), Equals, "")
+	names, err := d.listObjectNames(MIGRATE_CFG_PREFIX)
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+}
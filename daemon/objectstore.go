@@ -1,13 +1,20 @@
 package daemon
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/metrics"
 	"github.com/rancher/convoy/objectstore"
 	"github.com/rancher/convoy/util"
 
@@ -22,8 +29,20 @@ func (s *daemon) doBackupList(version string, w http.ResponseWriter, r *http.Req
 	}
 	request.URL = util.UnescapeURL(request.URL)
 
+	if request.Limit < 0 {
+		return fmt.Errorf("Invalid limit %v, must be a non-negative integer", request.Limit)
+	}
 	opts := map[string]string{
-		OPT_VOLUME_NAME: request.VolumeName,
+		OPT_VOLUME_NAME:   request.VolumeName,
+		OPT_LIST_MARKER:   request.Marker,
+		OPT_CREATED_SINCE: request.CreatedSince,
+		OPT_CREATED_UNTIL: request.CreatedUntil,
+	}
+	if request.Limit != 0 {
+		opts[OPT_LIST_LIMIT] = strconv.Itoa(request.Limit)
+	}
+	if request.NoCache {
+		opts[OPT_LIST_NO_CACHE] = "true"
 	}
 	result := make(map[string]map[string]string)
 	for _, driver := range s.ConvoyDrivers {
@@ -41,11 +60,44 @@ func (s *daemon) doBackupList(version string, w http.ResponseWriter, r *http.Req
 		}
 	}
 
-	data, err := api.ResponseOutput(result)
-	if err != nil {
+	// Each driver returns at most Limit backups of its own volumes, the
+	// first Limit of all of them are the page
+	urls := []string{}
+	for backupURL := range result {
+		urls = append(urls, backupURL)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		return objectstore.BackupURLLess(urls[i], urls[j])
+	})
+	if request.Limit != 0 && len(urls) > request.Limit {
+		urls = urls[:request.Limit]
+	}
+	return writeBackupList(w, urls, result)
+}
+
+// writeBackupList writes backups as a JSON object keyed by URL in the order
+// of urls, one backup at a time rather than marshalling the whole list
+func writeBackupList(w http.ResponseWriter, urls []string, infos map[string]map[string]string) error {
+	if _, err := w.Write([]byte("{")); err != nil {
 		return err
 	}
-	_, err = w.Write(data)
+	for i, backupURL := range urls {
+		key, err := json.Marshal(backupURL)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(infos[backupURL])
+		if err != nil {
+			return err
+		}
+		if i != 0 {
+			key = append([]byte(","), key...)
+		}
+		if _, err := w.Write(append(append(key, ':'), value...)); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte("}"))
 	return err
 }
 
@@ -79,37 +131,115 @@ func (s *daemon) doBackupCreate(version string, w http.ResponseWriter, r *http.R
 		return err
 	}
 	request.URL = util.UnescapeURL(request.URL)
+	if request.Retain < 0 {
+		return fmt.Errorf("Invalid retain count %v", request.Retain)
+	}
+	destURL, err := objectstore.ApplyDestOptions(request.URL, request.Options)
+	if err != nil {
+		return err
+	}
+	request.URL = destURL
+
+	encryptionKeyID, err := s.getBackupEncryptionKey(request.EncryptionKey, request.EncryptionKMSKeyID)
+	if err != nil {
+		return err
+	}
+
+	backupURL, err := s.processBackupCreate(request.SnapshotName, request.URL, encryptionKeyID, request.Compression)
+	if err != nil {
+		return err
+	}
+	if request.Retain != 0 {
+		volumeName := s.SnapshotVolumeIndex.Get(request.SnapshotName)
+		// The backup has been created, failing to prune old ones would be
+		// retried by the next backup with retain count
+		if err := s.processBackupPrune(volumeName, request.URL, backupURL, request.Retain); err != nil {
+			log.WithFields(logrus.Fields{
+				LOG_FIELD_VOLUME:   volumeName,
+				LOG_FIELD_DEST_URL: request.URL,
+			}).Warnf("Failed to prune old backups: %v", err)
+		}
+	}
+
+	backup := &api.BackupURLResponse{
+		URL: backupURL,
+	}
+	if request.Verbose {
+		return sendResponse(w, backup)
+	}
+	escapedURL := strings.Replace(backupURL, "&", "\\u0026", 1)
+	return writeStringResponse(w, escapedURL)
+}
 
-	snapshotName := request.SnapshotName
+// processBackupCreate notifies hooks of the result of backup, whether it
+// succeeded or failed
+func (s *daemon) processBackupCreate(snapshotName, destURL, encryptionKeyID, compression string) (string, error) {
+	backupURL, err := s.createBackup(snapshotName, destURL, encryptionKeyID, compression)
+	s.notifyBackup(s.SnapshotVolumeIndex.Get(snapshotName), snapshotName, destURL, backupURL, err)
+	return backupURL, err
+}
+
+// notifyBackup notifies the result of backup of snapshot to destURL
+func (s *daemon) notifyBackup(volumeName, snapshotName, destURL, backupURL string, err error) {
+	event := &api.EventResponse{
+		Event:     EVENT_BACKUP_COMPLETE,
+		Volume:    volumeName,
+		Snapshot:  snapshotName,
+		DestURL:   destURL,
+		BackupURL: backupURL,
+	}
+	if err != nil {
+		event.Event = EVENT_BACKUP_FAILED
+		event.Error = err.Error()
+	}
+	s.notifier.notify(event)
+}
+
+func (s *daemon) createBackup(snapshotName, destURL, encryptionKeyID, compression string) (string, error) {
+	if err := util.ValidateCompression(compression); err != nil {
+		return "", err
+	}
 	volumeName := s.SnapshotVolumeIndex.Get(snapshotName)
 	if volumeName == "" {
-		return fmt.Errorf("Cannot find volume of snapshot %v", snapshotName)
+		return "", api.NewError(api.ERROR_CODE_NOT_FOUND, "Cannot find volume of snapshot %v", snapshotName).WithDetail("snapshot", snapshotName)
 	}
 
+	// Snapshot must stay until backup completes
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	return s.backupSnapshot(volumeName, snapshotName, destURL, encryptionKeyID, compression)
+}
+
+// backupSnapshot backs up the snapshot of volume to destURL, caller must hold
+// the lock of volume
+func (s *daemon) backupSnapshot(volumeName, snapshotName, destURL, encryptionKeyID, compression string) (string, error) {
 	if !s.snapshotExists(volumeName, snapshotName) {
-		return fmt.Errorf("snapshot %v of volume %v doesn't exist", snapshotName, volumeName)
+		return "", snapshotNotFoundError(snapshotName, volumeName)
 	}
 
 	volume := s.getVolume(volumeName)
 	backupOps, err := s.getBackupOpsForVolume(volume)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	volumeInfo, err := s.getVolumeDriverInfo(volume)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	snapshot, err := s.getSnapshotDriverInfo(snapshotName, volume)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	opts := map[string]string{
 		OPT_VOLUME_NAME:           volumeName,
 		OPT_VOLUME_CREATED_TIME:   volumeInfo[OPT_VOLUME_CREATED_TIME],
 		OPT_SNAPSHOT_CREATED_TIME: snapshot[OPT_SNAPSHOT_CREATED_TIME],
+		OPT_ENCRYPTION_KEY_ID:     encryptionKeyID,
+		OPT_COMPRESSION:           compression,
 	}
 
 	log.WithFields(logrus.Fields{
@@ -119,12 +249,14 @@ func (s *daemon) doBackupCreate(version string, w http.ResponseWriter, r *http.R
 		LOG_FIELD_SNAPSHOT: snapshotName,
 		LOG_FIELD_VOLUME:   volumeName,
 		LOG_FIELD_DRIVER:   backupOps.Name(),
-		LOG_FIELD_DEST_URL: request.URL,
+		LOG_FIELD_DEST_URL: destURL,
 	}).Debug()
-	backupURL, err := backupOps.CreateBackup(snapshotName, volumeName, request.URL, opts)
+	backupURL, err := backupOps.CreateBackup(snapshotName, volumeName, destURL, opts)
 	if err != nil {
-		return err
+		metrics.RecordBackupFailure(volumeName, destURL)
+		return "", err
 	}
+	metrics.RecordBackupSuccess(volumeName, destURL, time.Now())
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
 		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
@@ -132,27 +264,442 @@ func (s *daemon) doBackupCreate(version string, w http.ResponseWriter, r *http.R
 		LOG_FIELD_SNAPSHOT: snapshotName,
 		LOG_FIELD_VOLUME:   volumeName,
 		LOG_FIELD_DRIVER:   backupOps.Name(),
-		LOG_FIELD_DEST_URL: request.URL,
+		LOG_FIELD_DEST_URL: destURL,
 	}).Debug()
 
-	backup := &api.BackupURLResponse{
-		URL: backupURL,
+	if err := s.recordBackupDestination(volumeName, snapshotName, destURL); err != nil {
+		return "", err
+	}
+	return backupURL, nil
+}
+
+func (s *daemon) doBackupNow(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupNowRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
 	}
+	if request.SnapshotName != "" {
+		if err := util.CheckName(request.SnapshotName); err != nil {
+			return err
+		}
+	}
+	if request.Retain < 0 {
+		return fmt.Errorf("Invalid retain count %v", request.Retain)
+	}
+	if err := util.ValidateCompression(request.Compression); err != nil {
+		return err
+	}
+	destURL, err := objectstore.ApplyDestOptions(request.URL, request.Options)
+	if err != nil {
+		return err
+	}
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+	if _, err := s.getBackupOpsForVolume(volume); err != nil {
+		return err
+	}
+
+	encryptionKeyID, err := s.getBackupEncryptionKey(request.EncryptionKey, request.EncryptionKMSKeyID)
+	if err != nil {
+		return err
+	}
+
+	backup, err := s.processBackupNow(volume, request.SnapshotName, request.Labels, destURL, encryptionKeyID, request.Compression, request.DeleteSnapshot)
+	if err != nil {
+		return err
+	}
+	if request.Retain != 0 {
+		if err := s.processBackupPrune(volumeName, destURL, backup.URL, request.Retain); err != nil {
+			log.WithFields(logrus.Fields{
+				LOG_FIELD_VOLUME:   volumeName,
+				LOG_FIELD_DEST_URL: destURL,
+			}).Warnf("Failed to prune old backups: %v", err)
+		}
+	}
+
 	if request.Verbose {
 		return sendResponse(w, backup)
 	}
-	escapedURL := strings.Replace(backupURL, "&", "\\u0026", 1)
+	escapedURL := strings.Replace(backup.URL, "&", "\\u0026", 1)
 	return writeStringResponse(w, escapedURL)
 }
 
+/*
+processBackupNow creates a snapshot of volume and backs it up, holding the
+lock of volume throughout, so nothing changes the volume in between. The
+snapshot is deleted if the backup fails, since it's only taken for the
+backup. It's kept after the backup unless deleteSnapshot, so the next
+backup can be incremental from it.
+*/
+func (s *daemon) processBackupNow(volume *Volume, snapshotName string, labels map[string]string, destURL, encryptionKeyID, compression string, deleteSnapshot bool) (*api.BackupNowResponse, error) {
+	s.volumeLocks.Lock(volume.Name)
+	defer s.volumeLocks.Unlock(volume.Name)
+
+	snapshotName, err := s.createSnapshot(volume, snapshotName, labels, compression, nil)
+	if err != nil {
+		return nil, err
+	}
+	backupURL, err := s.backupSnapshot(volume.Name, snapshotName, destURL, encryptionKeyID, compression)
+	s.notifyBackup(volume.Name, snapshotName, destURL, backupURL, err)
+	if err != nil {
+		if err := s.deleteSnapshot(volume.Name, snapshotName); err != nil {
+			log.Warnf("Failed to cleanup snapshot %v after backup failure: %v", snapshotName, err)
+		}
+		return nil, err
+	}
+
+	backup := &api.BackupNowResponse{
+		URL:          backupURL,
+		SnapshotName: snapshotName,
+	}
+	if deleteSnapshot {
+		// The backup has been created, the snapshot left can be deleted by
+		// snapshot delete
+		if err := s.deleteSnapshot(volume.Name, snapshotName); err != nil {
+			log.Warnf("Failed to delete snapshot %v after backup: %v", snapshotName, err)
+		} else {
+			backup.SnapshotDeleted = true
+		}
+		return backup, nil
+	}
+	if _, err := s.enforceSnapshotRetention(volume, time.Now()); err != nil {
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_REASON: LOG_REASON_FAILURE,
+			LOG_FIELD_EVENT:  LOG_EVENT_DELETE,
+			LOG_FIELD_OBJECT: LOG_OBJECT_SNAPSHOT,
+			LOG_FIELD_VOLUME: volume.Name,
+		}).Warnf("Failed to prune snapshots by retention, would retry after the next snapshot: %v", err)
+	}
+	return backup, nil
+}
+
+// recordBackupDestination records destURL of the backups of volume, and
+// snapshotName as the base of the next backup there unless it's empty, e.g.
+// for a copied backup
+func (s *daemon) recordBackupDestination(volumeName, snapshotName, destURL string) error {
+	if destURL == "" {
+		return nil
+	}
+	return s.updateVolumeConfig(volumeName, func(config *VolumeConfig) (bool, error) {
+		changed := false
+		if snapshotName != "" && config.BackupBases[destURL] != snapshotName {
+			if config.BackupBases == nil {
+				config.BackupBases = map[string]string{}
+			}
+			config.BackupBases[destURL] = snapshotName
+			changed = true
+		}
+		for _, dest := range config.BackupDestinations {
+			if dest == destURL {
+				return changed, nil
+			}
+		}
+		config.BackupDestinations = append(config.BackupDestinations, destURL)
+		return true, nil
+	})
+}
+
+func (s *daemon) doVolumeBackups(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeBackupsRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
+	}
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+
+	backupOps, err := s.getBackupOpsForVolume(volume)
+	if err != nil {
+		return err
+	}
+	config, err := s.loadVolumeConfig(volumeName)
+	if err != nil {
+		return err
+	}
+
+	opts := map[string]string{
+		OPT_VOLUME_NAME: volumeName,
+	}
+	lists := []map[string]map[string]string{}
+	for _, dest := range config.BackupDestinations {
+		infos, err := backupOps.ListBackup(dest, opts)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				LOG_FIELD_VOLUME:   volumeName,
+				LOG_FIELD_DEST_URL: dest,
+			}).Warnf("Failed to list backups: %v", err)
+			continue
+		}
+		lists = append(lists, infos)
+	}
+
+	data, err := api.ResponseOutput(objectstore.MergeBackupLists(lists...))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
 func (s *daemon) doBackupDelete(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.BackupDeleteRequest{}
 	if err := decodeRequest(r, request); err != nil {
 		return err
 	}
-	request.URL = util.UnescapeURL(request.URL)
+	backupURL := util.UnescapeURL(request.URL)
+	if s.TrashBackups && s.trashGracePeriod != 0 && !request.Purge {
+		return s.trashBackup(backupURL)
+	}
+	return s.processBackupDelete(backupURL)
+}
 
-	backupOps, err := s.getBackupOpsForBackup(request.URL)
+// doBackupArchive moves the backup to another storage class of the
+// objectstore, which may take a while since every object is copied
+// doBackupCopy copies a backup to another objectstore, and records the
+// destination for the volume if it's managed by the daemon
+func (s *daemon) doBackupCopy(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupCopyRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.DestURL == "" {
+		return fmt.Errorf("Destination URL is required")
+	}
+	backupURL := util.UnescapeURL(request.URL)
+	destURL, err := objectstore.ApplyDestOptions(util.UnescapeURL(request.DestURL), request.Options)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL: destURL,
+	}).Debugf("Copying backup %v", backupURL)
+	copyURL, err := objectstore.CopyBackup(backupURL, destURL)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL: destURL,
+	}).Debugf("Copied backup %v", backupURL)
+
+	objVolume, err := objectstore.LoadVolume(copyURL)
+	if err != nil {
+		return err
+	}
+	if s.getVolume(objVolume.Name) != nil {
+		if err := s.recordBackupDestination(objVolume.Name, "", destURL); err != nil {
+			return err
+		}
+	}
+
+	if request.Verbose {
+		return sendResponse(w, &api.BackupURLResponse{
+			URL: copyURL,
+		})
+	}
+	escapedURL := strings.Replace(copyURL, "&", "\\u0026", 1)
+	return writeStringResponse(w, escapedURL)
+}
+
+func (s *daemon) doBackupArchive(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupArchiveRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.StorageClass == "" {
+		return fmt.Errorf("Storage class is required")
+	}
+	backupURL := util.UnescapeURL(request.URL)
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL: backupURL,
+	}).Debugf("Archiving backup to storage class %v", request.StorageClass)
+	if err := objectstore.ArchiveBackup(backupURL, request.StorageClass); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_DEST_URL: backupURL,
+	}).Debugf("Archived backup to storage class %v", request.StorageClass)
+	return nil
+}
+
+func (s *daemon) doBackupRestoreArchive(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupRestoreArchiveRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.Days == 0 {
+		request.Days = objectstore.DEFAULT_ARCHIVE_RESTORE_DAYS
+	}
+	return objectstore.RestoreArchivedBackup(util.UnescapeURL(request.URL), request.Days, request.Tier)
+}
+
+// doBackupGC removes the shared blocks of the destination no backup refers
+// to, which may take a while since every backup config is read
+func (s *daemon) doBackupGC(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupGCRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.URL == "" {
+		return fmt.Errorf("Destination URL is required")
+	}
+	result, err := objectstore.CollectSharedBlocks(util.UnescapeURL(request.URL), request.DryRun)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, &api.BackupGCResponse{
+		Backups:            result.Backups,
+		Blocks:             result.Blocks,
+		UnreferencedBlocks: result.UnreferencedBlocks,
+		RemovedBlocks:      result.RemovedBlocks,
+	})
+}
+
+// doObjectStoreGC removes the objects of the destination no backup refers
+// to, which haven't been modified for the minimum age
+func (s *daemon) doObjectStoreGC(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.ObjectStoreGCRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if request.URL == "" {
+		return fmt.Errorf("Destination URL is required")
+	}
+	minAge := objectstore.DEFAULT_GC_MIN_AGE
+	if request.MinAge != "" {
+		var err error
+		if minAge, err = time.ParseDuration(request.MinAge); err != nil || minAge < 0 {
+			return fmt.Errorf("Invalid minimum age %v, must be a non-negative duration, e.g. 24h", request.MinAge)
+		}
+	}
+	result, err := objectstore.CollectOrphans(util.UnescapeURL(request.URL), minAge, request.DryRun)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, &api.ObjectStoreGCResponse{
+		OrphanBlocks:  result.OrphanBlocks,
+		OrphanFiles:   result.OrphanFiles,
+		EmptyVolumes:  result.EmptyVolumes,
+		RecentOrphans: result.RecentOrphans,
+		Removed:       result.Removed,
+	})
+}
+
+func (s *daemon) doBackupRestoreFile(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.BackupRestoreFileRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	return s.processBackupRestoreFile(util.UnescapeURL(request.URL), request.Paths, request.To)
+}
+
+/*
+processBackupRestoreFile restores only paths from the backup, rather than the
+whole volume. Backups in files format are streamed from the objectstore and
+only paths are extracted. Other backups are restored to a temporary volume
+by the driver created them, which is deleted after paths are copied.
+*/
+func (s *daemon) processBackupRestoreFile(backupURL string, paths []string, to string) error {
+	if backupURL == "" {
+		return fmt.Errorf("backup URL is required")
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("at least one path is required")
+	}
+	cleanedPaths := []string{}
+	for _, path := range paths {
+		cleaned, err := util.CleanRelativePath(path)
+		if err != nil {
+			return err
+		}
+		cleanedPaths = append(cleanedPaths, cleaned)
+	}
+	if !filepath.IsAbs(to) {
+		return fmt.Errorf("target directory %v must be an absolute path", to)
+	}
+	if st, err := os.Stat(to); err != nil || !st.IsDir() {
+		return fmt.Errorf("target directory %v doesn't exist", to)
+	}
+
+	format, err := objectstore.GetBackupFormat(backupURL)
+	if err != nil {
+		return err
+	}
+	if format == objectstore.BACKUP_FORMAT_FILES {
+		return objectstore.ExtractFilesBackup(backupURL, cleanedPaths, to)
+	}
+
+	objVolume, err := objectstore.LoadVolume(backupURL)
+	if err != nil {
+		return err
+	}
+	volumeName, err := s.generateName()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Restoring backup %v to temporary volume %v for %v", backupURL, volumeName, cleanedPaths)
+	volume, err := s.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:       volumeName,
+		DriverName: objVolume.Driver,
+		BackupURL:  backupURL,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.processVolumeDelete(&api.VolumeDeleteRequest{
+			VolumeName: volumeName,
+			Purge:      true,
+		}); err != nil {
+			log.Errorf("Failed to delete temporary volume %v: %v", volumeName, err)
+		}
+	}()
+	return s.copyVolumePaths(volume, cleanedPaths, to)
+}
+
+// copyVolumePaths copies paths in volume to directory to, the volume is
+// mounted for the copy
+func (s *daemon) copyVolumePaths(volume *Volume, paths []string, to string) error {
+	s.volumeLocks.Lock(volume.Name)
+	defer s.volumeLocks.Unlock(volume.Name)
+
+	mountPoint, err := s.mountVolume(volume, &api.VolumeMountRequest{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := s.umountVolume(volume); err != nil {
+			log.Errorf("Failed to umount volume %v: %v", volume.Name, err)
+		}
+	}()
+	return util.CopyPaths(mountPoint, paths, to)
+}
+
+func (s *daemon) processBackupDelete(backupURL string) error {
+	backupOps, err := s.getBackupOpsForBackup(backupURL)
 	if err != nil {
 		return err
 	}
@@ -161,19 +708,51 @@ func (s *daemon) doBackupDelete(version string, w http.ResponseWriter, r *http.R
 		LOG_FIELD_REASON:   LOG_REASON_PREPARE,
 		LOG_FIELD_EVENT:    LOG_EVENT_REMOVE,
 		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
-		LOG_FIELD_DEST_URL: request.URL,
+		LOG_FIELD_DEST_URL: backupURL,
 		LOG_FIELD_DRIVER:   backupOps.Name(),
 	}).Debug()
-	if err := backupOps.DeleteBackup(request.URL); err != nil {
+	if err := backupOps.DeleteBackup(backupURL); err != nil {
 		return err
 	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
 		LOG_FIELD_EVENT:    LOG_EVENT_REMOVE,
 		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
-		LOG_FIELD_DEST_URL: request.URL,
+		LOG_FIELD_DEST_URL: backupURL,
 		LOG_FIELD_DRIVER:   backupOps.Name(),
 	}).Debug()
+	volumeName, _ := objectstore.GetBackupVolumeName(backupURL)
+	s.notifier.notify(&api.EventResponse{
+		Event:     EVENT_BACKUP_DELETE,
+		Volume:    volumeName,
+		BackupURL: backupURL,
+	})
+	return nil
+}
+
+// processBackupPrune deletes the oldest backups of the volume in destURL, so
+// only the latest retain backups, including backupURL just created, are kept
+func (s *daemon) processBackupPrune(volumeName, destURL, backupURL string, retain int) error {
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+	backupOps, err := s.getBackupOpsForVolume(volume)
+	if err != nil {
+		return err
+	}
+	// List only once, since it can take a while with lots of backups
+	infos, err := backupOps.ListBackup(destURL, map[string]string{
+		OPT_VOLUME_NAME: volumeName,
+	})
+	if err != nil {
+		return err
+	}
+	for _, url := range objectstore.BackupsToPrune(infos, backupURL, retain) {
+		if err := s.processBackupDelete(url); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,380 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestBackupPrune(c *C) {
+	d := s.newVFSDaemon(c)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	destURL := "vfs://" + dest
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	volume := d.getVolume("vol1")
+
+	backupURL := ""
+	for i := 0; i < 3; i++ {
+		snapshotName, err := d.processSnapshotCreate(volume, "", nil, "", nil)
+		c.Assert(err, IsNil)
+		backupURL, err = d.processBackupCreate(snapshotName, destURL, "", "")
+		c.Assert(err, IsNil)
+	}
+	c.Assert(d.processBackupPrune("vol1", destURL, backupURL, 2), IsNil)
+
+	backupOps, err := d.getBackupOpsForVolume(volume)
+	c.Assert(err, IsNil)
+	infos, err := backupOps.ListBackup(destURL, map[string]string{
+		OPT_VOLUME_NAME: "vol1",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 2)
+	c.Assert(infos[backupURL], NotNil)
+
+	c.Assert(d.processBackupPrune("nonexistent", destURL, backupURL, 2), ErrorMatches, "volume nonexistent doesn't exist")
+}
+
+func (s *TestSuite) TestBackupEncryption(c *C) {
+	d := s.newVFSDaemon(c)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	destURL := "vfs://" + dest
+
+	key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("ef", objectstore.ENCRYPTION_KEY_SIZE)))
+	keyID, err := d.getBackupEncryptionKey(key, "")
+	c.Assert(err, IsNil)
+	// The key is only kept in memory
+	_, err = os.Stat(d.getEncryptionKeysDir())
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = d.getBackupEncryptionKey(key, "kms-key")
+	c.Assert(err, ErrorMatches, "Cannot specify both.*")
+	_, err = d.addEncryptionKey("not base64")
+	c.Assert(err, ErrorMatches, "Invalid encryption key, must be in base64.*")
+
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "data"), []byte("data"), 0644), IsNil)
+	snapshotName, err := d.processSnapshotCreate(d.getVolume("vol1"), "", nil, "", nil)
+	c.Assert(err, IsNil)
+	backupURL, err := d.processBackupCreate(snapshotName, destURL, keyID, "")
+	c.Assert(err, IsNil)
+
+	info, err := objectstore.GetBackupInfo(backupURL)
+	c.Assert(err, IsNil)
+	c.Assert(info["EncryptionKeyID"], Equals, keyID)
+
+	// As if the daemon restarted, the key must be provided again
+	objectstore.RemoveEncryptionKey(keyID)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:      "vol2",
+		BackupURL: backupURL,
+	})
+	c.Assert(err, ErrorMatches, ".*Cannot find encryption key "+keyID+".*")
+	_, err = d.addEncryptionKey(key)
+	c.Assert(err, IsNil)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:      "vol2",
+		BackupURL: backupURL,
+	})
+	c.Assert(err, IsNil)
+
+	// Encrypted backup is decrypted while being extracted
+	to := filepath.Join(s.root, "restored")
+	c.Assert(os.Mkdir(to, 0700), IsNil)
+	c.Assert(d.processBackupRestoreFile(backupURL, []string{"data"}, to), IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(to, "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+}
+
+// fakeKMS wraps keys by reversing them after the KMS key ID
+type fakeKMS struct {
+	generated int
+	decrypted int
+}
+
+func (k *fakeKMS) GenerateDataKey(kmsKeyID string) ([]byte, []byte, error) {
+	k.generated++
+	key := make([]byte, objectstore.ENCRYPTION_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := k.reverse(kmsKeyID, append([]byte(kmsKeyID), key...))
+	return key, wrapped, err
+}
+
+func (k *fakeKMS) Decrypt(kmsKeyID string, wrapped []byte) ([]byte, error) {
+	k.decrypted++
+	data, err := k.reverse(kmsKeyID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(string(data), kmsKeyID) {
+		return nil, fmt.Errorf("key is not wrapped by %v", kmsKeyID)
+	}
+	return data[len(kmsKeyID):], nil
+}
+
+func (k *fakeKMS) reverse(kmsKeyID string, data []byte) ([]byte, error) {
+	if kmsKeyID == "" {
+		return nil, fmt.Errorf("no KMS key")
+	}
+	result := make([]byte, len(data))
+	for i := range data {
+		result[len(data)-1-i] = data[i]
+	}
+	return result, nil
+}
+
+func (s *TestSuite) TestBackupKMSEncryption(c *C) {
+	kms := &fakeKMS{}
+	defer objectstore.SetKMS(objectstore.SetKMS(kms))
+
+	d := s.newVFSDaemon(c)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	destURL := "vfs://" + dest
+
+	keyID, err := d.getBackupEncryptionKey("", "kms-key")
+	c.Assert(err, IsNil)
+	// Only the wrapped key is kept, and reused for later backups
+	files, err := ioutil.ReadDir(d.getEncryptionKeysDir())
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	data, err := ioutil.ReadFile(filepath.Join(d.getEncryptionKeysDir(), files[0].Name()))
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), keyID), Equals, true)
+	c.Assert(d.loadEncryptionKeys(), IsNil)
+	id, err := d.getBackupEncryptionKey("", "kms-key")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, keyID)
+	c.Assert(kms.generated, Equals, 1)
+
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "data"), []byte("data"), 0644), IsNil)
+	snapshotName, err := d.processSnapshotCreate(d.getVolume("vol1"), "", nil, "", nil)
+	c.Assert(err, IsNil)
+	backupURL, err := d.processBackupCreate(snapshotName, destURL, keyID, "")
+	c.Assert(err, IsNil)
+
+	// The backup carries the wrapped key, which is unwrapped by KMS to
+	// restore it without the key
+	objectstore.RemoveEncryptionKey(keyID)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:      "vol2",
+		BackupURL: backupURL,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(kms.decrypted, Equals, 1)
+	mountPoint, err = d.processVolumeMount(d.getVolume("vol2"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(filepath.Join(mountPoint, "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+}
+
+func (s *TestSuite) TestBackupRestoreFile(c *C) {
+	d := s.newVFSDaemon(c)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(mountPoint, "etc", "app"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "etc", "app.conf"), []byte("conf"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "etc", "app", "extra.conf"), []byte("extra"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "data"), []byte("data"), 0644), IsNil)
+	snapshotName, err := d.processSnapshotCreate(d.getVolume("vol1"), "", nil, "", nil)
+	c.Assert(err, IsNil)
+	backupURL, err := d.processBackupCreate(snapshotName, "vfs://"+dest, "", "")
+	c.Assert(err, IsNil)
+
+	to := filepath.Join(s.root, "restored")
+	c.Assert(os.Mkdir(to, 0700), IsNil)
+	c.Assert(d.processBackupRestoreFile(backupURL, []string{"etc/app.conf", "/etc/app/"}, to), ErrorMatches, "Invalid path /etc/app/.*")
+	c.Assert(d.processBackupRestoreFile(backupURL, []string{"etc/app.conf", "etc/app/"}, to), IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(to, "etc", "app.conf"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "conf")
+	data, err = ioutil.ReadFile(filepath.Join(to, "etc", "app", "extra.conf"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "extra")
+	_, err = os.Stat(filepath.Join(to, "data"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(d.processBackupRestoreFile(backupURL, []string{"../data"}, to), ErrorMatches, "Invalid path ../data.*")
+	c.Assert(d.processBackupRestoreFile(backupURL, []string{"nonexistent"}, to), ErrorMatches, "(?s).*nonexistent: Not found in archive.*")
+	c.Assert(d.processBackupRestoreFile(backupURL, []string{"data"}, "restored"), ErrorMatches, "target directory restored must be an absolute path")
+}
+
+func (s *TestSuite) TestBackupCopy(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	src := "vfs://" + filepath.Join(s.root, "backups")
+	dest := "vfs://" + filepath.Join(s.root, "replica")
+	c.Assert(os.Mkdir(filepath.Join(s.root, "backups"), 0700), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(s.root, "replica"), 0700), IsNil)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	snapshotName, err := d.processSnapshotCreate(d.getVolume("vol1"), "", nil, "", nil)
+	c.Assert(err, IsNil)
+	backupURL, err := d.processBackupCreate(snapshotName, src, "", "")
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/v1/backups/copy", &api.BackupCopyRequest{URL: backupURL})
+	c.Assert(w.Code, Not(Equals), http.StatusOK)
+	w = s.serveRequest(c, router, "POST", "/v1/backups/copy", &api.BackupCopyRequest{
+		URL:     backupURL,
+		DestURL: dest,
+		Verbose: true,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	result := &api.BackupURLResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), result), IsNil)
+	c.Assert(result.URL, Equals, strings.Replace(backupURL, src, dest, 1))
+
+	// The copy is listed with the backups of the volume
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.BackupDestinations, DeepEquals, []string{src, dest})
+	info, err := objectstore.GetBackupInfo(result.URL)
+	c.Assert(err, IsNil)
+	c.Assert(info["SnapshotName"], Equals, snapshotName)
+}
+
+func (s *TestSuite) TestBackupNow(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	destURL := "vfs://" + dest
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/v1/backups/now", &api.BackupNowRequest{
+		VolumeName:   "vol1",
+		URL:          destURL,
+		SnapshotName: "snap1",
+		Verbose:      true,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	result := &api.BackupNowResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), result), IsNil)
+	c.Assert(result.SnapshotName, Equals, "snap1")
+	c.Assert(result.SnapshotDeleted, Equals, false)
+	info, err := objectstore.GetBackupInfo(result.URL)
+	c.Assert(err, IsNil)
+	c.Assert(info["SnapshotName"], Equals, "snap1")
+	// The snapshot is kept for the next backup by default
+	c.Assert(d.SnapshotVolumeIndex.Get("snap1"), Equals, "vol1")
+
+	w = s.serveRequest(c, router, "POST", "/v1/backups/now", &api.BackupNowRequest{
+		VolumeName:     "vol1",
+		URL:            destURL,
+		DeleteSnapshot: true,
+		Verbose:        true,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	result = &api.BackupNowResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), result), IsNil)
+	c.Assert(result.SnapshotName, Not(Equals), "")
+	c.Assert(result.SnapshotDeleted, Equals, true)
+	c.Assert(d.SnapshotVolumeIndex.Get(result.SnapshotName), Equals, "")
+	_, err = objectstore.GetBackupInfo(result.URL)
+	c.Assert(err, IsNil)
+
+	// The snapshot is deleted if the backup fails
+	w = s.serveRequest(c, router, "POST", "/v1/backups/now", &api.BackupNowRequest{
+		VolumeName:   "vol1",
+		URL:          "vfs://" + filepath.Join(s.root, "nonexistent"),
+		SnapshotName: "snap3",
+	})
+	c.Assert(w.Code, Not(Equals), http.StatusOK)
+	c.Assert(d.SnapshotVolumeIndex.Get("snap3"), Equals, "")
+	names := []string{}
+	for _, event := range s.listEvents(c, router, "volume=vol1") {
+		names = append(names, event.Event)
+	}
+	c.Assert(names, DeepEquals, []string{EVENT_VOLUME_CREATE,
+		EVENT_SNAPSHOT_CREATE, EVENT_BACKUP_COMPLETE,
+		EVENT_SNAPSHOT_CREATE, EVENT_BACKUP_COMPLETE, EVENT_SNAPSHOT_DELETE,
+		EVENT_SNAPSHOT_CREATE, EVENT_BACKUP_FAILED, EVENT_SNAPSHOT_DELETE})
+
+	w = s.serveRequest(c, router, "POST", "/v1/backups/now", &api.BackupNowRequest{
+		VolumeName: "nonexistent",
+		URL:        destURL,
+	})
+	s.assertError(c, w, api.ERROR_CODE_NOT_FOUND, "volume nonexistent doesn't exist")
+}
+
+func (s *TestSuite) TestBackupGC(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/v1/backups/gc", &api.BackupGCRequest{})
+	c.Assert(w.Code, Not(Equals), http.StatusOK)
+	w = s.serveRequest(c, router, "POST", "/v1/backups/gc", &api.BackupGCRequest{URL: "vfs://" + dest, DryRun: true})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	result := &api.BackupGCResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), result), IsNil)
+	c.Assert(*result, Equals, api.BackupGCResponse{})
+}
+
+func (s *TestSuite) TestObjectStoreGC(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	snapshotName, err := d.processSnapshotCreate(d.getVolume("vol1"), "", nil, "", nil)
+	c.Assert(err, IsNil)
+	_, err = d.processBackupCreate(snapshotName, "vfs://"+dest, "", "")
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/v1/objectstore/gc", &api.ObjectStoreGCRequest{URL: "vfs://" + dest, MinAge: "-1h"})
+	c.Assert(w.Code, Not(Equals), http.StatusOK)
+	w = s.serveRequest(c, router, "POST", "/v1/objectstore/gc", &api.ObjectStoreGCRequest{URL: "vfs://" + dest, MinAge: "0s"})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	result := &api.ObjectStoreGCResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), result), IsNil)
+	c.Assert(result, DeepEquals, &api.ObjectStoreGCResponse{
+		OrphanFiles:  []string{},
+		EmptyVolumes: []string{},
+	})
+}
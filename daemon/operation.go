@@ -0,0 +1,240 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	MIN_OPERATIONS_WATCH_INTERVAL = time.Second
+)
+
+// Routes not tracked as operations, since they're polled for monitoring or
+// stream for long
+var untrackedRoutes = map[string]bool{
+	"/health":     true,
+	"/metrics":    true,
+	"/operations": true,
+	"/events":     true,
+}
+
+// Fields of requests naming what the operation is on, in the order of
+// preference
+var operationTargetFields = []string{"VolumeName", "SnapshotName", "BackupURL", "URL", "Name"}
+
+/*
+operationTracker tracks the operations in progress, so operators can find
+out what a daemon seemingly stuck is doing: API requests, Docker plugin
+requests changing volumes, jobs, and runs of schedules and policies. The zero
+value is ready to use.
+*/
+type operationTracker struct {
+	mutex      sync.Mutex
+	operations map[string]*operation
+}
+
+type operation struct {
+	api.OperationResponse
+	started time.Time
+}
+
+// start records the operation until finish() is called for it
+func (t *operationTracker) start(name, target, requester string) *operation {
+	now := time.Now()
+	op := &operation{
+		OperationResponse: api.OperationResponse{
+			ID:          util.NewUUID(),
+			Operation:   name,
+			Target:      target,
+			Requester:   requester,
+			StartedTime: now.Format(time.RubyDate),
+		},
+		started: now,
+	}
+	t.mutex.Lock()
+	if t.operations == nil {
+		t.operations = make(map[string]*operation)
+	}
+	t.operations[op.ID] = op
+	t.mutex.Unlock()
+	return op
+}
+
+func (t *operationTracker) finish(op *operation) {
+	t.mutex.Lock()
+	delete(t.operations, op.ID)
+	t.mutex.Unlock()
+}
+
+// setJobID records the job the operation runs as
+func (t *operationTracker) setJobID(op *operation, jobID string) {
+	t.mutex.Lock()
+	op.JobID = jobID
+	t.mutex.Unlock()
+}
+
+// list returns the operations in progress, oldest first
+func (t *operationTracker) list(now time.Time) []api.OperationResponse {
+	t.mutex.Lock()
+	ops := []operation{}
+	for _, op := range t.operations {
+		ops = append(ops, *op)
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].started.Equal(ops[j].started) {
+			return ops[i].ID < ops[j].ID
+		}
+		return ops[i].started.Before(ops[j].started)
+	})
+	result := []api.OperationResponse{}
+	for _, op := range ops {
+		resp := op.OperationResponse
+		resp.Duration = formatDuration(now.Sub(op.started))
+		result = append(result, resp)
+	}
+	return result
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// requestTarget returns what the request of body is on, empty if it cannot
+// be told
+func requestTarget(body []byte) string {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ""
+	}
+	for _, name := range operationTargetFields {
+		if value, ok := fields[name].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// readRequestBody returns the body of r, which is kept for the handler
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// operationHandlerFunc tracks the requests to route handled by next as
+// operations
+func (s *daemon) operationHandlerFunc(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := readRequestBody(r)
+		if err != nil {
+			writeError(w, api.NewError(api.ERROR_CODE_INVALID_REQUEST, "%v", err), 0)
+			return
+		}
+		op := s.operations.start(name, requestTarget(body), getRequester(r))
+		defer s.operations.finish(op)
+		next(w, r)
+	}
+}
+
+// getOperations returns the activity of daemon at now. Throughput of backups
+// is averaged since last at lastTime, or since they started if they're not
+// in last.
+func (s *daemon) getOperations(now time.Time, last *api.OperationsResponse, lastTime time.Time) *api.OperationsResponse {
+	lastUploaded := map[string]int64{}
+	if last != nil {
+		for _, b := range last.Backups {
+			lastUploaded[b.Name] = b.UploadedBytes
+		}
+	}
+	backups := []api.BackupProgressResponse{}
+	for _, p := range objectstore.ListBackupProgress() {
+		since := p.StartedTime
+		uploaded := p.UploadedBytes
+		if last, exists := lastUploaded[p.Name]; exists {
+			since = lastTime
+			uploaded -= last
+		}
+		var throughput int64
+		if elapsed := now.Sub(since).Seconds(); elapsed > 0 {
+			throughput = int64(float64(uploaded) / elapsed)
+		}
+		backups = append(backups, api.BackupProgressResponse{
+			Name:          p.Name,
+			Volume:        p.VolumeName,
+			DestURL:       p.DestURL,
+			StartedTime:   p.StartedTime.Format(time.RubyDate),
+			Duration:      formatDuration(now.Sub(p.StartedTime)),
+			TotalBlocks:   p.TotalBlocks,
+			DoneBlocks:    p.DoneBlocks,
+			UploadedBytes: p.UploadedBytes,
+			Throughput:    throughput,
+		})
+	}
+	return &api.OperationsResponse{
+		Time:       now.Format(time.RubyDate),
+		Operations: s.operations.list(now),
+		Backups:    backups,
+		Locks:      s.volumeLocks.list(now),
+	}
+}
+
+// doOperations responds the activity of daemon, or keeps streaming it as
+// JSON objects every interval asked by "watch" until the client goes away
+func (s *daemon) doOperations(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	value := r.URL.Query().Get(api.KEY_WATCH)
+	if value == "" {
+		return writeResponseOutput(w, s.getOperations(time.Now(), nil, time.Time{}))
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Invalid watch interval %v: %v", value, err)
+	}
+	if interval < MIN_OPERATIONS_WATCH_INTERVAL {
+		return api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Invalid watch interval %v, must be at least %v",
+			value, MIN_OPERATIONS_WATCH_INTERVAL)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var (
+		last     *api.OperationsResponse
+		lastTime time.Time
+	)
+	for {
+		now := time.Now()
+		last = s.getOperations(now, last, lastTime)
+		lastTime = now
+		if err := encoder.Encode(last); err != nil {
+			// Client has gone away
+			return nil
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
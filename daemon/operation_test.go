@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) getOperations(c *C, router http.Handler) *api.OperationsResponse {
+	w := s.serveRequest(c, router, "GET", "/operations", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	resp := &api.OperationsResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), resp), IsNil)
+	return resp
+}
+
+func (s *TestSuite) TestOperations(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	// The job would wait for the lock of volume
+	d.volumeLocks.Lock("vol1")
+	w := s.serveRequest(c, router, "POST", "/snapshots/create?async=true", &api.SnapshotCreateRequest{
+		Name:       "snap1",
+		VolumeName: "vol1",
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	job := &api.JobResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), job), IsNil)
+
+	var resp *api.OperationsResponse
+	for i := 0; i < 100; i++ {
+		resp = s.getOperations(c, router)
+		if len(resp.Locks) == 1 && resp.Locks[0].Waiters == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(resp.Operations, HasLen, 1)
+	c.Assert(resp.Operations[0].Operation, Equals, "snapshot create")
+	c.Assert(resp.Operations[0].Target, Equals, "vol1")
+	c.Assert(resp.Operations[0].JobID, Equals, job.ID)
+	c.Assert(resp.Locks, HasLen, 1)
+	c.Assert(resp.Locks[0].Volume, Equals, "vol1")
+	c.Assert(resp.Locks[0].HeldSince, Not(Equals), "")
+	c.Assert(resp.Locks[0].Waiters, Equals, 1)
+	c.Assert(resp.Backups, HasLen, 0)
+
+	d.volumeLocks.Unlock("vol1")
+	job = s.waitJob(c, router, job.ID)
+	c.Assert(job.Status, Equals, api.JOB_STATUS_SUCCEEDED)
+	for i := 0; i < 100; i++ {
+		resp = s.getOperations(c, router)
+		if len(resp.Operations) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(resp.Operations, HasLen, 0)
+	c.Assert(resp.Locks, HasLen, 0)
+}
+
+func (s *TestSuite) TestOperationsWatch(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	w := s.serveRequest(c, router, "GET", "/operations?watch=10ms", nil)
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, "Invalid watch interval 10ms, must be at least 1s")
+	w = s.serveRequest(c, router, "GET", "/operations?watch=soon", nil)
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, "Invalid watch interval soon: .*")
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/v1/operations?watch=1s")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	decoder := json.NewDecoder(resp.Body)
+	for i := 0; i < 2; i++ {
+		update := &api.OperationsResponse{}
+		c.Assert(decoder.Decode(update), IsNil)
+		c.Assert(update.Time, Not(Equals), "")
+		c.Assert(update.Operations, HasLen, 0)
+	}
+}
+
+func (s *TestSuite) TestRequestTarget(c *C) {
+	c.Assert(requestTarget([]byte(`{"Name":"snap1","VolumeName":"vol1"}`)), Equals, "vol1")
+	c.Assert(requestTarget([]byte(`{"URL":"s3://bucket@us-west-2/","SnapshotName":"snap1"}`)), Equals, "snap1")
+	c.Assert(requestTarget([]byte(`{"Name":"vol2"}`)), Equals, "vol2")
+	c.Assert(requestTarget([]byte(`{"VolumeName":""}`)), Equals, "")
+	c.Assert(requestTarget(nil), Equals, "")
+}
@@ -0,0 +1,369 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	POLICY_CFG_PREFIX = "policy_"
+)
+
+/*
+BackupPolicy selects volumes by labels instead of names. Policies are run
+along with snapshot schedules, and every volume whose labels contain all the
+key/value pairs of Selector would be snapshotted and backed up to URL at the
+times specified by the cron expression, or the first time it's selected. Only
+the latest Retain backups (and the snapshots they were made of) created by the
+policy would be kept, if Retain is not zero.
+*/
+type BackupPolicy struct {
+	Name     string
+	Selector map[string]string
+	Cron     string
+	URL      string
+	Retain   int
+	Volumes  map[string]*PolicyVolumeState
+
+	configPath string
+}
+
+// PolicyVolumeState records what a policy has done to a volume
+type PolicyVolumeState struct {
+	LastRun string
+	Backups []PolicyBackup
+}
+
+type PolicyBackup struct {
+	SnapshotName string
+	BackupURL    string
+}
+
+func (p *BackupPolicy) ConfigFile() (string, error) {
+	if p.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty policy name")
+	}
+	if p.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty policy config path")
+	}
+	return filepath.Join(p.configPath, POLICY_CFG_PREFIX+p.Name+CFG_POSTFIX), nil
+}
+
+func (s *daemon) blankPolicy(name string) *BackupPolicy {
+	return &BackupPolicy{
+		Name:       name,
+		configPath: s.Root,
+	}
+}
+
+func (s *daemon) listPolicies() ([]*BackupPolicy, error) {
+	names, err := s.listObjectNames(POLICY_CFG_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	policies := []*BackupPolicy{}
+	for _, name := range names {
+		policy := s.blankPolicy(name)
+		if err := s.loadObject(policy); err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func selectorMatches(selector, labels map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for key, value := range selector {
+		if v, exists := labels[key]; !exists || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *daemon) doPolicyCreate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.PolicyCreateRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if err := util.CheckName(request.Name); err != nil {
+		return err
+	}
+	if len(request.Selector) == 0 {
+		return fmt.Errorf("Policy %v must have a label selector", request.Name)
+	}
+	if _, err := parseCron(request.Cron); err != nil {
+		return err
+	}
+	if request.URL == "" {
+		return fmt.Errorf("Policy %v must have a backup destination", request.Name)
+	}
+	if request.Retain < 0 {
+		return fmt.Errorf("Invalid retain count %v of policy %v", request.Retain, request.Name)
+	}
+
+	s.policyLock.Lock()
+	defer s.policyLock.Unlock()
+
+	policy := s.blankPolicy(request.Name)
+	exists, err := s.objectExists(policy)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return api.NewError(api.ERROR_CODE_CONFLICT, "Policy %v already exists", request.Name).WithDetail("policy", request.Name)
+	}
+	policy.Selector = request.Selector
+	policy.Cron = request.Cron
+	policy.URL = util.UnescapeURL(request.URL)
+	policy.Retain = request.Retain
+	policy.Volumes = make(map[string]*PolicyVolumeState)
+	if err := s.saveObject(policy); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_POLICY,
+		LOG_FIELD_POLICY: policy.Name,
+	}).Debug()
+	return writeResponseOutput(w, policy)
+}
+
+func (s *daemon) doPolicyList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	s.policyLock.Lock()
+	defer s.policyLock.Unlock()
+
+	policies, err := s.listPolicies()
+	if err != nil {
+		return err
+	}
+	result := make(map[string]*BackupPolicy)
+	for _, policy := range policies {
+		result[policy.Name] = policy
+	}
+	return writeResponseOutput(w, result)
+}
+
+func (s *daemon) doPolicyDelete(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.PolicyDeleteRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if err := util.CheckName(request.Name); err != nil {
+		return err
+	}
+
+	s.policyLock.Lock()
+	defer s.policyLock.Unlock()
+
+	policy := s.blankPolicy(request.Name)
+	exists, err := s.objectExists(policy)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return api.NewError(api.ERROR_CODE_NOT_FOUND, "Policy %v doesn't exist", request.Name).WithDetail("policy", request.Name)
+	}
+	// Backups and snapshots created by the policy are left as they are
+	if err := s.deleteObject(policy); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_DELETE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_POLICY,
+		LOG_FIELD_POLICY: policy.Name,
+	}).Debug()
+	return nil
+}
+
+func (s *daemon) runPolicies(now time.Time) {
+	// The lock is only held to load and save policies rather than while
+	// backing up volumes, so policies can be listed and changed meanwhile
+	s.policyLock.Lock()
+	policies, err := s.listPolicies()
+	s.policyLock.Unlock()
+	if err != nil {
+		log.Errorf("Failed to list backup policies: %v", err)
+		return
+	}
+	for _, policy := range policies {
+		if err := s.runPolicy(policy, now); err != nil {
+			log.WithFields(logrus.Fields{
+				LOG_FIELD_REASON: LOG_REASON_FAILURE,
+				LOG_FIELD_OBJECT: LOG_OBJECT_POLICY,
+				LOG_FIELD_POLICY: policy.Name,
+			}).Errorf("Failed to run backup policy: %v", err)
+		}
+	}
+}
+
+// runPolicy evaluates the selector against current volumes, so volumes
+// labeled after the policy was created would be covered as well
+func (s *daemon) runPolicy(policy *BackupPolicy, now time.Time) error {
+	cron, err := parseCron(policy.Cron)
+	if err != nil {
+		return err
+	}
+	if policy.Volumes == nil {
+		policy.Volumes = make(map[string]*PolicyVolumeState)
+	}
+
+	volumeNames := []string{}
+	for name := range s.getVolumeList() {
+		volumeNames = append(volumeNames, name)
+	}
+	sort.Strings(volumeNames)
+
+	for _, volumeName := range volumeNames {
+		config, err := s.loadVolumeConfig(volumeName)
+		if err != nil {
+			return err
+		}
+		if !selectorMatches(policy.Selector, config.Labels) {
+			continue
+		}
+		state := policy.Volumes[volumeName]
+		if state == nil {
+			state = &PolicyVolumeState{}
+			policy.Volumes[volumeName] = state
+		}
+		// Volume selected the first time is backed up right away
+		if state.LastRun != "" {
+			lastRun, err := time.Parse(time.RubyDate, state.LastRun)
+			if err == nil && !cron.due(lastRun, now) {
+				continue
+			}
+		}
+
+		if err := s.runPolicyForVolume(policy, volumeName, state); err != nil {
+			log.WithFields(logrus.Fields{
+				LOG_FIELD_REASON: LOG_REASON_FAILURE,
+				LOG_FIELD_EVENT:  LOG_EVENT_BACKUP,
+				LOG_FIELD_OBJECT: LOG_OBJECT_POLICY,
+				LOG_FIELD_POLICY: policy.Name,
+				LOG_FIELD_VOLUME: volumeName,
+			}).Errorf("Failed to backup volume: %v", err)
+			continue
+		}
+		// The backup is recorded before pruning, so it wouldn't be taken
+		// again if pruning fails
+		state.LastRun = now.Format(time.RubyDate)
+		exists, err := s.savePolicyVolumeState(policy.Name, volumeName, state)
+		if err != nil || !exists {
+			return err
+		}
+		if policy.Retain == 0 || len(state.Backups) <= policy.Retain {
+			continue
+		}
+		s.prunePolicyBackups(policy, volumeName, state)
+		if exists, err := s.savePolicyVolumeState(policy.Name, volumeName, state); err != nil || !exists {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+savePolicyVolumeState saves what policy has done to the volume. The rest of
+the policy is kept as it is, since it may have been changed while the volume
+was being backed up. Nothing is saved if the policy has been deleted
+meanwhile, and false is returned.
+*/
+func (s *daemon) savePolicyVolumeState(policyName, volumeName string, state *PolicyVolumeState) (bool, error) {
+	s.policyLock.Lock()
+	defer s.policyLock.Unlock()
+
+	policy := s.blankPolicy(policyName)
+	exists, err := s.objectExists(policy)
+	if err != nil || !exists {
+		return false, err
+	}
+	if err := s.loadObject(policy); err != nil {
+		return false, err
+	}
+	if policy.Volumes == nil {
+		policy.Volumes = make(map[string]*PolicyVolumeState)
+	}
+	policy.Volumes[volumeName] = state
+	return true, s.saveObject(policy)
+}
+
+func (s *daemon) runPolicyForVolume(policy *BackupPolicy, volumeName string, state *PolicyVolumeState) error {
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_POLICY,
+		LOG_FIELD_POLICY:   policy.Name,
+		LOG_FIELD_VOLUME:   volumeName,
+		LOG_FIELD_DEST_URL: policy.URL,
+	}).Debug()
+	op := s.operations.start("policy "+policy.Name, volumeName, "")
+	defer s.operations.finish(op)
+	snapshotName, err := s.processSnapshotCreate(volume, "", nil, "", nil)
+	if err != nil {
+		return err
+	}
+	backupURL, err := s.processBackupCreate(snapshotName, policy.URL, "", "")
+	if err != nil {
+		if err := s.processSnapshotDelete(snapshotName); err != nil {
+			log.Warnf("Failed to cleanup snapshot %v after backup failure: %v", snapshotName, err)
+		}
+		return err
+	}
+	state.Backups = append(state.Backups, PolicyBackup{
+		SnapshotName: snapshotName,
+		BackupURL:    backupURL,
+	})
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_POLICY,
+		LOG_FIELD_POLICY:   policy.Name,
+		LOG_FIELD_VOLUME:   volumeName,
+		LOG_FIELD_SNAPSHOT: snapshotName,
+		LOG_FIELD_DEST_URL: backupURL,
+	}).Debug()
+	return nil
+}
+
+// prunePolicyBackups deletes the backups of volume out of the retain count of
+// policy, and the snapshots they were made of. The ones failed to be deleted
+// are kept in state and retried next time.
+func (s *daemon) prunePolicyBackups(policy *BackupPolicy, volumeName string, state *PolicyVolumeState) {
+	count := len(state.Backups) - policy.Retain
+	kept := []PolicyBackup{}
+	for _, backup := range state.Backups[:count] {
+		if err := s.processBackupDelete(backup.BackupURL); err != nil {
+			log.Warnf("Failed to remove backup %v of volume %v by policy %v: %v", backup.BackupURL, volumeName, policy.Name, err)
+			kept = append(kept, backup)
+			continue
+		}
+		// The snapshot may have been deleted by user
+		if s.SnapshotVolumeIndex.Get(backup.SnapshotName) != "" {
+			if err := s.processSnapshotDelete(backup.SnapshotName); err != nil {
+				log.Warnf("Failed to remove snapshot %v of volume %v by policy %v: %v", backup.SnapshotName, volumeName, policy.Name, err)
+			}
+		}
+	}
+	state.Backups = append(kept, state.Backups[count:]...)
+}
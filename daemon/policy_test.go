@@ -0,0 +1,171 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+	"github.com/rancher/convoy/vfs"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) newVFSDaemon(c *C) *daemon {
+	d := s.newDaemon(DRIVER_INIT_MODE_STRICT, vfs.KIND)
+	c.Assert(d.initDrivers(map[string]string{
+		vfs.VFS_PATH: filepath.Join(s.root, "volumes"),
+	}), IsNil)
+	c.Assert(d.finializeInitialization(), IsNil)
+	return d
+}
+
+func (s *TestSuite) createPolicy(c *C, d *daemon, name string, selector map[string]string, retain int) string {
+	dest := filepath.Join(s.root, "backups-"+name)
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	policy := d.blankPolicy(name)
+	policy.Selector = selector
+	policy.Cron = "@daily"
+	policy.URL = "vfs://" + dest
+	policy.Retain = retain
+	c.Assert(util.ObjectSave(policy), IsNil)
+	return policy.URL
+}
+
+func (s *TestSuite) loadPolicy(c *C, d *daemon, name string) *BackupPolicy {
+	policy := d.blankPolicy(name)
+	c.Assert(util.ObjectLoad(policy), IsNil)
+	return policy
+}
+
+func (s *TestSuite) TestSelectorMatches(c *C) {
+	labels := map[string]string{"backup": "daily", "team": "web"}
+	c.Assert(selectorMatches(map[string]string{"backup": "daily"}, labels), Equals, true)
+	c.Assert(selectorMatches(map[string]string{"backup": "daily", "team": "web"}, labels), Equals, true)
+	c.Assert(selectorMatches(map[string]string{"backup": "weekly"}, labels), Equals, false)
+	c.Assert(selectorMatches(map[string]string{"env": "prod"}, labels), Equals, false)
+	c.Assert(selectorMatches(map[string]string{}, labels), Equals, false)
+}
+
+func (s *TestSuite) TestPolicyPicksUpNewlyLabeledVolume(c *C) {
+	d := s.newVFSDaemon(c)
+	s.createPolicy(c, d, "daily", map[string]string{"backup": "daily"}, 0)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:   "vol1",
+		Labels: map[string]string{"backup": "daily"},
+	})
+	c.Assert(err, IsNil)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "unlabeled",
+	})
+	c.Assert(err, IsNil)
+
+	now := time.Date(2016, time.March, 4, 10, 7, 0, 0, time.Local)
+	d.runPolicies(now)
+	policy := s.loadPolicy(c, d, "daily")
+	c.Assert(policy.Volumes, HasLen, 1)
+	c.Assert(policy.Volumes["vol1"].Backups, HasLen, 1)
+
+	// A volume labeled after the policy was created is covered as well
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:   "vol2",
+		Labels: map[string]string{"backup": "daily", "team": "web"},
+	})
+	c.Assert(err, IsNil)
+
+	d.runPolicies(now.Add(time.Hour))
+	policy = s.loadPolicy(c, d, "daily")
+	c.Assert(policy.Volumes, HasLen, 2)
+	c.Assert(policy.Volumes["vol2"].Backups, HasLen, 1)
+	// Not due yet
+	c.Assert(policy.Volumes["vol1"].Backups, HasLen, 1)
+}
+
+func (s *TestSuite) TestPolicyRetain(c *C) {
+	d := s.newVFSDaemon(c)
+	s.createPolicy(c, d, "keep2", map[string]string{"backup": "daily"}, 2)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:   "vol1",
+		Labels: map[string]string{"backup": "daily"},
+	})
+	c.Assert(err, IsNil)
+
+	now := time.Date(2016, time.March, 4, 10, 7, 0, 0, time.Local)
+	for i := 0; i < 3; i++ {
+		d.runPolicies(now.Add(time.Duration(i) * 24 * time.Hour))
+	}
+	policy := s.loadPolicy(c, d, "keep2")
+	backups := policy.Volumes["vol1"].Backups
+	c.Assert(backups, HasLen, 2)
+
+	snapshots, err := d.listSnapshotDriverInfos(d.getVolume("vol1"))
+	c.Assert(err, IsNil)
+	c.Assert(snapshots, HasLen, 2)
+	for _, backup := range backups {
+		c.Assert(snapshots[backup.SnapshotName], NotNil)
+	}
+}
+
+func (s *TestSuite) TestPolicyPruneFailure(c *C) {
+	d := s.newVFSDaemon(c)
+	dest := s.createPolicy(c, d, "keep1", map[string]string{"backup": "daily"}, 1)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:   "vol1",
+		Labels: map[string]string{"backup": "daily"},
+	})
+	c.Assert(err, IsNil)
+
+	now := time.Date(2016, time.March, 4, 10, 7, 0, 0, time.Local)
+	d.runPolicies(now)
+	policy := s.loadPolicy(c, d, "keep1")
+	c.Assert(policy.Volumes["vol1"].Backups, HasLen, 1)
+
+	// The old backup cannot be deleted, while the new one is still recorded
+	policy.Volumes["vol1"].Backups[0].BackupURL = dest + "?backup=nonexistent&volume=vol1"
+	c.Assert(util.ObjectSave(policy), IsNil)
+	d.runPolicies(now.Add(24 * time.Hour))
+	policy = s.loadPolicy(c, d, "keep1")
+	c.Assert(policy.Volumes["vol1"].Backups, HasLen, 2)
+	c.Assert(policy.Volumes["vol1"].LastRun, Equals, now.Add(24*time.Hour).Format(time.RubyDate))
+
+	// Not backed up again before it's due, and the deletion is retried when
+	// it is
+	d.runPolicies(now.Add(25 * time.Hour))
+	policy = s.loadPolicy(c, d, "keep1")
+	c.Assert(policy.Volumes["vol1"].Backups, HasLen, 2)
+	d.runPolicies(now.Add(48 * time.Hour))
+	policy = s.loadPolicy(c, d, "keep1")
+	c.Assert(policy.Volumes["vol1"].Backups, HasLen, 2)
+	c.Assert(policy.Volumes["vol1"].Backups[0].BackupURL, Equals, dest+"?backup=nonexistent&volume=vol1")
+}
+
+func (s *TestSuite) TestPolicyVolumeState(c *C) {
+	d := s.newVFSDaemon(c)
+	s.createPolicy(c, d, "daily", map[string]string{"backup": "daily"}, 0)
+
+	// Retain is changed while the volume is being backed up
+	policy := s.loadPolicy(c, d, "daily")
+	policy.Retain = 3
+	c.Assert(util.ObjectSave(policy), IsNil)
+
+	state := &PolicyVolumeState{LastRun: time.Now().Format(time.RubyDate)}
+	exists, err := d.savePolicyVolumeState("daily", "vol1", state)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, true)
+	policy = s.loadPolicy(c, d, "daily")
+	c.Assert(policy.Retain, Equals, 3)
+	c.Assert(policy.Volumes["vol1"], DeepEquals, state)
+
+	// Deleted policy isn't saved again
+	c.Assert(d.deleteObject(policy), IsNil)
+	exists, err = d.savePolicyVolumeState("daily", "vol1", state)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+	exists, err = d.objectExists(d.blankPolicy("daily"))
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+}
@@ -0,0 +1,205 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	SETTINGS_SECTION_PROFILE_PREFIX = "profile."
+
+	// Key of the profile in the recorded create options of volume
+	CREATE_OPT_PROFILE = "Profile"
+)
+
+/*
+volumeProfile is a named set of options of volume create, defined by a
+[profile.<name>] section of config file, e.g.:
+
+	[profile.fast]
+	driver = "ebs"
+	type = "gp3"
+	iops = 8000
+	default = true
+
+Create with the profile gets the options it doesn't specify from the profile.
+The default profile of a driver is used by the volumes of the driver created
+without a profile, e.g. by Docker.
+*/
+type volumeProfile struct {
+	Name    string
+	Default bool
+	// Options in the fields of create request, the empty ones are left to
+	// the request
+	Options api.VolumeCreateRequest
+}
+
+type profileSet struct {
+	mutex    sync.RWMutex
+	profiles map[string]*volumeProfile
+}
+
+func parseProfileSettings(name string, values map[string]string) (*volumeProfile, error) {
+	if name == "" || !util.ValidateName(name) {
+		return nil, fmt.Errorf("invalid profile name %q", name)
+	}
+	p := &volumeProfile{
+		Name: name,
+	}
+	opts := &p.Options
+	for key, value := range values {
+		var err error
+		switch key {
+		case "driver":
+			opts.DriverName = value
+		case "size":
+			opts.Size, err = util.ParseSize(value)
+		case "type":
+			opts.Type = value
+		case "fs":
+			opts.FSType = value
+		case "iops":
+			opts.IOPS, err = strconv.ParseInt(value, 10, 64)
+		case "throughput":
+			opts.Throughput, err = strconv.ParseInt(value, 10, 64)
+		case "mountopts":
+			opts.MountOptions = value
+			err = util.ValidateMountOptions(value)
+		case "ro":
+			opts.ReadOnly, err = strconv.ParseBool(value)
+		case "tags":
+			opts.Tags, err = util.ParseTags(value)
+		case "encrypted":
+			opts.Encrypted, err = strconv.ParseBool(value)
+		case "kmskeyid":
+			opts.KmsKeyID = value
+		case "uid":
+			opts.UID = value
+		case "gid":
+			opts.GID = value
+		case "mode":
+			opts.Mode = value
+		case "default":
+			p.Default, err = strconv.ParseBool(value)
+		default:
+			return nil, fmt.Errorf("unknown setting %v of profile %v", key, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %v of profile %v: %v", key, value, name, err)
+		}
+	}
+	if p.Default && opts.DriverName == "" {
+		return nil, fmt.Errorf("default profile %v must have a driver", name)
+	}
+	return p, nil
+}
+
+// validateProfiles checks there is at most one default profile per driver
+func validateProfiles(profiles map[string]*volumeProfile) error {
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	defaults := map[string]string{}
+	for _, name := range names {
+		p := profiles[name]
+		if !p.Default {
+			continue
+		}
+		if other, exists := defaults[p.Options.DriverName]; exists {
+			return fmt.Errorf("profile %v and %v are both default of driver %v", other, name, p.Options.DriverName)
+		}
+		defaults[p.Options.DriverName] = name
+	}
+	return nil
+}
+
+func (ps *profileSet) set(profiles map[string]*volumeProfile) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.profiles = profiles
+}
+
+func (ps *profileSet) get(name string) *volumeProfile {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	return ps.profiles[name]
+}
+
+func (ps *profileSet) getDefault(driverName string) *volumeProfile {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	for _, p := range ps.profiles {
+		if p.Default && p.Options.DriverName == driverName {
+			return p
+		}
+	}
+	return nil
+}
+
+// apply fills the options request doesn't specify from the profile
+func (p *volumeProfile) apply(request *api.VolumeCreateRequest) {
+	opts := &p.Options
+	setString := func(value *string, profileValue string) {
+		if *value == "" {
+			*value = profileValue
+		}
+	}
+	setInt := func(value *int64, profileValue int64) {
+		if *value == 0 {
+			*value = profileValue
+		}
+	}
+	request.Profile = p.Name
+	setString(&request.DriverName, opts.DriverName)
+	setInt(&request.Size, opts.Size)
+	setString(&request.Type, opts.Type)
+	setString(&request.FSType, opts.FSType)
+	setInt(&request.IOPS, opts.IOPS)
+	setInt(&request.Throughput, opts.Throughput)
+	setString(&request.MountOptions, opts.MountOptions)
+	request.ReadOnly = request.ReadOnly || opts.ReadOnly
+	if len(request.Tags) == 0 && len(opts.Tags) != 0 {
+		request.Tags = opts.Tags
+	}
+	request.Encrypted = request.Encrypted || opts.Encrypted
+	setString(&request.KmsKeyID, opts.KmsKeyID)
+	setString(&request.UID, opts.UID)
+	setString(&request.GID, opts.GID)
+	setString(&request.Mode, opts.Mode)
+}
+
+// resolveVolumeProfile applies the profile of request, or the default profile
+// of the driver if the request doesn't name one, before the request is handed
+// to the driver
+func (s *daemon) resolveVolumeProfile(request *api.VolumeCreateRequest) error {
+	if request.Profile == "" {
+		// Volumes of snapshot are created by the driver of snapshot
+		if request.SnapshotName != "" {
+			return nil
+		}
+		driverName := request.DriverName
+		if driverName == "" {
+			driverName = s.DefaultDriver
+		}
+		if p := s.profiles.getDefault(driverName); p != nil {
+			p.apply(request)
+		}
+		return nil
+	}
+	p := s.profiles.get(request.Profile)
+	if p == nil {
+		return api.NewError(api.ERROR_CODE_NOT_FOUND, "Cannot find profile %v", request.Profile).WithDetail("profile", request.Profile)
+	}
+	if p.Options.DriverName != "" && request.DriverName != "" && p.Options.DriverName != request.DriverName {
+		return fmt.Errorf("Profile %v is for driver %v rather than %v", p.Name, p.Options.DriverName, request.DriverName)
+	}
+	p.apply(request)
+	return nil
+}
@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"github.com/rancher/convoy/api"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestVolumeProfile(c *C) {
+	d := s.newVFSDaemon(c)
+	settings, err := loadSettingsFile(s.writeSettingsFile(c, `
+[profile.shared]
+driver = "vfs"
+mode = "2775"
+default = true
+
+[profile.fast]
+driver = "ebs"
+type = "gp3"
+iops = 8000
+`))
+	c.Assert(err, IsNil)
+	c.Assert(d.applySettings(settings), IsNil)
+
+	// Options not specified are taken from the profile
+	request := &api.VolumeCreateRequest{
+		Profile: "fast",
+		IOPS:    3000,
+	}
+	c.Assert(d.resolveVolumeProfile(request), IsNil)
+	c.Assert(*request, DeepEquals, api.VolumeCreateRequest{
+		Profile:    "fast",
+		DriverName: "ebs",
+		Type:       "gp3",
+		IOPS:       3000,
+	})
+
+	// The default profile of the driver is used without a profile
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.CreateOptions, DeepEquals, map[string]string{
+		OPT_MODE:           "2775",
+		CREATE_OPT_PROFILE: "shared",
+	})
+	// Created again the same way, e.g. by Docker
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+
+	for _, t := range []struct {
+		request *api.VolumeCreateRequest
+		message string
+	}{
+		{&api.VolumeCreateRequest{Name: "vol2", Profile: "slow"}, "Cannot find profile slow"},
+		{&api.VolumeCreateRequest{Name: "vol2", Profile: "fast", DriverName: "vfs"}, "Profile fast is for driver ebs rather than vfs"},
+	} {
+		_, err := d.processVolumeCreate(t.request)
+		c.Assert(err, ErrorMatches, t.message)
+	}
+
+	c.Assert(validateProfiles(map[string]*volumeProfile{
+		"a": {Name: "a", Default: true, Options: api.VolumeCreateRequest{DriverName: "vfs"}},
+		"b": {Name: "b", Default: true, Options: api.VolumeCreateRequest{DriverName: "vfs"}},
+	}), ErrorMatches, "profile a and b are both default of driver vfs")
+}
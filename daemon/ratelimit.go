@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/api"
+)
+
+// Routes never limited, since they're used for monitoring
+var rateLimitExemptRoutes = map[string]bool{
+	"/health":  true,
+	"/metrics": true,
+}
+
+// rateLimit allows RequestsPerSecond API requests on average, and at most
+// Burst requests at once. Zero RequestsPerSecond means unlimited.
+type rateLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+}
+
+func (l rateLimit) validate() error {
+	if l.RequestsPerSecond < 0 {
+		return fmt.Errorf("Invalid rate limit %v requests per second, cannot be negative", l.RequestsPerSecond)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("Invalid rate limit burst %v, cannot be negative", l.Burst)
+	}
+	return nil
+}
+
+// rateLimiter is a token bucket, whose limit can be changed at any time
+type rateLimiter struct {
+	mutex  sync.Mutex
+	limit  rateLimit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) setLimit(limit rateLimit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.limit = limit
+	l.burst = float64(limit.Burst)
+	if l.burst == 0 {
+		l.burst = math.Max(1, math.Ceil(limit.RequestsPerSecond))
+	}
+	l.tokens = l.burst
+	l.last = time.Time{}
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.limit.RequestsPerSecond == 0 {
+		return true
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.limit.RequestsPerSecond
+		l.tokens = math.Min(l.tokens, l.burst)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// rateLimitHandlerFunc rejects API requests exceeding the rate limit with 429.
+// Requests of Docker are never limited, since failing them would fail the
+// containers.
+func (s *daemon) rateLimitHandlerFunc(route string, next http.HandlerFunc) http.HandlerFunc {
+	if rateLimitExemptRoutes[route] {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.rateLimiter.allow(time.Now()) {
+			log.Warnf("Rejected request %v %v exceeding rate limit", r.Method, r.RequestURI)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, api.NewError(api.ERROR_CODE_BUSY, "Too many requests, rate limit exceeded"), http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
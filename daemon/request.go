@@ -0,0 +1,42 @@
+package daemon
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+// Request IDs accepted from clients, others are replaced so they cannot
+// mess up the logs
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._:/+=-]{1,128}$`)
+
+/*
+requestIDHandlerFunc identifies the requests handled by next by the ID in
+their X-Request-ID header, so a request can be traced across the components
+passing it along, or by a new ID otherwise. The ID is responded in the same
+header, and the logs of the request are tagged with it, including the ones of
+drivers and the jobs it starts.
+*/
+func requestIDHandlerFunc(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(api.REQUEST_ID_HEADER)
+		if !validRequestID.MatchString(id) {
+			id = util.NewUUID()
+		}
+		// The request is kept, since mux finds the variables of route by it
+		r.Header.Set(api.REQUEST_ID_HEADER, id)
+		w.Header().Set(api.REQUEST_ID_HEADER, id)
+		defer SetRequestID(id)()
+		next(w, r)
+	}
+}
+
+// getRequestID returns the ID of r, which is accepted or generated by
+// requestIDHandlerFunc
+func getRequestID(r *http.Request) string {
+	return r.Header.Get(api.REQUEST_ID_HEADER)
+}
@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+
+	. "github.com/rancher/convoy/logging"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestRequestID(c *C) {
+	var (
+		id     string
+		logged string
+	)
+	handler := requestIDHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = getRequestID(r)
+		logged = GetRequestID()
+		// Goroutines working for the request log with its ID as well
+		done := make(chan string)
+		GoWithRequestID(func() {
+			done <- GetRequestID()
+		})
+		c.Assert(<-done, Equals, id)
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/v1/info", nil)
+	r.Header.Set(api.REQUEST_ID_HEADER, "docker-mount-42")
+	handler(w, r)
+	c.Assert(id, Equals, "docker-mount-42")
+	c.Assert(logged, Equals, id)
+	c.Assert(w.Header().Get(api.REQUEST_ID_HEADER), Equals, id)
+	c.Assert(GetRequestID(), Equals, "")
+
+	for _, header := range []string{"", "has space", strings.Repeat("a", 129)} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/v1/info", nil)
+		r.Header.Set(api.REQUEST_ID_HEADER, header)
+		handler(w, r)
+		c.Assert(id, Not(Equals), header)
+		c.Assert(id, Matches, "[0-9a-f-]{36}")
+		c.Assert(w.Header().Get(api.REQUEST_ID_HEADER), Equals, id)
+	}
+}
+
+func (s *TestSuite) TestRequestIDLogs(c *C) {
+	var buf bytes.Buffer
+	logger := logrus.StandardLogger()
+	formatter, out, level := logger.Formatter, logger.Out, logger.Level
+	defer func() {
+		logrus.SetFormatter(formatter)
+		logrus.SetOutput(out)
+		logrus.SetLevel(level)
+	}()
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	logrus.SetFormatter(RequestIDFormatter{Formatter: &logrus.JSONFormatter{}})
+	logrus.SetOutput(&buf)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	body, err := json.Marshal(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	r := httptest.NewRequest("POST", "/v1/volumes/create", bytes.NewReader(body))
+	r.Header.Set(api.REQUEST_ID_HEADER, "trace-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	log.Debug("Not handling a request")
+
+	tagged := 0
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		entry := map[string]interface{}{}
+		c.Assert(json.Unmarshal([]byte(line), &entry), IsNil)
+		if entry[LOG_FIELD_REQUEST_ID] == "trace-1" {
+			tagged++
+		} else {
+			c.Assert(entry[LOG_FIELD_REQUEST_ID], IsNil)
+			c.Assert(entry["msg"], Equals, "Not handling a request")
+		}
+	}
+	// Logs of both daemon and the driver
+	c.Assert(tagged > 2, Equals, true)
+	c.Assert(log.Data[LOG_FIELD_REQUEST_ID], IsNil)
+}
@@ -0,0 +1,185 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+/*
+rescanDrivers rebuilds the indexes of volume and snapshot names from the
+volumes and snapshots reported by every driver, so the volumes can be managed
+again after the daemon's own metadata is lost or corrupted. Snapshots which
+are no longer reported are dropped from the indexes along with their labels,
+and volume configs which cannot be parsed are moved aside. It keeps going on
+errors, which are returned in the response.
+*/
+func (s *daemon) rescanDrivers() *api.RescanResponse {
+	resp := &api.RescanResponse{}
+
+	volumeDrivers := map[string]string{}
+	for _, driverName := range s.DriverList {
+		driver, exists := s.ConvoyDrivers[driverName]
+		if !exists {
+			continue
+		}
+		volOps, err := driver.VolumeOps()
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot get volume operations of driver %v: %v", driverName, err))
+			continue
+		}
+		volumes, err := volOps.ListVolume(map[string]string{})
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot list volumes of driver %v: %v", driverName, err))
+			continue
+		}
+		names := []string{}
+		for name := range volumes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// Volumes in trash stay out of the indexes until restored
+			if s.volumeInTrash(name) {
+				continue
+			}
+			// The other copy of a volume being migrated
+			if owner := s.migrationOwner(name); owner != "" && owner != driverName {
+				continue
+			}
+			if other, exists := volumeDrivers[name]; exists {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("Volume %v is reported by both driver %v and %v, only the one of %v is used",
+					name, other, driverName, other))
+				continue
+			}
+			volumeDrivers[name] = driverName
+			if err := s.NameUUIDIndex.Add(name, "exists"); err != nil {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot index volume %v: %v", name, err))
+				continue
+			}
+			resp.Volumes++
+			s.rescanVolume(driver, name, resp)
+		}
+	}
+
+	// Snapshots of volumes which are gone
+	for snapshotName, volumeName := range s.SnapshotVolumeIndex.Entries() {
+		if _, exists := volumeDrivers[volumeName]; !exists {
+			s.SnapshotVolumeIndex.Delete(snapshotName)
+			s.NameUUIDIndex.Delete(snapshotName)
+			resp.StaleSnapshots = append(resp.StaleSnapshots, snapshotName)
+		}
+	}
+	sort.Strings(resp.StaleSnapshots)
+	return resp
+}
+
+// rescanVolume indexes the snapshots of volume and repairs its config. The
+// lock of volume is held, so no snapshot of it is being created or deleted.
+func (s *daemon) rescanVolume(driver ConvoyDriver, volumeName string, resp *api.RescanResponse) {
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	snapshots := map[string]map[string]string{}
+	if snapOps, err := driver.SnapshotOps(); err == nil {
+		snapshots, err = snapOps.ListSnapshot(map[string]string{
+			OPT_VOLUME_NAME: volumeName,
+		})
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot list snapshots of volume %v: %v", volumeName, err))
+			return
+		}
+	}
+	names := []string{}
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := s.SnapshotVolumeIndex.Add(name, volumeName); err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot index snapshot %v of volume %v: %v", name, volumeName, err))
+			continue
+		}
+		if err := s.NameUUIDIndex.Add(name, "exists"); err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot index snapshot %v of volume %v: %v", name, volumeName, err))
+			continue
+		}
+		resp.Snapshots++
+	}
+	stale := []string{}
+	for snapshotName, indexedVolume := range s.SnapshotVolumeIndex.Entries() {
+		if _, exists := snapshots[snapshotName]; indexedVolume == volumeName && !exists {
+			s.SnapshotVolumeIndex.Delete(snapshotName)
+			s.NameUUIDIndex.Delete(snapshotName)
+			stale = append(stale, snapshotName)
+		}
+	}
+	resp.StaleSnapshots = append(resp.StaleSnapshots, stale...)
+
+	if _, err := s.loadVolumeConfig(volumeName); err != nil {
+		key, err := s.moveAsideVolumeConfig(volumeName)
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot move aside config of volume %v: %v", volumeName, err))
+			return
+		}
+		resp.CorruptedConfigs = append(resp.CorruptedConfigs, key)
+		return
+	}
+	if err := s.updateVolumeConfig(volumeName, func(config *VolumeConfig) (bool, error) {
+		changed := false
+		for snapshotName := range config.SnapshotLabels {
+			if _, exists := snapshots[snapshotName]; !exists {
+				delete(config.SnapshotLabels, snapshotName)
+				changed = true
+			}
+		}
+		return changed, nil
+	}); err != nil {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("Cannot save config of volume %v: %v", volumeName, err))
+	}
+}
+
+// moveAsideVolumeConfig keeps the corrupted config of volume with another key
+// in the metadata store, which is returned
+func (s *daemon) moveAsideVolumeConfig(volumeName string) (string, error) {
+	key, err := objectKey(&VolumeConfig{Name: volumeName, configPath: s.Root})
+	if err != nil {
+		return "", err
+	}
+	data, err := s.store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	corruptedKey := key + ".corrupted-" + util.GenerateName("rescan")
+	if err := s.store.Put(corruptedKey, data); err != nil {
+		return "", err
+	}
+	if err := s.store.Delete(key); err != nil {
+		return "", err
+	}
+	return corruptedKey, nil
+}
+
+// logRescan reports the result of rescan on startup, where there is no one
+// to return it to
+func logRescan(resp *api.RescanResponse) {
+	for _, name := range resp.StaleSnapshots {
+		log.Warnf("Dropped snapshot %v no longer reported by any driver", name)
+	}
+	for _, key := range resp.CorruptedConfigs {
+		log.Warnf("Moved corrupted volume config to %v", key)
+	}
+	for _, err := range resp.Errors {
+		log.Error(err)
+	}
+	log.Infof("Rescanned %v volumes and %v snapshots", resp.Volumes, resp.Snapshots)
+}
+
+func (s *daemon) doRescan(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	return writeResponseOutput(w, s.rescanDrivers())
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestRescan(c *C) {
+	d := s.newVFSDaemon(c)
+	for _, name := range []string{"vol1", "vol2"} {
+		_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+			Name: name,
+		})
+		c.Assert(err, IsNil)
+	}
+	labels := map[string]string{"app": "db"}
+	for _, name := range []string{"snap1", "snap2"} {
+		_, err := d.processSnapshotCreate(d.getVolume("vol1"), name, labels, "", nil)
+		c.Assert(err, IsNil)
+	}
+
+	// snap2 is deleted outside of daemon, and the indexes are lost except
+	// an entry of a volume which is gone
+	snapOps, err := d.getSnapshotOpsForVolume(d.getVolume("vol1"))
+	c.Assert(err, IsNil)
+	c.Assert(snapOps.DeleteSnapshot(Request{
+		Name: "snap2",
+		Options: map[string]string{
+			OPT_VOLUME_NAME: "vol1",
+		},
+	}), IsNil)
+	d.NameUUIDIndex = util.NewIndex()
+	d.SnapshotVolumeIndex = util.NewIndex()
+	c.Assert(d.SnapshotVolumeIndex.Add("snap3", "vol3"), IsNil)
+	configFile, err := (&VolumeConfig{Name: "vol2", configPath: d.Root}).ConfigFile()
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(configFile, []byte("{"), 0600), IsNil)
+
+	w := s.serveRequest(c, createRouter(d), "POST", "/v1/rescan", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	resp := api.RescanResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &resp), IsNil)
+	c.Assert(resp.Volumes, Equals, 2)
+	c.Assert(resp.Snapshots, Equals, 1)
+	c.Assert(resp.StaleSnapshots, DeepEquals, []string{"snap3"})
+	c.Assert(resp.CorruptedConfigs, HasLen, 1)
+	c.Assert(strings.HasPrefix(resp.CorruptedConfigs[0], "volume_vol2.json.corrupted-"), Equals, true)
+	c.Assert(resp.Errors, HasLen, 0)
+
+	c.Assert(d.SnapshotVolumeIndex.Get("snap1"), Equals, "vol1")
+	c.Assert(d.SnapshotVolumeIndex.Get("snap3"), Equals, "")
+	c.Assert(d.NameUUIDIndex.Get("vol2"), Equals, "exists")
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.SnapshotLabels, DeepEquals, map[string]map[string]string{"snap1": labels})
+	_, err = d.loadVolumeConfig("vol2")
+	c.Assert(err, IsNil)
+
+	// Indexes are consistent now, nothing else to do
+	resp = *d.rescanDrivers()
+	c.Assert(resp, DeepEquals, api.RescanResponse{Volumes: 2, Snapshots: 1})
+}
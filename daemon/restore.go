@@ -0,0 +1,126 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+estimateRestore returns what restoring the objectstore backup of backupURL
+by driverName would take, and the problems which would fail the restore,
+e.g. the driver doesn't have space for it. With probe, part of the backup is
+read to measure the bandwidth if it's unknown. Backups of other drivers,
+e.g. EBS snapshots, are not supported.
+*/
+func (s *daemon) estimateRestore(backupURL, driverName string, probe bool) (*api.RestoreEstimateResponse, error) {
+	if _, err := objectstore.GetObjectStoreDriver(backupURL); err != nil {
+		u, err := url.Parse(backupURL)
+		if err != nil {
+			return nil, err
+		}
+		return nil, driverUnsupportedError(u.Scheme, "estimate of restore")
+	}
+	if driverName == "" {
+		driverName = s.DefaultDriver
+	}
+	driver, err := s.getDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &api.RestoreEstimateResponse{
+		URL:       backupURL,
+		Driver:    driverName,
+		FreeSpace: -1,
+	}
+	if err := objectstore.CheckRestore(backupURL); err != nil {
+		resp.Problems = append(resp.Problems, err.Error())
+		// Reading the backup would fail as well
+		probe = false
+	}
+	estimate, err := objectstore.EstimateRestore(backupURL, probe)
+	if err != nil {
+		return nil, err
+	}
+	resp.VolumeSize = estimate.VolumeSize
+	resp.DataSize = estimate.DataSize
+	resp.Blocks = estimate.Blocks
+	resp.Files = estimate.Files
+	resp.DownloadSize = estimate.DownloadSize
+	resp.Bandwidth = int64(estimate.Bandwidth)
+	resp.Concurrency = estimate.Concurrency
+	if estimate.Duration != 0 {
+		resp.EstimatedDuration = formatDuration(estimate.Duration)
+	}
+
+	// Compressed files backups take at least the space of the download
+	resp.RequiredSpace = estimate.DataSize
+	if resp.RequiredSpace < 0 {
+		resp.RequiredSpace = estimate.DownloadSize
+	}
+	if reporter, ok := driver.(SpaceReporter); ok {
+		free, err := reporter.GetFreeSpace()
+		if err != nil {
+			log.Warnf("Failed to get free space of driver %v: %v", driverName, err)
+		} else {
+			resp.FreeSpace = free
+			if resp.RequiredSpace > free {
+				resp.Problems = append(resp.Problems, fmt.Sprintf("Not enough space in driver %v, %v bytes needed but %v bytes available",
+					driverName, resp.RequiredSpace, free))
+			}
+		}
+	}
+	return resp, nil
+}
+
+// checkRestore fails if the objectstore backup of backupURL cannot be
+// restored by driverName, before the driver starts writing the volume
+func (s *daemon) checkRestore(backupURL, driverName string) error {
+	if _, err := objectstore.GetObjectStoreDriver(backupURL); err != nil {
+		// Restored by the driver of backup
+		return nil
+	}
+	resp, err := s.estimateRestore(backupURL, driverName, false)
+	if err != nil {
+		return err
+	}
+	if len(resp.Problems) != 0 {
+		return api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Cannot restore backup %v: %v",
+			backupURL, strings.Join(resp.Problems, "; ")).WithDetail("backup", backupURL)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:      LOG_EVENT_RESTORE,
+		LOG_FIELD_BACKUP_URL: backupURL,
+	}).Debugf("Restoring %v bytes of data, %v bytes to download in %v", resp.DataSize, resp.DownloadSize, resp.EstimatedDuration)
+	return nil
+}
+
+func (s *daemon) doBackupEstimate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.RestoreEstimateRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.URL = util.UnescapeURL(request.URL)
+	if request.EncryptionKey != "" {
+		if _, err := s.addEncryptionKey(request.EncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.estimateRestore(request.URL, request.DriverName, true)
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, resp)
+}
@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/convoy/api"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+const testFullDriver = "test-full"
+
+// fullDriver is the vfs driver reporting a byte of free space, which no
+// backup fits in
+type fullDriver struct {
+	ConvoyDriver
+}
+
+func (d *fullDriver) GetFreeSpace() (int64, error) {
+	return 1, nil
+}
+
+func (s *TestSuite) TestBackupEstimate(c *C) {
+	d := s.newVFSDaemon(c)
+	d.ConvoyDrivers[testFullDriver] = &fullDriver{d.ConvoyDrivers["vfs"]}
+	router := createRouter(d)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "data"), []byte("data"), 0644), IsNil)
+	snapshotName, err := d.processSnapshotCreate(d.getVolume("vol1"), "", nil, "", nil)
+	c.Assert(err, IsNil)
+	backupURL, err := d.processBackupCreate(snapshotName, "vfs://"+dest, "", "")
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "GET", "/v1/backups/estimate", &api.RestoreEstimateRequest{URL: backupURL})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	estimate := &api.RestoreEstimateResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), estimate), IsNil)
+	c.Assert(estimate.Driver, Equals, "vfs")
+	c.Assert(estimate.Files, Equals, 1)
+	c.Assert(estimate.Blocks, Equals, 0)
+	// Size of the compressed archive isn't the size of the files
+	c.Assert(estimate.DataSize, Equals, int64(-1))
+	c.Assert(estimate.DownloadSize > 0, Equals, true)
+	c.Assert(estimate.RequiredSpace, Equals, estimate.DownloadSize)
+	c.Assert(estimate.FreeSpace > 0, Equals, true)
+	c.Assert(estimate.Problems, HasLen, 0)
+
+	w = s.serveRequest(c, router, "GET", "/v1/backups/estimate", &api.RestoreEstimateRequest{
+		URL:        backupURL,
+		DriverName: testFullDriver,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	estimate = &api.RestoreEstimateResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), estimate), IsNil)
+	c.Assert(estimate.FreeSpace, Equals, int64(1))
+	c.Assert(estimate.Problems, HasLen, 1)
+	c.Assert(estimate.Problems[0], Matches, "Not enough space in driver test-full, [0-9]+ bytes needed but 1 bytes available")
+
+	// Restore fails before the driver is asked to create the volume
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:       "vol2",
+		DriverName: testFullDriver,
+		BackupURL:  backupURL,
+	})
+	c.Assert(err, ErrorMatches, "Cannot restore backup .*: Not enough space in driver test-full, .*")
+	c.Assert(api.IsErrorCode(err, api.ERROR_CODE_INVALID_REQUEST), Equals, true)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:      "vol2",
+		BackupURL: backupURL,
+	})
+	c.Assert(err, IsNil)
+
+	w = s.serveRequest(c, router, "GET", "/v1/backups/estimate", &api.RestoreEstimateRequest{URL: "ebs://us-west-2a/snap-1234"})
+	s.assertError(c, w, api.ERROR_CODE_DRIVER_UNSUPPORTED, "Driver ebs doesn't support estimate of restore")
+}
@@ -0,0 +1,241 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "github.com/rancher/convoy/logging"
+)
+
+type datedSnapshot struct {
+	name    string
+	created time.Time
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// startOfWeek returns the start of Monday of the week of t
+func startOfWeek(t time.Time) time.Time {
+	return startOfDay(t).AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+}
+
+// keepLatestPerPeriod marks the latest snapshot of each period since oldest,
+// where period returns the start of the period of a time. snapshots are
+// sorted from the latest.
+func keepLatestPerPeriod(snapshots []datedSnapshot, oldest time.Time, period func(time.Time) time.Time, keep map[string]bool) {
+	seen := map[time.Time]bool{}
+	for _, snapshot := range snapshots {
+		start := period(snapshot.created.In(oldest.Location()))
+		if start.Before(oldest) || seen[start] {
+			continue
+		}
+		seen[start] = true
+		keep[snapshot.name] = true
+	}
+}
+
+/*
+snapshotsToPrune returns the snapshots not kept by retention from the oldest,
+by the times they were created. Days and weeks are in the time zone of now,
+and weeks start on Monday. Snapshots which don't have a known created time
+are always kept.
+*/
+func snapshotsToPrune(created map[string]time.Time, retention *api.SnapshotRetention, now time.Time) []string {
+	snapshots := []datedSnapshot{}
+	for name, t := range created {
+		snapshots = append(snapshots, datedSnapshot{name, t})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		if !snapshots[i].created.Equal(snapshots[j].created) {
+			return snapshots[i].created.After(snapshots[j].created)
+		}
+		return snapshots[i].name > snapshots[j].name
+	})
+
+	keep := map[string]bool{}
+	for i := 0; i < retention.KeepLast && i < len(snapshots); i++ {
+		keep[snapshots[i].name] = true
+	}
+	if retention.KeepDaily != 0 {
+		keepLatestPerPeriod(snapshots, startOfDay(now).AddDate(0, 0, 1-retention.KeepDaily), startOfDay, keep)
+	}
+	if retention.KeepWeekly != 0 {
+		keepLatestPerPeriod(snapshots, startOfWeek(now).AddDate(0, 0, 7*(1-retention.KeepWeekly)), startOfWeek, keep)
+	}
+
+	pruned := []string{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !keep[snapshots[i].name] {
+			pruned = append(pruned, snapshots[i].name)
+		}
+	}
+	return pruned
+}
+
+func validateSnapshotRetention(retention *api.SnapshotRetention) error {
+	if retention.KeepLast < 0 || retention.KeepDaily < 0 || retention.KeepWeekly < 0 {
+		return fmt.Errorf("Invalid snapshot retention %+v, counts must not be negative", *retention)
+	}
+	return nil
+}
+
+/*
+pinnedSnapshots returns the snapshots of volume which retention must keep:
+the bases of the next incremental backups, the snapshots recorded by backup
+policies and snapshot schedules, which prune them by their own retain counts,
+and the snapshots other volumes were created from, which may depend on them,
+e.g. clones of zfs.
+*/
+func (s *daemon) pinnedSnapshots(volumeName string, config *VolumeConfig) (map[string]bool, error) {
+	pinned := map[string]bool{}
+	for _, name := range config.BackupBases {
+		pinned[name] = true
+	}
+
+	s.policyLock.Lock()
+	policies, err := s.listPolicies()
+	s.policyLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		if state := policy.Volumes[volumeName]; state != nil {
+			for _, backup := range state.Backups {
+				pinned[backup.SnapshotName] = true
+			}
+		}
+	}
+
+	s.scheduleLock.Lock()
+	schedules, err := s.listSchedules()
+	s.scheduleLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, schedule := range schedules {
+		if schedule.VolumeName != volumeName {
+			continue
+		}
+		for _, name := range schedule.Snapshots {
+			pinned[name] = true
+		}
+	}
+
+	names, err := s.listObjectNames(VOLUME_CFG_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if name == volumeName {
+			continue
+		}
+		other, err := s.loadVolumeConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		if snapshotName := other.CreateOptions[OPT_SNAPSHOT_NAME]; snapshotName != "" {
+			pinned[snapshotName] = true
+		}
+	}
+	return pinned, nil
+}
+
+// enforceSnapshotRetention deletes the snapshots of volume not kept by its
+// retention, and returns the ones deleted. Pinned snapshots are always kept,
+// and aren't counted by retention. Caller must hold the lock of volume.
+func (s *daemon) enforceSnapshotRetention(volume *Volume, now time.Time) ([]string, error) {
+	config, err := s.loadVolumeConfig(volume.Name)
+	if err != nil {
+		return nil, err
+	}
+	if config.SnapshotRetention == nil {
+		return nil, nil
+	}
+	snapshots, err := s.listSnapshotDriverInfos(volume)
+	if err != nil {
+		return nil, err
+	}
+	pinned, err := s.pinnedSnapshots(volume.Name, config)
+	if err != nil {
+		return nil, err
+	}
+	created := map[string]time.Time{}
+	for name, info := range snapshots {
+		if pinned[name] {
+			continue
+		}
+		t, err := time.Parse(time.RubyDate, info[OPT_SNAPSHOT_CREATED_TIME])
+		if err != nil {
+			log.Warnf("Keeping snapshot %v of volume %v, cannot parse its created time %q", name, volume.Name, info[OPT_SNAPSHOT_CREATED_TIME])
+			continue
+		}
+		created[name] = t
+	}
+
+	pruned := []string{}
+	for _, name := range snapshotsToPrune(created, config.SnapshotRetention, now) {
+		if err := s.deleteSnapshot(volume.Name, name); err != nil {
+			return pruned, err
+		}
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+			LOG_FIELD_EVENT:    LOG_EVENT_DELETE,
+			LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+			LOG_FIELD_SNAPSHOT: name,
+			LOG_FIELD_VOLUME:   volume.Name,
+		}).Debug("Pruned snapshot by retention")
+		pruned = append(pruned, name)
+	}
+	return pruned, nil
+}
+
+func (s *daemon) doVolumeRetention(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeRetentionRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if err := util.CheckName(request.VolumeName); err != nil {
+		return err
+	}
+	retention := &api.SnapshotRetention{
+		KeepLast:   request.KeepLast,
+		KeepDaily:  request.KeepDaily,
+		KeepWeekly: request.KeepWeekly,
+	}
+	if err := validateSnapshotRetention(retention); err != nil {
+		return err
+	}
+	if *retention == (api.SnapshotRetention{}) {
+		retention = nil
+	}
+
+	s.volumeLocks.Lock(request.VolumeName)
+	defer s.volumeLocks.Unlock(request.VolumeName)
+
+	volume := s.getVolume(request.VolumeName)
+	if volume == nil {
+		return volumeNotFoundError(request.VolumeName)
+	}
+	if _, err := s.getSnapshotOpsForVolume(volume); err != nil {
+		return err
+	}
+	if err := s.updateVolumeConfig(volume.Name, func(config *VolumeConfig) (bool, error) {
+		config.SnapshotRetention = retention
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	if retention == nil {
+		retention = &api.SnapshotRetention{}
+	}
+	return writeResponseOutput(w, retention)
+}
@@ -0,0 +1,132 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestSnapshotsToPrune(c *C) {
+	// Wednesday
+	now := time.Date(2016, 3, 9, 12, 0, 0, 0, time.UTC)
+	created := map[string]time.Time{
+		"wed-2":       now.Add(-1 * time.Hour),
+		"wed-1":       now.Add(-2 * time.Hour),
+		"tue-2":       now.Add(-20 * time.Hour),
+		"tue-1":       now.Add(-22 * time.Hour),
+		"mon":         now.Add(-2 * 24 * time.Hour),
+		"last-sun":    now.Add(-3 * 24 * time.Hour),
+		"last-mon":    now.Add(-9 * 24 * time.Hour),
+		"2-weeks-ago": now.Add(-14 * 24 * time.Hour),
+	}
+
+	for _, t := range []struct {
+		retention api.SnapshotRetention
+		pruned    []string
+	}{
+		{api.SnapshotRetention{KeepLast: 3},
+			[]string{"2-weeks-ago", "last-mon", "last-sun", "mon", "tue-1"}},
+		{api.SnapshotRetention{KeepDaily: 2},
+			[]string{"2-weeks-ago", "last-mon", "last-sun", "mon", "tue-1", "wed-1"}},
+		{api.SnapshotRetention{KeepWeekly: 2},
+			[]string{"2-weeks-ago", "last-mon", "mon", "tue-1", "tue-2", "wed-1"}},
+		{api.SnapshotRetention{KeepLast: 1, KeepDaily: 3, KeepWeekly: 3},
+			[]string{"last-mon", "tue-1", "wed-1"}},
+		{api.SnapshotRetention{KeepLast: 100}, []string{}},
+	} {
+		c.Assert(snapshotsToPrune(created, &t.retention, now), DeepEquals, t.pruned, Commentf("%+v", t.retention))
+	}
+}
+
+func (s *TestSuite) TestSnapshotRetention(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	for _, name := range []string{"snap1", "snap2"} {
+		_, err = d.processSnapshotCreate(d.getVolume("vol1"), name, nil, "", nil)
+		c.Assert(err, IsNil)
+		// Created times are in seconds
+		time.Sleep(1100 * time.Millisecond)
+	}
+
+	w := s.serveRequest(c, router, "POST", "/v1/volumes/retention", &api.VolumeRetentionRequest{VolumeName: "vol1", KeepLast: -1})
+	c.Assert(w.Code, Not(Equals), http.StatusOK)
+	w = s.serveRequest(c, router, "POST", "/v1/volumes/retention", &api.VolumeRetentionRequest{VolumeName: "vol1", KeepLast: 2})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.SnapshotRetention, DeepEquals, &api.SnapshotRetention{KeepLast: 2})
+
+	// The oldest snapshot is pruned after the new one is created
+	w = s.serveRequest(c, router, "POST", "/v1/snapshots/create", &api.SnapshotCreateRequest{
+		Name:       "snap3",
+		VolumeName: "vol1",
+		Verbose:    true,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	snapshot := &api.SnapshotResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), snapshot), IsNil)
+	c.Assert(snapshot.Name, Equals, "snap3")
+	c.Assert(snapshot.Pruned, DeepEquals, []string{"snap1"})
+	c.Assert(d.snapshotExists("vol1", "snap1"), Equals, false)
+	c.Assert(d.SnapshotVolumeIndex.Get("snap1"), Equals, "")
+	c.Assert(d.snapshotExists("vol1", "snap2"), Equals, true)
+
+	// Cleared by all zero counts
+	w = s.serveRequest(c, router, "POST", "/v1/volumes/retention", &api.VolumeRetentionRequest{VolumeName: "vol1"})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	config, err = d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.SnapshotRetention, IsNil)
+	_, err = d.processSnapshotCreate(d.getVolume("vol1"), "snap4", nil, "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(d.snapshotExists("vol1", "snap2"), Equals, true)
+}
+
+func (s *TestSuite) TestSnapshotRetentionPinned(c *C) {
+	d := s.newVFSDaemon(c)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	volume := d.getVolume("vol1")
+	for _, name := range []string{"snap1", "snap2", "base", "policy", "schedule", "source"} {
+		_, err = d.processSnapshotCreate(volume, name, nil, "", nil)
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(d.recordBackupDestination("vol1", "base", "vfs:///backups"), IsNil)
+	policy := d.blankPolicy("p1")
+	policy.Volumes = map[string]*PolicyVolumeState{
+		"vol1": {Backups: []PolicyBackup{{SnapshotName: "policy"}}},
+	}
+	c.Assert(d.saveObject(policy), IsNil)
+	schedule := d.blankSchedule("s1")
+	schedule.VolumeName = "vol1"
+	schedule.Snapshots = []string{"schedule"}
+	c.Assert(d.saveObject(schedule), IsNil)
+	clone := &VolumeConfig{
+		Name:          "vol2",
+		CreateOptions: map[string]string{OPT_SNAPSHOT_NAME: "source"},
+		configPath:    d.Root,
+	}
+	c.Assert(d.saveObject(clone), IsNil)
+
+	// Pinned snapshots are neither pruned nor counted by retention
+	c.Assert(d.updateVolumeConfig("vol1", func(config *VolumeConfig) (bool, error) {
+		config.SnapshotRetention = &api.SnapshotRetention{KeepLast: 1}
+		return true, nil
+	}), IsNil)
+	pruned, err := d.enforceSnapshotRetention(volume, time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(pruned, DeepEquals, []string{"snap1"})
+	for _, name := range []string{"snap2", "base", "policy", "schedule", "source"} {
+		c.Assert(d.snapshotExists("vol1", name), Equals, true, Commentf("%v", name))
+	}
+}
@@ -0,0 +1,295 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	SCHEDULE_CFG_PREFIX = "schedule_"
+
+	// How often the daemon checks whether any schedule is due, which is
+	// also the finest granularity of cron expression
+	SCHEDULE_CHECK_INTERVAL = time.Minute
+
+	SCHEDULE_SNAPSHOT_TIME_FORMAT = "20060102-150405"
+)
+
+/*
+SnapshotSchedule snapshots a volume at the times specified by a cron
+expression. Snapshots are named after the schedule and the time they were
+taken. Only the latest Retain snapshots created by the schedule would be
+kept, if Retain is not zero. Schedules FromSettings are defined by the
+config file of daemon, see syncSettingsSchedules.
+*/
+type SnapshotSchedule struct {
+	Name       string
+	VolumeName string
+	Cron       string
+	Retain     int
+	LastRun    string
+	Snapshots  []string
+
+	FromSettings bool
+
+	configPath string
+}
+
+func (sc *SnapshotSchedule) ConfigFile() (string, error) {
+	if sc.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty schedule name")
+	}
+	if sc.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty schedule config path")
+	}
+	return filepath.Join(sc.configPath, SCHEDULE_CFG_PREFIX+sc.Name+CFG_POSTFIX), nil
+}
+
+func (s *daemon) blankSchedule(name string) *SnapshotSchedule {
+	return &SnapshotSchedule{
+		Name:       name,
+		configPath: s.Root,
+	}
+}
+
+func (s *daemon) listSchedules() ([]*SnapshotSchedule, error) {
+	names, err := s.listObjectNames(SCHEDULE_CFG_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	schedules := []*SnapshotSchedule{}
+	for _, name := range names {
+		schedule := s.blankSchedule(name)
+		if err := s.loadObject(schedule); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, nil
+}
+
+func (s *daemon) doScheduleCreate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.ScheduleCreateRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if err := util.CheckName(request.Name); err != nil {
+		return err
+	}
+	if request.Name == "" {
+		return fmt.Errorf("Schedule must have a name")
+	}
+	if s.getVolume(request.VolumeName) == nil {
+		return volumeNotFoundError(request.VolumeName)
+	}
+	if _, err := parseCron(request.Cron); err != nil {
+		return err
+	}
+	if request.Retain < 0 {
+		return fmt.Errorf("Invalid retain count %v of schedule %v", request.Retain, request.Name)
+	}
+
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+
+	schedule := s.blankSchedule(request.Name)
+	exists, err := s.objectExists(schedule)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return api.NewError(api.ERROR_CODE_CONFLICT, "Schedule %v already exists", request.Name).WithDetail("schedule", request.Name)
+	}
+	schedule.VolumeName = request.VolumeName
+	schedule.Cron = request.Cron
+	schedule.Retain = request.Retain
+	// The first snapshot would be taken at the next matching time
+	schedule.LastRun = time.Now().Format(time.RubyDate)
+	schedule.Snapshots = []string{}
+	if err := s.saveObject(schedule); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SCHEDULE,
+		LOG_FIELD_SCHEDULE: schedule.Name,
+		LOG_FIELD_VOLUME:   schedule.VolumeName,
+	}).Debug()
+	return writeResponseOutput(w, schedule)
+}
+
+func (s *daemon) doScheduleList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+
+	schedules, err := s.listSchedules()
+	if err != nil {
+		return err
+	}
+	result := make(map[string]*SnapshotSchedule)
+	for _, schedule := range schedules {
+		result[schedule.Name] = schedule
+	}
+	return writeResponseOutput(w, result)
+}
+
+func (s *daemon) doScheduleDelete(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.ScheduleDeleteRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	if err := util.CheckName(request.Name); err != nil {
+		return err
+	}
+
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+
+	schedule := s.blankSchedule(request.Name)
+	exists, err := s.objectExists(schedule)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return api.NewError(api.ERROR_CODE_NOT_FOUND, "Schedule %v doesn't exist", request.Name).WithDetail("schedule", request.Name)
+	}
+	if err := s.loadObject(schedule); err != nil {
+		return err
+	}
+	if schedule.FromSettings {
+		return fmt.Errorf("Schedule %v is defined by config file, remove it from the file instead", request.Name)
+	}
+	// Snapshots created by the schedule are left as they are
+	if err := s.deleteObject(schedule); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_DELETE,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SCHEDULE,
+		LOG_FIELD_SCHEDULE: schedule.Name,
+	}).Debug()
+	return nil
+}
+
+// startScheduleRunner runs both snapshot schedules and backup policies
+func (s *daemon) startScheduleRunner() {
+	go func() {
+		for now := range time.Tick(SCHEDULE_CHECK_INTERVAL) {
+			s.runSchedules(now)
+			s.runPolicies(now)
+		}
+	}()
+}
+
+func (s *daemon) runSchedules(now time.Time) {
+	// The lock is only held to load and save schedules rather than while
+	// taking snapshots, so schedules can be listed and changed meanwhile
+	s.scheduleLock.Lock()
+	schedules, err := s.listSchedules()
+	s.scheduleLock.Unlock()
+	if err != nil {
+		log.Errorf("Failed to list snapshot schedules: %v", err)
+		return
+	}
+	for _, schedule := range schedules {
+		if err := s.runSchedule(schedule, now); err != nil {
+			log.WithFields(logrus.Fields{
+				LOG_FIELD_REASON:   LOG_REASON_FAILURE,
+				LOG_FIELD_OBJECT:   LOG_OBJECT_SCHEDULE,
+				LOG_FIELD_SCHEDULE: schedule.Name,
+				LOG_FIELD_VOLUME:   schedule.VolumeName,
+			}).Errorf("Failed to run snapshot schedule: %v", err)
+		}
+	}
+}
+
+// runSchedule takes at most one snapshot, even if the daemon was down
+// during several matching times
+func (s *daemon) runSchedule(schedule *SnapshotSchedule, now time.Time) error {
+	cron, err := parseCron(schedule.Cron)
+	if err != nil {
+		return err
+	}
+	lastRun, err := time.Parse(time.RubyDate, schedule.LastRun)
+	if err != nil {
+		return err
+	}
+	if !cron.due(lastRun, now) {
+		return nil
+	}
+
+	volume := s.getVolume(schedule.VolumeName)
+	if volume == nil {
+		return volumeNotFoundError(schedule.VolumeName)
+	}
+	snapshotName := schedule.Name + "-" + now.UTC().Format(SCHEDULE_SNAPSHOT_TIME_FORMAT)
+	op := s.operations.start("schedule "+schedule.Name, schedule.VolumeName, "")
+	defer s.operations.finish(op)
+	if _, err := s.processSnapshotCreate(volume, snapshotName, nil, "", nil); err != nil {
+		return err
+	}
+	schedule.Snapshots = append(schedule.Snapshots, snapshotName)
+	schedule.LastRun = now.Format(time.RubyDate)
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SCHEDULE,
+		LOG_FIELD_SCHEDULE: schedule.Name,
+		LOG_FIELD_VOLUME:   schedule.VolumeName,
+		LOG_FIELD_SNAPSHOT: snapshotName,
+	}).Debug()
+
+	if schedule.Retain != 0 {
+		for len(schedule.Snapshots) > schedule.Retain {
+			oldest := schedule.Snapshots[0]
+			// The snapshot may have been deleted by user
+			if s.SnapshotVolumeIndex.Get(oldest) != "" {
+				if err := s.processSnapshotDelete(oldest); err != nil {
+					// Retry next time, the new snapshot is still recorded
+					log.Warnf("Failed to remove snapshot %v of schedule %v: %v", oldest, schedule.Name, err)
+					break
+				}
+			}
+			schedule.Snapshots = schedule.Snapshots[1:]
+		}
+	}
+	return s.saveScheduleState(schedule)
+}
+
+/*
+saveScheduleState saves LastRun and Snapshots of schedule, which are what the
+runner changes. The rest of the schedule may have been changed while it was
+running, e.g. by the config file of daemon, and is kept. Nothing is saved if
+the schedule has been deleted meanwhile.
+*/
+func (s *daemon) saveScheduleState(schedule *SnapshotSchedule) error {
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+
+	current := s.blankSchedule(schedule.Name)
+	exists, err := s.objectExists(current)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	if err := s.loadObject(current); err != nil {
+		return err
+	}
+	current.LastRun = schedule.LastRun
+	current.Snapshots = schedule.Snapshots
+	return s.saveObject(current)
+}
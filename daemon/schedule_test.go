@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestCronNext(c *C) {
+	base := time.Date(2016, time.March, 4, 10, 7, 30, 0, time.UTC) // Friday
+
+	cron, err := parseCron("*/15 * * * *")
+	c.Assert(err, IsNil)
+	c.Assert(cron.next(base), Equals, time.Date(2016, time.March, 4, 10, 15, 0, 0, time.UTC))
+
+	cron, err = parseCron("0 3 * * 1-5")
+	c.Assert(err, IsNil)
+	c.Assert(cron.next(base), Equals, time.Date(2016, time.March, 7, 3, 0, 0, 0, time.UTC))
+
+	cron, err = parseCron("@daily")
+	c.Assert(err, IsNil)
+	c.Assert(cron.next(base), Equals, time.Date(2016, time.March, 5, 0, 0, 0, 0, time.UTC))
+
+	// Either day of month or day of week matches, Sunday as 7
+	cron, err = parseCron("30 1 1 * 7")
+	c.Assert(err, IsNil)
+	c.Assert(cron.next(base), Equals, time.Date(2016, time.March, 6, 1, 30, 0, 0, time.UTC))
+
+	cron, err = parseCron("0 0 31 2 *")
+	c.Assert(err, IsNil)
+	c.Assert(cron.next(base).IsZero(), Equals, true)
+	c.Assert(cron.due(base, base.Add(CRON_SEARCH_LIMIT)), Equals, false)
+
+	cron, err = parseCron("0 2 * * *")
+	c.Assert(err, IsNil)
+	c.Assert(cron.due(base, time.Date(2016, time.March, 5, 1, 59, 0, 0, time.UTC)), Equals, false)
+	c.Assert(cron.due(base, time.Date(2016, time.March, 5, 2, 0, 0, 0, time.UTC)), Equals, true)
+	c.Assert(cron.due(base, time.Date(2016, time.March, 9, 0, 0, 0, 0, time.UTC)), Equals, true)
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@often"} {
+		_, err = parseCron(expr)
+		c.Assert(err, ErrorMatches, "Invalid cron expression.*", Commentf("%q", expr))
+	}
+}
+
+func (s *TestSuite) TestScheduleRetain(c *C) {
+	d := s.newVFSDaemon(c)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	start := time.Date(2016, time.March, 4, 10, 7, 0, 0, time.Local)
+	schedule := d.blankSchedule("hourly")
+	schedule.VolumeName = "vol1"
+	schedule.Cron = "0 * * * *"
+	schedule.Retain = 2
+	schedule.LastRun = start.Format(time.RubyDate)
+	schedule.Snapshots = []string{}
+
+	// Not due yet
+	c.Assert(d.runSchedule(schedule, start.Add(30*time.Minute)), IsNil)
+	c.Assert(schedule.Snapshots, HasLen, 0)
+
+	var names []string
+	for i := 1; i <= 3; i++ {
+		now := start.Add(time.Duration(i) * time.Hour)
+		c.Assert(d.runSchedule(schedule, now), IsNil)
+		names = append(names, "hourly-"+now.UTC().Format(SCHEDULE_SNAPSHOT_TIME_FORMAT))
+	}
+	c.Assert(schedule.Snapshots, DeepEquals, names[1:])
+	c.Assert(d.SnapshotVolumeIndex.Get(names[0]), Equals, "")
+	c.Assert(d.SnapshotVolumeIndex.Get(names[1]), Equals, "vol1")
+	c.Assert(d.SnapshotVolumeIndex.Get(names[2]), Equals, "vol1")
+
+	// Daemon was down for a while, only one snapshot would be taken
+	c.Assert(d.runSchedule(schedule, start.Add(10*time.Hour)), IsNil)
+	c.Assert(schedule.Snapshots, HasLen, 2)
+	c.Assert(d.runSchedule(schedule, start.Add(10*time.Hour+time.Minute)), IsNil)
+	c.Assert(schedule.Snapshots, HasLen, 2)
+	c.Assert(schedule.Snapshots[1], Equals, "hourly-"+start.Add(10*time.Hour).UTC().Format(SCHEDULE_SNAPSHOT_TIME_FORMAT))
+}
+
+func (s *TestSuite) TestScheduleStateKeepsChanges(c *C) {
+	d := s.newVFSDaemon(c)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	start := time.Date(2016, time.March, 4, 10, 7, 0, 0, time.Local)
+	schedule := d.blankSchedule("hourly")
+	schedule.VolumeName = "vol1"
+	schedule.Cron = "0 * * * *"
+	schedule.LastRun = start.Format(time.RubyDate)
+	schedule.Snapshots = []string{}
+	c.Assert(d.saveObject(schedule), IsNil)
+
+	// Retain is changed while the runner is taking the snapshot
+	changed := d.blankSchedule("hourly")
+	c.Assert(d.loadObject(changed), IsNil)
+	changed.Retain = 5
+	c.Assert(d.saveObject(changed), IsNil)
+
+	c.Assert(d.runSchedule(schedule, start.Add(time.Hour)), IsNil)
+	saved := d.blankSchedule("hourly")
+	c.Assert(d.loadObject(saved), IsNil)
+	c.Assert(saved.Retain, Equals, 5)
+	c.Assert(saved.Snapshots, HasLen, 1)
+	c.Assert(saved.LastRun, Equals, start.Add(time.Hour).Format(time.RubyDate))
+
+	// Deleted schedule isn't saved again by the runner
+	c.Assert(d.deleteObject(saved), IsNil)
+	c.Assert(d.runSchedule(schedule, start.Add(2*time.Hour)), IsNil)
+	exists, err := d.objectExists(d.blankSchedule("hourly"))
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+}
@@ -0,0 +1,565 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/rancher/convoy/api"
+)
+
+const (
+	OPENAPI_VERSION = "3.0.3"
+)
+
+// routeSpec documents an API route in the OpenAPI schema
+type routeSpec struct {
+	Summary string
+	Query   []queryParam
+	// Request is a value of the JSON request body, nil if there is none
+	Request interface{}
+	// Response is a value of the JSON response, an empty string for plain
+	// text response, or a binaryResponse, nil if there is none
+	Response interface{}
+	// VerboseResponse is the JSON response when "Verbose" is asked, instead
+	// of the plain text one
+	VerboseResponse interface{}
+	// Async routes can run as jobs, see asyncHandler
+	Async bool
+}
+
+// binaryResponse is the media type of a binary response, e.g. a tarball
+type binaryResponse string
+
+type queryParam struct {
+	Name        string
+	Description string
+	Boolean     bool
+	Array       bool
+}
+
+var asyncQueryParam = queryParam{
+	Name:        api.KEY_ASYNC,
+	Description: "run the operation as a job, defaults to false in v1 and true in v2",
+	Boolean:     true,
+}
+
+var apiRouteSpecs = map[string]map[string]routeSpec{
+	"GET": {
+		"/info": {
+			Summary:  "Show the config and the driver status of the daemon",
+			Response: map[string]interface{}{},
+		},
+		"/metrics": {
+			Summary:  "Show the metrics in Prometheus text format",
+			Response: "",
+		},
+		"/health": {
+			Summary:  "Check the health of the daemon, drivers and backup destinations, responds 503 if unhealthy",
+			Response: api.HealthResponse{},
+		},
+		"/volumes/list": {
+			Summary: "List volumes",
+			Query: []queryParam{
+				{Name: "driver", Description: "list driver specific information of volumes if 1"},
+				{Name: "filter", Description: "filter volumes by label=<key> or label=<key>=<value>", Array: true},
+			},
+			Response: map[string]api.VolumeResponse{},
+		},
+		"/volumes/": {
+			Summary:  "Inspect a volume",
+			Request:  api.VolumeInspectRequest{},
+			Response: api.VolumeResponse{},
+		},
+		"/snapshots/": {
+			Summary:  "Inspect a snapshot",
+			Request:  api.SnapshotInspectRequest{},
+			Response: api.SnapshotResponse{},
+		},
+		"/snapshots/diff": {
+			Summary:  "List files or block extents changed between two snapshots of a volume",
+			Request:  api.SnapshotDiffRequest{},
+			Response: api.SnapshotDiffResponse{},
+		},
+		"/volumes/backups": {
+			Summary:  "List backups of a volume in all its backup destinations",
+			Request:  api.VolumeBackupsRequest{},
+			Response: map[string]map[string]string{},
+		},
+		"/volumes/export": {
+			Summary:  "Stream the tarball of the current content of a volume, failure after it's started is reported by trailer " + api.ERROR_TRAILER,
+			Request:  api.VolumeExportRequest{},
+			Response: binaryResponse(EXPORT_CONTENT_TYPE),
+		},
+		"/volumes/stats": {
+			Summary:  "Show the IO of the block device of a volume",
+			Request:  api.VolumeStatsRequest{},
+			Response: api.VolumeStatsResponse{},
+		},
+		"/backups/list": {
+			Summary:  "List backups in an objectstore",
+			Request:  api.BackupListRequest{},
+			Response: map[string]map[string]string{},
+		},
+		"/backups/inspect": {
+			Summary:  "Inspect a backup",
+			Request:  api.BackupListRequest{},
+			Response: map[string]string{},
+		},
+		"/backups/estimate": {
+			Summary:  "Estimate the size and duration of restoring a backup, and check whether it can be restored",
+			Request:  api.RestoreEstimateRequest{},
+			Response: api.RestoreEstimateResponse{},
+		},
+		"/policies/list": {
+			Summary:  "List backup policies",
+			Response: map[string]BackupPolicy{},
+		},
+		"/schedules/list": {
+			Summary:  "List snapshot schedules",
+			Response: map[string]SnapshotSchedule{},
+		},
+		"/trash/list": {
+			Summary:  "List volumes and backups in trash",
+			Response: []TrashEntry{},
+		},
+		"/jobs": {
+			Summary:  "List running and recently finished jobs",
+			Response: []api.JobResponse{},
+		},
+		"/jobs/{id}": {
+			Summary:  "Inspect a job",
+			Response: api.JobResponse{},
+		},
+		"/operations": {
+			Summary: "Show the operations in progress, backups being created and volume locks held",
+			Query: []queryParam{
+				{Name: api.KEY_WATCH, Description: "keep streaming the response as JSON objects every interval, e.g. 2s"},
+			},
+			Response: api.OperationsResponse{},
+		},
+		"/events": {
+			Summary: "List the latest events of volumes, snapshots and backups, or follow them as server-sent events",
+			Query: []queryParam{
+				{Name: api.KEY_FOLLOW, Description: "keep streaming events as server-sent events, resuming after Last-Event-ID header if specified", Boolean: true},
+				{Name: "since", Description: "only return events after the event of the ID"},
+				{Name: "volume", Description: "only return events of the volume"},
+				{Name: "event", Description: "only return events of the names", Array: true},
+			},
+			Response: []api.EventResponse{},
+		},
+		"/log/levels": {
+			Summary:  "Show the global log level and the levels of packages overriding it",
+			Response: api.LogLevelsResponse{},
+		},
+		"/audit/list": {
+			Summary: "List audit records",
+			Query: []queryParam{
+				{Name: "since", Description: "only list records since the time, in RFC3339 format"},
+			},
+			Response: []AuditRecord{},
+		},
+		"/schema": {
+			Summary:  "Show the OpenAPI schema of the API version",
+			Response: map[string]interface{}{},
+		},
+	},
+	"POST": {
+		"/volumes/create": {
+			Summary:         "Create a volume, responds its name",
+			Request:         api.VolumeCreateRequest{},
+			Response:        "",
+			VerboseResponse: api.VolumeResponse{},
+			Async:           true,
+		},
+		"/volumes/import": {
+			Summary:         "Import existing data of driver as a volume without copying it, responds its name",
+			Request:         api.VolumeImportRequest{},
+			Response:        "",
+			VerboseResponse: api.VolumeResponse{},
+			Async:           true,
+		},
+		"/volumes/clone": {
+			Summary:         "Create a writable copy of a volume by its driver, responds the name of the copy",
+			Request:         api.VolumeCloneRequest{},
+			Response:        "",
+			VerboseResponse: api.VolumeResponse{},
+			Async:           true,
+		},
+		"/volumes/migrate": {
+			Summary:         "Move an unmounted volume to another driver under the same name, responds its name",
+			Request:         api.VolumeMigrateRequest{},
+			Response:        "",
+			VerboseResponse: api.VolumeResponse{},
+			Async:           true,
+		},
+		"/volumes/mount": {
+			Summary:         "Mount a volume, responds the mount point",
+			Request:         api.VolumeMountRequest{},
+			Response:        "",
+			VerboseResponse: api.VolumeResponse{},
+		},
+		"/volumes/umount": {
+			Summary: "Unmount a volume",
+			Request: api.VolumeUmountRequest{},
+		},
+		"/volumes/force-umount": {
+			Summary: "Unmount a volume lazily even if it's in use, optionally killing the processes using it",
+			Request: api.VolumeForceUmountRequest{},
+		},
+		"/volumes/fence": {
+			Summary: "Force unmount and detach a volume, and keep this host from mounting it until unfenced",
+			Request: api.VolumeFenceRequest{},
+		},
+		"/volumes/unfence": {
+			Summary: "Allow this host to mount a fenced volume again",
+			Request: api.VolumeUnfenceRequest{},
+		},
+		"/volumes/refresh": {
+			Summary:         "Refresh the mount of a volume, responds the mount point",
+			Request:         api.VolumeRefreshRequest{},
+			Response:        "",
+			VerboseResponse: api.VolumeResponse{},
+		},
+		"/volumes/resize": {
+			Summary: "Resize a volume",
+			Request: api.VolumeResizeRequest{},
+		},
+		"/volumes/retention": {
+			Summary:  "Set the snapshot retention of a volume, zero counts for none",
+			Request:  api.VolumeRetentionRequest{},
+			Response: api.SnapshotRetention{},
+		},
+		"/snapshots/create": {
+			Summary:         "Create a snapshot, responds its name",
+			Request:         api.SnapshotCreateRequest{},
+			Response:        "",
+			VerboseResponse: api.SnapshotResponse{},
+			Async:           true,
+		},
+		"/backups/create": {
+			Summary:         "Create a backup of a snapshot, responds its URL",
+			Request:         api.BackupCreateRequest{},
+			Response:        "",
+			VerboseResponse: api.BackupURLResponse{},
+			Async:           true,
+		},
+		"/backups/now": {
+			Summary:         "Create a snapshot of a volume and back it up, deleting the snapshot if the backup fails, responds the URL of backup",
+			Request:         api.BackupNowRequest{},
+			Response:        "",
+			VerboseResponse: api.BackupNowResponse{},
+			Async:           true,
+		},
+		"/backups/copy": {
+			Summary:         "Copy a backup to another objectstore, responds the URL of the copy",
+			Request:         api.BackupCopyRequest{},
+			Response:        "",
+			VerboseResponse: api.BackupURLResponse{},
+			Async:           true,
+		},
+		"/backups/archive": {
+			Summary: "Move a backup to another storage class",
+			Request: api.BackupArchiveRequest{},
+			Async:   true,
+		},
+		"/backups/restore-archive": {
+			Summary: "Request retrieval of an archived backup",
+			Request: api.BackupRestoreArchiveRequest{},
+		},
+		"/backups/restore-file": {
+			Summary: "Restore paths from a backup to a directory of the daemon host",
+			Request: api.BackupRestoreFileRequest{},
+			Async:   true,
+		},
+		"/backups/gc": {
+			Summary:  "Remove shared blocks no backup of the destination refers to",
+			Request:  api.BackupGCRequest{},
+			Response: api.BackupGCResponse{},
+			Async:    true,
+		},
+		"/objectstore/gc": {
+			Summary:  "Remove objects of the destination left by failed backups",
+			Request:  api.ObjectStoreGCRequest{},
+			Response: api.ObjectStoreGCResponse{},
+			Async:    true,
+		},
+		"/policies/create": {
+			Summary:  "Create or update a backup policy",
+			Request:  api.PolicyCreateRequest{},
+			Response: BackupPolicy{},
+		},
+		"/schedules/create": {
+			Summary:  "Create or update a snapshot schedule",
+			Request:  api.ScheduleCreateRequest{},
+			Response: SnapshotSchedule{},
+		},
+		"/trash/restore": {
+			Summary: "Restore a volume or backup from trash",
+			Request: api.TrashRestoreRequest{},
+		},
+		"/doctor": {
+			Summary:  "Reconcile recorded mount points with the actual mounts",
+			Response: api.DoctorResponse{},
+		},
+		"/rescan": {
+			Summary:  "Rebuild indexes of volumes and snapshots from the drivers",
+			Response: api.RescanResponse{},
+		},
+		"/log/level": {
+			Summary:  "Set the global log level or the level of a package until the daemon restarts or reloads its config file",
+			Request:  api.LogLevelRequest{},
+			Response: api.LogLevelsResponse{},
+		},
+	},
+	"DELETE": {
+		"/volumes/": {
+			Summary: "Delete a volume",
+			Request: api.VolumeDeleteRequest{},
+		},
+		"/snapshots/": {
+			Summary: "Delete a snapshot",
+			Request: api.SnapshotDeleteRequest{},
+			Async:   true,
+		},
+		"/backups": {
+			Summary: "Delete a backup",
+			Request: api.BackupDeleteRequest{},
+			Async:   true,
+		},
+		"/policies/": {
+			Summary: "Delete a backup policy",
+			Request: api.PolicyDeleteRequest{},
+		},
+		"/schedules/": {
+			Summary: "Delete a snapshot schedule",
+			Request: api.ScheduleDeleteRequest{},
+		},
+		"/trash": {
+			Summary: "Delete volumes or backups in trash for real",
+			Request: api.TrashPurgeRequest{},
+			Async:   true,
+		},
+	},
+}
+
+// schemaBuilder generates JSON schemas of Go types, putting structs in
+// components so they can be referred by name
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func (b *schemaBuilder) schemaOf(t reflect.Type) map[string]interface{} {
+	if t == rawMessageType {
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schemaOf(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaOf(t.Elem())}
+	case reflect.Struct:
+		return b.structRef(t)
+	}
+	// Interfaces can be anything
+	return map[string]interface{}{}
+}
+
+func (b *schemaBuilder) structRef(t reflect.Type) map[string]interface{} {
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	if _, exists := b.components[t.Name()]; exists {
+		return ref
+	}
+	properties := map[string]interface{}{}
+	// Registered before the fields in case of recursive types
+	b.components[t.Name()] = map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		properties[name] = b.schemaOf(field.Type)
+	}
+	return ref
+}
+
+// addContent adds the response v to content by media type, which would be
+// one of the JSON responses if there is one already
+func (b *schemaBuilder) addContent(content map[string]interface{}, v interface{}) {
+	mediaType := "application/json"
+	schema := map[string]interface{}{"type": "string"}
+	if s, ok := v.(string); ok && s == "" {
+		mediaType = "text/plain"
+	} else if t, ok := v.(binaryResponse); ok {
+		mediaType = string(t)
+		schema["format"] = "binary"
+	} else {
+		schema = b.schemaOf(reflect.TypeOf(v))
+	}
+	if existing, ok := content[mediaType].(map[string]interface{}); ok {
+		schema = map[string]interface{}{
+			"oneOf": []interface{}{existing["schema"], schema},
+		}
+	}
+	content[mediaType] = map[string]interface{}{"schema": schema}
+}
+
+func (b *schemaBuilder) content(responses ...interface{}) map[string]interface{} {
+	content := map[string]interface{}{}
+	for _, v := range responses {
+		if v != nil {
+			b.addContent(content, v)
+		}
+	}
+	return content
+}
+
+func (b *schemaBuilder) operation(version, route string, spec routeSpec) map[string]interface{} {
+	parameters := []interface{}{}
+	for _, part := range strings.Split(route, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     strings.Trim(part, "{}"),
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	query := spec.Query
+	if spec.Async {
+		query = append([]queryParam{asyncQueryParam}, query...)
+	}
+	for _, q := range query {
+		schema := map[string]interface{}{"type": "string"}
+		if q.Boolean {
+			schema["type"] = "boolean"
+		}
+		if q.Array {
+			schema = map[string]interface{}{"type": "array", "items": schema}
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name":        q.Name,
+			"in":          "query",
+			"description": q.Description,
+			"schema":      schema,
+		})
+	}
+
+	description := "Succeeded"
+	if spec.VerboseResponse != nil {
+		description += ", in JSON if Verbose is requested"
+	}
+	success := b.content(spec.Response, spec.VerboseResponse)
+	responses := map[string]interface{}{
+		"default": map[string]interface{}{
+			"description": "Failed, with the code of error",
+			"content":     b.content(api.Error{}),
+		},
+	}
+	if spec.Async && version == api.API_VERSION {
+		b.addContent(success, api.JobResponse{})
+		description += ", or the job if async is requested"
+	} else if spec.Async {
+		responses["202"] = map[string]interface{}{
+			"description": "Started a job for the operation",
+			"headers": map[string]interface{}{
+				"Location": map[string]interface{}{
+					"description": "Path of the job",
+					"schema":      map[string]interface{}{"type": "string"},
+				},
+			},
+			"content": b.content(api.JobResponse{}),
+		}
+	}
+	ok := map[string]interface{}{"description": description}
+	if len(success) != 0 {
+		ok["content"] = success
+	}
+	responses["200"] = ok
+
+	result := map[string]interface{}{
+		"summary":   spec.Summary,
+		"responses": responses,
+	}
+	if len(parameters) != 0 {
+		result["parameters"] = parameters
+	}
+	if spec.Request != nil {
+		result["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  b.content(spec.Request),
+		}
+	}
+	return result
+}
+
+// openAPISchema generates the OpenAPI document of the API version, with the
+// paths relative to "/v<version>"
+func openAPISchema(version string) (map[string]interface{}, error) {
+	if !isSupportedAPIVersion(version) {
+		return nil, fmt.Errorf("API version %v is not supported", version)
+	}
+	b := &schemaBuilder{
+		components: map[string]interface{}{},
+	}
+	paths := map[string]interface{}{}
+	for method, routes := range apiRouteSpecs {
+		for route, spec := range routes {
+			item, exists := paths[route].(map[string]interface{})
+			if !exists {
+				item = map[string]interface{}{}
+				paths[route] = item
+			}
+			item[strings.ToLower(method)] = b.operation(version, route, spec)
+		}
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   "Convoy",
+			"version": version,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": "/v" + version},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+		},
+	}, nil
+}
+
+func (s *daemon) doSchema(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	schema, err := openAPISchema(version)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return writeResponseOutput(w, schema)
+}
@@ -0,0 +1,134 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestAPIRouteSpecs(c *C) {
+	d := s.newVFSDaemon(c)
+	routes := d.apiRoutes()
+	c.Assert(apiRouteSpecs, HasLen, len(routes))
+	for method := range routes {
+		c.Assert(apiRouteSpecs[method], HasLen, len(routes[method]), Commentf("%v", method))
+		for route := range routes[method] {
+			spec, exists := apiRouteSpecs[method][route]
+			c.Assert(exists, Equals, true, Commentf("%v %v is not documented", method, route))
+			c.Assert(spec.Summary, Not(Equals), "")
+		}
+	}
+}
+
+func (s *TestSuite) TestSchema(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	getSchema := func(path string) map[string]interface{} {
+		w := s.serveRequest(c, router, "GET", path, nil)
+		c.Assert(w.Code, Equals, http.StatusOK)
+		schema := map[string]interface{}{}
+		c.Assert(json.Unmarshal(w.Body.Bytes(), &schema), IsNil)
+		return schema
+	}
+	operation := func(schema map[string]interface{}, route, method string) map[string]interface{} {
+		return schema["paths"].(map[string]interface{})[route].(map[string]interface{})[method].(map[string]interface{})
+	}
+
+	v1 := getSchema("/v1/schema")
+	c.Assert(v1["openapi"], Equals, OPENAPI_VERSION)
+	c.Assert(v1["servers"], DeepEquals, []interface{}{map[string]interface{}{"url": "/v1"}})
+	c.Assert(v1["paths"], HasLen, len(getSchema("/schema")["paths"].(map[string]interface{})))
+
+	schemas := v1["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	properties := schemas["VolumeCreateRequest"].(map[string]interface{})["properties"].(map[string]interface{})
+	c.Assert(properties["Size"], DeepEquals, map[string]interface{}{"type": "integer", "format": "int64"})
+	c.Assert(properties["Labels"], DeepEquals, map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"type": "string"},
+	})
+	properties = schemas["VolumeResponse"].(map[string]interface{})["properties"].(map[string]interface{})
+	c.Assert(properties["Snapshots"], DeepEquals, map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"$ref": "#/components/schemas/SnapshotResponse"},
+	})
+
+	// Job is one of the responses of v1, while v2 responds 202 for it
+	create := operation(v1, "/volumes/create", "post")
+	responses := create["responses"].(map[string]interface{})
+	c.Assert(responses["202"], IsNil)
+	content := responses["200"].(map[string]interface{})["content"].(map[string]interface{})
+	c.Assert(content["text/plain"], NotNil)
+	c.Assert(content["application/json"], DeepEquals, map[string]interface{}{
+		"schema": map[string]interface{}{
+			"oneOf": []interface{}{
+				map[string]interface{}{"$ref": "#/components/schemas/VolumeResponse"},
+				map[string]interface{}{"$ref": "#/components/schemas/JobResponse"},
+			},
+		},
+	})
+
+	v2 := getSchema("/v2/schema")
+	c.Assert(v2["servers"], DeepEquals, []interface{}{map[string]interface{}{"url": "/v2"}})
+	responses = operation(v2, "/volumes/create", "post")["responses"].(map[string]interface{})
+	c.Assert(responses["202"], NotNil)
+	content = responses["200"].(map[string]interface{})["content"].(map[string]interface{})
+	c.Assert(content["application/json"], DeepEquals, map[string]interface{}{
+		"schema": map[string]interface{}{"$ref": "#/components/schemas/VolumeResponse"},
+	})
+	parameters := operation(v2, "/jobs/{id}", "get")["parameters"].([]interface{})
+	c.Assert(parameters, HasLen, 1)
+	c.Assert(parameters[0].(map[string]interface{})["in"], Equals, "path")
+
+	w := s.serveRequest(c, router, "GET", "/v3/schema", nil)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	s.assertError(c, w, api.ERROR_CODE_NOT_FOUND, "API version 3 is not supported, supported versions are 1, 2")
+}
+
+func (s *TestSuite) TestAPIVersion(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	// v1 only runs jobs on request
+	w := s.serveRequest(c, router, "POST", "/v1/snapshots/create", &api.SnapshotCreateRequest{
+		Name:       "snap1",
+		VolumeName: "vol1",
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "snap1")
+
+	// v2 runs jobs unless asked otherwise
+	w = s.serveRequest(c, router, "POST", "/v2/snapshots/create", &api.SnapshotCreateRequest{
+		Name:       "snap2",
+		VolumeName: "vol1",
+	})
+	c.Assert(w.Code, Equals, http.StatusAccepted)
+	job := &api.JobResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), job), IsNil)
+	c.Assert(w.Header().Get("Location"), Equals, "/v2/jobs/"+job.ID)
+	job = s.waitJob(c, router, job.ID)
+	c.Assert(job.Status, Equals, api.JOB_STATUS_SUCCEEDED)
+	c.Assert(job.Result, Equals, "snap2")
+
+	w = s.serveRequest(c, router, "POST", "/v2/snapshots/create?async=false", &api.SnapshotCreateRequest{
+		Name:       "snap3",
+		VolumeName: "vol1",
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, "snap3")
+
+	r := httptest.NewRequest("GET", "/v1/volumes/list", nil)
+	r.Header.Set("User-Agent", "Convoy-Client/3")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	c.Assert(w.Code, Equals, http.StatusNotFound)
+	s.assertError(c, w, api.ERROR_CODE_NOT_FOUND, "client version 3 is not supported by server.*")
+}
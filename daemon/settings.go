@@ -0,0 +1,526 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/go-ini/ini"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	SETTINGS_SECTION_DAEMON          = "daemon"
+	SETTINGS_SECTION_DRIVER_OPTS     = "driver_opts"
+	SETTINGS_SECTION_RATE_LIMIT      = "rate_limit"
+	SETTINGS_SECTION_SCHEDULE_PREFIX = "schedule."
+	SETTINGS_SECTION_HOOK_PREFIX     = "hook."
+
+	DEFAULT_LOG_LEVEL = "debug"
+)
+
+// daemonSettingFlags maps the keys of daemon section to the command line
+// flags they replace
+var daemonSettingFlags = map[string]string{
+	"root":                   "root",
+	"log":                    "log",
+	"log_level":              "log-level",
+	"log_package_levels":     "log-package-levels",
+	"log_format":             "log-format",
+	"log_max_size":           "log-max-size",
+	"log_max_age":            "log-max-age",
+	"log_max_backups":        "log-max-backups",
+	"drivers":                "drivers",
+	"mnt_ns":                 "mnt-ns",
+	"ignore_docker_delete":   "ignore-docker-delete",
+	"create_on_docker_mount": "create-on-docker-mount",
+	"docker_volume_opts":     "docker-volume-opts",
+	"cmd_timeout":            "cmd-timeout",
+	"driver_init_mode":       "driver-init-mode",
+	"plugin_scope":           "plugin-scope",
+	"backup_concurrency":     "backup-concurrency",
+	"backup_shared_blocks":   "backup-shared-blocks",
+	"backup_checksum":        "backup-checksum",
+	"staging_dir":            "staging-dir",
+	"audit_log":              "audit-log",
+	"metadata_store":         "metadata-store",
+	"cluster_host":           "cluster-host",
+	"cmd_retries":            "cmd-retries",
+	"cmd_retry_backoff":      "cmd-retry-backoff",
+	"cmd_retry_on":           "cmd-retry-on",
+	"cmd_timeouts":           "cmd-timeouts",
+	"operation_timeouts":     "operation-timeouts",
+	"trash_grace_period":     "trash-grace-period",
+	"trash_backups":          "trash-backups",
+	"objectstore_http":       "objectstore-http",
+}
+
+// Daemon settings applied by reload, the others need a restart. Driver
+// options never change without a restart either.
+var reloadableSettings = map[string]bool{
+	"log_level":          true,
+	"log_package_levels": true,
+	"backup_concurrency": true,
+}
+
+/*
+settingsFile is the daemon configuration file specified by --config, in the
+subset of TOML made of sections, and keys of strings, numbers, booleans or
+arrays of strings, e.g.:
+
+	[daemon]
+	drivers = ["devicemapper", "vfs"]
+	log_level = "info"
+
+	[driver_opts]
+	dm.datadev = "/dev/loop0"
+
+	[rate_limit]
+	requests_per_second = 10
+	burst = 20
+
+	[schedule.nightly]
+	volume = "vol1"
+	cron = "0 2 * * *"
+	retain = 7
+
+	[hook.slack]
+	url = "https://hooks.slack.com/services/..."
+	format = "slack"
+	events = ["backup.failed"]
+
+	[profile.fast]
+	driver = "ebs"
+	type = "gp3"
+	iops = 8000
+
+Settings in the file take precedence over command line flags and the config
+saved in root directory.
+*/
+type settingsFile struct {
+	Path       string
+	Daemon     map[string]string
+	DriverOpts map[string]string
+	RateLimit  rateLimit
+	Schedules  map[string]*SnapshotSchedule
+	Hooks      []*hook
+	Profiles   map[string]*volumeProfile
+}
+
+func loadSettingsFile(path string) (*settingsFile, error) {
+	f, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load config file %v: %v", path, err)
+	}
+	settings := &settingsFile{
+		Path:       path,
+		Daemon:     map[string]string{},
+		DriverOpts: map[string]string{},
+		Schedules:  map[string]*SnapshotSchedule{},
+		Profiles:   map[string]*volumeProfile{},
+	}
+	for _, section := range f.Sections() {
+		name := section.Name()
+		values := section.KeysHash()
+		var err error
+		switch {
+		case name == ini.DEFAULT_SECTION:
+			if len(values) != 0 {
+				err = fmt.Errorf("settings must be in a section, e.g. [%v]", SETTINGS_SECTION_DAEMON)
+			}
+		case name == SETTINGS_SECTION_DAEMON:
+			for key, value := range values {
+				if _, exists := daemonSettingFlags[key]; !exists {
+					err = fmt.Errorf("unknown setting %v in section [%v]", key, name)
+					break
+				}
+				settings.Daemon[key] = value
+			}
+		case name == SETTINGS_SECTION_DRIVER_OPTS:
+			settings.DriverOpts = values
+		case name == SETTINGS_SECTION_RATE_LIMIT:
+			settings.RateLimit, err = parseRateLimit(values)
+		case strings.HasPrefix(name, SETTINGS_SECTION_SCHEDULE_PREFIX):
+			scheduleName := strings.TrimPrefix(name, SETTINGS_SECTION_SCHEDULE_PREFIX)
+			settings.Schedules[scheduleName], err = parseScheduleSettings(scheduleName, values)
+		case strings.HasPrefix(name, SETTINGS_SECTION_HOOK_PREFIX):
+			var h *hook
+			h, err = parseHookSettings(strings.TrimPrefix(name, SETTINGS_SECTION_HOOK_PREFIX), values)
+			settings.Hooks = append(settings.Hooks, h)
+		case strings.HasPrefix(name, SETTINGS_SECTION_PROFILE_PREFIX):
+			profileName := strings.TrimPrefix(name, SETTINGS_SECTION_PROFILE_PREFIX)
+			settings.Profiles[profileName], err = parseProfileSettings(profileName, values)
+		default:
+			err = fmt.Errorf("unknown section [%v]", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config file %v: %v", path, err)
+		}
+	}
+	if _, err := parseLogLevel(settings.Daemon["log_level"]); err != nil {
+		return nil, fmt.Errorf("Invalid config file %v: %v", path, err)
+	}
+	if err := validateProfiles(settings.Profiles); err != nil {
+		return nil, fmt.Errorf("Invalid config file %v: %v", path, err)
+	}
+	if err := applyDaemonSettings(settings.Daemon, &daemonConfig{}); err != nil {
+		return nil, fmt.Errorf("Invalid config file %v: %v", path, err)
+	}
+	return settings, nil
+}
+
+// parseList parses an array of strings, either in TOML like ["a", "b"], or
+// separated by commas
+func parseList(value string) []string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		value = value[1 : len(value)-1]
+	}
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.Trim(strings.TrimSpace(item), `"'`)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseRateLimit(values map[string]string) (rateLimit, error) {
+	limit := rateLimit{}
+	for key, value := range values {
+		var err error
+		switch key {
+		case "requests_per_second":
+			limit.RequestsPerSecond, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			limit.Burst, err = strconv.Atoi(value)
+		default:
+			return limit, fmt.Errorf("unknown setting %v in section [%v]", key, SETTINGS_SECTION_RATE_LIMIT)
+		}
+		if err != nil {
+			return limit, fmt.Errorf("invalid %v %v of section [%v]", key, value, SETTINGS_SECTION_RATE_LIMIT)
+		}
+	}
+	return limit, limit.validate()
+}
+
+func parseScheduleSettings(name string, values map[string]string) (*SnapshotSchedule, error) {
+	if name == "" || !util.ValidateName(name) {
+		return nil, fmt.Errorf("invalid schedule name %q", name)
+	}
+	schedule := &SnapshotSchedule{
+		Name: name,
+	}
+	for key, value := range values {
+		switch key {
+		case "volume":
+			schedule.VolumeName = value
+		case "cron":
+			schedule.Cron = value
+		case "retain":
+			retain, err := strconv.Atoi(value)
+			if err != nil || retain < 0 {
+				return nil, fmt.Errorf("invalid retain count %v of schedule %v", value, name)
+			}
+			schedule.Retain = retain
+		default:
+			return nil, fmt.Errorf("unknown setting %v of schedule %v", key, name)
+		}
+	}
+	if schedule.VolumeName == "" {
+		return nil, fmt.Errorf("schedule %v must have a volume", name)
+	}
+	if _, err := parseCron(schedule.Cron); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+func parseLogLevel(level string) (logrus.Level, error) {
+	if level == "" {
+		level = DEFAULT_LOG_LEVEL
+	}
+	return logrus.ParseLevel(level)
+}
+
+// applyDaemonSettings overrides config with the settings of daemon section.
+// The settings of logging and root directory are not part of config, they
+// are only validated.
+func applyDaemonSettings(settings map[string]string, config *daemonConfig) error {
+	for key, value := range settings {
+		var err error
+		switch key {
+		case "log_package_levels":
+			_, err = parsePackageLevels(parseList(value))
+		case "log_format":
+			err = validateLogFormat(value)
+		case "log_max_size":
+			_, err = parseLogMaxSize(value)
+		case "log_max_age":
+			_, err = parseLogMaxAge(value)
+		case "log_max_backups":
+			_, err = parseLogMaxBackups(value)
+		case "drivers":
+			list := parseList(value)
+			if len(list) == 0 {
+				return fmt.Errorf("%v cannot be empty", key)
+			}
+			config.DriverList = list
+			config.DefaultDriver = list[0]
+		case "mnt_ns":
+			config.MountNamespaceFD = value
+		case "ignore_docker_delete":
+			config.IgnoreDockerDelete, err = strconv.ParseBool(value)
+		case "create_on_docker_mount":
+			config.CreateOnDockerMount, err = strconv.ParseBool(value)
+		case "docker_volume_opts":
+			config.DockerVolumeOpts, err = strconv.ParseBool(value)
+		case "cmd_timeout":
+			config.CmdTimeout = value
+		case "driver_init_mode":
+			config.DriverInitMode = value
+			err = validateDriverInitMode(value)
+		case "plugin_scope":
+			config.PluginScope = value
+			err = validatePluginScope(value)
+		case "backup_concurrency":
+			config.BackupConcurrency, err = strconv.Atoi(value)
+			if err == nil && config.BackupConcurrency < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "backup_shared_blocks":
+			config.BackupSharedBlocks, err = strconv.ParseBool(value)
+		case "backup_checksum":
+			config.BackupChecksum = value
+			err = util.ValidateChecksumAlgorithm(value)
+		case "staging_dir":
+			config.StagingDir = value
+		case "audit_log":
+			config.AuditLog = value
+		case "metadata_store":
+			config.MetadataStore = value
+		case "cluster_host":
+			config.ClusterHost = value
+		case "cmd_retries":
+			config.CmdRetries, err = strconv.Atoi(value)
+			if err == nil && config.CmdRetries < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "cmd_retry_backoff":
+			config.CmdRetryBackoff = value
+		case "cmd_retry_on":
+			config.CmdRetryOn = parseList(value)
+		case "cmd_timeouts":
+			config.CmdTimeouts = parseList(value)
+		case "operation_timeouts":
+			config.OperationTimeouts = parseList(value)
+			_, err = parseOperationTimeouts(config.OperationTimeouts)
+		case "trash_grace_period":
+			config.TrashGracePeriod = value
+			_, err = parseTrashGracePeriod(value)
+		case "trash_backups":
+			config.TrashBackups, err = strconv.ParseBool(value)
+		case "objectstore_http":
+			config.ObjectStoreHTTP = parseList(value)
+			err = objectstore.ValidateHTTPConfig(config.ObjectStoreHTTP)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %v %v: %v", key, value, err)
+		}
+	}
+	return nil
+}
+
+// getSetting returns the value of key in daemon section of settings if it's
+// set, otherwise the value of the corresponding flag
+func getSetting(c *cli.Context, settings *settingsFile, key string) string {
+	if settings != nil {
+		if value, exists := settings.Daemon[key]; exists {
+			return value
+		}
+	}
+	return c.String(daemonSettingFlags[key])
+}
+
+func setLogLevel(level string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	SetLevel(l)
+	return nil
+}
+
+/*
+syncSettingsSchedules makes the schedules defined by config file exactly the
+ones in schedules. Schedules defined by the file before but removed from it
+are deleted, while LastRun and Snapshots of the existing ones are kept.
+Schedules created by API with the same name are taken over.
+*/
+func (s *daemon) syncSettingsSchedules(schedules map[string]*SnapshotSchedule) error {
+	s.scheduleLock.Lock()
+	defer s.scheduleLock.Unlock()
+
+	existing, err := s.listSchedules()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	current := map[string]*SnapshotSchedule{}
+	for _, schedule := range existing {
+		current[schedule.Name] = schedule
+	}
+
+	for _, schedule := range existing {
+		if _, defined := schedules[schedule.Name]; defined || !schedule.FromSettings {
+			continue
+		}
+		if err := s.deleteObject(schedule); err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+			LOG_FIELD_EVENT:    LOG_EVENT_DELETE,
+			LOG_FIELD_OBJECT:   LOG_OBJECT_SCHEDULE,
+			LOG_FIELD_SCHEDULE: schedule.Name,
+		}).Debug("Deleted schedule removed from config file")
+	}
+
+	for _, name := range names {
+		defined := schedules[name]
+		schedule, exists := current[name]
+		if !exists {
+			schedule = s.blankSchedule(name)
+			// The first snapshot would be taken at the next matching time
+			schedule.LastRun = time.Now().Format(time.RubyDate)
+			schedule.Snapshots = []string{}
+		} else if schedule.FromSettings && schedule.VolumeName == defined.VolumeName &&
+			schedule.Cron == defined.Cron && schedule.Retain == defined.Retain {
+			continue
+		}
+		if s.getVolume(defined.VolumeName) == nil {
+			log.Warnf("Volume %v of schedule %v in config file doesn't exist", defined.VolumeName, name)
+		}
+		schedule.VolumeName = defined.VolumeName
+		schedule.Cron = defined.Cron
+		schedule.Retain = defined.Retain
+		schedule.FromSettings = true
+		if err := s.saveObject(schedule); err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+			LOG_FIELD_EVENT:    LOG_EVENT_CREATE,
+			LOG_FIELD_OBJECT:   LOG_OBJECT_SCHEDULE,
+			LOG_FIELD_SCHEDULE: schedule.Name,
+			LOG_FIELD_VOLUME:   schedule.VolumeName,
+		}).Debug("Updated schedule from config file")
+	}
+	return nil
+}
+
+/*
+applySettings applies the settings which can be changed while the daemon is
+running. The log levels fall back to the ones of command line. Everything is
+validated first, and the schedules, which are the only ones saved to the
+metadata store, are synced before the others are applied, so nothing else is
+applied if either fails.
+*/
+func (s *daemon) applySettings(settings *settingsFile) error {
+	level, exists := settings.Daemon["log_level"]
+	if !exists {
+		level = s.logLevelFlag
+	}
+	logLevel, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	packageLevels := s.logPackageLevelsFlag
+	if value, exists := settings.Daemon["log_package_levels"]; exists {
+		packageLevels = parseList(value)
+	}
+	levels, err := parsePackageLevels(packageLevels)
+	if err != nil {
+		return err
+	}
+	if err := s.syncSettingsSchedules(settings.Schedules); err != nil {
+		return err
+	}
+	SetLevel(logLevel)
+	SetPackageLevels(levels)
+	s.rateLimiter.setLimit(settings.RateLimit)
+	s.notifier.setHooks(settings.Hooks)
+	s.profiles.set(settings.Profiles)
+	return nil
+}
+
+/*
+reloadSettings reloads the config file on SIGHUP. The log levels, backup
+concurrency, rate limit, schedules, hooks and profiles are applied right away.
+Changes of other settings are only logged, since they need a restart.
+Removing the backup concurrency keeps the current one. Nothing is applied if
+the file is invalid, or the schedules in it fail to be synced.
+*/
+func (s *daemon) reloadSettings() error {
+	settings, err := loadSettingsFile(s.settings.Path)
+	if err != nil {
+		return err
+	}
+	keys := map[string]bool{}
+	for key := range s.settings.Daemon {
+		keys[key] = true
+	}
+	for key := range settings.Daemon {
+		keys[key] = true
+	}
+	for key := range keys {
+		if !reloadableSettings[key] && settings.Daemon[key] != s.settings.Daemon[key] {
+			log.Warnf("Setting %v in config file changed, restart the daemon to apply it", key)
+		}
+	}
+	if !mapEquals(settings.DriverOpts, s.settings.DriverOpts) {
+		log.Warnf("Driver options in config file changed, restart the daemon to apply them")
+	}
+
+	concurrency := 0
+	if value, exists := settings.Daemon["backup_concurrency"]; exists {
+		if concurrency, err = strconv.Atoi(value); err != nil || concurrency < 1 {
+			return fmt.Errorf("Invalid backup_concurrency %v of config file %v, must be at least 1", value, settings.Path)
+		}
+	}
+	if err := s.applySettings(settings); err != nil {
+		return err
+	}
+	if concurrency != 0 {
+		if err := objectstore.SetConcurrency(concurrency); err != nil {
+			return err
+		}
+	}
+	s.settings = settings
+	log.Infof("Reloaded config file %v", settings.Path)
+	return nil
+}
+
+func mapEquals(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if v, exists := b[key]; !exists || v != value {
+			return false
+		}
+	}
+	return true
+}
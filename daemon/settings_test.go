@@ -0,0 +1,250 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) writeSettingsFile(c *C, content string) string {
+	path := filepath.Join(s.root, "convoy.toml")
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0600), IsNil)
+	return path
+}
+
+func (s *TestSuite) TestLoadSettingsFile(c *C) {
+	path := s.writeSettingsFile(c, `
+# Convoy daemon
+[daemon]
+drivers = ["vfs", "devicemapper"]
+log_level = "info"
+ignore_docker_delete = true
+backup_concurrency = 8
+staging_dir = "/var/lib/convoy-staging"
+
+[driver_opts]
+vfs.path = "/opt/convoy"
+
+[rate_limit]
+requests_per_second = 2.5
+
+[schedule.nightly]
+volume = "vol1"
+cron = "0 2 * * *"
+retain = 7
+
+[hook.page]
+command = """/usr/local/bin/page; logger -t convoy failed"""
+events = ["backup.failed"]
+
+[profile.fast]
+driver = "ebs"
+type = "gp3"
+iops = 8000
+tags = "tier=fast"
+default = true
+`)
+	settings, err := loadSettingsFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(settings.DriverOpts, DeepEquals, map[string]string{"vfs.path": "/opt/convoy"})
+	c.Assert(settings.RateLimit, Equals, rateLimit{RequestsPerSecond: 2.5})
+	c.Assert(settings.Schedules, HasLen, 1)
+	c.Assert(*settings.Schedules["nightly"], DeepEquals, SnapshotSchedule{
+		Name:       "nightly",
+		VolumeName: "vol1",
+		Cron:       "0 2 * * *",
+		Retain:     7,
+	})
+	c.Assert(settings.Hooks, HasLen, 1)
+	c.Assert(settings.Hooks[0].Command, Equals, "/usr/local/bin/page; logger -t convoy failed")
+	c.Assert(settings.Profiles, HasLen, 1)
+	c.Assert(*settings.Profiles["fast"], DeepEquals, volumeProfile{
+		Name:    "fast",
+		Default: true,
+		Options: api.VolumeCreateRequest{
+			DriverName: "ebs",
+			Type:       "gp3",
+			IOPS:       8000,
+			Tags:       map[string]string{"tier": "fast"},
+		},
+	})
+
+	config := &daemonConfig{
+		DriverList:        []string{"devicemapper"},
+		CmdTimeout:        "2m",
+		BackupConcurrency: 4,
+	}
+	c.Assert(applyDaemonSettings(settings.Daemon, config), IsNil)
+	c.Assert(config.DriverList, DeepEquals, []string{"vfs", "devicemapper"})
+	c.Assert(config.DefaultDriver, Equals, "vfs")
+	c.Assert(config.IgnoreDockerDelete, Equals, true)
+	c.Assert(config.BackupConcurrency, Equals, 8)
+	c.Assert(config.StagingDir, Equals, "/var/lib/convoy-staging")
+	c.Assert(config.CmdTimeout, Equals, "2m")
+
+	for content, message := range map[string]string{
+		"drivers = vfs":                                       ".*settings must be in a section.*",
+		"[daemon]\nlisten = 0.0.0.0:9600":                     ".*unknown setting listen in section \\[daemon\\]",
+		"[volumes]":                                           ".*unknown section \\[volumes\\]",
+		"[daemon]\nlog_level = loud":                          ".*not a valid logrus Level.*",
+		"[daemon]\nbackup_concurrency = 0":                    ".*invalid backup_concurrency 0.*",
+		"[daemon]\nlog_package_levels = objectstore":          ".*invalid package log level objectstore, must be <package>=<level>",
+		"[daemon]\nlog_format = xml":                          ".*invalid log_format xml: log format must be text or json",
+		"[daemon]\nlog_max_age = -1h":                         ".*invalid log_max_age -1h: must not be negative",
+		"[daemon]\nplugin_scope = cluster":                    ".*invalid plugin_scope cluster.*",
+		"[daemon]\ntrash_grace_period = -1h":                  ".*invalid trash_grace_period -1h: must not be negative",
+		"[rate_limit]\nrequests_per_second = -1":              ".*Invalid rate limit -1.*",
+		"[schedule.hourly]\ncron = \"0 * * * *\"":             ".*schedule hourly must have a volume",
+		"[schedule.hourly]\nvolume = vol1\ncron = \"@often\"": "Invalid config file .*: Invalid cron expression.*",
+		"[hook.page]\nformat = slack":                         ".*hook page must have either url or command",
+		"[profile.fast]\niops = many":                         ".*invalid iops many of profile fast.*",
+		"[profile.fast]\nspeed = 9":                           ".*unknown setting speed of profile fast",
+		"[profile.fast]\ndefault = true":                      ".*default profile fast must have a driver",
+	} {
+		_, err := loadSettingsFile(s.writeSettingsFile(c, content))
+		c.Assert(err, ErrorMatches, message, Commentf("%q", content))
+	}
+}
+
+func (s *TestSuite) TestSyncSettingsSchedules(c *C) {
+	d := s.newVFSDaemon(c)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	// Schedules created by API are left alone
+	manual := d.blankSchedule("manual")
+	manual.VolumeName = "vol1"
+	manual.Cron = "@daily"
+	manual.LastRun = time.Now().Format(time.RubyDate)
+	manual.Snapshots = []string{}
+	c.Assert(util.ObjectSave(manual), IsNil)
+
+	c.Assert(d.syncSettingsSchedules(map[string]*SnapshotSchedule{
+		"nightly": {Name: "nightly", VolumeName: "vol1", Cron: "0 2 * * *", Retain: 7},
+	}), IsNil)
+	schedules, err := d.listSchedules()
+	c.Assert(err, IsNil)
+	c.Assert(schedules, HasLen, 2)
+	c.Assert(schedules[0].Name, Equals, "manual")
+	c.Assert(schedules[0].FromSettings, Equals, false)
+	c.Assert(schedules[1].Name, Equals, "nightly")
+	c.Assert(schedules[1].FromSettings, Equals, true)
+	c.Assert(schedules[1].Retain, Equals, 7)
+
+	// History of schedule is kept when it's changed
+	nightly := schedules[1]
+	nightly.Snapshots = []string{"nightly-20160304-020000"}
+	c.Assert(util.ObjectSave(nightly), IsNil)
+	c.Assert(d.syncSettingsSchedules(map[string]*SnapshotSchedule{
+		"nightly": {Name: "nightly", VolumeName: "vol1", Cron: "0 3 * * *", Retain: 3},
+	}), IsNil)
+	schedules, err = d.listSchedules()
+	c.Assert(err, IsNil)
+	c.Assert(schedules, HasLen, 2)
+	c.Assert(schedules[1].Cron, Equals, "0 3 * * *")
+	c.Assert(schedules[1].Retain, Equals, 3)
+	c.Assert(schedules[1].LastRun, Equals, nightly.LastRun)
+	c.Assert(schedules[1].Snapshots, DeepEquals, nightly.Snapshots)
+
+	// Schedules defined by config file cannot be deleted by API
+	w := s.serveRequest(c, createRouter(d), "DELETE", "/schedules/", &api.ScheduleDeleteRequest{Name: "nightly"})
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	s.assertError(c, w, api.ERROR_CODE_UNKNOWN, "Schedule nightly is defined by config file.*")
+
+	c.Assert(d.syncSettingsSchedules(map[string]*SnapshotSchedule{}), IsNil)
+	schedules, err = d.listSchedules()
+	c.Assert(err, IsNil)
+	c.Assert(schedules, HasLen, 1)
+	c.Assert(schedules[0].Name, Equals, "manual")
+}
+
+func (s *TestSuite) TestReloadSettings(c *C) {
+	d := s.newVFSDaemon(c)
+	defer logrus.SetLevel(logrus.DebugLevel)
+	defer SetPackageLevels(nil)
+	defer objectstore.SetConcurrency(objectstore.DEFAULT_CONCURRENCY)
+
+	path := s.writeSettingsFile(c, "[daemon]\nlog_level = info\n")
+	settings, err := loadSettingsFile(path)
+	c.Assert(err, IsNil)
+	d.settings = settings
+	c.Assert(d.applySettings(settings), IsNil)
+	c.Assert(logrus.GetLevel(), Equals, logrus.InfoLevel)
+	c.Assert(d.rateLimiter.allow(time.Now()), Equals, true)
+
+	s.writeSettingsFile(c, `
+[daemon]
+log_level = warning
+log_package_levels = ["objectstore=debug"]
+backup_concurrency = 2
+
+[rate_limit]
+requests_per_second = 1
+`)
+	c.Assert(d.reloadSettings(), IsNil)
+	level, levels := GetLevels()
+	c.Assert(level, Equals, logrus.WarnLevel)
+	c.Assert(levels, DeepEquals, map[string]logrus.Level{"objectstore": logrus.DebugLevel})
+	// Logrus passes the debug logs for the formatter to filter them
+	c.Assert(logrus.GetLevel(), Equals, logrus.DebugLevel)
+	now := time.Now()
+	c.Assert(d.rateLimiter.allow(now), Equals, true)
+	c.Assert(d.rateLimiter.allow(now), Equals, false)
+
+	// Invalid file is not applied
+	s.writeSettingsFile(c, "[daemon]\nlog_level = loud\n")
+	c.Assert(d.reloadSettings(), ErrorMatches, ".*not a valid logrus Level.*")
+	level, _ = GetLevels()
+	c.Assert(level, Equals, logrus.WarnLevel)
+	c.Assert(d.settings.RateLimit.RequestsPerSecond, Equals, float64(1))
+
+	s.writeSettingsFile(c, "[daemon]\nbackup_concurrency = 0\n")
+	c.Assert(d.reloadSettings(), ErrorMatches, ".*backup_concurrency.*must be at least 1")
+
+	// Nothing is applied if schedules fail to be synced either
+	c.Assert(d.store.Put(SCHEDULE_CFG_PREFIX+"broken"+CFG_POSTFIX, []byte("{")), IsNil)
+	s.writeSettingsFile(c, `
+[daemon]
+log_level = error
+log_package_levels = ["objectstore=info"]
+
+[schedule.nightly]
+volume = vol1
+cron = 0 2 * * *
+`)
+	c.Assert(d.reloadSettings(), ErrorMatches, "Cannot parse schedule_broken.json.*")
+	level, levels = GetLevels()
+	c.Assert(level, Equals, logrus.WarnLevel)
+	c.Assert(levels, DeepEquals, map[string]logrus.Level{"objectstore": logrus.DebugLevel})
+	c.Assert(d.settings.RateLimit.RequestsPerSecond, Equals, float64(1))
+	c.Assert(d.rateLimiter.allow(now), Equals, false)
+}
+
+func (s *TestSuite) TestRateLimiter(c *C) {
+	l := &rateLimiter{}
+	now := time.Now()
+	c.Assert(l.allow(now), Equals, true)
+
+	l.setLimit(rateLimit{RequestsPerSecond: 2, Burst: 3})
+	for i := 0; i < 3; i++ {
+		c.Assert(l.allow(now), Equals, true)
+	}
+	c.Assert(l.allow(now), Equals, false)
+	c.Assert(l.allow(now.Add(100*time.Millisecond)), Equals, false)
+	c.Assert(l.allow(now.Add(500*time.Millisecond)), Equals, true)
+	c.Assert(l.allow(now.Add(500*time.Millisecond)), Equals, false)
+
+	l.setLimit(rateLimit{})
+	c.Assert(l.allow(now), Equals, true)
+}
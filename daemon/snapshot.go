@@ -3,6 +3,7 @@ package daemon
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/api"
@@ -32,36 +33,94 @@ func (s *daemon) doSnapshotCreate(version string, w http.ResponseWriter, r *http
 	}
 	volume := s.getVolume(volumeName)
 	if volume == nil {
-		return fmt.Errorf("volume %v doesn't exist", volumeName)
+		return volumeNotFoundError(volumeName)
 	}
 
-	snapshotName := request.Name
+	snapshotName, pruned, err := s.processSnapshotCreateAndPrune(volume, request.Name, request.Labels, request.Compression, request.Tags)
+	if err != nil {
+		return err
+	}
+
+	driverInfo, err := s.getSnapshotDriverInfo(snapshotName, volume)
+	if err != nil {
+		return err
+	}
+	if request.Verbose {
+		return writeResponseOutput(w, api.SnapshotResponse{
+			Name:        snapshotName,
+			VolumeName:  volume.Name,
+			CreatedTime: driverInfo[OPT_SNAPSHOT_CREATED_TIME],
+			Labels:      request.Labels,
+			DriverInfo:  driverInfo,
+			Pruned:      pruned,
+		})
+	}
+	return writeStringResponse(w, snapshotName)
+}
+
+func (s *daemon) processSnapshotCreate(volume *Volume, snapshotName string, labels map[string]string, compression string, tags map[string]string) (string, error) {
+	snapshotName, _, err := s.processSnapshotCreateAndPrune(volume, snapshotName, labels, compression, tags)
+	return snapshotName, err
+}
+
+// processSnapshotCreateAndPrune creates the snapshot, then enforces the
+// snapshot retention of volume. It returns the snapshots pruned, failing to
+// prune them doesn't fail the snapshot.
+func (s *daemon) processSnapshotCreateAndPrune(volume *Volume, snapshotName string, labels map[string]string, compression string, tags map[string]string) (string, []string, error) {
+	volumeName := volume.Name
 	if snapshotName != "" {
 		if err := util.CheckName(snapshotName); err != nil {
-			return err
-		}
-		existName := s.NameUUIDIndex.Get(snapshotName)
-		if existName != "" {
-			return fmt.Errorf("Snapshot name %v already exists", snapshotName)
-		}
-	} else {
-		snapshotName = util.GenerateName("snapshot")
-		for s.NameUUIDIndex.Get(snapshotName) != "" {
-			snapshotName = util.GenerateName("snapshot")
+			return "", nil, err
 		}
 	}
+	if err := util.ValidateCompression(compression); err != nil {
+		return "", nil, err
+	}
+
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	snapshotName, err := s.createSnapshot(volume, snapshotName, labels, compression, tags)
+	if err != nil {
+		return "", nil, err
+	}
+	pruned, err := s.enforceSnapshotRetention(volume, time.Now())
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_REASON: LOG_REASON_FAILURE,
+			LOG_FIELD_EVENT:  LOG_EVENT_DELETE,
+			LOG_FIELD_OBJECT: LOG_OBJECT_SNAPSHOT,
+			LOG_FIELD_VOLUME: volumeName,
+		}).Warnf("Failed to prune snapshots by retention, would retry after the next snapshot: %v", err)
+	}
+	return snapshotName, pruned, nil
+}
 
+// createSnapshot creates the snapshot of volume in its driver and records it,
+// caller must hold the lock of volume
+func (s *daemon) createSnapshot(volume *Volume, snapshotName string, labels map[string]string, compression string, tags map[string]string) (string, error) {
+	volumeName := volume.Name
 	snapOps, err := s.getSnapshotOpsForVolume(volume)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	snapshotName, err = s.reserveSnapshotName(snapshotName)
+	if err != nil {
+		return "", err
 	}
 
 	req := Request{
 		Name: snapshotName,
 		Options: map[string]string{
 			OPT_VOLUME_NAME: volumeName,
+			OPT_COMPRESSION: compression,
+			OPT_TAGS:        util.FormatTags(tags),
 		},
 	}
+	ctx, cancel := s.operationContext(OPERATION_SNAPSHOT_CREATE)
+	defer cancel()
+	req.Ctx = ctx
 
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_PREPARE,
@@ -70,8 +129,17 @@ func (s *daemon) doSnapshotCreate(version string, w http.ResponseWriter, r *http
 		LOG_FIELD_SNAPSHOT: snapshotName,
 		LOG_FIELD_VOLUME:   volumeName,
 	}).Debug()
+	intent, err := s.beginSnapshotIntent(INTENT_SNAPSHOT_CREATE, volumeName, snapshotName)
+	if err != nil {
+		s.NameUUIDIndex.Delete(snapshotName)
+		return "", err
+	}
 	if err := snapOps.CreateSnapshot(req); err != nil {
-		return err
+		s.NameUUIDIndex.Delete(snapshotName)
+		if err := s.endSnapshotIntent(intent); err != nil {
+			log.Error(err)
+		}
+		return "", operationError(ctx, OPERATION_SNAPSHOT_CREATE, volumeName, err)
 	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
@@ -81,26 +149,80 @@ func (s *daemon) doSnapshotCreate(version string, w http.ResponseWriter, r *http
 		LOG_FIELD_VOLUME:   volumeName,
 	}).Debug()
 
-	//TODO: error handling
-	if err := s.SnapshotVolumeIndex.Add(snapshotName, volume.Name); err != nil {
+	if err := s.recordSnapshot(volumeName, snapshotName, labels, intent); err != nil {
+		s.abortSnapshotCreate(intent)
+		return "", err
+	}
+	s.notifier.notify(&api.EventResponse{
+		Event:    EVENT_SNAPSHOT_CREATE,
+		Volume:   volumeName,
+		Snapshot: snapshotName,
+	})
+	return snapshotName, nil
+}
+
+// recordSnapshot indexes the snapshot created in the driver and saves its
+// labels, then completes the intent of creating it
+func (s *daemon) recordSnapshot(volumeName, snapshotName string, labels map[string]string, intent *snapshotIntent) error {
+	if err := s.SnapshotVolumeIndex.Add(snapshotName, volumeName); err != nil {
 		return err
 	}
-	if err := s.NameUUIDIndex.Add(snapshotName, "exists"); err != nil {
-		return err
+	if len(labels) != 0 {
+		if err := s.setSnapshotLabels(volumeName, snapshotName, labels); err != nil {
+			return err
+		}
 	}
-	driverInfo, err := s.getSnapshotDriverInfo(snapshotName, volume)
+	return s.endSnapshotIntent(intent)
+}
+
+// Labels of snapshots are kept in the config of volume, caller must hold the
+// lock of volume
+func (s *daemon) setSnapshotLabels(volumeName, snapshotName string, labels map[string]string) error {
+	return s.updateVolumeConfig(volumeName, func(config *VolumeConfig) (bool, error) {
+		if labels == nil {
+			if _, exists := config.SnapshotLabels[snapshotName]; !exists {
+				return false, nil
+			}
+			delete(config.SnapshotLabels, snapshotName)
+		} else {
+			if config.SnapshotLabels == nil {
+				config.SnapshotLabels = make(map[string]map[string]string)
+			}
+			config.SnapshotLabels[snapshotName] = labels
+		}
+		return true, nil
+	})
+}
+
+func (s *daemon) getSnapshotLabels(volumeName, snapshotName string) (map[string]string, error) {
+	config, err := s.loadVolumeConfig(volumeName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if request.Verbose {
-		return writeResponseOutput(w, api.SnapshotResponse{
-			Name:        snapshotName,
-			VolumeName:  volume.Name,
-			CreatedTime: driverInfo[OPT_SNAPSHOT_CREATED_TIME],
-			DriverInfo:  driverInfo,
-		})
+	return config.SnapshotLabels[snapshotName], nil
+}
+
+// reserveSnapshotName adds the name to NameUUIDIndex, so no other snapshot
+// can take it while the snapshot is being created. A name would be generated
+// if it's empty.
+func (s *daemon) reserveSnapshotName(snapshotName string) (string, error) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if snapshotName != "" {
+		if s.NameUUIDIndex.Get(snapshotName) != "" {
+			return "", api.NewError(api.ERROR_CODE_CONFLICT, "Snapshot name %v already exists", snapshotName).WithDetail("snapshot", snapshotName)
+		}
+	} else {
+		snapshotName = util.GenerateName("snapshot")
+		for s.NameUUIDIndex.Get(snapshotName) != "" {
+			snapshotName = util.GenerateName("snapshot")
+		}
 	}
-	return writeStringResponse(w, snapshotName)
+	if err := s.NameUUIDIndex.Add(snapshotName, "exists"); err != nil {
+		return "", err
+	}
+	return snapshotName, nil
 }
 
 func (s *daemon) getSnapshotDriverInfo(snapshotName string, volume *Volume) (map[string]string, error) {
@@ -146,14 +268,27 @@ func (s *daemon) doSnapshotDelete(version string, w http.ResponseWriter, r *http
 	if err := util.CheckName(snapshotName); err != nil {
 		return err
 	}
+	return s.processSnapshotDelete(snapshotName)
+}
+
+func (s *daemon) processSnapshotDelete(snapshotName string) error {
 	volumeName := s.SnapshotVolumeIndex.Get(snapshotName)
 	if volumeName == "" {
 		return fmt.Errorf("cannot find volume for snapshot %v", snapshotName)
 	}
 
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	return s.deleteSnapshot(volumeName, snapshotName)
+}
+
+// deleteSnapshot deletes the snapshot in the driver and forgets it, caller
+// must hold the lock of volume
+func (s *daemon) deleteSnapshot(volumeName, snapshotName string) error {
 	volume := s.getVolume(volumeName)
 	if !s.snapshotExists(volumeName, snapshotName) {
-		return fmt.Errorf("snapshot %v of volume %v doesn't exist", snapshotName, volumeName)
+		return snapshotNotFoundError(snapshotName, volumeName)
 	}
 
 	snapOps, err := s.getSnapshotOpsForVolume(volume)
@@ -161,11 +296,14 @@ func (s *daemon) doSnapshotDelete(version string, w http.ResponseWriter, r *http
 		return err
 	}
 
+	ctx, cancel := s.operationContext(OPERATION_SNAPSHOT_DELETE)
+	defer cancel()
 	req := Request{
 		Name: snapshotName,
 		Options: map[string]string{
 			OPT_VOLUME_NAME: volumeName,
 		},
+		Ctx: ctx,
 	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_PREPARE,
@@ -174,9 +312,16 @@ func (s *daemon) doSnapshotDelete(version string, w http.ResponseWriter, r *http
 		LOG_FIELD_SNAPSHOT: snapshotName,
 		LOG_FIELD_VOLUME:   volumeName,
 	}).Debug()
-	if err := snapOps.DeleteSnapshot(req); err != nil {
+	intent, err := s.beginSnapshotIntent(INTENT_SNAPSHOT_DELETE, volumeName, snapshotName)
+	if err != nil {
 		return err
 	}
+	if err := snapOps.DeleteSnapshot(req); err != nil {
+		if err := s.endSnapshotIntent(intent); err != nil {
+			log.Error(err)
+		}
+		return operationError(ctx, OPERATION_SNAPSHOT_DELETE, volumeName, err)
+	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
 		LOG_FIELD_EVENT:    LOG_EVENT_DELETE,
@@ -185,13 +330,18 @@ func (s *daemon) doSnapshotDelete(version string, w http.ResponseWriter, r *http
 		LOG_FIELD_VOLUME:   volumeName,
 	}).Debug()
 
-	//TODO: error handling
-	if err := s.SnapshotVolumeIndex.Delete(snapshotName); err != nil {
+	// The intent is kept if it fails, so the rest is done on startup
+	if err := s.forgetSnapshot(volumeName, snapshotName); err != nil {
 		return err
 	}
-	if err := s.NameUUIDIndex.Delete(snapshotName); err != nil {
+	if err := s.endSnapshotIntent(intent); err != nil {
 		return err
 	}
+	s.notifier.notify(&api.EventResponse{
+		Event:    EVENT_SNAPSHOT_DELETE,
+		Volume:   volumeName,
+		Snapshot: snapshotName,
+	})
 	return nil
 }
 
@@ -229,11 +379,17 @@ func (s *daemon) doSnapshotInspect(version string, w http.ResponseWriter, r *htt
 		return err
 	}
 
+	labels, err := s.getSnapshotLabels(volumeName, snapshotName)
+	if err != nil {
+		return err
+	}
+
 	resp := api.SnapshotResponse{
 		Name:            snapshotName,
 		VolumeName:      volumeName,
 		VolumeCreatedAt: volumeDriverInfo[OPT_VOLUME_CREATED_TIME],
 		CreatedTime:     snapshot[OPT_SNAPSHOT_CREATED_TIME],
+		Labels:          labels,
 		DriverInfo:      driverInfo,
 	}
 	data, err := api.ResponseOutput(resp)
@@ -243,3 +399,78 @@ func (s *daemon) doSnapshotInspect(version string, w http.ResponseWriter, r *htt
 	_, err = w.Write(data)
 	return err
 }
+
+// doSnapshotDiff responds the change from the compared snapshot to the
+// snapshot, which must be of the same volume
+func (s *daemon) doSnapshotDiff(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.SnapshotDiffRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	snapshotName := request.SnapshotName
+	compareName := request.CompareSnapshotName
+	if err := util.CheckName(snapshotName); err != nil {
+		return err
+	}
+	if err := util.CheckName(compareName); err != nil {
+		return err
+	}
+	if snapshotName == compareName {
+		return fmt.Errorf("cannot diff snapshot %v with itself", snapshotName)
+	}
+	volumeName := s.SnapshotVolumeIndex.Get(snapshotName)
+	if volumeName == "" {
+		return fmt.Errorf("cannot find volume for snapshot %v", snapshotName)
+	}
+	if compareVolumeName := s.SnapshotVolumeIndex.Get(compareName); compareVolumeName != volumeName {
+		return fmt.Errorf("snapshot %v is not of volume %v", compareName, volumeName)
+	}
+
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return fmt.Errorf("cannot find volume %v", volumeName)
+	}
+	snapOps, err := s.getSnapshotOpsForVolume(volume)
+	if err != nil {
+		return err
+	}
+	differ, ok := snapOps.(SnapshotDiffer)
+	if !ok {
+		return driverUnsupportedError(volume.DriverName, "snapshot diff")
+	}
+
+	diff, err := differ.DiffSnapshot(Request{
+		Name: snapshotName,
+		Options: map[string]string{
+			OPT_VOLUME_NAME:           volumeName,
+			OPT_COMPARE_SNAPSHOT_NAME: compareName,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp := api.SnapshotDiffResponse{
+		VolumeName:      volumeName,
+		Snapshot:        snapshotName,
+		CompareSnapshot: compareName,
+		ChangedBytes:    diff.ChangedBytes,
+	}
+	for _, f := range diff.Files {
+		resp.Files = append(resp.Files, api.FileChangeResponse{
+			Path:   f.Path,
+			Change: f.Change,
+			Size:   f.Size,
+		})
+	}
+	for _, e := range diff.Extents {
+		resp.Extents = append(resp.Extents, api.ExtentResponse{
+			Offset: e.Offset,
+			Length: e.Length,
+		})
+	}
+	return writeResponseOutput(w, resp)
+}
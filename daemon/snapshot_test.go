@@ -0,0 +1,105 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestSnapshotDiff(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	for _, name := range []string{"vol1", "vol2"} {
+		_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+			Name: name,
+		})
+		c.Assert(err, IsNil)
+	}
+
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	_, err = d.processSnapshotCreate(d.getVolume("vol1"), "snap1", nil, "", nil)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(mountPoint, "data"), []byte("data"), 0600), IsNil)
+	_, err = d.processSnapshotCreate(d.getVolume("vol1"), "snap2", nil, "", nil)
+	c.Assert(err, IsNil)
+	_, err = d.processSnapshotCreate(d.getVolume("vol2"), "snap3", nil, "", nil)
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "GET", "/v1/snapshots/diff", &api.SnapshotDiffRequest{
+		SnapshotName:        "snap2",
+		CompareSnapshotName: "snap1",
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	resp := api.SnapshotDiffResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &resp), IsNil)
+	c.Assert(resp, DeepEquals, api.SnapshotDiffResponse{
+		VolumeName:      "vol1",
+		Snapshot:        "snap2",
+		CompareSnapshot: "snap1",
+		Files: []api.FileChangeResponse{
+			{Path: "data", Change: "added", Size: 4},
+		},
+		ChangedBytes: 4,
+	})
+
+	w = s.serveRequest(c, router, "GET", "/v1/snapshots/diff", &api.SnapshotDiffRequest{
+		SnapshotName:        "snap2",
+		CompareSnapshotName: "snap3",
+	})
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	s.assertError(c, w, api.ERROR_CODE_UNKNOWN, "snapshot snap3 is not of volume vol1")
+	w = s.serveRequest(c, router, "GET", "/v1/snapshots/diff", &api.SnapshotDiffRequest{
+		SnapshotName:        "snap2",
+		CompareSnapshotName: "snap2",
+	})
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+	s.assertError(c, w, api.ERROR_CODE_UNKNOWN, "cannot diff snapshot snap2 with itself")
+}
+
+func (s *TestSuite) TestSnapshotIntentRecovery(c *C) {
+	d := s.newVFSDaemon(c)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	labels := map[string]string{"app": "db"}
+	for _, name := range []string{"snap1", "snap2"} {
+		_, err = d.processSnapshotCreate(d.getVolume("vol1"), name, labels, "", nil)
+		c.Assert(err, IsNil)
+	}
+	intents, err := filepath.Glob(filepath.Join(d.Root, INTENT_CFG_PREFIX+"*"))
+	c.Assert(err, IsNil)
+	c.Assert(intents, HasLen, 0)
+
+	// Daemon crashed in the middle of creating snap2
+	intent, err := d.beginSnapshotIntent(INTENT_SNAPSHOT_CREATE, "vol1", "snap2")
+	c.Assert(err, IsNil)
+	d.recoverSnapshotIntents()
+
+	c.Assert(d.snapshotExists("vol1", "snap1"), Equals, true)
+	c.Assert(d.snapshotExists("vol1", "snap2"), Equals, false)
+	c.Assert(d.SnapshotVolumeIndex.Get("snap2"), Equals, "")
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.SnapshotLabels, DeepEquals, map[string]map[string]string{"snap1": labels})
+	exists, err := util.ObjectExists(intent)
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+
+	// Interrupted delete of a snapshot already removed in the driver
+	c.Assert(d.processSnapshotDelete("snap1"), IsNil)
+	c.Assert(d.setSnapshotLabels("vol1", "snap1", labels), IsNil)
+	_, err = d.beginSnapshotIntent(INTENT_SNAPSHOT_DELETE, "vol1", "snap1")
+	c.Assert(err, IsNil)
+	d.recoverSnapshotIntents()
+	config, err = d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.SnapshotLabels, HasLen, 0)
+}
@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/metrics"
+	"github.com/rancher/convoy/util"
+)
+
+type volumeDevice struct {
+	major  int
+	minor  int
+	shared bool
+}
+
+/*
+getVolumeDevice returns the block device of a volume by its driver info,
+which is the device reported by driver, e.g. the EBS volume or LVM logical
+volume, or the device of the filesystem of its mount point otherwise, e.g.
+the one holding vfs volumes. The latter may be shared with others.
+*/
+func getVolumeDevice(volumeName string, info map[string]string) (*volumeDevice, error) {
+	device := &volumeDevice{}
+	path := info["Device"]
+	if path == "" {
+		path = info["MountPoint"]
+		device.shared = true
+	}
+	if path == "" {
+		return nil, api.NewError(api.ERROR_CODE_INVALID_REQUEST, "Volume %v isn't mounted, and its driver reports no block device", volumeName).
+			WithDetail("volume", volumeName)
+	}
+	major, minor, err := util.GetBlockDeviceNumber(path)
+	if err != nil {
+		return nil, err
+	}
+	if major == 0 {
+		return nil, driverUnsupportedError(info["Driver"], "IO stats of volumes not on a block device").WithDetail("volume", volumeName)
+	}
+	device.major, device.minor = major, minor
+	return device, nil
+}
+
+func findDiskStats(list []util.DiskStats, device *volumeDevice) *util.DiskStats {
+	for i := range list {
+		if list[i].Major == device.major && list[i].Minor == device.minor {
+			return &list[i]
+		}
+	}
+	return nil
+}
+
+func volumeStatsResponse(volumeName string, device *volumeDevice, stats *util.DiskStats) *api.VolumeStatsResponse {
+	resp := &api.VolumeStatsResponse{
+		Volume:       volumeName,
+		Device:       stats.Name,
+		DeviceNumber: fmt.Sprintf("%d:%d", stats.Major, stats.Minor),
+		Shared:       device.shared,
+		ReadBytes:    stats.ReadSectors * util.DISKSTATS_SECTOR_SIZE,
+		WrittenBytes: stats.WriteSectors * util.DISKSTATS_SECTOR_SIZE,
+		Reads:        stats.Reads,
+		Writes:       stats.Writes,
+		ReadTime:     stats.ReadTime,
+		WriteTime:    stats.WriteTime,
+		InProgress:   stats.InProgress,
+		IOTime:       stats.IOTime,
+	}
+	if stats.Reads != 0 {
+		resp.ReadLatency = float64(stats.ReadTime) / float64(stats.Reads)
+	}
+	if stats.Writes != 0 {
+		resp.WriteLatency = float64(stats.WriteTime) / float64(stats.Writes)
+	}
+	return resp
+}
+
+func (s *daemon) doVolumeStats(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeStatsRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
+	}
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+
+	info, err := s.getVolumeDriverInfo(volume)
+	if err != nil {
+		return err
+	}
+	device, err := getVolumeDevice(volumeName, info)
+	if err != nil {
+		return err
+	}
+	list, err := util.ListDiskStats()
+	if err != nil {
+		return err
+	}
+	stats := findDiskStats(list, device)
+	if stats == nil {
+		return fmt.Errorf("Cannot find IO stats of device %v:%v of volume %v", device.major, device.minor, volumeName)
+	}
+	return writeResponseOutput(w, volumeStatsResponse(volumeName, device, stats))
+}
+
+// recordVolumeIOMetrics updates the IO metrics of mounted volumes, before
+// the metrics are scraped. Volumes without stats, e.g. the ones of network
+// filesystems, are skipped.
+func (s *daemon) recordVolumeIOMetrics() {
+	list, err := util.ListDiskStats()
+	if err != nil {
+		log.Warnf("Failed to read IO stats of volumes: %v", err)
+		return
+	}
+	volumes := []metrics.VolumeIO{}
+	for name, info := range s.getVolumeList() {
+		if info["MountPoint"] == "" {
+			continue
+		}
+		device, err := getVolumeDevice(name, info)
+		if err != nil {
+			log.Debugf("Skip IO metrics of volume %v: %v", name, err)
+			continue
+		}
+		stats := findDiskStats(list, device)
+		if stats == nil {
+			continue
+		}
+		resp := volumeStatsResponse(name, device, stats)
+		volumes = append(volumes, metrics.VolumeIO{
+			Volume:       name,
+			Device:       resp.Device,
+			ReadBytes:    resp.ReadBytes,
+			WrittenBytes: resp.WrittenBytes,
+			Reads:        resp.Reads,
+			Writes:       resp.Writes,
+			ReadSeconds:  float64(resp.ReadTime) / 1000,
+			WriteSeconds: float64(resp.WriteTime) / 1000,
+			IOSeconds:    float64(resp.IOTime) / 1000,
+			InProgress:   resp.InProgress,
+		})
+	}
+	metrics.RecordVolumeIO(volumes)
+}
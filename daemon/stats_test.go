@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestVolumeStats(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+
+	w := s.serveRequest(c, router, "GET", "/v1/volumes/stats", &api.VolumeStatsRequest{
+		VolumeName: "vol1",
+	})
+	s.assertError(c, w, api.ERROR_CODE_INVALID_REQUEST, "Volume vol1 isn't mounted, .*")
+
+	mountPoint, err := d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	st := syscall.Stat_t{}
+	c.Assert(syscall.Stat(mountPoint, &st), IsNil)
+	dev := uint64(st.Dev)
+	if major := (dev>>8)&0xfff | (dev>>32)&^uint64(0xfff); major == 0 {
+		c.Skip("Test root isn't on a block device")
+	}
+
+	// vfs volumes share the device of their filesystem
+	w = s.serveRequest(c, router, "GET", "/v1/volumes/stats", &api.VolumeStatsRequest{
+		VolumeName: "vol1",
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	stats := &api.VolumeStatsResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), stats), IsNil)
+	c.Assert(stats.Volume, Equals, "vol1")
+	c.Assert(stats.Shared, Equals, true)
+	c.Assert(stats.Device, Not(Equals), "")
+	c.Assert(stats.DeviceNumber, Matches, "[1-9][0-9]*:[0-9]+")
+
+	w = httptest.NewRecorder()
+	c.Assert(d.doMetrics("", w, nil, nil), IsNil)
+	// The counters keep going with the IO of the host
+	series := fmt.Sprintf(`convoy_volume_read_bytes_total{volume="vol1",device="%v"} `, stats.Device)
+	c.Assert(bytes.Contains(w.Body.Bytes(), []byte(series)), Equals, true)
+
+	// Metrics of volumes are dropped once they're umounted
+	c.Assert(d.processVolumeUmount(d.getVolume("vol1")), IsNil)
+	w = httptest.NewRecorder()
+	c.Assert(d.doMetrics("", w, nil, nil), IsNil)
+	c.Assert(bytes.Contains(w.Body.Bytes(), []byte(`convoy_volume_read_bytes_total{volume="vol1"`)), Equals, false)
+}
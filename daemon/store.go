@@ -0,0 +1,220 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	METADATA_STORE_FILE = "file"
+	METADATA_STORE_BOLT = "bolt"
+	METADATA_STORE_ETCD = "etcd"
+
+	FILE_STORE_SCHEME = "file"
+)
+
+/*
+metadataStore persists the daemon's own objects, like volume configs, policies,
+schedules and snapshot intents, as JSON documents by keys. Keys are the names
+of the files the objects are saved as in the root directory by the file
+store, e.g. "volume_vol1.json". The default store is an embedded BoltDB file
+in the root directory. The config of daemon itself always stays in the root
+directory, since it tells which store to use.
+*/
+type metadataStore interface {
+	Kind() string
+	// Get returns util.ErrorNotExists() if key doesn't exist
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	// Delete succeeds if key doesn't exist
+	Delete(key string) error
+	// List returns the keys with prefix and suffix in order
+	List(prefix, suffix string) ([]string, error)
+	// Update replaces the value of key with the result of update, unless
+	// key is changed by someone else meanwhile, in which case update is
+	// called again with the new value. Value is nil if key doesn't exist,
+	// and key is left as it is if update returns nil.
+	Update(key string, update func(value []byte) ([]byte, error)) error
+}
+
+// newMetadataStore returns the store of storeURL, or the BoltDB store in
+// root if it's empty
+func newMetadataStore(root, storeURL string) (metadataStore, error) {
+	if storeURL == "" {
+		storeURL = BOLT_SCHEME + "://"
+	}
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case BOLT_SCHEME:
+		return newBoltStore(root, u)
+	case FILE_STORE_SCHEME:
+		return &fileStore{root: root}, nil
+	case ETCD_SCHEME, ETCD_TLS_SCHEME:
+		return newEtcdStore(u)
+	}
+	return nil, fmt.Errorf("Unsupported metadata store %v, must be empty for BoltDB in root directory, bolt:///path, file:// for files in root directory, or etcd://host:port/prefix", storeURL)
+}
+
+// isSharedStore tells if the metadata store of storeURL can be shared by
+// daemons on different hosts
+func isSharedStore(storeURL string) bool {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == ETCD_SCHEME || u.Scheme == ETCD_TLS_SCHEME
+}
+
+// fileStore saves every object as a file in root, which is only used by this
+// daemon as ensured by the lock file
+type fileStore struct {
+	root string
+	// updateLock serializes Update
+	updateLock sync.Mutex
+}
+
+func (f *fileStore) Kind() string {
+	return METADATA_STORE_FILE
+}
+
+func (f *fileStore) path(key string) string {
+	return filepath.Join(f.root, key)
+}
+
+func (f *fileStore) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, util.ErrorNotExists()
+	}
+	return data, err
+}
+
+func (f *fileStore) Put(key string, value []byte) error {
+	return util.WriteFileAtomic(f.path(key), value)
+}
+
+func (f *fileStore) Delete(key string) error {
+	if err := os.Remove(f.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *fileStore) List(prefix, suffix string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(f.root, prefix+"*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, file := range files {
+		keys = append(keys, filepath.Base(file))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (f *fileStore) Update(key string, update func(value []byte) ([]byte, error)) error {
+	f.updateLock.Lock()
+	defer f.updateLock.Unlock()
+
+	value, err := f.Get(key)
+	if util.IsNotExistsError(err) {
+		value, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if value, err = update(value); err != nil || value == nil {
+		return err
+	}
+	return f.Put(key, value)
+}
+
+// objectKey is the key of object in metadata store, which is the name of its
+// config file
+func objectKey(obj interface{}) (string, error) {
+	config, err := util.ObjectConfig(obj)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(config), nil
+}
+
+func encodeObject(obj interface{}) ([]byte, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// loadObject returns util.ErrorNotExists() if obj doesn't exist
+func (s *daemon) loadObject(obj interface{}) error {
+	key, err := objectKey(obj)
+	if err != nil {
+		return err
+	}
+	data, err := s.store.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, obj); err != nil {
+		return fmt.Errorf("Cannot parse %v in %v metadata store: %v", key, s.store.Kind(), err)
+	}
+	return nil
+}
+
+func (s *daemon) objectExists(obj interface{}) (bool, error) {
+	key, err := objectKey(obj)
+	if err != nil {
+		return false, err
+	}
+	if _, err := s.store.Get(key); err != nil {
+		if util.IsNotExistsError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *daemon) saveObject(obj interface{}) error {
+	key, err := objectKey(obj)
+	if err != nil {
+		return err
+	}
+	data, err := encodeObject(obj)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(key, data)
+}
+
+func (s *daemon) deleteObject(obj interface{}) error {
+	key, err := objectKey(obj)
+	if err != nil {
+		return err
+	}
+	return s.store.Delete(key)
+}
+
+// listObjectNames returns the names of objects saved with keys of
+// prefix + name + CFG_POSTFIX
+func (s *daemon) listObjectNames(prefix string) ([]string, error) {
+	keys, err := s.store.List(prefix, CFG_POSTFIX)
+	if err != nil {
+		return nil, err
+	}
+	return util.ExtractNames(keys, prefix, CFG_POSTFIX)
+}
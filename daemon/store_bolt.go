@@ -0,0 +1,199 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	BOLT_SCHEME = "bolt"
+	// BOLT_DB_FILE is the embedded store in root directory by default
+	BOLT_DB_FILE = "metadata.db"
+
+	BOLT_OPEN_TIMEOUT = 5 * time.Second
+)
+
+var (
+	boltObjectsBucket = []byte("objects")
+	boltMetaBucket    = []byte("meta")
+	// boltImportedKey is set once the files of objects in root directory
+	// are imported
+	boltImportedKey = []byte("imported")
+
+	// boltImportPrefixes are the keys of objects which used to be files in
+	// root directory, the files of drivers there are left alone
+	boltImportPrefixes = []string{
+		VOLUME_CFG_PREFIX,
+		INTENT_CFG_PREFIX,
+		MIGRATE_CFG_PREFIX,
+		POLICY_CFG_PREFIX,
+		SCHEDULE_CFG_PREFIX,
+		TRASH_VOLUME_CFG_PREFIX,
+		TRASH_BACKUP_CFG_PREFIX,
+		CLUSTER_HOST_CFG_PREFIX,
+		CLUSTER_ATTACHMENT_CFG_PREFIX,
+	}
+)
+
+/*
+boltStore keeps objects in an embedded BoltDB file, which is the default
+metadata store. Every call is a transaction, so an object is never left half
+written, and Update is serialized by the single writer of BoltDB. The file is
+locked while it's open, so it's only used by one daemon.
+*/
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens the BoltDB file of u, or the one in root if u has no
+// path. Objects saved as files in root by earlier versions are imported
+// the first time.
+func newBoltStore(root string, u *url.URL) (*boltStore, error) {
+	if u.Host != "" {
+		return nil, fmt.Errorf("Invalid BoltDB URL %v, must be bolt:///path", u)
+	}
+	path := u.Path
+	if path == "" {
+		path = filepath.Join(root, BOLT_DB_FILE)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open metadata store %v: %v", path, err)
+	}
+	store := &boltStore{db: db}
+	if err := store.importFiles(root); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Cannot import metadata in %v to %v: %v", root, path, err)
+	}
+	return store, nil
+}
+
+// importFiles moves the objects saved as files in root into the store. The
+// files are imported in one transaction along with the mark, and removed
+// once it's committed, so a crash in the middle imports them again.
+func (b *boltStore) importFiles(root string) error {
+	files := []string{}
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		objects, err := tx.CreateBucketIfNotExists(boltObjectsBucket)
+		if err != nil {
+			return err
+		}
+		if meta.Get(boltImportedKey) != nil {
+			return nil
+		}
+		for _, prefix := range boltImportPrefixes {
+			matches, err := filepath.Glob(filepath.Join(root, prefix+"*"))
+			if err != nil {
+				return err
+			}
+			for _, file := range matches {
+				// trash_volume_ is not a volume config
+				if prefix == VOLUME_CFG_PREFIX && strings.HasPrefix(filepath.Base(file), TRASH_VOLUME_CFG_PREFIX) {
+					continue
+				}
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				if err := objects.Put([]byte(filepath.Base(file)), data); err != nil {
+					return err
+				}
+				files = append(files, file)
+			}
+		}
+		return meta.Put(boltImportedKey, []byte(util.Now()))
+	}); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			log.Warnf("Failed to remove %v imported to metadata store: %v", file, err)
+		}
+	}
+	if len(files) != 0 {
+		log.Infof("Imported %v objects in %v to metadata store", len(files), root)
+	}
+	return nil
+}
+
+func (b *boltStore) Kind() string {
+	return METADATA_STORE_BOLT
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *boltStore) Get(key string) ([]byte, error) {
+	var value []byte
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid in the transaction
+		if v := tx.Bucket(boltObjectsBucket).Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, util.ErrorNotExists()
+	}
+	return value, nil
+}
+
+func (b *boltStore) Put(key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltObjectsBucket).Put([]byte(key), value)
+	})
+}
+
+func (b *boltStore) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltObjectsBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltStore) List(prefix, suffix string) ([]string, error) {
+	keys := []string{}
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltObjectsBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			if bytes.HasSuffix(k, []byte(suffix)) {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (b *boltStore) Update(key string, update func(value []byte) ([]byte, error)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltObjectsBucket)
+		var value []byte
+		if v := bucket.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		value, err := update(value)
+		if err != nil || value == nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
@@ -0,0 +1,241 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	ETCD_SCHEME     = "etcd"
+	ETCD_TLS_SCHEME = "etcds"
+
+	// Query parameters of etcds:// URL for TLS
+	ETCD_QUERY_CACERT = "cacert"
+	ETCD_QUERY_CERT   = "cert"
+	ETCD_QUERY_KEY    = "key"
+
+	ETCD_REQUEST_TIMEOUT = 10 * time.Second
+	// Times Update retries when the key is changed by another daemon
+	ETCD_UPDATE_RETRIES = 10
+)
+
+/*
+etcdStore saves objects in etcd under a prefix, by the JSON gateway of etcd v3
+API, so multiple daemons can share the objects, e.g. of volumes on NFS or EBS
+which may be used by any host. The prefix should be different for daemons
+which don't share volumes. Update is a transaction comparing the revision of
+key, so concurrent updates from different hosts are never lost.
+*/
+type etcdStore struct {
+	endpoint string
+	prefix   string
+	client   *http.Client
+}
+
+// etcdKeyValue is mvccpb.KeyValue in JSON, where bytes are base64 encoded
+// and 64-bit integers are strings
+type etcdKeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+func newEtcdStore(u *url.URL) (*etcdStore, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid etcd URL %v, must be etcd://host:port/prefix", u)
+	}
+	prefix := path.Clean("/" + u.Path)
+	if prefix == "/" {
+		return nil, fmt.Errorf("Prefix of keys is required in etcd URL %v, e.g. etcd://host:port/convoy/<host>", u)
+	}
+	store := &etcdStore{
+		endpoint: "http://" + u.Host,
+		prefix:   prefix + "/",
+		client: &http.Client{
+			Timeout: ETCD_REQUEST_TIMEOUT,
+		},
+	}
+	if u.Scheme == ETCD_TLS_SCHEME {
+		query := u.Query()
+		tlsConfig, err := util.NewClientTLSConfig(query.Get(ETCD_QUERY_CACERT), query.Get(ETCD_QUERY_CERT), query.Get(ETCD_QUERY_KEY))
+		if err != nil {
+			return nil, err
+		}
+		store.endpoint = "https://" + u.Host
+		store.client.Transport = &http.Transport{
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	return store, nil
+}
+
+func (e *etcdStore) Kind() string {
+	return METADATA_STORE_ETCD
+}
+
+func encodeEtcdBytes(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// call posts request to method of etcd v3 API, e.g. "kv/range"
+func (e *etcdStore) call(method string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint+"/v3/"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed to request etcd %v: %v", e.endpoint, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to %v of etcd %v: %v %v", method, e.endpoint, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(data, response)
+}
+
+// get returns nil if key doesn't exist, and the revision of key which is
+// zero if it doesn't exist
+func (e *etcdStore) get(key string) ([]byte, string, error) {
+	resp := &etcdRangeResponse{}
+	if err := e.call("kv/range", map[string]string{
+		"key": encodeEtcdBytes(e.prefix + key),
+	}, resp); err != nil {
+		return nil, "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, "0", nil
+	}
+	value, err := base64.StdEncoding.DecodeString(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, "", err
+	}
+	// Value of a key can be empty but never nil
+	if value == nil {
+		value = []byte{}
+	}
+	return value, resp.Kvs[0].ModRevision, nil
+}
+
+func (e *etcdStore) Get(key string) ([]byte, error) {
+	value, _, err := e.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, util.ErrorNotExists()
+	}
+	return value, nil
+}
+
+func (e *etcdStore) Put(key string, value []byte) error {
+	return e.call("kv/put", map[string]string{
+		"key":   encodeEtcdBytes(e.prefix + key),
+		"value": base64.StdEncoding.EncodeToString(value),
+	}, nil)
+}
+
+func (e *etcdStore) Delete(key string) error {
+	return e.call("kv/deleterange", map[string]string{
+		"key": encodeEtcdBytes(e.prefix + key),
+	}, nil)
+}
+
+// prefixRangeEnd returns the end of range of all the keys with prefix
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// Up to the end of keys
+	return []byte{0}
+}
+
+func (e *etcdStore) List(prefix, suffix string) ([]string, error) {
+	start := e.prefix + prefix
+	resp := &etcdRangeResponse{}
+	if err := e.call("kv/range", map[string]interface{}{
+		"key":       encodeEtcdBytes(start),
+		"range_end": base64.StdEncoding.EncodeToString(prefixRangeEnd(start)),
+		"keys_only": true,
+	}, resp); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, kv := range resp.Kvs {
+		data, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.TrimPrefix(string(data), e.prefix)
+		if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, suffix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (e *etcdStore) Update(key string, update func(value []byte) ([]byte, error)) error {
+	for i := 0; i < ETCD_UPDATE_RETRIES; i++ {
+		value, revision, err := e.get(key)
+		if err != nil {
+			return err
+		}
+		if value, err = update(value); err != nil || value == nil {
+			return err
+		}
+		etcdKey := encodeEtcdBytes(e.prefix + key)
+		resp := &etcdTxnResponse{}
+		if err := e.call("kv/txn", map[string]interface{}{
+			"compare": []map[string]string{{
+				"key":          etcdKey,
+				"target":       "MOD",
+				"result":       "EQUAL",
+				"mod_revision": revision,
+			}},
+			"success": []map[string]interface{}{{
+				"request_put": map[string]string{
+					"key":   etcdKey,
+					"value": base64.StdEncoding.EncodeToString(value),
+				},
+			}},
+		}, resp); err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		log.Debugf("%v is changed in etcd while being updated, retrying", key)
+	}
+	return fmt.Errorf("Failed to update %v in etcd, it keeps being changed by others", key)
+}
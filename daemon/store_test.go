@@ -0,0 +1,263 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeEtcd serves the subset of etcd v3 JSON gateway used by etcdStore
+type fakeEtcd struct {
+	lock      sync.Mutex
+	values    map[string]string
+	revisions map[string]int64
+	revision  int64
+
+	server *httptest.Server
+}
+
+func decodeEtcdBytes(s string) string {
+	data, _ := base64.StdEncoding.DecodeString(s)
+	return string(data)
+}
+
+func (f *fakeEtcd) put(key, value string) {
+	f.revision++
+	f.values[key] = value
+	f.revisions[key] = f.revision
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	req := struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		RangeEnd string `json:"range_end"`
+		Compare  []struct {
+			Key         string `json:"key"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"compare"`
+		Success []struct {
+			RequestPut struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"request_put"`
+		} `json:"success"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := decodeEtcdBytes(req.Key)
+	var resp interface{}
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		kvs := []etcdKeyValue{}
+		for k, v := range f.values {
+			if k == key || (req.RangeEnd != "" && k >= key && k < decodeEtcdBytes(req.RangeEnd)) {
+				kvs = append(kvs, etcdKeyValue{
+					Key:         base64.StdEncoding.EncodeToString([]byte(k)),
+					Value:       base64.StdEncoding.EncodeToString([]byte(v)),
+					ModRevision: strconv.FormatInt(f.revisions[k], 10),
+				})
+			}
+		}
+		resp = etcdRangeResponse{Kvs: kvs}
+	case "/v3/kv/put":
+		f.put(key, decodeEtcdBytes(req.Value))
+		resp = struct{}{}
+	case "/v3/kv/deleterange":
+		delete(f.values, key)
+		delete(f.revisions, key)
+		resp = struct{}{}
+	case "/v3/kv/txn":
+		compare := req.Compare[0]
+		succeeded := strconv.FormatInt(f.revisions[decodeEtcdBytes(compare.Key)], 10) == compare.ModRevision
+		if succeeded {
+			put := req.Success[0].RequestPut
+			f.put(decodeEtcdBytes(put.Key), decodeEtcdBytes(put.Value))
+		}
+		resp = etcdTxnResponse{Succeeded: succeeded}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *TestSuite) newEtcdStore(c *C) (*etcdStore, *fakeEtcd) {
+	fake := &fakeEtcd{
+		values:    map[string]string{},
+		revisions: map[string]int64{},
+	}
+	fake.server = httptest.NewServer(fake)
+	u, err := url.Parse(fake.server.URL)
+	c.Assert(err, IsNil)
+	store, err := newEtcdStore(&url.URL{Scheme: ETCD_SCHEME, Host: u.Host, Path: "/convoy/host1"})
+	c.Assert(err, IsNil)
+	return store, fake
+}
+
+func testMetadataStore(c *C, store metadataStore) {
+	_, err := store.Get("volume_vol1.json")
+	c.Assert(util.IsNotExistsError(err), Equals, true)
+	c.Assert(store.Delete("volume_vol1.json"), IsNil)
+
+	for _, key := range []string{"volume_vol2.json", "volume_vol1.json", "policy_p1.json", "volume_vol3.json.corrupted"} {
+		c.Assert(store.Put(key, []byte(key)), IsNil)
+	}
+	value, err := store.Get("volume_vol1.json")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "volume_vol1.json")
+	keys, err := store.List("volume_", ".json")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"volume_vol1.json", "volume_vol2.json"})
+
+	c.Assert(store.Update("volume_vol1.json", func(value []byte) ([]byte, error) {
+		return append(value, '!'), nil
+	}), IsNil)
+	// Nothing changes if update returns nil
+	c.Assert(store.Update("volume_vol1.json", func(value []byte) ([]byte, error) {
+		return nil, nil
+	}), IsNil)
+	value, err = store.Get("volume_vol1.json")
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "volume_vol1.json!")
+	c.Assert(store.Update("volume_vol4.json", func(value []byte) ([]byte, error) {
+		c.Assert(value, IsNil)
+		return []byte("new"), nil
+	}), IsNil)
+
+	c.Assert(store.Delete("volume_vol1.json"), IsNil)
+	keys, err = store.List("volume_", ".json")
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"volume_vol2.json", "volume_vol4.json"})
+}
+
+func (s *TestSuite) TestFileStore(c *C) {
+	store, err := newMetadataStore(s.root, "file://")
+	c.Assert(err, IsNil)
+	c.Assert(store.Kind(), Equals, METADATA_STORE_FILE)
+	testMetadataStore(c, store)
+}
+
+func (s *TestSuite) TestBoltStore(c *C) {
+	store, err := newMetadataStore(s.root, "")
+	c.Assert(err, IsNil)
+	c.Assert(store.Kind(), Equals, METADATA_STORE_BOLT)
+	testMetadataStore(c, store)
+	c.Assert(store.(*boltStore).Close(), IsNil)
+	_, err = os.Stat(filepath.Join(s.root, BOLT_DB_FILE))
+	c.Assert(err, IsNil)
+
+	_, err = newMetadataStore(s.root, "bolt://host/metadata.db")
+	c.Assert(err, ErrorMatches, "Invalid BoltDB URL.*")
+}
+
+func (s *TestSuite) TestBoltStoreImport(c *C) {
+	root, err := ioutil.TempDir(s.root, "import")
+	c.Assert(err, IsNil)
+	files := map[string]string{
+		"volume_vol1.json":              `{"Name":"vol1"}`,
+		"policy_p1.json":                `{"Name":"p1"}`,
+		"trash_volume_vol2.json":        `{"Name":"vol2"}`,
+		"devicemapper_volume_vol1.json": `{"Name":"vol1"}`,
+		CONFIGFILE:                      `{}`,
+	}
+	for name, data := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(root, name), []byte(data), 0600), IsNil)
+	}
+
+	dbFile := filepath.Join(s.root, "import.db")
+	store, err := newMetadataStore(root, "bolt://"+dbFile)
+	c.Assert(err, IsNil)
+	for _, key := range []string{"volume_vol1.json", "policy_p1.json", "trash_volume_vol2.json"} {
+		value, err := store.Get(key)
+		c.Assert(err, IsNil)
+		c.Assert(string(value), Equals, files[key])
+		_, err = os.Stat(filepath.Join(root, key))
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
+	keys, err := store.List(VOLUME_CFG_PREFIX, CFG_POSTFIX)
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"volume_vol1.json"})
+	// Files of drivers and daemon config stay in root directory
+	for _, name := range []string{"devicemapper_volume_vol1.json", CONFIGFILE} {
+		_, err = os.Stat(filepath.Join(root, name))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(store.(*boltStore).Close(), IsNil)
+
+	// Files are only imported once
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "volume_vol3.json"), []byte(`{}`), 0600), IsNil)
+	store, err = newMetadataStore(root, "bolt://"+dbFile)
+	c.Assert(err, IsNil)
+	defer store.(*boltStore).Close()
+	_, err = store.Get("volume_vol3.json")
+	c.Assert(util.IsNotExistsError(err), Equals, true)
+}
+
+func (s *TestSuite) TestEtcdStore(c *C) {
+	store, fake := s.newEtcdStore(c)
+	defer fake.server.Close()
+	testMetadataStore(c, store)
+	// Keys are kept under the prefix
+	_, exists := fake.values["/convoy/host1/volume_vol2.json"]
+	c.Assert(exists, Equals, true)
+
+	// Update retries if the key is changed by someone else meanwhile
+	calls := 0
+	c.Assert(store.Update("volume_vol2.json", func(value []byte) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			fake.lock.Lock()
+			fake.put("/convoy/host1/volume_vol2.json", "changed")
+			fake.lock.Unlock()
+		}
+		return append(value, '!'), nil
+	}), IsNil)
+	c.Assert(calls, Equals, 2)
+	c.Assert(fake.values["/convoy/host1/volume_vol2.json"], Equals, "changed!")
+
+	_, err := newMetadataStore(s.root, "etcd://localhost:2379")
+	c.Assert(err, ErrorMatches, "Prefix of keys is required.*")
+	_, err = newMetadataStore(s.root, "consul://localhost:8500/convoy")
+	c.Assert(err, ErrorMatches, "Unsupported metadata store.*")
+}
+
+func (s *TestSuite) TestDaemonOnEtcdStore(c *C) {
+	store, fake := s.newEtcdStore(c)
+	defer fake.server.Close()
+	d := s.newVFSDaemon(c)
+	d.store = store
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+	})
+	c.Assert(err, IsNil)
+	labels := map[string]string{"app": "db"}
+	_, err = d.processSnapshotCreate(d.getVolume("vol1"), "snap1", labels, "", nil)
+	c.Assert(err, IsNil)
+
+	_, exists := fake.values["/convoy/host1/volume_vol1.json"]
+	c.Assert(exists, Equals, true)
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.SnapshotLabels, DeepEquals, map[string]map[string]string{"snap1": labels})
+	names, err := d.listObjectNames(INTENT_CFG_PREFIX)
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+}
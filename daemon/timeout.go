@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/convoy/api"
+)
+
+// Driver operations which can be limited by --operation-timeouts
+const (
+	OPERATION_CREATE          = "create"
+	OPERATION_IMPORT          = "import"
+	OPERATION_CLONE           = "clone"
+	OPERATION_DELETE          = "delete"
+	OPERATION_MOUNT           = "mount"
+	OPERATION_UMOUNT          = "umount"
+	OPERATION_RESIZE          = "resize"
+	OPERATION_SNAPSHOT_CREATE = "snapshot_create"
+	OPERATION_SNAPSHOT_DELETE = "snapshot_delete"
+)
+
+var timedOperations = map[string]bool{
+	OPERATION_CREATE:          true,
+	OPERATION_IMPORT:          true,
+	OPERATION_CLONE:           true,
+	OPERATION_DELETE:          true,
+	OPERATION_MOUNT:           true,
+	OPERATION_UMOUNT:          true,
+	OPERATION_RESIZE:          true,
+	OPERATION_SNAPSHOT_CREATE: true,
+	OPERATION_SNAPSHOT_DELETE: true,
+}
+
+// parseOperationTimeouts parses the timeouts of driver operations in the
+// format of "<operation>=<duration>", e.g. "mount=2m"
+func parseOperationTimeouts(timeouts []string) (map[string]time.Duration, error) {
+	result := map[string]time.Duration{}
+	for _, timeout := range timeouts {
+		parts := strings.SplitN(timeout, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid operation timeout %v, must be <operation>=<duration>", timeout)
+		}
+		if !timedOperations[parts[0]] {
+			return nil, fmt.Errorf("Invalid operation %v of timeout %v", parts[0], timeout)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("Invalid timeout %v of operation %v", parts[1], parts[0])
+		}
+		result[parts[0]] = duration
+	}
+	return result, nil
+}
+
+/*
+operationContext returns the context of a driver operation, which is done once
+the timeout of operation is reached. Drivers kill the commands they execute
+for the operation then, so a hung command, e.g. mount against an unreachable
+server, doesn't hold the lock of volume forever. Operations without timeout
+are only limited by the timeouts of commands.
+*/
+func (s *daemon) operationContext(operation string) (context.Context, context.CancelFunc) {
+	if timeout, exists := s.operationTimeouts[operation]; exists {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// operationError returns err as a Timeout error if the operation failed
+// because ctx timed out
+func operationError(ctx context.Context, operation, volumeName string, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return api.NewError(api.ERROR_CODE_TIMEOUT, "Operation %v of volume %v timed out: %v", operation, volumeName, err).
+		WithDetail("volume", volumeName).WithDetail("operation", operation)
+}
@@ -0,0 +1,45 @@
+package daemon
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestParseOperationTimeouts(c *C) {
+	timeouts, err := parseOperationTimeouts([]string{"mount=2m", "snapshot_create=30s"})
+	c.Assert(err, IsNil)
+	c.Assert(timeouts, DeepEquals, map[string]time.Duration{
+		OPERATION_MOUNT:           2 * time.Minute,
+		OPERATION_SNAPSHOT_CREATE: 30 * time.Second,
+	})
+
+	_, err = parseOperationTimeouts([]string{"mount"})
+	c.Assert(err, ErrorMatches, "Invalid operation timeout mount, .*")
+	_, err = parseOperationTimeouts([]string{"backup=1m"})
+	c.Assert(err, ErrorMatches, "Invalid operation backup of timeout backup=1m")
+	_, err = parseOperationTimeouts([]string{"mount=-1s"})
+	c.Assert(err, ErrorMatches, "Invalid timeout -1s of operation mount")
+}
+
+func (s *TestSuite) TestOperationTimeout(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+
+	// Deleting vfs volume removes its directory by command, which is
+	// killed once the operation times out
+	d.operationTimeouts = map[string]time.Duration{OPERATION_DELETE: time.Nanosecond}
+	w := s.serveRequest(c, router, "DELETE", "/volumes/", &api.VolumeDeleteRequest{VolumeName: "vol1"})
+	c.Assert(w.Code, Equals, http.StatusGatewayTimeout)
+	s.assertError(c, w, api.ERROR_CODE_TIMEOUT, "Operation delete of volume vol1 timed out: .*")
+	c.Assert(d.getVolume("vol1"), NotNil)
+
+	d.operationTimeouts = map[string]time.Duration{}
+	c.Assert(d.processVolumeDelete(&api.VolumeDeleteRequest{VolumeName: "vol1"}), IsNil)
+}
@@ -0,0 +1,471 @@
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	TRASH_VOLUME_CFG_PREFIX = "trash_volume_"
+	TRASH_BACKUP_CFG_PREFIX = "trash_backup_"
+
+	TRASH_KIND_VOLUME = "volume"
+	TRASH_KIND_BACKUP = "backup"
+
+	// How often the daemon checks whether anything in trash has expired
+	TRASH_CHECK_INTERVAL = time.Minute
+)
+
+/*
+TrashEntry is a volume or backup deleted by user, which is kept until
+ExpireTime in case it's deleted by mistake. A volume in trash stays in its
+driver, but it's hidden from the daemon and its name cannot be reused until
+it's purged. A backup in trash stays in the destination. The entry of volume
+is named by the volume, and the one of backup by a generated ID, since URL
+cannot be a file name.
+*/
+type TrashEntry struct {
+	ID         string
+	Kind       string
+	VolumeName string `json:",omitempty"`
+	DriverName string `json:",omitempty"`
+	BackupURL  string `json:",omitempty"`
+	// Only the reference of volume is deleted when it's purged
+	ReferenceOnly bool `json:",omitempty"`
+	DeletedTime   string
+	ExpireTime    string
+
+	configPath string
+}
+
+func (t *TrashEntry) ConfigFile() (string, error) {
+	if t.ID == "" {
+		return "", fmt.Errorf("BUG: Invalid empty trash entry ID")
+	}
+	if t.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty trash config path")
+	}
+	prefix := TRASH_VOLUME_CFG_PREFIX
+	if t.Kind == TRASH_KIND_BACKUP {
+		prefix = TRASH_BACKUP_CFG_PREFIX
+	}
+	return filepath.Join(t.configPath, prefix+t.ID+CFG_POSTFIX), nil
+}
+
+func (t *TrashEntry) expired(now time.Time) bool {
+	expireTime, err := time.Parse(time.RubyDate, t.ExpireTime)
+	if err != nil {
+		// Better to keep it forever than to delete it by mistake
+		log.Warnf("Invalid expire time %v of %v %v in trash", t.ExpireTime, t.Kind, t.ID)
+		return false
+	}
+	return !now.Before(expireTime)
+}
+
+func parseTrashGracePeriod(period string) (time.Duration, error) {
+	if period == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return duration, nil
+}
+
+// volumeInTrash returns whether the volume is hidden in trash
+func (s *daemon) volumeInTrash(volumeName string) bool {
+	s.trashLock.RLock()
+	defer s.trashLock.RUnlock()
+	return s.trashedVolumes[volumeName]
+}
+
+func (s *daemon) setVolumeInTrash(volumeName string, inTrash bool) {
+	s.trashLock.Lock()
+	defer s.trashLock.Unlock()
+	if !inTrash {
+		delete(s.trashedVolumes, volumeName)
+		return
+	}
+	if s.trashedVolumes == nil {
+		s.trashedVolumes = make(map[string]bool)
+	}
+	s.trashedVolumes[volumeName] = true
+}
+
+func volumeInTrashError(volumeName string) *api.Error {
+	return api.NewError(api.ERROR_CODE_CONFLICT, "Volume %v is in trash, restore or purge it first",
+		volumeName).WithDetail("volume", volumeName)
+}
+
+// listTrash returns the entries in trash, oldest first
+func (s *daemon) listTrash() ([]*TrashEntry, error) {
+	entries := []*TrashEntry{}
+	for kind, prefix := range map[string]string{
+		TRASH_KIND_VOLUME: TRASH_VOLUME_CFG_PREFIX,
+		TRASH_KIND_BACKUP: TRASH_BACKUP_CFG_PREFIX,
+	} {
+		ids, err := s.listObjectNames(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			entry := &TrashEntry{
+				ID:         id,
+				Kind:       kind,
+				configPath: s.Root,
+			}
+			if err := s.loadObject(entry); err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		ti, _ := time.Parse(time.RubyDate, entries[i].DeletedTime)
+		tj, _ := time.Parse(time.RubyDate, entries[j].DeletedTime)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// loadTrash hides the volumes in trash, before the indexes are built
+func (s *daemon) loadTrash() error {
+	ids, err := s.listObjectNames(TRASH_VOLUME_CFG_PREFIX)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		s.setVolumeInTrash(id, true)
+	}
+	return nil
+}
+
+// getTrashEntry returns the entry of volume or backup, nil if it's not in
+// trash
+func (s *daemon) getTrashEntry(volumeName, backupURL string) (*TrashEntry, error) {
+	entries, err := s.listTrash()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if volumeName != "" && entry.Kind == TRASH_KIND_VOLUME && entry.VolumeName == volumeName {
+			return entry, nil
+		}
+		if backupURL != "" && entry.Kind == TRASH_KIND_BACKUP && entry.BackupURL == backupURL {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *daemon) findTrashEntry(volumeName, backupURL string) (*TrashEntry, error) {
+	if (volumeName == "") == (backupURL == "") {
+		return nil, fmt.Errorf("Either volume name or backup URL of trash entry is required")
+	}
+	entry, err := s.getTrashEntry(volumeName, backupURL)
+	if err != nil || entry != nil {
+		return entry, err
+	}
+	if volumeName != "" {
+		return nil, api.NewError(api.ERROR_CODE_NOT_FOUND, "Volume %v is not in trash", volumeName).WithDetail("volume", volumeName)
+	}
+	return nil, api.NewError(api.ERROR_CODE_NOT_FOUND, "Backup %v is not in trash", backupURL).WithDetail("backup", backupURL)
+}
+
+func (s *daemon) newTrashEntry(kind, id string) *TrashEntry {
+	now := time.Now()
+	return &TrashEntry{
+		ID:          id,
+		Kind:        kind,
+		DeletedTime: now.Format(time.RubyDate),
+		ExpireTime:  now.Add(s.trashGracePeriod).Format(time.RubyDate),
+		configPath:  s.Root,
+	}
+}
+
+/*
+trashVolume moves the volume to trash instead of deleting it. The volume must
+not be mounted, since it's hidden until it's restored. Its name and the ones
+of its snapshots are dropped from the indexes like a deleted volume, and added
+back by restore. The caller holds the lock of volume.
+*/
+func (s *daemon) trashVolume(volume *Volume, referenceOnly bool) error {
+	volOps, err := s.getVolumeOpsForVolume(volume)
+	if err != nil {
+		return err
+	}
+	mountPoint, err := volOps.MountPoint(Request{
+		Name:    volume.Name,
+		Options: map[string]string{},
+	})
+	if err != nil {
+		return err
+	}
+	if mountPoint != "" {
+		return api.NewError(api.ERROR_CODE_IN_USE, "Volume %v is mounted at %v, umount it before deleting",
+			volume.Name, mountPoint).WithDetail("volume", volume.Name)
+	}
+	// In the case of snapshot is not supported, snapshots would be nil
+	snapshots, _ := s.listSnapshotDriverInfos(volume)
+
+	entry := s.newTrashEntry(TRASH_KIND_VOLUME, volume.Name)
+	entry.VolumeName = volume.Name
+	entry.DriverName = volume.DriverName
+	entry.ReferenceOnly = referenceOnly
+	if err := s.saveObject(entry); err != nil {
+		return err
+	}
+	s.setVolumeInTrash(volume.Name, true)
+	if err := s.NameUUIDIndex.Delete(volume.Name); err != nil {
+		return err
+	}
+	for snapshotName := range snapshots {
+		if err := s.SnapshotVolumeIndex.Delete(snapshotName); err != nil {
+			return err
+		}
+		if err := s.NameUUIDIndex.Delete(snapshotName); err != nil {
+			return err
+		}
+	}
+	s.publishClusterHost()
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_TRASH,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volume.Name,
+	}).Debugf("Moved volume to trash until %v", entry.ExpireTime)
+	return nil
+}
+
+// trashBackup moves the backup to trash instead of deleting it
+func (s *daemon) trashBackup(backupURL string) error {
+	backupOps, err := s.getBackupOpsForBackup(backupURL)
+	if err != nil {
+		return err
+	}
+	if _, err := backupOps.GetBackupInfo(backupURL); err != nil {
+		return err
+	}
+
+	s.trashOpLock.Lock()
+	defer s.trashOpLock.Unlock()
+
+	entry, err := s.getTrashEntry("", backupURL)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		return api.NewError(api.ERROR_CODE_CONFLICT, "Backup %v is already in trash", backupURL).WithDetail("backup", backupURL)
+	}
+	entry = s.newTrashEntry(TRASH_KIND_BACKUP, util.NewUUID())
+	entry.BackupURL = backupURL
+	if err := s.saveObject(entry); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_TRASH,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_BACKUP_URL,
+		LOG_FIELD_DEST_URL: backupURL,
+	}).Debugf("Moved backup to trash until %v", entry.ExpireTime)
+	return nil
+}
+
+// restoreTrashEntry brings the volume or backup back, as if it was never
+// deleted. The caller holds trashOpLock.
+func (s *daemon) restoreTrashEntry(entry *TrashEntry) error {
+	if entry.Kind == TRASH_KIND_BACKUP {
+		return s.deleteObject(entry)
+	}
+
+	name := entry.VolumeName
+	s.volumeLocks.Lock(name)
+	defer s.volumeLocks.Unlock(name)
+
+	volume := &Volume{
+		Name:       name,
+		DriverName: entry.DriverName,
+	}
+	snapshots, _ := s.listSnapshotDriverInfos(volume)
+	// The names may have been taken meanwhile, by snapshots of other volumes
+	names := []string{name}
+	for snapshotName := range snapshots {
+		names = append(names, snapshotName)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if s.NameUUIDIndex.Get(n) != "" {
+			return api.NewError(api.ERROR_CODE_CONFLICT, "Cannot restore volume %v, name %v has been taken", name, n).WithDetail("volume", name)
+		}
+	}
+	if err := s.NameUUIDIndex.Add(name, "exists"); err != nil {
+		return err
+	}
+	for snapshotName := range snapshots {
+		if err := s.SnapshotVolumeIndex.Add(snapshotName, name); err != nil {
+			return err
+		}
+		if err := s.NameUUIDIndex.Add(snapshotName, "exists"); err != nil {
+			return err
+		}
+	}
+	if err := s.deleteObject(entry); err != nil {
+		return err
+	}
+	s.setVolumeInTrash(name, false)
+	s.publishClusterHost()
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_RESTORE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: name,
+	}).Debug("Restored volume from trash")
+	return nil
+}
+
+// purgeTrashEntry deletes the volume or backup for real. The caller holds
+// trashOpLock.
+func (s *daemon) purgeTrashEntry(entry *TrashEntry) error {
+	if entry.Kind == TRASH_KIND_BACKUP {
+		if err := s.processBackupDelete(entry.BackupURL); err != nil {
+			return err
+		}
+		return s.deleteObject(entry)
+	}
+
+	name := entry.VolumeName
+	s.volumeLocks.Lock(name)
+	defer s.volumeLocks.Unlock(name)
+
+	if err := s.deleteVolume(&Volume{
+		Name:       name,
+		DriverName: entry.DriverName,
+	}, entry.ReferenceOnly); err != nil {
+		return err
+	}
+	if err := s.deleteObject(entry); err != nil {
+		return err
+	}
+	s.setVolumeInTrash(name, false)
+	return nil
+}
+
+func (s *daemon) doTrashList(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	s.trashOpLock.Lock()
+	defer s.trashOpLock.Unlock()
+
+	entries, err := s.listTrash()
+	if err != nil {
+		return err
+	}
+	return writeResponseOutput(w, entries)
+}
+
+func (s *daemon) doTrashRestore(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.TrashRestoreRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.BackupURL = util.UnescapeURL(request.BackupURL)
+
+	s.trashOpLock.Lock()
+	defer s.trashOpLock.Unlock()
+
+	entry, err := s.findTrashEntry(request.VolumeName, request.BackupURL)
+	if err != nil {
+		return err
+	}
+	return s.restoreTrashEntry(entry)
+}
+
+func (s *daemon) doTrashPurge(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.TrashPurgeRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+	request.BackupURL = util.UnescapeURL(request.BackupURL)
+
+	s.trashOpLock.Lock()
+	defer s.trashOpLock.Unlock()
+
+	if !request.All {
+		entry, err := s.findTrashEntry(request.VolumeName, request.BackupURL)
+		if err != nil {
+			return err
+		}
+		return s.purgeTrashEntry(entry)
+	}
+	if request.VolumeName != "" || request.BackupURL != "" {
+		return fmt.Errorf("Cannot purge all entries and a specific one at the same time")
+	}
+	entries, err := s.listTrash()
+	if err != nil {
+		return err
+	}
+	// Keep going, so one broken entry doesn't hold the others
+	failures := []string{}
+	for _, entry := range entries {
+		if err := s.purgeTrashEntry(entry); err != nil {
+			failures = append(failures, fmt.Sprintf("%v %v: %v", entry.Kind, entry.ID, err))
+		}
+	}
+	if len(failures) != 0 {
+		return fmt.Errorf("Failed to purge %v of trash: %v", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (s *daemon) startTrashReaper() {
+	go func() {
+		for now := range time.Tick(TRASH_CHECK_INTERVAL) {
+			s.reapTrash(now)
+		}
+	}()
+}
+
+// reapTrash purges the entries expired by now. Failed ones are retried next
+// time.
+func (s *daemon) reapTrash(now time.Time) {
+	s.trashOpLock.Lock()
+	defer s.trashOpLock.Unlock()
+
+	entries, err := s.listTrash()
+	if err != nil {
+		log.Errorf("Failed to list trash: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if !entry.expired(now) {
+			continue
+		}
+		if err := s.purgeTrashEntry(entry); err != nil {
+			log.WithFields(logrus.Fields{
+				LOG_FIELD_REASON: LOG_REASON_FAILURE,
+				LOG_FIELD_EVENT:  LOG_EVENT_TRASH,
+			}).Errorf("Failed to purge expired %v %v in trash: %v", entry.Kind, entry.ID, err)
+			continue
+		}
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+			LOG_FIELD_EVENT:  LOG_EVENT_TRASH,
+		}).Debugf("Purged expired %v %v in trash", entry.Kind, entry.ID)
+	}
+}
@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rancher/convoy/api"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestVolumeTrash(c *C) {
+	d := s.newVFSDaemon(c)
+	d.trashGracePeriod = time.Hour
+	router := createRouter(d)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:   "vol1",
+		Labels: map[string]string{"team": "web"},
+	})
+	c.Assert(err, IsNil)
+	_, err = d.processSnapshotCreate(d.getVolume("vol1"), "snap1", nil, "", nil)
+	c.Assert(err, IsNil)
+
+	// Deleted volume is hidden and its name cannot be reused
+	c.Assert(d.processVolumeDelete(&api.VolumeDeleteRequest{VolumeName: "vol1"}), IsNil)
+	path := filepath.Join(s.root, "volumes", "vol1")
+	_, err = os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(d.getVolume("vol1"), IsNil)
+	c.Assert(d.getVolumeList(), HasLen, 0)
+	c.Assert(d.SnapshotVolumeIndex.Get("snap1"), Equals, "")
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, ErrorMatches, "Volume vol1 is in trash, restore or purge it first")
+
+	w := s.serveRequest(c, router, "GET", "/v1/trash/list", nil)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	entries := []*TrashEntry{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &entries), IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Kind, Equals, TRASH_KIND_VOLUME)
+	c.Assert(entries[0].VolumeName, Equals, "vol1")
+
+	// Still in trash after restart
+	d = s.newVFSDaemon(c)
+	d.trashGracePeriod = time.Hour
+	router = createRouter(d)
+	c.Assert(d.getVolume("vol1"), IsNil)
+
+	w = s.serveRequest(c, router, "POST", "/v1/trash/restore", &api.TrashRestoreRequest{VolumeName: "vol1"})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(d.getVolume("vol1"), NotNil)
+	c.Assert(d.SnapshotVolumeIndex.Get("snap1"), Equals, "vol1")
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.Labels, DeepEquals, map[string]string{"team": "web"})
+	w = s.serveRequest(c, router, "POST", "/v1/trash/restore", &api.TrashRestoreRequest{VolumeName: "vol1"})
+	s.assertError(c, w, api.ERROR_CODE_NOT_FOUND, "Volume vol1 is not in trash")
+
+	// Mounted volume cannot be moved to trash
+	_, err = d.processVolumeMount(d.getVolume("vol1"), &api.VolumeMountRequest{VolumeName: "vol1"})
+	c.Assert(err, IsNil)
+	c.Assert(d.processVolumeDelete(&api.VolumeDeleteRequest{VolumeName: "vol1"}), ErrorMatches, "Volume vol1 is mounted at .*, umount it before deleting")
+	c.Assert(d.processVolumeUmount(d.getVolume("vol1")), IsNil)
+
+	// Deleted for real once expired
+	c.Assert(d.processVolumeDelete(&api.VolumeDeleteRequest{VolumeName: "vol1"}), IsNil)
+	now := time.Now()
+	d.reapTrash(now)
+	_, err = os.Stat(path)
+	c.Assert(err, IsNil)
+	d.reapTrash(now.Add(2 * time.Hour))
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	entries, err = d.listTrash()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+	c.Assert(d.volumeInTrash("vol1"), Equals, false)
+	exists, err := d.objectExists(&VolumeConfig{Name: "vol1", configPath: s.root})
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+
+	// Purged right away if requested
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol2"})
+	c.Assert(err, IsNil)
+	c.Assert(d.processVolumeDelete(&api.VolumeDeleteRequest{VolumeName: "vol2", Purge: true}), IsNil)
+	_, err = os.Stat(filepath.Join(s.root, "volumes", "vol2"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	entries, err = d.listTrash()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+}
+
+func (s *TestSuite) TestBackupTrash(c *C) {
+	d := s.newVFSDaemon(c)
+	d.trashGracePeriod = time.Hour
+	d.TrashBackups = true
+	router := createRouter(d)
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	volume := d.getVolume("vol1")
+	snapshotName, err := d.processSnapshotCreate(volume, "", nil, "", nil)
+	c.Assert(err, IsNil)
+	backupURL, err := d.processBackupCreate(snapshotName, "vfs://"+dest, "", "")
+	c.Assert(err, IsNil)
+	backupOps, err := d.getBackupOpsForVolume(volume)
+	c.Assert(err, IsNil)
+
+	// Backup stays in the destination until it's purged
+	w := s.serveRequest(c, router, "DELETE", "/v1/backups", &api.BackupDeleteRequest{URL: backupURL})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	_, err = backupOps.GetBackupInfo(backupURL)
+	c.Assert(err, IsNil)
+	w = s.serveRequest(c, router, "DELETE", "/v1/backups", &api.BackupDeleteRequest{URL: backupURL})
+	s.assertError(c, w, api.ERROR_CODE_CONFLICT, "Backup .* is already in trash")
+
+	w = s.serveRequest(c, router, "POST", "/v1/trash/restore", &api.TrashRestoreRequest{BackupURL: backupURL})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	entries, err := d.listTrash()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	w = s.serveRequest(c, router, "DELETE", "/v1/backups", &api.BackupDeleteRequest{URL: backupURL})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	w = s.serveRequest(c, router, "DELETE", "/v1/trash", &api.TrashPurgeRequest{All: true})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	_, err = backupOps.GetBackupInfo(backupURL)
+	c.Assert(err, NotNil)
+	entries, err = d.listTrash()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+}
@@ -1,9 +1,13 @@
 package daemon
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/api"
@@ -18,9 +22,101 @@ type Volume struct {
 	DriverName string
 }
 
-var notFoundAPIError = APIError{
-	statusCode: http.StatusNotFound,
-	error:      fmt.Sprintf("Volume not found."),
+// VolumeConfig is the daemon's own record of a volume, for the information
+// which doesn't belong to any driver
+type VolumeConfig struct {
+	Name               string
+	BackupDestinations []string
+	// BackupBases are the snapshots last backed up, by destination URL,
+	// which the next backups there are incremental from
+	BackupBases map[string]string `json:",omitempty"`
+	Labels      map[string]string
+	// Labels of snapshots of the volume, by snapshot name
+	SnapshotLabels map[string]map[string]string `json:",omitempty"`
+	// Options the volume was created with, see volumeCreateOptions(). Nil
+	// for volumes created before they were recorded.
+	CreateOptions map[string]string `json:",omitempty"`
+	// SnapshotRetention is enforced after every snapshot of the volume is
+	// created, nil for none
+	SnapshotRetention *api.SnapshotRetention `json:",omitempty"`
+	// Fence keeps the host of it from mounting the volume, nil if the volume
+	// isn't fenced
+	Fence *api.VolumeFence `json:",omitempty"`
+	// DockerMountCallers are the IDs Docker mounted the volume for, see
+	// addDockerMount()
+	DockerMountCallers []string `json:",omitempty"`
+	// CSIPublishTargets are the paths CSI published the volume to, see
+	// addCSIPublishTarget()
+	CSIPublishTargets []string `json:",omitempty"`
+
+	configPath string
+}
+
+func (v *VolumeConfig) ConfigFile() (string, error) {
+	if v.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume name")
+	}
+	if v.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume config path")
+	}
+	return filepath.Join(v.configPath, VOLUME_CFG_PREFIX+v.Name+CFG_POSTFIX), nil
+}
+
+func (s *daemon) loadVolumeConfig(name string) (*VolumeConfig, error) {
+	config := &VolumeConfig{
+		Name:       name,
+		configPath: s.Root,
+	}
+	exists, err := s.objectExists(config)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return config, nil
+	}
+	if err := s.loadObject(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// updateVolumeConfig saves the config of volume changed by modify, which
+// returns whether it's changed. The config is read and saved atomically, and
+// modify may be called again if it's changed by another daemon meanwhile. Like
+// loadVolumeConfig, a blank config is used if there is none yet.
+func (s *daemon) updateVolumeConfig(name string, modify func(config *VolumeConfig) (bool, error)) error {
+	key, err := objectKey(&VolumeConfig{Name: name, configPath: s.Root})
+	if err != nil {
+		return err
+	}
+	return s.store.Update(key, func(value []byte) ([]byte, error) {
+		config := &VolumeConfig{
+			Name:       name,
+			configPath: s.Root,
+		}
+		if value != nil {
+			if err := json.Unmarshal(value, config); err != nil {
+				return nil, fmt.Errorf("Cannot parse %v in %v metadata store: %v", key, s.store.Kind(), err)
+			}
+		}
+		changed, err := modify(config)
+		if err != nil || !changed {
+			return nil, err
+		}
+		return encodeObject(config)
+	})
+}
+
+func (s *daemon) deleteVolumeConfig(name string) error {
+	config := &VolumeConfig{
+		Name:       name,
+		configPath: s.Root,
+	}
+	exists, err := s.objectExists(config)
+	if err != nil || !exists {
+		return err
+	}
+	return s.deleteObject(config)
 }
 
 func (s *daemon) getVolume(name string) *Volume {
@@ -72,6 +168,11 @@ func (s *daemon) isVolumeAttached(name string) (bool, error) {
 			return false, err
 		}
 
+		// Only EBS reports the attachment of volume in the backend, volumes
+		// of other drivers are always available once they exist
+		if _, isEBS := v["EBSVolumeID"]; !isEBS {
+			return true, nil
+		}
 		if v["AWSMountPoint"] != "" {
 			return true, nil
 		} else {
@@ -96,6 +197,9 @@ func (s *daemon) generateName() (string, error) {
 }
 
 func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume, error) {
+	if err := s.resolveVolumeProfile(request); err != nil {
+		return nil, err
+	}
 	volumeName := request.Name
 	driverName := request.DriverName
 
@@ -105,14 +209,50 @@ func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume,
 		if err != nil {
 			return nil, err
 		}
-	} else {
+	}
+
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	if request.Name != "" {
+		if s.volumeInTrash(volumeName) {
+			return nil, volumeInTrashError(volumeName)
+		}
 		exists, err := s.volumeExists(volumeName)
 		if err != nil {
 			return nil, fmt.Errorf("Error occurred while checking if volume %v exists: %v", volumeName, err)
 		}
 		if exists {
-			return nil, fmt.Errorf("Volume %v already exists ", volumeName)
+			return s.checkVolumeCreateConflict(volumeName, request)
+		}
+	}
+
+	if err := util.ValidateMountOptions(request.MountOptions); err != nil {
+		return nil, err
+	}
+
+	snapshotVolumeName := ""
+	if request.SnapshotName != "" {
+		if request.BackupURL != "" {
+			return nil, fmt.Errorf("Cannot create volume from both backup and snapshot")
+		}
+		snapshotVolumeName = s.SnapshotVolumeIndex.Get(request.SnapshotName)
+		if snapshotVolumeName == "" {
+			return nil, api.NewError(api.ERROR_CODE_NOT_FOUND, "Cannot find volume of snapshot %v", request.SnapshotName).WithDetail("snapshot", request.SnapshotName)
+		}
+		snapshotVolume := s.getVolume(snapshotVolumeName)
+		if snapshotVolume == nil {
+			return nil, fmt.Errorf("Cannot find volume %v", snapshotVolumeName)
 		}
+		// Snapshot is cloned by the driver holding it
+		if driverName != "" && driverName != snapshotVolume.DriverName {
+			return nil, fmt.Errorf("Cannot create volume of %v from snapshot %v of %v", driverName, request.SnapshotName, snapshotVolume.DriverName)
+		}
+		driverName = snapshotVolume.DriverName
+
+		// Snapshot must stay until the volume is created
+		s.volumeLocks.Lock(snapshotVolumeName)
+		defer s.volumeLocks.Unlock(snapshotVolumeName)
 	}
 
 	if driverName == "" {
@@ -122,24 +262,46 @@ func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume,
 	if err != nil {
 		return nil, err
 	}
+	if request.BackupURL != "" {
+		if err := s.checkRestore(util.UnescapeURL(request.BackupURL), driverName); err != nil {
+			return nil, err
+		}
+	}
 	volOps, err := driver.VolumeOps()
 	if err != nil {
 		return nil, err
 	}
+	if err := s.checkClusterVolumeName(volumeName, driverName); err != nil {
+		return nil, err
+	}
 
 	req := Request{
 		Name: volumeName,
 		Options: map[string]string{
-			OPT_SIZE:             strconv.FormatInt(request.Size, 10),
-			OPT_BACKUP_URL:       util.UnescapeURL(request.BackupURL),
-			OPT_VOLUME_NAME:      volumeName,
-			OPT_VOLUME_DRIVER_ID: request.DriverVolumeID,
-			OPT_VOLUME_TYPE:      request.Type,
-			OPT_VOLUME_FS_TYPE:   request.FSType,
-			OPT_VOLUME_IOPS:      strconv.FormatInt(request.IOPS, 10),
-			OPT_PREPARE_FOR_VM:   strconv.FormatBool(request.PrepareForVM),
+			OPT_SIZE:                 strconv.FormatInt(request.Size, 10),
+			OPT_BACKUP_URL:           util.UnescapeURL(request.BackupURL),
+			OPT_VOLUME_NAME:          volumeName,
+			OPT_VOLUME_DRIVER_ID:     request.DriverVolumeID,
+			OPT_VOLUME_TYPE:          request.Type,
+			OPT_VOLUME_FS_TYPE:       request.FSType,
+			OPT_VOLUME_IOPS:          strconv.FormatInt(request.IOPS, 10),
+			OPT_VOLUME_THROUGHPUT:    strconv.FormatInt(request.Throughput, 10),
+			OPT_PREPARE_FOR_VM:       strconv.FormatBool(request.PrepareForVM),
+			OPT_MOUNT_OPTIONS:        request.MountOptions,
+			OPT_READ_ONLY:            strconv.FormatBool(request.ReadOnly),
+			OPT_SNAPSHOT_NAME:        request.SnapshotName,
+			OPT_SNAPSHOT_VOLUME_NAME: snapshotVolumeName,
+			OPT_TAGS:                 util.FormatTags(request.Tags),
+			OPT_ENCRYPTED:            strconv.FormatBool(request.Encrypted),
+			OPT_KMS_KEY_ID:           request.KmsKeyID,
+			OPT_UID:                  request.UID,
+			OPT_GID:                  request.GID,
+			OPT_MODE:                 request.Mode,
 		},
 	}
+	ctx, cancel := s.operationContext(OPERATION_CREATE)
+	defer cancel()
+	req.Ctx = ctx
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON: LOG_REASON_PREPARE,
 		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
@@ -148,7 +310,7 @@ func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume,
 		LOG_FIELD_OPTS:   req.Options,
 	}).Debug()
 	if err := volOps.CreateVolume(req); err != nil {
-		return nil, err
+		return nil, operationError(ctx, OPERATION_CREATE, volumeName, err)
 	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
@@ -162,17 +324,136 @@ func (s *daemon) processVolumeCreate(request *api.VolumeCreateRequest) (*Volume,
 		DriverName: driverName,
 	}
 
+	config, err := s.loadVolumeConfig(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Labels) != 0 {
+		config.Labels = request.Labels
+	}
+	config.CreateOptions = volumeCreateOptions(request)
+	if err := s.saveObject(config); err != nil {
+		return nil, err
+	}
+
 	if err := s.NameUUIDIndex.Add(volumeName, "exists"); err != nil {
 		return nil, err
 	}
+	s.notifier.notify(&api.EventResponse{
+		Event:  EVENT_VOLUME_CREATE,
+		Volume: volumeName,
+	})
+	s.publishClusterHost()
 	return volume, nil
 }
 
+// volumeCreateOptions returns the options explicitly specified by request,
+// which should match the existing volume if it's created again
+func volumeCreateOptions(request *api.VolumeCreateRequest) map[string]string {
+	opts := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			opts[key] = value
+		}
+	}
+	if request.Size != 0 {
+		set(OPT_SIZE, strconv.FormatInt(request.Size, 10))
+	}
+	set(OPT_BACKUP_URL, util.UnescapeURL(request.BackupURL))
+	set(OPT_VOLUME_DRIVER_ID, request.DriverVolumeID)
+	set(OPT_VOLUME_TYPE, request.Type)
+	set(OPT_VOLUME_FS_TYPE, request.FSType)
+	if request.IOPS != 0 {
+		set(OPT_VOLUME_IOPS, strconv.FormatInt(request.IOPS, 10))
+	}
+	if request.Throughput != 0 {
+		set(OPT_VOLUME_THROUGHPUT, strconv.FormatInt(request.Throughput, 10))
+	}
+	if request.PrepareForVM {
+		set(OPT_PREPARE_FOR_VM, "true")
+	}
+	set(OPT_MOUNT_OPTIONS, request.MountOptions)
+	if request.ReadOnly {
+		set(OPT_READ_ONLY, "true")
+	}
+	set(OPT_SNAPSHOT_NAME, request.SnapshotName)
+	if request.Encrypted {
+		set(OPT_ENCRYPTED, "true")
+	}
+	set(OPT_KMS_KEY_ID, request.KmsKeyID)
+	set(OPT_UID, request.UID)
+	set(OPT_GID, request.GID)
+	set(OPT_MODE, request.Mode)
+	set(CREATE_OPT_PROFILE, request.Profile)
+	return opts
+}
+
+/*
+checkVolumeCreateConflict makes creating an existing volume succeed if the
+request is the same as the one created it, e.g. when Docker retries, so
+caller must hold the lock of volume. Only the options specified by request
+are compared, and volumes created before the options were recorded are
+only checked by driver.
+*/
+func (s *daemon) checkVolumeCreateConflict(volumeName string, request *api.VolumeCreateRequest) (*Volume, error) {
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return nil, api.NewError(api.ERROR_CODE_CONFLICT, "Volume %v already exists", volumeName).WithDetail("volume", volumeName)
+	}
+	if request.DriverName != "" && request.DriverName != volume.DriverName {
+		return nil, volumeConflictError(volumeName, []string{
+			fmt.Sprintf("driver is %v rather than %v", volume.DriverName, request.DriverName),
+		})
+	}
+
+	config, err := s.loadVolumeConfig(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if config.CreateOptions != nil {
+		opts := volumeCreateOptions(request)
+		keys := []string{}
+		for key := range opts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		diffs := []string{}
+		for _, key := range keys {
+			if opts[key] != config.CreateOptions[key] {
+				diffs = append(diffs, fmt.Sprintf("%v is %q rather than %q", key, config.CreateOptions[key], opts[key]))
+			}
+		}
+		if len(diffs) != 0 {
+			return nil, volumeConflictError(volumeName, diffs)
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volumeName,
+	}).Debug("Volume already exists with the same options")
+	if err := s.NameUUIDIndex.Add(volumeName, "exists"); err != nil {
+		return nil, err
+	}
+	return volume, nil
+}
+
+func volumeConflictError(volumeName string, diffs []string) error {
+	return api.NewError(api.ERROR_CODE_CONFLICT, "Volume %v already exists with different options: %v",
+		volumeName, strings.Join(diffs, ", ")).WithDetail("volume", volumeName)
+}
+
 func (s *daemon) doVolumeCreate(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.VolumeCreateRequest{}
 	if err := decodeRequest(r, request); err != nil {
 		return err
 	}
+	if request.EncryptionKey != "" {
+		if _, err := s.addEncryptionKey(request.EncryptionKey); err != nil {
+			return err
+		}
+	}
 
 	volume, err := s.processVolumeCreate(request)
 	if err != nil {
@@ -195,6 +476,276 @@ func (s *daemon) doVolumeCreate(version string, w http.ResponseWriter, r *http.R
 	return writeStringResponse(w, volume.Name)
 }
 
+func (s *daemon) processVolumeImport(request *api.VolumeImportRequest) (*Volume, error) {
+	volumeName := request.Name
+	if volumeName == "" {
+		return nil, fmt.Errorf("Volume name is required to import")
+	}
+	if err := util.CheckName(volumeName); err != nil {
+		return nil, err
+	}
+	if request.Source == "" {
+		return nil, fmt.Errorf("Source to import as volume %v is required", volumeName)
+	}
+	if err := util.ValidateMountOptions(request.MountOptions); err != nil {
+		return nil, err
+	}
+
+	s.volumeLocks.Lock(volumeName)
+	defer s.volumeLocks.Unlock(volumeName)
+
+	exists, err := s.volumeExists(volumeName)
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred while checking if volume %v exists: %v", volumeName, err)
+	}
+	if exists {
+		return nil, api.NewError(api.ERROR_CODE_CONFLICT, "Volume %v already exists", volumeName).WithDetail("volume", volumeName)
+	}
+
+	driverName := request.DriverName
+	if driverName == "" {
+		driverName = s.DefaultDriver
+	}
+	driver, err := s.getDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+	volOps, err := driver.VolumeOps()
+	if err != nil {
+		return nil, err
+	}
+	importer, ok := volOps.(VolumeImporter)
+	if !ok {
+		return nil, driverUnsupportedError(driverName, "import")
+	}
+	if err := s.checkClusterVolumeName(volumeName, driverName); err != nil {
+		return nil, err
+	}
+
+	req := Request{
+		Name: volumeName,
+		Options: map[string]string{
+			OPT_IMPORT_SOURCE: request.Source,
+			OPT_VOLUME_NAME:   volumeName,
+			OPT_MOUNT_OPTIONS: request.MountOptions,
+			OPT_READ_ONLY:     strconv.FormatBool(request.ReadOnly),
+		},
+	}
+	ctx, cancel := s.operationContext(OPERATION_IMPORT)
+	defer cancel()
+	req.Ctx = ctx
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volumeName,
+		LOG_FIELD_OPTS:   req.Options,
+	}).Debug("Importing volume")
+	if err := importer.ImportVolume(req); err != nil {
+		return nil, operationError(ctx, OPERATION_IMPORT, volumeName, err)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volumeName,
+	}).Debug("Imported volume")
+
+	config, err := s.loadVolumeConfig(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Labels) != 0 {
+		config.Labels = request.Labels
+	}
+	// Source is recorded to tell imported volumes from created ones
+	config.CreateOptions = map[string]string{
+		OPT_IMPORT_SOURCE: request.Source,
+	}
+	if err := s.saveObject(config); err != nil {
+		return nil, err
+	}
+
+	if err := s.NameUUIDIndex.Add(volumeName, "exists"); err != nil {
+		return nil, err
+	}
+	s.notifier.notify(&api.EventResponse{
+		Event:  EVENT_VOLUME_CREATE,
+		Volume: volumeName,
+	})
+	s.publishClusterHost()
+	return &Volume{
+		Name:       volumeName,
+		DriverName: driverName,
+	}, nil
+}
+
+func (s *daemon) doVolumeImport(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeImportRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volume, err := s.processVolumeImport(request)
+	if err != nil {
+		return err
+	}
+
+	if request.Verbose {
+		driverInfo, err := s.getVolumeDriverInfo(volume)
+		if err != nil {
+			return err
+		}
+		return writeResponseOutput(w, api.VolumeResponse{
+			Name:        volume.Name,
+			Driver:      volume.DriverName,
+			CreatedTime: driverInfo[OPT_VOLUME_CREATED_TIME],
+			DriverInfo:  driverInfo,
+			Snapshots:   map[string]api.SnapshotResponse{},
+		})
+	}
+	return writeStringResponse(w, volume.Name)
+}
+
+/*
+processVolumeClone creates a writable copy of a volume by the driver of it,
+while the volume may be in use. Both volumes are locked until the copy is
+created, in the order of their names so concurrent clones can't deadlock.
+*/
+func (s *daemon) processVolumeClone(request *api.VolumeCloneRequest) (*Volume, error) {
+	volumeName := request.Name
+	sourceName := request.VolumeName
+	if volumeName == "" {
+		return nil, fmt.Errorf("Volume name is required to clone")
+	}
+	if err := util.CheckName(volumeName); err != nil {
+		return nil, err
+	}
+	if err := util.CheckName(sourceName); err != nil {
+		return nil, err
+	}
+	if volumeName == sourceName {
+		return nil, fmt.Errorf("Cannot clone volume %v to itself", sourceName)
+	}
+
+	names := []string{sourceName, volumeName}
+	sort.Strings(names)
+	for _, name := range names {
+		s.volumeLocks.Lock(name)
+		defer s.volumeLocks.Unlock(name)
+	}
+
+	source := s.getVolume(sourceName)
+	if source == nil {
+		return nil, volumeNotFoundError(sourceName)
+	}
+	exists, err := s.volumeExists(volumeName)
+	if err != nil {
+		return nil, fmt.Errorf("Error occurred while checking if volume %v exists: %v", volumeName, err)
+	}
+	if exists {
+		return nil, api.NewError(api.ERROR_CODE_CONFLICT, "Volume %v already exists", volumeName).WithDetail("volume", volumeName)
+	}
+
+	driverName := source.DriverName
+	driver, err := s.getDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+	volOps, err := driver.VolumeOps()
+	if err != nil {
+		return nil, err
+	}
+	cloner, ok := volOps.(VolumeCloner)
+	if !ok {
+		return nil, driverUnsupportedError(driverName, "clone")
+	}
+	if err := s.checkClusterVolumeName(volumeName, driverName); err != nil {
+		return nil, err
+	}
+
+	req := Request{
+		Name: volumeName,
+		Options: map[string]string{
+			OPT_CLONE_SOURCE: sourceName,
+			OPT_VOLUME_NAME:  volumeName,
+		},
+	}
+	ctx, cancel := s.operationContext(OPERATION_CLONE)
+	defer cancel()
+	req.Ctx = ctx
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volumeName,
+		LOG_FIELD_OPTS:   req.Options,
+	}).Debug("Cloning volume")
+	if err := cloner.CloneVolume(req); err != nil {
+		return nil, operationError(ctx, OPERATION_CLONE, volumeName, err)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volumeName,
+	}).Debug("Cloned volume")
+
+	config, err := s.loadVolumeConfig(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if len(request.Labels) != 0 {
+		config.Labels = request.Labels
+	}
+	config.CreateOptions = map[string]string{
+		OPT_CLONE_SOURCE: sourceName,
+	}
+	if err := s.saveObject(config); err != nil {
+		return nil, err
+	}
+
+	if err := s.NameUUIDIndex.Add(volumeName, "exists"); err != nil {
+		return nil, err
+	}
+	s.notifier.notify(&api.EventResponse{
+		Event:  EVENT_VOLUME_CREATE,
+		Volume: volumeName,
+	})
+	s.publishClusterHost()
+	return &Volume{
+		Name:       volumeName,
+		DriverName: driverName,
+	}, nil
+}
+
+func (s *daemon) doVolumeClone(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeCloneRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volume, err := s.processVolumeClone(request)
+	if err != nil {
+		return err
+	}
+
+	if request.Verbose {
+		driverInfo, err := s.getVolumeDriverInfo(volume)
+		if err != nil {
+			return err
+		}
+		return writeResponseOutput(w, api.VolumeResponse{
+			Name:        volume.Name,
+			Driver:      volume.DriverName,
+			CreatedTime: driverInfo[OPT_VOLUME_CREATED_TIME],
+			DriverInfo:  driverInfo,
+			Snapshots:   map[string]api.SnapshotResponse{},
+		})
+	}
+	return writeStringResponse(w, volume.Name)
+}
+
 func (s *daemon) doVolumeDelete(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
 	request := &api.VolumeDeleteRequest{}
 	if err := decodeRequest(r, request); err != nil {
@@ -208,13 +759,28 @@ func (s *daemon) doVolumeDelete(version string, w http.ResponseWriter, r *http.R
 	return s.processVolumeDelete(request)
 }
 
+// processVolumeDelete moves the volume to trash if it's enabled, unless the
+// request purges it
 func (s *daemon) processVolumeDelete(request *api.VolumeDeleteRequest) error {
 	name := request.VolumeName
 
+	s.volumeLocks.Lock(name)
+	defer s.volumeLocks.Unlock(name)
+
 	volume := s.getVolume(name)
 	if volume == nil {
-		return notFoundAPIError
+		return volumeNotFoundError(name)
 	}
+	if s.trashGracePeriod != 0 && !request.Purge {
+		return s.trashVolume(volume, request.ReferenceOnly)
+	}
+	return s.deleteVolume(volume, request.ReferenceOnly)
+}
+
+// deleteVolume deletes the volume for real. The caller holds the lock of
+// volume.
+func (s *daemon) deleteVolume(volume *Volume, referenceOnly bool) error {
+	name := volume.Name
 
 	// In the case of snapshot is not supported, snapshots would be nil
 	snapshots, _ := s.listSnapshotDriverInfos(volume)
@@ -227,9 +793,12 @@ func (s *daemon) processVolumeDelete(request *api.VolumeDeleteRequest) error {
 	req := Request{
 		Name: name,
 		Options: map[string]string{
-			OPT_REFERENCE_ONLY: strconv.FormatBool(request.ReferenceOnly),
+			OPT_REFERENCE_ONLY: strconv.FormatBool(referenceOnly),
 		},
 	}
+	ctx, cancel := s.operationContext(OPERATION_DELETE)
+	defer cancel()
+	req.Ctx = ctx
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON: LOG_REASON_PREPARE,
 		LOG_FIELD_EVENT:  LOG_EVENT_DELETE,
@@ -237,7 +806,7 @@ func (s *daemon) processVolumeDelete(request *api.VolumeDeleteRequest) error {
 		LOG_FIELD_VOLUME: name,
 	}).Debug()
 	if err := volOps.DeleteVolume(req); err != nil {
-		return err
+		return operationError(ctx, OPERATION_DELETE, name, err)
 	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
@@ -248,6 +817,9 @@ func (s *daemon) processVolumeDelete(request *api.VolumeDeleteRequest) error {
 	if err := s.NameUUIDIndex.Delete(volume.Name); err != nil {
 		return err
 	}
+	if err := s.deleteVolumeConfig(volume.Name); err != nil {
+		return err
+	}
 	if snapshots != nil {
 		for snapshotName := range snapshots {
 			if err := s.NameUUIDIndex.Delete(snapshotName); err != nil {
@@ -255,6 +827,14 @@ func (s *daemon) processVolumeDelete(request *api.VolumeDeleteRequest) error {
 			}
 		}
 	}
+	if err := s.releaseAttachment(volume.Name); err != nil {
+		return err
+	}
+	s.publishClusterHost()
+	s.notifier.notify(&api.EventResponse{
+		Event:  EVENT_VOLUME_DELETE,
+		Volume: name,
+	})
 	return nil
 }
 
@@ -276,13 +856,33 @@ func (s *daemon) listVolumeInfo(volume *Volume) (*api.VolumeResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	config, err := s.loadVolumeConfig(volume.Name)
+	if err != nil {
+		return nil, err
+	}
 	resp := &api.VolumeResponse{
-		Name:        volume.Name,
-		Driver:      volume.DriverName,
-		MountPoint:  mountPoint,
-		CreatedTime: driverInfo[OPT_VOLUME_CREATED_TIME],
-		DriverInfo:  driverInfo,
-		Snapshots:   make(map[string]api.SnapshotResponse),
+		Name:          volume.Name,
+		Driver:        volume.DriverName,
+		MountPoint:    mountPoint,
+		CreatedTime:   driverInfo[OPT_VOLUME_CREATED_TIME],
+		UsedSize:      driverInfo[OPT_USED_SIZE],
+		AllocatedSize: driverInfo[OPT_ALLOCATED_SIZE],
+		Labels:        config.Labels,
+		DriverInfo:    driverInfo,
+		Snapshots:     make(map[string]api.SnapshotResponse),
+
+		SnapshotRetention: config.SnapshotRetention,
+		Fence:             config.Fence,
+	}
+	if s.clusterMode() {
+		resp.Host = s.ClusterHost
+		attachment, err := s.loadAttachment(volume.Name)
+		if err != nil {
+			return nil, err
+		}
+		if attachment != nil {
+			resp.AttachedHost = attachment.Host
+		}
 	}
 	snapshots, err := s.listSnapshotDriverInfos(volume)
 	if err != nil {
@@ -294,13 +894,14 @@ func (s *daemon) listVolumeInfo(volume *Volume) (*api.VolumeResponse, error) {
 		resp.Snapshots[name] = api.SnapshotResponse{
 			Name:        name,
 			CreatedTime: snapshot[OPT_SNAPSHOT_CREATED_TIME],
+			Labels:      config.SnapshotLabels[name],
 			DriverInfo:  snapshot,
 		}
 	}
 	return resp, nil
 }
 
-func (s *daemon) listVolume() ([]byte, error) {
+func (s *daemon) listVolume(filters []labelFilter) ([]byte, error) {
 	log.Debugf("Received request to list volumes")
 	list := make(map[string]api.VolumeResponse)
 
@@ -308,16 +909,27 @@ func (s *daemon) listVolume() ([]byte, error) {
 	volumes := s.getVolumeList()
 
 	for name, driverInfo := range volumes {
+		config, err := s.loadVolumeConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		if !labelsMatchFilters(config.Labels, filters) {
+			continue
+		}
+
 		log.Debugf("Getting info for volume %s", name)
 		volume := &Volume{Name: name, DriverName: driverInfo["Driver"]}
 
 		resp := &api.VolumeResponse{
-			Name:        name,
-			Driver:      driverInfo["Driver"],
-			MountPoint:  driverInfo["MountPoint"],
-			CreatedTime: driverInfo[OPT_VOLUME_CREATED_TIME],
-			DriverInfo:  driverInfo,
-			Snapshots:   make(map[string]api.SnapshotResponse),
+			Name:          name,
+			Driver:        driverInfo["Driver"],
+			MountPoint:    driverInfo["MountPoint"],
+			CreatedTime:   driverInfo[OPT_VOLUME_CREATED_TIME],
+			UsedSize:      driverInfo[OPT_USED_SIZE],
+			AllocatedSize: driverInfo[OPT_ALLOCATED_SIZE],
+			Labels:        config.Labels,
+			DriverInfo:    driverInfo,
+			Snapshots:     make(map[string]api.SnapshotResponse),
 		}
 		log.Debugf("Getting info for snapshots for volume %s if any", name)
 		snapshots, err := s.listSnapshotDriverInfos(volume)
@@ -330,6 +942,7 @@ func (s *daemon) listVolume() ([]byte, error) {
 			resp.Snapshots[name] = api.SnapshotResponse{
 				Name:        name,
 				CreatedTime: snapshot[OPT_SNAPSHOT_CREATED_TIME],
+				Labels:      config.SnapshotLabels[name],
 				DriverInfo:  snapshot,
 			}
 		}
@@ -340,10 +953,49 @@ func (s *daemon) listVolume() ([]byte, error) {
 		log.Debugf("ListVolume computation done.")
 		list[name] = *resp
 	}
+	if err := s.addClusterVolumes(list, filters); err != nil {
+		return nil, err
+	}
 
 	return api.ResponseOutput(list)
 }
 
+// labelFilter matches labels by "label=<key>" or "label=<key>=<value>"
+type labelFilter struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+func parseLabelFilters(filters []string) ([]labelFilter, error) {
+	result := []labelFilter{}
+	for _, filter := range filters {
+		parts := strings.SplitN(filter, "=", 3)
+		if len(parts) < 2 || parts[0] != "label" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid filter %v, must be label=<key> or label=<key>=<value>", filter)
+		}
+		f := labelFilter{
+			key:      parts[1],
+			anyValue: len(parts) == 2,
+		}
+		if !f.anyValue {
+			f.value = parts[2]
+		}
+		result = append(result, f)
+	}
+	return result, nil
+}
+
+func labelsMatchFilters(labels map[string]string, filters []labelFilter) bool {
+	for _, f := range filters {
+		value, exists := labels[f.key]
+		if !exists || (!f.anyValue && value != f.value) {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *daemon) getVolumeDriverInfo(volume *Volume) (map[string]string, error) {
 	volOps, err := s.getVolumeOpsForVolume(volume)
 	if err != nil {
@@ -362,13 +1014,26 @@ func (s *daemon) doVolumeList(version string, w http.ResponseWriter, r *http.Req
 	if err != nil {
 		return err
 	}
+	filters, err := parseLabelFilters(r.URL.Query()["filter"])
+	if err != nil {
+		return err
+	}
 
 	var data []byte
 	if driverSpecific == "1" {
 		result := s.getVolumeList()
+		for name := range result {
+			config, err := s.loadVolumeConfig(name)
+			if err != nil {
+				return err
+			}
+			if !labelsMatchFilters(config.Labels, filters) {
+				delete(result, name)
+			}
+		}
 		data, err = api.ResponseOutput(&result)
 	} else {
-		data, err = s.listVolume()
+		data, err = s.listVolume(filters)
 	}
 	if err != nil {
 		return err
@@ -380,7 +1045,7 @@ func (s *daemon) doVolumeList(version string, w http.ResponseWriter, r *http.Req
 func (s *daemon) inspectVolume(name string) ([]byte, error) {
 	volume := s.getVolume(name)
 	if volume == nil {
-		return nil, notFoundAPIError
+		return nil, volumeNotFoundError(name)
 	}
 	resp, err := s.listVolumeInfo(volume)
 	if err != nil {
@@ -422,7 +1087,7 @@ func (s *daemon) doVolumeMount(version string, w http.ResponseWriter, r *http.Re
 	}
 	volume := s.getVolume(volumeName)
 	if volume == nil {
-		return fmt.Errorf("volume %v doesn't exist", volumeName)
+		return volumeNotFoundError(volumeName)
 	}
 
 	mountPoint, err := s.processVolumeMount(volume, request)
@@ -440,6 +1105,23 @@ func (s *daemon) doVolumeMount(version string, w http.ResponseWriter, r *http.Re
 }
 
 func (s *daemon) processVolumeMount(volume *Volume, request *api.VolumeMountRequest) (string, error) {
+	s.volumeLocks.Lock(volume.Name)
+	defer s.volumeLocks.Unlock(volume.Name)
+
+	mountPoint, err := s.mountVolume(volume, request)
+	if err != nil {
+		return "", err
+	}
+	s.notifier.notify(&api.EventResponse{
+		Event:      EVENT_VOLUME_MOUNT,
+		Volume:     volume.Name,
+		MountPoint: mountPoint,
+	})
+	return mountPoint, nil
+}
+
+// mountVolume mounts the volume, caller must hold the lock of volume
+func (s *daemon) mountVolume(volume *Volume, request *api.VolumeMountRequest) (string, error) {
 	volOps, err := s.getVolumeOpsForVolume(volume)
 	if err != nil {
 		return "", err
@@ -448,9 +1130,20 @@ func (s *daemon) processVolumeMount(volume *Volume, request *api.VolumeMountRequ
 	req := Request{
 		Name: volume.Name,
 		Options: map[string]string{
-			OPT_MOUNT_POINT: request.MountPoint,
+			OPT_MOUNT_POINT:   request.MountPoint,
+			OPT_MOUNT_TIMEOUT: request.Timeout,
+			OPT_READ_ONLY:     strconv.FormatBool(request.ReadOnly),
 		},
 	}
+	if err := s.checkFence(volume.Name); err != nil {
+		return "", err
+	}
+	ctx, cancel := s.operationContext(OPERATION_MOUNT)
+	defer cancel()
+	req.Ctx = ctx
+	if err := s.claimAttachment(volume); err != nil {
+		return "", err
+	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON: LOG_REASON_PREPARE,
 		LOG_FIELD_EVENT:  LOG_EVENT_MOUNT,
@@ -460,8 +1153,10 @@ func (s *daemon) processVolumeMount(volume *Volume, request *api.VolumeMountRequ
 	}).Debug()
 	mountPoint, err := volOps.MountVolume(req)
 	if err != nil {
-		return "", err
+		s.releaseUnmountedAttachment(volOps, volume)
+		return "", operationError(ctx, OPERATION_MOUNT, volume.Name, err)
 	}
+	s.publishClusterHost()
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
 		LOG_FIELD_EVENT:      LOG_EVENT_LIST,
@@ -484,21 +1179,39 @@ func (s *daemon) doVolumeUmount(version string, w http.ResponseWriter, r *http.R
 	}
 	volume := s.getVolume(volumeName)
 	if volume == nil {
-		return fmt.Errorf("volume %v doesn't exist", volumeName)
+		return volumeNotFoundError(volumeName)
 	}
 
 	return s.processVolumeUmount(volume)
 }
 
 func (s *daemon) processVolumeUmount(volume *Volume) error {
+	s.volumeLocks.Lock(volume.Name)
+	defer s.volumeLocks.Unlock(volume.Name)
+
+	if err := s.umountVolume(volume); err != nil {
+		return err
+	}
+	s.notifier.notify(&api.EventResponse{
+		Event:  EVENT_VOLUME_UMOUNT,
+		Volume: volume.Name,
+	})
+	return nil
+}
+
+// umountVolume umounts the volume, caller must hold the lock of volume
+func (s *daemon) umountVolume(volume *Volume) error {
 	volOps, err := s.getVolumeOpsForVolume(volume)
 	if err != nil {
 		return err
 	}
 
+	ctx, cancel := s.operationContext(OPERATION_UMOUNT)
+	defer cancel()
 	req := Request{
 		Name:    volume.Name,
 		Options: map[string]string{},
+		Ctx:     ctx,
 	}
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON: LOG_REASON_PREPARE,
@@ -507,8 +1220,12 @@ func (s *daemon) processVolumeUmount(volume *Volume) error {
 		LOG_FIELD_VOLUME: volume.Name,
 	}).Debug()
 	if err := volOps.UmountVolume(req); err != nil {
+		return operationError(ctx, OPERATION_UMOUNT, volume.Name, err)
+	}
+	if err := s.releaseAttachment(volume.Name); err != nil {
 		return err
 	}
+	s.publishClusterHost()
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
 		LOG_FIELD_EVENT:  LOG_EVENT_UMOUNT,
@@ -519,6 +1236,178 @@ func (s *daemon) processVolumeUmount(volume *Volume) error {
 	return nil
 }
 
+func (s *daemon) doVolumeResize(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeResizeRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
+	}
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+	if request.Size == "" {
+		return fmt.Errorf("Need new size to resize volume %v", volumeName)
+	}
+
+	return s.processVolumeResize(volume, request.Size)
+}
+
+func (s *daemon) processVolumeResize(volume *Volume, size string) error {
+	s.volumeLocks.Lock(volume.Name)
+	defer s.volumeLocks.Unlock(volume.Name)
+
+	volOps, err := s.getVolumeOpsForVolume(volume)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := s.operationContext(OPERATION_RESIZE)
+	defer cancel()
+	req := Request{
+		Name: volume.Name,
+		Options: map[string]string{
+			OPT_SIZE: size,
+		},
+		Ctx: ctx,
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:  LOG_EVENT_RESIZE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volume.Name,
+		LOG_FIELD_SIZE:   size,
+	}).Debug()
+	if err := volOps.ResizeVolume(req); err != nil {
+		return operationError(ctx, OPERATION_RESIZE, volume.Name, err)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_RESIZE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volume.Name,
+		LOG_FIELD_SIZE:   size,
+	}).Debug()
+	return nil
+}
+
+func (s *daemon) doVolumeRefresh(version string, w http.ResponseWriter, r *http.Request, objs map[string]string) error {
+	request := &api.VolumeRefreshRequest{}
+	if err := decodeRequest(r, request); err != nil {
+		return err
+	}
+
+	volumeName := request.VolumeName
+	if err := util.CheckName(volumeName); err != nil {
+		return err
+	}
+	volume := s.getVolume(volumeName)
+	if volume == nil {
+		return volumeNotFoundError(volumeName)
+	}
+
+	mountPoint, err := s.processVolumeRefresh(volume)
+	if err != nil {
+		return err
+	}
+
+	if request.Verbose {
+		return writeResponseOutput(w, api.VolumeResponse{
+			Name:       volumeName,
+			MountPoint: mountPoint,
+		})
+	}
+	return writeStringResponse(w, mountPoint)
+}
+
+func (s *daemon) processVolumeRefresh(volume *Volume) (string, error) {
+	s.volumeLocks.Lock(volume.Name)
+	defer s.volumeLocks.Unlock(volume.Name)
+
+	volOps, err := s.getVolumeOpsForVolume(volume)
+	if err != nil {
+		return "", err
+	}
+
+	req := Request{
+		Name:    volume.Name,
+		Options: map[string]string{},
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_PREPARE,
+		LOG_FIELD_EVENT:  LOG_EVENT_REFRESH,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volume.Name,
+	}).Debug()
+	mountPoint, err := volOps.RefreshMountPoint(req)
+	if err != nil {
+		return "", err
+	}
+	if err := s.refreshMountCallers(volume.Name, mountPoint); err != nil {
+		return "", err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_REFRESH,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME:     volume.Name,
+		LOG_FIELD_MOUNTPOINT: mountPoint,
+	}).Debug()
+	return mountPoint, nil
+}
+
+/*
+refreshMountCallers corrects the recorded users of the mount of volume by the
+mount table, like the mount point is, so the volume is unmounted once the
+actual users are gone. Nothing uses the volume if it's not mounted anymore,
+otherwise the targets CSI published it to which are no longer mounted are
+dropped. Callers of Docker can't be checked, so they're kept while the volume
+is mounted.
+*/
+func (s *daemon) refreshMountCallers(name, mountPoint string) error {
+	config, err := s.loadVolumeConfig(name)
+	if err != nil {
+		return err
+	}
+	mounted := map[string]bool{}
+	if mountPoint != "" && len(config.CSIPublishTargets) != 0 {
+		targets, err := util.MountedPaths(config.CSIPublishTargets)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			mounted[target] = true
+		}
+	}
+	return s.updateVolumeConfig(name, func(config *VolumeConfig) (bool, error) {
+		targets := []string{}
+		for _, target := range config.CSIPublishTargets {
+			if mounted[target] {
+				targets = append(targets, target)
+			}
+		}
+		callers := config.DockerMountCallers
+		if mountPoint == "" {
+			callers = nil
+		}
+		if len(targets) == len(config.CSIPublishTargets) && len(callers) == len(config.DockerMountCallers) {
+			return false, nil
+		}
+		log.Warnf("Volume %v was recorded as used by Docker callers %v and CSI targets %v, but found used by %v and %v, correcting",
+			name, config.DockerMountCallers, config.CSIPublishTargets, callers, targets)
+		if len(targets) == 0 {
+			targets = nil
+		}
+		config.CSIPublishTargets = targets
+		config.DockerMountCallers = callers
+		return true, nil
+	})
+}
+
 func (s *daemon) getVolumeMountPoint(volume *Volume) (string, error) {
 	volOps, err := s.getVolumeOpsForVolume(volume)
 	if err != nil {
@@ -552,6 +1441,12 @@ func (s *daemon) getVolumeMountPoint(volume *Volume) (string, error) {
 }
 
 func (s *daemon) getDriverForVolume(id string) (ConvoyDriver, error) {
+	if s.volumeInTrash(id) {
+		return nil, fmt.Errorf("Volume %v is in trash", id)
+	}
+	if owner := s.migrationOwner(id); owner != "" {
+		return s.getDriver(owner)
+	}
 	for _, driver := range s.ConvoyDrivers {
 		volOps, err := driver.VolumeOps()
 		if err != nil {
@@ -582,6 +1477,12 @@ func (s *daemon) getVolumeList() map[string]map[string]string {
 			break
 		}
 		for k, v := range volumes {
+			if s.volumeInTrash(k) {
+				continue
+			}
+			if owner := s.migrationOwner(k); owner != "" && owner != driver.Name() {
+				continue
+			}
 			v["Driver"] = driver.Name()
 			result[k] = v
 		}
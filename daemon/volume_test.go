@@ -0,0 +1,247 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/rancher/convoy/api"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestLabels(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	for name, labels := range map[string]map[string]string{
+		"vol1": {"team": "web", "env": "prod"},
+		"vol2": {"team": "db", "env": "prod"},
+		"vol3": nil,
+	} {
+		_, err := d.processVolumeCreate(&api.VolumeCreateRequest{
+			Name:   name,
+			Labels: labels,
+		})
+		c.Assert(err, IsNil)
+	}
+	_, err := d.processSnapshotCreate(d.getVolume("vol1"), "snap1", map[string]string{"daily": "true"}, "", nil)
+	c.Assert(err, IsNil)
+
+	list := func(filters ...string) map[string]api.VolumeResponse {
+		v := url.Values{}
+		for _, filter := range filters {
+			v.Add("filter", filter)
+		}
+		w := s.serveRequest(c, router, "GET", "/volumes/list?"+v.Encode(), nil)
+		c.Assert(w.Code, Equals, http.StatusOK)
+		result := map[string]api.VolumeResponse{}
+		c.Assert(json.Unmarshal(w.Body.Bytes(), &result), IsNil)
+		return result
+	}
+	c.Assert(list(), HasLen, 3)
+	c.Assert(list("label=env"), HasLen, 2)
+	c.Assert(list("label=env=prod", "label=team=db"), HasLen, 1)
+	c.Assert(list("label=team=none"), HasLen, 0)
+
+	result := list("label=team=web")
+	c.Assert(result, HasLen, 1)
+	c.Assert(result["vol1"].Labels, DeepEquals, map[string]string{"team": "web", "env": "prod"})
+	c.Assert(result["vol1"].Snapshots["snap1"].Labels, DeepEquals, map[string]string{"daily": "true"})
+
+	w := s.serveRequest(c, router, "GET", "/volumes/list?filter=team%3Dweb", nil)
+	c.Assert(w.Code, Equals, http.StatusBadRequest)
+
+	w = s.serveRequest(c, router, "GET", "/snapshots/", &api.SnapshotInspectRequest{SnapshotName: "snap1"})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	snapshot := api.SnapshotResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &snapshot), IsNil)
+	c.Assert(snapshot.Labels, DeepEquals, map[string]string{"daily": "true"})
+
+	// Labels are gone with the snapshot
+	c.Assert(d.processSnapshotDelete("snap1"), IsNil)
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.SnapshotLabels, HasLen, 0)
+}
+
+func (s *TestSuite) TestVolumeCreateIdempotent(c *C) {
+	d := s.newVFSDaemon(c)
+
+	request := &api.VolumeCreateRequest{
+		Name:       "vol1",
+		DriverName: "vfs",
+		Size:       1073741824,
+	}
+	_, err := d.processVolumeCreate(request)
+	c.Assert(err, IsNil)
+
+	// Same request, or one without the options, finds the existing volume
+	volume, err := d.processVolumeCreate(request)
+	c.Assert(err, IsNil)
+	c.Assert(volume.Name, Equals, "vol1")
+	c.Assert(volume.DriverName, Equals, "vfs")
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+		Size: 2147483648,
+	})
+	c.Assert(err, ErrorMatches, `Volume vol1 already exists with different options: Size is "1073741824" rather than "2147483648"`)
+	c.Assert(checkForStatusCode(err), Equals, http.StatusConflict)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name:       "vol1",
+		DriverName: "devicemapper",
+	})
+	c.Assert(err, ErrorMatches, "Volume vol1 already exists with different options: driver is vfs rather than devicemapper")
+
+	// Options of volumes created before they were recorded are unknown
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	config.CreateOptions = nil
+	c.Assert(util.ObjectSave(config), IsNil)
+	_, err = d.processVolumeCreate(&api.VolumeCreateRequest{
+		Name: "vol1",
+		Size: 2147483648,
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestVolumeImport(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	source := filepath.Join(s.root, "legacy")
+	c.Assert(os.Mkdir(source, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(source, "data"), []byte("data"), 0600), IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/v1/volumes/import", &api.VolumeImportRequest{
+		Name:    "vol1",
+		Source:  source,
+		Labels:  map[string]string{"team": "web"},
+		Verbose: true,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	volume := &api.VolumeResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), volume), IsNil)
+	c.Assert(volume.Name, Equals, "vol1")
+	c.Assert(volume.Driver, Equals, "vfs")
+	c.Assert(volume.DriverInfo["Path"], Equals, source)
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.Labels, DeepEquals, map[string]string{"team": "web"})
+	c.Assert(config.CreateOptions, DeepEquals, map[string]string{OPT_IMPORT_SOURCE: source})
+
+	// Data is adopted rather than copied
+	_, err = d.processSnapshotCreate(d.getVolume("vol1"), "snap1", nil, "", nil)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(source, "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+
+	for _, t := range []struct {
+		request *api.VolumeImportRequest
+		message string
+	}{
+		{&api.VolumeImportRequest{Source: source}, "Volume name is required to import"},
+		{&api.VolumeImportRequest{Name: "vol2"}, "Source to import as volume vol2 is required"},
+		{&api.VolumeImportRequest{Name: "vol1", Source: source}, "Volume vol1 already exists"},
+		{&api.VolumeImportRequest{Name: "vol2", Source: filepath.Join(source, "data")}, "Cannot import .*, it's not a directory"},
+		{&api.VolumeImportRequest{Name: "vol2", Source: "legacy"}, "Invalid directory legacy to import, must be an absolute path"},
+	} {
+		_, err := d.processVolumeImport(t.request)
+		c.Assert(err, ErrorMatches, t.message)
+	}
+	c.Assert(d.getVolume("vol2"), IsNil)
+}
+
+func (s *TestSuite) TestVolumeClone(c *C) {
+	d := s.newVFSDaemon(c)
+	router := createRouter(d)
+
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	source := filepath.Join(s.root, "volumes", "vol1")
+	c.Assert(os.Mkdir(filepath.Join(source, "dir"), 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(source, "dir", "data"), []byte("data"), 0600), IsNil)
+
+	w := s.serveRequest(c, router, "POST", "/v1/volumes/clone", &api.VolumeCloneRequest{
+		Name:       "vol2",
+		VolumeName: "vol1",
+		Labels:     map[string]string{"team": "web"},
+		Verbose:    true,
+	})
+	c.Assert(w.Code, Equals, http.StatusOK)
+	volume := &api.VolumeResponse{}
+	c.Assert(json.Unmarshal(w.Body.Bytes(), volume), IsNil)
+	c.Assert(volume.Name, Equals, "vol2")
+	c.Assert(volume.Driver, Equals, "vfs")
+	config, err := d.loadVolumeConfig("vol2")
+	c.Assert(err, IsNil)
+	c.Assert(config.Labels, DeepEquals, map[string]string{"team": "web"})
+	c.Assert(config.CreateOptions, DeepEquals, map[string]string{OPT_CLONE_SOURCE: "vol1"})
+
+	// Data is copied, the volumes are independent afterwards
+	clone := volume.DriverInfo["Path"]
+	c.Assert(clone, Equals, filepath.Join(s.root, "volumes", "vol2"))
+	data, err := ioutil.ReadFile(filepath.Join(clone, "dir", "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+	c.Assert(ioutil.WriteFile(filepath.Join(clone, "dir", "data"), []byte("changed"), 0600), IsNil)
+	data, err = ioutil.ReadFile(filepath.Join(source, "dir", "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+
+	for _, t := range []struct {
+		request *api.VolumeCloneRequest
+		message string
+	}{
+		{&api.VolumeCloneRequest{VolumeName: "vol1"}, "Volume name is required to clone"},
+		{&api.VolumeCloneRequest{Name: "vol3", VolumeName: "vol4"}, "volume vol4 doesn't exist"},
+		{&api.VolumeCloneRequest{Name: "vol1", VolumeName: "vol1"}, "Cannot clone volume vol1 to itself"},
+		{&api.VolumeCloneRequest{Name: "vol2", VolumeName: "vol1"}, "Volume vol2 already exists"},
+	} {
+		_, err := d.processVolumeClone(t.request)
+		c.Assert(err, ErrorMatches, t.message)
+	}
+	c.Assert(d.getVolume("vol3"), IsNil)
+}
+
+func (s *TestSuite) TestVolumeRefreshMountCallers(c *C) {
+	d := s.newVFSDaemon(c)
+	_, err := d.processVolumeCreate(&api.VolumeCreateRequest{Name: "vol1"})
+	c.Assert(err, IsNil)
+	volume := d.getVolume("vol1")
+	target := filepath.Join(s.root, "pods", "pod1", "mount")
+
+	// Users are gone if the volume is not mounted anymore
+	c.Assert(d.addDockerMount("vol1", "container1"), IsNil)
+	c.Assert(d.addCSIPublishTarget("vol1", target), IsNil)
+	mountPoint, err := d.processVolumeRefresh(volume)
+	c.Assert(err, IsNil)
+	c.Assert(mountPoint, Equals, "")
+	config, err := d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.DockerMountCallers, IsNil)
+	c.Assert(config.CSIPublishTargets, IsNil)
+
+	// Targets which are not mounted are dropped, while Docker callers are
+	// kept as long as the volume is mounted
+	mountPoint, err = d.processVolumeMount(volume, &api.VolumeMountRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(d.addDockerMount("vol1", "container1"), IsNil)
+	c.Assert(d.addCSIPublishTarget("vol1", target), IsNil)
+	refreshed, err := d.processVolumeRefresh(volume)
+	c.Assert(err, IsNil)
+	c.Assert(refreshed, Equals, mountPoint)
+	config, err = d.loadVolumeConfig("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(config.DockerMountCallers, DeepEquals, []string{"container1"})
+	c.Assert(config.CSIPublishTargets, IsNil)
+}
@@ -59,6 +59,40 @@ func (d *Driver) CompareSnapshot(id, compareID, volumeID string) (*metadata.Mapp
 	return mapping, err
 }
 
+// DiffSnapshot returns the blocks changed from the compared snapshot to
+// snapshot, which is the same as an incremental backup would read
+func (d *Driver) DiffSnapshot(req convoydriver.Request) (*convoydriver.SnapshotDiff, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volumeID, err := util.GetFieldFromOpts(convoydriver.OPT_VOLUME_NAME, req.Options)
+	if err != nil {
+		return nil, err
+	}
+	compareID, err := util.GetFieldFromOpts(convoydriver.OPT_COMPARE_SNAPSHOT_NAME, req.Options)
+	if err != nil {
+		return nil, err
+	}
+	if compareID == req.Name {
+		return nil, fmt.Errorf("Cannot diff snapshot %v with itself", req.Name)
+	}
+	mappings, err := d.CompareSnapshot(req.Name, compareID, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	diff := &convoydriver.SnapshotDiff{
+		Extents: []convoydriver.Extent{},
+	}
+	for _, m := range mappings.Mappings {
+		diff.Extents = append(diff.Extents, convoydriver.Extent{
+			Offset: m.Offset,
+			Length: m.Size,
+		})
+		diff.ChangedBytes += m.Size
+	}
+	return diff, nil
+}
+
 func (d *Driver) OpenSnapshot(id, volumeID string) error {
 	snapshot, volume, err := d.getSnapshotAndVolume(id, volumeID)
 	if err != nil {
@@ -138,8 +172,10 @@ func (d *Driver) CreateBackup(snapshotID, volumeID, destURL string, opts map[str
 		CreatedTime: opts[convoydriver.OPT_VOLUME_CREATED_TIME],
 	}
 	objSnapshot := &objectstore.Snapshot{
-		Name:        snapshotID,
-		CreatedTime: opts[convoydriver.OPT_SNAPSHOT_CREATED_TIME],
+		Name:            snapshotID,
+		CreatedTime:     opts[convoydriver.OPT_SNAPSHOT_CREATED_TIME],
+		EncryptionKeyID: opts[convoydriver.OPT_ENCRYPTION_KEY_ID],
+		Compression:     opts[convoydriver.OPT_COMPRESSION],
 	}
 	return objectstore.CreateDeltaBlockBackup(objVolume, objSnapshot, destURL, d)
 }
@@ -176,5 +212,9 @@ func (d *Driver) ListBackup(destURL string, opts map[string]string) (map[string]
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
 
-	return objectstore.List(opts[convoydriver.OPT_VOLUME_NAME], destURL, d.Name())
+	listOpts, err := objectstore.ParseListOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return objectstore.ListWithOptions(destURL, d.Name(), listOpts)
 }
@@ -3,10 +3,12 @@
 package devmapper
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/docker/docker/pkg/devicemapper"
 	"github.com/rancher/convoy/objectstore"
 	"github.com/rancher/convoy/util"
+	"github.com/rancher/convoy/util/fs"
 
 	. "github.com/rancher/convoy/convoydriver"
 	. "github.com/rancher/convoy/logging"
@@ -27,6 +30,9 @@ const (
 	DM_DIR                = "/dev/mapper/"
 	MOUNTS_DIR            = "mounts"
 
+	// Thin-pool with less free data or metadata space is unhealthy
+	THINPOOL_MIN_FREE_PERCENT = 10
+
 	THIN_PROVISION_TOOLS_BINARY      = "convoy-pdata_tools"
 	THIN_PROVISION_TOOLS_MIN_VERSION = "0.5.1"
 
@@ -64,6 +70,7 @@ const (
 type Driver struct {
 	mutex      *sync.RWMutex
 	devIDMutex *sync.Mutex
+	usage      *util.UsageCache
 	Device
 }
 
@@ -75,6 +82,12 @@ type Volume struct {
 	MountPoint  string
 	CreatedTime string
 	Snapshots   map[string]Snapshot
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Whether the current mount is read-only
+	MountedReadOnly bool
 
 	configPath string
 	Filesystem string
@@ -102,7 +115,7 @@ func (v *Volume) GetDevice() (string, error) {
 }
 
 func (v *Volume) GetMountOpts() []string {
-	return []string{}
+	return util.MountOptionsArgs(util.ReadOnlyMountOptions(v.MountOptions, v.MountedReadOnly))
 }
 
 func (v *Volume) GenerateDefaultMountPoint() string {
@@ -119,6 +132,16 @@ type Device struct {
 	DefaultVolumeSize int64
 	LastDevID         int
 	Filesystem        string
+	// Percent of data or metadata space used, above which volumes and
+	// snapshots won't be created
+	ThinpoolThreshold int64
+	// Bytes to extend the data device by, when the threshold is reached
+	ThinpoolExtendSize int64
+	// Don't discard the blocks of volume before it's deleted, which is
+	// done by default
+	SkipDiscardOnDelete bool
+	// Interval to trim the filesystems of mounted volumes, 0 if disabled
+	FstrimInterval time.Duration
 }
 
 func (dev *Device) ConfigFile() (string, error) {
@@ -201,6 +224,13 @@ func verifyConfig(config map[string]string) (*Device, error) {
 	}
 	dv.Filesystem = fs_type
 
+	if err := parseThinpoolConfig(&dv, config); err != nil {
+		return nil, err
+	}
+	if err := parseTrimConfig(&dv, config); err != nil {
+		return nil, err
+	}
+
 	return &dv, nil
 }
 
@@ -328,9 +358,20 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 		if err := util.ObjectLoad(dev); err != nil {
 			return nil, err
 		}
+		// Thin-pool and trim options can be changed for the existing pool
+		if err := parseThinpoolConfig(dev, config); err != nil {
+			return nil, err
+		}
+		if err := parseTrimConfig(dev, config); err != nil {
+			return nil, err
+		}
+		if err := util.ObjectSave(dev); err != nil {
+			return nil, err
+		}
 		d := &Driver{
 			mutex:      &sync.RWMutex{},
 			devIDMutex: &sync.Mutex{},
+			usage:      util.NewUsageCache(util.DEFAULT_USAGE_CACHE_TTL),
 			Device:     *dev,
 		}
 		if err := d.activatePool(); err != nil {
@@ -339,6 +380,8 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 		if err := d.remountVolumes(); err != nil {
 			return nil, err
 		}
+		go d.monitorThinpool()
+		go d.trimVolumes()
 		return d, nil
 	}
 
@@ -378,8 +421,11 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 	d := &Driver{
 		mutex:      &sync.RWMutex{},
 		devIDMutex: &sync.Mutex{},
+		usage:      util.NewUsageCache(util.DEFAULT_USAGE_CACHE_TTL),
 		Device:     *dev,
 	}
+	go d.monitorThinpool()
+	go d.trimVolumes()
 	return d, nil
 }
 
@@ -436,21 +482,77 @@ func (d *Driver) CreateVolume(req Request) error {
 	id := req.Name
 	opts := req.Options
 
+	// Backup of files from other drivers would be extracted to a new
+	// filesystem, instead of restoring the blocks
+	restoreFiles := false
 	backupURL := opts[OPT_BACKUP_URL]
-	if backupURL != "" {
-		objVolume, err := objectstore.LoadVolume(backupURL)
+
+	// Volume of local snapshot, or clone of volume, would be a thin
+	// snapshot of the origin device, sharing the blocks and the filesystem
+	var (
+		originName   string
+		originDevID  int
+		originVolume *Volume
+	)
+	snapshotName := opts[OPT_SNAPSHOT_NAME]
+	cloneSource := opts[OPT_CLONE_SOURCE]
+	if cloneSource != "" {
+		if backupURL != "" || snapshotName != "" {
+			return fmt.Errorf("Cannot clone volume from backup or snapshot")
+		}
+		originVolume = d.blankVolume(cloneSource)
+		if err := util.ObjectLoad(originVolume); err != nil {
+			return err
+		}
+		originName = cloneSource
+		originDevID = originVolume.DevID
+		size = originVolume.Size
+	} else if snapshotName != "" {
+		if backupURL != "" {
+			return fmt.Errorf("Cannot create volume from both backup and snapshot")
+		}
+		snapshot, snapshotVolume, err := d.getSnapshotAndVolume(snapshotName, opts[OPT_SNAPSHOT_VOLUME_NAME])
 		if err != nil {
 			return err
 		}
-		if objVolume.Driver != d.Name() {
-			return fmt.Errorf("Cannot restore backup of %v to %v", objVolume.Driver, d.Name())
+		size, err = d.getSize(opts, snapshotVolume.Size)
+		if err != nil {
+			return err
+		}
+		if size != snapshotVolume.Size {
+			return fmt.Errorf("Volume size must match with snapshot's size")
 		}
-		size, err = d.getSize(opts, objVolume.Size)
+		originName = snapshotName
+		originDevID = snapshot.DevID
+		originVolume = snapshotVolume
+	} else if backupURL != "" {
+		objVolume, err := objectstore.LoadVolume(backupURL)
 		if err != nil {
 			return err
 		}
-		if size != objVolume.Size {
-			return fmt.Errorf("Volume size must match with backup's size")
+		if objVolume.Driver != d.Name() {
+			format, err := objectstore.GetBackupFormat(backupURL)
+			if err != nil {
+				return err
+			}
+			if format != objectstore.BACKUP_FORMAT_FILES {
+				return fmt.Errorf("Cannot restore backup of %v to %v", objVolume.Driver, d.Name())
+			}
+			restoreFiles = true
+		}
+		if restoreFiles {
+			size, err = d.getSize(opts, d.DefaultVolumeSize)
+			if err != nil {
+				return err
+			}
+		} else {
+			size, err = d.getSize(opts, objVolume.Size)
+			if err != nil {
+				return err
+			}
+			if size != objVolume.Size {
+				return fmt.Errorf("Volume size must match with backup's size")
+			}
 		}
 	} else {
 		size, err = d.getSize(opts, d.DefaultVolumeSize)
@@ -473,6 +575,9 @@ func (d *Driver) CreateVolume(req Request) error {
 			LOG_FIELD_VOLUME: id,
 		}, "Already has volume with specific uuid")
 	}
+	if err := d.checkThinpoolSpace(); err != nil {
+		return fmt.Errorf("Cannot create volume %v: %v", id, err)
+	}
 
 	devID, err := d.allocateDevID()
 	if err != nil {
@@ -485,7 +590,11 @@ func (d *Driver) CreateVolume(req Request) error {
 		LOG_FIELD_VOLUME:          id,
 		DM_LOG_FIELD_VOLUME_DEVID: devID,
 	}).Debugf("Creating volume")
-	err = devicemapper.CreateDevice(d.ThinpoolDevice, devID)
+	if originVolume != nil {
+		err = devicemapper.CreateSnapDevice(d.ThinpoolDevice, devID, originName, originDevID)
+	} else {
+		err = devicemapper.CreateDevice(d.ThinpoolDevice, devID)
+	}
 	if err != nil {
 		return err
 	}
@@ -524,6 +633,14 @@ func (d *Driver) CreateVolume(req Request) error {
 	volume.CreatedTime = util.Now()
 	volume.Snapshots = make(map[string]Snapshot)
 	volume.Filesystem = d.Filesystem
+	if originVolume != nil {
+		volume.Filesystem = originVolume.Filesystem
+	}
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	if cloneSource != "" && volume.MountOptions == "" {
+		volume.MountOptions = originVolume.MountOptions
+	}
+	volume.ReadOnly = opts[OPT_READ_ONLY] == "true"
 	if err := util.ObjectSave(volume); err != nil {
 		return err
 	}
@@ -532,12 +649,17 @@ func (d *Driver) CreateVolume(req Request) error {
 	if err != nil {
 		return err
 	}
-	if backupURL == "" {
+	if (backupURL == "" && originVolume == nil) || restoreFiles {
 		// format the device
-		if err := d.createFilesystem(dev); err != nil {
+		if err := d.createFilesystem(req.Context(), dev); err != nil {
 			return err
 		}
-	} else {
+	}
+	if restoreFiles {
+		if err := restoreFilesBackup(volume, backupURL); err != nil {
+			return err
+		}
+	} else if backupURL != "" {
 		if err := objectstore.RestoreDeltaBlockBackup(backupURL, dev); err != nil {
 			return err
 		}
@@ -546,12 +668,31 @@ func (d *Driver) CreateVolume(req Request) error {
 	return nil
 }
 
-func (d *Driver) createFilesystem(dev string) error {
+// CloneVolume creates the volume as a thin snapshot of the volume
+// req.Options[OPT_CLONE_SOURCE], which is suspended briefly if it's active
+func (d *Driver) CloneVolume(req Request) error {
+	return d.CreateVolume(req)
+}
+
+// restoreFilesBackup mounts the volume temporarily to extract the backup
+func restoreFilesBackup(volume *Volume, backupURL string) error {
+	mountPoint, err := util.VolumeMount(volume, "", false)
+	if err != nil {
+		return err
+	}
+	restoreErr := objectstore.RestoreFilesBackup(backupURL, mountPoint)
+	if err := util.VolumeUmount(volume); err != nil {
+		return err
+	}
+	return restoreErr
+}
+
+func (d *Driver) createFilesystem(ctx context.Context, dev string) error {
 	var err error
 
 	log.Debugf("Formatting device %s with %s filesystem", dev, d.Filesystem)
 
-	_, err = util.Execute("mkfs", []string{"-t", d.Filesystem, dev})
+	_, err = util.ExecuteWithRetryContext(ctx, "mkfs", []string{"-t", d.Filesystem, dev})
 
 	if err != nil {
 		log.Errorf("Formatting device failed")
@@ -567,9 +708,6 @@ func devPath(name string) string {
 }
 
 func (d *Driver) removeDevice(name string) error {
-	if err := devicemapper.BlockDeviceDiscard(devPath(name)); err != nil {
-		log.Debugf("Error %s when discarding %v, ignored", err, name)
-	}
 	for i := 0; i < 200; i++ {
 		err := devicemapper.RemoveDevice(name)
 		if err == nil {
@@ -586,6 +724,76 @@ func (d *Driver) removeDevice(name string) error {
 	return nil
 }
 
+// reloadDevice replaces the table of an active thin device with a new size.
+// The device would be suspended during the reload.
+func reloadDevice(poolName string, name string, deviceId int, size uint64) error {
+	if err := devicemapper.SuspendDevice(name); err != nil {
+		return err
+	}
+	task, err := devicemapper.TaskCreateNamed(devicemapper.DeviceReload, name)
+	if task == nil {
+		devicemapper.ResumeDevice(name)
+		return err
+	}
+	params := fmt.Sprintf("%s %d", poolName, deviceId)
+	if err := task.AddTarget(0, size/512, "thin", params); err != nil {
+		devicemapper.ResumeDevice(name)
+		return fmt.Errorf("Can't add target %s", err)
+	}
+	if err := task.Run(); err != nil {
+		devicemapper.ResumeDevice(name)
+		return fmt.Errorf("Error running DeviceReload %s", err)
+	}
+	return devicemapper.ResumeDevice(name)
+}
+
+func (d *Driver) ResizeVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	size, err := util.ParseSize(req.Options[OPT_SIZE])
+	if err != nil {
+		return err
+	}
+	if size <= volume.Size {
+		return fmt.Errorf("New size %v must be larger than current size %v of volume %v", size, volume.Size, id)
+	}
+	if size%(d.ThinpoolBlockSize*SECTOR_SIZE) != 0 {
+		return fmt.Errorf("Size must be multiple of block size")
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:          LOG_REASON_START,
+		LOG_FIELD_EVENT:           LOG_EVENT_RESIZE,
+		LOG_FIELD_OBJECT:          LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME:          id,
+		LOG_FIELD_SIZE:            size,
+		DM_LOG_FIELD_VOLUME_DEVID: volume.DevID,
+	}).Debugf("Resizing device for volume")
+	if err := reloadDevice(d.ThinpoolDevice, id, volume.DevID, uint64(size)); err != nil {
+		return err
+	}
+	volume.Size = size
+	if err := util.ObjectSave(volume); err != nil {
+		return err
+	}
+
+	dev, err := volume.GetDevice()
+	if err != nil {
+		return err
+	}
+	if err := fs.ResizeWithContext(req.Context(), dev); err != nil {
+		return fmt.Errorf("Device of volume %v has been resized to %v, but failed to resize filesystem: %v", id, size, err)
+	}
+	return nil
+}
+
 func (d *Driver) DeleteVolume(req Request) error {
 	var err error
 
@@ -613,6 +821,13 @@ func (d *Driver) DeleteVolume(req Request) error {
 		}
 	}
 
+	// Blocks of thin device are freed in the pool once it's deleted, while
+	// discard passes them down to the data device, e.g. thin LVM or SSD
+	if !d.SkipDiscardOnDelete {
+		if err := devicemapper.BlockDeviceDiscard(devPath(id)); err != nil {
+			log.Debugf("Error %s when discarding %v, ignored", err, id)
+		}
+	}
 	if err = d.removeDevice(id); err != nil {
 		return err
 	}
@@ -629,6 +844,7 @@ func (d *Driver) DeleteVolume(req Request) error {
 		return err
 	}
 
+	d.usage.Invalidate(id)
 	if err := util.ObjectDelete(volume); err != nil {
 		return err
 	}
@@ -669,6 +885,9 @@ func (d *Driver) CreateSnapshot(req Request) error {
 	if err := util.ObjectLoad(volume); err != nil {
 		return err
 	}
+	if err := d.checkThinpoolSpace(); err != nil {
+		return fmt.Errorf("Cannot create snapshot %v of volume %v: %v", id, volumeID, err)
+	}
 	devID, err := d.allocateDevID()
 	if err != nil {
 		return err
@@ -755,20 +974,108 @@ func (d *Driver) Info() (map[string]string, error) {
 	blockSize := d.ThinpoolBlockSize * 512
 
 	info := map[string]string{
-		"Driver":            d.Name(),
-		"Root":              d.Root,
-		"DataDevice":        d.DataDevice,
-		"MetadataDevice":    d.MetadataDevice,
-		"ThinpoolDevice":    d.ThinpoolDevice,
-		"ThinpoolSize":      strconv.FormatInt(d.ThinpoolSize, 10),
-		"ThinpoolBlockSize": strconv.FormatInt(blockSize, 10),
-		"DefaultVolumeSize": strconv.FormatInt(d.DefaultVolumeSize, 10),
-		"Filesystem":        d.Filesystem,
+		"Driver":             d.Name(),
+		"Root":               d.Root,
+		"DataDevice":         d.DataDevice,
+		"MetadataDevice":     d.MetadataDevice,
+		"ThinpoolDevice":     d.ThinpoolDevice,
+		"ThinpoolSize":       strconv.FormatInt(d.ThinpoolSize, 10),
+		"ThinpoolBlockSize":  strconv.FormatInt(blockSize, 10),
+		"DefaultVolumeSize":  strconv.FormatInt(d.DefaultVolumeSize, 10),
+		"Filesystem":         d.Filesystem,
+		"ThinpoolThreshold":  strconv.FormatInt(d.ThinpoolThreshold, 10),
+		"ThinpoolExtendSize": strconv.FormatInt(d.ThinpoolExtendSize, 10),
+		"DiscardOnDelete":    strconv.FormatBool(!d.SkipDiscardOnDelete),
+		"FstrimInterval":     d.FstrimInterval.String(),
+	}
+	// Usage is left out if the pool is unavailable, which is reported by
+	// health check
+	poolInfo, err := d.thinpoolInfo()
+	if err != nil {
+		log.Warnf("Failed to get usage of thin-pool: %v", err)
+	}
+	for k, v := range poolInfo {
+		info[k] = v
 	}
 
 	return info, nil
 }
 
+// parseUsage parses "<used>/<total>" blocks in thin-pool status
+func parseUsage(s string) (int64, int64, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid usage %v", s)
+	}
+	used, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("Invalid usage %v", s)
+	}
+	return used, total, nil
+}
+
+/*
+checkThinpoolStatus fails if the thin-pool is not writable, or either the data
+or metadata space left is less than THINPOOL_MIN_FREE_PERCENT. See
+parseThinpoolStatus() for the status.
+*/
+func checkThinpoolStatus(params string) error {
+	status, err := parseThinpoolStatus(params)
+	if err != nil {
+		return err
+	}
+	if status.Mode != "" && status.Mode != "rw" {
+		return fmt.Errorf("Thin-pool is in %v mode", status.Mode)
+	}
+	spaces := []struct {
+		name        string
+		used, total int64
+	}{
+		{"metadata", status.UsedMetadata, status.TotalMetadata},
+		{"data", status.UsedData, status.TotalData},
+	}
+	for _, space := range spaces {
+		if free := (space.total - space.used) * 100 / space.total; free < THINPOOL_MIN_FREE_PERCENT {
+			return fmt.Errorf("Only %v%% of thin-pool %v space is free, %v of %v blocks used", free, space.name, space.used, space.total)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) CheckHealth() []HealthCheck {
+	_, _, _, params, err := devicemapper.GetStatus(filepath.Base(d.ThinpoolDevice))
+	if err == nil {
+		err = checkThinpoolStatus(params)
+	}
+	return []HealthCheck{
+		{
+			Name:  "thinpool",
+			Error: err,
+		},
+	}
+}
+
+// GetFreeSpace returns the data space of thin-pool not allocated yet, which
+// is shared by the thin volumes
+func (d *Driver) GetFreeSpace() (int64, error) {
+	_, _, _, params, err := devicemapper.GetStatus(filepath.Base(d.ThinpoolDevice))
+	if err != nil {
+		return 0, err
+	}
+	status, err := parseThinpoolStatus(params)
+	if err != nil {
+		return 0, err
+	}
+	return (status.TotalData - status.UsedData) * d.ThinpoolBlockSize * SECTOR_SIZE, nil
+}
+
 func (d *Driver) getSnapshotAndVolume(snapshotID, volumeID string) (*Snapshot, *Volume, error) {
 	volume := d.blankVolume(volumeID)
 	if err := util.ObjectLoad(volume); err != nil {
@@ -855,7 +1162,19 @@ func (d *Driver) MountVolume(req Request) (string, error) {
 		return "", err
 	}
 
-	mountPoint, err := util.VolumeMount(volume, opts[OPT_MOUNT_POINT], false)
+	ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	readOnly := volume.ReadOnly || opts[OPT_READ_ONLY] == "true"
+	if err := util.CheckMountMode(id, volume.MountPoint, volume.MountedReadOnly, readOnly); err != nil {
+		return "", err
+	}
+	volume.MountedReadOnly = readOnly
+
+	mountPoint, err := util.VolumeMountWithContext(ctx, volume, opts[OPT_MOUNT_POINT], false)
 	if err != nil {
 		return "", err
 	}
@@ -878,9 +1197,10 @@ func (d *Driver) UmountVolume(req Request) error {
 		return err
 	}
 
-	if err := util.VolumeUmount(volume); err != nil {
+	if err := util.VolumeUmountWithContext(req.Context(), volume); err != nil {
 		return err
 	}
+	volume.MountedReadOnly = false
 
 	if err := util.ObjectSave(volume); err != nil {
 		return err
@@ -889,6 +1209,22 @@ func (d *Driver) UmountVolume(req Request) error {
 	return nil
 }
 
+// ForceUmountVolume doesn't take the lock of driver, since the umount it's
+// for may be holding it
+func (d *Driver) ForceUmountVolume(req Request) error {
+	id := req.Name
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeForceUmount(req.Context(), volume, req.Options[OPT_KILL] == "true"); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
 func (d *Driver) MountPoint(req Request) (string, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -902,6 +1238,50 @@ func (d *Driver) MountPoint(req Request) (string, error) {
 	return volume.MountPoint, nil
 }
 
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+
+	mountPoint, err := util.VolumeMountRefresh(volume)
+	if err != nil {
+		return "", err
+	}
+
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+
+	return mountPoint, nil
+}
+
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	names, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, name := range names {
+		volume := d.blankVolume(name)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, MOUNTS_DIR), mountPoints)
+}
+
 func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
@@ -922,10 +1302,43 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 		OPT_MOUNT_POINT:         volume.MountPoint,
 		OPT_SIZE:                strconv.FormatInt(volume.Size, 10),
 		OPT_FILESYSTEM:          volume.Filesystem,
+		OPT_MOUNT_OPTIONS:       volume.MountOptions,
+		OPT_READ_ONLY:           strconv.FormatBool(volume.ReadOnly),
+		"MountedReadOnly":       strconv.FormatBool(volume.MountedReadOnly),
+		OPT_ALLOCATED_SIZE:      strconv.FormatInt(volume.Size, 10),
+	}
+	used, err := d.usage.Get(volume.Name, func() (int64, error) {
+		return getMappedSize(volume.Name)
+	})
+	if err != nil {
+		log.Warnf("Failed to get usage of volume %v: %v", volume.Name, err)
+		return result, nil
 	}
+	result[OPT_USED_SIZE] = strconv.FormatInt(used, 10)
 	return result, nil
 }
 
+// getMappedSize returns the bytes of thin pool mapped to the thin device
+func getMappedSize(name string) (int64, error) {
+	_, _, targetType, params, err := devicemapper.GetStatus(name)
+	if err != nil {
+		return 0, err
+	}
+	if targetType != "thin" {
+		return 0, fmt.Errorf("Device %v is not a thin device but %v", name, targetType)
+	}
+	// <nr mapped sectors> <highest mapped sector>, or "Fail"
+	fields := strings.Fields(params)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Unexpected status of thin device %v: %v", name, params)
+	}
+	sectors, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected status of thin device %v: %v", name, params)
+	}
+	return sectors * 512, nil
+}
+
 func (d *Driver) GetSnapshotInfo(req Request) (map[string]string, error) {
 	d.mutex.RLock()
 	defer d.mutex.RUnlock()
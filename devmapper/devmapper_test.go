@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/convoydriver"
@@ -257,3 +258,55 @@ func (s *TestSuite) TestSnapshot(c *C) {
 	err = volOps.DeleteVolume(volumeID)
 	c.Assert(err, IsNil)
 }
+
+func (s *TestSuite) TestCheckThinpoolStatus(c *C) {
+	c.Assert(checkThinpoolStatus("1 100/1000 200/1000 - rw discard_passdown queue_if_no_space -"), IsNil)
+	c.Assert(checkThinpoolStatus("1 950/1000 200/1000 - rw discard_passdown"), ErrorMatches, "Only 5% of thin-pool metadata space is free.*")
+	c.Assert(checkThinpoolStatus("1 100/1000 999/1000 - rw discard_passdown"), ErrorMatches, "Only 0% of thin-pool data space is free.*")
+	c.Assert(checkThinpoolStatus("1 100/1000 200/1000 - out_of_data_space discard_passdown"), ErrorMatches, "Thin-pool is in out_of_data_space mode")
+	c.Assert(checkThinpoolStatus("Fail"), ErrorMatches, "Thin-pool has failed.*")
+}
+
+func (s *TestSuite) TestThinpoolSpace(c *C) {
+	status, err := parseThinpoolStatus("1 100/1000 850/1000 - rw discard_passdown queue_if_no_space -")
+	c.Assert(err, IsNil)
+	c.Assert(status.dataUsedPercent(), Equals, int64(85))
+	c.Assert(status.metadataUsedPercent(), Equals, int64(10))
+	c.Assert(status.checkSpace(90), IsNil)
+	c.Assert(status.checkSpace(85), ErrorMatches, "85% of thin-pool data space is used, reaching the threshold 85%")
+
+	status, err = parseThinpoolStatus("1 100/1000 200/1000 - ro discard_passdown")
+	c.Assert(err, IsNil)
+	c.Assert(status.checkSpace(90), ErrorMatches, "Thin-pool is in ro mode")
+
+	dev := &Device{}
+	c.Assert(parseThinpoolConfig(dev, map[string]string{}), IsNil)
+	c.Assert(dev.ThinpoolThreshold, Equals, int64(DEFAULT_THINPOOL_THRESHOLD))
+	c.Assert(dev.ThinpoolExtendSize, Equals, int64(0))
+	c.Assert(parseThinpoolConfig(dev, map[string]string{
+		DM_THINPOOL_THRESHOLD:   "80",
+		DM_THINPOOL_EXTEND_SIZE: "10G",
+	}), IsNil)
+	c.Assert(dev.ThinpoolThreshold, Equals, int64(80))
+	c.Assert(dev.ThinpoolExtendSize, Equals, int64(10<<30))
+	c.Assert(parseThinpoolConfig(dev, map[string]string{DM_THINPOOL_THRESHOLD: "101"}), NotNil)
+}
+
+func (s *TestSuite) TestTrimConfig(c *C) {
+	dev := &Device{}
+	c.Assert(parseTrimConfig(dev, map[string]string{}), IsNil)
+	c.Assert(dev.SkipDiscardOnDelete, Equals, false)
+	c.Assert(dev.FstrimInterval, Equals, time.Duration(0))
+
+	c.Assert(parseTrimConfig(dev, map[string]string{
+		DM_DISCARD_ON_DELETE: "false",
+		DM_FSTRIM_INTERVAL:   "24h",
+	}), IsNil)
+	c.Assert(dev.SkipDiscardOnDelete, Equals, true)
+	c.Assert(dev.FstrimInterval, Equals, 24*time.Hour)
+
+	c.Assert(parseTrimConfig(dev, map[string]string{DM_FSTRIM_INTERVAL: "0"}), IsNil)
+	c.Assert(dev.FstrimInterval, Equals, time.Duration(0))
+	c.Assert(parseTrimConfig(dev, map[string]string{DM_FSTRIM_INTERVAL: "1s"}), NotNil)
+	c.Assert(parseTrimConfig(dev, map[string]string{DM_DISCARD_ON_DELETE: "maybe"}), NotNil)
+}
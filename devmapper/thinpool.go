@@ -0,0 +1,296 @@
+// +build linux
+
+package devmapper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/devicemapper"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	DM_THINPOOL_THRESHOLD   = "dm.thinpoolthreshold"
+	DM_THINPOOL_EXTEND_SIZE = "dm.thinpoolextendsize"
+	DM_DISCARD_ON_DELETE    = "dm.discardondelete"
+	DM_FSTRIM_INTERVAL      = "dm.fstriminterval"
+
+	// Percent of data or metadata space used, above which volumes and
+	// snapshots won't be created
+	DEFAULT_THINPOOL_THRESHOLD = 90
+
+	THINPOOL_MONITOR_INTERVAL = time.Minute
+	MIN_FSTRIM_INTERVAL       = time.Minute
+
+	LVEXTEND_BINARY = "lvextend"
+)
+
+// thinpoolStatus is the usage of thin-pool, in blocks
+type thinpoolStatus struct {
+	UsedMetadata  int64
+	TotalMetadata int64
+	UsedData      int64
+	TotalData     int64
+	// rw, ro, out_of_data_space, or empty if it's not reported
+	Mode string
+}
+
+/*
+parseThinpoolStatus parses the status of thin-pool, which is "<transaction id>
+<used metadata blocks>/<total metadata blocks> <used data blocks>/<total data
+blocks> <held metadata root> ro|rw|out_of_data_space ...", or "Fail".
+*/
+func parseThinpoolStatus(params string) (*thinpoolStatus, error) {
+	fields := strings.Fields(params)
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("Thin-pool has failed, status: %v", params)
+	}
+	status := &thinpoolStatus{}
+	var err error
+	if status.UsedMetadata, status.TotalMetadata, err = parseUsage(fields[1]); err != nil {
+		return nil, fmt.Errorf("Unexpected status of thin-pool %v: %v", params, err)
+	}
+	if status.UsedData, status.TotalData, err = parseUsage(fields[2]); err != nil {
+		return nil, fmt.Errorf("Unexpected status of thin-pool %v: %v", params, err)
+	}
+	if len(fields) > 5 {
+		status.Mode = fields[5]
+	}
+	return status, nil
+}
+
+func (s *thinpoolStatus) metadataUsedPercent() int64 {
+	return s.UsedMetadata * 100 / s.TotalMetadata
+}
+
+func (s *thinpoolStatus) dataUsedPercent() int64 {
+	return s.UsedData * 100 / s.TotalData
+}
+
+// checkSpace fails if the thin-pool is not writable, or the data or metadata
+// space used reaches threshold percent
+func (s *thinpoolStatus) checkSpace(threshold int64) error {
+	if s.Mode != "" && s.Mode != "rw" {
+		return fmt.Errorf("Thin-pool is in %v mode", s.Mode)
+	}
+	if used := s.metadataUsedPercent(); used >= threshold {
+		return fmt.Errorf("%v%% of thin-pool metadata space is used, reaching the threshold %v%%", used, threshold)
+	}
+	if used := s.dataUsedPercent(); used >= threshold {
+		return fmt.Errorf("%v%% of thin-pool data space is used, reaching the threshold %v%%", used, threshold)
+	}
+	return nil
+}
+
+func (d *Driver) getThinpoolStatus() (*thinpoolStatus, error) {
+	_, _, _, params, err := devicemapper.GetStatus(filepath.Base(d.ThinpoolDevice))
+	if err != nil {
+		return nil, err
+	}
+	return parseThinpoolStatus(params)
+}
+
+// parseThinpoolConfig sets the threshold and extend size of thin-pool by
+// config, keeping the current ones of dev if they're not specified
+func parseThinpoolConfig(dev *Device, config map[string]string) error {
+	if dev.ThinpoolThreshold == 0 {
+		dev.ThinpoolThreshold = DEFAULT_THINPOOL_THRESHOLD
+	}
+	if value, exists := config[DM_THINPOOL_THRESHOLD]; exists {
+		threshold, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || threshold <= 0 || threshold > 100 {
+			return fmt.Errorf("Invalid %v %v, must be a percent between 1 and 100", DM_THINPOOL_THRESHOLD, value)
+		}
+		dev.ThinpoolThreshold = threshold
+	}
+	if value, exists := config[DM_THINPOOL_EXTEND_SIZE]; exists {
+		size, err := util.ParseSize(value)
+		if err != nil || size < 0 {
+			return fmt.Errorf("Invalid %v %v", DM_THINPOOL_EXTEND_SIZE, value)
+		}
+		dev.ThinpoolExtendSize = size
+	}
+	return nil
+}
+
+/*
+checkThinpoolSpace fails creating volume or snapshot if the thin-pool is
+low on space, since thin devices stall or fail writes once the pool is full.
+The pool is extended first if it's enabled. Caller must hold the lock of
+driver.
+*/
+func (d *Driver) checkThinpoolSpace() error {
+	status, err := d.getThinpoolStatus()
+	if err != nil {
+		return err
+	}
+	spaceErr := status.checkSpace(d.ThinpoolThreshold)
+	if spaceErr == nil || d.ThinpoolExtendSize == 0 {
+		return spaceErr
+	}
+	log.Warnf("Extending thin-pool: %v", spaceErr)
+	if err := d.extendThinpool(); err != nil {
+		return fmt.Errorf("%v, and failed to extend thin-pool: %v", spaceErr, err)
+	}
+	if status, err = d.getThinpoolStatus(); err != nil {
+		return err
+	}
+	return status.checkSpace(d.ThinpoolThreshold)
+}
+
+/*
+extendThinpool extends the data device, which must be a LVM logical volume,
+by ThinpoolExtendSize, then reloads the thin-pool with the new size. The
+metadata space is not extended. Caller must hold the lock of driver.
+*/
+func (d *Driver) extendThinpool() error {
+	if _, err := util.Execute(LVEXTEND_BINARY, []string{"-L", "+" + strconv.FormatInt(d.ThinpoolExtendSize/1024, 10) + "k", d.DataDevice}); err != nil {
+		return err
+	}
+
+	dataDev, err := os.Open(d.DataDevice)
+	if err != nil {
+		return err
+	}
+	defer dataDev.Close()
+	metadataDev, err := os.Open(d.MetadataDevice)
+	if err != nil {
+		return err
+	}
+	defer metadataDev.Close()
+
+	size, err := devicemapper.GetBlockDeviceSize(dataDev)
+	if err != nil {
+		return err
+	}
+	poolName := filepath.Base(d.ThinpoolDevice)
+	if err := devicemapper.ReloadPool(poolName, dataDev, metadataDev, uint32(d.ThinpoolBlockSize)); err != nil {
+		return err
+	}
+	if err := devicemapper.SuspendDevice(poolName); err != nil {
+		return err
+	}
+	if err := devicemapper.ResumeDevice(poolName); err != nil {
+		return err
+	}
+	log.Infof("Extended thin-pool %v from %v to %v bytes", poolName, d.ThinpoolSize, size)
+
+	d.ThinpoolSize = int64(size)
+	return util.ObjectSave(&d.Device)
+}
+
+// monitorThinpool warns when the thin-pool reaches the threshold, and extends
+// it ahead of requests if it's enabled
+func (d *Driver) monitorThinpool() {
+	for range time.Tick(THINPOOL_MONITOR_INTERVAL) {
+		status, err := d.getThinpoolStatus()
+		if err != nil {
+			log.Errorf("Failed to get status of thin-pool: %v", err)
+			continue
+		}
+		spaceErr := status.checkSpace(d.ThinpoolThreshold)
+		if spaceErr == nil {
+			continue
+		}
+		if d.ThinpoolExtendSize == 0 {
+			log.Warnf("New volumes and snapshots are blocked: %v", spaceErr)
+			continue
+		}
+		d.mutex.Lock()
+		if err := d.checkThinpoolSpace(); err != nil {
+			log.Warnf("New volumes and snapshots are blocked: %v", err)
+		}
+		d.mutex.Unlock()
+	}
+}
+
+// thinpoolInfo returns the usage of thin-pool in bytes, for Info()
+func (d *Driver) thinpoolInfo() (map[string]string, error) {
+	status, err := d.getThinpoolStatus()
+	if err != nil {
+		return nil, err
+	}
+	// Metadata block is always 4KiB
+	metadataBlockSize := int64(4096)
+	dataBlockSize := d.ThinpoolBlockSize * SECTOR_SIZE
+	return map[string]string{
+		"ThinpoolMode":                status.Mode,
+		"ThinpoolDataUsed":            strconv.FormatInt(status.UsedData*dataBlockSize, 10),
+		"ThinpoolDataTotal":           strconv.FormatInt(status.TotalData*dataBlockSize, 10),
+		"ThinpoolDataUsedPercent":     strconv.FormatInt(status.dataUsedPercent(), 10),
+		"ThinpoolMetadataUsed":        strconv.FormatInt(status.UsedMetadata*metadataBlockSize, 10),
+		"ThinpoolMetadataTotal":       strconv.FormatInt(status.TotalMetadata*metadataBlockSize, 10),
+		"ThinpoolMetadataUsedPercent": strconv.FormatInt(status.metadataUsedPercent(), 10),
+	}, nil
+}
+
+// parseTrimConfig sets the discard and fstrim options by config, keeping the
+// current ones of dev if they're not specified
+func parseTrimConfig(dev *Device, config map[string]string) error {
+	if value, exists := config[DM_DISCARD_ON_DELETE]; exists {
+		discard, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid %v %v, must be true or false", DM_DISCARD_ON_DELETE, value)
+		}
+		dev.SkipDiscardOnDelete = !discard
+	}
+	if value, exists := config[DM_FSTRIM_INTERVAL]; exists {
+		interval := time.Duration(0)
+		if value != "" && value != "0" {
+			var err error
+			interval, err = time.ParseDuration(value)
+			if err != nil || interval < MIN_FSTRIM_INTERVAL {
+				return fmt.Errorf("Invalid %v %v, must be a duration of at least %v, or 0 to disable", DM_FSTRIM_INTERVAL, value, MIN_FSTRIM_INTERVAL)
+			}
+		}
+		dev.FstrimInterval = interval
+	}
+	return nil
+}
+
+/*
+trimVolumes runs fstrim on the mounted volumes every FstrimInterval, so the
+blocks of deleted files are returned to the thin-pool. Volumes are trimmed
+one by one without holding the lock of driver, since it could take a while.
+*/
+func (d *Driver) trimVolumes() {
+	if d.FstrimInterval == 0 {
+		return
+	}
+	for range time.Tick(d.FstrimInterval) {
+		d.mutex.RLock()
+		volumes := []*Volume{}
+		volumeIDs, err := d.listVolumeNames()
+		if err == nil {
+			for _, id := range volumeIDs {
+				volume := d.blankVolume(id)
+				if err = util.ObjectLoad(volume); err != nil {
+					break
+				}
+				if volume.MountPoint != "" {
+					volumes = append(volumes, volume)
+				}
+			}
+		}
+		d.mutex.RUnlock()
+		if err != nil {
+			log.Errorf("Failed to list volumes to trim: %v", err)
+			continue
+		}
+
+		for _, volume := range volumes {
+			output, err := util.VolumeTrim(context.Background(), volume)
+			if err != nil {
+				log.Warnf("Failed to trim volume %v: %v", volume.Name, err)
+				continue
+			}
+			log.Debugf("Trimmed volume %v: %v", volume.Name, output)
+		}
+	}
+}
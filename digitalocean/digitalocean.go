@@ -1,6 +1,7 @@
 package digitalocean
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"path/filepath"
@@ -56,6 +57,13 @@ type Volume struct {
 	Device     string
 	MountPoint string
 	Size       int64
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Whether the current mount is read-only
+	MountedReadOnly bool
+
 	configPath string
 }
 
@@ -75,7 +83,7 @@ func (v *Volume) GetDevice() (string, error) {
 }
 
 func (v *Volume) GetMountOpts() []string {
-	return []string{}
+	return util.MountOptionsArgs(util.ReadOnlyMountOptions(v.MountOptions, v.MountedReadOnly))
 }
 
 func (v *Volume) GenerateDefaultMountPoint() string {
@@ -238,9 +246,11 @@ func (d *Driver) CreateVolume(req Request) error {
 	vol.ID = vID
 	vol.Device = filepath.Join(DO_DEVICE_FOLDER, DO_DEVICE_PREFIX+id)
 	vol.Size = size
+	vol.MountOptions = opt[OPT_MOUNT_OPTIONS]
+	vol.ReadOnly = opt[OPT_READ_ONLY] == "true"
 
 	if format {
-		if err := formatDevice(vol.Device, DO_VOLUME_FS); err != nil {
+		if err := formatDevice(req.Context(), vol.Device, DO_VOLUME_FS); err != nil {
 			return err
 		}
 	}
@@ -282,7 +292,19 @@ func (d *Driver) MountVolume(req Request) (string, error) {
 		return "", err
 	}
 
-	mountPoint, err := util.VolumeMount(vol, opts[OPT_MOUNT_POINT], false)
+	ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	readOnly := vol.ReadOnly || opts[OPT_READ_ONLY] == "true"
+	if err := util.CheckMountMode(id, vol.MountPoint, vol.MountedReadOnly, readOnly); err != nil {
+		return "", err
+	}
+	vol.MountedReadOnly = readOnly
+
+	mountPoint, err := util.VolumeMountWithContext(ctx, vol, opts[OPT_MOUNT_POINT], false)
 	if err != nil {
 		return "", err
 	}
@@ -302,10 +324,25 @@ func (d *Driver) UmountVolume(req Request) error {
 		return err
 	}
 
-	if err := util.VolumeUmount(vol); err != nil {
+	if err := util.VolumeUmountWithContext(req.Context(), vol); err != nil {
 		return err
 	}
+	vol.MountedReadOnly = false
+
+	return util.ObjectSave(vol)
+}
+
+func (d *Driver) ForceUmountVolume(req Request) error {
+	id := req.Name
 
+	vol := d.blankVolume(id)
+	if err := util.ObjectLoad(vol); err != nil {
+		return err
+	}
+	if err := util.VolumeForceUmount(req.Context(), vol, req.Options[OPT_KILL] == "true"); err != nil {
+		return err
+	}
+	vol.MountedReadOnly = false
 	return util.ObjectSave(vol)
 }
 
@@ -320,6 +357,47 @@ func (d *Driver) MountPoint(req Request) (string, error) {
 	return vol.MountPoint, nil
 }
 
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	id := req.Name
+
+	vol := d.blankVolume(id)
+	if err := util.ObjectLoad(vol); err != nil {
+		return "", err
+	}
+
+	mountPoint, err := util.VolumeMountRefresh(vol)
+	if err != nil {
+		return "", err
+	}
+
+	if err := util.ObjectSave(vol); err != nil {
+		return "", err
+	}
+
+	return mountPoint, nil
+}
+
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	names, err := util.ListConfigIDs(d.Root, CFG_PREFIX+VOLUME_CFG_PREFIX, CFG_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, name := range names {
+		volume := d.blankVolume(name)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, MOUNTS_DIR), mountPoints)
+}
+
 func (d *Driver) GetVolumeInfo(name string) (map[string]string, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -336,11 +414,15 @@ func (d *Driver) GetVolumeInfo(name string) (map[string]string, error) {
 
 	size := doVol.SizeGigaBytes * GB
 	info := map[string]string{
-		"Device":        vol.Device,
-		"MountPoint":    vol.MountPoint,
-		"ID":            vol.ID,
-		OPT_VOLUME_NAME: name,
-		"Size":          strconv.FormatInt(size, 10),
+		"Device":           vol.Device,
+		"MountPoint":       vol.MountPoint,
+		"ID":               vol.ID,
+		OPT_VOLUME_NAME:    name,
+		"Size":             strconv.FormatInt(size, 10),
+		OPT_MOUNT_OPTIONS:  vol.MountOptions,
+		OPT_READ_ONLY:      strconv.FormatBool(vol.ReadOnly),
+		"MountedReadOnly":  strconv.FormatBool(vol.MountedReadOnly),
+		OPT_ALLOCATED_SIZE: strconv.FormatInt(size, 10),
 	}
 	return info, nil
 }
@@ -369,12 +451,16 @@ func (d *Driver) getSize(opts map[string]string, defaultVolumeSize int64) (int64
 	return util.ParseSize(size)
 }
 
-func formatDevice(device, fs string) error {
-	_, err := util.Execute("mkfs", []string{"-t", fs, device})
+func formatDevice(ctx context.Context, device, fs string) error {
+	_, err := util.ExecuteWithRetryContext(ctx, "mkfs", []string{"-t", fs, device})
 	return err
 }
 
 // These methods are not implemented currently at DigitalOcean
+func (d *Driver) ResizeVolume(req Request) error {
+	return fmt.Errorf("Doesn't support resize volume")
+}
+
 func (d *Driver) SnapshotOps() (SnapshotOperations, error) {
 	return nil, errors.New("not implemented")
 }
@@ -13,6 +13,7 @@ import (
 
 	. "github.com/rancher/convoy/convoydriver"
 	. "github.com/rancher/convoy/logging"
+	"github.com/rancher/convoy/objectstore"
 	"github.com/rancher/convoy/util"
 	"github.com/rancher/convoy/util/fs"
 
@@ -37,6 +38,7 @@ const (
 	EBS_DEFAULT_FILESYSTEM  = "ebs.defaultfilesystem"
 	EBS_AUTOFORMAT          = "ebs.autoformat"
 	EBS_AUTORESIZEFS        = "ebs.autoresizefs"
+	EBS_DEFAULT_TAGS        = "ebs.defaulttags"
 
 	DEFAULT_VOLUME_SIZE  = "4G"
 	DEFAULT_VOLUME_TYPE  = "gp2"
@@ -46,8 +48,40 @@ const (
 	MOUNTS_DIR    = "mounts"
 	MOUNT_BINARY  = "mount"
 	UMOUNT_BINARY = "umount"
+
+	// AWS limits of provisioned IOPS and throughput (MiB/s)
+	IO1_MIN_IOPS        = 100
+	IO1_MAX_IOPS        = 64000
+	IO1_MAX_IOPS_PER_GB = 50
+	GP3_MIN_IOPS        = 3000
+	GP3_MAX_IOPS        = 16000
+	GP3_MAX_IOPS_PER_GB = 500
+	GP3_MIN_THROUGHPUT  = 125
+	GP3_MAX_THROUGHPUT  = 1000
+	// gp3 throughput can be at most 0.25 MiB/s per IOPS
+	GP3_IOPS_PER_THROUGHPUT = 4
+
+	// AWS allows 50 tags per resource, some of them are used by convoy
+	MAX_CUSTOM_TAGS      = 40
+	MAX_TAG_KEY_LENGTH   = 128
+	MAX_TAG_VALUE_LENGTH = 256
 )
 
+// reservedTags are the tags used by convoy itself, which cannot be custom
+// tags
+var reservedTags = map[string]bool{
+	"Name":               true,
+	"DCName":             true,
+	"ConvoyVolumeName":   true,
+	"ConvoySnapshotName": true,
+	"GarbageCollection":  true,
+	"DetachedFrom":       true,
+	"DetachedAt":         true,
+	"ForceDetachedFrom":  true,
+	TAG_LOCK_OWNER:       true,
+	TAG_LOCK_ACQUIRED:    true,
+}
+
 type Driver struct {
 	mutex      *sync.RWMutex
 	ebsService EBS
@@ -64,6 +98,13 @@ type Device struct {
 	DefaultEncrypted  bool
 	AutoResizeFS      bool
 	AutoFormat        bool
+	// Tags of every EBS volume and snapshot created, e.g. for cost
+	// allocation
+	DefaultTags map[string]string
+	// What to do if the volume is used by another instance, and how long
+	// to wait for it with LOCK_POLICY_WAIT
+	LockPolicy  string
+	LockTimeout time.Duration
 }
 
 func (dev *Device) ConfigFile() (string, error) {
@@ -85,6 +126,17 @@ type Volume struct {
 	Device     string
 	MountPoint string
 	Snapshots  map[string]Snapshot
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Whether the current mount is read-only
+	MountedReadOnly bool
+	// Provisioned throughput in MiB/s for gp3 volume, which is not
+	// reported by EC2 API
+	Throughput int64
+	// Custom tags of the volume, which are propagated to its snapshots
+	Tags map[string]string
 
 	configPath string
 }
@@ -127,7 +179,7 @@ func (v *Volume) GetDevice() (string, error) {
 }
 
 func (v *Volume) GetMountOpts() []string {
-	return []string{}
+	return util.MountOptionsArgs(util.ReadOnlyMountOptions(v.MountOptions, v.MountedReadOnly))
 }
 
 func (v *Volume) GenerateDefaultMountPoint() string {
@@ -147,6 +199,7 @@ func generateError(fields logrus.Fields, format string, v ...interface{}) error
 func checkVolumeType(volumeType string) error {
 	validVolumeType := map[string]bool{
 		"gp2":      true,
+		"gp3":      true,
 		"io1":      true,
 		"standard": true,
 		"st1":      true,
@@ -158,6 +211,103 @@ func checkVolumeType(volumeType string) error {
 	return nil
 }
 
+/*
+checkVolumePerformance validates provisioned IOPS and throughput against
+the limits of volume type. Size is in GB. Zero IOPS or throughput of gp3
+volume means the baseline provided by AWS.
+*/
+func checkVolumePerformance(volumeType string, size, iops, throughput int64) error {
+	if volumeType != "gp3" && throughput != 0 {
+		return errors.New("Throughput only valid for volume type gp3")
+	}
+	switch volumeType {
+	case "io1":
+		if iops == 0 {
+			return errors.New("Invalid IOPS for volume type io1")
+		}
+		if iops < IO1_MIN_IOPS || iops > IO1_MAX_IOPS {
+			return fmt.Errorf("IOPS=%v of volume type io1 must be between %v and %v", iops, IO1_MIN_IOPS, IO1_MAX_IOPS)
+		}
+		if iops > size*IO1_MAX_IOPS_PER_GB {
+			return fmt.Errorf("IOPS=%v of volume type io1 cannot exceed %v per GB of volume size=%vGB", iops, IO1_MAX_IOPS_PER_GB, size)
+		}
+	case "gp3":
+		if iops != 0 && (iops < GP3_MIN_IOPS || iops > GP3_MAX_IOPS) {
+			return fmt.Errorf("IOPS=%v of volume type gp3 must be between %v and %v", iops, GP3_MIN_IOPS, GP3_MAX_IOPS)
+		}
+		if iops > GP3_MIN_IOPS && iops > size*GP3_MAX_IOPS_PER_GB {
+			return fmt.Errorf("IOPS=%v of volume type gp3 cannot exceed %v per GB of volume size=%vGB", iops, GP3_MAX_IOPS_PER_GB, size)
+		}
+		if throughput != 0 && (throughput < GP3_MIN_THROUGHPUT || throughput > GP3_MAX_THROUGHPUT) {
+			return fmt.Errorf("Throughput=%v of volume type gp3 must be between %v and %v MiB/s", throughput, GP3_MIN_THROUGHPUT, GP3_MAX_THROUGHPUT)
+		}
+		if iops == 0 {
+			iops = GP3_MIN_IOPS
+		}
+		if throughput*GP3_IOPS_PER_THROUGHPUT > iops {
+			return fmt.Errorf("Throughput=%v of volume type gp3 cannot exceed IOPS=%v divided by %v", throughput, iops, GP3_IOPS_PER_THROUGHPUT)
+		}
+	default:
+		if iops != 0 {
+			return errors.New("IOPS only valid for volume type io1 and gp3")
+		}
+	}
+	return nil
+}
+
+// checkTags validates custom tags against the limits of AWS, and makes sure
+// they don't replace the tags used by convoy
+func checkTags(tags map[string]string) error {
+	if len(tags) > MAX_CUSTOM_TAGS {
+		return fmt.Errorf("Too many tags, at most %v are allowed", MAX_CUSTOM_TAGS)
+	}
+	for key, value := range tags {
+		if reservedTags[key] {
+			return fmt.Errorf("Tag=%v is used by convoy", key)
+		}
+		if strings.HasPrefix(strings.ToLower(key), "aws:") {
+			return fmt.Errorf("Tag=%v cannot start with aws:", key)
+		}
+		if len(key) > MAX_TAG_KEY_LENGTH || len(value) > MAX_TAG_VALUE_LENGTH {
+			return fmt.Errorf("Tag=%v is too long, key is limited to %v characters and value to %v", key, MAX_TAG_KEY_LENGTH, MAX_TAG_VALUE_LENGTH)
+		}
+	}
+	return nil
+}
+
+func parseTags(tags string) (map[string]string, error) {
+	result, err := util.ParseTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTags(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+/*
+customTags returns the custom tags of EBS volume or snapshot to be created,
+which are the default tags of driver, overridden by the inherited ones, e.g.
+the tags of volume for its snapshot, and then the ones of request.
+*/
+func (d *Driver) customTags(inherited map[string]string, opts map[string]string) (map[string]string, error) {
+	requested, err := parseTags(opts[OPT_TAGS])
+	if err != nil {
+		return nil, util.NewConvoyDriverErr(err, util.ErrInvalidRequestCode)
+	}
+	result := map[string]string{}
+	for _, tags := range []map[string]string{d.DefaultTags, inherited, requested} {
+		for key, value := range tags {
+			result[key] = value
+		}
+	}
+	if err := checkTags(result); err != nil {
+		return nil, util.NewConvoyDriverErr(err, util.ErrInvalidRequestCode)
+	}
+	return result, nil
+}
+
 func (d *Driver) remountVolumes() error {
 	volumeIDs, err := d.listVolumeNames()
 	if err != nil {
@@ -229,6 +379,14 @@ func getDefaultDevice(root string, config map[string]string) (*Device, error) {
 		}
 	}
 	log.Debugf("Setting driver flags for autoFormat=%v autoResizefs=%v", autoFormat, autoResizefs)
+	defaultTags, err := parseTags(config[EBS_DEFAULT_TAGS])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v: %v", EBS_DEFAULT_TAGS, err)
+	}
+	lockPolicy, lockTimeout, err := getLockConfig(config)
+	if err != nil {
+		return nil, err
+	}
 
 	dev := &Device{
 		Root:              root,
@@ -240,6 +398,9 @@ func getDefaultDevice(root string, config map[string]string) (*Device, error) {
 		DefaultEncrypted:  encrypted,
 		AutoFormat:        autoFormat,
 		AutoResizeFS:      autoResizefs,
+		DefaultTags:       defaultTags,
+		LockPolicy:        lockPolicy,
+		LockTimeout:       lockTimeout,
 	}
 	return dev, nil
 }
@@ -260,6 +421,25 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 		if err := util.ObjectLoad(dev); err != nil {
 			return nil, err
 		}
+		// Upgrade from the config without volume locking
+		if dev.LockPolicy == "" {
+			if dev.LockPolicy, dev.LockTimeout, err = getLockConfig(config); err != nil {
+				return nil, err
+			}
+			if err := util.ObjectSave(dev); err != nil {
+				return nil, err
+			}
+		}
+		// Default tags can be added to the existing config, unlike the
+		// other options
+		if dev.DefaultTags == nil && config[EBS_DEFAULT_TAGS] != "" {
+			if dev.DefaultTags, err = parseTags(config[EBS_DEFAULT_TAGS]); err != nil {
+				return nil, fmt.Errorf("Invalid %v: %v", EBS_DEFAULT_TAGS, err)
+			}
+			if err := util.ObjectSave(dev); err != nil {
+				return nil, err
+			}
+		}
 	} else {
 		if err := util.MkdirIfNotExists(root); err != nil {
 			return nil, err
@@ -302,6 +482,9 @@ func (d *Driver) Info() (map[string]string, error) {
 	infos["AvailiablityZone"] = d.ebsService.GetAvailabilityZone()
 	infos["AutoResizeFS"] = fmt.Sprint(d.AutoResizeFS)
 	infos["AutoFormat"] = fmt.Sprint(d.AutoFormat)
+	infos["LockPolicy"] = d.LockPolicy
+	infos["LockTimeout"] = d.LockTimeout.String()
+	infos["DefaultTags"] = util.FormatTags(d.DefaultTags)
 	return infos, nil
 }
 
@@ -317,31 +500,40 @@ func (d *Driver) getSize(opts map[string]string, defaultVolumeSize int64) (int64
 	return util.ParseSize(size)
 }
 
-func (d *Driver) getTypeAndIOPS(opts map[string]string) (string, int64, error) {
-	var (
-		iops int64
-		err  error
-	)
-	volumeType := opts[OPT_VOLUME_TYPE]
-	if volumeType == "" {
-		volumeType = d.DefaultVolumeType
+type volumePerformance struct {
+	volumeType string
+	iops       int64
+	throughput int64
+}
+
+func (d *Driver) getVolumePerformance(opts map[string]string, size int64) (*volumePerformance, error) {
+	var err error
+
+	p := &volumePerformance{
+		volumeType: opts[OPT_VOLUME_TYPE],
 	}
-	if err := checkVolumeType(volumeType); err != nil {
-		return "", 0, err
+	if p.volumeType == "" {
+		p.volumeType = d.DefaultVolumeType
+	}
+	if err := checkVolumeType(p.volumeType); err != nil {
+		return nil, err
 	}
 	if opts[OPT_VOLUME_IOPS] != "" {
-		iops, err = strconv.ParseInt(opts[OPT_VOLUME_IOPS], 10, 64)
+		p.iops, err = strconv.ParseInt(opts[OPT_VOLUME_IOPS], 10, 64)
 		if err != nil {
-			return "", 0, err
+			return nil, err
 		}
 	}
-	if volumeType == "io1" && iops == 0 {
-		return "", 0, errors.New("Invalid IOPS for volume type io1")
+	if opts[OPT_VOLUME_THROUGHPUT] != "" {
+		p.throughput, err = strconv.ParseInt(opts[OPT_VOLUME_THROUGHPUT], 10, 64)
+		if err != nil {
+			return nil, err
+		}
 	}
-	if volumeType != "io1" && iops != 0 {
-		return "", 0, errors.New("IOPS only valid for volume type io1")
+	if err := checkVolumePerformance(p.volumeType, (size+GB-1)/GB, p.iops, p.throughput); err != nil {
+		return nil, err
 	}
-	return volumeType, iops, nil
+	return p, nil
 }
 
 func convertEc2TagsToMap(tags []*ec2.Tag) map[string]string {
@@ -393,20 +585,40 @@ func (d *Driver) BuildFromSnapshot(snapshot *ec2.Snapshot, args *BuildArgs) (*Bu
 		return nil, util.NewConvoyDriverErr(fmt.Errorf("Volume size cannot be less than snapshot size=%v", snapshotVolumeSize), util.ErrInvalidRequestCode)
 	}
 
-	volumeType, iops, err := d.getTypeAndIOPS(args.opts)
+	performance, err := d.getVolumePerformance(args.opts, volumeSize)
 	if err != nil {
 		return nil, err
 	}
 
+	// Volume of encrypted snapshot is always encrypted, by the key of
+	// snapshot. Unencrypted snapshot, or snapshot encrypted by another key
+	// than the requested one, has to be copied with encryption first.
+	snapshotID := *snapshot.SnapshotId
+	encrypted, kmsKeyID := d.volumeEncryption(args.opts)
+	if encrypted && needsEncryptedCopy(snapshot, args.opts[OPT_KMS_KEY_ID]) {
+		copyID, err := d.encryptSnapshot(snapshotID, kmsKeyID)
+		if err != nil {
+			return nil, err
+		}
+		// Volume keeps the data after the snapshot is deleted
+		defer func() {
+			if err := d.ebsService.DeleteSnapshot(copyID); err != nil {
+				log.Warnf("Failed to delete encrypted copy=%v of snapshot=%v: %v", copyID, snapshotID, err)
+			}
+		}()
+		snapshotID = copyID
+	}
+
 	r := &CreateEBSVolumeRequest{
 		Size:       volumeSize,
-		SnapshotID: *snapshot.SnapshotId,
-		VolumeType: volumeType,
-		IOPS:       iops,
+		SnapshotID: snapshotID,
+		VolumeType: performance.volumeType,
+		IOPS:       performance.iops,
+		Throughput: performance.throughput,
 		Tags:       convertEc2TagsToMap(snapshot.Tags),
-		Encrypted:  *snapshot.Encrypted,
+		Encrypted:  aws.BoolValue(snapshot.Encrypted) || encrypted,
 	}
-	log.Debugf("Creating new volume from snapshotId=%v ", *snapshot.SnapshotId)
+	log.Debugf("Creating new volume from snapshotId=%v ", snapshotID)
 	volumeID, err := d.ebsService.CreateVolume(r)
 	if err != nil {
 		return nil, err
@@ -419,9 +631,57 @@ func (d *Driver) BuildFromSnapshot(snapshot *ec2.Snapshot, args *BuildArgs) (*Bu
 	return &BuildReturn{
 		volumeId:   volumeID,
 		volumeSize: volumeSize,
+		throughput: performance.throughput,
 	}, nil
 }
 
+// encryptSnapshot returns the encrypted copy of snapshot by kmsKeyID, or the
+// default key of account for EBS if it's empty, once the copy is completed
+func (d *Driver) encryptSnapshot(snapshotID, kmsKeyID string) (string, error) {
+	log.Debugf("Copying snapshot=%v with encryption by KMS key=%q", snapshotID, kmsKeyID)
+	copyID, err := d.ebsService.EncryptSnapshot(snapshotID, kmsKeyID)
+	if err != nil {
+		return "", err
+	}
+	if err := d.ebsService.WaitForSnapshotComplete(copyID); err != nil {
+		if deleteErr := d.ebsService.DeleteSnapshot(copyID); deleteErr != nil {
+			log.Warnf("Failed to delete encrypted copy=%v of snapshot=%v: %v", copyID, snapshotID, deleteErr)
+		}
+		return "", err
+	}
+	log.Debugf("Snapshot=%v is copied to encrypted snapshot=%v", snapshotID, copyID)
+	return copyID, nil
+}
+
+/*
+volumeEncryption returns whether the new volume should be encrypted and by
+which KMS key, requested by opts or the defaults of driver. Empty key means
+the default key of account for EBS. Specifying the key implies encryption.
+*/
+func (d *Driver) volumeEncryption(opts map[string]string) (bool, string) {
+	kmsKeyID := opts[OPT_KMS_KEY_ID]
+	if kmsKeyID == "" {
+		kmsKeyID = d.DefaultKmsKeyID
+	}
+	encrypted := opts[OPT_ENCRYPTED] == "true" || d.DefaultEncrypted || kmsKeyID != ""
+	return encrypted, kmsKeyID
+}
+
+// needsEncryptedCopy returns true if snapshot is not encrypted, or encrypted
+// by another key than the requested kmsKeyID
+func needsEncryptedCopy(snapshot *ec2.Snapshot, kmsKeyID string) bool {
+	if !aws.BoolValue(snapshot.Encrypted) {
+		return true
+	}
+	return kmsKeyID != "" && !isSameKmsKey(kmsKeyID, aws.StringValue(snapshot.KmsKeyId))
+}
+
+// isSameKmsKey returns true if key is the ID or ARN of the key of keyARN.
+// Aliases can't be resolved without KMS, so they never match.
+func isSameKmsKey(key, keyARN string) bool {
+	return key == keyARN || strings.HasSuffix(keyARN, ":key/"+key)
+}
+
 func (d *Driver) UpdateTags(volumeID string, newTags map[string]string) error {
 	if err := d.ebsService.AddTags(volumeID, newTags); err != nil {
 		log.Errorf("Failed to update tags for volume=%v: %s", volumeID, err)
@@ -435,16 +695,18 @@ func (d *Driver) BuildNewVolume(args *BuildArgs) (*BuildReturn, error) {
 	if err != nil {
 		return nil, err
 	}
-	volumeType, iops, err := d.getTypeAndIOPS(args.opts)
+	performance, err := d.getVolumePerformance(args.opts, volumeSize)
 	if err != nil {
 		return nil, err
 	}
+	encrypted, kmsKeyID := d.volumeEncryption(args.opts)
 	r := &CreateEBSVolumeRequest{
 		Size:       volumeSize,
-		VolumeType: volumeType,
-		IOPS:       iops,
-		KmsKeyID:   d.DefaultKmsKeyID,
-		Encrypted:  d.DefaultEncrypted,
+		VolumeType: performance.volumeType,
+		IOPS:       performance.iops,
+		Throughput: performance.throughput,
+		KmsKeyID:   kmsKeyID,
+		Encrypted:  encrypted,
 	}
 	volumeID, err := d.ebsService.CreateVolume(r)
 	if err != nil {
@@ -454,9 +716,72 @@ func (d *Driver) BuildNewVolume(args *BuildArgs) (*BuildReturn, error) {
 	return &BuildReturn{
 		volumeId:   volumeID,
 		volumeSize: volumeSize,
+		throughput: performance.throughput,
 	}, nil
 }
 
+// buildFromLocalSnapshot creates a new EBS volume from the EBS snapshot of a
+// snapshot taken by convoy
+func (d *Driver) buildFromLocalSnapshot(snapshotName, snapshotVolumeName string, args *BuildArgs) (*BuildReturn, error) {
+	snapshot, _, err := d.getSnapshotAndVolume(snapshotName, snapshotVolumeName)
+	if err != nil {
+		return nil, err
+	}
+	ec2Snapshot, err := d.ebsService.GetSnapshot(snapshot.EBSID)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Building name=%v from snapshot=%v of volume=%v", args.volumeName, snapshot.EBSID, snapshotVolumeName)
+	return d.BuildFromSnapshot(ec2Snapshot, args)
+}
+
+/*
+buildFromVolume creates a new EBS volume from a temporary EBS snapshot of the
+volume source, which is deleted once the new volume is created. The new
+volume has the type and performance of source, unless they're requested.
+*/
+func (d *Driver) buildFromVolume(source *Volume, args *BuildArgs) (*BuildReturn, error) {
+	ebsVolume, err := d.ebsService.GetVolume(source.EBSID)
+	if err != nil {
+		return nil, err
+	}
+	opts := map[string]string{}
+	for key, value := range args.opts {
+		opts[key] = value
+	}
+	// IOPS is reported for all volume types, but only provisioned for some
+	volumeType := aws.StringValue(ebsVolume.VolumeType)
+	if opts[OPT_VOLUME_TYPE] == "" && volumeType != "" {
+		opts[OPT_VOLUME_TYPE] = volumeType
+		if (volumeType == "io1" || volumeType == "gp3") && (opts[OPT_VOLUME_IOPS] == "" || opts[OPT_VOLUME_IOPS] == "0") {
+			opts[OPT_VOLUME_IOPS] = strconv.FormatInt(aws.Int64Value(ebsVolume.Iops), 10)
+		}
+		if opts[OPT_VOLUME_THROUGHPUT] == "" || opts[OPT_VOLUME_THROUGHPUT] == "0" {
+			opts[OPT_VOLUME_THROUGHPUT] = strconv.FormatInt(source.Throughput, 10)
+		}
+	}
+
+	snapshotID, err := d.ebsService.LaunchSnapshot(source.EBSID, fmt.Sprintf("Convoy: Cloning volume=%v", source.Name), source.Tags)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := d.ebsService.DeleteSnapshot(snapshotID); err != nil {
+			log.Warnf("Failed to delete temporary snapshot=%v of volume=%v: %v", snapshotID, source.Name, err)
+		}
+	}()
+	snapshot, err := d.ebsService.GetSnapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Cloning volume=%v from snapshot=%v of volume=%v", args.volumeName, snapshotID, source.Name)
+	return d.BuildFromSnapshot(snapshot, &BuildArgs{
+		volumeName: args.volumeName,
+		opts:       opts,
+		tags:       args.tags,
+	})
+}
+
 func (d *Driver) BuildVolumeFromScratch(volume *ec2.Volume, snapshot *ec2.Snapshot, args *BuildArgs) (*BuildReturn, error) {
 	// If there is no current reference to the volumeName or the snapshot has opted out of failover the build a volume from scratch
 	if snapshot == nil && volume == nil {
@@ -536,6 +861,8 @@ type BuildArgs struct {
 type BuildReturn struct {
 	volumeId   string
 	volumeSize int64
+	// Only known if the volume was created by convoy
+	throughput int64
 }
 
 func (d *Driver) BuildVolume(volumeName string, volumeID string, opts map[string]string, newTags map[string]string) (*BuildReturn, error) {
@@ -566,6 +893,16 @@ func (d *Driver) BuildVolume(volumeName string, volumeID string, opts map[string
 		return nil, err
 	}
 
+	// Volume used by another instance could be released according to the
+	// lock policy
+	if mostRecentVolume != nil && *mostRecentVolume.State == ec2.VolumeStateInUse && d.isVolumeInLocalAz(mostRecentVolume) {
+		if err := d.acquireVolumeLock(*mostRecentVolume.VolumeId); err != nil {
+			return nil, err
+		}
+		if mostRecentVolume, err = d.ebsService.GetVolume(*mostRecentVolume.VolumeId); err != nil {
+			return nil, err
+		}
+	}
 	if mostRecentVolume != nil && *mostRecentVolume.State != ec2.VolumeStateAvailable {
 		return nil, util.NewConvoyDriverErr(fmt.Errorf("Volume (id=%v, name=%v) is in an unexpected state=%v expected state=%v", *mostRecentVolume.VolumeId, volumeName, *mostRecentVolume.State, ec2.VolumeStateAvailable), util.ErrVolumeExistsCode)
 	}
@@ -682,7 +1019,38 @@ func (d *Driver) CreateVolume(req Request) error {
 	if volumeID != "" && volumeName != "" {
 		return util.NewConvoyDriverErr(errors.New("Cannot specify both EBS volume ID and EBS volume Name"), util.ErrInvalidRequestCode)
 	}
-	if volumeName != "" {
+	snapshotName := opts[OPT_SNAPSHOT_NAME]
+	if snapshotName != "" && (backupURL != "" || volumeID != "") {
+		return util.NewConvoyDriverErr(errors.New("Cannot specify snapshot with backup or EBS volume ID"), util.ErrInvalidRequestCode)
+	}
+	if volumeID != "" && (opts[OPT_ENCRYPTED] == "true" || opts[OPT_KMS_KEY_ID] != "") {
+		return util.NewConvoyDriverErr(errors.New("Cannot specify encryption with EBS volume ID, existing volume won't be encrypted"), util.ErrInvalidRequestCode)
+	}
+	var source *Volume
+	if opts[OPT_CLONE_SOURCE] != "" {
+		if snapshotName != "" || backupURL != "" || volumeID != "" {
+			return util.NewConvoyDriverErr(errors.New("Cannot specify clone source with snapshot, backup or EBS volume ID"), util.ErrInvalidRequestCode)
+		}
+		source = d.blankVolume(opts[OPT_CLONE_SOURCE])
+		if err := util.ObjectLoad(source); err != nil {
+			return err
+		}
+	}
+	// Backup of files in objectstore would be extracted to the new volume
+	restoreFiles := false
+	if backupURL != "" && !strings.HasPrefix(backupURL, DRIVER_NAME+"://") {
+		format, err := objectstore.GetBackupFormat(backupURL)
+		if err != nil {
+			return err
+		}
+		if format != objectstore.BACKUP_FORMAT_FILES {
+			return util.NewConvoyDriverErr(fmt.Errorf("Cannot restore backup %v to %v, only backup in %v format is supported", backupURL, d.Name(), objectstore.BACKUP_FORMAT_FILES), util.ErrInvalidRequestCode)
+		}
+		restoreFiles = true
+	}
+	// Volume of local snapshot or clone is always a new one, existing
+	// volume of the name won't be reused
+	if volumeName != "" && snapshotName == "" && source == nil {
 		log.Debugf("Checking if volume with name=%v is in EBS", volumeName)
 		ebsVolume, err := d.ebsService.GetVolumeByName(volumeName, d.DefaultDCName)
 		if err != nil {
@@ -706,13 +1074,39 @@ func (d *Driver) CreateVolume(req Request) error {
 		}
 	}
 
-	newTags := map[string]string{
-		"Name":   id,
-		"DCName": d.DefaultDCName,
+	// Clone has the custom tags of its source, like snapshot does
+	var inheritedTags map[string]string
+	if source != nil {
+		inheritedTags = source.Tags
+	}
+	customTags, err := d.customTags(inheritedTags, opts)
+	if err != nil {
+		return err
+	}
+	newTags := map[string]string{}
+	for key, value := range customTags {
+		newTags[key] = value
+	}
+	newTags["Name"] = id
+	newTags["DCName"] = d.DefaultDCName
+
+	var buildReturn *BuildReturn
+	if source != nil {
+		buildReturn, err = d.buildFromVolume(source, &BuildArgs{
+			volumeName: volumeName,
+			opts:       opts,
+			tags:       newTags,
+		})
+	} else if snapshotName != "" {
+		buildReturn, err = d.buildFromLocalSnapshot(snapshotName, opts[OPT_SNAPSHOT_VOLUME_NAME], &BuildArgs{
+			volumeName: volumeName,
+			opts:       opts,
+			tags:       newTags,
+		})
+	} else {
+		// If Failover Tag is false, will be designated inside this logic and return the proper values
+		buildReturn, err = d.BuildVolume(volumeName, volumeID, opts, newTags)
 	}
-
-	// If Failover Tag is false, will be designated inside this logic and return the proper values
-	buildReturn, err := d.BuildVolume(volumeName, volumeID, opts, newTags)
 	if err != nil {
 		return err
 	}
@@ -722,8 +1116,14 @@ func (d *Driver) CreateVolume(req Request) error {
 		return err
 	}
 
+	if err := d.acquireVolumeLock(volumeID); err != nil {
+		return err
+	}
 	dev, err := d.ebsService.AttachVolume(volumeID, volumeSize)
 	if err != nil {
+		if lockErr := d.releaseVolumeLock(volumeID); lockErr != nil {
+			log.Warnf("Failed to release lock of volume=%v: %v", volumeID, lockErr)
+		}
 		return err
 	}
 	log.Debugf("Attached EBS volume=%v to dev=%v", volumeID, dev)
@@ -732,6 +1132,13 @@ func (d *Driver) CreateVolume(req Request) error {
 	volume.EBSID = volumeID
 	volume.Device = dev
 	volume.Snapshots = make(map[string]Snapshot)
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	if source != nil && volume.MountOptions == "" {
+		volume.MountOptions = source.MountOptions
+	}
+	volume.ReadOnly = opts[OPT_READ_ONLY] == "true"
+	volume.Throughput = buildReturn.throughput
+	volume.Tags = customTags
 
 	var needsFS bool
 	if fsType, err := fs.Detect(volume.Device); err != nil {
@@ -744,7 +1151,7 @@ func (d *Driver) CreateVolume(req Request) error {
 		log.Debugf("Detected existing filesystem type=%v for device=%v", fsType, volume.Device)
 		if d.AutoResizeFS {
 			log.Debugf("Ensuring filesystem size and device=%v size match", volume.Device)
-			if err := fs.Resize(volume.Device); err != nil {
+			if err := fs.ResizeWithContext(req.Context(), volume.Device); err != nil {
 				log.Debugf("Syncing device=%s sizes error: %s", volume.Device, err)
 				return err
 			}
@@ -761,7 +1168,16 @@ func (d *Driver) CreateVolume(req Request) error {
 	}
 	if needsFS && d.AutoFormat {
 		log.Debugf("Formatting device=%v with filesystem type=%v", volume.Device, fsType)
-		if err := fs.FormatDevice(volume.Device, fsType); err != nil {
+		if err := fs.FormatDeviceWithContext(req.Context(), volume.Device, fsType); err != nil {
+			return err
+		}
+	}
+
+	if restoreFiles {
+		if needsFS && !d.AutoFormat {
+			return util.NewConvoyDriverErr(fmt.Errorf("Cannot restore backup to device=%v without filesystem, since %v is disabled", volume.Device, EBS_AUTOFORMAT), util.ErrInvalidRequestCode)
+		}
+		if err := restoreFilesBackup(volume, backupURL); err != nil {
 			return err
 		}
 	}
@@ -773,6 +1189,119 @@ func (d *Driver) CreateVolume(req Request) error {
 	return nil
 }
 
+/*
+ImportVolume attaches the existing EBS volume of ID in
+req.Options[OPT_IMPORT_SOURCE] as the volume, regardless of its name tag. Its
+filesystem is used as it is, volumes without filesystem are rejected rather
+than formatted since there is nothing to import.
+*/
+func (d *Driver) ImportVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	opts := req.Options
+	volumeID := opts[OPT_IMPORT_SOURCE]
+	if err := checkEBSVolumeID(volumeID); err != nil {
+		return util.NewConvoyDriverErr(err, util.ErrInvalidRequestCode)
+	}
+
+	volume := d.blankVolume(id)
+	exists, err := util.ObjectExists(volume)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return util.NewConvoyDriverErr(fmt.Errorf("Volume=%v already exists", id), util.ErrVolumeExistsCode)
+	}
+
+	ebsVolume, err := d.ebsService.GetVolume(volumeID)
+	if err != nil {
+		return err
+	}
+	if !d.isVolumeInLocalAz(ebsVolume) {
+		return util.NewConvoyDriverErr(fmt.Errorf("EBS volume=%v is in availability zone=%v, not the one of this instance=%v",
+			volumeID, aws.StringValue(ebsVolume.AvailabilityZone), d.ebsService.GetAvailabilityZone()), util.ErrInvalidRequestCode)
+	}
+	if err := d.acquireVolumeLock(volumeID); err != nil {
+		return err
+	}
+	dev, err := d.attachImportedVolume(id, ebsVolume)
+	if err != nil {
+		if lockErr := d.releaseVolumeLock(volumeID); lockErr != nil {
+			log.Warnf("Failed to release lock of volume=%v: %v", volumeID, lockErr)
+		}
+		return err
+	}
+	log.Debugf("Imported EBS volume=%v attached to dev=%v", volumeID, dev)
+
+	volume.EBSID = volumeID
+	volume.Device = dev
+	volume.Snapshots = make(map[string]Snapshot)
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	volume.ReadOnly = opts[OPT_READ_ONLY] == "true"
+	return util.ObjectSave(volume)
+}
+
+// attachImportedVolume attaches the volume and checks it has a filesystem,
+// it would be detached if it doesn't
+func (d *Driver) attachImportedVolume(id string, ebsVolume *ec2.Volume) (string, error) {
+	volumeID := aws.StringValue(ebsVolume.VolumeId)
+	// Volume lock may have force detached it from a dead instance
+	ebsVolume, err := d.ebsService.GetVolume(volumeID)
+	if err != nil {
+		return "", err
+	}
+	if aws.StringValue(ebsVolume.State) != ec2.VolumeStateAvailable {
+		return "", util.NewConvoyDriverErr(fmt.Errorf("EBS volume=%v is in an unexpected state=%v expected state=%v",
+			volumeID, aws.StringValue(ebsVolume.State), ec2.VolumeStateAvailable), util.ErrVolumeNotAvailableCode)
+	}
+	if err := d.UpdateTags(volumeID, map[string]string{
+		"Name":   id,
+		"DCName": d.DefaultDCName,
+	}); err != nil {
+		return "", err
+	}
+	dev, err := d.ebsService.AttachVolume(volumeID, aws.Int64Value(ebsVolume.Size)*GB)
+	if err != nil {
+		return "", err
+	}
+	if fsType, err := fs.Detect(dev); err != nil {
+		if detachErr := d.ebsService.DetachVolume(volumeID); detachErr != nil {
+			log.Warnf("Failed to detach EBS volume=%v: %v", volumeID, detachErr)
+		}
+		if err == fs.ErrNoFilesystemDetected {
+			return "", util.NewConvoyDriverErr(fmt.Errorf("EBS volume=%v has no filesystem to import", volumeID), util.ErrInvalidRequestCode)
+		}
+		return "", err
+	} else {
+		log.Debugf("Detected existing filesystem type=%v for device=%v", fsType, dev)
+	}
+	return dev, nil
+}
+
+/*
+CloneVolume creates the volume from a temporary EBS snapshot of the volume
+req.Options[OPT_CLONE_SOURCE]. Like for snapshot, writes to the source which
+are not flushed yet won't be in the clone.
+*/
+func (d *Driver) CloneVolume(req Request) error {
+	return d.CreateVolume(req)
+}
+
+// restoreFilesBackup mounts the volume temporarily to extract the backup
+func restoreFilesBackup(volume *Volume, backupURL string) error {
+	mountPoint, err := util.VolumeMount(volume, "", false)
+	if err != nil {
+		return err
+	}
+	restoreErr := objectstore.RestoreFilesBackup(backupURL, mountPoint)
+	if err := util.VolumeUmount(volume); err != nil {
+		return err
+	}
+	return restoreErr
+}
+
 func (d *Driver) DeleteVolume(req Request) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -794,6 +1323,9 @@ func (d *Driver) DeleteVolume(req Request) error {
 		log.Warnf("Unable to detach id=%v/ebsid=%v due to backend error: %s - Deleting object from state", id, volume.EBSID, err)
 	} else {
 		log.Debugf("Successfully detached id=%v/ebsid=%v from dev=%v", id, volume.EBSID, volume.Device)
+		if err := d.releaseVolumeLock(volume.EBSID); err != nil {
+			log.WithField("volume-id", id).Warnf("failed releasing lock of volume: %v", err)
+		}
 	}
 
 	//Add some tracking information
@@ -828,7 +1360,19 @@ func (d *Driver) MountVolume(req Request) (string, error) {
 		return "", err
 	}
 
-	mountPoint, err := util.VolumeMount(volume, opts[OPT_MOUNT_POINT], false)
+	ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	readOnly := volume.ReadOnly || opts[OPT_READ_ONLY] == "true"
+	if err := util.CheckMountMode(id, volume.MountPoint, volume.MountedReadOnly, readOnly); err != nil {
+		return "", err
+	}
+	volume.MountedReadOnly = readOnly
+
+	mountPoint, err := util.VolumeMountWithContext(ctx, volume, opts[OPT_MOUNT_POINT], false)
 	if err != nil {
 		// if device doesn't exist, it's a stale entry.
 		errorStr := err.Error()
@@ -857,9 +1401,10 @@ func (d *Driver) UmountVolume(req Request) error {
 		return err
 	}
 
-	if err := util.VolumeUmount(volume); err != nil {
+	if err := util.VolumeUmountWithContext(req.Context(), volume); err != nil {
 		return err
 	}
+	volume.MountedReadOnly = false
 
 	if err := util.ObjectSave(volume); err != nil {
 		return err
@@ -874,6 +1419,56 @@ func (d *Driver) UmountVolume(req Request) error {
 	return nil
 }
 
+// ForceUmountVolume keeps the volume attached, unlike UmountVolume, see
+// FenceVolume for detaching it
+func (d *Driver) ForceUmountVolume(req Request) error {
+	id := req.Name
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeForceUmount(req.Context(), volume, req.Options[OPT_KILL] == "true"); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+/*
+FenceVolume detaches the volume by force, even if the host still writes to
+it, and forgets it like DeleteVolume does. The volume can be attached to
+another host once the lock of this host is released.
+*/
+func (d *Driver) FenceVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	instanceID := d.ebsService.GetInstanceID()
+	if err := d.ebsService.ForceDetachVolume(volume.EBSID, instanceID); err != nil {
+		return err
+	}
+	log.Debugf("Force detached id=%v/ebsid=%v from dev=%v", id, volume.EBSID, volume.Device)
+	if err := d.releaseVolumeLock(volume.EBSID); err != nil {
+		log.WithField("volume-id", id).Warnf("failed releasing lock of volume: %v", err)
+	}
+
+	fenceTags := map[string]string{
+		"FencedFrom": instanceID,
+		"FencedAt":   time.Now().String(),
+	}
+	if err := d.UpdateTags(volume.EBSID, fenceTags); err != nil {
+		log.WithField("volume-id", id).Warnf("failed adding fence tracking tags to volume: %v", err)
+	}
+	return util.ObjectDelete(volume)
+}
+
 func (d *Driver) MountPoint(req Request) (string, error) {
 	id := req.Name
 
@@ -884,6 +1479,26 @@ func (d *Driver) MountPoint(req Request) (string, error) {
 	return volume.MountPoint, nil
 }
 
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	id := req.Name
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+
+	mountPoint, err := util.VolumeMountRefresh(volume)
+	if err != nil {
+		return "", err
+	}
+
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+
+	return mountPoint, nil
+}
+
 func (d *Driver) GetVolumesInfo(ids []string) ([]map[string]string, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -908,7 +1523,8 @@ func (d *Driver) GetVolumesInfo(ids []string) ([]map[string]string, error) {
 
 	for k, ebsID := range ebsIDs {
 		wg.Add(1)
-		go func(i int, id string) {
+		i, id := k, ebsID
+		GoWithRequestID(func() {
 			defer wg.Done()
 			if ebsVolume, err := d.ebsService.GetVolume(id); err != nil {
 				if strings.Contains(err.Error(), "InvalidVolume.NotFound") {
@@ -924,7 +1540,7 @@ func (d *Driver) GetVolumesInfo(ids []string) ([]map[string]string, error) {
 			} else {
 				ebsVolumes[i] = ebsVolume
 			}
-		}(k, ebsID)
+		})
 	}
 	wg.Wait()
 
@@ -955,6 +1571,27 @@ func (d *Driver) GetVolumesInfo(ids []string) ([]map[string]string, error) {
 	return infoList, nil
 }
 
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	names, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, name := range names {
+		volume := d.blankVolume(name)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, MOUNTS_DIR), mountPoints)
+}
+
 func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -980,11 +1617,16 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 	if ebsVolume.Iops != nil {
 		iops = strconv.FormatInt(*ebsVolume.Iops, 10)
 	}
+	throughput := ""
+	if volume.Throughput != 0 {
+		throughput = strconv.FormatInt(volume.Throughput, 10)
+	}
 	info := map[string]string{
 		"Device":                volume.Device,
 		"MountPoint":            volume.MountPoint,
 		"EBSVolumeID":           volume.EBSID,
 		"KmsKeyId":              aws.StringValue(ebsVolume.KmsKeyId),
+		"Encrypted":             strconv.FormatBool(aws.BoolValue(ebsVolume.Encrypted)),
 		"AvailiablityZone":      aws.StringValue(ebsVolume.AvailabilityZone),
 		OPT_VOLUME_NAME:         id,
 		OPT_VOLUME_CREATED_TIME: (*ebsVolume.CreateTime).Format(time.RubyDate),
@@ -992,6 +1634,11 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 		"State":                 aws.StringValue(ebsVolume.State),
 		"Type":                  aws.StringValue(ebsVolume.VolumeType),
 		"IOPS":                  iops,
+		"Throughput":            throughput,
+		OPT_MOUNT_OPTIONS:       volume.MountOptions,
+		OPT_READ_ONLY:           strconv.FormatBool(volume.ReadOnly),
+		"MountedReadOnly":       strconv.FormatBool(volume.MountedReadOnly),
+		OPT_ALLOCATED_SIZE:      strconv.FormatInt(*ebsVolume.Size*GB, 10),
 	}
 
 	if len(ebsVolume.Attachments) != 0 && aws.StringValue(ebsVolume.Attachments[0].Device) != "" {
@@ -1001,6 +1648,39 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 	return info, nil
 }
 
+func (d *Driver) ResizeVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	size, err := util.ParseSize(req.Options[OPT_SIZE])
+	if err != nil {
+		return util.NewConvoyDriverErr(err, util.ErrInvalidRequestCode)
+	}
+	if size%GB != 0 {
+		return util.NewConvoyDriverErr(fmt.Errorf("Size of EBS volume must be multiple of 1G"), util.ErrInvalidRequestCode)
+	}
+	ebsVolume, err := d.ebsService.GetVolume(volume.EBSID)
+	if err != nil {
+		return err
+	}
+	if size <= *ebsVolume.Size*GB {
+		return util.NewConvoyDriverErr(fmt.Errorf("New size %v must be larger than current size %v of volume=%v",
+			size, *ebsVolume.Size*GB, id), util.ErrInvalidRequestCode)
+	}
+
+	log.Debugf("Resizing EBS volume=%v from %v GB to %v GB", volume.EBSID, *ebsVolume.Size, size/GB)
+	if err := d.ebsService.ResizeVolume(volume.EBSID, size/GB); err != nil {
+		return err
+	}
+	return fs.ResizeWithContext(req.Context(), volume.Device)
+}
+
 func (d *Driver) listVolumeNames() ([]string, error) {
 	return util.ListConfigIDs(d.Root, CFG_PREFIX+VOLUME_CFG_PREFIX, CFG_POSTFIX)
 }
@@ -1064,10 +1744,12 @@ func (d *Driver) CreateSnapshot(req Request) error {
 		}, "Already has snapshot with uuid")
 	}
 
-	tags := map[string]string{
-		"ConvoyVolumeName":   volumeID,
-		"ConvoySnapshotName": id,
+	tags, err := d.customTags(volume.Tags, req.Options)
+	if err != nil {
+		return err
 	}
+	tags["ConvoyVolumeName"] = volumeID
+	tags["ConvoySnapshotName"] = id
 	ebsSnapshotID, err := d.ebsService.LaunchSnapshot(volume.EBSID, "Convoy Snapshot", tags)
 	if err != nil {
 		return err
@@ -1193,6 +1875,14 @@ func (d *Driver) BackupOps() (BackupOperations, error) {
 	return d, nil
 }
 
+func checkEBSVolumeID(id string) error {
+	validID := regexp.MustCompile(`^vol-[0-9a-z]+$`)
+	if !validID.MatchString(id) {
+		return fmt.Errorf("invalid EBS volume id=%v", id)
+	}
+	return nil
+}
+
 func checkEBSSnapshotID(id string) error {
 	validID := regexp.MustCompile(`^snap-[0-9a-z]+$`)
 	if !validID.MatchString(id) {
@@ -1225,6 +1915,12 @@ func decodeURL(backupURL string) (string, string, error) {
 
 func (d *Driver) CreateBackup(snapshotID, volumeID, destURL string, opts map[string]string) (string, error) {
 	//destURL is not necessary in EBS case
+	if opts[OPT_ENCRYPTION_KEY_ID] != "" {
+		return "", fmt.Errorf("EBS backup doesn't support client side encryption, use encrypted EBS volume instead")
+	}
+	if opts[OPT_COMPRESSION] != "" {
+		return "", fmt.Errorf("EBS backup doesn't support compression, EBS snapshots are managed by AWS")
+	}
 	snapshot, _, err := d.getSnapshotAndVolume(snapshotID, volumeID)
 	if err != nil {
 		return "", err
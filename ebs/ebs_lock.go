@@ -0,0 +1,189 @@
+package ebs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	EBS_LOCK_POLICY  = "ebs.lockpolicy"
+	EBS_LOCK_TIMEOUT = "ebs.locktimeout"
+
+	// What to do when the volume is locked by another instance
+	LOCK_POLICY_FAIL  = "fail"
+	LOCK_POLICY_WAIT  = "wait"
+	LOCK_POLICY_FORCE = "force"
+
+	DEFAULT_LOCK_POLICY  = LOCK_POLICY_FAIL
+	DEFAULT_LOCK_TIMEOUT = 5 * time.Minute
+
+	// Tags of EBS volume recording the instance attaching it
+	TAG_LOCK_OWNER    = "ConvoyLockOwner"
+	TAG_LOCK_ACQUIRED = "ConvoyLockAcquiredAt"
+)
+
+var (
+	// Tags are not updated atomically, so the lock is only acquired if it's
+	// still ours after other instances had the chance to overwrite it
+	lockSettlePeriod = 2 * time.Second
+	lockPollInterval = RETRY_INTERVAL * time.Second
+)
+
+func getLockConfig(config map[string]string) (string, time.Duration, error) {
+	policy := config[EBS_LOCK_POLICY]
+	if policy == "" {
+		policy = DEFAULT_LOCK_POLICY
+	}
+	if policy != LOCK_POLICY_FAIL && policy != LOCK_POLICY_WAIT && policy != LOCK_POLICY_FORCE {
+		return "", 0, fmt.Errorf("Invalid %v %v, must be %v, %v or %v",
+			EBS_LOCK_POLICY, policy, LOCK_POLICY_FAIL, LOCK_POLICY_WAIT, LOCK_POLICY_FORCE)
+	}
+	timeout := DEFAULT_LOCK_TIMEOUT
+	if config[EBS_LOCK_TIMEOUT] != "" {
+		var err error
+		timeout, err = time.ParseDuration(config[EBS_LOCK_TIMEOUT])
+		if err != nil || timeout <= 0 {
+			return "", 0, fmt.Errorf("Invalid %v %v, must be a positive duration, e.g. 5m", EBS_LOCK_TIMEOUT, config[EBS_LOCK_TIMEOUT])
+		}
+	}
+	return policy, timeout, nil
+}
+
+// isInstanceDead returns true if the instance can no longer use the volume,
+// which is the case if it's stopped, being terminated or doesn't exist
+func isInstanceDead(state string) bool {
+	return state == "" || state == ec2.InstanceStateNameStopped ||
+		state == ec2.InstanceStateNameShuttingDown || state == ec2.InstanceStateNameTerminated
+}
+
+// getLockHolder returns the instance using the volume, which is the one it's
+// attached to, or the owner of the lock if it's not attached yet
+func getLockHolder(volume *ec2.Volume, tags map[string]string) (string, bool, error) {
+	for _, attachment := range volume.Attachments {
+		if instanceID := aws.StringValue(attachment.InstanceId); instanceID != "" {
+			return instanceID, true, nil
+		}
+	}
+	if aws.StringValue(volume.State) != ec2.VolumeStateAvailable {
+		return "", false, util.NewConvoyDriverErr(fmt.Errorf("Volume (id=%v) is in an unexpected state=%v expected state=%v", aws.StringValue(volume.VolumeId), aws.StringValue(volume.State), ec2.VolumeStateAvailable), util.ErrVolumeExistsCode)
+	}
+	return tags[TAG_LOCK_OWNER], false, nil
+}
+
+/*
+acquireVolumeLock makes sure the current instance is the only one attaching
+the EBS volume, by recording it in the tags of volume. If the volume is used
+by another instance, which is either attached to it or owns the lock,
+LockPolicy decides what to do:
+
+fail: Return an error naming the other instance.
+
+wait: Wait up to LockTimeout for the other instance to release the volume.
+
+force: Force detach the volume if the other instance is dead, i.e. stopped
+or terminated. Volumes used by a running instance are never taken over.
+
+Locks of dead instances are dropped regardless of the policy if the volume
+is not attached to them.
+*/
+func (d *Driver) acquireVolumeLock(volumeID string) error {
+	instanceID := d.ebsService.GetInstanceID()
+	policy, timeout := d.LockPolicy, d.LockTimeout
+	if policy == "" {
+		policy = DEFAULT_LOCK_POLICY
+	}
+	if timeout == 0 {
+		timeout = DEFAULT_LOCK_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		volume, err := d.ebsService.GetVolume(volumeID)
+		if err != nil {
+			return err
+		}
+		tags, err := d.ebsService.GetTags(volumeID)
+		if err != nil {
+			return err
+		}
+		holder, attached, err := getLockHolder(volume, tags)
+		if err != nil {
+			return err
+		}
+
+		if holder == "" || holder == instanceID {
+			if tags[TAG_LOCK_OWNER] == instanceID {
+				return nil
+			}
+			if err := d.ebsService.AddTags(volumeID, map[string]string{
+				TAG_LOCK_OWNER:    instanceID,
+				TAG_LOCK_ACQUIRED: time.Now().String(),
+			}); err != nil {
+				return err
+			}
+			time.Sleep(lockSettlePeriod)
+			if tags, err = d.ebsService.GetTags(volumeID); err != nil {
+				return err
+			}
+			if tags[TAG_LOCK_OWNER] == instanceID {
+				log.Debugf("Acquired lock of volume=%v", volumeID)
+				return nil
+			}
+			holder, attached = tags[TAG_LOCK_OWNER], false
+			log.Debugf("Lost the race for lock of volume=%v to instance=%v", volumeID, holder)
+			if holder == "" {
+				continue
+			}
+		}
+
+		state, err := d.ebsService.GetInstanceState(holder)
+		if err != nil {
+			return err
+		}
+		if isInstanceDead(state) && (!attached || policy == LOCK_POLICY_FORCE) {
+			if attached {
+				log.Warnf("Force detaching volume=%v from dead instance=%v in state=%q", volumeID, holder, state)
+				if err := d.ebsService.ForceDetachVolume(volumeID, holder); err != nil {
+					return err
+				}
+				if err := d.UpdateTags(volumeID, map[string]string{
+					"ForceDetachedFrom": holder,
+					"ForceDetachedAt":   time.Now().String(),
+				}); err != nil {
+					log.Warnf("Failed adding force detach tracking tags to volume=%v: %v", volumeID, err)
+				}
+			} else {
+				log.Warnf("Dropping lock of volume=%v held by dead instance=%v in state=%q", volumeID, holder, state)
+			}
+			if err := d.ebsService.DeleteTags(volumeID, map[string]string{TAG_LOCK_OWNER: holder}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if policy == LOCK_POLICY_WAIT && time.Now().Before(deadline) {
+			log.Debugf("Waiting for instance=%v to release volume=%v", holder, volumeID)
+			time.Sleep(lockPollInterval)
+			continue
+		}
+		message := fmt.Sprintf("EBS volume=%v is used by instance=%v in state=%q", volumeID, holder, state)
+		if policy == LOCK_POLICY_WAIT {
+			message += fmt.Sprintf(", timed out after %v waiting for it to be released", timeout)
+		} else if isInstanceDead(state) {
+			message += fmt.Sprintf(", set %v to %v to force detach it", EBS_LOCK_POLICY, LOCK_POLICY_FORCE)
+		}
+		return util.NewConvoyDriverErr(errors.New(message), util.ErrVolumeInUseCode)
+	}
+}
+
+// releaseVolumeLock drops the lock of volume if it's still held by the
+// current instance
+func (d *Driver) releaseVolumeLock(volumeID string) error {
+	return d.ebsService.DeleteTags(volumeID, map[string]string{
+		TAG_LOCK_OWNER: d.ebsService.GetInstanceID(),
+	})
+}
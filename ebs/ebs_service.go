@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -13,6 +14,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/rancher/convoy/util"
@@ -39,7 +41,10 @@ type EBS interface {
 	GetVolumeByName(string, string) (*ec2.Volume, error)
 	FindFreeDeviceForAttach() (string, error)
 	AttachVolume(string, int64) (string, error)
+	ResizeVolume(string, int64) error
 	DetachVolume(string) error
+	ForceDetachVolume(string, string) error
+	GetInstanceState(string) (string, error)
 	GetMostRecentSnapshot(string, string, ...*ec2.Filter) (*ec2.Snapshot, error)
 	GetMostRecentVolume(string, string, ...*ec2.Filter) (*ec2.Volume, error)
 	LaunchSnapshot(string, string, map[string]string) (string, error)
@@ -51,6 +56,7 @@ type EBS interface {
 	DeleteSnapshotWithRegion(string, string) error
 	DeleteSnapshot(string) error
 	CopySnapshot(string, string) (string, error)
+	EncryptSnapshot(string, string) (string, error)
 	AddTags(string, map[string]string) error
 	DeleteTags(string, map[string]string) error
 	GetTags(string) (map[string]string, error)
@@ -66,8 +72,10 @@ type ebsService struct {
 }
 
 type CreateEBSVolumeRequest struct {
-	Size       int64
-	IOPS       int64
+	Size int64
+	IOPS int64
+	// Throughput in MiB/s, only for gp3
+	Throughput int64
 	SnapshotID string
 	VolumeType string
 	Tags       map[string]string
@@ -298,11 +306,8 @@ func (s *ebsService) CreateVolume(request *CreateEBSVolumeRequest) (string, erro
 		if err := checkVolumeType(volumeType); err != nil {
 			return "", util.NewConvoyDriverErr(err, util.ErrInvalidRequestCode)
 		}
-		if volumeType == "io1" && iops == 0 {
-			return "", util.NewConvoyDriverErr(errors.New("Invalid IOPS for volume type io1"), util.ErrInvalidRequestCode)
-		}
-		if volumeType != "io1" && iops != 0 {
-			return "", util.NewConvoyDriverErr(errors.New("IOPS only valid for volume type io1"), util.ErrInvalidRequestCode)
+		if err := checkVolumePerformance(volumeType, ebsSize, iops, request.Throughput); err != nil {
+			return "", util.NewConvoyDriverErr(err, util.ErrInvalidRequestCode)
 		}
 		params.VolumeType = aws.String(volumeType)
 		if iops != 0 {
@@ -310,7 +315,11 @@ func (s *ebsService) CreateVolume(request *CreateEBSVolumeRequest) (string, erro
 		}
 	}
 
-	ec2Volume, err := s.ec2Client.CreateVolume(params)
+	req, ec2Volume := s.ec2Client.CreateVolumeRequest(params)
+	if request.Throughput != 0 {
+		req.Handlers.Build.PushBack(addThroughputParam(request.Throughput))
+	}
+	err := req.Send()
 	if err != nil {
 		return "", parseAwsError(err)
 	}
@@ -333,6 +342,28 @@ func (s *ebsService) CreateVolume(request *CreateEBSVolumeRequest) (string, erro
 	return volumeID, nil
 }
 
+// addThroughputParam adds Throughput to the built CreateVolume query, since
+// the field is missing in CreateVolumeInput of the SDK in use
+func addThroughputParam(throughput int64) func(*request.Request) {
+	return func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			r.Error = err
+			return
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			r.Error = err
+			return
+		}
+		values.Set("Throughput", strconv.FormatInt(throughput, 10))
+		r.SetBufferBody([]byte(values.Encode()))
+	}
+}
+
 func (s *ebsService) DeleteVolume(volumeID string) error {
 	params := &ec2.DeleteVolumeInput{
 		VolumeId: aws.String(volumeID),
@@ -401,6 +432,45 @@ func (s *ebsService) GetVolume(volumeID string) (*ec2.Volume, error) {
 	return volumes.Volumes[0], nil
 }
 
+// ResizeVolume grows the EBS volume to size GiB. It returns once the new size
+// is usable by the instance, i.e. the modification is optimizing or completed.
+func (s *ebsService) ResizeVolume(volumeID string, size int64) error {
+	params := &ec2.ModifyVolumeInput{
+		VolumeId: aws.String(volumeID),
+		Size:     aws.Int64(size),
+	}
+	if _, err := s.ec2Client.ModifyVolume(params); err != nil {
+		return parseAwsError(err)
+	}
+
+	timeChan := time.NewTimer(time.Second * 301).C
+	tickChan := time.NewTicker(time.Second * 5).C
+	for {
+		resp, err := s.ec2Client.DescribeVolumesModifications(&ec2.DescribeVolumesModificationsInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		})
+		if err != nil {
+			return parseAwsError(err)
+		}
+		if len(resp.VolumesModifications) != 0 {
+			modification := resp.VolumesModifications[0]
+			switch aws.StringValue(modification.ModificationState) {
+			case ec2.VolumeModificationStateOptimizing, ec2.VolumeModificationStateCompleted:
+				return nil
+			case ec2.VolumeModificationStateFailed:
+				return util.NewConvoyDriverErr(fmt.Errorf("Failed to resize volume=%v: %v",
+					volumeID, aws.StringValue(modification.StatusMessage)), util.ErrGenericFailureCode)
+			}
+		}
+		select {
+		case <-timeChan:
+			return util.NewConvoyDriverErr(fmt.Errorf("Timed out waiting for volume=%v to be resized", volumeID), util.ErrGenericFailureCode)
+		case <-tickChan:
+			log.Debugf("Still waiting for volume=%v to be resized..", volumeID)
+		}
+	}
+}
+
 func volumesToString(volumes []*ec2.Volume) string {
 	var volStrings []string
 	for _, v := range volumes {
@@ -670,6 +740,45 @@ func (s *ebsService) DetachVolume(volumeID string) error {
 	return detachErr
 }
 
+// ForceDetachVolume detaches volume from another instance, which may not
+// be able to do it by itself
+func (s *ebsService) ForceDetachVolume(volumeID, instanceID string) error {
+	params := &ec2.DetachVolumeInput{
+		VolumeId:   aws.String(volumeID),
+		InstanceId: aws.String(instanceID),
+		Force:      aws.Bool(true),
+	}
+	if _, err := s.ec2Client.DetachVolume(params); err != nil {
+		return parseAwsError(err)
+	}
+	return s.waitForVolumeTransition(volumeID, ec2.VolumeStateInUse, ec2.VolumeStateAvailable)
+}
+
+// GetInstanceState returns the state of instance, or empty string if it
+// doesn't exist
+func (s *ebsService) GetInstanceState(instanceID string) (string, error) {
+	params := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{
+			aws.String(instanceID),
+		},
+	}
+	resp, err := s.ec2Client.DescribeInstances(params)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidInstanceID.NotFound" {
+			return "", nil
+		}
+		return "", parseAwsError(err)
+	}
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.StringValue(instance.InstanceId) == instanceID && instance.State != nil {
+				return aws.StringValue(instance.State.Name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
 func (s *ebsService) GetMostRecentSnapshot(volumeName string, dcName string, filters ...*ec2.Filter) (*ec2.Snapshot, error) {
 	snapshots, err := s.GetSnapshots(volumeName, dcName, filters...)
 	if err != nil {
@@ -701,7 +810,8 @@ func (s *ebsService) GetMostRecentVolume(volumeName string, dcName string, filte
 	volumeInput.Filters = append(volumeInput.Filters, filters...)
 	log.Debugf("GetMostRecentVolume API filters Name=%v DCName=%v", volumeName, dcName)
 	req, volOutput := s.ec2Client.DescribeVolumesRequest(volumeInput)
-	if err := req.Send(); err != nil {
+	err := req.Send()
+	if err != nil {
 		return nil, util.NewConvoyDriverErr(err, util.ErrVolumeNotAvailableCode)
 	}
 	sort.Sort(sort.Reverse(VolumeByCreateTime(volOutput.Volumes)))
@@ -747,7 +857,8 @@ func (s *ebsService) GetSnapshots(volumeName string, dcName string, filters ...*
 	}
 	snapshotInput.Filters = append(snapshotInput.Filters, filters...)
 	req, snapOutput := s.ec2Client.DescribeSnapshotsRequest(snapshotInput)
-	if err := req.Send(); err != nil {
+	err := req.Send()
+	if err != nil {
 		return []*ec2.Snapshot{}, err
 	}
 	sort.Sort(SnapshotByTime(snapOutput.Snapshots))
@@ -842,6 +953,27 @@ func (s *ebsService) CopySnapshot(snapshotID, srcRegion string) (string, error)
 	return *resp.SnapshotId, nil
 }
 
+// EncryptSnapshot copies the snapshot in current region to an encrypted one,
+// by the KMS key kmsKeyID, or the default key of account for EBS if it's empty
+func (s *ebsService) EncryptSnapshot(snapshotID, kmsKeyID string) (string, error) {
+	params := &ec2.CopySnapshotInput{
+		SourceRegion:     aws.String(s.Region),
+		SourceSnapshotId: aws.String(snapshotID),
+		Description:      aws.String(fmt.Sprintf("Convoy: Encrypted copy of snapshot=%v", snapshotID)),
+		Encrypted:        aws.Bool(true),
+	}
+	if kmsKeyID != "" {
+		params.KmsKeyId = aws.String(kmsKeyID)
+	}
+
+	resp, err := s.ec2Client.CopySnapshot(params)
+	if err != nil {
+		return "", parseAwsError(err)
+	}
+
+	return *resp.SnapshotId, nil
+}
+
 func (s *ebsService) AddTags(resourceID string, tags map[string]string) error {
 	if tags == nil {
 		return nil
@@ -26,6 +26,11 @@ type EbsMock struct {
 
 	Snapshot *ec2.Snapshot
 
+	TagsMapById    map[string]map[string]string
+	InstanceStates map[string]string
+
+	CreateVolumeRequests []*CreateEBSVolumeRequest
+
 	*Device
 }
 
@@ -40,6 +45,8 @@ func NewEbsMock() *EbsMock {
 		VolumeMapByName:    make(map[string]*ec2.Volume),
 		SnapshotMapById:    make(map[string]*ec2.Snapshot),
 		SnapshotsMapByName: make(map[string][]*ec2.Snapshot),
+		TagsMapById:        make(map[string]map[string]string),
+		InstanceStates:     make(map[string]string),
 	}
 }
 
@@ -92,6 +99,7 @@ func (e *EbsMock) GetAvailabilityZones(...*ec2.Filter) ([]*string, error) {
 }
 
 func (e *EbsMock) CreateVolume(createVolume *CreateEBSVolumeRequest) (string, error) {
+	e.CreateVolumeRequests = append(e.CreateVolumeRequests, createVolume)
 	return "newVolumeId", nil
 }
 
@@ -132,10 +140,33 @@ func (e *EbsMock) AttachVolume(id string, size int64) (string, error) {
 	return "/dev/sda", nil
 }
 
+func (e *EbsMock) ResizeVolume(id string, size int64) error {
+	vol, err := e.getVolumeById(id)
+	if err != nil {
+		return err
+	}
+	vol.Size = aws.Int64(size)
+	return nil
+}
+
 func (e *EbsMock) DetachVolume(id string) error {
 	return nil
 }
 
+func (e *EbsMock) ForceDetachVolume(id string, instanceID string) error {
+	vol, err := e.getVolumeById(id)
+	if err != nil {
+		return err
+	}
+	vol.Attachments = nil
+	vol.State = aws.String(ec2.VolumeStateAvailable)
+	return nil
+}
+
+func (e *EbsMock) GetInstanceState(instanceID string) (string, error) {
+	return e.InstanceStates[instanceID], nil
+}
+
 func (e *EbsMock) SetMostRecentSnapshot(snapshot *ec2.Snapshot) {
 	e.SnapshotMapById[*snapshot.SnapshotId] = snapshot
 	e.MostRecentSnapshot = snapshot
@@ -165,6 +196,9 @@ func (e *EbsMock) LaunchSnapshot(volumeId string, desc string, tag map[string]st
 		Encrypted:  volume.Encrypted,
 	}
 	e.SnapshotMapById["snap-a"] = snapshot
+	if err := e.AddTags("snap-a", tag); err != nil {
+		return "", err
+	}
 	return "snap-a", nil
 }
 
@@ -206,14 +240,47 @@ func (e *EbsMock) CopySnapshot(string, string) (string, error) {
 	return "snap-b", nil
 }
 
-func (e *EbsMock) AddTags(string, map[string]string) error {
+func (e *EbsMock) EncryptSnapshot(snapshotID, kmsKeyID string) (string, error) {
+	snapshot, err := e.getSnapshotById(snapshotID)
+	if err != nil {
+		return "", err
+	}
+	if kmsKeyID == "" {
+		kmsKeyID = "arn:aws:kms:us-east-1:123456789012:key/default"
+	}
+	e.SnapshotMapById["snap-encrypted"] = &ec2.Snapshot{
+		SnapshotId: aws.String("snap-encrypted"),
+		VolumeSize: snapshot.VolumeSize,
+		Encrypted:  aws.Bool(true),
+		KmsKeyId:   aws.String(kmsKeyID),
+	}
+	return "snap-encrypted", nil
+}
+
+func (e *EbsMock) AddTags(id string, tags map[string]string) error {
+	if e.TagsMapById[id] == nil {
+		e.TagsMapById[id] = map[string]string{}
+	}
+	for k, v := range tags {
+		e.TagsMapById[id][k] = v
+	}
 	return nil
 }
 
-func (e *EbsMock) DeleteTags(string, map[string]string) error {
+// DeleteTags only deletes tags of the same values, like EC2 does
+func (e *EbsMock) DeleteTags(id string, tags map[string]string) error {
+	for k, v := range tags {
+		if value, ok := e.TagsMapById[id][k]; ok && (v == "" || v == value) {
+			delete(e.TagsMapById[id], k)
+		}
+	}
 	return nil
 }
 
-func (e *EbsMock) GetTags(string) (map[string]string, error) {
-	return map[string]string{}, nil
+func (e *EbsMock) GetTags(id string) (map[string]string, error) {
+	tags := map[string]string{}
+	for k, v := range e.TagsMapById[id] {
+		tags[k] = v
+	}
+	return tags, nil
 }
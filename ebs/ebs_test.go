@@ -4,7 +4,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	. "github.com/rancher/convoy/convoydriver"
+	"github.com/rancher/convoy/util"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"sync"
@@ -388,3 +390,427 @@ func TestRandomCombinations(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckVolumePerformance(t *testing.T) {
+	require.Nil(t, checkVolumePerformance("gp2", 5, 0, 0))
+	require.NotNil(t, checkVolumePerformance("gp2", 5, 100, 0))
+	require.NotNil(t, checkVolumePerformance("gp2", 5, 0, 125))
+
+	require.Nil(t, checkVolumePerformance("io1", 5, 250, 0))
+	require.NotNil(t, checkVolumePerformance("io1", 5, 0, 0))
+	require.NotNil(t, checkVolumePerformance("io1", 5, 50, 0))
+	require.NotNil(t, checkVolumePerformance("io1", 5, 300, 0))
+	require.NotNil(t, checkVolumePerformance("io1", 5, 250, 125))
+
+	// Baseline of gp3 is available regardless of size
+	require.Nil(t, checkVolumePerformance("gp3", 1, 0, 0))
+	require.Nil(t, checkVolumePerformance("gp3", 1, 3000, 750))
+	require.NotNil(t, checkVolumePerformance("gp3", 1, 0, 751))
+	require.Nil(t, checkVolumePerformance("gp3", 10, 5000, 1000))
+	require.NotNil(t, checkVolumePerformance("gp3", 8, 5000, 0))
+	require.NotNil(t, checkVolumePerformance("gp3", 100, 2000, 0))
+	require.NotNil(t, checkVolumePerformance("gp3", 100, 20000, 0))
+	require.NotNil(t, checkVolumePerformance("gp3", 100, 16000, 100))
+	require.NotNil(t, checkVolumePerformance("gp3", 100, 16000, 1001))
+	require.NotNil(t, checkVolumePerformance("gp3", 100, 3000, 1000))
+}
+
+func TestGetVolumePerformance(t *testing.T) {
+	d := &Driver{
+		Device: Device{
+			DefaultVolumeType: "gp2",
+		},
+	}
+	opts := map[string]string{
+		OPT_VOLUME_TYPE:       "gp3",
+		OPT_VOLUME_IOPS:       "6000",
+		OPT_VOLUME_THROUGHPUT: "500",
+	}
+	p, err := d.getVolumePerformance(opts, 20*GB)
+	require.Nil(t, err)
+	require.Equal(t, "gp3", p.volumeType)
+	require.Equal(t, int64(6000), p.iops)
+	require.Equal(t, int64(500), p.throughput)
+
+	// Limits are checked against size rounded up to GB
+	_, err = d.getVolumePerformance(opts, 12*GB-1)
+	require.Nil(t, err)
+	_, err = d.getVolumePerformance(opts, 11*GB)
+	require.NotNil(t, err)
+
+	p, err = d.getVolumePerformance(map[string]string{}, 20*GB)
+	require.Nil(t, err)
+	require.Equal(t, "gp2", p.volumeType)
+
+	_, err = d.getVolumePerformance(map[string]string{OPT_VOLUME_THROUGHPUT: "500"}, 20*GB)
+	require.NotNil(t, err)
+}
+
+func attachVolume(volume *ec2.Volume, instanceID string) {
+	volume.State = aws.String(ec2.VolumeStateInUse)
+	volume.Attachments = []*ec2.VolumeAttachment{
+		{InstanceId: aws.String(instanceID)},
+	}
+}
+
+func TestVolumeLock(t *testing.T) {
+	lockSettlePeriod = 0
+	lockPollInterval = time.Millisecond
+
+	ebsMock := NewEbsMock()
+	ebsMock.InstanceId = "i-self"
+	ebsMock.InstanceStates["i-running"] = ec2.InstanceStateNameRunning
+	ebsMock.InstanceStates["i-stopped"] = ec2.InstanceStateNameStopped
+	volume := getVolume(MOCK_VOLUME_ID)
+	ebsMock.VolumeMapById[MOCK_VOLUME_ID] = volume
+	d := &Driver{
+		ebsService: ebsMock,
+		Device: Device{
+			LockPolicy:  LOCK_POLICY_FAIL,
+			LockTimeout: 10 * time.Millisecond,
+		},
+	}
+
+	// Free volume
+	require.Nil(t, d.acquireVolumeLock(MOCK_VOLUME_ID))
+	require.Equal(t, "i-self", ebsMock.TagsMapById[MOCK_VOLUME_ID][TAG_LOCK_OWNER])
+	require.Nil(t, d.acquireVolumeLock(MOCK_VOLUME_ID))
+	require.Nil(t, d.releaseVolumeLock(MOCK_VOLUME_ID))
+	require.Equal(t, "", ebsMock.TagsMapById[MOCK_VOLUME_ID][TAG_LOCK_OWNER])
+
+	// Locked by a running instance which is attaching the volume
+	ebsMock.AddTags(MOCK_VOLUME_ID, map[string]string{TAG_LOCK_OWNER: "i-running"})
+	err := d.acquireVolumeLock(MOCK_VOLUME_ID)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "used by instance=i-running")
+
+	d.LockPolicy = LOCK_POLICY_WAIT
+	err = d.acquireVolumeLock(MOCK_VOLUME_ID)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "timed out")
+
+	// Running instances are never force detached
+	d.LockPolicy = LOCK_POLICY_FORCE
+	attachVolume(volume, "i-running")
+	require.NotNil(t, d.acquireVolumeLock(MOCK_VOLUME_ID))
+	require.Equal(t, ec2.VolumeStateInUse, *volume.State)
+
+	// Stale lock of a dead instance is dropped regardless of policy
+	d.LockPolicy = LOCK_POLICY_FAIL
+	volume.State = aws.String(ec2.VolumeStateAvailable)
+	volume.Attachments = nil
+	ebsMock.AddTags(MOCK_VOLUME_ID, map[string]string{TAG_LOCK_OWNER: "i-terminated"})
+	require.Nil(t, d.acquireVolumeLock(MOCK_VOLUME_ID))
+	require.Equal(t, "i-self", ebsMock.TagsMapById[MOCK_VOLUME_ID][TAG_LOCK_OWNER])
+	require.Nil(t, d.releaseVolumeLock(MOCK_VOLUME_ID))
+
+	// Volume attached to a dead instance is only force detached by policy
+	attachVolume(volume, "i-stopped")
+	ebsMock.AddTags(MOCK_VOLUME_ID, map[string]string{TAG_LOCK_OWNER: "i-stopped"})
+	err = d.acquireVolumeLock(MOCK_VOLUME_ID)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), EBS_LOCK_POLICY)
+	require.Equal(t, ec2.VolumeStateInUse, *volume.State)
+
+	d.LockPolicy = LOCK_POLICY_FORCE
+	require.Nil(t, d.acquireVolumeLock(MOCK_VOLUME_ID))
+	require.Equal(t, ec2.VolumeStateAvailable, *volume.State)
+	require.Equal(t, "i-self", ebsMock.TagsMapById[MOCK_VOLUME_ID][TAG_LOCK_OWNER])
+	require.Equal(t, "i-stopped", ebsMock.TagsMapById[MOCK_VOLUME_ID]["ForceDetachedFrom"])
+
+	// Only the lock of current instance is released
+	ebsMock.AddTags(MOCK_VOLUME_ID, map[string]string{TAG_LOCK_OWNER: "i-running"})
+	require.Nil(t, d.releaseVolumeLock(MOCK_VOLUME_ID))
+	require.Equal(t, "i-running", ebsMock.TagsMapById[MOCK_VOLUME_ID][TAG_LOCK_OWNER])
+}
+
+func TestGetLockConfig(t *testing.T) {
+	policy, timeout, err := getLockConfig(map[string]string{})
+	require.Nil(t, err)
+	require.Equal(t, DEFAULT_LOCK_POLICY, policy)
+	require.Equal(t, DEFAULT_LOCK_TIMEOUT, timeout)
+
+	policy, timeout, err = getLockConfig(map[string]string{
+		EBS_LOCK_POLICY:  LOCK_POLICY_WAIT,
+		EBS_LOCK_TIMEOUT: "30s",
+	})
+	require.Nil(t, err)
+	require.Equal(t, LOCK_POLICY_WAIT, policy)
+	require.Equal(t, 30*time.Second, timeout)
+
+	_, _, err = getLockConfig(map[string]string{EBS_LOCK_POLICY: "steal"})
+	require.NotNil(t, err)
+	_, _, err = getLockConfig(map[string]string{EBS_LOCK_TIMEOUT: "-1s"})
+	require.NotNil(t, err)
+}
+
+func TestImportVolume(t *testing.T) {
+	lockSettlePeriod = 0
+	root, err := ioutil.TempDir("", "convoy-ebs")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	ebsMock := NewEbsMock()
+	ebsMock.AvailabilityZone = "az-2"
+	ebsMock.InstanceId = "i-self"
+	volume := getVolume("vol-0abc")
+	ebsMock.VolumeMapById["vol-0abc"] = volume
+	d := &Driver{
+		mutex:      new(sync.RWMutex),
+		ebsService: ebsMock,
+		Device: Device{
+			Root: root,
+		},
+	}
+	req := func(source string) Request {
+		return Request{
+			Name:    MOCK_VOLUME_NAME,
+			Options: map[string]string{OPT_IMPORT_SOURCE: source},
+		}
+	}
+
+	err = d.ImportVolume(req(MOCK_VOLUME_ID))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid EBS volume id")
+
+	// Volumes can only be attached in the same availability zone
+	err = d.ImportVolume(req("vol-0abc"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "availability zone=az-1")
+
+	// Lock is released if the volume cannot be attached
+	ebsMock.AvailabilityZone = "az-1"
+	volume.State = aws.String(ec2.VolumeStateCreating)
+	err = d.ImportVolume(req("vol-0abc"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unexpected state")
+	require.Equal(t, "", ebsMock.TagsMapById["vol-0abc"][TAG_LOCK_OWNER])
+
+	exists, err := util.ObjectExists(d.blankVolume(MOCK_VOLUME_NAME))
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestFenceVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "convoy-ebs")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	ebsMock := NewEbsMock()
+	ebsMock.InstanceId = "i-self"
+	volume := getVolume(MOCK_VOLUME_ID)
+	attachVolume(volume, "i-self")
+	ebsMock.VolumeMapById[MOCK_VOLUME_ID] = volume
+	ebsMock.AddTags(MOCK_VOLUME_ID, map[string]string{TAG_LOCK_OWNER: "i-self"})
+	d := &Driver{
+		mutex:      new(sync.RWMutex),
+		ebsService: ebsMock,
+		Device: Device{
+			Root: root,
+		},
+	}
+	v := d.blankVolume(MOCK_VOLUME_NAME)
+	v.EBSID = MOCK_VOLUME_ID
+	require.Nil(t, util.ObjectSave(v))
+
+	req := Request{Name: MOCK_VOLUME_NAME, Options: map[string]string{}}
+	require.Nil(t, d.FenceVolume(req))
+	require.Equal(t, ec2.VolumeStateAvailable, *volume.State)
+	require.Empty(t, volume.Attachments)
+	require.Equal(t, "", ebsMock.TagsMapById[MOCK_VOLUME_ID][TAG_LOCK_OWNER])
+	require.Equal(t, "i-self", ebsMock.TagsMapById[MOCK_VOLUME_ID]["FencedFrom"])
+
+	exists, err := util.ObjectExists(v)
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	require.NotNil(t, d.FenceVolume(req))
+}
+
+func TestCustomTags(t *testing.T) {
+	d := &Driver{
+		Device: Device{
+			DefaultTags: map[string]string{"CostCenter": "storage", "Team": "infra"},
+		},
+	}
+	tags, err := d.customTags(nil, map[string]string{OPT_TAGS: "Team=db,Env=prod"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"CostCenter": "storage", "Team": "db", "Env": "prod"}, tags)
+
+	// Tags of request override the inherited ones
+	tags, err = d.customTags(map[string]string{"Env": "prod", "App": "web"}, map[string]string{OPT_TAGS: "Env=staging"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"CostCenter": "storage", "Team": "infra", "Env": "staging", "App": "web"}, tags)
+
+	for _, invalid := range []string{"Name=vol", "aws:createdBy=me", "Team", TAG_LOCK_OWNER + "=i-self"} {
+		_, err = d.customTags(nil, map[string]string{OPT_TAGS: invalid})
+		require.NotNil(t, err, invalid)
+	}
+
+	dev, err := getDefaultDevice("/tmp", map[string]string{EBS_DEFAULT_TAGS: "CostCenter=storage"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"CostCenter": "storage"}, dev.DefaultTags)
+	_, err = getDefaultDevice("/tmp", map[string]string{EBS_DEFAULT_TAGS: "DCName=dc1"})
+	require.NotNil(t, err)
+}
+
+func TestSnapshotTags(t *testing.T) {
+	root, err := ioutil.TempDir("", "convoy-ebs")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	ebsMock := NewEbsMock()
+	ebsMock.VolumeMapById[MOCK_VOLUME_ID] = getVolume(MOCK_VOLUME_ID)
+	d := &Driver{
+		mutex:      new(sync.RWMutex),
+		ebsService: ebsMock,
+		Device: Device{
+			Root:        root,
+			DefaultTags: map[string]string{"CostCenter": "storage"},
+		},
+	}
+	volume := d.blankVolume(MOCK_VOLUME_NAME)
+	volume.EBSID = MOCK_VOLUME_ID
+	volume.Snapshots = map[string]Snapshot{}
+	volume.Tags = map[string]string{"CostCenter": "db", "Team": "infra"}
+	require.Nil(t, util.ObjectSave(volume))
+
+	require.Nil(t, d.CreateSnapshot(Request{
+		Name: "snap1",
+		Options: map[string]string{
+			OPT_VOLUME_NAME: MOCK_VOLUME_NAME,
+			OPT_TAGS:        "Backup=nightly",
+		},
+	}))
+	require.Equal(t, map[string]string{
+		"CostCenter":         "db",
+		"Team":               "infra",
+		"Backup":             "nightly",
+		"ConvoyVolumeName":   MOCK_VOLUME_NAME,
+		"ConvoySnapshotName": "snap1",
+	}, ebsMock.TagsMapById["snap-a"])
+}
+
+func TestEncryptedVolume(t *testing.T) {
+	root, err := ioutil.TempDir("", "convoy-ebs")
+	require.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	ebsMock := NewEbsMock()
+	d := &Driver{
+		mutex:      new(sync.RWMutex),
+		ebsService: ebsMock,
+		Device: Device{
+			Root:              root,
+			DefaultVolumeSize: MOCK_VOLUME_SIZE,
+			DefaultVolumeType: "gp2",
+		},
+	}
+
+	_, err = d.BuildNewVolume(&BuildArgs{opts: map[string]string{OPT_ENCRYPTED: "true", OPT_KMS_KEY_ID: "key-1"}})
+	require.Nil(t, err)
+	require.True(t, ebsMock.CreateVolumeRequests[0].Encrypted)
+	require.Equal(t, "key-1", ebsMock.CreateVolumeRequests[0].KmsKeyID)
+
+	// Unencrypted snapshot is copied with encryption, and the copy is
+	// deleted once the volume is created
+	snapshot := getSnapshot("snap-plain")
+	snapshot.Encrypted = aws.Bool(false)
+	snapshot.VolumeSize = aws.Int64(MOCK_VOLUME_SIZE_IN_GB)
+	ebsMock.SnapshotMapById["snap-plain"] = snapshot
+	_, err = d.BuildFromSnapshot(snapshot, &BuildArgs{opts: map[string]string{OPT_KMS_KEY_ID: "key-1"}})
+	require.Nil(t, err)
+	r := ebsMock.CreateVolumeRequests[1]
+	require.Equal(t, "snap-encrypted", r.SnapshotID)
+	require.True(t, r.Encrypted)
+	_, exists := ebsMock.SnapshotMapById["snap-encrypted"]
+	require.False(t, exists)
+
+	// Without encryption requested the volume is the same as snapshot
+	_, err = d.BuildFromSnapshot(snapshot, &BuildArgs{opts: map[string]string{}})
+	require.Nil(t, err)
+	r = ebsMock.CreateVolumeRequests[2]
+	require.Equal(t, "snap-plain", r.SnapshotID)
+	require.False(t, r.Encrypted)
+
+	// Snapshot encrypted by the requested key is used as is
+	snapshot.Encrypted = aws.Bool(true)
+	snapshot.KmsKeyId = aws.String("arn:aws:kms:us-east-1:123456789012:key/key-1")
+	_, err = d.BuildFromSnapshot(snapshot, &BuildArgs{opts: map[string]string{OPT_KMS_KEY_ID: "key-1"}})
+	require.Nil(t, err)
+	require.Equal(t, "snap-plain", ebsMock.CreateVolumeRequests[3].SnapshotID)
+	_, err = d.BuildFromSnapshot(snapshot, &BuildArgs{opts: map[string]string{OPT_KMS_KEY_ID: "key-2"}})
+	require.Nil(t, err)
+	require.Equal(t, "snap-encrypted", ebsMock.CreateVolumeRequests[4].SnapshotID)
+
+	// Defaults of driver apply if the volume doesn't specify encryption
+	d.DefaultEncrypted = true
+	encrypted, kmsKeyID := d.volumeEncryption(map[string]string{})
+	require.True(t, encrypted)
+	require.Equal(t, "", kmsKeyID)
+	d.DefaultEncrypted = false
+	d.DefaultKmsKeyID = "key-3"
+	encrypted, kmsKeyID = d.volumeEncryption(map[string]string{})
+	require.True(t, encrypted)
+	require.Equal(t, "key-3", kmsKeyID)
+
+	err = d.CreateVolume(Request{
+		Name: MOCK_VOLUME_NAME,
+		Options: map[string]string{
+			OPT_VOLUME_DRIVER_ID: MOCK_VOLUME_ID,
+			OPT_ENCRYPTED:        "true",
+		},
+	})
+	require.NotNil(t, err)
+}
+
+func TestBuildFromVolume(t *testing.T) {
+	ebsMock := NewEbsMock()
+	ebsVolume := getVolume(MOCK_VOLUME_ID)
+	ebsVolume.VolumeType = aws.String("gp3")
+	ebsVolume.Iops = aws.Int64(3000)
+	ebsMock.VolumeMapById[MOCK_VOLUME_ID] = ebsVolume
+	d := &Driver{
+		mutex:      new(sync.RWMutex),
+		ebsService: ebsMock,
+		Device: Device{
+			DefaultVolumeType: "gp2",
+		},
+	}
+	source := d.blankVolume(MOCK_VOLUME_NAME)
+	source.EBSID = MOCK_VOLUME_ID
+	source.Throughput = 250
+	source.Tags = map[string]string{"Team": "infra"}
+
+	// Clone has the performance of source, and the temporary snapshot is
+	// deleted once the volume is created
+	_, err := d.buildFromVolume(source, &BuildArgs{opts: map[string]string{}})
+	require.Nil(t, err)
+	r := ebsMock.CreateVolumeRequests[0]
+	require.Equal(t, "snap-a", r.SnapshotID)
+	require.Equal(t, MOCK_VOLUME_SIZE, r.Size)
+	require.Equal(t, "gp3", r.VolumeType)
+	require.Equal(t, int64(3000), r.IOPS)
+	require.Equal(t, int64(250), r.Throughput)
+	require.True(t, r.Encrypted)
+	require.Equal(t, map[string]string{"Team": "infra"}, ebsMock.TagsMapById["snap-a"])
+	_, exists := ebsMock.SnapshotMapById["snap-a"]
+	require.False(t, exists)
+
+	// Unless another type is requested
+	_, err = d.buildFromVolume(source, &BuildArgs{opts: map[string]string{OPT_VOLUME_TYPE: "st1"}})
+	require.Nil(t, err)
+	r = ebsMock.CreateVolumeRequests[1]
+	require.Equal(t, "st1", r.VolumeType)
+	require.Equal(t, int64(0), r.IOPS)
+
+	// Baseline IOPS of gp2 is not provisioned
+	ebsVolume.VolumeType = aws.String("gp2")
+	ebsVolume.Iops = aws.Int64(100)
+	source.Throughput = 0
+	_, err = d.buildFromVolume(source, &BuildArgs{opts: map[string]string{}})
+	require.Nil(t, err)
+	r = ebsMock.CreateVolumeRequests[2]
+	require.Equal(t, "gp2", r.VolumeType)
+	require.Equal(t, int64(0), r.IOPS)
+}
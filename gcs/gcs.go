@@ -0,0 +1,185 @@
+package gcs
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/objectstore"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "gcs"})
+)
+
+type GCSObjectStoreDriver struct {
+	destURL string
+	path    string
+	service GCSService
+}
+
+const (
+	KIND = "gcs"
+)
+
+func init() {
+	if err := objectstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (objectstore.ObjectStoreDriver, error) {
+	b := &GCSObjectStoreDriver{}
+
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	b.service.Bucket = u.Host
+	b.path = u.Path
+	if b.service.Bucket == "" || b.path == "" {
+		return nil, fmt.Errorf("Invalid URL. Must be gcs://bucket/path")
+	}
+
+	// Same as S3, leading '/' would result in an empty directory name
+	b.path = strings.TrimLeft(b.path, "/")
+
+	if err := b.service.Init(u.Query()); err != nil {
+		return nil, err
+	}
+
+	//Test connection
+	if _, err := b.List(""); err != nil {
+		return nil, err
+	}
+
+	b.destURL = KIND + "://" + b.service.Bucket + "/" + b.path
+	if query := objectstore.HTTPQuery(u.Query()); len(query) != 0 {
+		b.destURL += "?" + query.Encode()
+	}
+
+	log.Debugf("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func (g *GCSObjectStoreDriver) Kind() string {
+	return KIND
+}
+
+func (g *GCSObjectStoreDriver) GetURL() string {
+	return g.destURL
+}
+
+func (g *GCSObjectStoreDriver) updatePath(path string) string {
+	return filepath.Join(g.path, path)
+}
+
+func (g *GCSObjectStoreDriver) List(listPath string) ([]string, error) {
+	var result []string
+
+	path := g.updatePath(listPath) + "/"
+	objects, prefixes, err := g.service.ListObjects(path, "/")
+	if err != nil {
+		log.Error("Fail to list gcs: ", err)
+		return result, err
+	}
+
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return result, nil
+	}
+	result = []string{}
+	for _, obj := range objects {
+		r := strings.TrimPrefix(obj.Name, path)
+		if r != "" {
+			result = append(result, r)
+		}
+	}
+	for _, p := range prefixes {
+		r := strings.TrimPrefix(p, path)
+		r = strings.TrimSuffix(r, "/")
+		if r != "" {
+			result = append(result, r)
+		}
+	}
+
+	return result, nil
+}
+
+func (g *GCSObjectStoreDriver) FileExists(filePath string) bool {
+	return g.FileSize(filePath) >= 0
+}
+
+func (g *GCSObjectStoreDriver) FileSize(filePath string) int64 {
+	size, err := g.service.GetObjectSize(g.updatePath(filePath))
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func (g *GCSObjectStoreDriver) Remove(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = g.updatePath(name)
+	}
+	return g.service.DeleteObjects(paths)
+}
+
+func (g *GCSObjectStoreDriver) Read(src string) (io.ReadCloser, error) {
+	return g.service.GetObject(g.updatePath(src))
+}
+
+func (g *GCSObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return g.service.PutObject(g.updatePath(dst), rs, size)
+}
+
+func (g *GCSObjectStoreDriver) Upload(src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return g.service.PutObject(g.updatePath(dst), file, st.Size())
+}
+
+func (g *GCSObjectStoreDriver) Download(src, dst string) error {
+	if _, err := os.Stat(dst); err != nil {
+		os.Remove(dst)
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rc, err := g.service.GetObject(g.updatePath(src))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(f, rc)
+	return err
+}
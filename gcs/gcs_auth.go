@@ -0,0 +1,240 @@
+package gcs
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ENV_CREDENTIALS = "GOOGLE_APPLICATION_CREDENTIALS"
+
+	STORAGE_SCOPE     = "https://www.googleapis.com/auth/devstorage.read_write"
+	JWT_GRANT_TYPE    = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	DEFAULT_TOKEN_URI = "https://oauth2.googleapis.com/token"
+
+	CREDENTIALS_TYPE_SERVICE_ACCOUNT = "service_account"
+
+	// Refresh the token a bit earlier than it expires
+	TOKEN_EXPIRY_DELTA = time.Minute
+)
+
+var (
+	// The metadata server provides tokens of the service account attached
+	// to GCE instance, or the one bound by GKE workload identity
+	metadataEndpoint = "http://metadata.google.internal"
+)
+
+type token struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+
+	expiry time.Time
+}
+
+func (t *token) valid() bool {
+	return t != nil && t.AccessToken != "" && time.Now().Add(TOKEN_EXPIRY_DELTA).Before(t.expiry)
+}
+
+type tokenSource interface {
+	fetchToken() (*token, error)
+}
+
+// cachedTokenSource reuses a token until it's about to expire
+type cachedTokenSource struct {
+	source tokenSource
+	mutex  sync.Mutex
+	token  *token
+}
+
+func (c *cachedTokenSource) Token() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.token.valid() {
+		t, err := c.source.fetchToken()
+		if err != nil {
+			return "", err
+		}
+		c.token = t
+	}
+	return c.token.AccessToken, nil
+}
+
+type serviceAccountCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// serviceAccountTokenSource exchanges a self-signed JWT for access token,
+// using the key in service account JSON file
+type serviceAccountTokenSource struct {
+	credentials *serviceAccountCredentials
+	key         *rsa.PrivateKey
+}
+
+type metadataTokenSource struct{}
+
+// newTokenSource uses service account JSON file specified by
+// GOOGLE_APPLICATION_CREDENTIALS if set, otherwise falls back to metadata
+// server, which covers both GCE default service account and workload identity
+func newTokenSource() (*cachedTokenSource, error) {
+	file := os.Getenv(ENV_CREDENTIALS)
+	if file == "" {
+		log.Debug("Use GCE metadata server for GCS credentials")
+		return &cachedTokenSource{source: &metadataTokenSource{}}, nil
+	}
+	source, err := newServiceAccountTokenSource(file)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Use service account %v for GCS credentials", source.credentials.ClientEmail)
+	return &cachedTokenSource{source: source}, nil
+}
+
+func newServiceAccountTokenSource(file string) (*serviceAccountTokenSource, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	credentials := &serviceAccountCredentials{}
+	if err := json.Unmarshal(data, credentials); err != nil {
+		return nil, fmt.Errorf("Cannot parse GCS credentials file %v: %v", file, err)
+	}
+	if credentials.Type != CREDENTIALS_TYPE_SERVICE_ACCOUNT {
+		return nil, fmt.Errorf("Unsupported credentials type %v in %v, only %v is supported",
+			credentials.Type, file, CREDENTIALS_TYPE_SERVICE_ACCOUNT)
+	}
+	if credentials.ClientEmail == "" || credentials.PrivateKey == "" {
+		return nil, fmt.Errorf("Missing client_email or private_key in GCS credentials file %v", file)
+	}
+	if credentials.TokenURI == "" {
+		credentials.TokenURI = DEFAULT_TOKEN_URI
+	}
+	key, err := parsePrivateKey(credentials.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid private key in GCS credentials file %v: %v", file, err)
+	}
+	return &serviceAccountTokenSource{
+		credentials: credentials,
+		key:         key,
+	}, nil
+}
+
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not RSA")
+	}
+	return key, nil
+}
+
+func encodeSegment(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func (s *serviceAccountTokenSource) signJWT(now time.Time) (string, error) {
+	header, err := encodeSegment(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": s.credentials.PrivateKeyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := encodeSegment(map[string]interface{}{
+		"iss":   s.credentials.ClientEmail,
+		"scope": STORAGE_SCOPE,
+		"aud":   s.credentials.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + claims
+	hash := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (s *serviceAccountTokenSource) fetchToken() (*token, error) {
+	assertion, err := s.signJWT(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", JWT_GRANT_TYPE)
+	form.Set("assertion", assertion)
+	req, err := http.NewRequest("POST", s.credentials.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(req)
+}
+
+func (m *metadataTokenSource) fetchToken() (*token, error) {
+	req, err := http.NewRequest("GET",
+		metadataEndpoint+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return doTokenRequest(req)
+}
+
+func doTokenRequest(req *http.Request) (*token, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get GCS access token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Cannot get GCS access token from %v: %v %v",
+			req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	t := &token{}
+	if err := json.NewDecoder(resp.Body).Decode(t); err != nil {
+		return nil, err
+	}
+	if t.AccessToken == "" {
+		return nil, fmt.Errorf("Empty GCS access token returned by %v", req.URL.Host)
+	}
+	t.expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	return t, nil
+}
@@ -0,0 +1,191 @@
+package gcs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/convoy/objectstore"
+)
+
+var (
+	storageEndpoint = "https://storage.googleapis.com"
+)
+
+// GCSService talks to GCS JSON API directly
+type GCSService struct {
+	Bucket string
+
+	tokens     *cachedTokenSource
+	httpClient *http.Client
+}
+
+type gcsObject struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+}
+
+type gcsObjectList struct {
+	Items         []gcsObject `json:"items"`
+	Prefixes      []string    `json:"prefixes"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+type gcsError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Init loads the credentials and the HTTP client of storage requests, tuned
+// by the HTTP options of daemon and query of destination URL. Token requests
+// keep the default client, the metadata server must not go through a proxy.
+func (s *GCSService) Init(query url.Values) error {
+	tokens, err := newTokenSource()
+	if err != nil {
+		return err
+	}
+	httpConfig, err := objectstore.GetHTTPConfig(query)
+	if err != nil {
+		return err
+	}
+	s.tokens = tokens
+	s.httpClient = &http.Client{Transport: httpConfig.Transport()}
+	return nil
+}
+
+func (s *GCSService) objectURL(key string) string {
+	return storageEndpoint + "/storage/v1/b/" + url.PathEscape(s.Bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (s *GCSService) do(method, u string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	accessToken, err := s.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return resp, parseGCSError(method, u, resp)
+	}
+	return resp, nil
+}
+
+func parseGCSError(method, u string, resp *http.Response) error {
+	data, _ := ioutil.ReadAll(resp.Body)
+	gErr := &gcsError{}
+	if err := json.Unmarshal(data, gErr); err == nil && gErr.Error.Message != "" {
+		return fmt.Errorf("GCS Error: %v %v: %v %v", method, u, gErr.Error.Code, gErr.Error.Message)
+	}
+	return fmt.Errorf("GCS Error: %v %v: %v %v", method, u, resp.Status, strings.TrimSpace(string(data)))
+}
+
+// ListObjects returns names of objects and prefixes of "directories" under
+// key. Same as S3, directory must end in "/", otherwise it may match
+// unintentionally.
+func (s *GCSService) ListObjects(key, delimiter string) ([]gcsObject, []string, error) {
+	objects := []gcsObject{}
+	prefixes := []string{}
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", key)
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		u := storageEndpoint + "/storage/v1/b/" + url.PathEscape(s.Bucket) + "/o?" + query.Encode()
+		resp, err := s.do("GET", u, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		list := &gcsObjectList{}
+		err = json.NewDecoder(resp.Body).Decode(list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, list.Items...)
+		prefixes = append(prefixes, list.Prefixes...)
+		if list.NextPageToken == "" {
+			break
+		}
+		pageToken = list.NextPageToken
+	}
+	return objects, prefixes, nil
+}
+
+func (s *GCSService) GetObjectSize(key string) (int64, error) {
+	resp, err := s.do("GET", s.objectURL(key), nil, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+	obj := &gcsObject{}
+	if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+		return -1, err
+	}
+	return strconv.ParseInt(obj.Size, 10, 64)
+}
+
+func (s *GCSService) PutObject(key string, reader io.Reader, size int64) error {
+	query := url.Values{}
+	query.Set("uploadType", "media")
+	query.Set("name", key)
+	u := storageEndpoint + "/upload/storage/v1/b/" + url.PathEscape(s.Bucket) + "/o?" + query.Encode()
+	resp, err := s.do("POST", u, reader, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *GCSService) GetObject(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.objectURL(key)+"?alt=media", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteObjects removes every object whose name starts with one of keys
+func (s *GCSService) DeleteObjects(keys []string) error {
+	for _, key := range keys {
+		objects, _, err := s.ListObjects(key, "")
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			resp, err := s.do("DELETE", s.objectURL(obj.Name), nil, 0)
+			if err != nil {
+				if resp != nil && resp.StatusCode == http.StatusNotFound {
+					continue
+				}
+				return err
+			}
+			resp.Body.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package gcs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+const (
+	testBucket = "test-bucket"
+	testToken  = "test-access-token"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	server  *httptest.Server
+	fake    *fakeGCS
+	workDir string
+}
+
+var _ = Suite(&TestSuite{})
+
+// fakeGCS implements the part of GCS JSON API and token endpoints used by
+// the driver
+type fakeGCS struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+	key     *rsa.PrivateKey
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch {
+	case r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token":
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing Metadata-Flavor", http.StatusForbidden)
+			return
+		}
+		writeToken(w)
+		return
+	case r.URL.Path == "/token":
+		if err := f.verifyAssertion(r.FormValue("assertion")); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		writeToken(w)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		http.Error(w, `{"error":{"code":401,"message":"unauthorized"}}`, http.StatusUnauthorized)
+		return
+	}
+	objectPrefix := "/storage/v1/b/" + testBucket + "/o/"
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/"+testBucket+"/o":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Query().Get("name")] = data
+		json.NewEncoder(w).Encode(gcsObject{Name: r.URL.Query().Get("name")})
+	case r.Method == "GET" && r.URL.Path == "/storage/v1/b/"+testBucket+"/o":
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+	case strings.HasPrefix(r.URL.EscapedPath(), objectPrefix):
+		name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), objectPrefix))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, exists := f.objects[name]
+		if !exists {
+			http.Error(w, `{"error":{"code":404,"message":"No such object"}}`, http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == "DELETE":
+			delete(f.objects, name)
+		case r.URL.Query().Get("alt") == "media":
+			w.Write(data)
+		default:
+			json.NewEncoder(w).Encode(map[string]string{
+				"name": name,
+				"size": strconv.Itoa(len(data)),
+			})
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, prefix, delimiter string) {
+	list := gcsObjectList{}
+	prefixes := map[string]bool{}
+	names := []string{}
+	for name := range f.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		if delimiter != "" && strings.Contains(rest, delimiter) {
+			p := prefix + rest[:strings.Index(rest, delimiter)+1]
+			if !prefixes[p] {
+				prefixes[p] = true
+				list.Prefixes = append(list.Prefixes, p)
+			}
+			continue
+		}
+		list.Items = append(list.Items, gcsObject{Name: name})
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func (f *fakeGCS) verifyAssertion(assertion string) error {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid assertion %v", assertion)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	return rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, hash[:], signature)
+}
+
+func writeToken(w http.ResponseWriter) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": testToken,
+		"expires_in":   3600,
+	})
+}
+
+func (s *TestSuite) SetUpSuite(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	s.fake = &fakeGCS{
+		objects: map[string][]byte{},
+		key:     key,
+	}
+	s.server = httptest.NewServer(s.fake)
+	storageEndpoint = s.server.URL
+	metadataEndpoint = s.server.URL
+}
+
+func (s *TestSuite) TearDownSuite(c *C) {
+	s.server.Close()
+}
+
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.workDir, err = ioutil.TempDir("", "convoy-gcs")
+	c.Assert(err, IsNil)
+	s.fake.objects = map[string][]byte{}
+	os.Unsetenv(ENV_CREDENTIALS)
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	os.Unsetenv(ENV_CREDENTIALS)
+	c.Assert(os.RemoveAll(s.workDir), IsNil)
+}
+
+func (s *TestSuite) TestDriverFuncs(c *C) {
+	_, err := initFunc("gcs:///path")
+	c.Assert(err, ErrorMatches, "Invalid URL.*")
+
+	driver, err := initFunc("gcs://" + testBucket + "/backupstore")
+	c.Assert(err, IsNil)
+	c.Assert(driver.GetURL(), Equals, "gcs://"+testBucket+"/backupstore")
+
+	body := []byte("this is only a test file")
+	c.Assert(driver.Write("dir/dir1/file1", bytes.NewReader(body)), IsNil)
+	c.Assert(driver.Write("dir/dir2/file2", bytes.NewReader(body)), IsNil)
+	c.Assert(driver.Write("dir/file3", bytes.NewReader(body)), IsNil)
+
+	names, err := driver.List("dir")
+	c.Assert(err, IsNil)
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, []string{"dir1", "dir2", "file3"})
+
+	c.Assert(driver.FileExists("dir/file3"), Equals, true)
+	c.Assert(driver.FileExists("dir/nonexistent"), Equals, false)
+
+	rc, err := driver.Read("dir/dir1/file1")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, body)
+
+	src := filepath.Join(s.workDir, "src")
+	dst := filepath.Join(s.workDir, "dst")
+	c.Assert(ioutil.WriteFile(src, body, 0600), IsNil)
+	c.Assert(driver.Upload(src, "dir/uploaded"), IsNil)
+	c.Assert(driver.Download("dir/uploaded", dst), IsNil)
+	data, err = ioutil.ReadFile(dst)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, body)
+
+	c.Assert(driver.Remove("dir/dir1", "dir/file3"), IsNil)
+	names, err = driver.List("dir")
+	c.Assert(err, IsNil)
+	sort.Strings(names)
+	c.Assert(names, DeepEquals, []string{"dir2", "uploaded"})
+}
+
+func (s *TestSuite) TestServiceAccountCredentials(c *C) {
+	keyData := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(s.fake.key),
+	})
+	credentials, err := json.Marshal(serviceAccountCredentials{
+		Type:        CREDENTIALS_TYPE_SERVICE_ACCOUNT,
+		ClientEmail: "convoy@project.iam.gserviceaccount.com",
+		PrivateKey:  string(keyData),
+		TokenURI:    s.server.URL + "/token",
+	})
+	c.Assert(err, IsNil)
+	file := filepath.Join(s.workDir, "credentials.json")
+	c.Assert(ioutil.WriteFile(file, credentials, 0600), IsNil)
+	os.Setenv(ENV_CREDENTIALS, file)
+
+	driver, err := initFunc("gcs://" + testBucket + "/backupstore")
+	c.Assert(err, IsNil)
+	c.Assert(driver.Write("file", bytes.NewReader([]byte("data"))), IsNil)
+
+	// Key not matching the one known by token endpoint would be rejected
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, IsNil)
+	credentials, err = json.Marshal(serviceAccountCredentials{
+		Type:        CREDENTIALS_TYPE_SERVICE_ACCOUNT,
+		ClientEmail: "convoy@project.iam.gserviceaccount.com",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(otherKey),
+		})),
+		TokenURI: s.server.URL + "/token",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(file, credentials, 0600), IsNil)
+	_, err = initFunc("gcs://" + testBucket + "/backupstore")
+	c.Assert(err, ErrorMatches, "Cannot get GCS access token.*")
+
+	c.Assert(ioutil.WriteFile(file, []byte(`{"type": "authorized_user"}`), 0600), IsNil)
+	_, err = initFunc("gcs://" + testBucket + "/backupstore")
+	c.Assert(err, ErrorMatches, "Unsupported credentials type.*")
+}
@@ -3,10 +3,12 @@ package glusterfs
 import (
 	"fmt"
 	"math/rand"
+	"net"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/util"
@@ -25,20 +27,28 @@ const (
 	SNAPSHOT_PATH = "snapshots"
 
 	MOUNTS_DIR = "mounts"
+	// Volumes mounted by themselves rather than used in place in the pool
+	VOLUME_MOUNTS_DIR = "volume_mounts"
 
 	GLUSTERFS_SERVERS             = "glusterfs.servers"
 	GLUSTERFS_DEFAULT_VOLUME_POOL = "glusterfs.defaultvolumepool"
 	GLUSTERFS_DEFAULT_VOLUME_SIZE = "glusterfs.defaultvolumesize"
 	DEFAULT_VOLUME_SIZE           = "100G"
+
+	GLUSTERD_PORT = "24007"
 )
 
 var (
 	log = logrus.WithFields(logrus.Fields{"pkg": "glusterfs"})
+
+	glusterdPort      = GLUSTERD_PORT
+	serverDialTimeout = 3 * time.Second
 )
 
 type Driver struct {
 	mutex    *sync.RWMutex
 	gVolumes map[string]*GlusterFSVolume
+	usage    *util.UsageCache
 	Device
 }
 
@@ -74,8 +84,16 @@ type Volume struct {
 	Size         int64
 	PrepareForVM bool
 	CreatedTime  string
+	// Comma separated options to mount the subdirectory of volume with.
+	// Volume is used in place in the pool without them.
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Whether the current mount is read-only
+	MountedReadOnly bool
 
 	configPath string
+	servers    []string
 }
 
 type GlusterFSVolume struct {
@@ -103,6 +121,34 @@ func (gv *GlusterFSVolume) GenerateDefaultMountPoint() string {
 	return filepath.Join(gv.configPath, MOUNTS_DIR, gv.Name)
 }
 
+// GetDevice returns the subdirectory of volume in the pool, which is mounted
+// from the first server so it can be found in the mount table by refresh
+func (v *Volume) GetDevice() (string, error) {
+	if len(v.servers) == 0 {
+		return "", fmt.Errorf("No server IP provided for glusterfs")
+	}
+	return v.servers[0] + ":/" + v.VolumePool + "/" + v.Name, nil
+}
+
+// GetMountOpts passes the mount options of volume through, with the other
+// servers to fetch the volume file from if the first one is down
+func (v *Volume) GetMountOpts() []string {
+	options := util.ReadOnlyMountOptions(v.MountOptions, v.MountedReadOnly)
+	if len(v.servers) > 1 && !strings.Contains(options, "backup-volfile-servers=") {
+		backup := "backup-volfile-servers=" + strings.Join(v.servers[1:], ":")
+		if options == "" {
+			options = backup
+		} else {
+			options += "," + backup
+		}
+	}
+	return append([]string{"-t", "glusterfs"}, util.MountOptionsArgs(options)...)
+}
+
+func (v *Volume) GenerateDefaultMountPoint() string {
+	return filepath.Join(v.configPath, VOLUME_MOUNTS_DIR, v.Name)
+}
+
 func (v *Volume) ConfigFile() (string, error) {
 	if v.Name == "" {
 		return "", fmt.Errorf("BUG: Invalid empty volume name")
@@ -178,19 +224,26 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 	d := &Driver{
 		mutex:    &sync.RWMutex{},
 		gVolumes: map[string]*GlusterFSVolume{},
+		usage:    util.NewUsageCache(util.DEFAULT_USAGE_CACHE_TTL),
 		Device:   *dev,
 	}
-	gVolume := &GlusterFSVolume{
-		Name:       dev.DefaultVolumePool,
-		Servers:    dev.Servers,
-		configPath: d.Root,
-	}
-	// We would always mount the default volume pool
-	// TODO: Also need to mount any existing volume's pool
-	if _, err := util.VolumeMount(gVolume, "", true); err != nil {
+	// We would always mount the default volume pool, and the pools of
+	// existing volumes in case the default one has changed
+	pools, err := d.listVolumePools()
+	if err != nil {
 		return nil, err
 	}
-	d.gVolumes[d.DefaultVolumePool] = gVolume
+	for _, pool := range pools {
+		gVolume := &GlusterFSVolume{
+			Name:       pool,
+			Servers:    dev.Servers,
+			configPath: d.Root,
+		}
+		if _, err := util.VolumeMount(gVolume, "", true); err != nil {
+			return nil, err
+		}
+		d.gVolumes[pool] = gVolume
+	}
 
 	if err := util.ObjectSave(dev); err != nil {
 		return nil, err
@@ -198,15 +251,95 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 	return d, nil
 }
 
+// listVolumePools returns the default volume pool and the pools of existing
+// volumes
+func (d *Driver) listVolumePools() ([]string, error) {
+	pools := []string{d.DefaultVolumePool}
+	found := map[string]bool{d.DefaultVolumePool: true}
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range volumeIDs {
+		volume := d.blankVolume(id)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.VolumePool != "" && !found[volume.VolumePool] {
+			found[volume.VolumePool] = true
+			pools = append(pools, volume.VolumePool)
+		}
+	}
+	return pools, nil
+}
+
+// checkServers connects to glusterd of every server, which serves the volume
+// files needed to mount, and returns the errors of unreachable ones
+func (d *Driver) checkServers() map[string]error {
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	result := map[string]error{}
+	for _, server := range d.Servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, glusterdPort), serverDialTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			mutex.Lock()
+			result[server] = err
+			mutex.Unlock()
+		}(server)
+	}
+	wg.Wait()
+	return result
+}
+
 func (d *Driver) Info() (map[string]string, error) {
+	reachable := []string{}
+	unreachable := []string{}
+	serverErrs := d.checkServers()
+	for _, server := range d.Servers {
+		if serverErrs[server] == nil {
+			reachable = append(reachable, server)
+		} else {
+			unreachable = append(unreachable, server)
+		}
+	}
 	return map[string]string{
-		"Root":              d.Root,
-		"GlusterFSServers":  fmt.Sprintf("%v", d.Servers),
-		"DefaultVolumePool": d.DefaultVolumePool,
-		"DefaultVolumeSize": strconv.FormatInt(d.DefaultVolumeSize, 10),
+		"Root":               d.Root,
+		"GlusterFSServers":   fmt.Sprintf("%v", d.Servers),
+		"DefaultVolumePool":  d.DefaultVolumePool,
+		"DefaultVolumeSize":  strconv.FormatInt(d.DefaultVolumeSize, 10),
+		"ReachableServers":   strings.Join(reachable, ","),
+		"UnreachableServers": strings.Join(unreachable, ","),
 	}, nil
 }
 
+func (d *Driver) CheckHealth() []HealthCheck {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	checks := []HealthCheck{}
+	serverErrs := d.checkServers()
+	for _, server := range d.Servers {
+		checks = append(checks, HealthCheck{
+			Name:  "server " + server,
+			Error: serverErrs[server],
+		})
+	}
+	for name, gVolume := range d.gVolumes {
+		checks = append(checks, HealthCheck{
+			Name:  "pool " + name,
+			Error: util.CheckPathWritable(gVolume.MountPoint),
+		})
+	}
+	return checks
+}
+
 func (d *Driver) VolumeOps() (VolumeOperations, error) {
 	return d, nil
 }
@@ -214,6 +347,7 @@ func (d *Driver) VolumeOps() (VolumeOperations, error) {
 func (d *Driver) blankVolume(name string) *Volume {
 	return &Volume{
 		configPath: d.Root,
+		servers:    d.Servers,
 		Name:       name,
 	}
 }
@@ -233,6 +367,11 @@ func (d *Driver) CreateVolume(req Request) error {
 	id := req.Name
 	opts := req.Options
 
+	ownership, err := util.ParseVolumeOwnership(opts[OPT_UID], opts[OPT_GID], opts[OPT_MODE])
+	if err != nil {
+		return err
+	}
+
 	volume := d.blankVolume(id)
 	exists, err := util.ObjectExists(volume)
 	if err != nil {
@@ -260,10 +399,17 @@ func (d *Driver) CreateVolume(req Request) error {
 	} else if err := util.VolumeMountPointDirectoryCreate(gVolume, id); err != nil {
 		return err
 	}
+	if ownership != nil {
+		if err := ownership.Apply(volumePath); err != nil {
+			return err
+		}
+	}
 	volume.Name = id
 	volume.Path = volumePath
 	volume.VolumePool = gVolume.Name
 	volume.CreatedTime = util.Now()
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	volume.ReadOnly = opts[OPT_READ_ONLY] == "true"
 
 	return util.ObjectSave(volume)
 }
@@ -291,6 +437,7 @@ func (d *Driver) DeleteVolume(req Request) error {
 			return err
 		}
 	}
+	d.usage.Invalidate(id)
 	return util.ObjectDelete(volume)
 }
 
@@ -310,8 +457,26 @@ func (d *Driver) MountVolume(req Request) (string, error) {
 	if specifiedPoint != "" {
 		return "", fmt.Errorf("GlusterFS doesn't support specified mount point")
 	}
+	readOnly := volume.ReadOnly || opts[OPT_READ_ONLY] == "true"
+	if err := util.CheckMountMode(id, volume.MountPoint, volume.MountedReadOnly, readOnly); err != nil {
+		return "", err
+	}
 	if volume.MountPoint == "" {
-		volume.MountPoint = volume.Path
+		if volume.MountOptions == "" && !readOnly {
+			volume.MountPoint = volume.Path
+		} else {
+			// Subdirectory of volume is mounted by itself to apply
+			// the options
+			ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+			if err != nil {
+				return "", err
+			}
+			defer cancel()
+			volume.MountedReadOnly = readOnly
+			if _, err := util.VolumeMountWithContext(ctx, volume, "", false); err != nil {
+				return "", err
+			}
+		}
 	}
 	if volume.PrepareForVM {
 		if err := util.MountPointPrepareImageFile(volume.MountPoint, volume.Size); err != nil {
@@ -335,9 +500,31 @@ func (d *Driver) UmountVolume(req Request) error {
 		return err
 	}
 
-	if volume.MountPoint != "" {
-		volume.MountPoint = ""
+	if volume.MountPoint != "" && volume.MountPoint != volume.Path {
+		if err := util.VolumeUmountWithContext(req.Context(), volume); err != nil {
+			return err
+		}
 	}
+	volume.MountPoint = ""
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) ForceUmountVolume(req Request) error {
+	id := req.Name
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	if volume.MountPoint != "" && volume.MountPoint != volume.Path {
+		if err := util.VolumeForceUmount(req.Context(), volume, req.Options[OPT_KILL] == "true"); err != nil {
+			return err
+		}
+	}
+	volume.MountPoint = ""
+	volume.MountedReadOnly = false
 	return util.ObjectSave(volume)
 }
 
@@ -379,7 +566,7 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 		size = strconv.FormatInt(volume.Size, 10)
 	}
 
-	return map[string]string{
+	info := map[string]string{
 		OPT_VOLUME_NAME:         volume.Name,
 		"Path":                  volume.Path,
 		OPT_MOUNT_POINT:         volume.MountPoint,
@@ -388,7 +575,24 @@ func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
 		OPT_VOLUME_CREATED_TIME: volume.CreatedTime,
 		"GlusterFSVolume":       volume.VolumePool,
 		"GlusterFSServers":      fmt.Sprintf("%v", gVolume.Servers),
-	}, nil
+		OPT_MOUNT_OPTIONS:       volume.MountOptions,
+		OPT_READ_ONLY:           strconv.FormatBool(volume.ReadOnly),
+		"MountedReadOnly":       strconv.FormatBool(volume.MountedReadOnly),
+	}
+	used, err := d.usage.Get(volume.Name, func() (int64, error) {
+		return util.GetDirUsage(volume.Path)
+	})
+	if err != nil {
+		log.Warnf("Failed to get usage of volume %v: %v", volume.Name, err)
+		return info, nil
+	}
+	allocated := used
+	if volume.PrepareForVM && volume.Size > used {
+		allocated = volume.Size
+	}
+	info[OPT_USED_SIZE] = strconv.FormatInt(used, 10)
+	info[OPT_ALLOCATED_SIZE] = strconv.FormatInt(allocated, 10)
+	return info, nil
 }
 
 func (d *Driver) MountPoint(req Request) (string, error) {
@@ -404,6 +608,59 @@ func (d *Driver) MountPoint(req Request) (string, error) {
 	return volume.MountPoint, nil
 }
 
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	// Only volumes mounted by themselves have kernel mount state to
+	// reconcile with, the others are used in place
+	if volume.MountPoint == volume.Path {
+		return volume.MountPoint, nil
+	}
+	mountPoint, err := util.VolumeMountRefresh(volume)
+	if err != nil {
+		return "", err
+	}
+	if mountPoint == "" {
+		volume.MountedReadOnly = false
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+// CleanupOrphanMounts umounts the subdirectories of volumes left mounted,
+// e.g. after a crash in the middle of mount. Pools are kept mounted.
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, id := range volumeIDs {
+		volume := d.blankVolume(id)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, VOLUME_MOUNTS_DIR), mountPoints)
+}
+
+func (d *Driver) ResizeVolume(req Request) error {
+	return fmt.Errorf("Doesn't support resize volume")
+}
+
 func (d *Driver) SnapshotOps() (SnapshotOperations, error) {
 	return nil, fmt.Errorf("Doesn't support snapshot operations")
 }
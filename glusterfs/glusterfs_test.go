@@ -0,0 +1,69 @@
+package glusterfs
+
+import (
+	"net"
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct{}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) TestVolumeMountOpts(c *C) {
+	volume := &Volume{
+		Name:       "vol1",
+		VolumePool: "pool1",
+		configPath: "/var/lib/convoy/glusterfs",
+		servers:    []string{"10.1.1.2", "10.1.1.3", "10.1.1.4"},
+	}
+	dev, err := volume.GetDevice()
+	c.Assert(err, IsNil)
+	c.Assert(dev, Equals, "10.1.1.2:/pool1/vol1")
+	c.Assert(volume.GenerateDefaultMountPoint(), Equals, "/var/lib/convoy/glusterfs/volume_mounts/vol1")
+	c.Assert(volume.GetMountOpts(), DeepEquals, []string{"-t", "glusterfs", "-o", "backup-volfile-servers=10.1.1.3:10.1.1.4"})
+
+	volume.MountOptions = "log-level=WARNING,backup-volfile-servers=10.1.1.4"
+	volume.MountedReadOnly = true
+	c.Assert(volume.GetMountOpts(), DeepEquals, []string{"-t", "glusterfs", "-o", "log-level=WARNING,backup-volfile-servers=10.1.1.4,ro"})
+
+	volume.servers = volume.servers[:1]
+	volume.MountOptions = ""
+	volume.MountedReadOnly = false
+	c.Assert(volume.GetMountOpts(), DeepEquals, []string{"-t", "glusterfs"})
+
+	volume.servers = nil
+	_, err = volume.GetDevice()
+	c.Assert(err, ErrorMatches, "No server IP provided for glusterfs")
+}
+
+func (s *TestSuite) TestCheckServers(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	c.Assert(err, IsNil)
+	glusterdPort = port
+	defer func() {
+		glusterdPort = GLUSTERD_PORT
+	}()
+
+	// Nothing listens on the port of another loopback address
+	d := &Driver{
+		Device: Device{
+			Servers: []string{"127.0.0.1", "127.0.0.2"},
+		},
+	}
+	errs := d.checkServers()
+	c.Assert(errs, HasLen, 2)
+	c.Assert(errs["127.0.0.1"], IsNil)
+	c.Assert(errs["127.0.0.2"], NotNil)
+
+	info, err := d.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info["ReachableServers"], Equals, "127.0.0.1")
+	c.Assert(info["UnreachableServers"], Equals, "127.0.0.2")
+}
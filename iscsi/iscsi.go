@@ -0,0 +1,758 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+	"github.com/rancher/convoy/util/fs"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+const (
+	DRIVER_NAME        = "iscsi"
+	DRIVER_CONFIG_FILE = "iscsi.cfg"
+
+	VOLUME_CFG_PREFIX = "volume_"
+	DRIVER_CFG_PREFIX = DRIVER_NAME + "_"
+	CFG_POSTFIX       = ".json"
+
+	MOUNTS_DIR = "mounts"
+
+	ISCSI_PORTAL           = "iscsi.portal"
+	ISCSI_CHAP_USERNAME    = "iscsi.chapusername"
+	ISCSI_CHAP_SECRET_FILE = "iscsi.chapsecretfile"
+	ISCSI_DEFAULT_FS_TYPE  = "iscsi.defaultfstype"
+
+	DEFAULT_PORT    = "3260"
+	DEFAULT_FS_TYPE = "ext4"
+
+	ISCSIADM_BINARY = "iscsiadm"
+
+	DEVICE_WAIT_TIMEOUT  = 30 * time.Second
+	DEVICE_WAIT_INTERVAL = time.Second
+	PORTAL_CHECK_TIMEOUT = 3 * time.Second
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "iscsi"})
+
+	iscsiadmBinary = ISCSIADM_BINARY
+	// Links to the devices of LUNs, named by portal, target and LUN
+	devicesByPathDir = "/dev/disk/by-path"
+)
+
+type Driver struct {
+	mutex *sync.RWMutex
+	Device
+}
+
+func init() {
+	if err := Register(DRIVER_NAME, Init); err != nil {
+		panic(err)
+	}
+}
+
+func (d *Driver) Name() string {
+	return DRIVER_NAME
+}
+
+type Device struct {
+	Root string
+	// Target portal in the format of <IP>:<port>
+	Portal string
+	// CHAP is used to log into targets if the username is set, with the
+	// password in the secret file
+	ChapUsername   string
+	ChapSecretFile string
+	// Filesystem created on LUNs without one
+	DefaultFSType string
+}
+
+func (dev *Device) ConfigFile() (string, error) {
+	if dev.Root == "" {
+		return "", fmt.Errorf("BUG: Invalid empty device config path")
+	}
+	return filepath.Join(dev.Root, DRIVER_CONFIG_FILE), nil
+}
+
+type Volume struct {
+	Name string
+	// IQN of target and LUN of the volume, on Portal
+	Target      string
+	LUN         int
+	Portal      string
+	Device      string
+	MountPoint  string
+	CreatedTime string
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Whether the current mount is read-only
+	MountedReadOnly bool
+
+	configPath string
+}
+
+func (v *Volume) ConfigFile() (string, error) {
+	if v.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume name")
+	}
+	if v.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume config path")
+	}
+	return filepath.Join(v.configPath, DRIVER_CFG_PREFIX+VOLUME_CFG_PREFIX+v.Name+CFG_POSTFIX), nil
+}
+
+func (v *Volume) GetDevice() (string, error) {
+	return v.Device, nil
+}
+
+func (v *Volume) GetMountOpts() []string {
+	return util.MountOptionsArgs(util.ReadOnlyMountOptions(v.MountOptions, v.MountedReadOnly))
+}
+
+func (v *Volume) GenerateDefaultMountPoint() string {
+	return filepath.Join(v.configPath, MOUNTS_DIR, v.Name)
+}
+
+// parsePortal returns the portal in the format of <IP>:<port>, which is how
+// the device links of LUNs are named
+func parsePortal(portal string) (string, error) {
+	host, port, err := net.SplitHostPort(portal)
+	if err != nil {
+		host, port = strings.Trim(portal, "[]"), DEFAULT_PORT
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("Invalid %v %v, must be an IP address with optional port", ISCSI_PORTAL, portal)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("Invalid port of %v %v", ISCSI_PORTAL, portal)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// parseTarget parses the LUN of target in the format of <IQN>[/<LUN>], e.g.
+// "iqn.2001-05.com.example:storage.vol1/1". LUN is 0 if it's not specified.
+func parseTarget(spec string) (string, int, error) {
+	target, lun := spec, 0
+	if i := strings.LastIndex(spec, "/"); i != -1 {
+		var err error
+		target = spec[:i]
+		if lun, err = strconv.Atoi(spec[i+1:]); err != nil || lun < 0 {
+			return "", 0, fmt.Errorf("Invalid LUN of target %v, must be a non-negative number", spec)
+		}
+	}
+	if !strings.HasPrefix(target, "iqn.") && !strings.HasPrefix(target, "eui.") && !strings.HasPrefix(target, "naa.") {
+		return "", 0, fmt.Errorf("Invalid target %v, must be like iqn.2001-05.com.example:storage/<LUN>", spec)
+	}
+	if strings.ContainsAny(target, " \t\n/") {
+		return "", 0, fmt.Errorf("Invalid target %v, cannot contain space or /", spec)
+	}
+	return target, lun, nil
+}
+
+func devicePath(portal, target string, lun int) string {
+	return filepath.Join(devicesByPathDir, fmt.Sprintf("ip-%v-iscsi-%v-lun-%v", portal, target, lun))
+}
+
+func (device *Device) listVolumeNames() ([]string, error) {
+	return util.ListConfigIDs(device.Root, DRIVER_CFG_PREFIX+VOLUME_CFG_PREFIX, CFG_POSTFIX)
+}
+
+// parseConfig sets the options of dev by config, keeping the current ones if
+// they're not specified
+func parseConfig(dev *Device, config map[string]string) error {
+	if value, exists := config[ISCSI_PORTAL]; exists {
+		portal, err := parsePortal(value)
+		if err != nil {
+			return err
+		}
+		dev.Portal = portal
+	}
+	if dev.Portal == "" {
+		return fmt.Errorf("Missing required parameter: %v", ISCSI_PORTAL)
+	}
+	if value, exists := config[ISCSI_CHAP_USERNAME]; exists {
+		dev.ChapUsername = value
+	}
+	if value, exists := config[ISCSI_CHAP_SECRET_FILE]; exists {
+		if value != "" && !filepath.IsAbs(value) {
+			return fmt.Errorf("Invalid %v %v, must be an absolute path", ISCSI_CHAP_SECRET_FILE, value)
+		}
+		dev.ChapSecretFile = value
+	}
+	if dev.ChapUsername != "" && dev.ChapSecretFile == "" {
+		return fmt.Errorf("%v is required by %v", ISCSI_CHAP_SECRET_FILE, ISCSI_CHAP_USERNAME)
+	}
+	if value, exists := config[ISCSI_DEFAULT_FS_TYPE]; exists {
+		dev.DefaultFSType = value
+	}
+	if dev.DefaultFSType == "" {
+		dev.DefaultFSType = DEFAULT_FS_TYPE
+	}
+	return nil
+}
+
+// readChapSecret returns the CHAP password in the secret file, and warns if
+// the file can be read by other users
+func readChapSecret(file string) (string, error) {
+	st, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read CHAP secret file: %v", err)
+	}
+	if st.Mode().Perm()&0077 != 0 {
+		log.Warnf("CHAP secret file %v is accessible by other users, its permission should be 0600", file)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read CHAP secret file: %v", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", fmt.Errorf("CHAP secret file %v is empty", file)
+	}
+	return secret, nil
+}
+
+func Init(root string, config map[string]string) (ConvoyDriver, error) {
+	dev := &Device{
+		Root: root,
+	}
+	exists, err := util.ObjectExists(dev)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if err := util.ObjectLoad(dev); err != nil {
+			return nil, err
+		}
+	} else if err := util.MkdirIfNotExists(root); err != nil {
+		return nil, err
+	}
+	if err := parseConfig(dev, config); err != nil {
+		return nil, err
+	}
+	if dev.ChapUsername != "" {
+		if _, err := readChapSecret(dev.ChapSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := util.ObjectSave(dev); err != nil {
+		return nil, err
+	}
+	return &Driver{
+		mutex:  &sync.RWMutex{},
+		Device: *dev,
+	}, nil
+}
+
+func (d *Driver) Info() (map[string]string, error) {
+	return map[string]string{
+		"Root":           d.Root,
+		"Portal":         d.Portal,
+		"ChapUsername":   d.ChapUsername,
+		"ChapSecretFile": d.ChapSecretFile,
+		"DefaultFSType":  d.DefaultFSType,
+	}, nil
+}
+
+func (d *Driver) CheckHealth() []HealthCheck {
+	checks := []HealthCheck{}
+	conn, err := net.DialTimeout("tcp", d.Portal, PORTAL_CHECK_TIMEOUT)
+	if err == nil {
+		conn.Close()
+	}
+	checks = append(checks, HealthCheck{
+		Name:  "portal " + d.Portal,
+		Error: err,
+	})
+	if d.ChapUsername != "" {
+		_, err := readChapSecret(d.ChapSecretFile)
+		checks = append(checks, HealthCheck{
+			Name:  "CHAP secret",
+			Error: err,
+		})
+	}
+	return checks
+}
+
+func (d *Driver) VolumeOps() (VolumeOperations, error) {
+	return d, nil
+}
+
+func (d *Driver) blankVolume(name string) *Volume {
+	return &Volume{
+		configPath: d.Root,
+		Name:       name,
+	}
+}
+
+func (d *Driver) iscsiadm(ctx context.Context, args ...string) (string, error) {
+	return util.ExecuteWithContext(ctx, iscsiadmBinary, args)
+}
+
+// loggedIn returns whether there is a session with target on portal
+func (d *Driver) loggedIn(ctx context.Context, portal, target string) (bool, error) {
+	output, err := d.iscsiadm(ctx, "-m", "session")
+	if err != nil {
+		// iscsiadm fails if there is no session at all
+		if strings.Contains(err.Error(), "No active sessions") {
+			return false, nil
+		}
+		return false, err
+	}
+	// e.g. "tcp: [1] 10.0.0.5:3260,1 iqn.2001-05.com.example:storage (non-flash)"
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && strings.HasPrefix(fields[2], portal+",") && fields[3] == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/*
+login logs into the target of volume if there is no session yet, and waits
+for the device of LUN to show up. The node is set to log in at boot, so the
+volumes are back after the host reboots. Caller must hold the lock of driver.
+*/
+func (d *Driver) login(ctx context.Context, volume *Volume) error {
+	if _, err := os.Stat(volume.Device); err == nil {
+		return nil
+	}
+	node := []string{"-m", "node", "-T", volume.Target, "-p", volume.Portal}
+	loggedIn, err := d.loggedIn(ctx, volume.Portal, volume.Target)
+	if err != nil {
+		return err
+	}
+	if loggedIn {
+		// LUN may be added to the target after login
+		if _, err := d.iscsiadm(ctx, append(node, "-R")...); err != nil {
+			return err
+		}
+	} else {
+		settings := [][]string{{"node.startup", "automatic"}}
+		if d.ChapUsername != "" {
+			secret, err := readChapSecret(d.ChapSecretFile)
+			if err != nil {
+				return err
+			}
+			settings = append(settings,
+				[]string{"node.session.auth.authmethod", "CHAP"},
+				[]string{"node.session.auth.username", d.ChapUsername},
+				[]string{"node.session.auth.password", secret})
+		}
+		if _, err := d.iscsiadm(ctx, append(node, "-o", "new")...); err != nil {
+			return err
+		}
+		for _, setting := range settings {
+			if _, err := d.iscsiadm(ctx, append(node, "-o", "update", "-n", setting[0], "-v", setting[1])...); err != nil {
+				var execErr *util.ExecError
+				if setting[0] == "node.session.auth.password" && errors.As(err, &execErr) {
+					// Arguments of the command include the password
+					return fmt.Errorf("Failed to set CHAP password of target %v, output %v, error %v", volume.Target, execErr.Output, execErr.Err)
+				}
+				return err
+			}
+		}
+		log.Debugf("Logging into target %v on %v", volume.Target, volume.Portal)
+		if _, err := d.iscsiadm(ctx, append(node, "--login")...); err != nil {
+			return err
+		}
+	}
+	return waitForDevice(ctx, volume.Device)
+}
+
+func waitForDevice(ctx context.Context, dev string) error {
+	ctx, cancel := context.WithTimeout(ctx, DEVICE_WAIT_TIMEOUT)
+	defer cancel()
+	for {
+		if _, err := os.Stat(dev); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Device %v didn't show up after login, check the LUN of target", dev)
+		case <-time.After(DEVICE_WAIT_INTERVAL):
+		}
+	}
+}
+
+/*
+logout logs out of the target of volume and deletes its node, unless other
+volumes use LUNs of the same target. Caller must hold the lock of driver, and
+volume must have been deleted.
+*/
+func (d *Driver) logout(ctx context.Context, volume *Volume) error {
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return err
+	}
+	for _, id := range volumeIDs {
+		other := d.blankVolume(id)
+		if err := util.ObjectLoad(other); err != nil {
+			return err
+		}
+		if other.Name != volume.Name && other.Portal == volume.Portal && other.Target == volume.Target {
+			return nil
+		}
+	}
+	node := []string{"-m", "node", "-T", volume.Target, "-p", volume.Portal}
+	loggedIn, err := d.loggedIn(ctx, volume.Portal, volume.Target)
+	if err != nil {
+		return err
+	}
+	if loggedIn {
+		log.Debugf("Logging out of target %v on %v", volume.Target, volume.Portal)
+		if _, err := d.iscsiadm(ctx, append(node, "--logout")...); err != nil {
+			return err
+		}
+	}
+	_, err = d.iscsiadm(ctx, append(node, "-o", "delete")...)
+	return err
+}
+
+// CreateVolume uses the LUN of opts[OPT_VOLUME_DRIVER_ID] as the volume,
+// which is formatted if it has no filesystem. LUNs are managed on the SAN, so
+// it has to exist already.
+func (d *Driver) CreateVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	spec := req.Options[OPT_VOLUME_DRIVER_ID]
+	if spec == "" {
+		return fmt.Errorf("Target of volume is required by %v, specify it by --id", d.Name())
+	}
+	return d.createVolume(req, spec, true)
+}
+
+// ImportVolume is the same as CreateVolume, with the LUN of
+// opts[OPT_IMPORT_SOURCE], which must have a filesystem
+func (d *Driver) ImportVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.createVolume(req, req.Options[OPT_IMPORT_SOURCE], false)
+}
+
+func (d *Driver) createVolume(req Request, spec string, format bool) error {
+	id := req.Name
+	opts := req.Options
+
+	if opts[OPT_BACKUP_URL] != "" || opts[OPT_SNAPSHOT_NAME] != "" {
+		return fmt.Errorf("Creating volume from backup or snapshot is not supported by %v", d.Name())
+	}
+	if opts[OPT_UID] != "" || opts[OPT_GID] != "" || opts[OPT_MODE] != "" {
+		return fmt.Errorf("Owner and permission of volume are not supported by %v", d.Name())
+	}
+	target, lun, err := parseTarget(spec)
+	if err != nil {
+		return err
+	}
+	fsType := opts[OPT_VOLUME_FS_TYPE]
+	if fsType == "" {
+		fsType = d.DefaultFSType
+	}
+
+	volume := d.blankVolume(id)
+	exists, err := util.ObjectExists(volume)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Volume %v already exists", id)
+	}
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return err
+	}
+	for _, otherID := range volumeIDs {
+		other := d.blankVolume(otherID)
+		if err := util.ObjectLoad(other); err != nil {
+			return err
+		}
+		if other.Portal == d.Portal && other.Target == target && other.LUN == lun {
+			return fmt.Errorf("LUN %v of target %v is already used by volume %v", lun, target, otherID)
+		}
+	}
+
+	volume.Target = target
+	volume.LUN = lun
+	volume.Portal = d.Portal
+	volume.Device = devicePath(d.Portal, target, lun)
+	volume.CreatedTime = util.Now()
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	volume.ReadOnly = opts[OPT_READ_ONLY] == "true"
+
+	ctx := req.Context()
+	if err := d.login(ctx, volume); err != nil {
+		if logoutErr := d.logout(ctx, volume); logoutErr != nil {
+			log.Warnf("Failed to log out of target %v: %v", target, logoutErr)
+		}
+		return err
+	}
+	if err := d.prepareFilesystem(ctx, volume, fsType, format); err != nil {
+		if logoutErr := d.logout(ctx, volume); logoutErr != nil {
+			log.Warnf("Failed to log out of target %v: %v", target, logoutErr)
+		}
+		return err
+	}
+	return util.ObjectSave(volume)
+}
+
+// prepareFilesystem formats the LUN of volume if it has no filesystem and
+// format is true, and fails otherwise
+func (d *Driver) prepareFilesystem(ctx context.Context, volume *Volume, fsType string, format bool) error {
+	existing, err := fs.Detect(volume.Device)
+	if err == nil {
+		log.Debugf("Detected existing filesystem type=%v for device=%v", existing, volume.Device)
+		return nil
+	}
+	if err != fs.ErrNoFilesystemDetected {
+		return err
+	}
+	if !format {
+		return util.NewConvoyDriverErr(fmt.Errorf("LUN %v of target %v has no filesystem to import", volume.LUN, volume.Target), util.ErrInvalidRequestCode)
+	}
+	log.Debugf("Formatting device=%v with filesystem type=%v", volume.Device, fsType)
+	return fs.FormatDeviceWithContext(ctx, volume.Device, fsType)
+}
+
+// DeleteVolume logs out of the target if it's not used by other volumes. The
+// data on the LUN is never deleted, since it's managed on the SAN.
+func (d *Driver) DeleteVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if volume.MountPoint != "" {
+		return fmt.Errorf("Cannot delete volume %v. It is still mounted", req.Name)
+	}
+	if err := util.ObjectDelete(volume); err != nil {
+		return err
+	}
+	if err := d.logout(req.Context(), volume); err != nil {
+		log.Warnf("Failed to log out of target %v of volume %v: %v", volume.Target, volume.Name, err)
+	}
+	return nil
+}
+
+func (d *Driver) MountVolume(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	opts := req.Options
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+
+	ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	readOnly := volume.ReadOnly || opts[OPT_READ_ONLY] == "true"
+	if err := util.CheckMountMode(id, volume.MountPoint, volume.MountedReadOnly, readOnly); err != nil {
+		return "", err
+	}
+	volume.MountedReadOnly = readOnly
+
+	// Session may be gone, e.g. the host rebooted without iscsid
+	if err := d.login(ctx, volume); err != nil {
+		return "", err
+	}
+	mountPoint, err := util.VolumeMountWithContext(ctx, volume, opts[OPT_MOUNT_POINT], false)
+	if err != nil {
+		return "", err
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+func (d *Driver) UmountVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeUmountWithContext(req.Context(), volume); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) ForceUmountVolume(req Request) error {
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeForceUmount(req.Context(), volume, req.Options[OPT_KILL] == "true"); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+// FenceVolume logs out of the target of the volume, which is logged in again
+// by MountVolume
+func (d *Driver) FenceVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	return d.logout(req.Context(), volume)
+}
+
+func (d *Driver) MountPoint(req Request) (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	return volume.MountPoint, nil
+}
+
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	mountPoint, err := util.VolumeMountRefresh(volume)
+	if err != nil {
+		return "", err
+	}
+	if mountPoint == "" {
+		volume.MountedReadOnly = false
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, id := range volumeIDs {
+		volume := d.blankVolume(id)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, MOUNTS_DIR), mountPoints)
+}
+
+func (d *Driver) ListVolume(opts map[string]string) (map[string]map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]string{}
+	for _, id := range volumeIDs {
+		result[id], err = d.getVolumeInfo(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.getVolumeInfo(id)
+}
+
+func (d *Driver) getVolumeInfo(id string) (map[string]string, error) {
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, err
+	}
+	info := map[string]string{
+		OPT_VOLUME_NAME:         volume.Name,
+		"Target":                volume.Target,
+		"LUN":                   strconv.Itoa(volume.LUN),
+		"Portal":                volume.Portal,
+		"Device":                volume.Device,
+		OPT_MOUNT_POINT:         volume.MountPoint,
+		OPT_VOLUME_CREATED_TIME: volume.CreatedTime,
+		OPT_MOUNT_OPTIONS:       volume.MountOptions,
+		OPT_READ_ONLY:           strconv.FormatBool(volume.ReadOnly),
+		"MountedReadOnly":       strconv.FormatBool(volume.MountedReadOnly),
+	}
+	size, err := deviceSize(volume.Device)
+	if err != nil {
+		log.Warnf("Failed to get size of volume %v: %v", volume.Name, err)
+		return info, nil
+	}
+	info[OPT_SIZE] = strconv.FormatInt(size, 10)
+	info[OPT_ALLOCATED_SIZE] = info[OPT_SIZE]
+	return info, nil
+}
+
+func deviceSize(dev string) (int64, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
+
+func (d *Driver) ResizeVolume(req Request) error {
+	return fmt.Errorf("Doesn't support resize volume")
+}
+
+func (d *Driver) SnapshotOps() (SnapshotOperations, error) {
+	return nil, fmt.Errorf("Doesn't support snapshot operations")
+}
+
+func (d *Driver) BackupOps() (BackupOperations, error) {
+	return nil, fmt.Errorf("Doesn't support backup operations")
+}
@@ -0,0 +1,216 @@
+package iscsi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher/convoy/util"
+	"github.com/rancher/convoy/util/fs"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+const (
+	testTarget = "iqn.2001-05.com.example:storage"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	root string
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.root, err = ioutil.TempDir("", "convoy-iscsi")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	iscsiadmBinary = ISCSIADM_BINARY
+	devicesByPathDir = "/dev/disk/by-path"
+	c.Assert(os.RemoveAll(s.root), IsNil)
+}
+
+func (s *TestSuite) TestParseTarget(c *C) {
+	target, lun, err := parseTarget(testTarget)
+	c.Assert(err, IsNil)
+	c.Assert(target, Equals, testTarget)
+	c.Assert(lun, Equals, 0)
+
+	target, lun, err = parseTarget(testTarget + "/3")
+	c.Assert(err, IsNil)
+	c.Assert(target, Equals, testTarget)
+	c.Assert(lun, Equals, 3)
+
+	for _, spec := range []string{"", "storage/1", testTarget + "/", testTarget + "/-1", "iqn.2001 storage/1"} {
+		_, _, err = parseTarget(spec)
+		c.Assert(err, NotNil, Commentf("target %v", spec))
+	}
+
+	for portal, expected := range map[string]string{
+		"10.0.0.5":          "10.0.0.5:3260",
+		"10.0.0.5:3261":     "10.0.0.5:3261",
+		"fd00::5":           "[fd00::5]:3260",
+		"[fd00::5]:3261":    "[fd00::5]:3261",
+		"[fd00::5]":         "[fd00::5]:3260",
+		"san.example.com":   "",
+		"10.0.0.5:iscsi":    "",
+		"10.0.0.5:99999999": "",
+	} {
+		result, err := parsePortal(portal)
+		if expected == "" {
+			c.Assert(err, NotNil, Commentf("portal %v", portal))
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(result, Equals, expected)
+	}
+}
+
+func (s *TestSuite) TestInit(c *C) {
+	root := filepath.Join(s.root, "root")
+	_, err := Init(root, map[string]string{})
+	c.Assert(err, ErrorMatches, "Missing required parameter: iscsi.portal")
+	_, err = Init(root, map[string]string{
+		ISCSI_PORTAL:        "10.0.0.5",
+		ISCSI_CHAP_USERNAME: "convoy",
+	})
+	c.Assert(err, ErrorMatches, "iscsi.chapsecretfile is required by iscsi.chapusername")
+
+	secretFile := filepath.Join(s.root, "chap.secret")
+	c.Assert(ioutil.WriteFile(secretFile, []byte("\n"), 0600), IsNil)
+	_, err = Init(root, map[string]string{
+		ISCSI_PORTAL:           "10.0.0.5",
+		ISCSI_CHAP_USERNAME:    "convoy",
+		ISCSI_CHAP_SECRET_FILE: secretFile,
+	})
+	c.Assert(err, ErrorMatches, "CHAP secret file .* is empty")
+
+	c.Assert(ioutil.WriteFile(secretFile, []byte("secret\n"), 0600), IsNil)
+	_, err = Init(root, map[string]string{
+		ISCSI_PORTAL:           "10.0.0.5",
+		ISCSI_CHAP_USERNAME:    "convoy",
+		ISCSI_CHAP_SECRET_FILE: secretFile,
+	})
+	c.Assert(err, IsNil)
+
+	// Options are kept unless they're specified again
+	driver, err := Init(root, map[string]string{ISCSI_DEFAULT_FS_TYPE: "xfs"})
+	c.Assert(err, IsNil)
+	info, err := driver.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info["Portal"], Equals, "10.0.0.5:3260")
+	c.Assert(info["ChapUsername"], Equals, "convoy")
+	c.Assert(info["DefaultFSType"], Equals, "xfs")
+}
+
+/*
+fakeIscsiadm records the commands, and emulates the session of testTarget.
+Logging in links the device of LUN 0 to image.
+*/
+func (s *TestSuite) fakeIscsiadm(c *C, image string) string {
+	record := filepath.Join(s.root, "iscsiadm-commands")
+	session := filepath.Join(s.root, "session")
+	script := `#!/bin/sh
+echo "$@" >> ` + record + `
+case "$*" in
+"-m session")
+	if [ ! -e ` + session + ` ]; then
+		echo "iscsiadm: No active sessions."
+		exit 21
+	fi
+	echo "tcp: [1] 10.0.0.5:3260,1 ` + testTarget + ` (non-flash)";;
+*--login)
+	touch ` + session + `
+	ln -s ` + image + ` ` + devicePath("10.0.0.5:3260", testTarget, 0) + `;;
+*--logout)
+	rm ` + session + `;;
+esac
+`
+	fakeBinary := filepath.Join(s.root, "fake-iscsiadm")
+	c.Assert(ioutil.WriteFile(fakeBinary, []byte(script), 0755), IsNil)
+	iscsiadmBinary = fakeBinary
+	return record
+}
+
+func readCommands(c *C, record string) []string {
+	output, err := ioutil.ReadFile(record)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(record), IsNil)
+	return strings.Split(strings.TrimSpace(string(output)), "\n")
+}
+
+func (s *TestSuite) TestCreateVolume(c *C) {
+	devicesByPathDir = filepath.Join(s.root, "by-path")
+	c.Assert(os.Mkdir(devicesByPathDir, 0755), IsNil)
+	image := filepath.Join(s.root, "lun0.img")
+	c.Assert(ioutil.WriteFile(image, make([]byte, 16<<20), 0600), IsNil)
+	record := s.fakeIscsiadm(c, image)
+
+	secretFile := filepath.Join(s.root, "chap.secret")
+	c.Assert(ioutil.WriteFile(secretFile, []byte("secret\n"), 0600), IsNil)
+	driver, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		ISCSI_PORTAL:           "10.0.0.5",
+		ISCSI_CHAP_USERNAME:    "convoy",
+		ISCSI_CHAP_SECRET_FILE: secretFile,
+	})
+	c.Assert(err, IsNil)
+	d := driver.(*Driver)
+
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{}}), ErrorMatches,
+		"Target of volume is required by iscsi, specify it by --id")
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{
+		OPT_VOLUME_DRIVER_ID: testTarget,
+		OPT_MOUNT_OPTIONS:    "noatime",
+	}}), IsNil)
+	node := "-m node -T " + testTarget + " -p 10.0.0.5:3260"
+	c.Assert(readCommands(c, record), DeepEquals, []string{
+		"-m session",
+		node + " -o new",
+		node + " -o update -n node.startup -v automatic",
+		node + " -o update -n node.session.auth.authmethod -v CHAP",
+		node + " -o update -n node.session.auth.username -v convoy",
+		node + " -o update -n node.session.auth.password -v secret",
+		node + " --login",
+	})
+	// LUN is formatted on first use
+	fsType, err := fs.Detect(image)
+	c.Assert(err, IsNil)
+	c.Assert(fsType, Equals, DEFAULT_FS_TYPE)
+
+	info, err := d.GetVolumeInfo("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(info["Device"], Equals, devicePath("10.0.0.5:3260", testTarget, 0))
+	c.Assert(info[OPT_MOUNT_OPTIONS], Equals, "noatime")
+	c.Assert(info[OPT_SIZE], Equals, "16777216")
+
+	c.Assert(d.CreateVolume(Request{Name: "vol2", Options: map[string]string{
+		OPT_VOLUME_DRIVER_ID: testTarget + "/0",
+	}}), ErrorMatches, "LUN 0 of target "+testTarget+" is already used by volume vol1")
+
+	// Target stays logged in for the other volume if import fails
+	device1 := devicePath("10.0.0.5:3260", testTarget, 1)
+	c.Assert(ioutil.WriteFile(device1, make([]byte, 1<<20), 0600), IsNil)
+	c.Assert(d.ImportVolume(Request{Name: "vol2", Options: map[string]string{
+		OPT_IMPORT_SOURCE: testTarget + "/1",
+	}}), ErrorMatches, "LUN 1 of target "+testTarget+" has no filesystem to import")
+	_, err = os.Stat(record)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(d.DeleteVolume(Request{Name: "vol1", Options: map[string]string{}}), IsNil)
+	c.Assert(readCommands(c, record), DeepEquals, []string{
+		"-m session",
+		node + " --logout",
+		node + " -o delete",
+	})
+	exists, err := util.ObjectExists(d.blankVolume("vol1"))
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+}
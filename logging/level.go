@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// LOG_FIELD_PKG is the field package loggers are created with, which
+	// package levels are matched against
+	LOG_FIELD_PKG = "pkg"
+)
+
+var (
+	levelMutex sync.RWMutex
+	// Level of the logs of packages without a level of their own
+	globalLevel = logrus.InfoLevel
+	// Levels of packages, by package name
+	packageLevels = map[string]logrus.Level{}
+)
+
+/*
+SetLevel sets the level of logs of packages without a level of their own, see
+SetPackageLevel(). Levels are only applied to the logs formatted by
+LevelFormatter.
+*/
+func SetLevel(level logrus.Level) {
+	levelMutex.Lock()
+	defer levelMutex.Unlock()
+	globalLevel = level
+	updateLoggerLevel()
+}
+
+// SetPackageLevel sets the level of logs of package pkg, i.e. the ones with
+// the "pkg" field of pkg, overriding the global level
+func SetPackageLevel(pkg string, level logrus.Level) {
+	levelMutex.Lock()
+	defer levelMutex.Unlock()
+	packageLevels[pkg] = level
+	updateLoggerLevel()
+}
+
+// ResetPackageLevel makes package pkg use the global level again
+func ResetPackageLevel(pkg string) {
+	levelMutex.Lock()
+	defer levelMutex.Unlock()
+	delete(packageLevels, pkg)
+	updateLoggerLevel()
+}
+
+// SetPackageLevels replaces the levels of all the packages with levels
+func SetPackageLevels(levels map[string]logrus.Level) {
+	levelMutex.Lock()
+	defer levelMutex.Unlock()
+	packageLevels = map[string]logrus.Level{}
+	for pkg, level := range levels {
+		packageLevels[pkg] = level
+	}
+	updateLoggerLevel()
+}
+
+// GetLevels returns the global level and the levels of packages
+func GetLevels() (logrus.Level, map[string]logrus.Level) {
+	levelMutex.RLock()
+	defer levelMutex.RUnlock()
+	levels := map[string]logrus.Level{}
+	for pkg, level := range packageLevels {
+		levels[pkg] = level
+	}
+	return globalLevel, levels
+}
+
+// updateLoggerLevel lets logrus pass the logs of the most verbose level in
+// use, LevelFormatter drops the ones below the level of their package
+func updateLoggerLevel() {
+	level := globalLevel
+	for _, l := range packageLevels {
+		if l > level {
+			level = l
+		}
+	}
+	logrus.SetLevel(level)
+}
+
+// LevelFormatter drops the entries below the level of their package, see
+// SetPackageLevel()
+type LevelFormatter struct {
+	logrus.Formatter
+}
+
+func (f LevelFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	levelMutex.RLock()
+	level := globalLevel
+	if pkg, ok := entry.Data[LOG_FIELD_PKG].(string); ok {
+		if l, exists := packageLevels[pkg]; exists {
+			level = l
+		}
+	}
+	levelMutex.RUnlock()
+	if entry.Level > level {
+		// Written as nothing by logrus
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
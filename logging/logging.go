@@ -28,6 +28,10 @@ const (
 	LOG_FIELD_FILEPATH      = "filepath"
 	LOG_FIELD_CONTEXT       = "context"
 	LOG_FIELD_OPTS          = "opts"
+	LOG_FIELD_POLICY        = "policy"
+	LOG_FIELD_SCHEDULE      = "schedule"
+	LOG_FIELD_JOB           = "job"
+	LOG_FIELD_REQUEST_ID    = "request_id"
 
 	LOG_FIELD_EVENT      = "event"
 	LOG_EVENT_INIT       = "init"
@@ -38,6 +42,8 @@ const (
 	LOG_EVENT_MOUNT      = "mount"
 	LOG_EVENT_UMOUNT     = "umount"
 	LOG_EVENT_MOUNTPOINT = "mountpoint"
+	LOG_EVENT_REFRESH    = "refresh"
+	LOG_EVENT_RESIZE     = "resize"
 	LOG_EVENT_ACTIVATE   = "activate"
 	LOG_EVENT_DEACTIVATE = "deactivate"
 	LOG_EVENT_REGISTER   = "register"
@@ -51,6 +57,8 @@ const (
 	LOG_EVENT_COMPARE    = "compare"
 	LOG_EVENT_UPLOAD     = "upload"
 	LOG_EVENT_DOWNLOAD   = "download"
+	LOG_EVENT_MIGRATE    = "migrate"
+	LOG_EVENT_TRASH      = "trash"
 
 	LOG_FIELD_REASON    = "reason"
 	LOG_REASON_PREPARE  = "prepare"
@@ -67,6 +75,9 @@ const (
 	LOG_OBJECT_BACKUP_URL = "backup_url"
 	LOG_OBJECT_DEST_URL   = "dest_url"
 	LOG_OBJECT_CONFIG     = "config"
+	LOG_OBJECT_POLICY     = "policy"
+	LOG_OBJECT_SCHEDULE   = "schedule"
+	LOG_OBJECT_JOB        = "job"
 )
 
 // Error is a wrapper for a go error contains more details
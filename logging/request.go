@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var (
+	requestIDMutex sync.RWMutex
+	// Request IDs of the goroutines handling requests, by goroutine ID
+	requestIDs = map[uint64]string{}
+)
+
+// goroutineID parses the ID of the current goroutine from the first line of
+// its stack, "goroutine <ID> [running]:"
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	fields := bytes.Fields(buf)
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
+/*
+SetRequestID tags the logs of the current goroutine with the ID of the
+request it's handling, until the returned function is called. Loggers are
+shared by packages rather than passed along with requests, so this is how
+the logs of drivers and objectstore are correlated with the request.
+*/
+func SetRequestID(id string) func() {
+	if id == "" {
+		return func() {}
+	}
+	gid := goroutineID()
+	requestIDMutex.Lock()
+	previous, exists := requestIDs[gid]
+	requestIDs[gid] = id
+	requestIDMutex.Unlock()
+
+	return func() {
+		requestIDMutex.Lock()
+		defer requestIDMutex.Unlock()
+		if exists {
+			requestIDs[gid] = previous
+		} else {
+			delete(requestIDs, gid)
+		}
+	}
+}
+
+// GetRequestID returns the ID of the request the current goroutine is
+// handling, empty if there is none
+func GetRequestID() string {
+	requestIDMutex.RLock()
+	idle := len(requestIDs) == 0
+	requestIDMutex.RUnlock()
+	if idle {
+		return ""
+	}
+	gid := goroutineID()
+	requestIDMutex.RLock()
+	defer requestIDMutex.RUnlock()
+	return requestIDs[gid]
+}
+
+// GoWithRequestID runs f in a new goroutine, whose logs are tagged with the
+// request ID of the current goroutine
+func GoWithRequestID(f func()) {
+	id := GetRequestID()
+	go func() {
+		defer SetRequestID(id)()
+		f()
+	}()
+}
+
+// RequestIDFormatter adds the request ID of the goroutine logging to the
+// fields of entries, see SetRequestID()
+type RequestIDFormatter struct {
+	logrus.Formatter
+}
+
+func (f RequestIDFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	id := GetRequestID()
+	if id == "" {
+		return f.Formatter.Format(entry)
+	}
+	// Fields of the entry are shared by all the logs of the logger
+	data := make(logrus.Fields, len(entry.Data)+1)
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	data[LOG_FIELD_REQUEST_ID] = id
+	tagged := *entry
+	tagged.Data = data
+	return f.Formatter.Format(&tagged)
+}
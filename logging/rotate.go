@@ -0,0 +1,157 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_LOG_MAX_BACKUPS = 5
+
+	// Suffix of rotated files, after the path of log and a dot
+	ROTATED_LOG_TIME_FORMAT = "20060102T150405.000000000Z"
+)
+
+/*
+RotatingFile is a log file which is rotated once it would grow beyond
+MaxSize bytes, or MaxAge after it was opened, whichever comes first. Rotated
+files are renamed to <path>.<time of rotation in UTC>, and only the latest
+MaxBackups of them are kept. Zero MaxSize, MaxAge or MaxBackups means no
+limit.
+*/
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// OpenRotatingFile opens f for appending, creating the file at f.Path if it
+// doesn't exist
+func OpenRotatingFile(f *RotatingFile) (*RotatingFile, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, fmt.Errorf("Log file %v is closed", f.Path)
+	}
+	if f.needRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to whichever file is open rather than losing logs
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file %v: %v\n", f.Path, err)
+			if f.file == nil {
+				if err := f.open(); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) needRotate(size int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.MaxSize > 0 && f.size+size > f.MaxSize {
+		return true
+	}
+	return f.MaxAge > 0 && time.Since(f.opened) >= f.MaxAge
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	rotated := f.Path + "." + time.Now().UTC().Format(ROTATED_LOG_TIME_FORMAT)
+	if err := os.Rename(f.Path, rotated); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.removeOldBackups()
+}
+
+// removeOldBackups removes the rotated files except the latest MaxBackups
+func (f *RotatingFile) removeOldBackups() error {
+	if f.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := f.Backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > f.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backups returns the paths of rotated files, from the oldest to the latest
+func (f *RotatingFile) Backups() ([]string, error) {
+	paths, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	prefix := f.Path + "."
+	backups := []string{}
+	for _, path := range paths {
+		if _, err := time.Parse(ROTATED_LOG_TIME_FORMAT, path[len(prefix):]); err == nil {
+			backups = append(backups, path)
+		}
+	}
+	// The format sorts by time
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
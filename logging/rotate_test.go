@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct{}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) TestRotatingFile(c *C) {
+	path := filepath.Join(c.MkDir(), "convoy.log")
+	c.Assert(ioutil.WriteFile(path, []byte("existing\n"), 0600), IsNil)
+	f, err := OpenRotatingFile(&RotatingFile{
+		Path:       path,
+		MaxSize:    20,
+		MaxBackups: 2,
+	})
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	// Appended to the existing file until it would grow beyond MaxSize
+	line := "0123456789\n"
+	for i := 0; i < 3; i++ {
+		n, err := f.Write([]byte(line))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(line))
+	}
+	backups, err := f.Backups()
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, 2)
+	data, err := ioutil.ReadFile(backups[0])
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "existing\n"+line)
+	data, err = ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, line)
+
+	// Only the latest MaxBackups are kept
+	_, err = f.Write([]byte(line))
+	c.Assert(err, IsNil)
+	latest, err := f.Backups()
+	c.Assert(err, IsNil)
+	c.Assert(latest, HasLen, 2)
+	c.Assert(latest[0], Equals, backups[1])
+	c.Assert(strings.HasPrefix(latest[1], path+"."), Equals, true)
+}
+
+func (s *TestSuite) TestRotatingFileMaxAge(c *C) {
+	path := filepath.Join(c.MkDir(), "convoy.log")
+	f, err := OpenRotatingFile(&RotatingFile{
+		Path:   path,
+		MaxAge: time.Hour,
+	})
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	_, err = f.Write([]byte("first\n"))
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte("second\n"))
+	c.Assert(err, IsNil)
+	backups, err := f.Backups()
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, 0)
+
+	f.opened = time.Now().Add(-time.Hour)
+	_, err = f.Write([]byte("third\n"))
+	c.Assert(err, IsNil)
+	backups, err = f.Backups()
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, 1)
+	data, err := ioutil.ReadFile(backups[0])
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "first\nsecond\n")
+
+	c.Assert(f.Close(), IsNil)
+	_, err = f.Write([]byte("closed\n"))
+	c.Assert(err, ErrorMatches, "Log file .* is closed")
+}
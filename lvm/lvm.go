@@ -0,0 +1,846 @@
+package lvm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+	"github.com/rancher/convoy/util/fs"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	DRIVER_NAME        = "lvm"
+	DRIVER_CONFIG_FILE = "lvm.cfg"
+
+	VOLUME_CFG_PREFIX = "volume_"
+	DRIVER_CFG_PREFIX = DRIVER_NAME + "_"
+	CFG_POSTFIX       = ".json"
+
+	MOUNTS_DIR = "mounts"
+
+	LVM_VOLUME_GROUP        = "lvm.volumegroup"
+	LVM_DEFAULT_VOLUME_SIZE = "lvm.defaultvolumesize"
+	LVM_DEFAULT_FS_TYPE     = "lvm.defaultfstype"
+	LVM_SNAPSHOT_SIZE       = "lvm.snapshotsize"
+
+	DEFAULT_VOLUME_SIZE   = "10G"
+	DEFAULT_FS_TYPE       = "ext4"
+	DEFAULT_SNAPSHOT_SIZE = "100%"
+
+	// Logical volumes created by Convoy are prefixed, so they can be told
+	// apart from other ones in the volume group
+	VOLUME_LV_PREFIX   = "convoy_vol_"
+	SNAPSHOT_LV_PREFIX = "convoy_snap_"
+
+	LVM_BINARY = "lvm"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "lvm"})
+
+	// All LVM commands are run as subcommands of lvm
+	lvmBinary = LVM_BINARY
+	devDir    = "/dev"
+)
+
+type Driver struct {
+	mutex *sync.RWMutex
+	Device
+}
+
+func init() {
+	if err := Register(DRIVER_NAME, Init); err != nil {
+		panic(err)
+	}
+}
+
+func (d *Driver) Name() string {
+	return DRIVER_NAME
+}
+
+type Device struct {
+	Root        string
+	VolumeGroup string
+	// Size of volumes created without --size
+	DefaultVolumeSize int64
+	// Filesystem created on volumes without --fs
+	DefaultFSType string
+	// Copy-on-write space of snapshots, either a size or a percentage of
+	// the size of volume like "20%"
+	SnapshotSize string
+}
+
+func (dev *Device) ConfigFile() (string, error) {
+	if dev.Root == "" {
+		return "", fmt.Errorf("BUG: Invalid empty device config path")
+	}
+	return filepath.Join(dev.Root, DRIVER_CONFIG_FILE), nil
+}
+
+type Volume struct {
+	Name          string
+	LogicalVolume string
+	VolumeGroup   string
+	Size          int64
+	Filesystem    string
+	MountPoint    string
+	CreatedTime   string
+	Snapshots     map[string]Snapshot
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Whether the current mount is read-only
+	MountedReadOnly bool
+
+	configPath string
+}
+
+type Snapshot struct {
+	Name          string
+	LogicalVolume string
+	CreatedTime   string
+}
+
+func (v *Volume) ConfigFile() (string, error) {
+	if v.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume name")
+	}
+	if v.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume config path")
+	}
+	return filepath.Join(v.configPath, DRIVER_CFG_PREFIX+VOLUME_CFG_PREFIX+v.Name+CFG_POSTFIX), nil
+}
+
+func (v *Volume) GetDevice() (string, error) {
+	return lvPath(v.VolumeGroup, v.LogicalVolume), nil
+}
+
+func (v *Volume) GetMountOpts() []string {
+	return util.MountOptionsArgs(util.ReadOnlyMountOptions(v.MountOptions, v.MountedReadOnly))
+}
+
+func (v *Volume) GenerateDefaultMountPoint() string {
+	return filepath.Join(v.configPath, MOUNTS_DIR, v.Name)
+}
+
+func lvPath(vg, lv string) string {
+	return filepath.Join(devDir, vg, lv)
+}
+
+// lvName returns the name of logical volume for a volume or snapshot, which
+// cannot contain "~" allowed in the names of Convoy
+func lvName(prefix, name string) (string, error) {
+	if strings.Contains(name, "~") {
+		return "", util.NewConvoyDriverErr(fmt.Errorf("Invalid name %v, %v doesn't support ~ in names", name, DRIVER_NAME), util.ErrInvalidRequestCode)
+	}
+	return prefix + name, nil
+}
+
+func (device *Device) listVolumeNames() ([]string, error) {
+	return util.ListConfigIDs(device.Root, DRIVER_CFG_PREFIX+VOLUME_CFG_PREFIX, CFG_POSTFIX)
+}
+
+// checkSnapshotSize validates the size of snapshot, either a size or a
+// percentage of the size of volume
+func checkSnapshotSize(size string) error {
+	if strings.HasSuffix(size, "%") {
+		percentage, err := strconv.Atoi(strings.TrimSuffix(size, "%"))
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return fmt.Errorf("Invalid %v %v, percentage must be between 1%% and 100%%", LVM_SNAPSHOT_SIZE, size)
+		}
+		return nil
+	}
+	value, err := util.ParseSize(size)
+	if err != nil || value <= 0 {
+		return fmt.Errorf("Invalid %v %v, must be a size like 1G or a percentage like 20%%", LVM_SNAPSHOT_SIZE, size)
+	}
+	return nil
+}
+
+// snapshotSizeArgs returns the arguments of lvcreate for the size of snapshot
+func snapshotSizeArgs(size string) []string {
+	if strings.HasSuffix(size, "%") {
+		return []string{"-l", size + "ORIGIN"}
+	}
+	value, _ := util.ParseSize(size)
+	return []string{"-L", strconv.FormatInt(value, 10) + "b"}
+}
+
+// parseConfig sets the options of dev by config, keeping the current ones if
+// they're not specified
+func parseConfig(dev *Device, config map[string]string) error {
+	if value, exists := config[LVM_VOLUME_GROUP]; exists {
+		dev.VolumeGroup = value
+	}
+	if dev.VolumeGroup == "" {
+		return fmt.Errorf("Missing required parameter: %v", LVM_VOLUME_GROUP)
+	}
+	if value, exists := config[LVM_DEFAULT_VOLUME_SIZE]; exists {
+		size, err := util.ParseSize(value)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("Invalid %v %v", LVM_DEFAULT_VOLUME_SIZE, value)
+		}
+		dev.DefaultVolumeSize = size
+	}
+	if dev.DefaultVolumeSize == 0 {
+		dev.DefaultVolumeSize, _ = util.ParseSize(DEFAULT_VOLUME_SIZE)
+	}
+	if value, exists := config[LVM_DEFAULT_FS_TYPE]; exists {
+		dev.DefaultFSType = value
+	}
+	if dev.DefaultFSType == "" {
+		dev.DefaultFSType = DEFAULT_FS_TYPE
+	}
+	if value, exists := config[LVM_SNAPSHOT_SIZE]; exists {
+		if err := checkSnapshotSize(value); err != nil {
+			return err
+		}
+		dev.SnapshotSize = value
+	}
+	if dev.SnapshotSize == "" {
+		dev.SnapshotSize = DEFAULT_SNAPSHOT_SIZE
+	}
+	return nil
+}
+
+func Init(root string, config map[string]string) (ConvoyDriver, error) {
+	dev := &Device{
+		Root: root,
+	}
+	exists, err := util.ObjectExists(dev)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if err := util.ObjectLoad(dev); err != nil {
+			return nil, err
+		}
+	} else if err := util.MkdirIfNotExists(root); err != nil {
+		return nil, err
+	}
+	if err := parseConfig(dev, config); err != nil {
+		return nil, err
+	}
+	d := &Driver{
+		mutex:  &sync.RWMutex{},
+		Device: *dev,
+	}
+	if _, err := d.freeSize(context.Background()); err != nil {
+		return nil, fmt.Errorf("Cannot find volume group %v: %v", dev.VolumeGroup, err)
+	}
+	if err := util.ObjectSave(dev); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Driver) lvm(ctx context.Context, args ...string) (string, error) {
+	return util.ExecuteWithContext(ctx, lvmBinary, args)
+}
+
+// freeSize returns the unallocated bytes of the volume group
+func (d *Driver) freeSize(ctx context.Context) (int64, error) {
+	output, err := d.lvm(ctx, "vgs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free", d.VolumeGroup)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected free size of volume group %v: %v", d.VolumeGroup, output)
+	}
+	return size, nil
+}
+
+func (d *Driver) Info() (map[string]string, error) {
+	info := map[string]string{
+		"Root":              d.Root,
+		"VolumeGroup":       d.VolumeGroup,
+		"DefaultVolumeSize": strconv.FormatInt(d.DefaultVolumeSize, 10),
+		"DefaultFSType":     d.DefaultFSType,
+		"SnapshotSize":      d.SnapshotSize,
+	}
+	free, err := d.freeSize(context.Background())
+	if err != nil {
+		log.Warnf("Failed to get free size of volume group %v: %v", d.VolumeGroup, err)
+		return info, nil
+	}
+	info["FreeSize"] = strconv.FormatInt(free, 10)
+	return info, nil
+}
+
+func (d *Driver) CheckHealth() []HealthCheck {
+	_, err := d.freeSize(context.Background())
+	return []HealthCheck{{
+		Name:  "volume group " + d.VolumeGroup,
+		Error: err,
+	}}
+}
+
+func (d *Driver) GetFreeSpace() (int64, error) {
+	return d.freeSize(context.Background())
+}
+
+func (d *Driver) VolumeOps() (VolumeOperations, error) {
+	return d, nil
+}
+
+func (d *Driver) blankVolume(name string) *Volume {
+	return &Volume{
+		configPath: d.Root,
+		Name:       name,
+	}
+}
+
+func (d *Driver) getSize(opts map[string]string, defaultVolumeSize int64) (int64, error) {
+	size := opts[OPT_SIZE]
+	if size == "" || size == "0" {
+		size = strconv.FormatInt(defaultVolumeSize, 10)
+	}
+	return util.ParseSize(size)
+}
+
+func (d *Driver) getSnapshotAndVolume(snapshotID, volumeID string) (*Snapshot, *Volume, error) {
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, nil, err
+	}
+	snapshot, exists := volume.Snapshots[snapshotID]
+	if !exists {
+		return nil, nil, fmt.Errorf("Cannot find snapshot %v of volume %v", snapshotID, volumeID)
+	}
+	return &snapshot, volume, nil
+}
+
+/*
+CreateVolume creates a logical volume in the volume group, and formats it.
+Volume of snapshot has the data of snapshot copied, since classic snapshots
+cannot be used as independent volumes.
+*/
+func (d *Driver) CreateVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	opts := req.Options
+
+	if opts[OPT_BACKUP_URL] != "" {
+		return fmt.Errorf("Creating volume from backup is not supported by %v", d.Name())
+	}
+	if opts[OPT_UID] != "" || opts[OPT_GID] != "" || opts[OPT_MODE] != "" {
+		return fmt.Errorf("Owner and permission of volume are not supported by %v", d.Name())
+	}
+	lv, err := lvName(VOLUME_LV_PREFIX, id)
+	if err != nil {
+		return err
+	}
+
+	volume := d.blankVolume(id)
+	exists, err := util.ObjectExists(volume)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Volume %v already exists", id)
+	}
+
+	var (
+		snapshot     *Snapshot
+		originVolume *Volume
+		size         int64
+	)
+	if snapshotName := opts[OPT_SNAPSHOT_NAME]; snapshotName != "" {
+		snapshot, originVolume, err = d.getSnapshotAndVolume(snapshotName, opts[OPT_SNAPSHOT_VOLUME_NAME])
+		if err != nil {
+			return err
+		}
+		size, err = d.getSize(opts, originVolume.Size)
+		if err != nil {
+			return err
+		}
+		if size != originVolume.Size {
+			return fmt.Errorf("Volume size must match with snapshot's size")
+		}
+	} else {
+		size, err = d.getSize(opts, d.DefaultVolumeSize)
+		if err != nil {
+			return err
+		}
+		if size <= 0 {
+			return fmt.Errorf("Invalid size %v of volume %v", opts[OPT_SIZE], id)
+		}
+	}
+	fsType := opts[OPT_VOLUME_FS_TYPE]
+	if fsType == "" {
+		fsType = d.DefaultFSType
+	}
+
+	ctx := req.Context()
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: id,
+		LOG_FIELD_SIZE:   size,
+	}).Debugf("Creating logical volume %v in %v", lv, d.VolumeGroup)
+	// Signatures of filesystems left on the blocks are wiped, so the volume
+	// is always formatted
+	if _, err := d.lvm(ctx, "lvcreate", "--yes", "-W", "y", "-L", strconv.FormatInt(size, 10)+"b", "-n", lv, d.VolumeGroup); err != nil {
+		return err
+	}
+
+	volume.LogicalVolume = lv
+	volume.VolumeGroup = d.VolumeGroup
+	volume.CreatedTime = util.Now()
+	volume.Snapshots = map[string]Snapshot{}
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	volume.ReadOnly = opts[OPT_READ_ONLY] == "true"
+	if err := d.prepareVolume(ctx, volume, snapshot, originVolume, fsType); err != nil {
+		if _, removeErr := d.lvm(ctx, "lvremove", "-f", d.VolumeGroup+"/"+lv); removeErr != nil {
+			log.Warnf("Failed to remove logical volume %v of failed volume %v: %v", lv, id, removeErr)
+		}
+		return err
+	}
+	return util.ObjectSave(volume)
+}
+
+// prepareVolume fills the new logical volume of volume with the data of
+// snapshot, or formats it if there is no snapshot
+func (d *Driver) prepareVolume(ctx context.Context, volume *Volume, snapshot *Snapshot, originVolume *Volume, fsType string) error {
+	dev, err := volume.GetDevice()
+	if err != nil {
+		return err
+	}
+	// Size is rounded up to the extents of volume group
+	if volume.Size, err = deviceSize(dev); err != nil {
+		return err
+	}
+	if snapshot == nil {
+		log.Debugf("Formatting device=%v with filesystem type=%v", dev, fsType)
+		volume.Filesystem = fsType
+		return fs.FormatDeviceWithContext(ctx, dev, fsType)
+	}
+	log.Debugf("Copying snapshot %v of volume %v to volume %v", snapshot.Name, originVolume.Name, volume.Name)
+	volume.Filesystem = originVolume.Filesystem
+	_, err = util.ExecuteWithContext(ctx, "dd", []string{
+		"if=" + lvPath(originVolume.VolumeGroup, snapshot.LogicalVolume),
+		"of=" + dev,
+		"bs=4M",
+		"conv=notrunc,fsync",
+	})
+	return err
+}
+
+func deviceSize(dev string) (int64, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
+
+// ResizeVolume extends the logical volume to req.Options[OPT_SIZE], and then
+// grows the filesystem, which works even if it's mounted
+func (d *Driver) ResizeVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	size, err := util.ParseSize(req.Options[OPT_SIZE])
+	if err != nil {
+		return err
+	}
+	if size <= volume.Size {
+		return fmt.Errorf("New size %v must be larger than current size %v of volume %v", size, volume.Size, id)
+	}
+
+	ctx := req.Context()
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_RESIZE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: id,
+		LOG_FIELD_SIZE:   size,
+	}).Debugf("Extending logical volume %v", volume.LogicalVolume)
+	if _, err := d.lvm(ctx, "lvextend", "-L", strconv.FormatInt(size, 10)+"b", volume.VolumeGroup+"/"+volume.LogicalVolume); err != nil {
+		return err
+	}
+	dev, err := volume.GetDevice()
+	if err != nil {
+		return err
+	}
+	if volume.Size, err = deviceSize(dev); err != nil {
+		return err
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return err
+	}
+	if err := fs.ResizeWithContext(ctx, dev); err != nil {
+		return fmt.Errorf("Logical volume of volume %v has been resized to %v, but failed to resize filesystem: %v", id, volume.Size, err)
+	}
+	return nil
+}
+
+func (d *Driver) DeleteVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if volume.MountPoint != "" {
+		return fmt.Errorf("Cannot delete volume %v. It is still mounted", id)
+	}
+
+	ctx := req.Context()
+	for snapshotID := range volume.Snapshots {
+		if err := d.deleteSnapshot(ctx, snapshotID, volume); err != nil {
+			return fmt.Errorf("Cannot delete snapshot %v as part of deletion of volume %v: %v", snapshotID, id, err)
+		}
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_REMOVE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: id,
+	}).Debugf("Removing logical volume %v", volume.LogicalVolume)
+	if _, err := d.lvm(ctx, "lvremove", "-f", volume.VolumeGroup+"/"+volume.LogicalVolume); err != nil {
+		return err
+	}
+	return util.ObjectDelete(volume)
+}
+
+func (d *Driver) MountVolume(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	opts := req.Options
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+
+	ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	readOnly := volume.ReadOnly || opts[OPT_READ_ONLY] == "true"
+	if err := util.CheckMountMode(id, volume.MountPoint, volume.MountedReadOnly, readOnly); err != nil {
+		return "", err
+	}
+	volume.MountedReadOnly = readOnly
+
+	mountPoint, err := util.VolumeMountWithContext(ctx, volume, opts[OPT_MOUNT_POINT], false)
+	if err != nil {
+		return "", err
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+func (d *Driver) UmountVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeUmountWithContext(req.Context(), volume); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) ForceUmountVolume(req Request) error {
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeForceUmount(req.Context(), volume, req.Options[OPT_KILL] == "true"); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) MountPoint(req Request) (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	return volume.MountPoint, nil
+}
+
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	mountPoint, err := util.VolumeMountRefresh(volume)
+	if err != nil {
+		return "", err
+	}
+	if mountPoint == "" {
+		volume.MountedReadOnly = false
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, id := range volumeIDs {
+		volume := d.blankVolume(id)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, MOUNTS_DIR), mountPoints)
+}
+
+func (d *Driver) ListVolume(opts map[string]string) (map[string]map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]string{}
+	for _, id := range volumeIDs {
+		result[id], err = d.getVolumeInfo(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.getVolumeInfo(id)
+}
+
+func (d *Driver) getVolumeInfo(id string) (map[string]string, error) {
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, err
+	}
+	dev, err := volume.GetDevice()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		OPT_VOLUME_NAME:         volume.Name,
+		"LogicalVolume":         volume.LogicalVolume,
+		"VolumeGroup":           volume.VolumeGroup,
+		"Device":                dev,
+		OPT_MOUNT_POINT:         volume.MountPoint,
+		OPT_VOLUME_CREATED_TIME: volume.CreatedTime,
+		OPT_SIZE:                strconv.FormatInt(volume.Size, 10),
+		OPT_ALLOCATED_SIZE:      strconv.FormatInt(volume.Size, 10),
+		OPT_FILESYSTEM:          volume.Filesystem,
+		OPT_MOUNT_OPTIONS:       volume.MountOptions,
+		OPT_READ_ONLY:           strconv.FormatBool(volume.ReadOnly),
+		"MountedReadOnly":       strconv.FormatBool(volume.MountedReadOnly),
+	}, nil
+}
+
+func (d *Driver) SnapshotOps() (SnapshotOperations, error) {
+	return d, nil
+}
+
+/*
+CreateSnapshot creates a classic copy-on-write snapshot of the logical volume.
+The filesystem of mounted volume is frozen by device mapper while the
+snapshot is taken, so it's consistent. Snapshot becomes invalid once its
+copy-on-write space of lvm.snapshotsize is used up.
+*/
+func (d *Driver) CreateSnapshot(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volumeID, err := util.GetFieldFromOpts(OPT_VOLUME_NAME, req.Options)
+	if err != nil {
+		return err
+	}
+	lv, err := lvName(SNAPSHOT_LV_PREFIX, id)
+	if err != nil {
+		return err
+	}
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if _, exists := volume.Snapshots[id]; exists {
+		return fmt.Errorf("Snapshot %v of volume %v already exists", id, volumeID)
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_SNAPSHOT: id,
+		LOG_FIELD_VOLUME:   volumeID,
+	}).Debugf("Creating snapshot logical volume %v", lv)
+	args := append([]string{"lvcreate", "--snapshot"}, snapshotSizeArgs(d.SnapshotSize)...)
+	args = append(args, "-n", lv, volume.VolumeGroup+"/"+volume.LogicalVolume)
+	if _, err := d.lvm(req.Context(), args...); err != nil {
+		return err
+	}
+	volume.Snapshots[id] = Snapshot{
+		Name:          id,
+		LogicalVolume: lv,
+		CreatedTime:   util.Now(),
+	}
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) DeleteSnapshot(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volumeID, err := util.GetFieldFromOpts(OPT_VOLUME_NAME, req.Options)
+	if err != nil {
+		return err
+	}
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	return d.deleteSnapshot(req.Context(), req.Name, volume)
+}
+
+func (d *Driver) deleteSnapshot(ctx context.Context, id string, volume *Volume) error {
+	snapshot, exists := volume.Snapshots[id]
+	if !exists {
+		return fmt.Errorf("Cannot find snapshot %v of volume %v", id, volume.Name)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_REMOVE,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_SNAPSHOT: id,
+		LOG_FIELD_VOLUME:   volume.Name,
+	}).Debugf("Removing snapshot logical volume %v", snapshot.LogicalVolume)
+	if _, err := d.lvm(ctx, "lvremove", "-f", volume.VolumeGroup+"/"+snapshot.LogicalVolume); err != nil {
+		return err
+	}
+	delete(volume.Snapshots, id)
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) GetSnapshotInfo(req Request) (map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volumeID, err := util.GetFieldFromOpts(OPT_VOLUME_NAME, req.Options)
+	if err != nil {
+		return nil, err
+	}
+	return d.getSnapshotInfo(req.Name, volumeID)
+}
+
+func (d *Driver) getSnapshotInfo(id, volumeID string) (map[string]string, error) {
+	snapshot, volume, err := d.getSnapshotAndVolume(id, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{
+		OPT_SNAPSHOT_NAME:         snapshot.Name,
+		OPT_SNAPSHOT_CREATED_TIME: snapshot.CreatedTime,
+		OPT_SIZE:                  strconv.FormatInt(volume.Size, 10),
+		"VolumeUUID":              volumeID,
+		"LogicalVolume":           snapshot.LogicalVolume,
+	}
+	// Percentage of copy-on-write space used, snapshot is invalid at 100
+	output, err := d.lvm(context.Background(), "lvs", "--noheadings", "-o", "data_percent", volume.VolumeGroup+"/"+snapshot.LogicalVolume)
+	if err != nil {
+		log.Warnf("Failed to get usage of snapshot %v: %v", id, err)
+		return info, nil
+	}
+	info["DataPercent"] = strings.TrimSpace(output)
+	return info, nil
+}
+
+func (d *Driver) ListSnapshot(opts map[string]string) (map[string]map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var (
+		volumeIDs []string
+		err       error
+	)
+	if volumeID := opts[OPT_VOLUME_NAME]; volumeID != "" {
+		volumeIDs = []string{volumeID}
+	} else {
+		volumeIDs, err = d.listVolumeNames()
+		if err != nil {
+			return nil, err
+		}
+	}
+	snapshots := map[string]map[string]string{}
+	for _, volumeID := range volumeIDs {
+		volume := d.blankVolume(volumeID)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		for snapshotID := range volume.Snapshots {
+			snapshots[snapshotID], err = d.getSnapshotInfo(snapshotID, volumeID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return snapshots, nil
+}
+
+func (d *Driver) BackupOps() (BackupOperations, error) {
+	return nil, fmt.Errorf("Doesn't support backup operations")
+}
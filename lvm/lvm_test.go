@@ -0,0 +1,227 @@
+package lvm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher/convoy/util"
+	"github.com/rancher/convoy/util/fs"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+const (
+	testVolumeGroup = "convoy-vg"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	root   string
+	record string
+}
+
+var _ = Suite(&TestSuite{})
+
+/*
+SetUpTest fakes lvm, which records the commands, and emulates logical volumes
+of testVolumeGroup by files, rounding up their sizes to 4MiB extents.
+Snapshots are copies of their origins.
+*/
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.root, err = ioutil.TempDir("", "convoy-lvm")
+	c.Assert(err, IsNil)
+
+	devDir = filepath.Join(s.root, "dev")
+	c.Assert(os.MkdirAll(filepath.Join(devDir, testVolumeGroup), 0755), IsNil)
+	s.record = filepath.Join(s.root, "lvm-commands")
+	script := `#!/bin/sh
+echo "$@" >> ` + s.record + `
+cmd=$1
+shift
+snapshot=
+while [ $# -gt 0 ]; do
+	case $1 in
+	--snapshot) snapshot=1;;
+	-L) size=${2%b}; shift;;
+	-n) name=$2; shift;;
+	-l|-o|-W|--units) shift;;
+	-*) ;;
+	*) target=$1;;
+	esac
+	shift
+done
+dev=` + devDir + `
+case $cmd in
+vgs)
+	if [ "$target" != "` + testVolumeGroup + `" ]; then
+		echo "Volume group \"$target\" not found" >&2
+		exit 5
+	fi
+	echo "  1073741824";;
+lvcreate)
+	if [ -n "$snapshot" ]; then
+		cp $dev/$target $dev/${target%/*}/$name
+	else
+		truncate -s $(( (size + 4194303) / 4194304 * 4194304 )) $dev/$target/$name
+	fi;;
+lvextend)
+	truncate -s $size $dev/$target;;
+lvremove)
+	rm $dev/$target;;
+lvs)
+	echo "  5.00";;
+esac
+`
+	fakeBinary := filepath.Join(s.root, "fake-lvm")
+	c.Assert(ioutil.WriteFile(fakeBinary, []byte(script), 0755), IsNil)
+	lvmBinary = fakeBinary
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	lvmBinary = LVM_BINARY
+	devDir = "/dev"
+	c.Assert(os.RemoveAll(s.root), IsNil)
+}
+
+func (s *TestSuite) readCommands(c *C) []string {
+	output, err := ioutil.ReadFile(s.record)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(s.record), IsNil)
+	return strings.Split(strings.TrimSpace(string(output)), "\n")
+}
+
+func (s *TestSuite) TestSnapshotSize(c *C) {
+	for size, expected := range map[string][]string{
+		"100%": {"-l", "100%ORIGIN"},
+		"20%":  {"-l", "20%ORIGIN"},
+		"1G":   {"-L", "1073741824b"},
+		"4096": {"-L", "4096b"},
+	} {
+		c.Assert(checkSnapshotSize(size), IsNil)
+		c.Assert(snapshotSizeArgs(size), DeepEquals, expected)
+	}
+	for _, size := range []string{"", "0", "0%", "101%", "x%", "1X"} {
+		c.Assert(checkSnapshotSize(size), NotNil, Commentf("size %v", size))
+	}
+}
+
+func (s *TestSuite) TestInit(c *C) {
+	root := filepath.Join(s.root, "root")
+	_, err := Init(root, map[string]string{})
+	c.Assert(err, ErrorMatches, "Missing required parameter: lvm.volumegroup")
+	_, err = Init(root, map[string]string{LVM_VOLUME_GROUP: "other-vg"})
+	c.Assert(err, ErrorMatches, "(?s)Cannot find volume group other-vg: .*not found.*")
+	_, err = Init(root, map[string]string{
+		LVM_VOLUME_GROUP:  testVolumeGroup,
+		LVM_SNAPSHOT_SIZE: "200%",
+	})
+	c.Assert(err, ErrorMatches, "Invalid lvm.snapshotsize 200%.*")
+
+	_, err = Init(root, map[string]string{
+		LVM_VOLUME_GROUP:        testVolumeGroup,
+		LVM_DEFAULT_VOLUME_SIZE: "16M",
+	})
+	c.Assert(err, IsNil)
+
+	// Options are kept unless they're specified again
+	driver, err := Init(root, map[string]string{LVM_SNAPSHOT_SIZE: "20%"})
+	c.Assert(err, IsNil)
+	info, err := driver.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info["VolumeGroup"], Equals, testVolumeGroup)
+	c.Assert(info["DefaultVolumeSize"], Equals, "16777216")
+	c.Assert(info["DefaultFSType"], Equals, DEFAULT_FS_TYPE)
+	c.Assert(info["SnapshotSize"], Equals, "20%")
+	c.Assert(info["FreeSize"], Equals, "1073741824")
+	c.Assert(driver.(*Driver).CheckHealth(), DeepEquals, []HealthCheck{{Name: "volume group " + testVolumeGroup}})
+}
+
+func (s *TestSuite) TestVolumeAndSnapshot(c *C) {
+	driver, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		LVM_VOLUME_GROUP:        testVolumeGroup,
+		LVM_DEFAULT_VOLUME_SIZE: "16M",
+	})
+	c.Assert(err, IsNil)
+	d := driver.(*Driver)
+	s.readCommands(c)
+
+	c.Assert(d.CreateVolume(Request{Name: "vol~1", Options: map[string]string{}}), ErrorMatches,
+		"Invalid name vol~1, lvm doesn't support ~ in names")
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{
+		OPT_SIZE:          "17M",
+		OPT_MOUNT_OPTIONS: "noatime",
+	}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"lvcreate --yes -W y -L 17825792b -n convoy_vol_vol1 " + testVolumeGroup,
+	})
+	dev := filepath.Join(devDir, testVolumeGroup, "convoy_vol_vol1")
+	fsType, err := fs.Detect(dev)
+	c.Assert(err, IsNil)
+	c.Assert(fsType, Equals, DEFAULT_FS_TYPE)
+
+	// Size is rounded up to extents
+	info, err := d.GetVolumeInfo("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(info["Device"], Equals, dev)
+	c.Assert(info["LogicalVolume"], Equals, "convoy_vol_vol1")
+	c.Assert(info[OPT_SIZE], Equals, "20971520")
+	c.Assert(info[OPT_FILESYSTEM], Equals, DEFAULT_FS_TYPE)
+	c.Assert(info[OPT_MOUNT_OPTIONS], Equals, "noatime")
+
+	c.Assert(d.ResizeVolume(Request{Name: "vol1", Options: map[string]string{OPT_SIZE: "16M"}}), ErrorMatches,
+		"New size 16777216 must be larger than current size 20971520 of volume vol1")
+	c.Assert(d.ResizeVolume(Request{Name: "vol1", Options: map[string]string{OPT_SIZE: "24M"}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"lvextend -L 25165824b " + testVolumeGroup + "/convoy_vol_vol1",
+	})
+	info, err = d.GetVolumeInfo("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(info[OPT_SIZE], Equals, "25165824")
+
+	c.Assert(d.CreateSnapshot(Request{Name: "snap1", Options: map[string]string{OPT_VOLUME_NAME: "vol1"}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"lvcreate --snapshot -l 100%ORIGIN -n convoy_snap_snap1 " + testVolumeGroup + "/convoy_vol_vol1",
+	})
+	c.Assert(d.CreateSnapshot(Request{Name: "snap1", Options: map[string]string{OPT_VOLUME_NAME: "vol1"}}), ErrorMatches,
+		"Snapshot snap1 of volume vol1 already exists")
+	snapshots, err := d.ListSnapshot(map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(snapshots, HasLen, 1)
+	c.Assert(snapshots["snap1"]["LogicalVolume"], Equals, "convoy_snap_snap1")
+	c.Assert(snapshots["snap1"]["DataPercent"], Equals, "5.00")
+	s.readCommands(c)
+
+	// Volume of snapshot has the data copied
+	c.Assert(d.CreateVolume(Request{Name: "vol2", Options: map[string]string{
+		OPT_SNAPSHOT_NAME:        "snap1",
+		OPT_SNAPSHOT_VOLUME_NAME: "vol1",
+		OPT_SIZE:                 "16M",
+	}}), ErrorMatches, "Volume size must match with snapshot's size")
+	c.Assert(d.CreateVolume(Request{Name: "vol2", Options: map[string]string{
+		OPT_SNAPSHOT_NAME:        "snap1",
+		OPT_SNAPSHOT_VOLUME_NAME: "vol1",
+	}}), IsNil)
+	fsType, err = fs.Detect(filepath.Join(devDir, testVolumeGroup, "convoy_vol_vol2"))
+	c.Assert(err, IsNil)
+	c.Assert(fsType, Equals, DEFAULT_FS_TYPE)
+	info, err = d.GetVolumeInfo("vol2")
+	c.Assert(err, IsNil)
+	c.Assert(info[OPT_SIZE], Equals, "25165824")
+	s.readCommands(c)
+
+	// Snapshots are deleted with the volume
+	c.Assert(d.DeleteVolume(Request{Name: "vol1", Options: map[string]string{}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"lvremove -f " + testVolumeGroup + "/convoy_snap_snap1",
+		"lvremove -f " + testVolumeGroup + "/convoy_vol_vol1",
+	})
+	exists, err := util.ObjectExists(d.blankVolume("vol1"))
+	c.Assert(err, IsNil)
+	c.Assert(exists, Equals, false)
+}
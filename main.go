@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/rancher/convoy/api"
 	"github.com/rancher/convoy/client"
 )
 
@@ -15,8 +14,7 @@ var (
 
 func cleanup() {
 	if r := recover(); r != nil {
-		api.ResponseLogAndError(r)
-		os.Exit(1)
+		os.Exit(client.HandleError(r))
 	}
 }
 
@@ -26,6 +24,6 @@ func main() {
 	cli := client.NewCli(VERSION)
 	err := cli.Run(os.Args)
 	if err != nil {
-		panic(fmt.Errorf("Error when executing command: %v", err))
+		panic(fmt.Errorf("Error when executing command: %w", err))
 	}
 }
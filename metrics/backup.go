@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"time"
+)
+
+var (
+	BackupLastSuccess = NewGaugeVec("convoy_backup_last_success_timestamp_seconds",
+		"Unix time of the last successful backup of the volume to the destination.",
+		"volume", "destination")
+	BackupSuccesses = NewCounterVec("convoy_backup_success_total",
+		"Number of successful backups of the volume to the destination.",
+		"volume", "destination")
+	BackupFailures = NewCounterVec("convoy_backup_failure_total",
+		"Number of failed backups of the volume to the destination.",
+		"volume", "destination")
+
+	ObjectStoreRequestDuration = NewHistogramVec("convoy_objectstore_request_duration_seconds",
+		"Latency of objectstore requests by destination and operation.",
+		[]float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+		"destination", "operation")
+	ObjectStoreRequestFailures = NewCounterVec("convoy_objectstore_request_failure_total",
+		"Number of failed objectstore requests by destination and operation.",
+		"destination", "operation")
+	ObjectStoreBytesUploaded = NewCounterVec("convoy_objectstore_uploaded_bytes_total",
+		"Bytes uploaded to the destination by this daemon since it started, including objects removed later, rather than bytes stored in the destination.",
+		"destination")
+	ObjectStoreBytesRead = NewCounterVec("convoy_objectstore_read_bytes_total",
+		"Bytes read from the destination by this daemon.",
+		"destination")
+	ObjectStoreReadTime = NewCounterVec("convoy_objectstore_read_time_seconds_total",
+		"Time spent reading objects from the destination, from opening to closing them.",
+		"destination")
+)
+
+func RecordBackupSuccess(volume, destination string, t time.Time) {
+	BackupSuccesses.Inc(volume, destination)
+	BackupLastSuccess.Set(float64(t.Unix()), volume, destination)
+}
+
+func RecordBackupFailure(volume, destination string) {
+	BackupFailures.Inc(volume, destination)
+}
+
+// RecordObjectStoreRequest observes latency of an objectstore operation
+// started at start, and counts it as failure if err is not nil
+func RecordObjectStoreRequest(destination, operation string, start time.Time, err error) {
+	ObjectStoreRequestDuration.Observe(time.Since(start).Seconds(), destination, operation)
+	if err != nil {
+		ObjectStoreRequestFailures.Inc(destination, operation)
+	}
+}
+
+// RecordObjectStoreRead counts n bytes read from the destination in d
+func RecordObjectStoreRead(destination string, n int64, d time.Duration) {
+	ObjectStoreBytesRead.Add(float64(n), destination)
+	ObjectStoreReadTime.Add(d.Seconds(), destination)
+}
@@ -0,0 +1,328 @@
+/*
+Package metrics provides a minimal set of labeled counters, gauges and
+histograms, which can be exported in Prometheus text exposition format.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TYPE_COUNTER   = "counter"
+	TYPE_GAUGE     = "gauge"
+	TYPE_HISTOGRAM = "histogram"
+)
+
+type collector interface {
+	write(w io.Writer) error
+}
+
+var (
+	registryLock = &sync.Mutex{}
+	registry     = map[string]collector{}
+)
+
+func register(name string, c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("BUG: Metric %v has already been registered", name))
+	}
+	registry[name] = c
+}
+
+// WriteText outputs all registered metrics in Prometheus text format
+func WriteText(w io.Writer) error {
+	registryLock.Lock()
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryLock.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		registryLock.Lock()
+		c := registry[name]
+		registryLock.Unlock()
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("BUG: Metric %v expects labels %v, but got %v", d.name, d.labels, values))
+	}
+	return strings.Join(values, "\x00")
+}
+
+func (d *desc) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+	return err
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabelValue(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// valueVec is shared by counters and gauges
+type valueVec struct {
+	desc
+	mutex       sync.Mutex
+	values      map[string]float64
+	labelValues map[string][]string
+}
+
+func newValueVec(kind, name, help string, labels ...string) *valueVec {
+	v := &valueVec{
+		desc: desc{
+			name:   name,
+			help:   help,
+			kind:   kind,
+			labels: labels,
+		},
+		values:      map[string]float64{},
+		labelValues: map[string][]string{},
+	}
+	register(name, v)
+	return v
+}
+
+func (v *valueVec) update(values []string, f func(old float64) float64) {
+	key := v.key(values)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.values[key] = f(v.values[key])
+	v.labelValues[key] = values
+}
+
+// Sample is a value of a metric with the values of its labels
+type Sample struct {
+	Value  float64
+	Labels []string
+}
+
+func (v *valueVec) replace(samples []Sample) {
+	values := map[string]float64{}
+	labelValues := map[string][]string{}
+	for _, sample := range samples {
+		key := v.key(sample.Labels)
+		values[key] = sample.Value
+		labelValues[key] = sample.Labels
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.values = values
+	v.labelValues = labelValues
+}
+
+func (v *valueVec) get(values []string) float64 {
+	key := v.key(values)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.values[key]
+}
+
+func (v *valueVec) write(w io.Writer) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(v.labelValues) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.labelValues[key]), formatFloat(v.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type CounterVec struct {
+	*valueVec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newValueVec(TYPE_COUNTER, name, help, labels...)}
+}
+
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("BUG: Counter %v cannot decrease", c.name))
+	}
+	c.update(values, func(old float64) float64 { return old + delta })
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Get(values ...string) float64 {
+	return c.get(values)
+}
+
+// Replace replaces all the values of counter with samples, for the counters
+// counted elsewhere, e.g. by the kernel
+func (c *CounterVec) Replace(samples []Sample) {
+	c.replace(samples)
+}
+
+type GaugeVec struct {
+	*valueVec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newValueVec(TYPE_GAUGE, name, help, labels...)}
+}
+
+func (g *GaugeVec) Set(value float64, values ...string) {
+	g.update(values, func(old float64) float64 { return value })
+}
+
+func (g *GaugeVec) Get(values ...string) float64 {
+	return g.get(values)
+}
+
+// Replace replaces all the values of gauge with samples
+func (g *GaugeVec) Replace(samples []Sample) {
+	g.replace(samples)
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	desc
+	buckets     []float64
+	mutex       sync.Mutex
+	histograms  map[string]*histogram
+	labelValues map[string][]string
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		desc: desc{
+			name:   name,
+			help:   help,
+			kind:   TYPE_HISTOGRAM,
+			labels: labels,
+		},
+		buckets:     sorted,
+		histograms:  map[string]*histogram{},
+		labelValues: map[string][]string{},
+	}
+	register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := h.key(values)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, exists := h.histograms[key]
+	if !exists {
+		hist = &histogram{
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.histograms[key] = hist
+		h.labelValues[key] = values
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// Count returns the number of observations of the labels
+func (h *HistogramVec) Count(values ...string) uint64 {
+	key := h.key(values)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if hist, exists := h.histograms[key]; exists {
+		return hist.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(h.labelValues) {
+		hist := h.histograms[key]
+		values := h.labelValues[key]
+		for i, bound := range h.buckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labels, values, "le", formatFloat(bound)), hist.counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(h.labels, values, "le", "+Inf"), hist.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", h.name,
+			formatLabels(h.labels, values), formatFloat(hist.sum)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_count%s %d\n", h.name,
+			formatLabels(h.labels, values), hist.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
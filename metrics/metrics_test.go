@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct{}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) TestTextFormat(c *C) {
+	counter := NewCounterVec("test_requests_total", "Number of requests.", "path")
+	gauge := NewGaugeVec("test_temperature", "Current temperature.", "room", "floor")
+	histogram := NewHistogramVec("test_latency_seconds", "Latency.", []float64{1, 0.1}, "path")
+
+	counter.Inc("/a")
+	counter.Add(2, "/b\"")
+	gauge.Set(21.5, "kitchen", "1")
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.5, "/a")
+	histogram.Observe(5, "/a")
+
+	c.Assert(counter.Get("/a"), Equals, float64(1))
+	c.Assert(histogram.Count("/a"), Equals, uint64(3))
+
+	buf := &bytes.Buffer{}
+	c.Assert(WriteText(buf), IsNil)
+	output := buf.String()
+
+	for _, expected := range []string{
+		"# HELP test_requests_total Number of requests.\n# TYPE test_requests_total counter\n",
+		"test_requests_total{path=\"/a\"} 1\n",
+		"test_requests_total{path=\"/b\\\"\"} 2\n",
+		"# TYPE test_temperature gauge\n",
+		"test_temperature{room=\"kitchen\",floor=\"1\"} 21.5\n",
+		"# TYPE test_latency_seconds histogram\n",
+		"test_latency_seconds_bucket{path=\"/a\",le=\"0.1\"} 1\n",
+		"test_latency_seconds_bucket{path=\"/a\",le=\"1\"} 2\n",
+		"test_latency_seconds_bucket{path=\"/a\",le=\"+Inf\"} 3\n",
+		"test_latency_seconds_sum{path=\"/a\"} 5.55\n",
+		"test_latency_seconds_count{path=\"/a\"} 3\n",
+	} {
+		c.Assert(bytes.Contains(buf.Bytes(), []byte(expected)), Equals, true,
+			Commentf("Cannot find %q in output:\n%v", expected, output))
+	}
+}
+
+func (s *TestSuite) TestBackupMetrics(c *C) {
+	now := time.Now()
+	RecordBackupFailure("vol1", "s3://bucket@us-west-2/backups")
+	RecordBackupSuccess("vol1", "vfs:///var/backups", now)
+
+	c.Assert(BackupFailures.Get("vol1", "s3://bucket@us-west-2/backups"), Equals, float64(1))
+	c.Assert(BackupFailures.Get("vol1", "vfs:///var/backups"), Equals, float64(0))
+	c.Assert(BackupSuccesses.Get("vol1", "vfs:///var/backups"), Equals, float64(1))
+	c.Assert(BackupLastSuccess.Get("vol1", "vfs:///var/backups"), Equals, float64(now.Unix()))
+}
+
+func (s *TestSuite) TestVolumeIOMetrics(c *C) {
+	RecordVolumeIO([]VolumeIO{
+		{Volume: "vol1", Device: "dm-1", ReadBytes: 4096, Writes: 2, WriteSeconds: 0.5},
+		{Volume: "vol2", Device: "xvdf", InProgress: 3},
+	})
+	c.Assert(VolumeReadBytes.Get("vol1", "dm-1"), Equals, float64(4096))
+	c.Assert(VolumeWrites.Get("vol1", "dm-1"), Equals, float64(2))
+	c.Assert(VolumeWriteTime.Get("vol1", "dm-1"), Equals, 0.5)
+	c.Assert(VolumeIOInProgress.Get("vol2", "xvdf"), Equals, float64(3))
+
+	// Volumes not recorded again are dropped
+	RecordVolumeIO([]VolumeIO{
+		{Volume: "vol1", Device: "dm-1", ReadBytes: 8192},
+	})
+	buf := &bytes.Buffer{}
+	c.Assert(WriteText(buf), IsNil)
+	c.Assert(bytes.Contains(buf.Bytes(), []byte("convoy_volume_read_bytes_total{volume=\"vol1\",device=\"dm-1\"} 8192\n")), Equals, true)
+	c.Assert(bytes.Contains(buf.Bytes(), []byte("vol2")), Equals, false)
+}
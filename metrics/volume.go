@@ -0,0 +1,66 @@
+package metrics
+
+var (
+	VolumeReadBytes = NewCounterVec("convoy_volume_read_bytes_total",
+		"Bytes read from the block device of the mounted volume.",
+		"volume", "device")
+	VolumeWrittenBytes = NewCounterVec("convoy_volume_written_bytes_total",
+		"Bytes written to the block device of the mounted volume.",
+		"volume", "device")
+	VolumeReads = NewCounterVec("convoy_volume_reads_total",
+		"Number of reads completed by the block device of the mounted volume.",
+		"volume", "device")
+	VolumeWrites = NewCounterVec("convoy_volume_writes_total",
+		"Number of writes completed by the block device of the mounted volume.",
+		"volume", "device")
+	VolumeReadTime = NewCounterVec("convoy_volume_read_time_seconds_total",
+		"Time spent on reads by the block device of the mounted volume.",
+		"volume", "device")
+	VolumeWriteTime = NewCounterVec("convoy_volume_write_time_seconds_total",
+		"Time spent on writes by the block device of the mounted volume.",
+		"volume", "device")
+	VolumeIOTime = NewCounterVec("convoy_volume_io_time_seconds_total",
+		"Time the block device of the mounted volume has been busy with IO.",
+		"volume", "device")
+	VolumeIOInProgress = NewGaugeVec("convoy_volume_io_in_progress",
+		"Number of IOs in progress on the block device of the mounted volume.",
+		"volume", "device")
+)
+
+// VolumeIO is the IO of the block device of a volume since the device is
+// created
+type VolumeIO struct {
+	Volume       string
+	Device       string
+	ReadBytes    uint64
+	WrittenBytes uint64
+	Reads        uint64
+	Writes       uint64
+	ReadSeconds  float64
+	WriteSeconds float64
+	IOSeconds    float64
+	InProgress   uint64
+}
+
+// RecordVolumeIO replaces the IO metrics of volumes with the ones of
+// volumes, so the volumes no longer mounted are dropped
+func RecordVolumeIO(volumes []VolumeIO) {
+	samples := make([][]Sample, 8)
+	for _, v := range volumes {
+		labels := []string{v.Volume, v.Device}
+		for i, value := range []float64{
+			float64(v.ReadBytes), float64(v.WrittenBytes), float64(v.Reads), float64(v.Writes),
+			v.ReadSeconds, v.WriteSeconds, v.IOSeconds, float64(v.InProgress),
+		} {
+			samples[i] = append(samples[i], Sample{Value: value, Labels: labels})
+		}
+	}
+	VolumeReadBytes.Replace(samples[0])
+	VolumeWrittenBytes.Replace(samples[1])
+	VolumeReads.Replace(samples[2])
+	VolumeWrites.Replace(samples[3])
+	VolumeReadTime.Replace(samples[4])
+	VolumeWriteTime.Replace(samples[5])
+	VolumeIOTime.Replace(samples[6])
+	VolumeIOInProgress.Replace(samples[7])
+}
@@ -0,0 +1,166 @@
+package objectstore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	// Status of the data of archived backup, see Archiver
+	ARCHIVE_STATUS_AVAILABLE = "available"
+	ARCHIVE_STATUS_ARCHIVED  = "archived"
+	ARCHIVE_STATUS_RESTORING = "restoring"
+	ARCHIVE_STATUS_RESTORED  = "restored"
+	// Retrieval has been requested, but the objectstore wasn't asked
+	// whether it has completed
+	ARCHIVE_STATUS_RESTORE_REQUESTED = "restore-requested"
+
+	DEFAULT_ARCHIVE_RESTORE_DAYS = 7
+)
+
+/*
+Archiver is implemented by drivers which can move objects to another storage
+class, e.g. STANDARD_IA or GLACIER of S3. Objects in archive classes cannot
+be read until a temporary copy has been restored.
+
+ValidateStorageClass returns whether the storage class is an archive one.
+RestoreArchive initiates the retrieval of an archived object, whose copy
+would be kept for days, and tier decides how fast it's retrieved, empty for
+the default. GetArchiveStatus returns ARCHIVE_STATUS_ARCHIVED, _RESTORING or
+_RESTORED for archived objects, and ARCHIVE_STATUS_AVAILABLE otherwise.
+*/
+type Archiver interface {
+	ValidateStorageClass(storageClass string) (bool, error)
+	SetStorageClass(filePath, storageClass string) error
+	RestoreArchive(filePath string, days int64, tier string) error
+	GetArchiveStatus(filePath string) (string, error)
+}
+
+func getArchiver(driver ObjectStoreDriver) (Archiver, error) {
+	if a, ok := unwrapDriver(driver).(Archiver); ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("Storage classes are not supported by %v destination %v", driver.Kind(), driver.GetURL())
+}
+
+// loadArchivableBackup returns the backup of backupURL and the archiver of
+// its objectstore. Only backups in a single file can be archived, since
+// blocks of delta block backups are shared with other backups, including
+// the ones created later.
+func loadArchivableBackup(backupURL string) (*Backup, ObjectStoreDriver, Archiver, error) {
+	driver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	archiver, err := getArchiver(driver)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if backup.SingleFile.FilePath == "" {
+		return nil, nil, nil, fmt.Errorf("Cannot archive backup %v, blocks of delta block backup are shared with other backups", backupURL)
+	}
+	return backup, driver, archiver, nil
+}
+
+// checkArchiveRestored fails if data of backup is archived and hasn't been
+// restored yet
+func checkArchiveRestored(backup *Backup, driver ObjectStoreDriver) error {
+	if !backup.Archived {
+		return nil
+	}
+	archiver, err := getArchiver(driver)
+	if err != nil {
+		return err
+	}
+	status, err := archiver.GetArchiveStatus(backup.SingleFile.FilePath)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case ARCHIVE_STATUS_ARCHIVED:
+		return fmt.Errorf("Backup %v is archived in %v, it must be restored by \"backup restore-archive\" first", backup.Name, backup.StorageClass)
+	case ARCHIVE_STATUS_RESTORING:
+		return fmt.Errorf("Backup %v is still being restored from %v, try again later", backup.Name, backup.StorageClass)
+	}
+	return nil
+}
+
+/*
+ArchiveBackup moves the data of backup to storageClass. The configs of
+backup and volume stay in the default storage class, so the backup can
+still be listed and inspected. Backup already in an archive class must be
+restored before being moved again.
+*/
+func ArchiveBackup(backupURL, storageClass string) error {
+	backup, driver, archiver, err := loadArchivableBackup(backupURL)
+	if err != nil {
+		return err
+	}
+	archived, err := archiver.ValidateStorageClass(storageClass)
+	if err != nil {
+		return err
+	}
+	if err := checkArchiveRestored(backup, driver); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_START,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_BACKUP_URL: backupURL,
+	}).Debugf("Moving backup to storage class %v", storageClass)
+	if err := archiver.SetStorageClass(backup.SingleFile.FilePath, storageClass); err != nil {
+		return err
+	}
+	backup.StorageClass = storageClass
+	backup.Archived = archived
+	backup.ArchivedAt = util.Now()
+	backup.ArchiveRestoreExpiry = ""
+	return saveBackup(backup, driver)
+}
+
+// RestoreArchivedBackup initiates the retrieval of archived backup, which can
+// be restored once it's completed. The retrieved copy is kept for days.
+func RestoreArchivedBackup(backupURL string, days int64, tier string) error {
+	if days <= 0 {
+		return fmt.Errorf("Invalid days %v, must be a positive integer", days)
+	}
+	backup, driver, archiver, err := loadArchivableBackup(backupURL)
+	if err != nil {
+		return err
+	}
+	if !backup.Archived {
+		return fmt.Errorf("Backup %v is not archived", backupURL)
+	}
+	if err := archiver.RestoreArchive(backup.SingleFile.FilePath, days, tier); err != nil {
+		return err
+	}
+	backup.ArchiveRestoreExpiry = time.Now().Add(time.Duration(days) * 24 * time.Hour).UTC().Format(time.RFC3339)
+	return saveBackup(backup, driver)
+}
+
+// archiveStatus returns the status of backup known from its config, without
+// asking the objectstore
+func archiveStatus(backup *Backup) string {
+	if !backup.Archived {
+		return ARCHIVE_STATUS_AVAILABLE
+	}
+	if expiry, err := time.Parse(time.RFC3339, backup.ArchiveRestoreExpiry); err == nil && time.Now().Before(expiry) {
+		return ARCHIVE_STATUS_RESTORE_REQUESTED
+	}
+	return ARCHIVE_STATUS_ARCHIVED
+}
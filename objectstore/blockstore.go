@@ -0,0 +1,323 @@
+package objectstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+Blocks of delta block backups are content addressed, and by default stored
+per volume, so a volume shares blocks among its backups only. With shared
+blocks enabled, new backups store their blocks in the block store of the
+destination instead, shared by the backups of every volume. Deleting such a
+backup leaves its blocks in place, since other volumes may refer to them, and
+CollectSharedBlocks() removes the ones no backup refers to by mark and sweep.
+
+Backups and garbage collection, including CollectOrphans(), exclude each
+other by markers in the destination, refreshed while they're running: each
+one writes its marker then checks the other's, so at least one of them sees
+the other and gives up. Markers which haven't been refreshed for
+MARKER_STALE_TIMEOUT are left by crashed daemons and ignored.
+*/
+
+const (
+	MARKERS_DIRECTORY     = "markers"
+	GC_MARKER_NAME        = "gc"
+	BACKUP_MARKER_PREFIX  = "backup_"
+	MARKER_REFRESH_PERIOD = time.Minute
+	MARKER_STALE_TIMEOUT  = 10 * time.Minute
+)
+
+var (
+	// Accessed atomically like concurrency
+	sharedBlocks int32
+)
+
+// SetSharedBlocks sets whether new delta block backups would store blocks in
+// the block store shared by all volumes of the destination. Backups record
+// the block store they use, so existing ones are not affected.
+func SetSharedBlocks(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&sharedBlocks, value)
+}
+
+func sharedBlocksEnabled() bool {
+	return atomic.LoadInt32(&sharedBlocks) != 0
+}
+
+func getSharedBlockPath() string {
+	return filepath.Join(OBJECTSTORE_BASE, BLOCKS_DIRECTORY) + "/"
+}
+
+type marker struct {
+	Host        string
+	UpdatedTime string
+}
+
+func getMarkerPath(name string) string {
+	return filepath.Join(OBJECTSTORE_BASE, MARKERS_DIRECTORY, name+CFG_SUFFIX)
+}
+
+func saveMarker(name string, driver ObjectStoreDriver) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	return saveConfigInObjectStore(getMarkerPath(name), driver, &marker{
+		Host:        host,
+		UpdatedTime: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// holdMarker saves the marker of name and keeps refreshing it, until the
+// returned function is called to remove it
+func holdMarker(name string, driver ObjectStoreDriver) (func(), error) {
+	if err := saveMarker(name, driver); err != nil {
+		return nil, err
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	GoWithRequestID(func() {
+		defer close(done)
+		ticker := time.NewTicker(MARKER_REFRESH_PERIOD)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := saveMarker(name, driver); err != nil {
+					log.Warnf("Failed to refresh marker %v: %v", name, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	})
+	return func() {
+		close(stop)
+		<-done
+		if err := driver.Remove(getMarkerPath(name)); err != nil {
+			log.Warnf("Failed to remove marker %v: %v", name, err)
+		}
+	}, nil
+}
+
+// listActiveMarkers returns the names of markers with prefix which have been
+// refreshed within MARKER_STALE_TIMEOUT
+func listActiveMarkers(prefix string, driver ObjectStoreDriver) ([]string, error) {
+	names := []string{}
+	files, err := driver.List(filepath.Join(OBJECTSTORE_BASE, MARKERS_DIRECTORY))
+	if err != nil {
+		// Directory doesn't exist
+		return names, nil
+	}
+	now := time.Now()
+	for _, file := range files {
+		if !strings.HasPrefix(file, prefix) || !strings.HasSuffix(file, CFG_SUFFIX) {
+			continue
+		}
+		name := strings.TrimSuffix(file, CFG_SUFFIX)
+		m := &marker{}
+		if err := loadConfigInObjectStore(getMarkerPath(name), driver, m); err != nil {
+			// Removed meanwhile
+			continue
+		}
+		updated, err := time.Parse(time.RFC3339, m.UpdatedTime)
+		if err != nil || now.Sub(updated) > MARKER_STALE_TIMEOUT {
+			log.Debugf("Ignore stale marker %v of host %v updated at %v", name, m.Host, m.UpdatedTime)
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// startBackup marks backupName as being created, unless garbage collection
+// is running, since the objects it uploads aren't referred to until it's
+// saved. The progress of the backup is tracked until it's released.
+func startBackup(backupName, volumeName string, driver ObjectStoreDriver) (*backupProgress, func(), error) {
+	release, err := holdMarker(BACKUP_MARKER_PREFIX+backupName, driver)
+	if err != nil {
+		return nil, nil, err
+	}
+	gc, err := listActiveMarkers(GC_MARKER_NAME, driver)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if len(gc) != 0 {
+		release()
+		return nil, nil, fmt.Errorf("Garbage collection is running in %v, retry once it's done", driver.GetURL())
+	}
+	progress, untrack := trackBackup(backupName, volumeName, driver)
+	return progress, func() {
+		untrack()
+		release()
+	}, nil
+}
+
+// startGC marks garbage collection as running, unless backups are being
+// created
+func startGC(driver ObjectStoreDriver) (func(), error) {
+	release, err := holdMarker(GC_MARKER_NAME, driver)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := listActiveMarkers(BACKUP_MARKER_PREFIX, driver)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if len(backups) != 0 {
+		release()
+		for i := range backups {
+			backups[i] = strings.TrimPrefix(backups[i], BACKUP_MARKER_PREFIX)
+		}
+		return nil, fmt.Errorf("Backups %v are being created in %v, retry garbage collection once they're done",
+			strings.Join(backups, ", "), driver.GetURL())
+	}
+	return release, nil
+}
+
+type BlockGCResult struct {
+	// Backups referring to shared blocks
+	Backups int
+	// Blocks in the shared block store, and the ones no backup refers to
+	Blocks             int
+	UnreferencedBlocks int
+	// Unreferenced blocks removed, none for dry run
+	RemovedBlocks int
+}
+
+/*
+CollectSharedBlocks removes the blocks in the shared block store of destURL
+which no backup refers to. Blocks of every backup in destURL are marked
+first, then the block store is swept. Dry run only counts the unreferenced
+blocks. It fails if backups with shared blocks are being created, since their
+blocks are not marked yet.
+*/
+func CollectSharedBlocks(destURL string, dryRun bool) (*BlockGCResult, error) {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		release, err := startGC(driver)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_DELETE,
+		LOG_FIELD_DEST_URL: destURL,
+	}).Debug("Collecting unreferenced shared blocks")
+
+	result := &BlockGCResult{}
+	referenced, err := markSharedBlocks(driver, result)
+	if err != nil {
+		return nil, err
+	}
+	blocks, unreferenced, _, err := sweepBlocks(getSharedBlockPath(), referenced, driver)
+	if err != nil {
+		return nil, err
+	}
+	result.Blocks = blocks
+	result.UnreferencedBlocks = len(unreferenced)
+	if !dryRun && len(unreferenced) != 0 {
+		if err := driver.Remove(unreferenced...); err != nil {
+			return nil, err
+		}
+		result.RemovedBlocks = len(unreferenced)
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_DELETE,
+		LOG_FIELD_DEST_URL: destURL,
+	}).Debugf("Collected unreferenced shared blocks: %+v", *result)
+	return result, nil
+}
+
+// markSharedBlocks returns the paths of shared blocks referred to by backups
+// of every volume
+func markSharedBlocks(driver ObjectStoreDriver, result *BlockGCResult) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	volumeNames, err := getVolumeNames(driver)
+	if err != nil {
+		return nil, err
+	}
+	for _, volumeName := range volumeNames {
+		backupNames, err := getBackupNamesForVolume(volumeName, driver)
+		if err != nil {
+			return nil, err
+		}
+		for _, backupName := range backupNames {
+			backup, err := loadBackup(backupName, volumeName, driver)
+			if err != nil {
+				return nil, err
+			}
+			if !backup.SharedBlocks {
+				continue
+			}
+			result.Backups++
+			for _, blk := range backup.Blocks {
+				referenced[getBlockFilePath(getSharedBlockPath(), blk.BlockChecksum, backup.ChecksumAlgorithm, backup.EncryptionKeyID, backup.Compression)] = true
+			}
+		}
+	}
+	return referenced, nil
+}
+
+/*
+sweepBlocks lists the block store of blockPath, and returns the number of
+blocks in it, the paths of blocks not in referenced, and the paths of the
+other files in it, e.g. left by interrupted writes.
+*/
+func sweepBlocks(blockPath string, referenced map[string]bool, driver ObjectStoreDriver) (int, []string, []string, error) {
+	blocks := 0
+	unreferenced := []string{}
+	others := []string{}
+	lv1Dirs, err := driver.List(blockPath)
+	if err != nil {
+		// Directory doesn't exist
+		return 0, unreferenced, others, nil
+	}
+	for _, lv1 := range lv1Dirs {
+		lv2Dirs, err := driver.List(filepath.Join(blockPath, lv1))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		for _, lv2 := range lv2Dirs {
+			files, err := driver.List(filepath.Join(blockPath, lv1, lv2))
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			for _, file := range files {
+				path := filepath.Join(blockPath, lv1, lv2, file)
+				if filepath.Ext(file) != ".blk" {
+					others = append(others, path)
+					continue
+				}
+				blocks++
+				if !referenced[path] {
+					log.Debugf("Found unreferenced block %v", path)
+					unreferenced = append(unreferenced, path)
+				}
+			}
+		}
+	}
+	return blocks, unreferenced, others, nil
+}
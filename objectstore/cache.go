@@ -0,0 +1,147 @@
+package objectstore
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+)
+
+/*
+VersionLister is implemented by drivers which can list the files in path
+along with their versions in a request, e.g. ETag of S3 or modification time
+of VFS. Version changes whenever the file is written, so configs loaded
+before can be reused from metadataCache without reading them again.
+Directories are not listed.
+*/
+type VersionLister interface {
+	ListVersions(path string) (map[string]string, error)
+}
+
+// getVersionLister returns nil if the driver cannot list versions
+func getVersionLister(driver ObjectStoreDriver) VersionLister {
+	if _, ok := unwrapDriver(driver).(VersionLister); !ok {
+		return nil
+	}
+	return driver.(VersionLister)
+}
+
+type cachedConfig struct {
+	version string
+	data    []byte
+}
+
+/*
+metadataCache keeps the configs loaded by ListWithOptions, keyed by the
+destination and the directory they're in, so listing a large objectstore
+again only reads the configs which have changed since.
+*/
+type metadataCache struct {
+	mutex sync.Mutex
+	dirs  map[string]map[string]cachedConfig
+}
+
+var configCache = &metadataCache{}
+
+func cacheDirKey(driver ObjectStoreDriver, dir string) string {
+	return driver.GetURL() + "|" + filepath.Clean(dir)
+}
+
+func (c *metadataCache) get(dirKey, name, version string, v interface{}) bool {
+	c.mutex.Lock()
+	config, exists := c.dirs[dirKey][name]
+	c.mutex.Unlock()
+	if !exists || config.version != version {
+		return false
+	}
+	return json.Unmarshal(config.data, v) == nil
+}
+
+func (c *metadataCache) put(dirKey, name, version string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.dirs == nil {
+		c.dirs = make(map[string]map[string]cachedConfig)
+	}
+	if c.dirs[dirKey] == nil {
+		c.dirs[dirKey] = make(map[string]cachedConfig)
+	}
+	c.dirs[dirKey][name] = cachedConfig{
+		version: version,
+		data:    data,
+	}
+}
+
+// retain drops the configs in the directory which no longer exist
+func (c *metadataCache) retain(dirKey string, versions map[string]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for name := range c.dirs[dirKey] {
+		if _, exists := versions[name]; !exists {
+			delete(c.dirs[dirKey], name)
+		}
+	}
+	if len(c.dirs[dirKey]) == 0 {
+		delete(c.dirs, dirKey)
+	}
+}
+
+/*
+cachedLister loads the configs of a destination for listing. With noCache,
+e.g. --no-cache is specified, cached configs are not used but still
+refreshed. Configs are always read from the destination if the driver
+cannot list versions.
+*/
+type cachedLister struct {
+	driver  ObjectStoreDriver
+	lister  VersionLister
+	noCache bool
+}
+
+func newCachedLister(driver ObjectStoreDriver, noCache bool) *cachedLister {
+	return &cachedLister{
+		driver:  driver,
+		lister:  getVersionLister(driver),
+		noCache: noCache,
+	}
+}
+
+// listVersions returns nil versions if they cannot be listed
+func (l *cachedLister) listVersions(dir string) (map[string]string, error) {
+	if l.lister == nil {
+		return nil, nil
+	}
+	versions, err := l.lister.ListVersions(dir)
+	if err != nil {
+		return nil, err
+	}
+	configCache.retain(cacheDirKey(l.driver, dir), versions)
+	return versions, nil
+}
+
+/*
+loadConfig loads the config at dir/name into v, which is taken from cache if
+its version is the same as the listed one. trim drops the fields of v which
+aren't needed for listing before it's cached, e.g. blocks of backup, it can
+be nil.
+*/
+func (l *cachedLister) loadConfig(dir, name string, versions map[string]string, v interface{}, trim func()) error {
+	dirKey := cacheDirKey(l.driver, dir)
+	version, listed := versions[name]
+	if listed && !l.noCache && configCache.get(dirKey, name, version, v) {
+		return nil
+	}
+	if err := loadConfigInObjectStore(filepath.Join(dir, name), l.driver, v); err != nil {
+		return err
+	}
+	if trim != nil {
+		trim()
+	}
+	if listed {
+		configCache.put(dirKey, name, version, v)
+	}
+	return nil
+}
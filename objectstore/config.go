@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/util"
@@ -19,6 +20,7 @@ const (
 
 	VOLUME_DIRECTORY     = "volumes"
 	VOLUME_CONFIG_FILE   = "volume.cfg"
+	VOLUME_LOCK_FILE     = "volume.lock"
 	BACKUP_DIRECTORY     = "backups"
 	BACKUP_CONFIG_PREFIX = "backup_"
 
@@ -154,7 +156,15 @@ func getBackupNamesForVolume(volumeName string, driver ObjectStoreDriver) ([]str
 		// path doesn't exist
 		return result, nil
 	}
-	return util.ExtractNames(fileList, BACKUP_CONFIG_PREFIX, CFG_SUFFIX)
+	// Skip temporary files being written by other daemons sharing the
+	// objectstore
+	cfgList := []string{}
+	for _, name := range fileList {
+		if strings.HasSuffix(name, CFG_SUFFIX) {
+			cfgList = append(cfgList, name)
+		}
+	}
+	return util.ExtractNames(cfgList, BACKUP_CONFIG_PREFIX, CFG_SUFFIX)
 }
 
 func getBackupPath(volumeName string) string {
@@ -176,10 +186,14 @@ func loadBackup(backupName, volumeName string, bsDriver ObjectStoreDriver) (*Bac
 	if err := loadConfigInObjectStore(getBackupConfigPath(backupName, volumeName), bsDriver, backup); err != nil {
 		return nil, err
 	}
+	if err := addBackupWrappedKey(backup); err != nil {
+		return nil, err
+	}
 	return backup, nil
 }
 
 func saveBackup(backup *Backup, bsDriver ObjectStoreDriver) error {
+	setBackupWrappedKey(backup)
 	filePath := getBackupConfigPath(backup.Name, backup.VolumeName)
 	if bsDriver.FileExists(filePath) {
 		log.Warnf("Snapshot configuration file %v already exists, would remove it\n", filePath)
@@ -0,0 +1,296 @@
+package objectstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+CopyBackup copies the backup of backupURL to the objectstore of destURL, and
+returns the URL of the copy. The backups it's incremental to are copied
+first, unless they're in destURL already, so the copy can be restored from
+destURL alone. Backups keep their names, so copying a backup again returns
+the existing copy. The data is streamed through the daemon as is: blocks
+already in destURL are skipped, and encrypted data is restored with the same
+key. Archived backup must be restored by RestoreArchivedBackup first.
+*/
+func CopyBackup(backupURL, destURL string) (string, error) {
+	srcDriver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return "", err
+	}
+	dstDriver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return "", err
+	}
+	if srcDriver.GetURL() == dstDriver.GetURL() {
+		return "", fmt.Errorf("Backup %v is in %v already", backupURL, destURL)
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return "", err
+	}
+	volume, err := loadVolume(volumeName, srcDriver)
+	if err != nil {
+		return "", err
+	}
+	backup, err := loadBackup(backupName, volumeName, srcDriver)
+	if err != nil {
+		return "", err
+	}
+	copyURL := encodeBackupURL(backupName, volumeName, destURL)
+	if backupExists(backupName, volumeName, dstDriver) {
+		log.Debugf("Backup %v of volume %v has been copied to %v already", backupName, volumeName, destURL)
+		return copyURL, nil
+	}
+
+	if err := addVolume(&Volume{
+		Name:        volume.Name,
+		Driver:      volume.Driver,
+		Size:        volume.Size,
+		CreatedTime: volume.CreatedTime,
+	}, dstDriver); err != nil {
+		return "", err
+	}
+	dstVolume, err := loadVolume(volumeName, dstDriver)
+	if err != nil {
+		return "", err
+	}
+	if dstVolume.Driver != volume.Driver {
+		return "", fmt.Errorf("Cannot copy backup %v of volume %v created by driver %v, the volume in %v is of driver %v",
+			backupName, volumeName, volume.Driver, destURL, dstVolume.Driver)
+	}
+
+	chain, err := loadMissingChain(backup, srcDriver, dstDriver)
+	if err != nil {
+		return "", err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_START,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+		LOG_FIELD_DEST_URL:   destURL,
+	}).Debugf("Copying %v backups", len(chain))
+	for _, b := range chain {
+		if err := copyBackup(b, srcDriver, dstDriver); err != nil {
+			return "", err
+		}
+	}
+	if err := updateVolumeForCopiedBackup(backup, dstDriver); err != nil {
+		return "", err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:     LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:      LOG_EVENT_BACKUP,
+		LOG_FIELD_VOLUME:     volumeName,
+		LOG_FIELD_BACKUP_URL: backupURL,
+		LOG_FIELD_DEST_URL:   destURL,
+	}).Debugf("Copied %v backups", len(chain))
+	return copyURL, nil
+}
+
+// loadMissingChain returns backup and the backups it's incremental to which
+// aren't in dstDriver, in the order they're copied
+func loadMissingChain(backup *Backup, srcDriver, dstDriver ObjectStoreDriver) ([]*Backup, error) {
+	chain := []*Backup{backup}
+	seen := map[string]bool{backup.Name: true}
+	for name := backup.ParentBackupName; name != "" && !backupExists(name, backup.VolumeName, dstDriver); {
+		if seen[name] {
+			return nil, fmt.Errorf("BUG: Backup %v of volume %v is incremental to itself", name, backup.VolumeName)
+		}
+		seen[name] = true
+		parent, err := loadBackup(name, backup.VolumeName, srcDriver)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load backup %v, which backup %v is incremental to: %v", name, backup.Name, err)
+		}
+		chain = append([]*Backup{parent}, chain...)
+		name = parent.ParentBackupName
+	}
+	for _, b := range chain {
+		if err := checkArchiveRestored(b, srcDriver); err != nil {
+			return nil, err
+		}
+	}
+	return chain, nil
+}
+
+// copyBackup uploads the data of backup to dstDriver, then saves its config
+// there. The copy is in the default storage class of dstDriver.
+func copyBackup(backup *Backup, srcDriver, dstDriver ObjectStoreDriver) error {
+	// The data uploaded must not be collected before the config is saved
+	progress, release, err := startBackup(backup.Name, backup.VolumeName, dstDriver)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	copied := *backup
+	copied.ServerSideEncryption = getServerSideEncryption(dstDriver)
+	copied.StorageClass = ""
+	copied.Archived = false
+	copied.ArchivedAt = ""
+	copied.ArchiveRestoreExpiry = ""
+
+	if len(backup.Blocks) != 0 {
+		if err := copyBlocks(srcDriver, dstDriver, backup, progress); err != nil {
+			return err
+		}
+	}
+	if backup.SingleFile.FilePath != "" {
+		copied.SingleFile.FilePath = getSingleFileBackupFilePath(&copied)
+		if err := copyFile(srcDriver, dstDriver, backup.SingleFile.FilePath, copied.SingleFile.FilePath, progress); err != nil {
+			return err
+		}
+	}
+	return saveBackup(&copied, dstDriver)
+}
+
+// copyFile copies the file of srcPath to dstPath through a temporary file,
+// since the file can be too large to be held in memory
+func copyFile(srcDriver, dstDriver ObjectStoreDriver, srcPath, dstPath string, progress *backupProgress) error {
+	if err := util.CheckStagingSpace(srcDriver.FileSize(srcPath), "copy of "+srcPath); err != nil {
+		return err
+	}
+	tmpDir, err := util.CreateStagingDir("copy-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpFile := filepath.Join(tmpDir, filepath.Base(srcPath))
+	if err := srcDriver.Download(srcPath, tmpFile); err != nil {
+		return err
+	}
+	if err := dstDriver.Upload(tmpFile, dstPath); err != nil {
+		return err
+	}
+	if st, err := os.Stat(tmpFile); err == nil {
+		progress.addUploaded(st.Size())
+	}
+	return nil
+}
+
+// copyBlocks copies the blocks of backup which aren't in dstDriver yet with
+// a pool of workers
+func copyBlocks(srcDriver, dstDriver ObjectStoreDriver, backup *Backup, progress *backupProgress) error {
+	known := &blockSet{
+		blocks: make(map[string]bool),
+	}
+	workers := getConcurrency(dstDriver)
+	if n := getConcurrency(srcDriver); n < workers {
+		workers = n
+	}
+	paths := make(chan string, workers)
+	errOnce := newErrorOnce()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		GoWithRequestID(func() {
+			defer wg.Done()
+			for path := range paths {
+				if errOnce.get() != nil {
+					continue
+				}
+				if err := copyBlock(srcDriver, dstDriver, path, progress); err != nil {
+					errOnce.set(err)
+					continue
+				}
+				progress.doneBlock()
+			}
+		})
+	}
+
+	blockPath := getBackupBlockPath(backup)
+feed:
+	for _, block := range backup.Blocks {
+		path := getBlockFilePath(blockPath, block.BlockChecksum, backup.ChecksumAlgorithm, backup.EncryptionKeyID, backup.Compression)
+		if !known.claim(path) {
+			continue
+		}
+		progress.addTotalBlocks(1)
+		select {
+		case paths <- path:
+		case <-errOnce.stop:
+			break feed
+		}
+	}
+	close(paths)
+	wg.Wait()
+	return errOnce.get()
+}
+
+func copyBlock(srcDriver, dstDriver ObjectStoreDriver, path string, progress *backupProgress) error {
+	if dstDriver.FileSize(path) >= 0 {
+		log.Debugf("Found existing block %v in %v, skip", path, dstDriver.GetURL())
+		return nil
+	}
+	rc, err := srcDriver.Read(path)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if err := dstDriver.Write(path, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	progress.addUploaded(int64(len(data)))
+	return nil
+}
+
+// updateVolumeForCopiedBackup records backup as the last backup of volume
+// in driver, if it's newer than the last one there, so the next backup to it
+// can be incremental to the copy. The size is updated if volume has grown.
+func updateVolumeForCopiedBackup(backup *Backup, driver ObjectStoreDriver) error {
+	unlock, err := lockVolume(backup.VolumeName, driver)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	volume, err := loadVolume(backup.VolumeName, driver)
+	if err != nil {
+		return err
+	}
+	newer := true
+	if volume.LastBackupName != "" && backupExists(volume.LastBackupName, volume.Name, driver) {
+		last, err := loadBackup(volume.LastBackupName, volume.Name, driver)
+		if err != nil {
+			return err
+		}
+		newer = createdAfter(backup, last)
+	}
+	if newer {
+		volume.LastBackupName = backup.Name
+	}
+	if backup.VolumeSize > volume.Size {
+		volume.Size = backup.VolumeSize
+	}
+	return saveVolume(volume, driver)
+}
+
+// createdAfter returns whether backup is created after other, or the created
+// time of either cannot be told
+func createdAfter(backup, other *Backup) bool {
+	t, err := time.Parse(time.RubyDate, backup.CreatedTime)
+	if err != nil {
+		return true
+	}
+	otherTime, err := time.Parse(time.RubyDate, other.CreatedTime)
+	if err != nil {
+		return true
+	}
+	return t.After(otherTime)
+}
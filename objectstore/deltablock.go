@@ -2,7 +2,6 @@ package objectstore
 
 import (
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 
@@ -48,6 +47,9 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL string,
 		return "", err
 	}
 
+	// Volume may have been resized since the last backup
+	volumeSize := volume.Size
+
 	// Update volume from objectstore
 	volume, err = loadVolume(volume.Name, bsDriver)
 	if err != nil {
@@ -55,6 +57,19 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL string,
 	}
 
 	lastBackupName := volume.LastBackupName
+	sharedBlocks := sharedBlocksEnabled()
+	checksumAlgorithm := getChecksumAlgorithm()
+	snapshot.Compression = util.GetCompression(snapshot.Compression)
+	if err := util.ValidateCompression(snapshot.Compression); err != nil {
+		return "", err
+	}
+
+	var key []byte
+	if snapshot.EncryptionKeyID != "" {
+		if key, err = getEncryptionKey(snapshot.EncryptionKeyID); err != nil {
+			return "", err
+		}
+	}
 
 	if err := deltaOps.OpenSnapshot(snapshot.Name, volume.Name); err != nil {
 		return "", err
@@ -70,7 +85,27 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL string,
 		}
 
 		lastSnapshotName = lastBackup.SnapshotName
-		if lastSnapshotName == snapshot.Name {
+		if lastBackup.EncryptionKeyID != snapshot.EncryptionKeyID {
+			// Blocks encrypted with different keys cannot be shared
+			lastSnapshotName = ""
+			lastBackup = nil
+			log.Debug("Encryption key changed, would create full snapshot metadata")
+		} else if util.GetCompression(lastBackup.Compression) != snapshot.Compression {
+			// Blocks compressed differently cannot be shared either
+			lastSnapshotName = ""
+			lastBackup = nil
+			log.Debug("Compression changed, would create full snapshot metadata")
+		} else if util.GetChecksumAlgorithm(lastBackup.ChecksumAlgorithm) != checksumAlgorithm {
+			// Blocks of the last backup are named by other checksums
+			lastSnapshotName = ""
+			lastBackup = nil
+			log.Debug("Checksum algorithm changed, would create full snapshot metadata")
+		} else if lastBackup.SharedBlocks != sharedBlocks {
+			// Blocks of the last backup are in the other block store
+			lastSnapshotName = ""
+			lastBackup = nil
+			log.Debug("Block store changed, would create full snapshot metadata")
+		} else if lastSnapshotName == snapshot.Name {
 			//Generate full snapshot if the snapshot has been backed up last time
 			lastSnapshotName = ""
 			log.Debug("Would create full snapshot metadata")
@@ -117,55 +152,33 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL string,
 		LOG_FIELD_SNAPSHOT: snapshot.Name,
 	}).Debug("Creating backup")
 
+	backupName := util.GenerateName("backup")
+	// Blocks found in objectstore must not be collected before the backup
+	// referring to them is saved
+	progress, release, err := startBackup(backupName, volume.Name, bsDriver)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	blockPath := getBlockPath(volume.Name)
+	if sharedBlocks {
+		blockPath = getSharedBlockPath()
+	}
+	blocks, err := backupBlocks(bsDriver, volume.Name, blockPath, checksumAlgorithm, snapshot, key, delta, deltaOps, lastBackup, progress)
+	if err != nil {
+		return "", err
+	}
 	deltaBackup := &Backup{
-		Name:         util.GenerateName("backup"),
-		VolumeName:   volume.Name,
-		SnapshotName: snapshot.Name,
-		Blocks:       []BlockMapping{},
-	}
-	mCounts := len(delta.Mappings)
-	for m, d := range delta.Mappings {
-		if d.Size%delta.BlockSize != 0 {
-			return "", fmt.Errorf("Mapping's size %v is not multiples of backup block size %v",
-				d.Size, delta.BlockSize)
-		}
-		block := make([]byte, DEFAULT_BLOCK_SIZE)
-		blkCounts := d.Size / delta.BlockSize
-		for i := int64(0); i < blkCounts; i++ {
-			offset := d.Offset + i*delta.BlockSize
-			log.Debugf("Backup for %v: segment %v/%v, blocks %v/%v", snapshot.Name, m+1, mCounts, i+1, blkCounts)
-			err := deltaOps.ReadSnapshot(snapshot.Name, volume.Name, offset, block)
-			if err != nil {
-				return "", err
-			}
-			checksum := util.GetChecksum(block)
-			blkFile := getBlockFilePath(volume.Name, checksum)
-			if bsDriver.FileSize(blkFile) >= 0 {
-				blockMapping := BlockMapping{
-					Offset:        offset,
-					BlockChecksum: checksum,
-				}
-				deltaBackup.Blocks = append(deltaBackup.Blocks, blockMapping)
-				log.Debugf("Found existed block match at %v", blkFile)
-				continue
-			}
-
-			rs, err := util.CompressData(block)
-			if err != nil {
-				return "", err
-			}
+		Name:            backupName,
+		VolumeName:      volume.Name,
+		SnapshotName:    snapshot.Name,
+		EncryptionKeyID: snapshot.EncryptionKeyID,
+		Compression:     snapshot.Compression,
+		SharedBlocks:    sharedBlocks,
+		Blocks:          blocks,
 
-			if err := bsDriver.Write(blkFile, rs); err != nil {
-				return "", err
-			}
-			log.Debugf("Created new block file at %v", blkFile)
-
-			blockMapping := BlockMapping{
-				Offset:        offset,
-				BlockChecksum: checksum,
-			}
-			deltaBackup.Blocks = append(deltaBackup.Blocks, blockMapping)
-		}
+		ChecksumAlgorithm:    checksumAlgorithm,
+		ServerSideEncryption: getServerSideEncryption(bsDriver),
 	}
 
 	log.WithFields(logrus.Fields{
@@ -179,12 +192,25 @@ func CreateDeltaBlockBackup(volume *Volume, snapshot *Snapshot, destURL string,
 	backup.SnapshotName = snapshot.Name
 	backup.SnapshotCreatedAt = snapshot.CreatedTime
 	backup.CreatedTime = util.Now()
+	backup.VolumeSize = volumeSize
 
 	if err := saveBackup(backup, bsDriver); err != nil {
 		return "", err
 	}
 
+	// Other daemons may have updated the volume meanwhile
+	unlock, err := lockVolume(volume.Name, bsDriver)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if volume, err = loadVolume(volume.Name, bsDriver); err != nil {
+		return "", err
+	}
 	volume.LastBackupName = backup.Name
+	if volumeSize > volume.Size {
+		volume.Size = volumeSize
+	}
 	if err := saveVolume(volume, bsDriver); err != nil {
 		return "", err
 	}
@@ -197,10 +223,16 @@ func mergeSnapshotMap(deltaBackup, lastBackup *Backup) *Backup {
 		return deltaBackup
 	}
 	backup := &Backup{
-		Name:         deltaBackup.Name,
-		VolumeName:   deltaBackup.VolumeName,
-		SnapshotName: deltaBackup.SnapshotName,
-		Blocks:       []BlockMapping{},
+		Name:            deltaBackup.Name,
+		VolumeName:      deltaBackup.VolumeName,
+		SnapshotName:    deltaBackup.SnapshotName,
+		EncryptionKeyID: deltaBackup.EncryptionKeyID,
+		Compression:     deltaBackup.Compression,
+		SharedBlocks:    deltaBackup.SharedBlocks,
+		Blocks:          []BlockMapping{},
+
+		ChecksumAlgorithm:    deltaBackup.ChecksumAlgorithm,
+		ServerSideEncryption: deltaBackup.ServerSideEncryption,
 	}
 	var d, l int
 	for d, l = 0, 0; d < len(deltaBackup.Blocks) && l < len(lastBackup.Blocks); {
@@ -248,8 +280,21 @@ func RestoreDeltaBlockBackup(backupURL, volDevName string) error {
 		}, "Volume doesn't exist in objectstore: %v", err)
 	}
 
-	if vol.Size == 0 || vol.Size%DEFAULT_BLOCK_SIZE != 0 {
-		return fmt.Errorf("Read invalid volume size %v", vol.Size)
+	backup, err := loadBackup(srcBackupName, srcVolumeName, bsDriver)
+	if err != nil {
+		return err
+	}
+
+	volSize := backupVolumeSize(backup, vol)
+	if volSize == 0 || volSize%DEFAULT_BLOCK_SIZE != 0 {
+		return fmt.Errorf("Read invalid volume size %v", volSize)
+	}
+
+	var key []byte
+	if backup.EncryptionKeyID != "" {
+		if key, err = getEncryptionKey(backup.EncryptionKeyID); err != nil {
+			return err
+		}
 	}
 
 	volDev, err := os.Create(volDevName)
@@ -263,11 +308,6 @@ func RestoreDeltaBlockBackup(backupURL, volDevName string) error {
 		return err
 	}
 
-	backup, err := loadBackup(srcBackupName, srcVolumeName, bsDriver)
-	if err != nil {
-		return err
-	}
-
 	log.WithFields(logrus.Fields{
 		LOG_FIELD_REASON:      LOG_REASON_START,
 		LOG_FIELD_EVENT:       LOG_EVENT_RESTORE,
@@ -277,31 +317,14 @@ func RestoreDeltaBlockBackup(backupURL, volDevName string) error {
 		LOG_FIELD_VOLUME_DEV:  volDevName,
 		LOG_FIELD_BACKUP_URL:  backupURL,
 	}).Debug()
-	blkCounts := len(backup.Blocks)
-	for i, block := range backup.Blocks {
-		log.Debugf("Restore for %v: block %v, %v/%v", volDevName, block.BlockChecksum, i+1, blkCounts)
-		blkFile := getBlockFilePath(srcVolumeName, block.BlockChecksum)
-		rc, err := bsDriver.Read(blkFile)
-		if err != nil {
-			return err
-		}
-		r, err := util.DecompressAndVerify(rc, block.BlockChecksum)
-		rc.Close()
-		if err != nil {
-			return err
-		}
-		if _, err := volDev.Seek(block.Offset, 0); err != nil {
-			return err
-		}
-		if _, err := io.CopyN(volDev, r, DEFAULT_BLOCK_SIZE); err != nil {
-			return err
-		}
+	if err := restoreBlocks(bsDriver, getBackupBlockPath(backup), backup.ChecksumAlgorithm, backup.EncryptionKeyID, backup.Compression, key, backup.Blocks, volDev); err != nil {
+		return err
 	}
 
 	// We want to truncate regular files, but not device
 	if stat.Mode()&os.ModeType == 0 {
-		log.Debugf("Truncate %v to size %v", volDevName, vol.Size)
-		if err := volDev.Truncate(vol.Size); err != nil {
+		log.Debugf("Truncate %v to size %v", volDevName, volSize)
+		if err := volDev.Truncate(volSize); err != nil {
 			return err
 		}
 	}
@@ -309,6 +332,42 @@ func RestoreDeltaBlockBackup(backupURL, volDevName string) error {
 	return nil
 }
 
+// updateVolumeForRemovedBackup clears the last backup of volume if it's the
+// removed one, and removes the volume once it has no backup left. Returns
+// whether the volume was removed.
+func updateVolumeForRemovedBackup(backupName, volumeName string, bsDriver ObjectStoreDriver) (bool, error) {
+	unlock, err := lockVolume(volumeName, bsDriver)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	// Other daemons may have updated the volume meanwhile
+	v, err := loadVolume(volumeName, bsDriver)
+	if err != nil {
+		return false, err
+	}
+	if backupName == v.LastBackupName {
+		v.LastBackupName = ""
+		if err := saveVolume(v, bsDriver); err != nil {
+			return false, err
+		}
+	}
+
+	backupNames, err := getBackupNamesForVolume(volumeName, bsDriver)
+	if err != nil {
+		return false, err
+	}
+	if len(backupNames) == 0 {
+		log.Debugf("No snapshot existed for the volume %v, removing volume", volumeName)
+		if err := removeVolume(volumeName, bsDriver); err != nil {
+			log.Warningf("Failed to remove volume %v due to: %v", volumeName, err.Error())
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
 func DeleteDeltaBlockBackup(backupURL string) error {
 	bsDriver, err := GetObjectStoreDriver(backupURL)
 	if err != nil {
@@ -320,7 +379,7 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 		return err
 	}
 
-	v, err := loadVolume(volumeName, bsDriver)
+	_, err = loadVolume(volumeName, bsDriver)
 	if err != nil {
 		return fmt.Errorf("Cannot find volume %v in objectstore", volumeName, err)
 	}
@@ -329,9 +388,24 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	if err != nil {
 		return err
 	}
+	if backup.SharedBlocks {
+		// Other volumes may refer to the blocks, which are removed by
+		// CollectSharedBlocks() once no backup does
+		if err := removeBackup(backup, bsDriver); err != nil {
+			return err
+		}
+		if _, err := updateVolumeForRemovedBackup(backup.Name, volumeName, bsDriver); err != nil {
+			return err
+		}
+		log.Debug("Removed objectstore backup ", backupName)
+		return nil
+	}
+
+	// Blocks of encrypted backups are stored per key, and blocks of backups
+	// compressed differently are different files, so track them by path
 	discardBlockSet := make(map[string]bool)
 	for _, blk := range backup.Blocks {
-		discardBlockSet[blk.BlockChecksum] = true
+		discardBlockSet[getBlockFilePath(getBlockPath(volumeName), blk.BlockChecksum, backup.ChecksumAlgorithm, backup.EncryptionKeyID, backup.Compression)] = true
 	}
 	discardBlockCounts := len(discardBlockSet)
 
@@ -339,24 +413,18 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 		return err
 	}
 
-	if backup.Name == v.LastBackupName {
-		v.LastBackupName = ""
-		if err := saveVolume(v, bsDriver); err != nil {
-			return err
-		}
+	volumeRemoved, err := updateVolumeForRemovedBackup(backup.Name, volumeName, bsDriver)
+	if err != nil {
+		return err
+	}
+	if volumeRemoved {
+		return nil
 	}
 
 	backupNames, err := getBackupNamesForVolume(volumeName, bsDriver)
 	if err != nil {
 		return err
 	}
-	if len(backupNames) == 0 {
-		log.Debugf("No snapshot existed for the volume %v, removing volume", volumeName)
-		if err := removeVolume(volumeName, bsDriver); err != nil {
-			log.Warningf("Failed to remove volume %v due to: %v", volumeName, err.Error())
-		}
-		return nil
-	}
 
 	log.Debug("GC started")
 	for _, backupName := range backupNames {
@@ -364,9 +432,13 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 		if err != nil {
 			return err
 		}
+		if backup.SharedBlocks {
+			continue
+		}
 		for _, blk := range backup.Blocks {
-			if _, exists := discardBlockSet[blk.BlockChecksum]; exists {
-				delete(discardBlockSet, blk.BlockChecksum)
+			blkFile := getBlockFilePath(getBlockPath(volumeName), blk.BlockChecksum, backup.ChecksumAlgorithm, backup.EncryptionKeyID, backup.Compression)
+			if _, exists := discardBlockSet[blkFile]; exists {
+				delete(discardBlockSet, blkFile)
 				discardBlockCounts--
 				if discardBlockCounts == 0 {
 					break
@@ -379,9 +451,9 @@ func DeleteDeltaBlockBackup(backupURL string) error {
 	}
 
 	var blkFileList []string
-	for blk := range discardBlockSet {
-		blkFileList = append(blkFileList, getBlockFilePath(volumeName, blk))
-		log.Debugf("Found unused blocks %v for volume %v", blk, volumeName)
+	for blkFile := range discardBlockSet {
+		blkFileList = append(blkFileList, blkFile)
+		log.Debugf("Found unused blocks %v for volume %v", blkFile, volumeName)
 	}
 	if err := bsDriver.Remove(blkFileList...); err != nil {
 		return err
@@ -398,11 +470,32 @@ func getBlockPath(volumeName string) string {
 	return filepath.Join(getVolumePath(volumeName), BLOCKS_DIRECTORY) + "/"
 }
 
-func getBlockFilePath(volumeName, checksum string) string {
+// getBackupBlockPath returns the block store the blocks of backup are in
+func getBackupBlockPath(backup *Backup) string {
+	if backup.SharedBlocks {
+		return getSharedBlockPath()
+	}
+	return getBlockPath(backup.VolumeName)
+}
+
+// Blocks encrypted by different keys or compressed by different algorithms
+// are different files, even with the same content. Gzipped blocks keep the
+// name from before the compression was recorded, and so do blocks
+// checksummed by SHA-512.
+func getBlockFilePath(blockPath, checksum, checksumAlgorithm, encryptionKeyID, compression string) string {
 	blockSubDirLayer1 := checksum[0:BLOCK_SEPARATE_LAYER1]
 	blockSubDirLayer2 := checksum[BLOCK_SEPARATE_LAYER1:BLOCK_SEPARATE_LAYER2]
-	path := filepath.Join(getBlockPath(volumeName), blockSubDirLayer1, blockSubDirLayer2)
-	fileName := checksum + ".blk"
+	path := filepath.Join(blockPath, blockSubDirLayer1, blockSubDirLayer2)
+	fileName := checksum
+	if checksumAlgorithm = util.GetChecksumAlgorithm(checksumAlgorithm); checksumAlgorithm != util.DEFAULT_CHECKSUM {
+		fileName += "." + checksumAlgorithm
+	}
+	if encryptionKeyID != "" {
+		fileName += "." + encryptionKeyID
+	}
+	if compression = util.GetCompression(compression); compression != util.COMPRESSION_GZIP {
+		fileName += "." + compression
+	}
 
-	return filepath.Join(path, fileName)
+	return filepath.Join(path, fileName+".blk")
 }
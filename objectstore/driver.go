@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 
@@ -29,6 +30,28 @@ var (
 	initializers map[string]InitFunc
 )
 
+// ServerSideEncrypter is implemented by drivers which can have objects
+// encrypted at rest by the storage service. ServerSideEncryption returns the
+// mode used for writing objects, empty if it's not enabled.
+type ServerSideEncrypter interface {
+	ServerSideEncryption() string
+}
+
+// Locker is implemented by drivers whose destination can be shared by
+// daemons of multiple hosts without a service coordinating the writes, e.g.
+// vfs on NFS. Lock blocks until the lock of name is acquired, and returns
+// the function to release it.
+type Locker interface {
+	Lock(name string) (func(), error)
+}
+
+// SequentialDriver is implemented by drivers whose destination is read and
+// written in order, e.g. spool for tape. Sequential returns true if objects
+// must be transferred one at a time, in the order of the backup.
+type SequentialDriver interface {
+	Sequential() bool
+}
+
 var (
 	log = logrus.WithFields(logrus.Fields{"pkg": "objectstore"})
 )
@@ -60,5 +83,40 @@ func GetObjectStoreDriver(destURL string) (ObjectStoreDriver, error) {
 	if _, exists := initializers[u.Scheme]; !exists {
 		return nil, fmt.Errorf("Driver %v is not supported!", u.Scheme)
 	}
-	return initializers[u.Scheme](destURL)
+	driver, err := initializers[u.Scheme](destURL)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedDriver{driver}, nil
+}
+
+func getServerSideEncryption(driver ObjectStoreDriver) string {
+	if e, ok := unwrapDriver(driver).(ServerSideEncrypter); ok {
+		return e.ServerSideEncryption()
+	}
+	return ""
+}
+
+/*
+ApplyDestOptions adds driver options to destURL. An option in the format of
+<kind>-<key>=<value>, e.g. s3-sse=aws:kms, would be added to the query string
+of destURL as <key>=<value>, if destURL is of the kind.
+*/
+func ApplyDestOptions(destURL string, opts map[string]string) (string, error) {
+	if len(opts) == 0 {
+		return destURL, nil
+	}
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return "", err
+	}
+	v := u.Query()
+	for opt, value := range opts {
+		if !strings.HasPrefix(opt, u.Scheme+"-") {
+			return "", fmt.Errorf("Option %v doesn't apply to destination %v", opt, destURL)
+		}
+		v.Set(strings.TrimPrefix(opt, u.Scheme+"-"), value)
+	}
+	u.RawQuery = v.Encode()
+	return u.String(), nil
 }
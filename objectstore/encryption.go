@@ -0,0 +1,213 @@
+package objectstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// AES-256
+	ENCRYPTION_KEY_SIZE = 32
+	// Length of key ID in hex, which is the beginning of SHA-256 of the key
+	ENCRYPTION_KEY_ID_LENGTH = 16
+
+	// Data is sealed in chunks, so large single file backups don't need to
+	// be held in memory
+	ENCRYPTION_CHUNK_SIZE = 1024 * 1024
+)
+
+/*
+Encrypted data is a sequence of chunks, each of them is:
+
+	sealed length (uint32, big endian) | nonce | sealed data
+
+Index of the chunk and whether it's the last one are authenticated as
+additional data, so chunks cannot be reordered or truncated. The last chunk
+is always present, even if it's empty.
+*/
+
+var (
+	encryptionKeys     = make(map[string][]byte)
+	encryptionKeysLock sync.RWMutex
+)
+
+// ParseEncryptionKey accepts 32 bytes raw key, or the key encoded in hex or
+// base64
+func ParseEncryptionKey(data []byte) ([]byte, error) {
+	if len(data) == ENCRYPTION_KEY_SIZE {
+		return data, nil
+	}
+	text := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == ENCRYPTION_KEY_SIZE {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == ENCRYPTION_KEY_SIZE {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Invalid encryption key, must be %v bytes, in raw, hex or base64", ENCRYPTION_KEY_SIZE)
+}
+
+func GetEncryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])[:ENCRYPTION_KEY_ID_LENGTH]
+}
+
+// AddEncryptionKey makes the key available for backup and restore, returns
+// the ID of the key
+func AddEncryptionKey(key []byte) (string, error) {
+	if len(key) != ENCRYPTION_KEY_SIZE {
+		return "", fmt.Errorf("Invalid encryption key size %v, must be %v", len(key), ENCRYPTION_KEY_SIZE)
+	}
+	id := GetEncryptionKeyID(key)
+	encryptionKeysLock.Lock()
+	encryptionKeys[id] = append([]byte{}, key...)
+	encryptionKeysLock.Unlock()
+	return id, nil
+}
+
+// RemoveEncryptionKey forgets the key of id, which must be provided again,
+// or unwrapped by KMS if it's generated by KMS, to be used
+func RemoveEncryptionKey(id string) {
+	encryptionKeysLock.Lock()
+	delete(encryptionKeys, id)
+	encryptionKeysLock.Unlock()
+}
+
+func LoadEncryptionKeyFile(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	key, err := ParseEncryptionKey(data)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", file, err)
+	}
+	return AddEncryptionKey(key)
+}
+
+func getEncryptionKey(id string) ([]byte, error) {
+	encryptionKeysLock.RLock()
+	key, exists := encryptionKeys[id]
+	encryptionKeysLock.RUnlock()
+	if !exists {
+		// Keys generated by KMS are kept wrapped until they're needed
+		return unwrapEncryptionKey(id)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkAdditionalData(index uint64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+func encryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, ENCRYPTION_CHUNK_SIZE)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(src, buf)
+		last := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		sealed := gcm.Seal(nil, nonce, buf[:n], chunkAdditionalData(index, last))
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(sealed)))
+		for _, data := range [][]byte{header, nonce, sealed} {
+			if _, err := dst.Write(data); err != nil {
+				return err
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func decryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	maxSealedSize := ENCRYPTION_CHUNK_SIZE + gcm.Overhead()
+	header := make([]byte, 4)
+	nonce := make([]byte, gcm.NonceSize())
+	for index := uint64(0); ; index++ {
+		if _, err := io.ReadFull(src, header); err != nil {
+			return fmt.Errorf("Encrypted data is truncated: %v", err)
+		}
+		size := int(binary.BigEndian.Uint32(header))
+		if size > maxSealedSize {
+			return fmt.Errorf("Invalid encrypted chunk size %v", size)
+		}
+		if _, err := io.ReadFull(src, nonce); err != nil {
+			return fmt.Errorf("Encrypted data is truncated: %v", err)
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(src, sealed); err != nil {
+			return fmt.Errorf("Encrypted data is truncated: %v", err)
+		}
+		last := true
+		data, err := gcm.Open(nil, nonce, sealed, chunkAdditionalData(index, last))
+		if err != nil {
+			last = false
+			data, err = gcm.Open(nil, nonce, sealed, chunkAdditionalData(index, last))
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt data, wrong key or data corrupted")
+		}
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func encryptData(data io.Reader, key []byte) (io.ReadSeeker, error) {
+	var b bytes.Buffer
+	if err := encryptStream(&b, data, key); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b.Bytes()), nil
+}
+
+func decryptData(data io.Reader, key []byte) (io.Reader, error) {
+	var b bytes.Buffer
+	if err := decryptStream(&b, data, key); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
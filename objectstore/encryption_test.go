@@ -0,0 +1,41 @@
+package objectstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptStream(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, ENCRYPTION_KEY_SIZE)
+	for _, size := range []int{0, 10, ENCRYPTION_CHUNK_SIZE, 2*ENCRYPTION_CHUNK_SIZE + 1} {
+		data := bytes.Repeat([]byte{2}, size)
+		var encrypted bytes.Buffer
+		if err := encryptStream(&encrypted, bytes.NewReader(data), key); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(encrypted.Bytes(), data) && size != 0 {
+			t.Fatalf("data of size %v is not encrypted", size)
+		}
+		sealed := encrypted.Bytes()
+
+		var decrypted bytes.Buffer
+		if err := decryptStream(&decrypted, bytes.NewReader(sealed), key); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), data) {
+			t.Fatalf("decrypted data of size %v doesn't match", size)
+		}
+
+		wrongKey := bytes.Repeat([]byte{3}, ENCRYPTION_KEY_SIZE)
+		if err := decryptStream(&bytes.Buffer{}, bytes.NewReader(sealed), wrongKey); err == nil {
+			t.Fatalf("data of size %v decrypted with wrong key", size)
+		}
+		// Dropping the last chunk must be detected
+		if size > ENCRYPTION_CHUNK_SIZE {
+			chunk := 4 + 12 + ENCRYPTION_CHUNK_SIZE + 16
+			if err := decryptStream(&bytes.Buffer{}, bytes.NewReader(sealed[:2*chunk]), key); err == nil {
+				t.Fatalf("truncated data of size %v decrypted", size)
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package objectstore
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/metrics"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	// Reads smaller than it, e.g. of configs, take mostly the latency of
+	// the objectstore, so they don't tell the bandwidth
+	BANDWIDTH_MIN_SAMPLE_SIZE = 256 * 1024
+	// Bytes read from a file of backup to measure the bandwidth, if no
+	// restore or backup has been read from the destination yet
+	BANDWIDTH_PROBE_SIZE = 8 * 1024 * 1024
+)
+
+type readSample struct {
+	bytes    int64
+	duration time.Duration
+}
+
+var (
+	readSamplesLock sync.Mutex
+	readSamples     = map[string]*readSample{}
+)
+
+// recordRead counts n bytes read from destination in d, for the metrics and
+// for measuring the bandwidth of destination
+func recordRead(destination string, n int64, d time.Duration) {
+	metrics.RecordObjectStoreRead(destination, n, d)
+	if n < BANDWIDTH_MIN_SAMPLE_SIZE {
+		return
+	}
+	readSamplesLock.Lock()
+	defer readSamplesLock.Unlock()
+	sample := readSamples[destination]
+	if sample == nil {
+		sample = &readSample{}
+		readSamples[destination] = sample
+	}
+	sample.bytes += n
+	sample.duration += d
+}
+
+// getBandwidth returns the bytes per second of a single read from
+// destination, 0 if it's unknown
+func getBandwidth(destination string) float64 {
+	readSamplesLock.Lock()
+	defer readSamplesLock.Unlock()
+	sample := readSamples[destination]
+	if sample == nil || sample.duration <= 0 {
+		return 0
+	}
+	return float64(sample.bytes) / sample.duration.Seconds()
+}
+
+// RestoreEstimate is what restoring a backup takes, see EstimateRestore()
+type RestoreEstimate struct {
+	VolumeSize int64
+	// Bytes written by restore, -1 if unknown, e.g. for compressed single
+	// file backups
+	DataSize int64
+	// Blocks of delta block backup, 0 for other backups
+	Blocks int
+	// Files downloaded for single file backups, including the ones of the
+	// backups it's incremental to
+	Files int
+	// Bytes downloaded from the objectstore, -1 if unknown. It's estimated
+	// by the size of the first block for delta block backups.
+	DownloadSize int64
+	// Bytes per second of a single read from the objectstore, and the reads
+	// done in parallel by restore. Bandwidth is 0 if it's unknown.
+	Bandwidth   float64
+	Concurrency int
+	// 0 if it's unknown
+	Duration time.Duration
+}
+
+/*
+CheckRestore fails if the backup of backupURL cannot be restored right now,
+e.g. it's archived and not retrieved, or it's encrypted by a key the daemon
+doesn't have. It reads only the configs of backups.
+*/
+func CheckRestore(backupURL string) error {
+	driver, backup, _, err := loadBackupOfURL(backupURL)
+	if err != nil {
+		return err
+	}
+	chain, err := loadBackupChain(backup, driver)
+	if err != nil {
+		return err
+	}
+	for _, b := range chain {
+		if err := checkArchiveRestored(b, driver); err != nil {
+			return err
+		}
+		if b.EncryptionKeyID != "" {
+			if _, err := getEncryptionKey(b.EncryptionKeyID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+EstimateRestore returns the size of the backup of backupURL to restore, and
+how long downloading it would take, by the bandwidth measured by the reads
+from its destination so far. With probe, part of the backup is read to
+measure the bandwidth if nothing has been read from the destination yet.
+*/
+func EstimateRestore(backupURL string, probe bool) (*RestoreEstimate, error) {
+	driver, backup, volume, err := loadBackupOfURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	estimate := &RestoreEstimate{
+		VolumeSize:  backupVolumeSize(backup, volume),
+		Concurrency: 1,
+	}
+
+	files := []string{}
+	if len(backup.Blocks) != 0 {
+		estimate.Blocks = len(backup.Blocks)
+		estimate.DataSize = int64(len(backup.Blocks)) * DEFAULT_BLOCK_SIZE
+		estimate.DownloadSize = -1
+		block := backup.Blocks[0]
+		blkFile := getBlockFilePath(getBackupBlockPath(backup), block.BlockChecksum, backup.ChecksumAlgorithm, backup.EncryptionKeyID, backup.Compression)
+		if size := driver.FileSize(blkFile); size >= 0 {
+			estimate.DownloadSize = size * int64(len(backup.Blocks))
+		}
+		if workers := getConcurrency(driver); workers < len(backup.Blocks) {
+			estimate.Concurrency = workers
+		} else {
+			estimate.Concurrency = len(backup.Blocks)
+		}
+		files = append(files, blkFile)
+	} else if backup.SingleFile.FilePath != "" {
+		chain, err := loadBackupChain(backup, driver)
+		if err != nil {
+			return nil, err
+		}
+		estimate.Files = len(chain)
+		for _, b := range chain {
+			size := driver.FileSize(b.SingleFile.FilePath)
+			if size < 0 || estimate.DownloadSize < 0 {
+				estimate.DownloadSize = -1
+			} else {
+				estimate.DownloadSize += size
+			}
+			files = append(files, b.SingleFile.FilePath)
+		}
+		estimate.DataSize = -1
+		if util.GetCompression(backup.Compression) == util.COMPRESSION_NONE && backup.EncryptionKeyID == "" {
+			estimate.DataSize = estimate.DownloadSize
+		}
+	}
+
+	destination := driver.GetURL()
+	estimate.Bandwidth = getBandwidth(destination)
+	if estimate.Bandwidth == 0 && probe && len(files) != 0 {
+		if err := probeBandwidth(driver, files[0]); err != nil {
+			return nil, err
+		}
+		estimate.Bandwidth = getBandwidth(destination)
+	}
+	if estimate.Bandwidth > 0 && estimate.DownloadSize > 0 {
+		seconds := float64(estimate.DownloadSize) / (estimate.Bandwidth * float64(estimate.Concurrency))
+		estimate.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	return estimate, nil
+}
+
+// probeBandwidth reads up to BANDWIDTH_PROBE_SIZE bytes of filePath, which
+// is recorded as a read of the destination by the instrumented driver
+func probeBandwidth(driver ObjectStoreDriver, filePath string) error {
+	rc, err := driver.Read(filePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if _, err := io.CopyN(ioutil.Discard, rc, BANDWIDTH_PROBE_SIZE); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func loadBackupOfURL(backupURL string) (ObjectStoreDriver, *Backup, *Volume, error) {
+	driver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return driver, backup, volume, nil
+}
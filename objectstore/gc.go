@@ -0,0 +1,291 @@
+package objectstore
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	DEFAULT_GC_MIN_AGE = 24 * time.Hour
+)
+
+// ModTimeLister is implemented by drivers which can list the files in path
+// along with their modification times in a request. Directories are not
+// listed.
+type ModTimeLister interface {
+	ListModTimes(path string) (map[string]time.Time, error)
+}
+
+// getModTimeLister returns nil if the driver cannot list modification times
+func getModTimeLister(driver ObjectStoreDriver) ModTimeLister {
+	if _, ok := unwrapDriver(driver).(ModTimeLister); !ok {
+		return nil
+	}
+	return driver.(ModTimeLister)
+}
+
+type OrphanGCResult struct {
+	// Blocks no backup refers to, left by failed backups or by deleted
+	// backups with shared blocks
+	OrphanBlocks int
+	// Backup files no backup refers to, files left by interrupted writes
+	// and stale markers
+	OrphanFiles []string
+	// Volumes without any backup, left by failed first backups
+	EmptyVolumes []string
+	// Orphans modified within the minimum age, which are kept
+	RecentOrphans int
+	// Orphans and empty volumes removed, none for dry run
+	Removed int
+}
+
+// orphanCollector decides which orphans are old enough to be removed
+type orphanCollector struct {
+	driver ObjectStoreDriver
+	lister ModTimeLister
+	minAge time.Duration
+	now    time.Time
+	result *OrphanGCResult
+	// Paths of old enough orphans
+	removable []string
+	// Modification times of files by directory, listed once
+	modTimes map[string]map[string]time.Time
+}
+
+// oldEnough tells whether the files in dir were modified before the minimum
+// age. Files are never old enough if the driver cannot tell when they were
+// modified, unless the minimum age is zero.
+func (o *orphanCollector) oldEnough(dir string, files []string) (map[string]bool, error) {
+	result := map[string]bool{}
+	if o.minAge == 0 {
+		for _, file := range files {
+			result[file] = true
+		}
+		return result, nil
+	}
+	if o.lister == nil || len(files) == 0 {
+		return result, nil
+	}
+	modTimes, exists := o.modTimes[dir]
+	if !exists {
+		var err error
+		if modTimes, err = o.lister.ListModTimes(dir); err != nil {
+			return nil, err
+		}
+		o.modTimes[dir] = modTimes
+	}
+	for _, file := range files {
+		if t, exists := modTimes[filepath.Base(file)]; exists && o.now.Sub(t) >= o.minAge {
+			result[file] = true
+		}
+	}
+	return result, nil
+}
+
+// add records paths of orphan files in dir, and whether they're old enough
+// to be removed. Blocks are only counted.
+func (o *orphanCollector) add(dir string, paths []string, blocks bool) error {
+	old, err := o.oldEnough(dir, paths)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if blocks {
+			o.result.OrphanBlocks++
+		} else {
+			o.result.OrphanFiles = append(o.result.OrphanFiles, path)
+		}
+		if old[path] {
+			o.removable = append(o.removable, path)
+		} else {
+			o.result.RecentOrphans++
+		}
+	}
+	return nil
+}
+
+// addBlocks records the orphans of the block store of blockPath
+func (o *orphanCollector) addBlocks(blockPath string, referenced map[string]bool) error {
+	_, unreferenced, others, err := sweepBlocks(blockPath, referenced, o.driver)
+	if err != nil {
+		return err
+	}
+	for _, path := range unreferenced {
+		if err := o.add(filepath.Dir(path), []string{path}, true); err != nil {
+			return err
+		}
+	}
+	for _, path := range others {
+		if err := o.add(filepath.Dir(path), []string{path}, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDir returns the paths of files in dir, skipping the ones keep returns
+// true for
+func listDir(dir string, driver ObjectStoreDriver, keep func(name string) bool) []string {
+	paths := []string{}
+	names, err := driver.List(dir)
+	if err != nil {
+		// Directory doesn't exist
+		return paths
+	}
+	for _, name := range names {
+		if !keep(name) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	return paths
+}
+
+// collectVolume records the orphans of volume, and adds the shared blocks
+// its backups refer to to sharedReferenced
+func (o *orphanCollector) collectVolume(volumeName string, sharedReferenced map[string]bool) error {
+	backupNames, err := getBackupNamesForVolume(volumeName, o.driver)
+	if err != nil {
+		return err
+	}
+	volumePath := getVolumePath(volumeName)
+	if len(backupNames) == 0 {
+		old, err := o.oldEnough(volumePath, []string{VOLUME_CONFIG_FILE})
+		if err != nil {
+			return err
+		}
+		o.result.EmptyVolumes = append(o.result.EmptyVolumes, volumeName)
+		if old[VOLUME_CONFIG_FILE] {
+			o.removable = append(o.removable, volumePath)
+		} else {
+			o.result.RecentOrphans++
+		}
+		return nil
+	}
+
+	blocks := map[string]bool{}
+	files := map[string]bool{}
+	for _, backupName := range backupNames {
+		// Orphans cannot be told if any config cannot be read
+		backup, err := loadBackup(backupName, volumeName, o.driver)
+		if err != nil {
+			return err
+		}
+		if backup.SingleFile.FilePath != "" {
+			files[filepath.Clean(backup.SingleFile.FilePath)] = true
+		}
+		for _, blk := range backup.Blocks {
+			path := getBlockFilePath(getBackupBlockPath(backup), blk.BlockChecksum, backup.ChecksumAlgorithm, backup.EncryptionKeyID, backup.Compression)
+			if backup.SharedBlocks {
+				sharedReferenced[path] = true
+			} else {
+				blocks[path] = true
+			}
+		}
+	}
+
+	backupPath := filepath.Clean(getBackupPath(volumeName))
+	temps := listDir(backupPath, o.driver, func(name string) bool {
+		return strings.HasSuffix(name, CFG_SUFFIX)
+	})
+	if err := o.add(backupPath, temps, false); err != nil {
+		return err
+	}
+	filesPath := filepath.Join(volumePath, BACKUP_FILES_DIRECTORY)
+	unreferencedFiles := listDir(filesPath, o.driver, func(name string) bool {
+		return files[filepath.Join(filesPath, name)]
+	})
+	if err := o.add(filesPath, unreferencedFiles, false); err != nil {
+		return err
+	}
+	return o.addBlocks(getBlockPath(volumeName), blocks)
+}
+
+/*
+CollectOrphans removes the objects of destURL no backup refers to, which are
+left by failed backups, interrupted writes and crashed daemons: blocks, backup
+files, temporary files, volumes without backups and stale markers. Only the
+ones not modified for minAge are removed, in case they belong to backups of
+daemons which don't mark the backups being created. Orphans are never old
+enough if the driver cannot list modification times, unless minAge is zero.
+Dry run only reports the orphans.
+*/
+func CollectOrphans(destURL string, minAge time.Duration, dryRun bool) (*OrphanGCResult, error) {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		release, err := startGC(driver)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_DELETE,
+		LOG_FIELD_DEST_URL: destURL,
+	}).Debugf("Collecting orphans older than %v", minAge)
+
+	o := &orphanCollector{
+		driver:   driver,
+		lister:   getModTimeLister(driver),
+		minAge:   minAge,
+		now:      time.Now(),
+		modTimes: map[string]map[string]time.Time{},
+		result: &OrphanGCResult{
+			OrphanFiles:  []string{},
+			EmptyVolumes: []string{},
+		},
+	}
+	volumeNames, err := getVolumeNames(driver)
+	if err != nil {
+		return nil, err
+	}
+	sharedReferenced := map[string]bool{}
+	for _, volumeName := range volumeNames {
+		if err := o.collectVolume(volumeName, sharedReferenced); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.addBlocks(getSharedBlockPath(), sharedReferenced); err != nil {
+		return nil, err
+	}
+
+	// Markers of the running backups and this collection are active
+	active, err := listActiveMarkers("", driver)
+	if err != nil {
+		return nil, err
+	}
+	activeFiles := map[string]bool{}
+	for _, name := range active {
+		activeFiles[name+CFG_SUFFIX] = true
+	}
+	markerPath := filepath.Join(OBJECTSTORE_BASE, MARKERS_DIRECTORY)
+	stale := listDir(markerPath, driver, func(name string) bool {
+		return activeFiles[name]
+	})
+	o.result.OrphanFiles = append(o.result.OrphanFiles, stale...)
+	o.removable = append(o.removable, stale...)
+
+	if !dryRun && len(o.removable) != 0 {
+		if err := driver.Remove(o.removable...); err != nil {
+			return nil, err
+		}
+		o.result.Removed = len(o.removable)
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:    LOG_EVENT_DELETE,
+		LOG_FIELD_DEST_URL: destURL,
+	}).Debugf("Collected orphans: %v blocks, %v files, %v empty volumes, %v kept as recent, %v removed",
+		o.result.OrphanBlocks, len(o.result.OrphanFiles), len(o.result.EmptyVolumes), o.result.RecentOrphans, o.result.Removed)
+	return o.result, nil
+}
@@ -0,0 +1,227 @@
+package objectstore
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Options of the HTTP client of drivers talking to the objectstore over
+	// HTTP, e.g. S3 and GCS. They're set for all destinations by the daemon,
+	// and for a destination by the query of its URL, e.g. from --opt
+	// s3-proxy=http://proxy:3128.
+	HTTP_OPT_PROXY            = "proxy"
+	HTTP_OPT_DIAL_TIMEOUT     = "dial-timeout"
+	HTTP_OPT_RESPONSE_TIMEOUT = "response-timeout"
+	HTTP_OPT_MAX_IDLE_CONNS   = "max-idle-conns"
+	HTTP_OPT_KEEPALIVE        = "keepalive"
+
+	// Defaults of http.DefaultTransport, which are kept unless specified
+	DEFAULT_HTTP_DIAL_TIMEOUT = 30 * time.Second
+	DEFAULT_HTTP_KEEPALIVE    = 30 * time.Second
+)
+
+var httpOptions = []string{
+	HTTP_OPT_PROXY,
+	HTTP_OPT_DIAL_TIMEOUT,
+	HTTP_OPT_RESPONSE_TIMEOUT,
+	HTTP_OPT_MAX_IDLE_CONNS,
+	HTTP_OPT_KEEPALIVE,
+}
+
+/*
+HTTPConfig tunes the HTTP client of a destination. Proxy is used for all
+requests instead of the one of HTTP_PROXY and HTTPS_PROXY environment
+variables. ResponseTimeout limits the wait for the response headers of a
+request, not the transfer of the body. MaxIdleConns is the connections kept
+open to the objectstore for reuse, and KeepAlive the period of TCP
+keep-alive probes. Zero values keep the defaults.
+*/
+type HTTPConfig struct {
+	Proxy           string
+	DialTimeout     time.Duration
+	ResponseTimeout time.Duration
+	MaxIdleConns    int
+	KeepAlive       time.Duration
+}
+
+var (
+	httpConfigLock sync.RWMutex
+	httpConfig     HTTPConfig
+
+	transportsLock sync.Mutex
+	transports     = map[HTTPConfig]*http.Transport{}
+)
+
+/*
+SetHTTPConfig sets the HTTP options of all destinations from opts in
+key=value format, e.g. "proxy=http://proxy:3128" or "dial-timeout=10s".
+Destinations override them by the query of their URL. Drivers loaded before
+are not affected.
+*/
+func SetHTTPConfig(opts []string) error {
+	config, err := parseHTTPConfig(opts)
+	if err != nil {
+		return err
+	}
+	httpConfigLock.Lock()
+	httpConfig = config
+	httpConfigLock.Unlock()
+	return nil
+}
+
+// ValidateHTTPConfig fails if opts are not valid for SetHTTPConfig()
+func ValidateHTTPConfig(opts []string) error {
+	_, err := parseHTTPConfig(opts)
+	return err
+}
+
+func parseHTTPConfig(opts []string) (HTTPConfig, error) {
+	values := map[string]string{}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return HTTPConfig{}, fmt.Errorf("Invalid HTTP option %v, must be in key=value format", opt)
+		}
+		if !isHTTPOption(kv[0]) {
+			return HTTPConfig{}, fmt.Errorf("Unknown HTTP option %v, must be one of %v", kv[0], strings.Join(httpOptions, ", "))
+		}
+		values[kv[0]] = kv[1]
+	}
+	return parseHTTPOptions(HTTPConfig{}, values)
+}
+
+func isHTTPOption(key string) bool {
+	for _, option := range httpOptions {
+		if key == option {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHTTPOptions(config HTTPConfig, values map[string]string) (HTTPConfig, error) {
+	for key, value := range values {
+		var err error
+		switch key {
+		case HTTP_OPT_PROXY:
+			if value != "" {
+				var u *url.URL
+				u, err = url.Parse(value)
+				if err == nil && (u.Scheme == "" || u.Host == "") {
+					err = fmt.Errorf("must be like http://host:port")
+				}
+			}
+			config.Proxy = value
+		case HTTP_OPT_DIAL_TIMEOUT:
+			config.DialTimeout, err = parseHTTPDuration(value)
+		case HTTP_OPT_RESPONSE_TIMEOUT:
+			config.ResponseTimeout, err = parseHTTPDuration(value)
+		case HTTP_OPT_KEEPALIVE:
+			config.KeepAlive, err = parseHTTPDuration(value)
+		case HTTP_OPT_MAX_IDLE_CONNS:
+			config.MaxIdleConns, err = strconv.Atoi(value)
+			if err == nil && config.MaxIdleConns < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		}
+		if err != nil {
+			return config, fmt.Errorf("Invalid HTTP option %v %v: %v", key, value, err)
+		}
+	}
+	return config, nil
+}
+
+func parseHTTPDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return d, nil
+}
+
+// GetHTTPConfig returns the HTTP config of a destination, which is the one
+// of daemon overridden by the HTTP options in query of its URL
+func GetHTTPConfig(query url.Values) (HTTPConfig, error) {
+	httpConfigLock.RLock()
+	config := httpConfig
+	httpConfigLock.RUnlock()
+	values := map[string]string{}
+	for _, key := range httpOptions {
+		if value, exists := query[key]; exists {
+			values[key] = value[0]
+		}
+	}
+	return parseHTTPOptions(config, values)
+}
+
+// HTTPQuery returns the HTTP options in query of destination URL, which
+// are kept in the URL of destination and backups to reach them the same way
+func HTTPQuery(query url.Values) url.Values {
+	v := url.Values{}
+	for _, key := range httpOptions {
+		if value, exists := query[key]; exists {
+			v.Set(key, value[0])
+		}
+	}
+	return v
+}
+
+/*
+Transport returns the transport of config shared by all destinations with
+the same config. Drivers are created per request, so sharing it keeps the
+connections to the objectstore open for reuse by the following requests,
+rather than leaving idle ones behind every time. It must not be changed,
+use NewTransport() for a transport to be tuned further.
+*/
+func (c HTTPConfig) Transport() *http.Transport {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	transport, exists := transports[c]
+	if !exists {
+		transport = c.NewTransport()
+		transports[c] = transport
+	}
+	return transport
+}
+
+// NewTransport returns a transport of http.DefaultTransport tuned by config
+func (c HTTPConfig) NewTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Proxy != "" {
+		// Validated by parseHTTPOptions()
+		u, _ := url.Parse(c.Proxy)
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if c.DialTimeout != 0 || c.KeepAlive != 0 {
+		dialer := &net.Dialer{
+			Timeout:   DEFAULT_HTTP_DIAL_TIMEOUT,
+			KeepAlive: DEFAULT_HTTP_KEEPALIVE,
+		}
+		if c.DialTimeout != 0 {
+			dialer.Timeout = c.DialTimeout
+		}
+		if c.KeepAlive != 0 {
+			dialer.KeepAlive = c.KeepAlive
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if c.ResponseTimeout != 0 {
+		transport.ResponseHeaderTimeout = c.ResponseTimeout
+	}
+	if c.MaxIdleConns != 0 {
+		// All connections of a destination go to the same host
+		transport.MaxIdleConns = c.MaxIdleConns
+		transport.MaxIdleConnsPerHost = c.MaxIdleConns
+	}
+	return transport
+}
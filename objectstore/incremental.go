@@ -0,0 +1,358 @@
+package objectstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+Incremental files backups only have the files changed since their parent
+backup, in the same tar layout as full ones, and record the paths deleted
+since the parent in DeletedPaths. A backup is restored by applying the
+backups from the full one to it in order, each one deleting its DeletedPaths
+then extracting its files. A backup which other backups are incremental to is
+merged into them when it's deleted, so the chain stays restorable.
+*/
+
+// CreateIncrementalFilesBackup uploads tarFile, a tar of the files changed
+// since the backup parentBackupName compressed with snapshot.Compression, as
+// a backup in files format incremental to it. deletedPaths are the paths
+// deleted since, or replaced by another type of file.
+func CreateIncrementalFilesBackup(volume *Volume, snapshot *Snapshot, tarFile string, deletedPaths []string, parentBackupName, destURL string) (string, error) {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return "", err
+	}
+	if !backupExists(parentBackupName, volume.Name, driver) {
+		return "", fmt.Errorf("Cannot find backup %v of volume %v to be incremental to", parentBackupName, volume.Name)
+	}
+	parent, err := loadBackup(parentBackupName, volume.Name, driver)
+	if err != nil {
+		return "", err
+	}
+	if parent.Format != BACKUP_FORMAT_FILES {
+		return "", fmt.Errorf("Cannot be incremental to backup %v of volume %v, which is not in %v format",
+			parentBackupName, volume.Name, BACKUP_FORMAT_FILES)
+	}
+	return createFilesBackup(volume, snapshot, tarFile, destURL, &Backup{
+		ParentBackupName: parentBackupName,
+		DeletedPaths:     deletedPaths,
+	})
+}
+
+// loadFilesBackupChain returns the backups from the full one to backup, in
+// the order they're applied
+func loadFilesBackupChain(backup *Backup, driver ObjectStoreDriver) ([]*Backup, error) {
+	chain, err := loadBackupChain(backup, driver)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range chain {
+		if err := checkArchiveRestored(b, driver); err != nil {
+			return nil, err
+		}
+	}
+	return chain, nil
+}
+
+// loadBackupChain returns the backups from the full one to backup, which is
+// incremental to the ones before it
+func loadBackupChain(backup *Backup, driver ObjectStoreDriver) ([]*Backup, error) {
+	chain := []*Backup{backup}
+	seen := map[string]bool{backup.Name: true}
+	for name := backup.ParentBackupName; name != ""; {
+		if seen[name] {
+			return nil, fmt.Errorf("BUG: Backup %v of volume %v is incremental to itself", name, backup.VolumeName)
+		}
+		seen[name] = true
+		parent, err := loadBackup(name, backup.VolumeName, driver)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load backup %v, which backup %v is incremental to: %v", name, backup.Name, err)
+		}
+		chain = append([]*Backup{parent}, chain...)
+		name = parent.ParentBackupName
+	}
+	return chain, nil
+}
+
+// applyFilesBackup deletes the paths deleted since the parent of backup in
+// dir, then extracts the files of backup into it. The file of backup is
+// downloaded to the staging directory first.
+func applyFilesBackup(backup *Backup, driver ObjectStoreDriver, dir string) error {
+	stagingDir, err := util.CreateStagingDir("restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingDir)
+	file, err := downloadSingleFileBackup(backup, driver, stagingDir)
+	if err != nil {
+		return err
+	}
+	return applyFilesBackupFile(backup, file, dir)
+}
+
+// applyFilesBackupFile is applyFilesBackup with the file of backup
+// downloaded already
+func applyFilesBackupFile(backup *Backup, file, dir string) error {
+	if err := removeDeletedPaths(dir, backup.DeletedPaths); err != nil {
+		return err
+	}
+	return util.ExtractDir(file, dir, backup.Compression)
+}
+
+// removeDeletedPaths removes paths relative to dir, without following
+// symlinks out of dir
+func removeDeletedPaths(dir string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	sorted := append([]string{}, paths...)
+	sort.Strings(sorted)
+	for _, path := range sorted {
+		cleaned, err := util.CleanRelativePath(path)
+		if err != nil {
+			return err
+		}
+		parent, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Dir(cleaned)))
+		if os.IsNotExist(err) {
+			// Removed along with its parent
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if parent != filepath.Join(root, filepath.Dir(cleaned)) {
+			return fmt.Errorf("Cannot remove deleted path %v, its parent is a symlink", path)
+		}
+		if err := os.RemoveAll(filepath.Join(root, cleaned)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractIncrementalFilesBackup restores the incremental backup to a
+// temporary directory, then copies paths from it to dir, since the files may
+// be in any backup of the chain
+func extractIncrementalFilesBackup(backupURL string, paths []string, dir string) error {
+	tmpDir, err := util.CreateStagingDir("restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := RestoreFilesBackup(backupURL, tmpDir); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_BACKUP_URL: backupURL,
+		LOG_FIELD_FILEPATH:   dir,
+	}).Debugf("Copying %v from restored incremental backup", paths)
+	return util.CopyPaths(tmpDir, paths, dir)
+}
+
+// DeleteFilesBackup deletes the backup of backupURL in files format. The
+// backups incremental to it are merged with it first, so they can still be
+// restored.
+func DeleteFilesBackup(backupURL string) error {
+	driver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return err
+	}
+	backupNames, err := getBackupNamesForVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+	for _, name := range backupNames {
+		if name == backupName {
+			continue
+		}
+		child, err := loadBackup(name, volumeName, driver)
+		if err != nil {
+			return err
+		}
+		if child.ParentBackupName != backupName {
+			continue
+		}
+		if err := mergeFilesBackup(backup, child, driver); err != nil {
+			return fmt.Errorf("Cannot delete backup %v, failed to merge it into backup %v incremental to it: %v", backupName, name, err)
+		}
+	}
+	if err := DeleteSingleFileBackup(backupURL); err != nil {
+		return err
+	}
+	// The next backup would be a full one if the last one was deleted
+	_, err = updateVolumeForRemovedBackup(backupName, volumeName, driver)
+	return err
+}
+
+/*
+mergeFilesBackup makes child, which is incremental to parent, incremental to
+the parent of parent instead, so parent can be deleted. The files of child
+are replaced by the ones of parent applied with child, leaving out the files
+of parent deleted since. The new files are uploaded over the old ones before
+the config of child is updated, and child restores to the same content with
+either of them.
+*/
+func mergeFilesBackup(parent, child *Backup, driver ObjectStoreDriver) error {
+	if err := checkArchiveRestored(parent, driver); err != nil {
+		return err
+	}
+	if err := checkArchiveRestored(child, driver); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_BACKUP,
+		LOG_FIELD_VOLUME: child.VolumeName,
+	}).Debugf("Merging backup %v into backup %v", parent.Name, child.Name)
+
+	// Both files are downloaded, and merged into a file of about the size
+	// of both, besides the extracted files
+	size := driver.FileSize(parent.SingleFile.FilePath) + driver.FileSize(child.SingleFile.FilePath)
+	if err := util.CheckStagingSpace(2*size, "merge of backup "+parent.Name); err != nil {
+		return err
+	}
+	tmpDir, err := util.CreateStagingDir("merge-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	dataDir := filepath.Join(tmpDir, "data")
+	if err := os.Mkdir(dataDir, 0700); err != nil {
+		return err
+	}
+
+	parentFile, err := downloadSingleFileBackup(parent, driver, tmpDir)
+	if err != nil {
+		return err
+	}
+	parentPaths, err := util.TarPaths(parentFile, parent.Compression)
+	if err != nil {
+		return err
+	}
+	if err := util.ExtractDir(parentFile, dataDir, parent.Compression); err != nil {
+		return err
+	}
+	if err := os.Remove(parentFile); err != nil {
+		return err
+	}
+	childFile, err := downloadSingleFileBackup(child, driver, tmpDir)
+	if err != nil {
+		return err
+	}
+	childPaths, err := util.TarPaths(childFile, child.Compression)
+	if err != nil {
+		return err
+	}
+	if err := applyFilesBackupFile(child, childFile, dataDir); err != nil {
+		return err
+	}
+
+	paths := mergeBackupPaths(parentPaths, childPaths, child.DeletedPaths)
+	mergedFile := filepath.Join(tmpDir, "merged"+util.CompressionExt(child.Compression))
+	if err := util.CompressPaths(dataDir, paths, mergedFile, child.Compression); err != nil {
+		return err
+	}
+	uploadFile := mergedFile
+	if child.EncryptionKeyID != "" {
+		if uploadFile, err = encryptFile(mergedFile, child.EncryptionKeyID); err != nil {
+			return err
+		}
+	}
+	if err := driver.Upload(uploadFile, child.SingleFile.FilePath); err != nil {
+		return err
+	}
+
+	child.ParentBackupName = parent.ParentBackupName
+	child.DeletedPaths = mergeDeletedPaths(parent.DeletedPaths, child.DeletedPaths)
+	if child.ParentBackupName == "" {
+		child.DeletedPaths = nil
+		child.FormatVersion = BACKUP_FORMAT_FILES_FULL_VERSION
+	}
+	if err := saveBackup(child, driver); err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_COMPLETE,
+		LOG_FIELD_EVENT:  LOG_EVENT_BACKUP,
+		LOG_FIELD_VOLUME: child.VolumeName,
+	}).Debugf("Merged backup %v into backup %v", parent.Name, child.Name)
+	return nil
+}
+
+// mergeBackupPaths returns the paths in the merge of a backup and the backup
+// incremental to it, which are the ones of the later backup, and the ones
+// of the earlier backup not deleted since. They're sorted, so directories
+// are extracted before their content.
+func mergeBackupPaths(parentPaths, childPaths, deletedPaths []string) []string {
+	set := map[string]bool{}
+	for _, path := range childPaths {
+		set[path] = true
+	}
+	deleted := map[string]bool{}
+	for _, path := range deletedPaths {
+		deleted[filepath.Clean(path)] = true
+	}
+	for _, path := range parentPaths {
+		if !pathDeleted(path, deleted) {
+			set[path] = true
+		}
+	}
+	paths := []string{}
+	for path := range set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// pathDeleted returns whether path or any directory containing it is deleted
+func pathDeleted(path string, deleted map[string]bool) bool {
+	for p := path; p != "." && p != "/" && p != ""; p = filepath.Dir(p) {
+		if deleted[p] {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeDeletedPaths(paths ...[]string) []string {
+	set := map[string]bool{}
+	for _, list := range paths {
+		for _, path := range list {
+			set[path] = true
+		}
+	}
+	result := []string{}
+	for path := range set {
+		result = append(result, path)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// mergeableBackup tells whether the backups incremental to the backup in
+// info, in the result of List(), are merged into them when it's deleted
+func mergeableBackup(info map[string]string) bool {
+	return info["Format"] == BACKUP_FORMAT_FILES
+}
@@ -0,0 +1,166 @@
+package objectstore
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/rancher/convoy/metrics"
+)
+
+// instrumentedDriver records latency, failures and uploaded bytes of every
+// operation to the underlying objectstore driver, labeled by destination
+type instrumentedDriver struct {
+	ObjectStoreDriver
+}
+
+// unwrapDriver returns the driver instrumented by GetObjectStoreDriver(), to
+// check which optional interfaces it implements. The calls of the ones
+// instrumentedDriver implements as well should still be made to driver, so
+// they're recorded.
+func unwrapDriver(driver ObjectStoreDriver) ObjectStoreDriver {
+	if d, ok := driver.(*instrumentedDriver); ok {
+		return d.ObjectStoreDriver
+	}
+	return driver
+}
+
+func (d *instrumentedDriver) record(operation string, start time.Time, err error) {
+	metrics.RecordObjectStoreRequest(d.GetURL(), operation, start, err)
+}
+
+func (d *instrumentedDriver) FileExists(filePath string) bool {
+	defer d.record("exists", time.Now(), nil)
+	return d.ObjectStoreDriver.FileExists(filePath)
+}
+
+func (d *instrumentedDriver) FileSize(filePath string) int64 {
+	defer d.record("size", time.Now(), nil)
+	return d.ObjectStoreDriver.FileSize(filePath)
+}
+
+func (d *instrumentedDriver) Remove(names ...string) error {
+	start := time.Now()
+	err := d.ObjectStoreDriver.Remove(names...)
+	d.record("remove", start, err)
+	return err
+}
+
+func (d *instrumentedDriver) Read(src string) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := d.ObjectStoreDriver.Read(src)
+	d.record("read", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &timedReadCloser{
+		countingReader: countingReader{Reader: rc},
+		closer:         rc,
+		destination:    d.GetURL(),
+		start:          start,
+	}, nil
+}
+
+func (d *instrumentedDriver) Write(dst string, rs io.ReadSeeker) error {
+	start := time.Now()
+	err := d.ObjectStoreDriver.Write(dst, rs)
+	d.record("write", start, err)
+	if err == nil {
+		if size, err := rs.Seek(0, os.SEEK_END); err == nil {
+			metrics.ObjectStoreBytesUploaded.Add(float64(size), d.GetURL())
+		}
+	}
+	return err
+}
+
+func (d *instrumentedDriver) List(path string) ([]string, error) {
+	start := time.Now()
+	result, err := d.ObjectStoreDriver.List(path)
+	d.record("list", start, err)
+	return result, err
+}
+
+// ListVersions must only be called if the underlying driver is a
+// VersionLister, see getVersionLister()
+func (d *instrumentedDriver) ListVersions(path string) (map[string]string, error) {
+	start := time.Now()
+	result, err := d.ObjectStoreDriver.(VersionLister).ListVersions(path)
+	d.record("list", start, err)
+	return result, err
+}
+
+// ListModTimes must only be called if the underlying driver is a
+// ModTimeLister, see getModTimeLister()
+func (d *instrumentedDriver) ListModTimes(path string) (map[string]time.Time, error) {
+	start := time.Now()
+	result, err := d.ObjectStoreDriver.(ModTimeLister).ListModTimes(path)
+	d.record("list", start, err)
+	return result, err
+}
+
+func (d *instrumentedDriver) Upload(src, dst string) error {
+	start := time.Now()
+	err := d.ObjectStoreDriver.Upload(src, dst)
+	d.record("upload", start, err)
+	if err == nil {
+		if st, err := os.Stat(src); err == nil {
+			metrics.ObjectStoreBytesUploaded.Add(float64(st.Size()), d.GetURL())
+		}
+	}
+	return err
+}
+
+func (d *instrumentedDriver) Download(src, dst string) error {
+	start := time.Now()
+	err := d.ObjectStoreDriver.Download(src, dst)
+	d.record("download", start, err)
+	if err == nil {
+		if st, err := os.Stat(dst); err == nil {
+			recordRead(d.GetURL(), st.Size(), time.Since(start))
+		}
+	}
+	return err
+}
+
+// UploadStream must only be called if the underlying driver is a
+// StreamUploader, see getStreamUploader()
+func (d *instrumentedDriver) UploadStream(src io.Reader, dst string) error {
+	start := time.Now()
+	counter := &countingReader{Reader: src}
+	err := d.ObjectStoreDriver.(StreamUploader).UploadStream(counter, dst)
+	d.record("upload", start, err)
+	if err == nil {
+		metrics.ObjectStoreBytesUploaded.Add(float64(counter.count), d.GetURL())
+	}
+	return err
+}
+
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// timedReadCloser records the bytes read from an object and the time it's
+// open once it's closed, which includes the time the reader spends between
+// reads, e.g. writing a restored stream
+type timedReadCloser struct {
+	countingReader
+	closer      io.Closer
+	destination string
+	start       time.Time
+	closed      bool
+}
+
+func (r *timedReadCloser) Close() error {
+	if !r.closed {
+		r.closed = true
+		recordRead(r.destination, r.count, time.Since(r.start))
+	}
+	return r.closer.Close()
+}
@@ -0,0 +1,242 @@
+package objectstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+/*
+KMS generates data keys to encrypt backups with, and returns them wrapped by
+a key which never leaves the KMS, so only the wrapped key is stored. It
+unwraps them again for restore.
+*/
+type KMS interface {
+	GenerateDataKey(kmsKeyID string) (key, wrapped []byte, err error)
+	Decrypt(kmsKeyID string, wrapped []byte) ([]byte, error)
+}
+
+// wrappedKey is a data key wrapped by KMS key KMSKeyID
+type wrappedKey struct {
+	KMSKeyID string
+	Blob     []byte
+}
+
+var (
+	kms KMS = &awsKMS{}
+
+	// Wrapped keys by ID of the data key, which are unwrapped when the key
+	// is needed
+	wrappedKeys     = make(map[string]wrappedKey)
+	wrappedKeysLock sync.RWMutex
+)
+
+// SetKMS replaces the KMS used for data keys, e.g. for tests, returns the
+// previous one
+func SetKMS(k KMS) KMS {
+	wrappedKeysLock.Lock()
+	defer wrappedKeysLock.Unlock()
+	previous := kms
+	kms = k
+	return previous
+}
+
+func getKMS() KMS {
+	wrappedKeysLock.RLock()
+	defer wrappedKeysLock.RUnlock()
+	return kms
+}
+
+/*
+GenerateKMSEncryptionKey makes a new data key wrapped by kmsKeyID available
+for backups, returns the ID of the data key and the wrapped key. Backups
+encrypted by it carry the wrapped key, so they're restored by unwrapping it
+with KMS, without the daemon keeping the key.
+*/
+func GenerateKMSEncryptionKey(kmsKeyID string) (string, []byte, error) {
+	key, wrapped, err := getKMS().GenerateDataKey(kmsKeyID)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to generate data key by KMS key %v: %v", kmsKeyID, err)
+	}
+	id, err := AddEncryptionKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	AddWrappedEncryptionKey(id, kmsKeyID, wrapped)
+	return id, wrapped, nil
+}
+
+// AddWrappedEncryptionKey makes the data key of id available once it's
+// needed, by unwrapping it with KMS key kmsKeyID
+func AddWrappedEncryptionKey(id, kmsKeyID string, wrapped []byte) {
+	wrappedKeysLock.Lock()
+	wrappedKeys[id] = wrappedKey{
+		KMSKeyID: kmsKeyID,
+		Blob:     append([]byte{}, wrapped...),
+	}
+	wrappedKeysLock.Unlock()
+}
+
+func getWrappedEncryptionKey(id string) (wrappedKey, bool) {
+	wrappedKeysLock.RLock()
+	defer wrappedKeysLock.RUnlock()
+	w, exists := wrappedKeys[id]
+	return w, exists
+}
+
+// unwrapEncryptionKey unwraps the key of id by KMS, which is then kept in
+// memory like the keys provided
+func unwrapEncryptionKey(id string) ([]byte, error) {
+	w, exists := getWrappedEncryptionKey(id)
+	if !exists {
+		return nil, fmt.Errorf("Cannot find encryption key %v, the key must be provided to access the backup", id)
+	}
+	key, err := getKMS().Decrypt(w.KMSKeyID, w.Blob)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt encryption key %v by KMS key %v: %v", id, w.KMSKeyID, err)
+	}
+	if GetEncryptionKeyID(key) != id {
+		return nil, fmt.Errorf("Encryption key decrypted by KMS key %v doesn't match key %v", w.KMSKeyID, id)
+	}
+	if _, err := AddEncryptionKey(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// setBackupWrappedKey records the wrapped key of backup, if it's encrypted
+// by a KMS data key
+func setBackupWrappedKey(backup *Backup) {
+	if backup.EncryptionKeyID == "" || backup.EncryptionKeyBlob != "" {
+		return
+	}
+	if w, exists := getWrappedEncryptionKey(backup.EncryptionKeyID); exists {
+		backup.EncryptionKMSKeyID = w.KMSKeyID
+		backup.EncryptionKeyBlob = base64.StdEncoding.EncodeToString(w.Blob)
+	}
+}
+
+// addBackupWrappedKey makes the wrapped key of backup available for
+// restoring it
+func addBackupWrappedKey(backup *Backup) error {
+	if backup.EncryptionKeyBlob == "" {
+		return nil
+	}
+	blob, err := base64.StdEncoding.DecodeString(backup.EncryptionKeyBlob)
+	if err != nil {
+		return fmt.Errorf("Invalid encryption key blob of backup %v: %v", backup.Name, err)
+	}
+	AddWrappedEncryptionKey(backup.EncryptionKeyID, backup.EncryptionKMSKeyID, blob)
+	return nil
+}
+
+const (
+	KMS_SERVICE = "kms"
+	// Data keys are for AES-256
+	KMS_KEY_SPEC = "AES_256"
+)
+
+// awsKMS calls AWS KMS by its JSON API, with the credentials of AWS SDK chain
+type awsKMS struct{}
+
+type kmsError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// getKMSRegion returns region of the key from its ARN, or AWS_REGION
+func getKMSRegion(kmsKeyID string) (string, error) {
+	// arn:aws:kms:<region>:<account>:key/<id>
+	if parts := strings.Split(kmsKeyID, ":"); len(parts) >= 6 && parts[0] == "arn" && parts[3] != "" {
+		return parts[3], nil
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown region of KMS key %v, use the ARN of the key or set AWS_REGION", kmsKeyID)
+}
+
+func (k *awsKMS) call(kmsKeyID, operation string, input, output interface{}) error {
+	region, err := getKMSRegion(kmsKeyID)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "https://kms."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+operation)
+	signer := v4.NewSigner(session.New().Config.Credentials)
+	if _, err := signer.Sign(req, bytes.NewReader(body), KMS_SERVICE, region, time.Now()); err != nil {
+		return err
+	}
+
+	httpConfig, err := GetHTTPConfig(nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: httpConfig.NewTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &kmsError{}
+		if json.Unmarshal(data, e) == nil && e.Type != "" {
+			return fmt.Errorf("%v %v: %v", operation, e.Type, e.Message)
+		}
+		return fmt.Errorf("%v failed with status %v: %v", operation, resp.StatusCode, string(data))
+	}
+	return json.Unmarshal(data, output)
+}
+
+func (k *awsKMS) GenerateDataKey(kmsKeyID string) ([]byte, []byte, error) {
+	input := map[string]string{
+		"KeyId":   kmsKeyID,
+		"KeySpec": KMS_KEY_SPEC,
+	}
+	output := &struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+	}{}
+	if err := k.call(kmsKeyID, "GenerateDataKey", input, output); err != nil {
+		return nil, nil, err
+	}
+	return output.Plaintext, output.CiphertextBlob, nil
+}
+
+func (k *awsKMS) Decrypt(kmsKeyID string, wrapped []byte) ([]byte, error) {
+	input := &struct {
+		CiphertextBlob []byte
+		KeyId          string
+	}{wrapped, kmsKeyID}
+	output := &struct {
+		Plaintext []byte
+	}{}
+	if err := k.call(kmsKeyID, "Decrypt", input, output); err != nil {
+		return nil, err
+	}
+	return output.Plaintext, nil
+}
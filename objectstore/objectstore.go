@@ -3,8 +3,13 @@ package objectstore
 import (
 	"fmt"
 	"net/url"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/rancher/convoy/convoydriver"
 	"github.com/rancher/convoy/util"
 )
 
@@ -19,6 +24,12 @@ type Volume struct {
 type Snapshot struct {
 	Name        string
 	CreatedTime string
+	// Backup of the snapshot would be encrypted with the key, see
+	// AddEncryptionKey(). Empty for no encryption.
+	EncryptionKeyID string
+	// Backup of the snapshot would be compressed with it, see
+	// util.COMPRESSION_*. Empty for the default.
+	Compression string
 }
 
 type Backup struct {
@@ -28,12 +39,67 @@ type Backup struct {
 	SnapshotName      string
 	SnapshotCreatedAt string
 	CreatedTime       string
+	// Size of the volume when the backup was created, since volume may be
+	// resized. Zero for backups created before it was recorded.
+	VolumeSize int64 `json:",omitempty"`
+	// ID of the key used to encrypt the backup data, empty if not encrypted
+	EncryptionKeyID string `json:",omitempty"`
+	// KMS key wrapping the encryption key, and the wrapped key in base64,
+	// if the key was generated by KMS. The key is unwrapped by KMS to
+	// restore the backup.
+	EncryptionKMSKeyID string `json:",omitempty"`
+	EncryptionKeyBlob  string `json:",omitempty"`
+	// Algorithm the backup data is compressed with, empty for backups
+	// created before it was recorded, which are gzipped
+	Compression string `json:",omitempty"`
+	// Format of portable backup, see BACKUP_FORMAT_FILES. Empty if backup
+	// can only be restored by the driver created it.
+	Format        string `json:",omitempty"`
+	FormatVersion int    `json:",omitempty"`
+	// Server side encryption mode of the objects, e.g. aws:kms for S3,
+	// empty if not encrypted by the storage service
+	ServerSideEncryption string `json:",omitempty"`
+	// Storage class the data was moved to by ArchiveBackup, and whether
+	// it must be restored before being read
+	StorageClass string `json:",omitempty"`
+	Archived     bool   `json:",omitempty"`
+	ArchivedAt   string `json:",omitempty"`
+	// Expiry of the copy retrieved by RestoreArchivedBackup, in RFC3339
+	ArchiveRestoreExpiry string `json:",omitempty"`
+	// Blocks are in the block store shared by all volumes of the
+	// destination, rather than the one of the volume, see SetSharedBlocks()
+	SharedBlocks bool `json:",omitempty"`
+	// Algorithm the blocks are checksummed by, see util.CHECKSUM_*. Empty
+	// for backups created before it was recorded, which use SHA-512.
+	ChecksumAlgorithm string `json:",omitempty"`
+	// Backup this one is incremental to, see CreateStreamBackup(). Empty
+	// for full backups.
+	ParentBackupName string `json:",omitempty"`
+	// Paths relative to the root of volume deleted since the parent
+	// backup, for incremental backup in files format
+	DeletedPaths []string `json:",omitempty"`
 
 	Blocks     []BlockMapping `json:",omitempty"`
 	SingleFile BackupFile     `json:",omitempty"`
 }
 
+// lockVolume serializes updates of the config of volume among the daemons
+// sharing the objectstore, if the driver needs it
+func lockVolume(volumeName string, driver ObjectStoreDriver) (func(), error) {
+	locker, ok := unwrapDriver(driver).(Locker)
+	if !ok {
+		return func() {}, nil
+	}
+	return locker.Lock(filepath.Join(getVolumePath(volumeName), VOLUME_LOCK_FILE))
+}
+
 func addVolume(volume *Volume, driver ObjectStoreDriver) error {
+	unlock, err := lockVolume(volume.Name, driver)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	if volumeExists(volume.Name, driver) {
 		return nil
 	}
@@ -66,6 +132,10 @@ func encodeBackupURL(backupName, volumeName, destURL string) string {
 	v := url.Values{}
 	v.Add("volume", volumeName)
 	v.Add("backup", backupName)
+	// Destination URL may have query already, e.g. endpoint of s3
+	if strings.Contains(destURL, "?") {
+		return destURL + "&" + v.Encode()
+	}
 	return destURL + "?" + v.Encode()
 }
 
@@ -83,72 +153,280 @@ func decodeBackupURL(backupURL string) (string, string, error) {
 	return backupName, volumeName, nil
 }
 
-func addListVolume(resp map[string]map[string]string, volumeName string, driver ObjectStoreDriver, storageDriverName string) error {
-	if volumeName == "" {
-		return fmt.Errorf("Invalid empty volume Name")
-	}
+// GetBackupVolumeName returns the name of volume of the backup in backupURL
+func GetBackupVolumeName(backupURL string) (string, error) {
+	_, volumeName, err := decodeBackupURL(backupURL)
+	return volumeName, err
+}
 
-	backupNames, err := getBackupNamesForVolume(volumeName, driver)
-	if err != nil {
-		return err
-	}
+/*
+ListOptions selects the backups returned by ListWithOptions. Backups are
+listed in order of volume name then backup name, so a long list can be
+fetched page by page, by passing the URL of the last backup of a page as
+Marker of the next one.
+*/
+type ListOptions struct {
+	VolumeName string
+	// Only backups created in [CreatedSince, CreatedUntil) are listed, zero
+	// value means no bound
+	CreatedSince time.Time
+	CreatedUntil time.Time
+	// Only backups after the one with URL Marker are listed
+	Marker string
+	// At most Limit backups are listed, zero means no limit
+	Limit int
+	// Read every config from the objectstore rather than the cache of the
+	// unchanged ones
+	NoCache bool
+}
 
-	volume, err := loadVolume(volumeName, driver)
+func (opts *ListOptions) createdInRange(backup *Backup) bool {
+	if opts.CreatedSince.IsZero() && opts.CreatedUntil.IsZero() {
+		return true
+	}
+	t, err := time.Parse(time.RubyDate, backup.CreatedTime)
 	if err != nil {
-		return err
+		log.Warnf("Skip backup %v of volume %v with invalid created time %v", backup.Name, backup.VolumeName, backup.CreatedTime)
+		return false
 	}
-	//Skip any volumes not owned by specified storage driver
-	if volume.Driver != storageDriverName {
-		return nil
+	if !opts.CreatedSince.IsZero() && t.Before(opts.CreatedSince) {
+		return false
+	}
+	if !opts.CreatedUntil.IsZero() && !t.Before(opts.CreatedUntil) {
+		return false
 	}
+	return true
+}
 
-	for _, backupName := range backupNames {
-		backup, err := loadBackup(backupName, volumeName, driver)
-		if err != nil {
-			return err
+// ParseListOptions parses options of ListBackup() of storage drivers
+func ParseListOptions(opts map[string]string) (*ListOptions, error) {
+	result := &ListOptions{
+		VolumeName: opts[convoydriver.OPT_VOLUME_NAME],
+		Marker:     opts[convoydriver.OPT_LIST_MARKER],
+		NoCache:    opts[convoydriver.OPT_LIST_NO_CACHE] == "true",
+	}
+	var err error
+	if value := opts[convoydriver.OPT_LIST_LIMIT]; value != "" {
+		if result.Limit, err = strconv.Atoi(value); err != nil || result.Limit < 0 {
+			return nil, fmt.Errorf("Invalid limit %v, must be a non-negative integer", value)
 		}
-		r := fillBackupInfo(backup, volume, driver.GetURL())
-		resp[r["BackupURL"]] = r
 	}
-	return nil
+	if value := opts[convoydriver.OPT_CREATED_SINCE]; value != "" {
+		if result.CreatedSince, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return nil, fmt.Errorf("Invalid time %v, must be in RFC3339 format: %v", value, err)
+		}
+	}
+	if value := opts[convoydriver.OPT_CREATED_UNTIL]; value != "" {
+		if result.CreatedUntil, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return nil, fmt.Errorf("Invalid time %v, must be in RFC3339 format: %v", value, err)
+		}
+	}
+	if result.Marker != "" {
+		if _, _, err := decodeBackupURL(result.Marker); err != nil {
+			return nil, fmt.Errorf("Invalid marker %v, must be a backup URL: %v", result.Marker, err)
+		}
+	}
+	return result, nil
+}
+
+// BackupURLLess orders backup URLs by volume name then backup name, which is
+// the order backups are listed in
+func BackupURLLess(url1, url2 string) bool {
+	backup1, volume1, err1 := decodeBackupURL(url1)
+	backup2, volume2, err2 := decodeBackupURL(url2)
+	if err1 != nil || err2 != nil {
+		return url1 < url2
+	}
+	if volume1 != volume2 {
+		return volume1 < volume2
+	}
+	return backup1 < backup2
 }
 
 func List(volumeName, destURL, storageDriverName string) (map[string]map[string]string, error) {
+	return ListWithOptions(destURL, storageDriverName, &ListOptions{
+		VolumeName: volumeName,
+	})
+}
+
+/*
+ListWithOptions returns backups of volumes created by storageDriverName in
+destURL, selected by opts. Backup configs are only loaded for the backups
+after marker, and no more than needed once limit is reached. Configs which
+haven't changed since the last list are taken from the cache, if the
+driver is a VersionLister.
+*/
+func ListWithOptions(destURL, storageDriverName string, opts *ListOptions) (map[string]map[string]string, error) {
 	driver, err := GetObjectStoreDriver(destURL)
 	if err != nil {
 		return nil, err
 	}
+
+	markerBackup, markerVolume := "", ""
+	if opts.Marker != "" {
+		if markerBackup, markerVolume, err = decodeBackupURL(opts.Marker); err != nil {
+			return nil, err
+		}
+	}
+
+	volumeNames := []string{opts.VolumeName}
+	if opts.VolumeName == "" {
+		if volumeNames, err = getVolumeNames(driver); err != nil {
+			return nil, err
+		}
+		sort.Strings(volumeNames)
+	}
+
+	lister := newCachedLister(driver, opts.NoCache)
 	resp := make(map[string]map[string]string)
-	if volumeName != "" {
-		if err = addListVolume(resp, volumeName, driver, storageDriverName); err != nil {
+	for _, volumeName := range volumeNames {
+		if volumeName == "" {
+			return nil, fmt.Errorf("Invalid empty volume Name")
+		}
+		if volumeName < markerVolume {
+			continue
+		}
+		backupVersions, err := lister.listVersions(getBackupPath(volumeName))
+		if err != nil {
 			return nil, err
 		}
-	} else {
-		volumeNames, err := getVolumeNames(driver)
+		var backupNames []string
+		if backupVersions != nil {
+			files := []string{}
+			for file := range backupVersions {
+				files = append(files, file)
+			}
+			if backupNames, err = util.ExtractNames(files, BACKUP_CONFIG_PREFIX, CFG_SUFFIX); err != nil {
+				return nil, err
+			}
+		} else if backupNames, err = getBackupNamesForVolume(volumeName, driver); err != nil {
+			return nil, err
+		}
+		if len(backupNames) == 0 {
+			continue
+		}
+		volumeVersions, err := lister.listVersions(getVolumePath(volumeName))
 		if err != nil {
 			return nil, err
 		}
-		for _, volumeName := range volumeNames {
-			if err := addListVolume(resp, volumeName, driver, storageDriverName); err != nil {
+		volume := &Volume{}
+		if err := lister.loadConfig(getVolumePath(volumeName), VOLUME_CONFIG_FILE, volumeVersions, volume, nil); err != nil {
+			return nil, err
+		}
+		//Skip any volumes not owned by specified storage driver
+		if volume.Driver != storageDriverName {
+			continue
+		}
+
+		sort.Strings(backupNames)
+		for _, backupName := range backupNames {
+			if volumeName == markerVolume && backupName <= markerBackup {
+				continue
+			}
+			backup := &Backup{}
+			if err := lister.loadConfig(getBackupPath(volumeName), getBackupConfigName(backupName), backupVersions, backup, func() {
+				// Blocks and deleted paths can be huge and aren't
+				// listed
+				backup.Blocks = nil
+				backup.DeletedPaths = nil
+			}); err != nil {
 				return nil, err
 			}
+			if !opts.createdInRange(backup) {
+				continue
+			}
+			r := fillBackupInfo(backup, volume, driver.GetURL())
+			resp[r["BackupURL"]] = r
+			if opts.Limit != 0 && len(resp) >= opts.Limit {
+				return resp, nil
+			}
 		}
 	}
 	return resp, nil
 }
 
+type backupInfoByTime []map[string]string
+
+func (b backupInfoByTime) Len() int {
+	return len(b)
+}
+
+func (b backupInfoByTime) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b backupInfoByTime) Less(i, j int) bool {
+	ti, erri := time.Parse(time.RubyDate, b[i]["CreatedTime"])
+	tj, errj := time.Parse(time.RubyDate, b[j]["CreatedTime"])
+	if erri != nil || errj != nil || ti.Equal(tj) {
+		return b[i]["BackupURL"] < b[j]["BackupURL"]
+	}
+	return ti.Before(tj)
+}
+
+// MergeBackupLists would merge results of List() from different destinations
+// into one list, sorted by backup creation time
+func MergeBackupLists(lists ...map[string]map[string]string) []map[string]string {
+	result := []map[string]string{}
+	for _, list := range lists {
+		for _, info := range list {
+			result = append(result, info)
+		}
+	}
+	sort.Sort(backupInfoByTime(result))
+	return result
+}
+
+func backupVolumeSize(backup *Backup, volume *Volume) int64 {
+	if backup.VolumeSize != 0 {
+		return backup.VolumeSize
+	}
+	return volume.Size
+}
+
 func fillBackupInfo(backup *Backup, volume *Volume, destURL string) map[string]string {
-	return map[string]string{
+	info := map[string]string{
 		"BackupName":        backup.Name,
 		"BackupURL":         encodeBackupURL(backup.Name, backup.VolumeName, destURL),
 		"DriverName":        volume.Driver,
 		"VolumeName":        backup.VolumeName,
-		"VolumeSize":        strconv.FormatInt(volume.Size, 10),
+		"VolumeSize":        strconv.FormatInt(backupVolumeSize(backup, volume), 10),
 		"VolumeCreatedAt":   volume.CreatedTime,
 		"SnapshotName":      backup.SnapshotName,
 		"SnapshotCreatedAt": backup.SnapshotCreatedAt,
 		"CreatedTime":       backup.CreatedTime,
 	}
+	if backup.EncryptionKeyID != "" {
+		info["EncryptionKeyID"] = backup.EncryptionKeyID
+	}
+	if backup.EncryptionKMSKeyID != "" {
+		info["EncryptionKMSKeyID"] = backup.EncryptionKMSKeyID
+	}
+	info["Compression"] = util.GetCompression(backup.Compression)
+	if format := backupFormat(backup, volume); format != "" {
+		info["Format"] = format
+	}
+	if backup.SharedBlocks {
+		info["SharedBlocks"] = "true"
+	}
+	if len(backup.Blocks) != 0 {
+		info["ChecksumAlgorithm"] = util.GetChecksumAlgorithm(backup.ChecksumAlgorithm)
+	}
+	if backup.ServerSideEncryption != "" {
+		info["ServerSideEncryption"] = backup.ServerSideEncryption
+	}
+	if backup.StorageClass != "" {
+		info["StorageClass"] = backup.StorageClass
+		info["ArchivedAt"] = backup.ArchivedAt
+		info["ArchiveStatus"] = archiveStatus(backup)
+	}
+	if backup.ArchiveRestoreExpiry != "" {
+		info["ArchiveRestoreExpiry"] = backup.ArchiveRestoreExpiry
+	}
+	if backup.ParentBackupName != "" {
+		info["ParentBackupURL"] = encodeBackupURL(backup.ParentBackupName, backup.VolumeName, destURL)
+	}
+	return info
 }
 
 func GetBackupInfo(backupURL string) (map[string]string, error) {
@@ -170,11 +448,25 @@ func GetBackupInfo(backupURL string) (map[string]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	return fillBackupInfo(backup, volume, driver.GetURL()), nil
+	info := fillBackupInfo(backup, volume, driver.GetURL())
+	// Only inspect asks the objectstore whether archived backup has been
+	// restored, since it's a request per backup
+	if backup.Archived {
+		archiver, err := getArchiver(driver)
+		if err != nil {
+			return nil, err
+		}
+		if info["ArchiveStatus"], err = archiver.GetArchiveStatus(backup.SingleFile.FilePath); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
 }
 
+// LoadVolume returns the objectstore volume of the backup, with the size of
+// volume at the time the backup was created
 func LoadVolume(backupURL string) (*Volume, error) {
-	_, volumeName, err := decodeBackupURL(backupURL)
+	backupName, volumeName, err := decodeBackupURL(backupURL)
 	if err != nil {
 		return nil, err
 	}
@@ -182,5 +474,14 @@ func LoadVolume(backupURL string) (*Volume, error) {
 	if err != nil {
 		return nil, err
 	}
-	return loadVolume(volumeName, driver)
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	volume.Size = backupVolumeSize(backup, volume)
+	return volume, nil
 }
@@ -0,0 +1,1590 @@
+package objectstore_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/convoy/convoydriver"
+	"github.com/rancher/convoy/metadata"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	// Involve VFS objectstore driver for registeration
+	_ "github.com/rancher/convoy/vfs"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	root string
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.root, err = ioutil.TempDir("", "convoy-objectstore")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	c.Assert(os.RemoveAll(s.root), IsNil)
+}
+
+func (s *TestSuite) createDest(c *C, name string) string {
+	path := filepath.Join(s.root, name)
+	c.Assert(os.Mkdir(path, 0700), IsNil)
+	return "vfs://" + path
+}
+
+func (s *TestSuite) TestMergeBackupListsAcrossDestinations(c *C) {
+	dest1 := s.createDest(c, "dest1")
+	dest2 := s.createDest(c, "dest2")
+
+	snapshotFile := filepath.Join(s.root, "snapshot.tar.gz")
+	c.Assert(ioutil.WriteFile(snapshotFile, []byte("snapshot"), 0600), IsNil)
+
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}
+	url1, err := objectstore.CreateSingleFileBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, snapshotFile, dest1)
+	c.Assert(err, IsNil)
+	url2, err := objectstore.CreateSingleFileBackup(volume, &objectstore.Snapshot{Name: "snapshot2"}, snapshotFile, dest2)
+	c.Assert(err, IsNil)
+
+	list1, err := objectstore.List("volume1", dest1, "vfs")
+	c.Assert(err, IsNil)
+	list2, err := objectstore.List("volume1", dest2, "vfs")
+	c.Assert(err, IsNil)
+
+	merged := objectstore.MergeBackupLists(list1, list2)
+	c.Assert(merged, HasLen, 2)
+	urls := map[string]bool{}
+	for _, info := range merged {
+		urls[info["BackupURL"]] = true
+	}
+	c.Assert(urls[url1], Equals, true)
+	c.Assert(urls[url2], Equals, true)
+}
+
+func (s *TestSuite) TestListWithOptions(c *C) {
+	dest := s.createDest(c, "dest")
+	snapshotFile := filepath.Join(s.root, "snapshot.tar.gz")
+	c.Assert(ioutil.WriteFile(snapshotFile, []byte("snapshot"), 0600), IsNil)
+
+	all := []string{}
+	for _, v := range []struct {
+		volume    string
+		driver    string
+		snapshots int
+	}{
+		{"volume2", "vfs", 2},
+		{"volume1", "vfs", 3},
+		{"volume3", "devicemapper", 1},
+	} {
+		volume := &objectstore.Volume{
+			Name:   v.volume,
+			Driver: v.driver,
+		}
+		for i := 0; i < v.snapshots; i++ {
+			backupURL, err := objectstore.CreateSingleFileBackup(volume, &objectstore.Snapshot{Name: fmt.Sprintf("snapshot%v", i)}, snapshotFile, dest)
+			c.Assert(err, IsNil)
+			if v.driver == "vfs" {
+				all = append(all, backupURL)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return objectstore.BackupURLLess(all[i], all[j])
+	})
+
+	list, err := objectstore.ListWithOptions(dest, "vfs", &objectstore.ListOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 5)
+
+	// Page through all backups in order
+	listed := []string{}
+	marker := ""
+	for {
+		page, err := objectstore.ListWithOptions(dest, "vfs", &objectstore.ListOptions{
+			Limit:  2,
+			Marker: marker,
+		})
+		c.Assert(err, IsNil)
+		if len(page) == 0 {
+			break
+		}
+		c.Assert(len(page) <= 2, Equals, true)
+		urls := []string{}
+		for backupURL := range page {
+			urls = append(urls, backupURL)
+		}
+		sort.Slice(urls, func(i, j int) bool {
+			return objectstore.BackupURLLess(urls[i], urls[j])
+		})
+		listed = append(listed, urls...)
+		marker = urls[len(urls)-1]
+	}
+	c.Assert(listed, DeepEquals, all)
+
+	list, err = objectstore.ListWithOptions(dest, "vfs", &objectstore.ListOptions{
+		VolumeName: "volume1",
+		Limit:      10,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 3)
+
+	now := time.Now()
+	list, err = objectstore.ListWithOptions(dest, "vfs", &objectstore.ListOptions{
+		CreatedSince: now.Add(-time.Hour),
+		CreatedUntil: now.Add(time.Hour),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 5)
+	list, err = objectstore.ListWithOptions(dest, "vfs", &objectstore.ListOptions{
+		CreatedSince: now.Add(time.Hour),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+	list, err = objectstore.ListWithOptions(dest, "vfs", &objectstore.ListOptions{
+		CreatedUntil: now.Add(-time.Hour),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
+
+func (s *TestSuite) TestParseListOptions(c *C) {
+	opts, err := objectstore.ParseListOptions(map[string]string{
+		convoydriver.OPT_VOLUME_NAME:   "volume1",
+		convoydriver.OPT_LIST_LIMIT:    "10",
+		convoydriver.OPT_LIST_MARKER:   "vfs:///backups?backup=backup1&volume=volume1",
+		convoydriver.OPT_CREATED_SINCE: "2016-01-02T15:04:05Z",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(opts.VolumeName, Equals, "volume1")
+	c.Assert(opts.Limit, Equals, 10)
+	c.Assert(opts.CreatedSince.Equal(time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)), Equals, true)
+	c.Assert(opts.CreatedUntil.IsZero(), Equals, true)
+
+	_, err = objectstore.ParseListOptions(map[string]string{convoydriver.OPT_LIST_LIMIT: "-1"})
+	c.Assert(err, ErrorMatches, "Invalid limit -1.*")
+	_, err = objectstore.ParseListOptions(map[string]string{convoydriver.OPT_CREATED_UNTIL: "yesterday"})
+	c.Assert(err, ErrorMatches, "Invalid time yesterday.*")
+	_, err = objectstore.ParseListOptions(map[string]string{convoydriver.OPT_LIST_MARKER: "vfs:///backups"})
+	c.Assert(err, ErrorMatches, "Invalid marker .*")
+}
+
+func (s *TestSuite) TestMergeBackupListsSortedByTime(c *C) {
+	older := map[string]map[string]string{
+		"vfs:///a?backup=b1&volume=v": {
+			"BackupURL":   "vfs:///a?backup=b1&volume=v",
+			"CreatedTime": "Mon Jan 02 15:04:05 +0000 2017",
+		},
+	}
+	newer := map[string]map[string]string{
+		"vfs:///b?backup=b2&volume=v": {
+			"BackupURL":   "vfs:///b?backup=b2&volume=v",
+			"CreatedTime": "Tue Jan 03 15:04:05 +0000 2017",
+		},
+	}
+	merged := objectstore.MergeBackupLists(newer, older)
+	c.Assert(merged, HasLen, 2)
+	c.Assert(merged[0]["BackupURL"], Equals, "vfs:///a?backup=b1&volume=v")
+	c.Assert(merged[1]["BackupURL"], Equals, "vfs:///b?backup=b2&volume=v")
+}
+
+func (s *TestSuite) TestBackupsToPrune(c *C) {
+	infos := map[string]map[string]string{}
+	urls := []string{}
+	for i := 1; i <= 4; i++ {
+		url := fmt.Sprintf("vfs:///a?backup=b%d&volume=v", i)
+		urls = append(urls, url)
+		infos[url] = map[string]string{
+			"BackupURL":   url,
+			"CreatedTime": fmt.Sprintf("Mon Jan 0%d 15:04:05 +0000 2017", i),
+		}
+	}
+	c.Assert(objectstore.BackupsToPrune(infos, urls[3], 0), IsNil)
+	c.Assert(objectstore.BackupsToPrune(infos, urls[3], 4), IsNil)
+	c.Assert(objectstore.BackupsToPrune(infos, urls[3], 2), DeepEquals, urls[:2])
+	c.Assert(objectstore.BackupsToPrune(infos, urls[3], 1), DeepEquals, urls[:3])
+
+	// Latest backup not listed yet would still be counted
+	delete(infos, urls[3])
+	c.Assert(objectstore.BackupsToPrune(infos, urls[3], 2), DeepEquals, urls[:2])
+
+	// Chain b1 <- b2 <- b4 and b3 alone, incremental ones are pruned first
+	// and the ones which retained ones are incremental to are kept
+	infos[urls[3]] = map[string]string{
+		"BackupURL":   urls[3],
+		"CreatedTime": "Mon Jan 04 15:04:05 +0000 2017",
+	}
+	infos[urls[1]]["ParentBackupURL"] = urls[0]
+	infos[urls[3]]["ParentBackupURL"] = urls[1]
+	c.Assert(objectstore.BackupsToPrune(infos, urls[3], 1), DeepEquals, []string{urls[2]})
+	delete(infos[urls[3]], "ParentBackupURL")
+	c.Assert(objectstore.BackupsToPrune(infos, urls[3], 1), DeepEquals, []string{urls[1], urls[2], urls[0]})
+
+	// Backups in files format are merged into the retained ones instead
+	infos[urls[3]]["ParentBackupURL"] = urls[1]
+	for _, url := range urls {
+		infos[url]["Format"] = objectstore.BACKUP_FORMAT_FILES
+	}
+	c.Assert(objectstore.BackupsToPrune(infos, urls[3], 1), DeepEquals, []string{urls[1], urls[2], urls[0]})
+}
+
+// fakeDeltaOps serves snapshots from memory, always comparing as full
+type fakeDeltaOps struct {
+	snapshots map[string][]byte
+}
+
+func (f *fakeDeltaOps) HasSnapshot(id, volumeID string) bool {
+	_, exists := f.snapshots[id]
+	return exists
+}
+
+func (f *fakeDeltaOps) CompareSnapshot(id, compareID, volumeID string) (*metadata.Mappings, error) {
+	data, exists := f.snapshots[id]
+	if !exists {
+		return nil, fmt.Errorf("snapshot %v doesn't exist", id)
+	}
+	return &metadata.Mappings{
+		Mappings: []metadata.Mapping{
+			{Offset: 0, Size: int64(len(data))},
+		},
+		BlockSize: objectstore.DEFAULT_BLOCK_SIZE,
+	}, nil
+}
+
+func (f *fakeDeltaOps) OpenSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func (f *fakeDeltaOps) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	copy(data, f.snapshots[id][start:])
+	return nil
+}
+
+func (f *fakeDeltaOps) CloseSnapshot(id, volumeID string) error {
+	return nil
+}
+
+func (s *TestSuite) TestDeltaBlockBackupAfterResize(c *C) {
+	dest := s.createDest(c, "dest")
+	blockSize := int64(objectstore.DEFAULT_BLOCK_SIZE)
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": bytes.Repeat([]byte{1}, int(2*blockSize)),
+			"snapshot2": bytes.Repeat([]byte{2}, int(3*blockSize)),
+		},
+	}
+
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   2 * blockSize,
+	}
+	url1, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+
+	// Volume was resized before the next backup
+	volume.Size = 3 * blockSize
+	url2, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot2"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+
+	objVolume, err := objectstore.LoadVolume(url1)
+	c.Assert(err, IsNil)
+	c.Assert(objVolume.Size, Equals, 2*blockSize)
+	objVolume, err = objectstore.LoadVolume(url2)
+	c.Assert(err, IsNil)
+	c.Assert(objVolume.Size, Equals, 3*blockSize)
+
+	for url, snapshot := range map[string]string{url1: "snapshot1", url2: "snapshot2"} {
+		info, err := objectstore.GetBackupInfo(url)
+		c.Assert(err, IsNil)
+		c.Assert(info["VolumeSize"], Equals, fmt.Sprint(len(deltaOps.snapshots[snapshot])))
+
+		restored := filepath.Join(s.root, snapshot+".img")
+		c.Assert(objectstore.RestoreDeltaBlockBackup(url, restored), IsNil)
+		data, err := ioutil.ReadFile(restored)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(data, deltaOps.snapshots[snapshot]), Equals, true)
+	}
+}
+
+func (s *TestSuite) TestParseEncryptionKey(c *C) {
+	key := bytes.Repeat([]byte{0xab}, objectstore.ENCRYPTION_KEY_SIZE)
+	for _, data := range [][]byte{
+		key,
+		[]byte(hex.EncodeToString(key) + "\n"),
+		[]byte(base64.StdEncoding.EncodeToString(key)),
+	} {
+		parsed, err := objectstore.ParseEncryptionKey(data)
+		c.Assert(err, IsNil)
+		c.Assert(parsed, DeepEquals, key)
+	}
+	_, err := objectstore.ParseEncryptionKey([]byte("short"))
+	c.Assert(err, ErrorMatches, "Invalid encryption key.*")
+}
+
+func (s *TestSuite) TestEncryptedBackup(c *C) {
+	dest := s.createDest(c, "dest")
+	blockSize := int64(objectstore.DEFAULT_BLOCK_SIZE)
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": bytes.Repeat([]byte{1}, int(2*blockSize)),
+			"snapshot2": bytes.Repeat([]byte{1}, int(2*blockSize)),
+		},
+	}
+	keyID, err := objectstore.AddEncryptionKey(bytes.Repeat([]byte{0xcd}, objectstore.ENCRYPTION_KEY_SIZE))
+	c.Assert(err, IsNil)
+
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   2 * blockSize,
+	}
+	_, err = objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{
+		Name:            "snapshot1",
+		EncryptionKeyID: "nonexistent",
+	}, dest, deltaOps)
+	c.Assert(err, ErrorMatches, "Cannot find encryption key nonexistent.*")
+
+	encryptedURL, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{
+		Name:            "snapshot1",
+		EncryptionKeyID: keyID,
+	}, dest, deltaOps)
+	c.Assert(err, IsNil)
+	info, err := objectstore.GetBackupInfo(encryptedURL)
+	c.Assert(err, IsNil)
+	c.Assert(info["EncryptionKeyID"], Equals, keyID)
+
+	// The same data backed up without encryption must not share blocks
+	// with the encrypted backup
+	plainURL, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot2"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+	info, err = objectstore.GetBackupInfo(plainURL)
+	c.Assert(err, IsNil)
+	c.Assert(info["EncryptionKeyID"], Equals, "")
+
+	for _, url := range []string{encryptedURL, plainURL} {
+		restored := filepath.Join(s.root, "restored.img")
+		c.Assert(objectstore.RestoreDeltaBlockBackup(url, restored), IsNil)
+		data, err := ioutil.ReadFile(restored)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(data, deltaOps.snapshots["snapshot1"]), Equals, true)
+	}
+
+	c.Assert(objectstore.DeleteDeltaBlockBackup(encryptedURL), IsNil)
+	restored := filepath.Join(s.root, "restored.img")
+	c.Assert(objectstore.RestoreDeltaBlockBackup(plainURL, restored), IsNil)
+
+	// Single file backup
+	content := bytes.Repeat([]byte("snapshot"), objectstore.ENCRYPTION_CHUNK_SIZE/4)
+	snapshotFile := filepath.Join(s.root, "snapshot.tar.gz")
+	c.Assert(ioutil.WriteFile(snapshotFile, content, 0600), IsNil)
+	url, err := objectstore.CreateSingleFileBackup(&objectstore.Volume{
+		Name:   "volume2",
+		Driver: "vfs",
+	}, &objectstore.Snapshot{
+		Name:            "snapshot1",
+		EncryptionKeyID: keyID,
+	}, snapshotFile, dest)
+	c.Assert(err, IsNil)
+
+	restoreDir := filepath.Join(s.root, "restore")
+	c.Assert(os.Mkdir(restoreDir, 0700), IsNil)
+	restoredFile, err := objectstore.RestoreSingleFileBackup(url, restoreDir)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(restoredFile)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(data, content), Equals, true)
+	files, err := ioutil.ReadDir(restoreDir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+}
+
+func (s *TestSuite) TestFilesBackup(c *C) {
+	dest := s.createDest(c, "dest")
+
+	srcDir := filepath.Join(s.root, "src")
+	c.Assert(os.Mkdir(srcDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "file1"), []byte("content1"), 0600), IsNil)
+	tarFile := filepath.Join(s.root, "snapshot.tar.gz")
+	c.Assert(util.CompressDir(srcDir, tarFile, util.COMPRESSION_GZIP), IsNil)
+
+	url, err := objectstore.CreateFilesBackup(&objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}, &objectstore.Snapshot{Name: "snapshot1"}, tarFile, dest)
+	c.Assert(err, IsNil)
+	format, err := objectstore.GetBackupFormat(url)
+	c.Assert(err, IsNil)
+	c.Assert(format, Equals, objectstore.BACKUP_FORMAT_FILES)
+	info, err := objectstore.GetBackupInfo(url)
+	c.Assert(err, IsNil)
+	c.Assert(info["Format"], Equals, objectstore.BACKUP_FORMAT_FILES)
+
+	// Existing files are kept
+	restoreDir := filepath.Join(s.root, "restore")
+	c.Assert(os.Mkdir(restoreDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(restoreDir, "file2"), []byte("content2"), 0600), IsNil)
+	c.Assert(objectstore.RestoreFilesBackup(url, restoreDir), IsNil)
+	files, err := ioutil.ReadDir(restoreDir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	data, err := ioutil.ReadFile(filepath.Join(restoreDir, "file1"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "content1")
+
+	zstdFile := filepath.Join(s.root, "snapshot.tar.zst")
+	c.Assert(util.CompressDir(srcDir, zstdFile, util.COMPRESSION_ZSTD), IsNil)
+	zstdURL, err := objectstore.CreateFilesBackup(&objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}, &objectstore.Snapshot{Name: "snapshot2", Compression: util.COMPRESSION_ZSTD}, zstdFile, dest)
+	c.Assert(err, IsNil)
+	info, err = objectstore.GetBackupInfo(zstdURL)
+	c.Assert(err, IsNil)
+	c.Assert(info["Compression"], Equals, util.COMPRESSION_ZSTD)
+	zstdDir := filepath.Join(s.root, "restore-zstd")
+	c.Assert(os.Mkdir(zstdDir, 0700), IsNil)
+	c.Assert(objectstore.RestoreFilesBackup(zstdURL, zstdDir), IsNil)
+	data, err = ioutil.ReadFile(filepath.Join(zstdDir, "file1"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "content1")
+
+	// Backups of vfs created before format was recorded
+	legacyURL, err := objectstore.CreateSingleFileBackup(&objectstore.Volume{
+		Name:   "volume2",
+		Driver: "vfs",
+	}, &objectstore.Snapshot{Name: "snapshot1"}, tarFile, dest)
+	c.Assert(err, IsNil)
+	format, err = objectstore.GetBackupFormat(legacyURL)
+	c.Assert(err, IsNil)
+	c.Assert(format, Equals, objectstore.BACKUP_FORMAT_FILES)
+
+	otherURL, err := objectstore.CreateSingleFileBackup(&objectstore.Volume{
+		Name:   "volume3",
+		Driver: "other",
+	}, &objectstore.Snapshot{Name: "snapshot1"}, tarFile, dest)
+	c.Assert(err, IsNil)
+	format, err = objectstore.GetBackupFormat(otherURL)
+	c.Assert(err, IsNil)
+	c.Assert(format, Equals, "")
+	err = objectstore.RestoreFilesBackup(otherURL, restoreDir)
+	c.Assert(err, ErrorMatches, "Backup .* is not in files format")
+}
+
+func (s *TestSuite) TestFilesBackupFromDir(c *C) {
+	dest := s.createDest(c, "dest")
+	c.Assert(objectstore.StreamUploadSupported(dest), Equals, true)
+
+	srcDir := filepath.Join(s.root, "src")
+	c.Assert(os.MkdirAll(filepath.Join(srcDir, "dir"), 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "file1"), []byte("content1"), 0600), IsNil)
+	large := strings.Repeat("content2", objectstore.ENCRYPTION_CHUNK_SIZE/4)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "dir", "file2"), []byte(large), 0600), IsNil)
+	keyID, err := objectstore.AddEncryptionKey(bytes.Repeat([]byte{0xef}, objectstore.ENCRYPTION_KEY_SIZE))
+	c.Assert(err, IsNil)
+
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}
+	for _, snapshot := range []*objectstore.Snapshot{
+		{Name: "snapshot1"},
+		{Name: "snapshot2", Compression: util.COMPRESSION_ZSTD},
+		{Name: "snapshot3", EncryptionKeyID: keyID},
+	} {
+		url, err := objectstore.CreateFilesBackupFromDir(volume, snapshot, srcDir, dest)
+		c.Assert(err, IsNil)
+		info, err := objectstore.GetBackupInfo(url)
+		c.Assert(err, IsNil)
+		c.Assert(info["Format"], Equals, objectstore.BACKUP_FORMAT_FILES)
+		c.Assert(info["Compression"], Equals, util.GetCompression(snapshot.Compression))
+		c.Assert(info["EncryptionKeyID"], Equals, snapshot.EncryptionKeyID)
+		s.assertFiles(c, s.restoreFiles(c, url), map[string]string{
+			"file1":     "content1",
+			"dir/file2": large,
+		})
+
+		// The next backup can be incremental to it
+		backup, err := objectstore.LoadLastBackup(volume.Name, dest)
+		c.Assert(err, IsNil)
+		c.Assert(backup.SnapshotName, Equals, snapshot.Name)
+	}
+
+	// Nothing is left if the tarball cannot be created
+	_, err = objectstore.CreateFilesBackupFromDir(volume, &objectstore.Snapshot{Name: "snapshot4"},
+		filepath.Join(s.root, "nonexistent"), dest)
+	c.Assert(err, NotNil)
+	backups, err := objectstore.List(volume.Name, dest, "vfs")
+	c.Assert(err, IsNil)
+	c.Assert(backups, HasLen, 3)
+	uploaded := []string{}
+	c.Assert(filepath.Walk(strings.TrimPrefix(dest, "vfs://"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Base(filepath.Dir(path)) == objectstore.BACKUP_FILES_DIRECTORY {
+			uploaded = append(uploaded, path)
+		}
+		return err
+	}), IsNil)
+	c.Assert(uploaded, HasLen, 3)
+}
+
+func (s *TestSuite) TestStagingDir(c *C) {
+	dest := s.createDest(c, "dest")
+	stagingDir := filepath.Join(s.root, "staging")
+	c.Assert(util.SetStagingDir(stagingDir), IsNil)
+	defer util.SetStagingDir("")
+
+	srcDir := filepath.Join(s.root, "src")
+	c.Assert(os.Mkdir(srcDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "file1"), []byte("content1"), 0600), IsNil)
+	tarFile := filepath.Join(s.root, "snapshot.tar.gz")
+	c.Assert(util.CompressDir(srcDir, tarFile, util.COMPRESSION_GZIP), IsNil)
+	url, err := objectstore.CreateFilesBackup(&objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}, &objectstore.Snapshot{Name: "snapshot1"}, tarFile, dest)
+	c.Assert(err, IsNil)
+
+	// Backup is downloaded to the staging directory rather than the
+	// restored one, and removed once extracted
+	s.assertFiles(c, s.restoreFiles(c, url), map[string]string{
+		"file1": "content1",
+	})
+	copyURL, err := objectstore.CopyBackup(url, s.createDest(c, "copy"))
+	c.Assert(err, IsNil)
+	s.assertFiles(c, s.restoreFiles(c, copyURL), map[string]string{
+		"file1": "content1",
+	})
+	staged, err := ioutil.ReadDir(stagingDir)
+	c.Assert(err, IsNil)
+	c.Assert(staged, HasLen, 0)
+}
+
+func (s *TestSuite) assertFiles(c *C, dir string, expected map[string]string) {
+	files := map[string]string{}
+	c.Assert(filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files[rel] = string(data)
+		return err
+	}), IsNil)
+	c.Assert(files, DeepEquals, expected)
+}
+
+func (s *TestSuite) restoreFiles(c *C, url string) string {
+	dir, err := ioutil.TempDir(s.root, "restore")
+	c.Assert(err, IsNil)
+	c.Assert(objectstore.RestoreFilesBackup(url, dir), IsNil)
+	return dir
+}
+
+func (s *TestSuite) TestIncrementalFilesBackup(c *C) {
+	dest := s.createDest(c, "dest")
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}
+	srcDir := filepath.Join(s.root, "src")
+	c.Assert(os.MkdirAll(filepath.Join(srcDir, "dir"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "dir", "unchanged"), []byte("unchanged"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "changed"), []byte("version 1"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "deleted"), []byte("deleted"), 0644), IsNil)
+	tarFile := filepath.Join(s.root, "backup.tar.gz")
+	c.Assert(util.CompressDir(srcDir, tarFile, util.COMPRESSION_GZIP), IsNil)
+	url1, err := objectstore.CreateFilesBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, tarFile, dest)
+	c.Assert(err, IsNil)
+	last, err := objectstore.LoadLastBackup("volume1", dest)
+	c.Assert(err, IsNil)
+	c.Assert(last.SnapshotName, Equals, "snapshot1")
+
+	_, err = objectstore.CreateIncrementalFilesBackup(volume, &objectstore.Snapshot{Name: "snapshot2"}, tarFile, nil, "backup-missing", dest)
+	c.Assert(err, ErrorMatches, "Cannot find backup backup-missing of volume volume1 to be incremental to")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "changed"), []byte("version 2"), 0644), IsNil)
+	c.Assert(os.Remove(filepath.Join(srcDir, "deleted")), IsNil)
+	c.Assert(util.CompressPaths(srcDir, []string{"changed"}, tarFile, util.COMPRESSION_GZIP), IsNil)
+	url2, err := objectstore.CreateIncrementalFilesBackup(volume, &objectstore.Snapshot{Name: "snapshot2"}, tarFile, []string{"deleted"}, last.Name, dest)
+	c.Assert(err, IsNil)
+
+	c.Assert(os.Mkdir(filepath.Join(srcDir, "deleted"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "deleted", "added"), []byte("added"), 0644), IsNil)
+	c.Assert(os.RemoveAll(filepath.Join(srcDir, "dir")), IsNil)
+	c.Assert(util.CompressPaths(srcDir, []string{"deleted", "deleted/added"}, tarFile, util.COMPRESSION_ZSTD), IsNil)
+	last, err = objectstore.LoadLastBackup("volume1", dest)
+	c.Assert(err, IsNil)
+	url3, err := objectstore.CreateIncrementalFilesBackup(volume, &objectstore.Snapshot{
+		Name:        "snapshot3",
+		Compression: util.COMPRESSION_ZSTD,
+	}, tarFile, []string{"dir"}, last.Name, dest)
+	c.Assert(err, IsNil)
+	info, err := objectstore.GetBackupInfo(url3)
+	c.Assert(err, IsNil)
+	c.Assert(info["ParentBackupURL"], Equals, url2)
+
+	// Every backup restores to the files at its time
+	snapshot1 := map[string]string{
+		"dir/unchanged": "unchanged",
+		"changed":       "version 1",
+		"deleted":       "deleted",
+	}
+	snapshot2 := map[string]string{
+		"dir/unchanged": "unchanged",
+		"changed":       "version 2",
+	}
+	snapshot3 := map[string]string{
+		"changed":       "version 2",
+		"deleted/added": "added",
+	}
+	s.assertFiles(c, s.restoreFiles(c, url1), snapshot1)
+	s.assertFiles(c, s.restoreFiles(c, url2), snapshot2)
+	s.assertFiles(c, s.restoreFiles(c, url3), snapshot3)
+
+	extractDir := filepath.Join(s.root, "extract")
+	c.Assert(os.Mkdir(extractDir, 0700), IsNil)
+	c.Assert(objectstore.ExtractFilesBackup(url2, []string{"changed", "dir"}, extractDir), IsNil)
+	s.assertFiles(c, extractDir, snapshot2)
+
+	// Deleted backups are merged into the ones incremental to them
+	c.Assert(objectstore.DeleteFilesBackup(url2), IsNil)
+	info, err = objectstore.GetBackupInfo(url3)
+	c.Assert(err, IsNil)
+	c.Assert(info["ParentBackupURL"], Equals, url1)
+	s.assertFiles(c, s.restoreFiles(c, url3), snapshot3)
+	c.Assert(objectstore.DeleteFilesBackup(url1), IsNil)
+	info, err = objectstore.GetBackupInfo(url3)
+	c.Assert(err, IsNil)
+	c.Assert(info["ParentBackupURL"], Equals, "")
+	s.assertFiles(c, s.restoreFiles(c, url3), snapshot3)
+
+	c.Assert(objectstore.DeleteFilesBackup(url3), IsNil)
+	last, err = objectstore.LoadLastBackup("volume1", dest)
+	c.Assert(err, IsNil)
+	c.Assert(last, IsNil)
+}
+
+func (s *TestSuite) createStream(c *C, name, content string) string {
+	streamFile := filepath.Join(s.root, name)
+	f, err := os.Create(streamFile)
+	c.Assert(err, IsNil)
+	c.Assert(util.CompressStream(f, strings.NewReader(content), util.COMPRESSION_GZIP), IsNil)
+	c.Assert(f.Close(), IsNil)
+	return streamFile
+}
+
+func (s *TestSuite) TestStreamBackup(c *C) {
+	dest := s.createDest(c, "dest")
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "zfs",
+	}
+
+	backupName, snapshotName, err := objectstore.GetLastBackup("volume1", dest)
+	c.Assert(err, IsNil)
+	c.Assert(backupName, Equals, "")
+	c.Assert(snapshotName, Equals, "")
+
+	_, err = objectstore.CreateStreamBackup(volume, &objectstore.Snapshot{Name: "snapshot1"},
+		s.createStream(c, "stream1", "full"), "backup-missing", dest)
+	c.Assert(err, ErrorMatches, "Cannot find backup backup-missing of volume volume1 to be incremental to")
+	url1, err := objectstore.CreateStreamBackup(volume, &objectstore.Snapshot{Name: "snapshot1"},
+		s.createStream(c, "stream1", "full"), "", dest)
+	c.Assert(err, IsNil)
+	backupName, snapshotName, err = objectstore.GetLastBackup("volume1", dest)
+	c.Assert(err, IsNil)
+	c.Assert(snapshotName, Equals, "snapshot1")
+	url2, err := objectstore.CreateStreamBackup(volume, &objectstore.Snapshot{Name: "snapshot2"},
+		s.createStream(c, "stream2", "incremental"), backupName, dest)
+	c.Assert(err, IsNil)
+	info, err := objectstore.GetBackupInfo(url2)
+	c.Assert(err, IsNil)
+	c.Assert(info["ParentBackupURL"], Equals, url1)
+
+	// Streams are received from the full one
+	received := []string{}
+	c.Assert(objectstore.RestoreStreamBackup(url2, func(stream io.Reader) error {
+		data, err := ioutil.ReadAll(stream)
+		received = append(received, string(data))
+		return err
+	}), IsNil)
+	c.Assert(received, DeepEquals, []string{"full", "incremental"})
+	c.Assert(objectstore.RestoreStreamBackup(url1, func(stream io.Reader) error {
+		return fmt.Errorf("receive failed")
+	}), ErrorMatches, "receive failed")
+
+	c.Assert(objectstore.DeleteStreamBackup(url1), ErrorMatches, "Cannot delete backup .*, backup .* is incremental to it")
+	c.Assert(objectstore.DeleteStreamBackup(url2), IsNil)
+	backupName, _, err = objectstore.GetLastBackup("volume1", dest)
+	c.Assert(err, IsNil)
+	c.Assert(backupName, Equals, "")
+	c.Assert(objectstore.DeleteStreamBackup(url1), IsNil)
+}
+
+func (s *TestSuite) TestEstimateRestore(c *C) {
+	dest := s.createDest(c, "dest")
+	blockSize := int64(objectstore.DEFAULT_BLOCK_SIZE)
+	// Random data isn't compressed, so the blocks are large enough to
+	// measure the bandwidth by
+	data := make([]byte, 2*blockSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": data,
+		},
+	}
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   4 * blockSize,
+	}
+	url, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+	c.Assert(objectstore.CheckRestore(url), IsNil)
+
+	// Nothing has been read from the destination yet
+	estimate, err := objectstore.EstimateRestore(url, false)
+	c.Assert(err, IsNil)
+	c.Assert(estimate.VolumeSize, Equals, 4*blockSize)
+	c.Assert(estimate.Blocks, Equals, 2)
+	c.Assert(estimate.DataSize, Equals, 2*blockSize)
+	c.Assert(estimate.DownloadSize >= 2*blockSize, Equals, true)
+	c.Assert(estimate.Concurrency, Equals, 2)
+	c.Assert(estimate.Bandwidth, Equals, float64(0))
+	c.Assert(estimate.Duration, Equals, time.Duration(0))
+
+	estimate, err = objectstore.EstimateRestore(url, true)
+	c.Assert(err, IsNil)
+	c.Assert(estimate.Bandwidth > 0, Equals, true)
+	c.Assert(estimate.Duration > 0, Equals, true)
+
+	volume = &objectstore.Volume{
+		Name:   "volume2",
+		Driver: "zfs",
+	}
+	url1, err := objectstore.CreateStreamBackup(volume, &objectstore.Snapshot{Name: "snapshot1"},
+		s.createStream(c, "stream1", "full"), "", dest)
+	c.Assert(err, IsNil)
+	backupName, _, err := objectstore.GetLastBackup("volume2", dest)
+	c.Assert(err, IsNil)
+	url2, err := objectstore.CreateStreamBackup(volume, &objectstore.Snapshot{Name: "snapshot2"},
+		s.createStream(c, "stream2", "incremental"), backupName, dest)
+	c.Assert(err, IsNil)
+
+	// Restore downloads the streams of both backups
+	estimate1, err := objectstore.EstimateRestore(url1, false)
+	c.Assert(err, IsNil)
+	c.Assert(estimate1.Files, Equals, 1)
+	estimate2, err := objectstore.EstimateRestore(url2, false)
+	c.Assert(err, IsNil)
+	c.Assert(estimate2.Files, Equals, 2)
+	c.Assert(estimate2.Blocks, Equals, 0)
+	c.Assert(estimate2.DataSize, Equals, int64(-1))
+	c.Assert(estimate2.DownloadSize > estimate1.DownloadSize, Equals, true)
+	c.Assert(estimate2.Concurrency, Equals, 1)
+	// The bandwidth measured by the delta block backup is reused
+	c.Assert(estimate2.Bandwidth, Equals, estimate.Bandwidth)
+	c.Assert(estimate2.Duration > 0, Equals, true)
+}
+
+func (s *TestSuite) TestCompressedDeltaBlockBackup(c *C) {
+	dest := s.createDest(c, "dest")
+	blockSize := objectstore.DEFAULT_BLOCK_SIZE
+	data := append(bytes.Repeat([]byte{1}, blockSize), bytes.Repeat([]byte{2}, blockSize)...)
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": data,
+			"snapshot2": data,
+			"snapshot3": data,
+		},
+	}
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   int64(len(data)),
+	}
+
+	_, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot1", Compression: "bzip2"}, dest, deltaOps)
+	c.Assert(err, ErrorMatches, "Invalid compression bzip2.*")
+
+	urls := map[string]string{}
+	for i, compression := range []string{"", util.COMPRESSION_ZSTD, util.COMPRESSION_LZ4} {
+		snapshot := &objectstore.Snapshot{
+			Name:        fmt.Sprintf("snapshot%v", i+1),
+			Compression: compression,
+		}
+		url, err := objectstore.CreateDeltaBlockBackup(volume, snapshot, dest, deltaOps)
+		c.Assert(err, IsNil)
+		urls[util.GetCompression(compression)] = url
+	}
+
+	// Blocks compressed differently are stored separately
+	blocks := 0
+	err = filepath.Walk(filepath.Join(s.root, "dest"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == ".blk" {
+			blocks++
+		}
+		return err
+	})
+	c.Assert(err, IsNil)
+	c.Assert(blocks, Equals, 6)
+
+	for compression, url := range urls {
+		info, err := objectstore.GetBackupInfo(url)
+		c.Assert(err, IsNil)
+		c.Assert(info["Compression"], Equals, compression)
+
+		restored := filepath.Join(s.root, compression+".img")
+		c.Assert(objectstore.RestoreDeltaBlockBackup(url, restored), IsNil)
+		restoredData, err := ioutil.ReadFile(restored)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(restoredData, data), Equals, true)
+	}
+}
+
+func (s *TestSuite) TestChecksumAlgorithm(c *C) {
+	dest := s.createDest(c, "dest")
+	blockSize := objectstore.DEFAULT_BLOCK_SIZE
+	data := append(bytes.Repeat([]byte{1}, blockSize), bytes.Repeat([]byte{2}, blockSize)...)
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": data,
+			"snapshot2": data,
+		},
+	}
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   int64(len(data)),
+	}
+
+	c.Assert(objectstore.SetChecksumAlgorithm("md5"), ErrorMatches, "Invalid checksum algorithm md5.*")
+	url1, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+	c.Assert(objectstore.SetChecksumAlgorithm(util.CHECKSUM_BLAKE3), IsNil)
+	defer objectstore.SetChecksumAlgorithm("")
+	url2, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot2"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+
+	// Blocks checksummed differently are stored separately, and the ones
+	// of SHA-512 keep their names
+	blocks := []string{}
+	err = filepath.Walk(filepath.Join(s.root, "dest"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == ".blk" {
+			blocks = append(blocks, filepath.Base(path))
+		}
+		return err
+	})
+	c.Assert(err, IsNil)
+	c.Assert(blocks, HasLen, 4)
+	blake3Blocks := 0
+	for _, block := range blocks {
+		if strings.HasSuffix(block, ".blake3.blk") {
+			blake3Blocks++
+		}
+	}
+	c.Assert(blake3Blocks, Equals, 2)
+
+	for url, algorithm := range map[string]string{url1: util.CHECKSUM_SHA512, url2: util.CHECKSUM_BLAKE3} {
+		info, err := objectstore.GetBackupInfo(url)
+		c.Assert(err, IsNil)
+		c.Assert(info["ChecksumAlgorithm"], Equals, algorithm)
+
+		restored := filepath.Join(s.root, algorithm+".img")
+		c.Assert(objectstore.RestoreDeltaBlockBackup(url, restored), IsNil)
+		restoredData, err := ioutil.ReadFile(restored)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(restoredData, data), Equals, true)
+	}
+}
+
+func (s *TestSuite) TestParallelDeltaBlockBackup(c *C) {
+	c.Assert(objectstore.SetConcurrency(0), NotNil)
+	c.Assert(objectstore.SetConcurrency(8), IsNil)
+	defer objectstore.SetConcurrency(objectstore.DEFAULT_CONCURRENCY)
+
+	dest := s.createDest(c, "dest")
+	blockSize := objectstore.DEFAULT_BLOCK_SIZE
+	// Distinct blocks mixed with duplicated ones
+	data := []byte{}
+	for i := 0; i < 20; i++ {
+		data = append(data, bytes.Repeat([]byte{byte(i % 7)}, blockSize)...)
+	}
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": data,
+		},
+	}
+
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   int64(len(data)),
+	}
+	url, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+
+	restored := filepath.Join(s.root, "restored.img")
+	c.Assert(objectstore.RestoreDeltaBlockBackup(url, restored), IsNil)
+	restoredData, err := ioutil.ReadFile(restored)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(restoredData, data), Equals, true)
+
+	blocks := 0
+	err = filepath.Walk(filepath.Join(s.root, "dest"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == ".blk" {
+			blocks++
+		}
+		return err
+	})
+	c.Assert(err, IsNil)
+	c.Assert(blocks, Equals, 7)
+}
+
+func (s *TestSuite) countBlocks(c *C, dir string) int {
+	blocks := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Ext(path) == ".blk" {
+			blocks++
+		}
+		return err
+	})
+	c.Assert(err, IsNil)
+	return blocks
+}
+
+func (s *TestSuite) TestSharedBlocks(c *C) {
+	dest := s.createDest(c, "dest")
+	blockSize := objectstore.DEFAULT_BLOCK_SIZE
+	base := bytes.Repeat([]byte{1}, blockSize)
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": append(append([]byte{}, base...), bytes.Repeat([]byte{2}, blockSize)...),
+			"snapshot2": append(append([]byte{}, base...), bytes.Repeat([]byte{3}, blockSize)...),
+			"snapshot3": append(append([]byte{}, base...), bytes.Repeat([]byte{4}, blockSize)...),
+		},
+	}
+	newVolume := func(name string) *objectstore.Volume {
+		return &objectstore.Volume{
+			Name:   name,
+			Driver: "devicemapper",
+			Size:   int64(2 * blockSize),
+		}
+	}
+
+	// Backup created before shared blocks were enabled keeps its blocks
+	url1, err := objectstore.CreateDeltaBlockBackup(newVolume("volume1"), &objectstore.Snapshot{Name: "snapshot1"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+
+	objectstore.SetSharedBlocks(true)
+	defer objectstore.SetSharedBlocks(false)
+	url2, err := objectstore.CreateDeltaBlockBackup(newVolume("volume1"), &objectstore.Snapshot{Name: "snapshot2"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+	url3, err := objectstore.CreateDeltaBlockBackup(newVolume("volume2"), &objectstore.Snapshot{Name: "snapshot3"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+	info, err := objectstore.GetBackupInfo(url3)
+	c.Assert(err, IsNil)
+	c.Assert(info["SharedBlocks"], Equals, "true")
+
+	// The base block is stored once by backups of both volumes
+	sharedDir := filepath.Join(s.root, "dest", objectstore.OBJECTSTORE_BASE, objectstore.BLOCKS_DIRECTORY)
+	c.Assert(s.countBlocks(c, sharedDir), Equals, 3)
+	for url, snapshot := range map[string]string{url1: "snapshot1", url2: "snapshot2", url3: "snapshot3"} {
+		restored := filepath.Join(s.root, snapshot+".img")
+		c.Assert(objectstore.RestoreDeltaBlockBackup(url, restored), IsNil)
+		data, err := ioutil.ReadFile(restored)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(data, deltaOps.snapshots[snapshot]), Equals, true)
+	}
+
+	// Blocks are left for garbage collection once no backup refers to them
+	c.Assert(objectstore.DeleteDeltaBlockBackup(url2), IsNil)
+	c.Assert(s.countBlocks(c, sharedDir), Equals, 3)
+	result, err := objectstore.CollectSharedBlocks(dest, true)
+	c.Assert(err, IsNil)
+	c.Assert(*result, Equals, objectstore.BlockGCResult{Backups: 1, Blocks: 3, UnreferencedBlocks: 1})
+	c.Assert(s.countBlocks(c, sharedDir), Equals, 3)
+
+	// Backups and garbage collection exclude each other
+	markers := filepath.Join(s.root, "dest", objectstore.OBJECTSTORE_BASE, objectstore.MARKERS_DIRECTORY)
+	c.Assert(os.MkdirAll(markers, 0700), IsNil)
+	marker := fmt.Sprintf(`{"Host":"host1","UpdatedTime":%q}`, time.Now().UTC().Format(time.RFC3339))
+	c.Assert(ioutil.WriteFile(filepath.Join(markers, "backup_backup-1.cfg"), []byte(marker), 0600), IsNil)
+	_, err = objectstore.CollectSharedBlocks(dest, false)
+	c.Assert(err, ErrorMatches, "Backups backup-1 are being created in .*")
+	c.Assert(os.Remove(filepath.Join(markers, "backup_backup-1.cfg")), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(markers, "gc.cfg"), []byte(marker), 0600), IsNil)
+	_, err = objectstore.CreateDeltaBlockBackup(newVolume("volume2"), &objectstore.Snapshot{Name: "snapshot2"}, dest, deltaOps)
+	c.Assert(err, ErrorMatches, "Garbage collection is running in .*")
+	// Marker of crashed daemon is ignored
+	stale := fmt.Sprintf(`{"Host":"host1","UpdatedTime":%q}`, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	c.Assert(ioutil.WriteFile(filepath.Join(markers, "gc.cfg"), []byte(stale), 0600), IsNil)
+
+	result, err = objectstore.CollectSharedBlocks(dest, false)
+	c.Assert(err, IsNil)
+	c.Assert(*result, Equals, objectstore.BlockGCResult{Backups: 1, Blocks: 3, UnreferencedBlocks: 1, RemovedBlocks: 1})
+	c.Assert(s.countBlocks(c, sharedDir), Equals, 2)
+	restored := filepath.Join(s.root, "snapshot3.img")
+	c.Assert(objectstore.RestoreDeltaBlockBackup(url3, restored), IsNil)
+	data, err := ioutil.ReadFile(restored)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(data, deltaOps.snapshots["snapshot3"]), Equals, true)
+	_, err = os.Stat(markers)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(objectstore.DeleteDeltaBlockBackup(url3), IsNil)
+	result, err = objectstore.CollectSharedBlocks(dest, false)
+	c.Assert(err, IsNil)
+	c.Assert(result.RemovedBlocks, Equals, 2)
+	_, err = os.Stat(sharedDir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestSuite) TestCollectOrphans(c *C) {
+	dest := s.createDest(c, "dest")
+	base := filepath.Join(s.root, "dest", objectstore.OBJECTSTORE_BASE)
+	blockSize := objectstore.DEFAULT_BLOCK_SIZE
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": bytes.Repeat([]byte{1}, blockSize),
+		},
+	}
+	blockURL, err := objectstore.CreateDeltaBlockBackup(&objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   int64(blockSize),
+	}, &objectstore.Snapshot{Name: "snapshot1"}, dest, deltaOps)
+	c.Assert(err, IsNil)
+	file := filepath.Join(s.root, "file")
+	c.Assert(ioutil.WriteFile(file, []byte("content"), 0600), IsNil)
+	fileURL, err := objectstore.CreateSingleFileBackup(&objectstore.Volume{
+		Name:   "volume2",
+		Driver: "vfs",
+	}, &objectstore.Snapshot{Name: "snapshot1"}, file, dest)
+	c.Assert(err, IsNil)
+	volume1 := filepath.Join(base, "volumes", "vo", "lu", "volume1")
+	volume2 := filepath.Join(base, "volumes", "vo", "lu", "volume2")
+	volume3 := filepath.Join(base, "volumes", "vo", "lu", "volume3")
+
+	// Left by failed backups and crashed daemons
+	old := time.Now().Add(-2 * objectstore.DEFAULT_GC_MIN_AGE)
+	orphans := map[string]time.Time{
+		filepath.Join(volume1, "blocks", "00", "11", "0011.blk"):                  old,
+		filepath.Join(volume1, "blocks", "00", "11", "0022.blk"):                  time.Now(),
+		filepath.Join(volume1, "backups", "backup_backup-1.cfg.tmp-1"):            old,
+		filepath.Join(volume2, "BackupFiles", "backup-2.bak"):                     old,
+		filepath.Join(volume3, "volume.cfg"):                                      old,
+		filepath.Join(base, "blocks", "00", "11", "0033.blk"):                     old,
+		filepath.Join(base, objectstore.MARKERS_DIRECTORY, "backup_backup-3.cfg"): old,
+	}
+	for path, t := range orphans {
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0700), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(`{"UpdatedTime":"2016-01-01T00:00:00Z"}`), 0600), IsNil)
+		c.Assert(os.Chtimes(path, t, t), IsNil)
+	}
+
+	expected := &objectstore.OrphanGCResult{
+		OrphanBlocks: 3,
+		OrphanFiles: []string{
+			"convoy-objectstore/markers/backup_backup-3.cfg",
+			"convoy-objectstore/volumes/vo/lu/volume1/backups/backup_backup-1.cfg.tmp-1",
+			"convoy-objectstore/volumes/vo/lu/volume2/BackupFiles/backup-2.bak",
+		},
+		EmptyVolumes:  []string{"volume3"},
+		RecentOrphans: 1,
+	}
+	result, err := objectstore.CollectOrphans(dest, objectstore.DEFAULT_GC_MIN_AGE, true)
+	c.Assert(err, IsNil)
+	sort.Strings(result.OrphanFiles)
+	c.Assert(result, DeepEquals, expected)
+	for path := range orphans {
+		_, err := os.Stat(path)
+		c.Assert(err, IsNil)
+	}
+
+	result, err = objectstore.CollectOrphans(dest, objectstore.DEFAULT_GC_MIN_AGE, false)
+	c.Assert(err, IsNil)
+	sort.Strings(result.OrphanFiles)
+	expected.Removed = 6
+	c.Assert(result, DeepEquals, expected)
+	for path, t := range orphans {
+		_, err := os.Stat(path)
+		c.Assert(os.IsNotExist(err), Equals, t == old, Commentf("%v", path))
+	}
+
+	c.Assert(objectstore.RestoreDeltaBlockBackup(blockURL, filepath.Join(s.root, "restored.img")), IsNil)
+	restored, err := objectstore.RestoreSingleFileBackup(fileURL, s.root)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(restored)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "content")
+
+	// Recent orphans are removed without minimum age
+	result, err = objectstore.CollectOrphans(dest, 0, false)
+	c.Assert(err, IsNil)
+	c.Assert(result.OrphanBlocks, Equals, 1)
+	c.Assert(result.Removed, Equals, 1)
+}
+
+func (s *TestSuite) TestCopyBackup(c *C) {
+	src := s.createDest(c, "src")
+	dest := s.createDest(c, "dest")
+	blockSize := objectstore.DEFAULT_BLOCK_SIZE
+	base := bytes.Repeat([]byte{1}, blockSize)
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": append(append([]byte{}, base...), bytes.Repeat([]byte{2}, blockSize)...),
+			"snapshot2": append(append([]byte{}, base...), bytes.Repeat([]byte{3}, blockSize)...),
+		},
+	}
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   int64(2 * blockSize),
+	}
+	url1, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, src, deltaOps)
+	c.Assert(err, IsNil)
+	url2, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot2"}, src, deltaOps)
+	c.Assert(err, IsNil)
+
+	_, err = objectstore.CopyBackup(url1, src)
+	c.Assert(err, ErrorMatches, "Backup .* is in .* already")
+
+	// Blocks already copied are skipped
+	copy2, err := objectstore.CopyBackup(url2, dest)
+	c.Assert(err, IsNil)
+	c.Assert(copy2, Equals, strings.Replace(url2, src, dest, 1))
+	destVolumes := filepath.Join(s.root, "dest", objectstore.OBJECTSTORE_BASE, objectstore.VOLUME_DIRECTORY)
+	c.Assert(s.countBlocks(c, destVolumes), Equals, 2)
+	copy1, err := objectstore.CopyBackup(url1, dest)
+	c.Assert(err, IsNil)
+	c.Assert(s.countBlocks(c, destVolumes), Equals, 3)
+	copied, err := objectstore.CopyBackup(url1, dest)
+	c.Assert(err, IsNil)
+	c.Assert(copied, Equals, copy1)
+
+	for url, snapshot := range map[string]string{copy1: "snapshot1", copy2: "snapshot2"} {
+		restored := filepath.Join(s.root, snapshot+".img")
+		c.Assert(objectstore.RestoreDeltaBlockBackup(url, restored), IsNil)
+		data, err := ioutil.ReadFile(restored)
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(data, deltaOps.snapshots[snapshot]), Equals, true)
+	}
+	// The older copy doesn't replace the last backup
+	last, err := objectstore.LoadLastBackup("volume1", dest)
+	c.Assert(err, IsNil)
+	c.Assert(last.SnapshotName, Equals, "snapshot2")
+
+	// Backups the copied one is incremental to are copied along
+	streamVolume := &objectstore.Volume{
+		Name:   "volume2",
+		Driver: "zfs",
+	}
+	stream1, err := objectstore.CreateStreamBackup(streamVolume, &objectstore.Snapshot{Name: "snapshot1"},
+		s.createStream(c, "stream1", "full"), "", src)
+	c.Assert(err, IsNil)
+	backupName, _, err := objectstore.GetLastBackup("volume2", src)
+	c.Assert(err, IsNil)
+	stream2, err := objectstore.CreateStreamBackup(streamVolume, &objectstore.Snapshot{Name: "snapshot2"},
+		s.createStream(c, "stream2", "incremental"), backupName, src)
+	c.Assert(err, IsNil)
+	copied, err = objectstore.CopyBackup(stream2, dest)
+	c.Assert(err, IsNil)
+	info, err := objectstore.GetBackupInfo(copied)
+	c.Assert(err, IsNil)
+	c.Assert(info["ParentBackupURL"], Equals, strings.Replace(stream1, src, dest, 1))
+	received := []string{}
+	c.Assert(objectstore.RestoreStreamBackup(copied, func(stream io.Reader) error {
+		data, err := ioutil.ReadAll(stream)
+		received = append(received, string(data))
+		return err
+	}), IsNil)
+	c.Assert(received, DeepEquals, []string{"full", "incremental"})
+
+	// Volume of the same name must be of the same driver
+	c.Assert(os.RemoveAll(filepath.Join(s.root, "dest", objectstore.OBJECTSTORE_BASE)), IsNil)
+	_, err = objectstore.CreateStreamBackup(&objectstore.Volume{Name: "volume1", Driver: "zfs"}, &objectstore.Snapshot{Name: "snapshot1"},
+		s.createStream(c, "stream1", "full"), "", dest)
+	c.Assert(err, IsNil)
+	_, err = objectstore.CopyBackup(url1, dest)
+	c.Assert(err, ErrorMatches, "Cannot copy backup .* of volume volume1 created by driver devicemapper, the volume in .* is of driver zfs")
+}
+
+func (s *TestSuite) TestApplyDestOptions(c *C) {
+	destURL, err := objectstore.ApplyDestOptions("s3://bucket@us-west-2/backups", nil)
+	c.Assert(err, IsNil)
+	c.Assert(destURL, Equals, "s3://bucket@us-west-2/backups")
+
+	destURL, err = objectstore.ApplyDestOptions("s3://bucket@us-west-2/backups", map[string]string{
+		"s3-sse":        "aws:kms",
+		"s3-kms-key-id": "alias/convoy",
+	})
+	c.Assert(err, IsNil)
+	u, err := url.Parse(destURL)
+	c.Assert(err, IsNil)
+	c.Assert(u.Scheme+"://"+u.User.Username()+"@"+u.Host+u.Path, Equals, "s3://bucket@us-west-2/backups")
+	c.Assert(u.Query().Get("sse"), Equals, "aws:kms")
+	c.Assert(u.Query().Get("kms-key-id"), Equals, "alias/convoy")
+
+	_, err = objectstore.ApplyDestOptions("vfs:///backups", map[string]string{
+		"s3-sse": "AES256",
+	})
+	c.Assert(err, ErrorMatches, "Option s3-sse doesn't apply to destination vfs:///backups")
+}
+
+func (s *TestSuite) TestHTTPConfig(c *C) {
+	defer objectstore.SetHTTPConfig(nil)
+
+	config, err := objectstore.GetHTTPConfig(nil)
+	c.Assert(err, IsNil)
+	c.Assert(config, Equals, objectstore.HTTPConfig{})
+	transport := config.NewTransport()
+	c.Assert(transport.DialContext, NotNil)
+	c.Assert(transport.ResponseHeaderTimeout, Equals, time.Duration(0))
+
+	c.Assert(objectstore.SetHTTPConfig([]string{
+		"proxy=http://proxy:3128",
+		"dial-timeout=10s",
+		"max-idle-conns=16",
+	}), IsNil)
+	config, err = objectstore.GetHTTPConfig(url.Values{
+		"dial-timeout":     []string{"5s"},
+		"response-timeout": []string{"1m"},
+		"sse":              []string{"AES256"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(config, Equals, objectstore.HTTPConfig{
+		Proxy:           "http://proxy:3128",
+		DialTimeout:     5 * time.Second,
+		ResponseTimeout: time.Minute,
+		MaxIdleConns:    16,
+	})
+	transport = config.NewTransport()
+	c.Assert(transport.ResponseHeaderTimeout, Equals, time.Minute)
+	// Transport is shared by destinations of the same config
+	c.Assert(config.Transport(), Equals, config.Transport())
+	c.Assert(config.Transport(), Not(Equals), objectstore.HTTPConfig{}.Transport())
+	c.Assert(config.Transport().ResponseHeaderTimeout, Equals, time.Minute)
+	c.Assert(transport.MaxIdleConnsPerHost, Equals, 16)
+	req, err := http.NewRequest("GET", "https://bucket.s3.amazonaws.com/", nil)
+	c.Assert(err, IsNil)
+	proxy, err := transport.Proxy(req)
+	c.Assert(err, IsNil)
+	c.Assert(proxy.String(), Equals, "http://proxy:3128")
+
+	// Only the HTTP options are kept in destination URL
+	query := objectstore.HTTPQuery(url.Values{
+		"proxy": []string{"http://proxy:3128"},
+		"sse":   []string{"AES256"},
+	})
+	c.Assert(query.Encode(), Equals, "proxy=http%3A%2F%2Fproxy%3A3128")
+
+	_, err = objectstore.GetHTTPConfig(url.Values{"max-idle-conns": []string{"-1"}})
+	c.Assert(err, ErrorMatches, "Invalid HTTP option max-idle-conns -1: must not be negative")
+	_, err = objectstore.GetHTTPConfig(url.Values{"proxy": []string{"proxy:3128"}})
+	c.Assert(err, ErrorMatches, "Invalid HTTP option proxy proxy:3128: must be like http://host:port")
+
+	c.Assert(objectstore.SetHTTPConfig([]string{"timeout=10s"}), ErrorMatches, "Unknown HTTP option timeout, must be one of .*")
+	c.Assert(objectstore.SetHTTPConfig([]string{"dial-timeout"}), ErrorMatches, "Invalid HTTP option dial-timeout, must be in key=value format")
+	c.Assert(objectstore.SetHTTPConfig([]string{"keepalive=-1s"}), ErrorMatches, "Invalid HTTP option keepalive -1s: must not be negative")
+	// Failed ones keep the config
+	config, err = objectstore.GetHTTPConfig(nil)
+	c.Assert(err, IsNil)
+	c.Assert(config.Proxy, Equals, "http://proxy:3128")
+}
+
+// fakeArchiveDriver is a vfs driver with storage classes, whose status is
+// kept in archiveStatuses by file path
+type fakeArchiveDriver struct {
+	objectstore.ObjectStoreDriver
+	destURL string
+}
+
+var archiveStatuses = map[string]string{}
+
+func init() {
+	objectstore.RegisterDriver("archive", func(destURL string) (objectstore.ObjectStoreDriver, error) {
+		driver, err := objectstore.GetObjectStoreDriver(strings.Replace(destURL, "archive://", "vfs://", 1))
+		if err != nil {
+			return nil, err
+		}
+		return &fakeArchiveDriver{driver, destURL}, nil
+	})
+}
+
+func (f *fakeArchiveDriver) Kind() string {
+	return "archive"
+}
+
+func (f *fakeArchiveDriver) GetURL() string {
+	return f.destURL
+}
+
+func (f *fakeArchiveDriver) ValidateStorageClass(storageClass string) (bool, error) {
+	switch storageClass {
+	case "STANDARD":
+		return false, nil
+	case "GLACIER":
+		return true, nil
+	}
+	return false, fmt.Errorf("Invalid storage class %v", storageClass)
+}
+
+func (f *fakeArchiveDriver) SetStorageClass(filePath, storageClass string) error {
+	archived, _ := f.ValidateStorageClass(storageClass)
+	archiveStatuses[filePath] = objectstore.ARCHIVE_STATUS_AVAILABLE
+	if archived {
+		archiveStatuses[filePath] = objectstore.ARCHIVE_STATUS_ARCHIVED
+	}
+	return nil
+}
+
+func (f *fakeArchiveDriver) RestoreArchive(filePath string, days int64, tier string) error {
+	archiveStatuses[filePath] = objectstore.ARCHIVE_STATUS_RESTORING
+	return nil
+}
+
+func (f *fakeArchiveDriver) GetArchiveStatus(filePath string) (string, error) {
+	return archiveStatuses[filePath], nil
+}
+
+func (s *TestSuite) TestArchiveBackup(c *C) {
+	dest := s.createDest(c, "dest")
+	archiveDest := strings.Replace(dest, "vfs://", "archive://", 1)
+
+	srcDir := filepath.Join(s.root, "src")
+	c.Assert(os.Mkdir(srcDir, 0700), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(srcDir, "file1"), []byte("content1"), 0600), IsNil)
+	tarFile := filepath.Join(s.root, "snapshot.tar.gz")
+	c.Assert(util.CompressDir(srcDir, tarFile, util.COMPRESSION_GZIP), IsNil)
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}
+
+	url, err := objectstore.CreateFilesBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, tarFile, dest)
+	c.Assert(err, IsNil)
+	err = objectstore.ArchiveBackup(url, "GLACIER")
+	c.Assert(err, ErrorMatches, "Storage classes are not supported by vfs.*")
+
+	url, err = objectstore.CreateFilesBackup(volume, &objectstore.Snapshot{Name: "snapshot2"}, tarFile, archiveDest)
+	c.Assert(err, IsNil)
+	c.Assert(objectstore.ArchiveBackup(url, "COLD"), ErrorMatches, "Invalid storage class COLD")
+	err = objectstore.RestoreArchivedBackup(url, 1, "")
+	c.Assert(err, ErrorMatches, "Backup .* is not archived")
+
+	c.Assert(objectstore.ArchiveBackup(url, "GLACIER"), IsNil)
+	info, err := objectstore.GetBackupInfo(url)
+	c.Assert(err, IsNil)
+	c.Assert(info["StorageClass"], Equals, "GLACIER")
+	c.Assert(info["ArchiveStatus"], Equals, objectstore.ARCHIVE_STATUS_ARCHIVED)
+	restoreDir := filepath.Join(s.root, "restore")
+	c.Assert(os.Mkdir(restoreDir, 0700), IsNil)
+	err = objectstore.RestoreFilesBackup(url, restoreDir)
+	c.Assert(err, ErrorMatches, "Backup .* is archived in GLACIER.*")
+	c.Assert(objectstore.ArchiveBackup(url, "STANDARD"), NotNil)
+
+	c.Assert(objectstore.RestoreArchivedBackup(url, 0, ""), ErrorMatches, "Invalid days 0.*")
+	c.Assert(objectstore.RestoreArchivedBackup(url, 1, ""), IsNil)
+	info, err = objectstore.GetBackupInfo(url)
+	c.Assert(err, IsNil)
+	c.Assert(info["ArchiveStatus"], Equals, objectstore.ARCHIVE_STATUS_RESTORING)
+	c.Assert(info["ArchiveRestoreExpiry"], Not(Equals), "")
+	err = objectstore.RestoreFilesBackup(url, restoreDir)
+	c.Assert(err, ErrorMatches, "Backup .* is still being restored.*")
+
+	for filePath := range archiveStatuses {
+		archiveStatuses[filePath] = objectstore.ARCHIVE_STATUS_RESTORED
+	}
+	c.Assert(objectstore.RestoreFilesBackup(url, restoreDir), IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(restoreDir, "file1"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "content1")
+
+	// Restored backup can be moved back to the default storage class
+	c.Assert(objectstore.ArchiveBackup(url, "STANDARD"), IsNil)
+	info, err = objectstore.GetBackupInfo(url)
+	c.Assert(err, IsNil)
+	c.Assert(info["ArchiveStatus"], Equals, objectstore.ARCHIVE_STATUS_AVAILABLE)
+
+	deltaOps := &fakeDeltaOps{
+		snapshots: map[string][]byte{
+			"snapshot1": bytes.Repeat([]byte{1}, objectstore.DEFAULT_BLOCK_SIZE),
+		},
+	}
+	deltaURL, err := objectstore.CreateDeltaBlockBackup(&objectstore.Volume{
+		Name:   "volume2",
+		Driver: "devicemapper",
+		Size:   objectstore.DEFAULT_BLOCK_SIZE,
+	}, &objectstore.Snapshot{Name: "snapshot1"}, archiveDest, deltaOps)
+	c.Assert(err, IsNil)
+	err = objectstore.ArchiveBackup(deltaURL, "GLACIER")
+	c.Assert(err, ErrorMatches, "Cannot archive backup .*, blocks of delta block backup are shared with other backups")
+}
+
+// countingDriver counts the reads of configs, and lists versions by the VFS
+// driver it wraps
+type countingDriver struct {
+	objectstore.ObjectStoreDriver
+	destURL string
+}
+
+var configReads int
+
+func init() {
+	objectstore.RegisterDriver("counting", func(destURL string) (objectstore.ObjectStoreDriver, error) {
+		driver, err := objectstore.GetObjectStoreDriver(strings.Replace(destURL, "counting://", "vfs://", 1))
+		if err != nil {
+			return nil, err
+		}
+		return &countingDriver{driver, destURL}, nil
+	})
+}
+
+func (f *countingDriver) GetURL() string {
+	return f.destURL
+}
+
+func (f *countingDriver) Read(src string) (io.ReadCloser, error) {
+	if strings.HasSuffix(src, ".cfg") {
+		configReads++
+	}
+	return f.ObjectStoreDriver.Read(src)
+}
+
+func (f *countingDriver) ListVersions(path string) (map[string]string, error) {
+	return f.ObjectStoreDriver.(objectstore.VersionLister).ListVersions(path)
+}
+
+func (s *TestSuite) TestListCache(c *C) {
+	dest := s.createDest(c, "dest")
+	countingDest := strings.Replace(dest, "vfs://", "counting://", 1)
+	snapshotFile := filepath.Join(s.root, "snapshot.tar.gz")
+	c.Assert(ioutil.WriteFile(snapshotFile, []byte("snapshot"), 0600), IsNil)
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}
+	for _, name := range []string{"snapshot1", "snapshot2"} {
+		_, err := objectstore.CreateSingleFileBackup(volume, &objectstore.Snapshot{Name: name}, snapshotFile, dest)
+		c.Assert(err, IsNil)
+	}
+
+	list := func(opts *objectstore.ListOptions, backups, reads int) map[string]map[string]string {
+		configReads = 0
+		result, err := objectstore.ListWithOptions(countingDest, "vfs", opts)
+		c.Assert(err, IsNil)
+		c.Assert(result, HasLen, backups)
+		c.Assert(configReads, Equals, reads)
+		return result
+	}
+
+	// Volume and backup configs are only read once
+	first := list(&objectstore.ListOptions{}, 2, 3)
+	c.Assert(list(&objectstore.ListOptions{}, 2, 0), DeepEquals, first)
+	list(&objectstore.ListOptions{NoCache: true}, 2, 3)
+
+	// Only the new backup is read, and deleted ones are dropped
+	backupURL, err := objectstore.CreateSingleFileBackup(volume, &objectstore.Snapshot{Name: "snapshot3"}, snapshotFile, dest)
+	c.Assert(err, IsNil)
+	list(&objectstore.ListOptions{}, 3, 1)
+	c.Assert(objectstore.DeleteSingleFileBackup(backupURL), IsNil)
+	c.Assert(list(&objectstore.ListOptions{}, 2, 0), DeepEquals, first)
+
+	// Changed config is read again
+	volumeFile := filepath.Join(strings.TrimPrefix(dest, "vfs://"), "convoy-objectstore/volumes/vo/lu/volume1/volume.cfg")
+	c.Assert(ioutil.WriteFile(volumeFile, []byte(`{"Name":"volume1","Driver":"vfs","Size":1024}`), 0600), IsNil)
+	for _, backup := range list(&objectstore.ListOptions{}, 2, 1) {
+		c.Assert(backup["VolumeSize"], Equals, "1024")
+	}
+}
+
+// blockingDeltaOps blocks reading the snapshot at offset until released
+type blockingDeltaOps struct {
+	fakeDeltaOps
+	offset  int64
+	reached chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingDeltaOps) ReadSnapshot(id, volumeID string, start int64, data []byte) error {
+	if start == f.offset {
+		close(f.reached)
+		<-f.release
+	}
+	return f.fakeDeltaOps.ReadSnapshot(id, volumeID, start, data)
+}
+
+func (s *TestSuite) TestBackupProgress(c *C) {
+	dest := s.createDest(c, "dest")
+	blockSize := objectstore.DEFAULT_BLOCK_SIZE
+	data := []byte{}
+	for i := 0; i < 4; i++ {
+		data = append(data, bytes.Repeat([]byte{byte(i + 1)}, blockSize)...)
+	}
+	deltaOps := &blockingDeltaOps{
+		fakeDeltaOps: fakeDeltaOps{
+			snapshots: map[string][]byte{
+				"snapshot1": data,
+			},
+		},
+		offset:  int64(3 * blockSize),
+		reached: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "devicemapper",
+		Size:   int64(len(data)),
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := objectstore.CreateDeltaBlockBackup(volume, &objectstore.Snapshot{Name: "snapshot1"}, dest, deltaOps)
+		done <- err
+	}()
+	<-deltaOps.reached
+
+	// Blocks read before are backed up meanwhile
+	var progress []objectstore.BackupProgress
+	for i := 0; i < 100; i++ {
+		progress = objectstore.ListBackupProgress()
+		if len(progress) == 1 && progress[0].DoneBlocks == 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(progress, HasLen, 1)
+	c.Assert(progress[0].VolumeName, Equals, "volume1")
+	c.Assert(progress[0].DestURL, Not(Equals), "")
+	c.Assert(progress[0].TotalBlocks, Equals, int64(4))
+	c.Assert(progress[0].DoneBlocks, Equals, int64(3))
+	c.Assert(progress[0].UploadedBytes > 0, Equals, true)
+
+	close(deltaOps.release)
+	c.Assert(<-done, IsNil)
+	c.Assert(objectstore.ListBackupProgress(), HasLen, 0)
+}
@@ -0,0 +1,366 @@
+package objectstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rancher/convoy/metadata"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	DEFAULT_CONCURRENCY = 4
+)
+
+var (
+	// Accessed atomically, since it can be changed while backups are running
+	concurrency int32 = DEFAULT_CONCURRENCY
+	// Holds the checksum algorithm of new backups
+	checksumAlgorithm atomic.Value
+)
+
+// SetConcurrency sets how many blocks would be uploaded or downloaded in
+// parallel by delta block backup and restore. Backups and restores already
+// running are not affected.
+func SetConcurrency(n int) error {
+	if n < 1 {
+		return fmt.Errorf("Invalid concurrency %v, must be at least 1", n)
+	}
+	atomic.StoreInt32(&concurrency, int32(n))
+	return nil
+}
+
+// SetChecksumAlgorithm sets the algorithm blocks of new delta block backups
+// would be checksummed by, see util.CHECKSUM_*. Backups record the algorithm
+// they use, so existing ones are not affected. Empty for the default.
+func SetChecksumAlgorithm(algorithm string) error {
+	if err := util.ValidateChecksumAlgorithm(algorithm); err != nil {
+		return err
+	}
+	checksumAlgorithm.Store(util.GetChecksumAlgorithm(algorithm))
+	return nil
+}
+
+func isSequential(driver ObjectStoreDriver) bool {
+	s, ok := unwrapDriver(driver).(SequentialDriver)
+	return ok && s.Sequential()
+}
+
+// getConcurrency returns how many objects can be transferred to or from
+// driver in parallel
+func getConcurrency(driver ObjectStoreDriver) int {
+	if isSequential(driver) {
+		return 1
+	}
+	return int(atomic.LoadInt32(&concurrency))
+}
+
+func getChecksumAlgorithm() string {
+	if algorithm, ok := checksumAlgorithm.Load().(string); ok {
+		return algorithm
+	}
+	return util.DEFAULT_CHECKSUM
+}
+
+// errorOnce keeps the first error reported by workers, and notifies the
+// others to stop
+type errorOnce struct {
+	mutex sync.Mutex
+	err   error
+	stop  chan struct{}
+}
+
+func newErrorOnce() *errorOnce {
+	return &errorOnce{
+		stop: make(chan struct{}),
+	}
+}
+
+func (e *errorOnce) set(err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.err == nil {
+		e.err = err
+		close(e.stop)
+	}
+}
+
+func (e *errorOnce) get() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.err
+}
+
+type blockJob struct {
+	offset   int64
+	data     []byte
+	checksum string
+}
+
+// blockSet tracks blocks known to be in objectstore or being uploaded, so
+// the same block won't be checked or uploaded twice
+type blockSet struct {
+	mutex  sync.Mutex
+	blocks map[string]bool
+}
+
+// claim returns true if the caller should upload the block
+func (s *blockSet) claim(blkFile string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.blocks[blkFile] {
+		return false
+	}
+	s.blocks[blkFile] = true
+	return true
+}
+
+type blockMappingsByOffset []BlockMapping
+
+func (b blockMappingsByOffset) Len() int {
+	return len(b)
+}
+
+func (b blockMappingsByOffset) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b blockMappingsByOffset) Less(i, j int) bool {
+	return b[i].Offset < b[j].Offset
+}
+
+/*
+backupBlocks uploads changed blocks of snapshot with a pool of workers. The
+snapshot is read sequentially, then blocks are checksummed by a pool of
+hashers, one per CPU, since hashing is bound by CPU while uploading is bound
+by the objectstore. At most as many blocks as hashers plus twice as many
+blocks as workers are held in memory. Blocks are written one at a time in
+the order of snapshot if the objectstore is sequential. Blocks of lastBackup are known to
+exist, so only the other blocks would be checked in blockPath of objectstore.
+*/
+func backupBlocks(bsDriver ObjectStoreDriver, volumeName, blockPath, checksumAlgorithm string, snapshot *Snapshot, key []byte,
+	delta *metadata.Mappings, deltaOps DeltaBlockBackupOperations, lastBackup *Backup, progress *backupProgress) ([]BlockMapping, error) {
+	for _, d := range delta.Mappings {
+		progress.addTotalBlocks(d.Size / delta.BlockSize)
+	}
+	known := &blockSet{
+		blocks: make(map[string]bool),
+	}
+	if lastBackup != nil {
+		for _, blk := range lastBackup.Blocks {
+			known.blocks[getBlockFilePath(blockPath, blk.BlockChecksum, lastBackup.ChecksumAlgorithm, lastBackup.EncryptionKeyID, lastBackup.Compression)] = true
+		}
+	}
+
+	workers := getConcurrency(bsDriver)
+	hashers := runtime.NumCPU()
+	if isSequential(bsDriver) {
+		// Hashers would reorder blocks otherwise
+		hashers = 1
+	}
+	buffers := make(chan []byte, hashers+2*workers)
+	for i := 0; i < hashers+2*workers; i++ {
+		buffers <- make([]byte, DEFAULT_BLOCK_SIZE)
+	}
+	jobs := make(chan blockJob, hashers)
+	hashed := make(chan blockJob, workers)
+	errOnce := newErrorOnce()
+
+	var hashWg sync.WaitGroup
+	for i := 0; i < hashers; i++ {
+		hashWg.Add(1)
+		go func() {
+			defer hashWg.Done()
+			for job := range jobs {
+				// Jobs are passed on regardless, so the buffers are returned
+				if errOnce.get() == nil {
+					job.checksum = util.ComputeChecksum(job.data, checksumAlgorithm)
+				}
+				hashed <- job
+			}
+		}()
+	}
+	go func() {
+		hashWg.Wait()
+		close(hashed)
+	}()
+
+	var (
+		wg          sync.WaitGroup
+		resultMutex sync.Mutex
+		blocks      = []BlockMapping{}
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		GoWithRequestID(func() {
+			defer wg.Done()
+			for job := range hashed {
+				if errOnce.get() != nil {
+					// Drain the remaining jobs
+					buffers <- job.data
+					continue
+				}
+				mapping, err := backupBlock(bsDriver, blockPath, checksumAlgorithm, snapshot.EncryptionKeyID, snapshot.Compression, key, job, known, progress)
+				buffers <- job.data
+				if err != nil {
+					errOnce.set(err)
+					continue
+				}
+				progress.doneBlock()
+				resultMutex.Lock()
+				blocks = append(blocks, mapping)
+				resultMutex.Unlock()
+			}
+		})
+	}
+
+	if err := readBlocks(snapshot.Name, volumeName, delta, deltaOps, buffers, jobs, errOnce.stop); err != nil {
+		errOnce.set(err)
+	}
+	close(jobs)
+	wg.Wait()
+	if err := errOnce.get(); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(blockMappingsByOffset(blocks))
+	return blocks, nil
+}
+
+func readBlocks(snapshotName, volumeName string, delta *metadata.Mappings, deltaOps DeltaBlockBackupOperations,
+	buffers chan []byte, jobs chan<- blockJob, stop <-chan struct{}) error {
+	mCounts := len(delta.Mappings)
+	for m, d := range delta.Mappings {
+		if d.Size%delta.BlockSize != 0 {
+			return fmt.Errorf("Mapping's size %v is not multiples of backup block size %v",
+				d.Size, delta.BlockSize)
+		}
+		blkCounts := d.Size / delta.BlockSize
+		for i := int64(0); i < blkCounts; i++ {
+			var block []byte
+			select {
+			case block = <-buffers:
+			case <-stop:
+				return nil
+			}
+			offset := d.Offset + i*delta.BlockSize
+			log.Debugf("Backup for %v: segment %v/%v, blocks %v/%v", snapshotName, m+1, mCounts, i+1, blkCounts)
+			if err := deltaOps.ReadSnapshot(snapshotName, volumeName, offset, block); err != nil {
+				return err
+			}
+			select {
+			case jobs <- blockJob{offset: offset, data: block}:
+			case <-stop:
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func backupBlock(bsDriver ObjectStoreDriver, blockPath, checksumAlgorithm, encryptionKeyID, compression string, key []byte,
+	job blockJob, known *blockSet, progress *backupProgress) (BlockMapping, error) {
+	blkFile := getBlockFilePath(blockPath, job.checksum, checksumAlgorithm, encryptionKeyID, compression)
+	blockMapping := BlockMapping{
+		Offset:        job.offset,
+		BlockChecksum: job.checksum,
+	}
+	if !known.claim(blkFile) || bsDriver.FileSize(blkFile) >= 0 {
+		log.Debugf("Found existed block match at %v", blkFile)
+		return blockMapping, nil
+	}
+
+	rs, err := util.CompressData(job.data, compression)
+	if err != nil {
+		return blockMapping, err
+	}
+	if key != nil {
+		if rs, err = encryptData(rs, key); err != nil {
+			return blockMapping, err
+		}
+	}
+	if err := bsDriver.Write(blkFile, rs); err != nil {
+		return blockMapping, err
+	}
+	if size, err := rs.Seek(0, io.SeekEnd); err == nil {
+		progress.addUploaded(size)
+	}
+	log.Debugf("Created new block file at %v", blkFile)
+	return blockMapping, nil
+}
+
+// restoreBlocks downloads blocks from blockPath with a pool of workers, and
+// writes them to volDev at their offsets
+func restoreBlocks(bsDriver ObjectStoreDriver, blockPath, checksumAlgorithm, encryptionKeyID, compression string, key []byte,
+	blocks []BlockMapping, volDev *os.File) error {
+	workers := getConcurrency(bsDriver)
+	indexes := make(chan int, workers)
+	errOnce := newErrorOnce()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		GoWithRequestID(func() {
+			defer wg.Done()
+			data := make([]byte, DEFAULT_BLOCK_SIZE)
+			for i := range indexes {
+				if errOnce.get() != nil {
+					continue
+				}
+				block := blocks[i]
+				log.Debugf("Restore for %v: block %v, %v/%v", volDev.Name(), block.BlockChecksum, i+1, len(blocks))
+				if err := restoreBlock(bsDriver, blockPath, checksumAlgorithm, encryptionKeyID, compression, key, block, data, volDev); err != nil {
+					errOnce.set(err)
+				}
+			}
+		})
+	}
+
+feed:
+	for i := range blocks {
+		select {
+		case indexes <- i:
+		case <-errOnce.stop:
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	return errOnce.get()
+}
+
+func restoreBlock(bsDriver ObjectStoreDriver, blockPath, checksumAlgorithm, encryptionKeyID, compression string, key []byte,
+	block BlockMapping, data []byte, volDev *os.File) error {
+	blkFile := getBlockFilePath(blockPath, block.BlockChecksum, checksumAlgorithm, encryptionKeyID, compression)
+	rc, err := bsDriver.Read(blkFile)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var compressed io.Reader = rc
+	if key != nil {
+		compressed, err = decryptData(rc, key)
+		if err != nil {
+			return fmt.Errorf("Block %v: %v", blkFile, err)
+		}
+	}
+	r, err := util.DecompressAndVerifyChecksum(compressed, block.BlockChecksum, checksumAlgorithm, compression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if _, err := volDev.WriteAt(data, block.Offset); err != nil {
+		return err
+	}
+	return nil
+}
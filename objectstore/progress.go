@@ -0,0 +1,125 @@
+package objectstore
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackupProgress is the progress of a backup being created or copied by this
+// process, see ListBackupProgress()
+type BackupProgress struct {
+	Name        string
+	VolumeName  string
+	DestURL     string
+	StartedTime time.Time
+	// Blocks of delta block backup to back up and the ones done, zero for
+	// the other backups
+	TotalBlocks int64
+	DoneBlocks  int64
+	// Bytes uploaded to the destination so far. Blocks found in the
+	// destination are not uploaded again, and backup files are counted
+	// once they're uploaded unless they're streamed.
+	UploadedBytes int64
+}
+
+// backupProgress is updated by the workers of the backup, so the counters
+// are accessed atomically
+type backupProgress struct {
+	BackupProgress
+}
+
+var (
+	progressMutex sync.Mutex
+	activeBackups = map[*backupProgress]bool{}
+)
+
+// trackBackup records the progress of the backup until the returned function
+// is called
+func trackBackup(backupName, volumeName string, driver ObjectStoreDriver) (*backupProgress, func()) {
+	p := &backupProgress{
+		BackupProgress: BackupProgress{
+			Name:        backupName,
+			VolumeName:  volumeName,
+			DestURL:     driver.GetURL(),
+			StartedTime: time.Now(),
+		},
+	}
+	progressMutex.Lock()
+	activeBackups[p] = true
+	progressMutex.Unlock()
+	return p, func() {
+		progressMutex.Lock()
+		delete(activeBackups, p)
+		progressMutex.Unlock()
+	}
+}
+
+func (p *backupProgress) addTotalBlocks(n int64) {
+	atomic.AddInt64(&p.TotalBlocks, n)
+}
+
+func (p *backupProgress) doneBlock() {
+	atomic.AddInt64(&p.DoneBlocks, 1)
+}
+
+func (p *backupProgress) addUploaded(n int64) {
+	atomic.AddInt64(&p.UploadedBytes, n)
+}
+
+func (p *backupProgress) get() BackupProgress {
+	return BackupProgress{
+		Name:          p.Name,
+		VolumeName:    p.VolumeName,
+		DestURL:       p.DestURL,
+		StartedTime:   p.StartedTime,
+		TotalBlocks:   atomic.LoadInt64(&p.TotalBlocks),
+		DoneBlocks:    atomic.LoadInt64(&p.DoneBlocks),
+		UploadedBytes: atomic.LoadInt64(&p.UploadedBytes),
+	}
+}
+
+// progressReader counts the bytes read from the stream being uploaded
+type progressReader struct {
+	io.Reader
+	progress *backupProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.progress.addUploaded(int64(n))
+	return n, err
+}
+
+// ListBackupProgress returns the progress of backups being created or copied
+// by this process, oldest first
+func ListBackupProgress() []BackupProgress {
+	progressMutex.Lock()
+	result := []BackupProgress{}
+	for p := range activeBackups {
+		result = append(result, p.get())
+	}
+	progressMutex.Unlock()
+
+	sort.Sort(backupProgressByTime(result))
+	return result
+}
+
+type backupProgressByTime []BackupProgress
+
+func (b backupProgressByTime) Len() int {
+	return len(b)
+}
+
+func (b backupProgressByTime) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b backupProgressByTime) Less(i, j int) bool {
+	if b[i].StartedTime.Equal(b[j].StartedTime) {
+		return b[i].Name < b[j].Name
+	}
+	return b[i].StartedTime.Before(b[j].StartedTime)
+}
@@ -0,0 +1,77 @@
+package objectstore
+
+// BackupsToPrune returns URLs of the backups in the result of List() which
+// are out of the retain count once the backup of latestURL is kept, oldest
+// first. The latest backup may be missing from the list when the objectstore
+// listing isn't consistent yet, it's counted as retained anyway so that one
+// more old backup won't be removed by mistake.
+//
+// Backups which retained ones are incremental to are kept as well, unless
+// they're merged into the retained ones when deleted, see
+// DeleteFilesBackup(). A pruned backup is returned after the pruned ones
+// incremental to it, so they can be deleted in order.
+func BackupsToPrune(infos map[string]map[string]string, latestURL string, retain int) []string {
+	if retain <= 0 {
+		return nil
+	}
+	others := make(map[string]map[string]string)
+	for url, info := range infos {
+		if url != latestURL {
+			others[url] = info
+		}
+	}
+	backups := MergeBackupLists(others)
+	keep := retain - 1
+	if len(backups) <= keep {
+		return nil
+	}
+
+	needed := map[string]bool{}
+	retained := []string{latestURL}
+	for _, info := range backups[len(backups)-keep:] {
+		retained = append(retained, info["BackupURL"])
+	}
+	for _, url := range retained {
+		seen := map[string]bool{}
+		for parent := infos[url]["ParentBackupURL"]; parent != "" && !needed[parent] && !seen[parent]; parent = infos[parent]["ParentBackupURL"] {
+			seen[parent] = true
+			if !mergeableBackup(infos[parent]) {
+				needed[parent] = true
+			}
+		}
+	}
+	pruned := []string{}
+	children := map[string]int{}
+	for _, info := range backups[:len(backups)-keep] {
+		url := info["BackupURL"]
+		if needed[url] {
+			continue
+		}
+		pruned = append(pruned, url)
+		if parent := info["ParentBackupURL"]; parent != "" {
+			children[parent]++
+		}
+	}
+
+	result := []string{}
+	done := map[string]bool{}
+	for len(result) < len(pruned) {
+		progress := false
+		for _, url := range pruned {
+			if done[url] || children[url] != 0 {
+				continue
+			}
+			result = append(result, url)
+			done[url] = true
+			progress = true
+			if parent := infos[url]["ParentBackupURL"]; parent != "" {
+				children[parent]--
+			}
+		}
+		if !progress {
+			// Broken chain, leave the rest to fail to be deleted
+			break
+		}
+	}
+	return result
+}
@@ -2,6 +2,9 @@ package objectstore
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 
 	"github.com/Sirupsen/logrus"
@@ -12,6 +15,19 @@ import (
 
 const (
 	BACKUP_FILES_DIRECTORY = "BackupFiles"
+
+	// Backup of the files in the volume as a compressed tar stream, rather
+	// than a driver specific image. It can be restored to a volume of any driver
+	// with a filesystem.
+	BACKUP_FORMAT_FILES = "files"
+	// Version 2 added incremental backups, see
+	// CreateIncrementalFilesBackup(). Full backups are still version 1, so
+	// older versions can restore them.
+	BACKUP_FORMAT_FILES_VERSION      = 2
+	BACKUP_FORMAT_FILES_FULL_VERSION = 1
+
+	// Backups of vfs were in files format before the format was recorded
+	LEGACY_FILES_BACKUP_DRIVER = "vfs"
 )
 
 type BackupFile struct {
@@ -24,6 +40,161 @@ func getSingleFileBackupFilePath(sfBackup *Backup) string {
 }
 
 func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destURL string) (string, error) {
+	return createSingleFileBackup(volume, snapshot, filePath, destURL, &Backup{})
+}
+
+// CreateFilesBackup uploads tarFile, which is a tar of the files in the
+// volume compressed with snapshot.Compression, as a backup in files format.
+// The next backup of volume can be incremental to it.
+func CreateFilesBackup(volume *Volume, snapshot *Snapshot, tarFile, destURL string) (string, error) {
+	return createFilesBackup(volume, snapshot, tarFile, destURL, &Backup{})
+}
+
+// createFilesBackup creates backup in files format, which has the parent
+// and the deleted paths of incremental backup if any
+func createFilesBackup(volume *Volume, snapshot *Snapshot, tarFile, destURL string, backup *Backup) (string, error) {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return "", err
+	}
+	backup.Format = BACKUP_FORMAT_FILES
+	backup.FormatVersion = BACKUP_FORMAT_FILES_FULL_VERSION
+	if backup.ParentBackupName != "" {
+		backup.FormatVersion = BACKUP_FORMAT_FILES_VERSION
+	}
+	backupURL, err := createSingleFileBackup(volume, snapshot, tarFile, destURL, backup)
+	if err != nil {
+		return "", err
+	}
+	if err := setLastBackup(volume.Name, backup.Name, driver); err != nil {
+		return "", err
+	}
+	return backupURL, nil
+}
+
+// StreamUploader is implemented by drivers which can upload a stream of
+// unknown size without staging it in a local file. The object must not be
+// created if reading src fails.
+type StreamUploader interface {
+	UploadStream(src io.Reader, dst string) error
+}
+
+// getStreamUploader returns nil if the driver cannot upload streams
+func getStreamUploader(driver ObjectStoreDriver) StreamUploader {
+	if _, ok := unwrapDriver(driver).(StreamUploader); !ok {
+		return nil
+	}
+	return driver.(StreamUploader)
+}
+
+// StreamUploadSupported tells whether backups can be streamed to destURL by
+// CreateFilesBackupFromDir()
+func StreamUploadSupported(destURL string) bool {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return false
+	}
+	return getStreamUploader(driver) != nil
+}
+
+// CreateFilesBackupFromDir creates the same backup as CreateFilesBackup()
+// with the tarball of dir, but the tarball is compressed, encrypted and
+// uploaded as a stream, so no local space is needed for it. The destination
+// must support it, see StreamUploadSupported().
+func CreateFilesBackupFromDir(volume *Volume, snapshot *Snapshot, dir, destURL string) (string, error) {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return "", err
+	}
+	uploader := getStreamUploader(driver)
+	if uploader == nil {
+		return "", fmt.Errorf("Objectstore %v cannot upload streams", destURL)
+	}
+	backup := &Backup{
+		Format:        BACKUP_FORMAT_FILES,
+		FormatVersion: BACKUP_FORMAT_FILES_FULL_VERSION,
+	}
+	backupURL, err := uploadSingleFileBackup(volume, snapshot, dir, destURL, backup, func(progress *backupProgress) error {
+		var (
+			key []byte
+			err error
+		)
+		if backup.EncryptionKeyID != "" {
+			if key, err = getEncryptionKey(backup.EncryptionKeyID); err != nil {
+				return err
+			}
+		}
+		return uploadDirStream(uploader, dir, backup.Compression, key, backup.SingleFile.FilePath, progress)
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := setLastBackup(volume.Name, backup.Name, driver); err != nil {
+		return "", err
+	}
+	return backupURL, nil
+}
+
+// uploadDirStream uploads the tarball of dir to dst, encrypted by key if
+// it's not nil
+func uploadDirStream(uploader StreamUploader, dir, compression string, key []byte, dst string, progress *backupProgress) error {
+	r, w := io.Pipe()
+	tarErr := make(chan error, 1)
+	go func() {
+		err := util.TarDirStream(w, dir, compression)
+		w.CloseWithError(err)
+		tarErr <- err
+	}()
+	var src io.Reader = r
+	if key != nil {
+		er, ew := io.Pipe()
+		go func() {
+			ew.CloseWithError(encryptStream(ew, r, key))
+		}()
+		// Unblock the encryption if uploading failed
+		defer er.Close()
+		src = er
+	}
+	err := uploader.UploadStream(&progressReader{Reader: src, progress: progress}, dst)
+	// Unblock the tar if uploading failed
+	r.Close()
+	if e := <-tarErr; e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// createSingleFileBackup uploads filePath as backup, which has the fields
+// specific to the kind of backup filled by caller, e.g. Format
+func createSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destURL string, backup *Backup) (string, error) {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return "", err
+	}
+	return uploadSingleFileBackup(volume, snapshot, filePath, destURL, backup, func(progress *backupProgress) error {
+		uploadFile := filePath
+		if backup.EncryptionKeyID != "" {
+			encryptedFile, err := encryptFile(filePath, backup.EncryptionKeyID)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(encryptedFile)
+			uploadFile = encryptedFile
+		}
+		if err := driver.Upload(uploadFile, backup.SingleFile.FilePath); err != nil {
+			return err
+		}
+		if st, err := os.Stat(uploadFile); err == nil {
+			progress.addUploaded(st.Size())
+		}
+		return nil
+	})
+}
+
+// uploadSingleFileBackup creates backup of the content of source, which is
+// uploaded to backup.SingleFile.FilePath by upload, encrypted if the backup
+// has an encryption key
+func uploadSingleFileBackup(volume *Volume, snapshot *Snapshot, source, destURL string, backup *Backup, upload func(progress *backupProgress) error) (string, error) {
 	driver, err := GetObjectStoreDriver(destURL)
 	if err != nil {
 		return "", err
@@ -43,18 +214,25 @@ func CreateSingleFileBackup(volume *Volume, snapshot *Snapshot, filePath, destUR
 		LOG_FIELD_EVENT:    LOG_EVENT_BACKUP,
 		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
 		LOG_FIELD_SNAPSHOT: snapshot.Name,
-		LOG_FIELD_FILEPATH: filePath,
+		LOG_FIELD_FILEPATH: source,
 	}).Debug("Creating backup")
 
-	backup := &Backup{
-		Name:              util.GenerateName("backup"),
-		VolumeName:        volume.Name,
-		SnapshotName:      snapshot.Name,
-		SnapshotCreatedAt: snapshot.CreatedTime,
-	}
+	backup.Name = util.GenerateName("backup")
+	backup.VolumeName = volume.Name
+	backup.SnapshotName = snapshot.Name
+	backup.SnapshotCreatedAt = snapshot.CreatedTime
+	backup.EncryptionKeyID = snapshot.EncryptionKeyID
+	backup.Compression = util.GetCompression(snapshot.Compression)
+	backup.ServerSideEncryption = getServerSideEncryption(driver)
 	backup.SingleFile.FilePath = getSingleFileBackupFilePath(backup)
 
-	if err := driver.Upload(filePath, backup.SingleFile.FilePath); err != nil {
+	progress, release, err := startBackup(backup.Name, volume.Name, driver)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if err := upload(progress); err != nil {
 		return "", err
 	}
 
@@ -95,15 +273,231 @@ func RestoreSingleFileBackup(backupURL, path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if err := checkArchiveRestored(backup, driver); err != nil {
+		return "", err
+	}
+	return downloadSingleFileBackup(backup, driver, path)
+}
 
-	dstFile := filepath.Join(path, filepath.Base(backup.SingleFile.FilePath))
-	if err := driver.Download(backup.SingleFile.FilePath, dstFile); err != nil {
+// downloadSingleFileBackup downloads the decrypted file of backup into the
+// directory path, and returns the path of the file. It fails before
+// downloading if there isn't enough space for it.
+func downloadSingleFileBackup(backup *Backup, driver ObjectStoreDriver, path string) (string, error) {
+	if err := checkDownloadSpace(backup, driver, path); err != nil {
 		return "", err
 	}
+	dstFile := filepath.Join(path, filepath.Base(backup.SingleFile.FilePath))
+	if backup.EncryptionKeyID == "" {
+		if err := driver.Download(backup.SingleFile.FilePath, dstFile); err != nil {
+			return "", err
+		}
+		return dstFile, nil
+	}
 
+	key, err := getEncryptionKey(backup.EncryptionKeyID)
+	if err != nil {
+		return "", err
+	}
+	encryptedFile := dstFile + ".encrypted"
+	if err := driver.Download(backup.SingleFile.FilePath, encryptedFile); err != nil {
+		return "", err
+	}
+	defer os.Remove(encryptedFile)
+	if err := decryptFile(encryptedFile, dstFile, key); err != nil {
+		os.Remove(dstFile)
+		return "", err
+	}
 	return dstFile, nil
 }
 
+// checkDownloadSpace fails if the directory path doesn't have space for the
+// file of backup, which takes twice the space while it's decrypted
+func checkDownloadSpace(backup *Backup, driver ObjectStoreDriver, path string) error {
+	size := driver.FileSize(backup.SingleFile.FilePath)
+	if size < 0 {
+		// Unknown to the driver, the download would tell
+		return nil
+	}
+	if backup.EncryptionKeyID != "" {
+		size *= 2
+	}
+	return util.CheckFreeSpace(path, size, "backup "+backup.Name)
+}
+
+func backupFormat(backup *Backup, volume *Volume) string {
+	if backup.Format == "" && backup.SingleFile.FilePath != "" && volume.Driver == LEGACY_FILES_BACKUP_DRIVER {
+		return BACKUP_FORMAT_FILES
+	}
+	return backup.Format
+}
+
+// GetBackupFormat returns the portable format of the backup, or empty string
+// if it can only be restored by the driver created it
+func GetBackupFormat(backupURL string) (string, error) {
+	backup, err := loadFormattedBackup(backupURL)
+	if err != nil {
+		return "", err
+	}
+	return backup.Format, nil
+}
+
+// loadFormattedBackup returns the backup with Format filled for legacy
+// backups, and fails if the format version is not supported
+func loadFormattedBackup(backupURL string) (*Backup, error) {
+	driver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	backup, err := loadBackup(backupName, volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	backup.Format = backupFormat(backup, volume)
+	if backup.Format == BACKUP_FORMAT_FILES && backup.FormatVersion > BACKUP_FORMAT_FILES_VERSION {
+		return nil, fmt.Errorf("Backup %v is in %v format version %v, only version %v or older is supported",
+			backupName, backup.Format, backup.FormatVersion, BACKUP_FORMAT_FILES_VERSION)
+	}
+	return backup, nil
+}
+
+// RestoreFilesBackup extracts files of backup in files format into dir,
+// existing files in dir would be overwritten. For incremental backup, the
+// backups it's incremental to are extracted first.
+func RestoreFilesBackup(backupURL, dir string) error {
+	backup, err := loadFormattedBackup(backupURL)
+	if err != nil {
+		return err
+	}
+	if backup.Format != BACKUP_FORMAT_FILES {
+		return fmt.Errorf("Backup %v is not in %v format", backupURL, BACKUP_FORMAT_FILES)
+	}
+	driver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	chain, err := loadFilesBackupChain(backup, driver)
+	if err != nil {
+		return err
+	}
+	for _, b := range chain {
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_REASON:     LOG_REASON_START,
+			LOG_FIELD_EVENT:      LOG_EVENT_RESTORE,
+			LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+			LOG_FIELD_SNAPSHOT:   b.SnapshotName,
+			LOG_FIELD_BACKUP_URL: backupURL,
+		}).Debugf("Extracting files of backup %v", b.Name)
+		if err := applyFilesBackup(b, driver, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtractFilesBackup extracts only paths, relative to the root of volume,
+// from backup in files format into the existing dir. The backup is streamed
+// from the objectstore rather than downloaded first, unless it's incremental.
+func ExtractFilesBackup(backupURL string, paths []string, dir string) error {
+	backup, err := loadFormattedBackup(backupURL)
+	if err != nil {
+		return err
+	}
+	if backup.Format != BACKUP_FORMAT_FILES {
+		return fmt.Errorf("Backup %v is not in %v format", backupURL, BACKUP_FORMAT_FILES)
+	}
+	if backup.ParentBackupName != "" {
+		return extractIncrementalFilesBackup(backupURL, paths, dir)
+	}
+	driver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	if err := checkArchiveRestored(backup, driver); err != nil {
+		return err
+	}
+
+	var key []byte
+	if backup.EncryptionKeyID != "" {
+		if key, err = getEncryptionKey(backup.EncryptionKeyID); err != nil {
+			return err
+		}
+	}
+	rc, err := driver.Read(backup.SingleFile.FilePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var src io.Reader = rc
+	if key != nil {
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(decryptStream(w, rc, key))
+		}()
+		// Unblock the decryption if extracting failed
+		defer r.Close()
+		src = r
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_BACKUP_URL: backupURL,
+		LOG_FIELD_FILEPATH:   dir,
+	}).Debugf("Extracting %v from backup", paths)
+	return util.ExtractPathsStream(src, dir, backup.Compression, paths)
+}
+
+// encryptFile writes encrypted content of filePath to a temporary file next
+// to it, caller should remove the file when done
+func encryptFile(filePath, keyID string) (string, error) {
+	key, err := getEncryptionKey(keyID)
+	if err != nil {
+		return "", err
+	}
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".encrypted")
+	if err != nil {
+		return "", err
+	}
+	if err := encryptStream(dst, src, key); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+func decryptFile(srcFile, dstFile string, key []byte) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dstFile)
+	if err != nil {
+		return err
+	}
+	if err := decryptStream(dst, src, key); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
 func DeleteSingleFileBackup(backupURL string) error {
 	driver, err := GetObjectStoreDriver(backupURL)
 	if err != nil {
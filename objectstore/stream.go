@@ -0,0 +1,211 @@
+package objectstore
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+/*
+Stream backups are the send streams of drivers with native replication, e.g.
+"zfs send", uploaded as single files. A backup is either the full stream of
+its snapshot, or the incremental stream from the snapshot of its parent
+backup. So it's restored by receiving the streams of its ancestors first, and
+cannot be deleted while other backups are incremental to it.
+*/
+
+// GetLastBackup returns the name of the last stream backup of volume in
+// destURL and the name of its snapshot, which the next backup can be
+// incremental to. Both are empty if there is none.
+func GetLastBackup(volumeName, destURL string) (string, string, error) {
+	backup, err := LoadLastBackup(volumeName, destURL)
+	if err != nil || backup == nil {
+		return "", "", err
+	}
+	return backup.Name, backup.SnapshotName, nil
+}
+
+// LoadLastBackup returns the last backup of volume in destURL which the
+// next backup can be incremental to, nil if there is none
+func LoadLastBackup(volumeName, destURL string) (*Backup, error) {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return nil, err
+	}
+	if !volumeExists(volumeName, driver) {
+		return nil, nil
+	}
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return nil, err
+	}
+	if volume.LastBackupName == "" {
+		return nil, nil
+	}
+	return loadBackup(volume.LastBackupName, volumeName, driver)
+}
+
+// setLastBackup records the backup as the one the next backup of volume can
+// be incremental to
+func setLastBackup(volumeName, backupName string, driver ObjectStoreDriver) error {
+	unlock, err := lockVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	volume, err := loadVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+	volume.LastBackupName = backupName
+	return saveVolume(volume, driver)
+}
+
+// CreateStreamBackup uploads streamFile, the send stream of snapshot
+// compressed with snapshot.Compression, as a backup incremental to the backup
+// parentBackupName, or as a full backup if it's empty
+func CreateStreamBackup(volume *Volume, snapshot *Snapshot, streamFile, parentBackupName, destURL string) (string, error) {
+	driver, err := GetObjectStoreDriver(destURL)
+	if err != nil {
+		return "", err
+	}
+	if parentBackupName != "" && !backupExists(parentBackupName, volume.Name, driver) {
+		return "", fmt.Errorf("Cannot find backup %v of volume %v to be incremental to", parentBackupName, volume.Name)
+	}
+	backup := &Backup{
+		ParentBackupName: parentBackupName,
+	}
+	backupURL, err := createSingleFileBackup(volume, snapshot, streamFile, destURL, backup)
+	if err != nil {
+		return "", err
+	}
+	if err := setLastBackup(volume.Name, backup.Name, driver); err != nil {
+		return "", err
+	}
+	return backupURL, nil
+}
+
+// RestoreStreamBackup calls receive with the decompressed stream of every
+// backup from the full one to the one of backupURL, in order. Streams are
+// read from the objectstore as they're received, rather than downloaded first.
+func RestoreStreamBackup(backupURL string, receive func(stream io.Reader) error) error {
+	driver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	chain := []*Backup{}
+	seen := map[string]bool{}
+	for name := backupName; name != ""; {
+		if seen[name] {
+			return fmt.Errorf("BUG: Backup %v of volume %v is incremental to itself", name, volumeName)
+		}
+		seen[name] = true
+		backup, err := loadBackup(name, volumeName, driver)
+		if err != nil {
+			return fmt.Errorf("Cannot load backup %v, which backup %v is incremental to: %v", name, backupName, err)
+		}
+		if err := checkArchiveRestored(backup, driver); err != nil {
+			return err
+		}
+		chain = append([]*Backup{backup}, chain...)
+		name = backup.ParentBackupName
+	}
+	for _, backup := range chain {
+		log.WithFields(logrus.Fields{
+			LOG_FIELD_REASON:     LOG_REASON_START,
+			LOG_FIELD_EVENT:      LOG_EVENT_RESTORE,
+			LOG_FIELD_OBJECT:     LOG_OBJECT_SNAPSHOT,
+			LOG_FIELD_SNAPSHOT:   backup.SnapshotName,
+			LOG_FIELD_BACKUP_URL: backupURL,
+		}).Debugf("Receiving stream of backup %v", backup.Name)
+		if err := receiveStreamBackup(backup, driver, receive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func receiveStreamBackup(backup *Backup, driver ObjectStoreDriver, receive func(stream io.Reader) error) error {
+	var (
+		key []byte
+		err error
+	)
+	if backup.EncryptionKeyID != "" {
+		if key, err = getEncryptionKey(backup.EncryptionKeyID); err != nil {
+			return err
+		}
+	}
+	rc, err := driver.Read(backup.SingleFile.FilePath)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var src io.Reader = rc
+	if key != nil {
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(decryptStream(w, rc, key))
+		}()
+		// Unblock the decryption if receiving failed
+		defer r.Close()
+		src = r
+	}
+	r, w := io.Pipe()
+	decompressErr := make(chan error, 1)
+	go func() {
+		err := util.DecompressStream(w, src, backup.Compression)
+		w.CloseWithError(err)
+		decompressErr <- err
+	}()
+	receiveErr := receive(r)
+	// Unblock the decompression if the stream wasn't read to the end
+	r.Close()
+	if err := <-decompressErr; err != nil && receiveErr == nil {
+		return fmt.Errorf("Failed to read stream of backup %v: %v", backup.Name, err)
+	}
+	return receiveErr
+}
+
+// DeleteStreamBackup deletes the backup of backupURL, unless other backups
+// are incremental to it
+func DeleteStreamBackup(backupURL string) error {
+	driver, err := GetObjectStoreDriver(backupURL)
+	if err != nil {
+		return err
+	}
+	backupName, volumeName, err := decodeBackupURL(backupURL)
+	if err != nil {
+		return err
+	}
+	backupNames, err := getBackupNamesForVolume(volumeName, driver)
+	if err != nil {
+		return err
+	}
+	for _, name := range backupNames {
+		if name == backupName {
+			continue
+		}
+		backup, err := loadBackup(name, volumeName, driver)
+		if err != nil {
+			return err
+		}
+		if backup.ParentBackupName == backupName {
+			return fmt.Errorf("Cannot delete backup %v, backup %v is incremental to it", backupName, name)
+		}
+	}
+	if err := DeleteSingleFileBackup(backupURL); err != nil {
+		return err
+	}
+	// The next backup would be a full one if the last one was deleted
+	_, err = updateVolumeForRemovedBackup(backupName, volumeName, driver)
+	return err
+}
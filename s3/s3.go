@@ -7,8 +7,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/rancher/convoy/objectstore"
 )
 
@@ -59,6 +61,19 @@ func initFunc(destURL string) (objectstore.ObjectStoreDriver, error) {
 	//Leading '/' can cause mystery problems for s3
 	b.path = strings.TrimLeft(b.path, "/")
 
+	if err := b.service.loadMultipartConfig(); err != nil {
+		return nil, err
+	}
+	if err := b.service.loadSSEConfig(u.Query()); err != nil {
+		return nil, err
+	}
+	if err := b.service.loadEndpointConfig(u.Query()); err != nil {
+		return nil, err
+	}
+	if err := b.service.loadCredentialsConfig(u.Query()); err != nil {
+		return nil, err
+	}
+
 	//Test connection
 	if _, err := b.List(""); err != nil {
 		return nil, err
@@ -69,6 +84,9 @@ func initFunc(destURL string) (objectstore.ObjectStoreDriver, error) {
 		b.destURL += "@" + b.service.Region
 	}
 	b.destURL += "/" + b.path
+	if query := endpointQuery(u.Query()); len(query) != 0 {
+		b.destURL += "?" + query.Encode()
+	}
 
 	log.Debug("Loaded driver for %v", b.destURL)
 	return b, nil
@@ -82,6 +100,10 @@ func (s *S3ObjectStoreDriver) GetURL() string {
 	return s.destURL
 }
 
+func (s *S3ObjectStoreDriver) ServerSideEncryption() string {
+	return s.service.SSE
+}
+
 func (s *S3ObjectStoreDriver) updatePath(path string) string {
 	return filepath.Join(s.path, path)
 }
@@ -119,6 +141,39 @@ func (s *S3ObjectStoreDriver) List(listPath string) ([]string, error) {
 	return result, nil
 }
 
+// ListVersions versions objects by their ETag
+func (s *S3ObjectStoreDriver) ListVersions(listPath string) (map[string]string, error) {
+	path := s.updatePath(listPath) + "/"
+	contents, _, err := s.service.ListObjects(path, "/")
+	if err != nil {
+		log.Error("Fail to list s3: ", err)
+		return nil, err
+	}
+	result := map[string]string{}
+	for _, obj := range contents {
+		if r := strings.TrimPrefix(*obj.Key, path); r != "" {
+			result[r] = aws.StringValue(obj.ETag)
+		}
+	}
+	return result, nil
+}
+
+func (s *S3ObjectStoreDriver) ListModTimes(listPath string) (map[string]time.Time, error) {
+	path := s.updatePath(listPath) + "/"
+	contents, _, err := s.service.ListObjects(path, "/")
+	if err != nil {
+		log.Error("Fail to list s3: ", err)
+		return nil, err
+	}
+	result := map[string]time.Time{}
+	for _, obj := range contents {
+		if r := strings.TrimPrefix(*obj.Key, path); r != "" {
+			result[r] = aws.TimeValue(obj.LastModified)
+		}
+	}
+	return result, nil
+}
+
 func (s *S3ObjectStoreDriver) FileExists(filePath string) bool {
 	return s.FileSize(filePath) >= 0
 }
@@ -163,13 +218,24 @@ func (s *S3ObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
 func (s *S3ObjectStoreDriver) Upload(src, dst string) error {
 	file, err := os.Open(src)
 	if err != nil {
-		return nil
+		return err
 	}
 	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
 	path := s.updatePath(dst)
+	if st.Size() > s.service.PartSize {
+		return s.service.MultipartUpload(path, file, st.Size())
+	}
 	return s.service.PutObject(path, file)
 }
 
+func (s *S3ObjectStoreDriver) UploadStream(src io.Reader, dst string) error {
+	return s.service.MultipartUploadStream(s.updatePath(dst), src)
+}
+
 func (s *S3ObjectStoreDriver) Download(src, dst string) error {
 	if _, err := os.Stat(dst); err != nil {
 		os.Remove(dst)
@@ -0,0 +1,217 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rancher/convoy/objectstore"
+)
+
+const (
+	// Objects larger than this must be copied in parts
+	MAX_COPY_OBJECT_SIZE = 5 * 1024 * 1024 * 1024
+
+	RESTORE_IN_PROGRESS = `ongoing-request="true"`
+)
+
+// storageClasses are the supported storage classes, and whether objects in
+// them must be restored before being read
+var storageClasses = map[string]bool{
+	"STANDARD":            false,
+	"STANDARD_IA":         false,
+	"ONEZONE_IA":          false,
+	"INTELLIGENT_TIERING": false,
+	"GLACIER_IR":          false,
+	"GLACIER":             true,
+	"DEEP_ARCHIVE":        true,
+}
+
+var restoreTiers = []string{
+	s3.TierStandard,
+	s3.TierBulk,
+	s3.TierExpedited,
+}
+
+func (s *S3ObjectStoreDriver) ValidateStorageClass(storageClass string) (bool, error) {
+	archived, exists := storageClasses[storageClass]
+	if !exists {
+		classes := []string{}
+		for class := range storageClasses {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		return false, fmt.Errorf("Invalid storage class %v, must be one of %v", storageClass, strings.Join(classes, ", "))
+	}
+	return archived, nil
+}
+
+func (s *S3ObjectStoreDriver) SetStorageClass(filePath, storageClass string) error {
+	return s.service.CopyObjectInPlace(s.updatePath(filePath), storageClass)
+}
+
+func (s *S3ObjectStoreDriver) RestoreArchive(filePath string, days int64, tier string) error {
+	if tier == "" {
+		tier = s3.TierStandard
+	}
+	valid := false
+	for _, t := range restoreTiers {
+		valid = valid || t == tier
+	}
+	if !valid {
+		return fmt.Errorf("Invalid restore tier %v, must be one of %v", tier, strings.Join(restoreTiers, ", "))
+	}
+	return s.service.RestoreObject(s.updatePath(filePath), days, tier)
+}
+
+// GetArchiveStatus reads the x-amz-restore header, which is only set once
+// the restore has been requested
+func (s *S3ObjectStoreDriver) GetArchiveStatus(filePath string) (string, error) {
+	head, err := s.service.HeadObject(s.updatePath(filePath))
+	if err != nil {
+		return "", err
+	}
+	if !storageClasses[aws.StringValue(head.StorageClass)] {
+		return objectstore.ARCHIVE_STATUS_AVAILABLE, nil
+	}
+	restore := aws.StringValue(head.Restore)
+	if restore == "" {
+		return objectstore.ARCHIVE_STATUS_ARCHIVED, nil
+	}
+	if strings.Contains(restore, RESTORE_IN_PROGRESS) {
+		return objectstore.ARCHIVE_STATUS_RESTORING, nil
+	}
+	return objectstore.ARCHIVE_STATUS_RESTORED, nil
+}
+
+func copySource(bucket, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+}
+
+/*
+CopyObjectInPlace rewrites object key in storageClass, keeping its metadata
+and server side encryption. Objects larger than MAX_COPY_OBJECT_SIZE are
+copied in parts of PartSize.
+*/
+func (s *S3Service) CopyObjectInPlace(key, storageClass string) error {
+	head, err := s.HeadObject(key)
+	if err != nil {
+		return err
+	}
+	size := aws.Int64Value(head.ContentLength)
+
+	svc, err := s.New()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if size <= MAX_COPY_OBJECT_SIZE {
+		params := &s3.CopyObjectInput{
+			Bucket:            aws.String(s.Bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(copySource(s.Bucket, key)),
+			MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+			StorageClass:      aws.String(storageClass),
+		}
+		if s.SSE != "" {
+			params.ServerSideEncryption = aws.String(s.SSE)
+		}
+		if s.SSEKMSKeyID != "" {
+			params.SSEKMSKeyId = aws.String(s.SSEKMSKeyID)
+		}
+		resp, err := svc.CopyObject(params)
+		if err != nil {
+			return parseAwsError(resp.String(), err)
+		}
+		return nil
+	}
+
+	params := &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(s.Bucket),
+		Key:          aws.String(key),
+		StorageClass: aws.String(storageClass),
+		Metadata:     head.Metadata,
+		ContentType:  head.ContentType,
+	}
+	if s.SSE != "" {
+		params.ServerSideEncryption = aws.String(s.SSE)
+	}
+	if s.SSEKMSKeyID != "" {
+		params.SSEKMSKeyId = aws.String(s.SSEKMSKeyID)
+	}
+	createResp, err := svc.CreateMultipartUpload(params)
+	if err != nil {
+		return parseAwsError(createResp.String(), err)
+	}
+	uploadID := createResp.UploadId
+
+	parts := splitParts(size, s.PartSize)
+	log.Debugf("Started multipart copy %v of %v, %v parts", *uploadID, key, len(parts))
+	completed := []*s3.CompletedPart{}
+	for _, part := range parts {
+		resp, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.Bucket),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(part.Number),
+			CopySource:      aws.String(copySource(s.Bucket, key)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", part.Offset, part.Offset+part.Size-1)),
+		})
+		if err != nil {
+			s.abortMultipartUpload(svc, key, uploadID)
+			return parseAwsError(resp.String(), err)
+		}
+		completed = append(completed, &s3.CompletedPart{
+			ETag:       resp.CopyPartResult.ETag,
+			PartNumber: aws.Int64(part.Number),
+		})
+	}
+	completeResp, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completed,
+		},
+	})
+	if err != nil {
+		s.abortMultipartUpload(svc, key, uploadID)
+		return parseAwsError(completeResp.String(), err)
+	}
+	log.Debugf("Completed multipart copy %v of %v", *uploadID, key)
+	return nil
+}
+
+// RestoreObject initiates the retrieval of archived object key. It succeeds
+// if the retrieval is already in progress.
+func (s *S3Service) RestoreObject(key string, days int64, tier string) error {
+	svc, err := s.New()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	resp, err := svc.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(days),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(tier),
+			},
+		},
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "RestoreAlreadyInProgress" {
+			log.Debugf("Restore of %v is already in progress", key)
+			return nil
+		}
+		return parseAwsError(resp.String(), err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package s3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+// ConfigTestSuite covers the options of destination URL and daemon, which
+// don't need S3 to be reached, unlike TestSuite of tag s3test
+type ConfigTestSuite struct {
+	workDir string
+}
+
+var _ = Suite(&ConfigTestSuite{})
+
+var configEnvs = []string{
+	ENV_ENDPOINT,
+	ENV_FORCE_PATH_STYLE,
+	ENV_CA_BUNDLE,
+	ENV_CREDENTIALS,
+	ENV_ROLE_ARN,
+	ENV_EXTERNAL_ID,
+	ENV_ECS_CREDENTIALS_URI,
+	"AWS_REGION",
+}
+
+func (s *ConfigTestSuite) SetUpTest(c *C) {
+	s.workDir = c.MkDir()
+	for _, env := range configEnvs {
+		os.Unsetenv(env)
+	}
+}
+
+func (s *ConfigTestSuite) TearDownTest(c *C) {
+	for _, env := range configEnvs {
+		os.Unsetenv(env)
+	}
+}
+
+func parseQuery(c *C, query string) url.Values {
+	v, err := url.ParseQuery(query)
+	c.Assert(err, IsNil)
+	return v
+}
+
+// writeCABundle writes a self-signed CA certificate to a PEM file
+func (s *ConfigTestSuite) writeCABundle(c *C) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "convoy test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	file := filepath.Join(s.workDir, "ca.pem")
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	c.Assert(err, IsNil)
+	return file
+}
+
+func (s *ConfigTestSuite) TestEndpointConfig(c *C) {
+	service := &S3Service{}
+	err := service.loadEndpointConfig(url.Values{})
+	c.Assert(err, IsNil)
+	c.Assert(service.Endpoint, Equals, "")
+	c.Assert(service.Region, Equals, "")
+	c.Assert(service.ForcePathStyle, Equals, false)
+	c.Assert(service.httpClient, NotNil)
+
+	// Region is required for signing by custom endpoint
+	service = &S3Service{}
+	err = service.loadEndpointConfig(parseQuery(c, "endpoint=https://minio:9000&force-path-style=true"))
+	c.Assert(err, IsNil)
+	c.Assert(service.Endpoint, Equals, "https://minio:9000")
+	c.Assert(service.Region, Equals, DEFAULT_ENDPOINT_REGION)
+	c.Assert(service.ForcePathStyle, Equals, true)
+
+	service = &S3Service{Region: "us-west-2"}
+	err = service.loadEndpointConfig(parseQuery(c, "endpoint=http://minio&region=eu-west-1"))
+	c.Assert(err, IsNil)
+	c.Assert(service.Region, Equals, "eu-west-1")
+
+	for _, endpoint := range []string{"minio:9000", "ftp://minio", "https://", "http://%zz"} {
+		service = &S3Service{}
+		err = service.loadEndpointConfig(url.Values{QUERY_ENDPOINT: {endpoint}})
+		c.Assert(err, ErrorMatches, "Invalid endpoint.*", Commentf("endpoint %v", endpoint))
+	}
+	service = &S3Service{}
+	err = service.loadEndpointConfig(parseQuery(c, "force-path-style=yes"))
+	c.Assert(err, ErrorMatches, "Invalid force-path-style yes, must be true or false")
+	service = &S3Service{}
+	err = service.loadEndpointConfig(parseQuery(c, "ca-bundle="+filepath.Join(s.workDir, "missing.pem")))
+	c.Assert(err, ErrorMatches, "Invalid ca-bundle .*")
+	service = &S3Service{}
+	err = service.loadEndpointConfig(parseQuery(c, "response-timeout=soon"))
+	c.Assert(err, NotNil)
+}
+
+func (s *ConfigTestSuite) TestEndpointConfigPrecedence(c *C) {
+	os.Setenv(ENV_ENDPOINT, "https://env-endpoint")
+	os.Setenv(ENV_FORCE_PATH_STYLE, "true")
+
+	service := &S3Service{}
+	err := service.loadEndpointConfig(url.Values{})
+	c.Assert(err, IsNil)
+	c.Assert(service.Endpoint, Equals, "https://env-endpoint")
+	c.Assert(service.ForcePathStyle, Equals, true)
+
+	// Query of destination overrides environment of daemon, even if empty
+	service = &S3Service{}
+	err = service.loadEndpointConfig(parseQuery(c, "endpoint=https://query-endpoint&force-path-style=false"))
+	c.Assert(err, IsNil)
+	c.Assert(service.Endpoint, Equals, "https://query-endpoint")
+	c.Assert(service.ForcePathStyle, Equals, false)
+	service = &S3Service{}
+	err = service.loadEndpointConfig(parseQuery(c, "endpoint="))
+	c.Assert(err, IsNil)
+	c.Assert(service.Endpoint, Equals, "")
+	c.Assert(service.Region, Equals, "")
+
+	// Region of SDK environment is used with custom endpoint
+	os.Setenv("AWS_REGION", "ap-south-1")
+	service = &S3Service{}
+	err = service.loadEndpointConfig(url.Values{})
+	c.Assert(err, IsNil)
+	c.Assert(service.Region, Equals, "")
+}
+
+func (s *ConfigTestSuite) TestEndpointCABundle(c *C) {
+	caBundle := s.writeCABundle(c)
+
+	service1 := &S3Service{}
+	err := service1.loadEndpointConfig(parseQuery(c, "endpoint=https://minio&ca-bundle="+caBundle))
+	c.Assert(err, IsNil)
+	c.Assert(service1.CABundle, Equals, caBundle)
+	service2 := &S3Service{}
+	os.Setenv(ENV_CA_BUNDLE, caBundle)
+	err = service2.loadEndpointConfig(parseQuery(c, "endpoint=https://minio"))
+	c.Assert(err, IsNil)
+	c.Assert(service2.CABundle, Equals, caBundle)
+
+	// Transport is shared by destinations with the same CA bundle, but not
+	// the ones without it
+	c.Assert(service1.httpClient.Transport, Equals, service2.httpClient.Transport)
+	service3 := &S3Service{}
+	err = service3.loadEndpointConfig(parseQuery(c, "endpoint=https://minio&ca-bundle="))
+	c.Assert(err, IsNil)
+	c.Assert(service3.CABundle, Equals, "")
+	c.Assert(service3.httpClient.Transport, Not(Equals), service1.httpClient.Transport)
+}
+
+func (s *ConfigTestSuite) loadCredentialsConfig(c *C, query string) (*S3Service, error) {
+	service := &S3Service{}
+	v := parseQuery(c, query)
+	c.Assert(service.loadEndpointConfig(v), IsNil)
+	return service, service.loadCredentialsConfig(v)
+}
+
+func (s *ConfigTestSuite) TestCredentialsConfig(c *C) {
+	service, err := s.loadCredentialsConfig(c, "")
+	c.Assert(err, IsNil)
+	c.Assert(service.CredentialsSource, Equals, CREDENTIALS_DEFAULT)
+	c.Assert(service.RoleARN, Equals, "")
+	c.Assert(service.credentials, IsNil)
+
+	for _, source := range []string{CREDENTIALS_ENV, CREDENTIALS_SHARED, CREDENTIALS_INSTANCE_PROFILE} {
+		service, err = s.loadCredentialsConfig(c, "credentials="+source)
+		c.Assert(err, IsNil)
+		c.Assert(service.CredentialsSource, Equals, source)
+		c.Assert(service.credentials, NotNil)
+	}
+
+	_, err = s.loadCredentialsConfig(c, "credentials=vault")
+	c.Assert(err, ErrorMatches, "Invalid credentials vault, must be one of default, env, shared, instance-profile, ecs")
+	_, err = s.loadCredentialsConfig(c, "credentials=ecs")
+	c.Assert(err, ErrorMatches, "Cannot use ECS task role, .* is not set by ECS agent")
+	os.Setenv(ENV_ECS_CREDENTIALS_URI, "/v2/credentials/test")
+	service, err = s.loadCredentialsConfig(c, "credentials=ecs")
+	c.Assert(err, IsNil)
+	c.Assert(service.credentials, NotNil)
+
+	_, err = s.loadCredentialsConfig(c, "role-arn=my-role")
+	c.Assert(err, ErrorMatches, "Invalid role-arn my-role, must be like .*")
+	_, err = s.loadCredentialsConfig(c, "external-id=abc")
+	c.Assert(err, ErrorMatches, "external-id can only be specified with role-arn")
+	_, err = s.loadCredentialsConfig(c, "role-session-name=backup")
+	c.Assert(err, ErrorMatches, "role-session-name can only be specified with role-arn")
+
+	service, err = s.loadCredentialsConfig(c, "role-arn=arn:aws:iam::123456789012:role/backup&external-id=abc")
+	c.Assert(err, IsNil)
+	c.Assert(service.ExternalID, Equals, "abc")
+	c.Assert(service.RoleSessionName, Equals, DEFAULT_ROLE_SESSION_NAME)
+	c.Assert(service.credentials, NotNil)
+
+	// Assumed role is cached by the source and role
+	another, err := s.loadCredentialsConfig(c, "role-arn=arn:aws:iam::123456789012:role/backup&external-id=abc")
+	c.Assert(err, IsNil)
+	c.Assert(another.credentials, Equals, service.credentials)
+	another, err = s.loadCredentialsConfig(c, "role-arn=arn:aws:iam::123456789012:role/backup&role-session-name=nightly")
+	c.Assert(err, IsNil)
+	c.Assert(another.RoleSessionName, Equals, "nightly")
+	c.Assert(another.credentials, Not(Equals), service.credentials)
+}
+
+func (s *ConfigTestSuite) TestCredentialsConfigPrecedence(c *C) {
+	os.Setenv(ENV_CREDENTIALS, CREDENTIALS_ENV)
+	os.Setenv(ENV_ROLE_ARN, "arn:aws:iam::123456789012:role/daemon")
+	os.Setenv(ENV_EXTERNAL_ID, "daemon-id")
+
+	service, err := s.loadCredentialsConfig(c, "")
+	c.Assert(err, IsNil)
+	c.Assert(service.CredentialsSource, Equals, CREDENTIALS_ENV)
+	c.Assert(service.RoleARN, Equals, "arn:aws:iam::123456789012:role/daemon")
+	c.Assert(service.ExternalID, Equals, "daemon-id")
+
+	// Query of destination overrides environment of daemon
+	service, err = s.loadCredentialsConfig(c, "credentials=shared&role-arn=arn:aws:iam::123456789012:role/dest")
+	c.Assert(err, IsNil)
+	c.Assert(service.CredentialsSource, Equals, CREDENTIALS_SHARED)
+	c.Assert(service.RoleARN, Equals, "arn:aws:iam::123456789012:role/dest")
+	c.Assert(service.ExternalID, Equals, "daemon-id")
+
+	// Empty role of destination disables the role of daemon along with its
+	// external ID
+	service, err = s.loadCredentialsConfig(c, "role-arn=")
+	c.Assert(err, IsNil)
+	c.Assert(service.RoleARN, Equals, "")
+	c.Assert(service.ExternalID, Equals, "")
+	c.Assert(service.credentials, NotNil)
+}
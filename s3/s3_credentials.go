@@ -0,0 +1,228 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/rancher/convoy/objectstore"
+)
+
+const (
+	// Defaults of daemon, can be overridden by destination URL
+	ENV_CREDENTIALS = "CONVOY_S3_CREDENTIALS"
+	ENV_ROLE_ARN    = "CONVOY_S3_ROLE_ARN"
+	ENV_EXTERNAL_ID = "CONVOY_S3_EXTERNAL_ID"
+
+	// Query parameters of destination URL, e.g. from --opt s3-role-arn=...
+	QUERY_CREDENTIALS       = "credentials"
+	QUERY_ROLE_ARN          = "role-arn"
+	QUERY_EXTERNAL_ID       = "external-id"
+	QUERY_ROLE_SESSION_NAME = "role-session-name"
+
+	// Sources of credentials. The default one is the chain of AWS SDK,
+	// which tries environment variables, shared credentials file, then ECS
+	// task role or EC2 instance profile.
+	CREDENTIALS_DEFAULT          = "default"
+	CREDENTIALS_ENV              = "env"
+	CREDENTIALS_SHARED           = "shared"
+	CREDENTIALS_INSTANCE_PROFILE = "instance-profile"
+	CREDENTIALS_ECS              = "ecs"
+
+	// Set by ECS agent in containers of tasks with a role
+	ENV_ECS_CREDENTIALS_URI = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+	ECS_CREDENTIALS_HOST    = "http://169.254.170.2"
+
+	DEFAULT_ROLE_SESSION_NAME = "convoy"
+	ROLE_DURATION             = time.Hour
+	// Temporary credentials are refreshed as early before they expire, so
+	// the requests of a long backup aren't signed by expired ones
+	CREDENTIALS_EXPIRY_WINDOW = 5 * time.Minute
+)
+
+var credentialsSources = []string{
+	CREDENTIALS_DEFAULT,
+	CREDENTIALS_ENV,
+	CREDENTIALS_SHARED,
+	CREDENTIALS_INSTANCE_PROFILE,
+	CREDENTIALS_ECS,
+}
+
+// credentialsKey identifies the temporary credentials shared by destinations
+type credentialsKey struct {
+	source      string
+	roleARN     string
+	externalID  string
+	sessionName string
+	region      string
+	http        objectstore.HTTPConfig
+}
+
+var (
+	credentialsCacheLock sync.Mutex
+	credentialsCache     = map[credentialsKey]*credentials.Credentials{}
+)
+
+/*
+loadCredentialsConfig reads where to get the credentials from, from query of
+destination URL or environment variables of daemon. credentials is one of
+credentialsSources, and role-arn is a role assumed by the credentials of the
+source through STS, with the optional external-id and role-session-name.
+Temporary credentials, i.e. of instance profile, ECS task role or assumed
+role, are cached by the source and role, and refreshed automatically before
+they expire. It must be called after loadEndpointConfig(), since STS is
+reached by the HTTP options of destination as well.
+*/
+func (s *S3Service) loadCredentialsConfig(query url.Values) error {
+	s.CredentialsSource = getConfigValue(query, QUERY_CREDENTIALS, ENV_CREDENTIALS)
+	if s.CredentialsSource == "" {
+		s.CredentialsSource = CREDENTIALS_DEFAULT
+	}
+	if !isCredentialsSource(s.CredentialsSource) {
+		return fmt.Errorf("Invalid %v %v, must be one of %v", QUERY_CREDENTIALS,
+			s.CredentialsSource, strings.Join(credentialsSources, ", "))
+	}
+
+	s.RoleARN = getConfigValue(query, QUERY_ROLE_ARN, ENV_ROLE_ARN)
+	s.ExternalID = getConfigValue(query, QUERY_EXTERNAL_ID, ENV_EXTERNAL_ID)
+	s.RoleSessionName = query.Get(QUERY_ROLE_SESSION_NAME)
+	if s.RoleARN == "" {
+		if _, exists := query[QUERY_EXTERNAL_ID]; exists {
+			return fmt.Errorf("%v can only be specified with %v", QUERY_EXTERNAL_ID, QUERY_ROLE_ARN)
+		}
+		if s.RoleSessionName != "" {
+			return fmt.Errorf("%v can only be specified with %v", QUERY_ROLE_SESSION_NAME, QUERY_ROLE_ARN)
+		}
+		// External ID of daemon default is only for its role
+		s.ExternalID = ""
+	} else {
+		if !strings.HasPrefix(s.RoleARN, "arn:") {
+			return fmt.Errorf("Invalid %v %v, must be like arn:aws:iam::<account>:role/<name>", QUERY_ROLE_ARN, s.RoleARN)
+		}
+		if s.RoleSessionName == "" {
+			s.RoleSessionName = DEFAULT_ROLE_SESSION_NAME
+		}
+	}
+
+	creds, err := s.getCredentials()
+	if err != nil {
+		return err
+	}
+	s.credentials = creds
+	return nil
+}
+
+func isCredentialsSource(source string) bool {
+	for _, s := range credentialsSources {
+		if source == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getCredentials returns the credentials of source and role of service, nil
+// for the default chain of AWS SDK
+func (s *S3Service) getCredentials() (*credentials.Credentials, error) {
+	if s.RoleARN == "" {
+		switch s.CredentialsSource {
+		case CREDENTIALS_DEFAULT:
+			return nil, nil
+		case CREDENTIALS_ENV:
+			return credentials.NewEnvCredentials(), nil
+		case CREDENTIALS_SHARED:
+			// Read again every time, in case keys in the file are rotated
+			return credentials.NewSharedCredentials("", ""), nil
+		}
+	}
+
+	key := credentialsKey{
+		source:      s.CredentialsSource,
+		roleARN:     s.RoleARN,
+		externalID:  s.ExternalID,
+		sessionName: s.RoleSessionName,
+		region:      s.Region,
+		http:        s.httpConfig,
+	}
+	credentialsCacheLock.Lock()
+	defer credentialsCacheLock.Unlock()
+	if creds, exists := credentialsCache[key]; exists {
+		return creds, nil
+	}
+
+	var creds *credentials.Credentials
+	if s.CredentialsSource != CREDENTIALS_DEFAULT {
+		provider, err := newCredentialsProvider(s.CredentialsSource)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewCredentials(provider)
+	}
+	if s.RoleARN != "" {
+		creds = s.newAssumeRoleCredentials(creds)
+	}
+	credentialsCache[key] = creds
+	log.Debugf("Use %v credentials for S3, role %v", s.CredentialsSource, s.RoleARN)
+	return creds, nil
+}
+
+// newCredentialsProvider returns the provider of source other than the
+// default chain. Metadata endpoints of EC2 and ECS are link-local, so
+// they're reached without the HTTP options of destination, e.g. its proxy.
+func newCredentialsProvider(source string) (credentials.Provider, error) {
+	sess := session.New()
+	switch source {
+	case CREDENTIALS_ENV:
+		return &credentials.EnvProvider{}, nil
+	case CREDENTIALS_SHARED:
+		return &credentials.SharedCredentialsProvider{}, nil
+	case CREDENTIALS_INSTANCE_PROFILE:
+		return &ec2rolecreds.EC2RoleProvider{
+			Client:       ec2metadata.New(sess),
+			ExpiryWindow: CREDENTIALS_EXPIRY_WINDOW,
+		}, nil
+	case CREDENTIALS_ECS:
+		uri := os.Getenv(ENV_ECS_CREDENTIALS_URI)
+		if uri == "" {
+			return nil, fmt.Errorf("Cannot use ECS task role, %v is not set by ECS agent", ENV_ECS_CREDENTIALS_URI)
+		}
+		return endpointcreds.NewProviderClient(*sess.Config, sess.Handlers, ECS_CREDENTIALS_HOST+uri,
+			func(p *endpointcreds.Provider) {
+				p.ExpiryWindow = CREDENTIALS_EXPIRY_WINDOW
+			}), nil
+	}
+	return nil, fmt.Errorf("BUG: Unknown credentials source %v", source)
+}
+
+// newAssumeRoleCredentials returns the credentials of role of service,
+// assumed by source credentials, or the default chain if it's nil
+func (s *S3Service) newAssumeRoleCredentials(source *credentials.Credentials) *credentials.Credentials {
+	config := &aws.Config{
+		Credentials: source,
+		HTTPClient:  &http.Client{Transport: s.httpConfig.Transport()},
+	}
+	if s.Region != "" {
+		config.Region = aws.String(s.Region)
+	}
+	svc := sts.New(session.New(), config)
+	return stscreds.NewCredentialsWithClient(svc, s.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = s.RoleSessionName
+		p.Duration = ROLE_DURATION
+		p.ExpiryWindow = CREDENTIALS_EXPIRY_WINDOW
+		if s.ExternalID != "" {
+			p.ExternalID = aws.String(s.ExternalID)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	// Defaults of daemon, can be overridden by destination URL
+	ENV_ENDPOINT         = "CONVOY_S3_ENDPOINT"
+	ENV_FORCE_PATH_STYLE = "CONVOY_S3_FORCE_PATH_STYLE"
+	ENV_CA_BUNDLE        = "CONVOY_S3_CA_BUNDLE"
+
+	// Query parameters of destination URL, e.g. from --opt s3-endpoint=...
+	QUERY_ENDPOINT         = "endpoint"
+	QUERY_FORCE_PATH_STYLE = "force-path-style"
+	QUERY_REGION           = "region"
+	QUERY_CA_BUNDLE        = "ca-bundle"
+
+	// Region used with custom endpoint if none is specified, most S3
+	// compatible services don't care about it but it's required for signing
+	DEFAULT_ENDPOINT_REGION = "us-east-1"
+)
+
+// endpointQueries are the parameters needed to reach the objects again,
+// including the credentials to use, so they're kept in the URL of
+// destination and backups
+var endpointQueries = []string{
+	QUERY_ENDPOINT,
+	QUERY_FORCE_PATH_STYLE,
+	QUERY_CA_BUNDLE,
+	QUERY_CREDENTIALS,
+	QUERY_ROLE_ARN,
+	QUERY_EXTERNAL_ID,
+	QUERY_ROLE_SESSION_NAME,
+}
+
+func getConfigValue(query url.Values, key, env string) string {
+	if value, exists := query[key]; exists {
+		return value[0]
+	}
+	return os.Getenv(env)
+}
+
+/*
+loadEndpointConfig reads the options to use a S3 compatible service, e.g.
+MinIO or Ceph RGW, instead of AWS, from query of destination URL or
+environment variables of daemon. endpoint is the URL of service,
+force-path-style puts bucket in the path instead of host name of requests,
+and ca-bundle is a PEM file of CA certificates to verify the service, which
+would be used instead of system CAs. The HTTP client is tuned by the HTTP
+options of daemon and destination URL, see objectstore.HTTPConfig.
+*/
+func (s *S3Service) loadEndpointConfig(query url.Values) error {
+	if region := query.Get(QUERY_REGION); region != "" {
+		s.Region = region
+	}
+
+	s.Endpoint = getConfigValue(query, QUERY_ENDPOINT, ENV_ENDPOINT)
+	if s.Endpoint != "" {
+		u, err := url.Parse(s.Endpoint)
+		if err != nil {
+			return fmt.Errorf("Invalid endpoint %v: %v", s.Endpoint, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid endpoint %v, must be http://host[:port] or https://host[:port]", s.Endpoint)
+		}
+		if s.Region == "" && os.Getenv("AWS_REGION") == "" {
+			s.Region = DEFAULT_ENDPOINT_REGION
+		}
+	}
+
+	s.ForcePathStyle = false
+	if value := getConfigValue(query, QUERY_FORCE_PATH_STYLE, ENV_FORCE_PATH_STYLE); value != "" {
+		forcePathStyle, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid %v %v, must be true or false", QUERY_FORCE_PATH_STYLE, value)
+		}
+		s.ForcePathStyle = forcePathStyle
+	}
+
+	s.CABundle = getConfigValue(query, QUERY_CA_BUNDLE, ENV_CA_BUNDLE)
+	httpConfig, err := objectstore.GetHTTPConfig(query)
+	if err != nil {
+		return err
+	}
+	s.httpConfig = httpConfig
+	transport, err := s.getTransport()
+	if err != nil {
+		return err
+	}
+	s.httpClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// transportKey identifies the HTTP transport shared by destinations
+type transportKey struct {
+	http     objectstore.HTTPConfig
+	caBundle string
+}
+
+var (
+	transportsLock sync.Mutex
+	transports     = map[transportKey]*http.Transport{}
+)
+
+// getTransport returns the transport of the HTTP config and CA bundle of
+// service, which is shared by destinations like the one of objectstore, so
+// connections are reused by the services created per request
+func (s *S3Service) getTransport() (*http.Transport, error) {
+	if s.CABundle == "" {
+		return s.httpConfig.Transport(), nil
+	}
+	key := transportKey{
+		http:     s.httpConfig,
+		caBundle: s.CABundle,
+	}
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	if transport, exists := transports[key]; exists {
+		return transport, nil
+	}
+	tlsConfig, err := util.NewClientTLSConfig(s.CABundle, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %v %v: %v", QUERY_CA_BUNDLE, s.CABundle, err)
+	}
+	transport := s.httpConfig.NewTransport()
+	transport.TLSClientConfig = tlsConfig
+	transports[key] = transport
+	return transport, nil
+}
+
+// endpointQuery returns the endpoint parameters and HTTP options specified
+// by destination URL
+func endpointQuery(query url.Values) url.Values {
+	v := objectstore.HTTPQuery(query)
+	for _, key := range endpointQueries {
+		if value, exists := query[key]; exists {
+			v.Set(key, value[0])
+		}
+	}
+	return v
+}
@@ -0,0 +1,352 @@
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	ENV_PART_SIZE          = "CONVOY_S3_PART_SIZE"
+	ENV_UPLOAD_CONCURRENCY = "CONVOY_S3_UPLOAD_CONCURRENCY"
+
+	DEFAULT_PART_SIZE          = 64 * 1024 * 1024
+	DEFAULT_UPLOAD_CONCURRENCY = 4
+
+	// Limits of S3 multipart upload
+	MIN_PART_SIZE = 5 * 1024 * 1024
+	MAX_PARTS     = 10000
+
+	PART_UPLOAD_RETRIES = 3
+	PART_RETRY_INTERVAL = 2 * time.Second
+)
+
+type filePart struct {
+	Number int64
+	Offset int64
+	Size   int64
+}
+
+// loadMultipartConfig reads part size and parallelism of multipart upload
+// from environment variables, same as AWS credentials and region
+func (s *S3Service) loadMultipartConfig() error {
+	s.PartSize = DEFAULT_PART_SIZE
+	s.Concurrency = DEFAULT_UPLOAD_CONCURRENCY
+
+	if value := os.Getenv(ENV_PART_SIZE); value != "" {
+		size, err := util.ParseSize(value)
+		if err != nil {
+			return fmt.Errorf("Invalid %v %v: %v", ENV_PART_SIZE, value, err)
+		}
+		if size < MIN_PART_SIZE {
+			return fmt.Errorf("Invalid %v %v, must be at least %v bytes", ENV_PART_SIZE, value, MIN_PART_SIZE)
+		}
+		s.PartSize = size
+	}
+	if value := os.Getenv(ENV_UPLOAD_CONCURRENCY); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			return fmt.Errorf("Invalid %v %v, must be a positive integer", ENV_UPLOAD_CONCURRENCY, value)
+		}
+		s.Concurrency = concurrency
+	}
+	return nil
+}
+
+// splitParts divides a file into parts of partSize. The part size would be
+// enlarged if the file cannot fit in MAX_PARTS parts.
+func splitParts(size, partSize int64) []filePart {
+	if partSize < MIN_PART_SIZE {
+		partSize = MIN_PART_SIZE
+	}
+	if (size+partSize-1)/partSize > MAX_PARTS {
+		partSize = (size + MAX_PARTS - 1) / MAX_PARTS
+	}
+	parts := []filePart{}
+	for offset, number := int64(0), int64(1); offset < size; offset, number = offset+partSize, number+1 {
+		part := filePart{
+			Number: number,
+			Offset: offset,
+			Size:   partSize,
+		}
+		if offset+partSize > size {
+			part.Size = size - offset
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+/*
+MultipartUpload uploads size bytes from reader as object key, in parts of
+PartSize with at most Concurrency parts in flight. A failed part would be
+retried alone for PART_UPLOAD_RETRIES times, rather than restarting the whole
+upload. The upload would be aborted if any part fails eventually, so no
+orphan parts would be left in the bucket.
+*/
+func (s *S3Service) MultipartUpload(key string, reader io.ReaderAt, size int64) error {
+	svc, err := s.New()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	concurrency := s.Concurrency
+	if concurrency < 1 {
+		concurrency = DEFAULT_UPLOAD_CONCURRENCY
+	}
+	parts := splitParts(size, s.PartSize)
+
+	params := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+	if s.SSE != "" {
+		params.ServerSideEncryption = aws.String(s.SSE)
+	}
+	if s.SSEKMSKeyID != "" {
+		params.SSEKMSKeyId = aws.String(s.SSEKMSKeyID)
+	}
+	createResp, err := svc.CreateMultipartUpload(params)
+	if err != nil {
+		return parseAwsError(createResp.String(), err)
+	}
+	uploadID := createResp.UploadId
+	log.Debugf("Started multipart upload %v of %v, %v parts", *uploadID, key, len(parts))
+
+	completed := make([]*s3.CompletedPart, len(parts))
+	errs := make([]error, len(parts))
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		GoWithRequestID(func() {
+			defer wg.Done()
+			for idx := range indexes {
+				completed[idx], errs[idx] = s.uploadPartWithRetry(svc, key, uploadID, reader, parts[idx])
+			}
+		})
+	}
+	for idx := range parts {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			s.abortMultipartUpload(svc, key, uploadID)
+			return err
+		}
+	}
+
+	completeResp, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completed,
+		},
+	})
+	if err != nil {
+		s.abortMultipartUpload(svc, key, uploadID)
+		return parseAwsError(completeResp.String(), err)
+	}
+	log.Debugf("Completed multipart upload %v of %v", *uploadID, key)
+	return nil
+}
+
+func (s *S3Service) uploadPartWithRetry(svc *s3.S3, key string, uploadID *string, reader io.ReaderAt, part filePart) (*s3.CompletedPart, error) {
+	var err error
+	for i := 0; i < PART_UPLOAD_RETRIES; i++ {
+		if i != 0 {
+			log.Warnf("Retry part %v of %v after failure: %v", part.Number, key, err)
+			time.Sleep(PART_RETRY_INTERVAL)
+		}
+		var resp *s3.UploadPartOutput
+		resp, err = svc.UploadPart(&s3.UploadPartInput{
+			Bucket:        aws.String(s.Bucket),
+			Key:           aws.String(key),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int64(part.Number),
+			ContentLength: aws.Int64(part.Size),
+			Body:          io.NewSectionReader(reader, part.Offset, part.Size),
+		})
+		if err == nil {
+			return &s3.CompletedPart{
+				ETag:       resp.ETag,
+				PartNumber: aws.Int64(part.Number),
+			}, nil
+		}
+		err = parseAwsError(resp.String(), err)
+	}
+	return nil, fmt.Errorf("Failed to upload part %v of %v after %v attempts: %v",
+		part.Number, key, PART_UPLOAD_RETRIES, err)
+}
+
+func (s *S3Service) abortMultipartUpload(svc *s3.S3, key string, uploadID *string) {
+	resp, err := svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Warnf("Failed to abort multipart upload %v of %v: %v",
+			*uploadID, key, parseAwsError(resp.String(), err))
+	}
+}
+
+/*
+MultipartUploadStream uploads everything read from reader as object key,
+without knowing the size in advance. Parts of PartSize are read into memory
+and uploaded with at most Concurrency parts in flight, so it takes up to
+(Concurrency + 1) * PartSize of memory. A stream which fits in a part is put
+as a single object instead. The upload would be aborted if reading fails, so
+a partial stream never becomes the object.
+*/
+func (s *S3Service) MultipartUploadStream(key string, reader io.Reader) error {
+	partSize := s.PartSize
+	if partSize < MIN_PART_SIZE {
+		partSize = MIN_PART_SIZE
+	}
+	first, err := readPart(reader, partSize)
+	if err != nil {
+		return err
+	}
+	if int64(len(first)) < partSize {
+		return s.PutObject(key, bytes.NewReader(first))
+	}
+
+	svc, err := s.New()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	concurrency := s.Concurrency
+	if concurrency < 1 {
+		concurrency = DEFAULT_UPLOAD_CONCURRENCY
+	}
+	params := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	}
+	if s.SSE != "" {
+		params.ServerSideEncryption = aws.String(s.SSE)
+	}
+	if s.SSEKMSKeyID != "" {
+		params.SSEKMSKeyId = aws.String(s.SSEKMSKeyID)
+	}
+	createResp, err := svc.CreateMultipartUpload(params)
+	if err != nil {
+		return parseAwsError(createResp.String(), err)
+	}
+	uploadID := createResp.UploadId
+	log.Debugf("Started multipart upload %v of stream to %v", *uploadID, key)
+
+	type streamPart struct {
+		filePart
+		data []byte
+	}
+	var (
+		mutex     sync.Mutex
+		completed []*s3.CompletedPart
+		uploadErr error
+	)
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return uploadErr != nil
+	}
+	parts := make(chan streamPart)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		GoWithRequestID(func() {
+			defer wg.Done()
+			for part := range parts {
+				if failed() {
+					continue
+				}
+				c, err := s.uploadPartWithRetry(svc, key, uploadID, bytes.NewReader(part.data), part.filePart)
+				mutex.Lock()
+				if err == nil {
+					completed = append(completed, c)
+				} else if uploadErr == nil {
+					uploadErr = err
+				}
+				mutex.Unlock()
+			}
+		})
+	}
+
+	var readErr error
+	data := first
+	for number := int64(1); len(data) != 0 && !failed(); number++ {
+		if number > MAX_PARTS {
+			readErr = fmt.Errorf("Stream to %v exceeds %v parts of %v bytes, %v must be larger", key, MAX_PARTS, partSize, ENV_PART_SIZE)
+			break
+		}
+		parts <- streamPart{
+			filePart: filePart{
+				Number: number,
+				Size:   int64(len(data)),
+			},
+			data: data,
+		}
+		if int64(len(data)) < partSize {
+			break
+		}
+		if data, readErr = readPart(reader, partSize); readErr != nil {
+			break
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if readErr == nil {
+		readErr = uploadErr
+	}
+	if readErr != nil {
+		s.abortMultipartUpload(svc, key, uploadID)
+		return readErr
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+	completeResp, err := svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(s.Bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completed,
+		},
+	})
+	if err != nil {
+		s.abortMultipartUpload(svc, key, uploadID)
+		return parseAwsError(completeResp.String(), err)
+	}
+	log.Debugf("Completed multipart upload %v of stream to %v, %v parts", *uploadID, key, len(completed))
+	return nil
+}
+
+// readPart reads up to size bytes from reader, less only at the end of it
+func readPart(reader io.Reader, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	n, err := io.ReadFull(reader, data)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return data[:n], nil
+}
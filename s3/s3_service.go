@@ -3,20 +3,61 @@ package s3
 import (
 	"fmt"
 	"io"
+	"net/http"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rancher/convoy/objectstore"
 )
 
 type S3Service struct {
 	Region string
 	Bucket string
+
+	// Files larger than PartSize would be uploaded in parts, with at
+	// most Concurrency parts being uploaded at the same time
+	PartSize    int64
+	Concurrency int
+
+	// Server side encryption of uploaded objects, empty, AES256 or aws:kms
+	SSE string
+	// KMS key used by aws:kms, the default key of the account if empty
+	SSEKMSKeyID string
+
+	// S3 compatible service used instead of AWS if Endpoint is not empty
+	Endpoint       string
+	ForcePathStyle bool
+	CABundle       string
+	httpClient     *http.Client
+	httpConfig     objectstore.HTTPConfig
+
+	// Source of credentials, and role assumed by them if RoleARN is not
+	// empty
+	CredentialsSource string
+	RoleARN           string
+	ExternalID        string
+	RoleSessionName   string
+	credentials       *credentials.Credentials
 }
 
 func (s *S3Service) New() (*s3.S3, error) {
-	return s3.New(session.New(), &aws.Config{Region: &s.Region}), nil
+	config := &aws.Config{
+		Region:           &s.Region,
+		S3ForcePathStyle: aws.Bool(s.ForcePathStyle),
+	}
+	if s.Endpoint != "" {
+		config.Endpoint = aws.String(s.Endpoint)
+	}
+	if s.httpClient != nil {
+		config.HTTPClient = s.httpClient
+	}
+	if s.credentials != nil {
+		config.Credentials = s.credentials
+	}
+	return s3.New(session.New(), config), nil
 }
 
 func (s *S3Service) Close() {
@@ -83,6 +124,12 @@ func (s *S3Service) PutObject(key string, reader io.ReadSeeker) error {
 		Key:    aws.String(key),
 		Body:   reader,
 	}
+	if s.SSE != "" {
+		params.ServerSideEncryption = aws.String(s.SSE)
+	}
+	if s.SSEKMSKeyID != "" {
+		params.SSEKMSKeyId = aws.String(s.SSEKMSKeyID)
+	}
 
 	resp, err := svc.PutObject(params)
 	if err != nil {
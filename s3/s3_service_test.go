@@ -4,17 +4,16 @@ package s3
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
-	"testing"
+	"testing/iotest"
 
 	"github.com/Sirupsen/logrus"
 
 	. "gopkg.in/check.v1"
 )
 
-func Test(t *testing.T) { TestingT(t) }
-
 type TestSuite struct {
 	service S3Service
 }
@@ -106,3 +105,77 @@ func (s *TestSuite) TestList(c *C) {
 	c.Assert(objs, HasLen, 0)
 	c.Assert(prefixes, HasLen, 0)
 }
+
+func (s *TestSuite) TestSplitParts(c *C) {
+	parts := splitParts(0, MIN_PART_SIZE)
+	c.Assert(parts, HasLen, 0)
+
+	parts = splitParts(2*MIN_PART_SIZE+1, MIN_PART_SIZE)
+	c.Assert(parts, HasLen, 3)
+	c.Assert(parts[0], Equals, filePart{Number: 1, Offset: 0, Size: MIN_PART_SIZE})
+	c.Assert(parts[2], Equals, filePart{Number: 3, Offset: 2 * MIN_PART_SIZE, Size: 1})
+
+	// Part size would be raised to the minimum allowed by S3
+	parts = splitParts(MIN_PART_SIZE, 1024)
+	c.Assert(parts, HasLen, 1)
+
+	// Part size would be enlarged to fit in the maximum number of parts
+	size := int64(MAX_PARTS+1) * MIN_PART_SIZE
+	parts = splitParts(size, MIN_PART_SIZE)
+	c.Assert(len(parts) <= MAX_PARTS, Equals, true)
+	last := parts[len(parts)-1]
+	c.Assert(last.Offset+last.Size, Equals, size)
+}
+
+func (s *TestSuite) TestMultipartUpload(c *C) {
+	key := "test_multipart_file"
+	body := make([]byte, 2*MIN_PART_SIZE+100)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	service := s.service
+	service.PartSize = MIN_PART_SIZE
+	service.Concurrency = 2
+	err := service.MultipartUpload(key, bytes.NewReader(body), int64(len(body)))
+	c.Assert(err, IsNil)
+
+	r, err := service.GetObject(key)
+	c.Assert(err, IsNil)
+	newBody, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(newBody, body), Equals, true)
+
+	err = service.DeleteObjects([]string{key})
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestMultipartUploadStream(c *C) {
+	key := "test_multipart_stream"
+	body := make([]byte, 2*MIN_PART_SIZE+100)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	service := s.service
+	service.PartSize = MIN_PART_SIZE
+	service.Concurrency = 2
+	err := service.MultipartUploadStream(key, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+
+	r, err := service.GetObject(key)
+	c.Assert(err, IsNil)
+	newBody, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(newBody, body), Equals, true)
+
+	// Object is not created if reading the stream fails
+	failedKey := "test_multipart_stream_failed"
+	err = service.MultipartUploadStream(failedKey, io.MultiReader(bytes.NewReader(body), iotest.TimeoutReader(bytes.NewReader(body))))
+	c.Assert(err, NotNil)
+	_, err = service.HeadObject(failedKey)
+	c.Assert(err, NotNil)
+
+	err = service.DeleteObjects([]string{key})
+	c.Assert(err, IsNil)
+}
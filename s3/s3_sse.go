@@ -0,0 +1,50 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Defaults of daemon, can be overridden by destination URL
+	ENV_SSE            = "CONVOY_S3_SSE"
+	ENV_SSE_KMS_KEY_ID = "CONVOY_S3_KMS_KEY_ID"
+
+	// Query parameters of destination URL, e.g. from --opt s3-sse=aws:kms
+	QUERY_SSE            = "sse"
+	QUERY_SSE_KMS_KEY_ID = "kms-key-id"
+)
+
+/*
+loadSSEConfig reads server side encryption options from query of destination
+URL, or environment variables of daemon. "AES256" is SSE-S3 with keys
+managed by S3, and "aws:kms" is SSE-KMS with the key specified by
+kms-key-id, or the default KMS key of S3 in the account.
+*/
+func (s *S3Service) loadSSEConfig(query url.Values) error {
+	s.SSE = os.Getenv(ENV_SSE)
+	s.SSEKMSKeyID = os.Getenv(ENV_SSE_KMS_KEY_ID)
+	if sse, exists := query[QUERY_SSE]; exists {
+		s.SSE = sse[0]
+		// Key of daemon default doesn't apply to the mode specified
+		s.SSEKMSKeyID = ""
+	}
+	if keyID := query.Get(QUERY_SSE_KMS_KEY_ID); keyID != "" {
+		s.SSEKMSKeyID = keyID
+	}
+
+	switch s.SSE {
+	case "", s3.ServerSideEncryptionAes256:
+		if s.SSEKMSKeyID != "" {
+			return fmt.Errorf("KMS key ID can only be specified with server side encryption %v", s3.ServerSideEncryptionAwsKms)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("Invalid server side encryption %v, must be %v or %v",
+			s.SSE, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "sftp"})
+)
+
+type SFTPObjectStoreDriver struct {
+	destURL string
+	path    string
+	service SFTPService
+}
+
+const (
+	KIND = "sftp"
+
+	// Defaults of daemon, can be overridden by destination URL
+	ENV_IDENTITY_FILE = "CONVOY_SFTP_IDENTITY_FILE"
+	ENV_KNOWN_HOSTS   = "CONVOY_SFTP_KNOWN_HOSTS"
+
+	// Query parameters of destination URL, which are kept in the URL of
+	// destination and backups
+	QUERY_IDENTITY_FILE = "identity-file"
+	QUERY_KNOWN_HOSTS   = "known-hosts"
+
+	MAX_CLEANUP_LEVEL = 10
+)
+
+func init() {
+	if err := objectstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func getConfigValue(query url.Values, key, env string) string {
+	if value, exists := query[key]; exists {
+		return value[0]
+	}
+	return os.Getenv(env)
+}
+
+func initFunc(destURL string) (objectstore.ObjectStoreDriver, error) {
+	return initDriver(destURL, "")
+}
+
+// initDriver runs server directly instead of connecting by SSH if it's
+// specified, for testing
+func initDriver(destURL, server string) (*SFTPObjectStoreDriver, error) {
+	b := &SFTPObjectStoreDriver{}
+
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	b.service.Host = u.Hostname()
+	b.service.Port = u.Port()
+	if u.User != nil {
+		b.service.User = u.User.Username()
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return nil, fmt.Errorf("Password is not supported by %v, use key instead", KIND)
+		}
+	}
+	b.path = filepath.Clean(u.Path)
+	if b.service.Host == "" || u.Path == "" || b.path == "/" {
+		return nil, fmt.Errorf("Invalid URL. Must be sftp://[user@]host[:port]/path")
+	}
+
+	query := u.Query()
+	b.service.IdentityFile = getConfigValue(query, QUERY_IDENTITY_FILE, ENV_IDENTITY_FILE)
+	b.service.KnownHostsFile = getConfigValue(query, QUERY_KNOWN_HOSTS, ENV_KNOWN_HOSTS)
+	b.service.server = server
+
+	//Test connection
+	if _, err := b.service.list(b.path); err != nil {
+		return nil, fmt.Errorf("SFTP path %v doesn't exist or cannot be accessed: %v", b.path, err)
+	}
+
+	b.destURL = KIND + "://"
+	if b.service.User != "" {
+		b.destURL += b.service.User + "@"
+	}
+	b.destURL += u.Host + b.path
+	v := url.Values{}
+	for _, key := range []string{QUERY_IDENTITY_FILE, QUERY_KNOWN_HOSTS} {
+		if value, exists := query[key]; exists {
+			v.Set(key, value[0])
+		}
+	}
+	if len(v) != 0 {
+		b.destURL += "?" + v.Encode()
+	}
+
+	log.Debugf("Loaded driver for %v", b.destURL)
+	return b, nil
+}
+
+func (s *SFTPObjectStoreDriver) Kind() string {
+	return KIND
+}
+
+func (s *SFTPObjectStoreDriver) GetURL() string {
+	return s.destURL
+}
+
+func (s *SFTPObjectStoreDriver) updatePath(path string) string {
+	return filepath.Join(s.path, path)
+}
+
+func (s *SFTPObjectStoreDriver) List(listPath string) ([]string, error) {
+	result := []string{}
+	infos, err := s.service.list(s.updatePath(listPath))
+	if isNotFound(err) {
+		return result, nil
+	}
+	if err != nil {
+		log.Error("Fail to list sftp: ", err)
+		return nil, err
+	}
+	for _, info := range infos {
+		result = append(result, filepath.Base(info.Path))
+	}
+	return result, nil
+}
+
+func (s *SFTPObjectStoreDriver) FileExists(filePath string) bool {
+	return s.FileSize(filePath) >= 0
+}
+
+func (s *SFTPObjectStoreDriver) FileSize(filePath string) int64 {
+	info, err := s.service.stat(s.updatePath(filePath))
+	if err != nil || info == nil || info.IsDir {
+		return -1
+	}
+	return info.Size
+}
+
+func (s *SFTPObjectStoreDriver) Remove(names ...string) error {
+	for _, name := range names {
+		path := s.updatePath(name)
+		if err := s.service.removeAll(path); err != nil {
+			return err
+		}
+		// Also cleanup upper level directories, which fails once a
+		// directory is not empty
+		commands := []string{}
+		dir := path
+		for i := 0; i < MAX_CLEANUP_LEVEL; i++ {
+			dir = filepath.Dir(dir)
+			// Don't clean above OBJECTSTORE_BASE
+			if strings.HasSuffix(dir, objectstore.OBJECTSTORE_BASE) || !strings.HasPrefix(dir, s.path+"/") {
+				break
+			}
+			commands = append(commands, "-rmdir "+quote(dir))
+		}
+		if len(commands) != 0 {
+			if _, err := s.service.run(commands...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read downloads src to a temporary file, which is removed once it's opened
+func (s *SFTPObjectStoreDriver) Read(src string) (io.ReadCloser, error) {
+	tmpFile, err := util.CreateStagingFile("sftp-read")
+	if err != nil {
+		return nil, err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	if err := s.Download(src, tmpFile.Name()); err != nil {
+		return nil, err
+	}
+	return os.Open(tmpFile.Name())
+}
+
+func (s *SFTPObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	tmpFile, err := util.CreateStagingFile("sftp-write")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := io.Copy(tmpFile, rs); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return s.Upload(tmpFile.Name(), dst)
+}
+
+func (s *SFTPObjectStoreDriver) Upload(src, dst string) error {
+	return s.service.upload(s.path, src, s.updatePath(dst))
+}
+
+func (s *SFTPObjectStoreDriver) Download(src, dst string) error {
+	return s.service.download(s.updatePath(src), dst)
+}
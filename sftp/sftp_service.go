@@ -0,0 +1,247 @@
+package sftp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	SFTP_BINARY = "sftp"
+
+	// Commands to the same server share the master connection of OpenSSH,
+	// which is kept for a while after the last command
+	CONTROL_PERSIST = "60s"
+	CONNECT_TIMEOUT = "30"
+	// Connection is dropped if the server doesn't respond for
+	// SERVER_ALIVE_INTERVAL * SERVER_ALIVE_COUNT_MAX seconds
+	SERVER_ALIVE_INTERVAL  = "15"
+	SERVER_ALIVE_COUNT_MAX = "4"
+
+	BATCH_PROMPT = "sftp> "
+)
+
+var (
+	// Line of "ls -ln", e.g.
+	// "-rw-r--r--    1 1000     1000         1234 Jan  2 15:04 /backup/volume.cfg"
+	longListingRegexp = regexp.MustCompile(`^(\S)\S*\s+\S+\s+\S+\s+\S+\s+(\d+)\s+\S+\s+\S+\s+\S+\s(.+)$`)
+)
+
+/*
+SFTPService runs batches of commands by the sftp program of OpenSSH, so the
+keys, known hosts and other settings of ssh are honored. Only key-based
+authentication is allowed, since there is no one to type a password.
+*/
+type SFTPService struct {
+	User           string
+	Host           string
+	Port           string
+	IdentityFile   string
+	KnownHostsFile string
+
+	// Program of SFTP server to run directly instead of connecting by SSH,
+	// only for testing
+	server string
+}
+
+type fileInfo struct {
+	Path  string
+	IsDir bool
+	Size  int64
+}
+
+// quote makes path a single argument of sftp command. Paths are globbed by
+// some commands, but names in objectstore never contain glob characters.
+func quote(path string) string {
+	path = strings.Replace(path, `\`, `\\`, -1)
+	path = strings.Replace(path, `"`, `\"`, -1)
+	return `"` + path + `"`
+}
+
+func getControlPath() (string, error) {
+	dir := filepath.Join(os.TempDir(), "convoy-sftp")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// %C is the hash of user, host and port, which is short enough for
+	// the path of socket
+	return filepath.Join(dir, "%C"), nil
+}
+
+func (s *SFTPService) args() ([]string, error) {
+	if s.server != "" {
+		return []string{"-q", "-D", s.server, "-b", "-"}, nil
+	}
+	controlPath, err := getControlPath()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-q", "-b", "-",
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=" + CONNECT_TIMEOUT,
+		"-o", "ServerAliveInterval=" + SERVER_ALIVE_INTERVAL,
+		"-o", "ServerAliveCountMax=" + SERVER_ALIVE_COUNT_MAX,
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + controlPath,
+		"-o", "ControlPersist=" + CONTROL_PERSIST,
+	}
+	if s.Port != "" {
+		args = append(args, "-P", s.Port)
+	}
+	if s.IdentityFile != "" {
+		args = append(args, "-i", s.IdentityFile, "-o", "IdentitiesOnly=yes")
+	}
+	if s.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+s.KnownHostsFile)
+	}
+	target := s.Host
+	if s.User != "" {
+		target = s.User + "@" + s.Host
+	}
+	return append(args, target), nil
+}
+
+// run executes commands in a batch, which stops at the first failed command
+// unless it's prefixed by "-". Commands echoed by sftp are dropped from the
+// output.
+func (s *SFTPService) run(commands ...string) (string, error) {
+	args, err := s.args()
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(SFTP_BINARY, args...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Failed to execute sftp commands %v on %v: %v, error %v",
+			commands, s.Host, strings.TrimSpace(stderr.String()), err)
+	}
+	lines := []string{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, BATCH_PROMPT) {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func isNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "not found")
+}
+
+func parseLongListing(out string) ([]fileInfo, error) {
+	infos := []fileInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		match := longListingRegexp.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("Cannot parse listing of sftp: %v", line)
+		}
+		size, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(match[3])
+		if name == "." || name == ".." {
+			continue
+		}
+		infos = append(infos, fileInfo{
+			Path:  match[3],
+			IsDir: match[1] == "d",
+			Size:  size,
+		})
+	}
+	return infos, nil
+}
+
+// list returns the entries of directory path, or the file itself if path is
+// a file. Error of nonexistent path tells isNotFound().
+func (s *SFTPService) list(path string) ([]fileInfo, error) {
+	out, err := s.run("ls -lna " + quote(path))
+	if err != nil {
+		return nil, err
+	}
+	return parseLongListing(out)
+}
+
+// stat returns nil if path doesn't exist
+func (s *SFTPService) stat(path string) (*fileInfo, error) {
+	infos, err := s.list(path)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 1 && infos[0].Path == path && !infos[0].IsDir {
+		return &infos[0], nil
+	}
+	return &fileInfo{
+		Path:  path,
+		IsDir: true,
+	}, nil
+}
+
+// removeAll removes path like "rm -rf", since the protocol can only remove
+// files and empty directories
+func (s *SFTPService) removeAll(path string) error {
+	infos, err := s.list(path)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(infos) == 1 && infos[0].Path == path && !infos[0].IsDir {
+		_, err := s.run("rm " + quote(path))
+		return err
+	}
+	commands := []string{}
+	for _, info := range infos {
+		if info.IsDir {
+			if err := s.removeAll(info.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		commands = append(commands, "rm "+quote(info.Path))
+	}
+	commands = append(commands, "rmdir "+quote(path))
+	_, err = s.run(commands...)
+	return err
+}
+
+// upload writes local file src to dst through a temporary file, so dst is
+// either the old or the new one. Directories of dst below root are
+// created as needed.
+func (s *SFTPService) upload(root, src, dst string) error {
+	commands := []string{}
+	dirs := []string{}
+	for dir := filepath.Dir(dst); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		// Fails if the directory exists
+		commands = append(commands, "-mkdir "+quote(dir))
+	}
+	tmpDst := dst + ".tmp"
+	commands = append(commands,
+		"put "+quote(src)+" "+quote(tmpDst),
+		"rename "+quote(tmpDst)+" "+quote(dst))
+	_, err := s.run(commands...)
+	return err
+}
+
+func (s *SFTPService) download(src, dst string) error {
+	_, err := s.run("get " + quote(src) + " " + quote(dst))
+	return err
+}
@@ -0,0 +1,742 @@
+package spool
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "spool"})
+
+	// Objectstore drivers are created per request, so the manifests of
+	// spool directories are kept here by path, and access to them and the
+	// spool files is serialized across all driver instances.
+	spoolLock = &sync.Mutex{}
+	manifests = map[string]*manifest{}
+
+	// Readers positioned in spool files, by path of the sealed file. Opened
+	// files are still read after a partial one is sealed by renaming it.
+	cursorsLock = &sync.Mutex{}
+	cursors     = map[string]*cursor{}
+)
+
+/*
+SpoolObjectStoreDriver stores objectstore content in a staging directory
+suitable for sequential media. Every backup is written as its own tar file:
+objects of a volume are appended to the partial spool file of the volume,
+which is sealed once the config of a backup is written, the last object
+written by a backup. Objects shared by volumes go to a shared partial file,
+sealed along with the backup. Sealed files are never written again, and are
+what a tape system picks up. A manifest records the spool file and offset of
+every object. Since sequential media cannot be rewritten, removing an object
+only marks it as removed in the manifest. Reads stream through the spool
+files from the beginning rather than seeking, so the driver is Sequential:
+objects are written and read one at a time, in the order of the backup.
+*/
+type SpoolObjectStoreDriver struct {
+	destURL string
+	path    string
+}
+
+const (
+	KIND = "spool"
+
+	SPOOL_FILE_PREFIX = "convoy-spool-"
+	SPOOL_FILE_SUFFIX = ".tar"
+	// Suffix of the spool file being written, dropped once it's sealed
+	PARTIAL_SUFFIX = ".partial"
+	MANIFEST_FILE  = "convoy-spool.manifest"
+
+	TAR_BLOCK_SIZE = 512
+
+	// Spool file of a cursor not read for this long is closed
+	CURSOR_IDLE_TIMEOUT = time.Minute
+)
+
+type ManifestEntry struct {
+	Path string
+	// Number of the spool file, and offset of the content of object in it
+	File      int
+	Offset    int64
+	Size      int64
+	CreatedAt string
+	Removed   bool
+}
+
+/*
+manifest records where the objects of a spool directory are. The manifest
+file is a log of ManifestEntry, one JSON record per line, appended as objects
+are written and removed, so it's never rewritten as a whole. It's read once
+when the spool directory is first used, and the latest record of every live
+object is kept in memory.
+*/
+type manifest struct {
+	file    *os.File
+	size    int64
+	objects map[string]ManifestEntry
+
+	// Numbers of the partial files by their keys, and of the next file
+	partials map[string]int
+	next     int
+}
+
+func init() {
+	if err := objectstore.RegisterDriver(KIND, initFunc); err != nil {
+		panic(err)
+	}
+}
+
+func initFunc(destURL string) (objectstore.ObjectStoreDriver, error) {
+	s := &SpoolObjectStoreDriver{}
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != KIND {
+		return nil, fmt.Errorf("BUG: Why dispatch %v to %v?", u.Scheme, KIND)
+	}
+
+	if u.Host != "" {
+		return nil, fmt.Errorf("Spool path must follow: spool:///path/ format")
+	}
+
+	s.path = u.Path
+	if s.path == "" {
+		return nil, fmt.Errorf("Cannot find spool path")
+	}
+	st, err := os.Stat(s.path)
+	if err != nil || !st.IsDir() {
+		return nil, fmt.Errorf("Spool path %v doesn't exist or is not a directory", s.path)
+	}
+
+	s.destURL = KIND + "://" + s.path
+	log.Debugf("Loaded driver for %v", s.destURL)
+	return s, nil
+}
+
+func getSpoolFileName(file int) string {
+	return fmt.Sprintf("%v%06d%v", SPOOL_FILE_PREFIX, file, SPOOL_FILE_SUFFIX)
+}
+
+// spoolFilePath returns the path of spool file, which is the partial one if
+// it's not sealed yet
+func (s *SpoolObjectStoreDriver) spoolFilePath(file int) string {
+	path := filepath.Join(s.path, getSpoolFileName(file))
+	if _, err := os.Stat(path); err != nil {
+		return path + PARTIAL_SUFFIX
+	}
+	return path
+}
+
+// getPartialKey returns the key of the partial file objects of path are
+// written to. Objects of a volume are written to their own partial file, so
+// concurrent backups of different volumes don't interleave, while objects
+// shared by volumes, e.g. shared blocks, are written to the shared one.
+func getPartialKey(path string) string {
+	parts := strings.Split(cleanPath(path), "/")
+	if len(parts) > 5 && parts[0] == objectstore.OBJECTSTORE_BASE && parts[1] == objectstore.VOLUME_DIRECTORY {
+		return parts[4]
+	}
+	return ""
+}
+
+// loadPartials finds the partial files in the spool directory, and the key
+// of each by its first record. Sealed and partial files are numbered in the
+// order they're opened.
+func (s *SpoolObjectStoreDriver) loadPartials(m *manifest) error {
+	names, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+	for _, e := range m.objects {
+		if e.File >= m.next {
+			m.next = e.File + 1
+		}
+	}
+	for _, st := range names {
+		name := st.Name()
+		if !strings.HasPrefix(name, SPOOL_FILE_PREFIX) {
+			continue
+		}
+		partial := strings.HasSuffix(name, PARTIAL_SUFFIX)
+		name = strings.TrimSuffix(name, PARTIAL_SUFFIX)
+		if !strings.HasSuffix(name, SPOOL_FILE_SUFFIX) {
+			continue
+		}
+		file, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, SPOOL_FILE_PREFIX), SPOOL_FILE_SUFFIX))
+		if err != nil {
+			continue
+		}
+		if file >= m.next {
+			m.next = file + 1
+		}
+		if !partial {
+			continue
+		}
+		path := filepath.Join(s.path, st.Name())
+		key, err := readPartialKey(path)
+		if err != nil {
+			// Not appended to anymore, it's left for the tape system
+			log.Warnf("Cannot find the first record of spool file %v: %v", path, err)
+			continue
+		}
+		if other, ok := m.partials[key]; ok && other > file {
+			continue
+		}
+		m.partials[key] = file
+	}
+	return nil
+}
+
+func readPartialKey(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hdr, err := tar.NewReader(f).Next()
+	if err != nil {
+		return "", err
+	}
+	return getPartialKey(hdr.Name), nil
+}
+
+// getManifest returns the manifest of the spool directory, read from the
+// manifest file when it's first used. Caller must hold spoolLock.
+func (s *SpoolObjectStoreDriver) getManifest() (*manifest, error) {
+	if m, ok := manifests[s.path]; ok {
+		return m, nil
+	}
+	path := filepath.Join(s.path, MANIFEST_FILE)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{
+		file:     f,
+		objects:  make(map[string]ManifestEntry),
+		partials: make(map[string]int),
+	}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		e := ManifestEntry{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Invalid record at %v of spool manifest %v: %v", m.size, path, err)
+		}
+		m.apply(e)
+		m.size += int64(len(line))
+	}
+	// Drop the record partially appended by a crashed daemon
+	if err := f.Truncate(m.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := s.loadPartials(m); err != nil {
+		f.Close()
+		return nil, err
+	}
+	manifests[s.path] = m
+	return m, nil
+}
+
+func (m *manifest) apply(e ManifestEntry) {
+	if e.Removed {
+		delete(m.objects, e.Path)
+	} else {
+		m.objects[e.Path] = e
+	}
+}
+
+// append records entries in the manifest file and applies them. A failed
+// write truncates the file back to where it was.
+func (m *manifest) append(entries ...ManifestEntry) error {
+	data := []byte{}
+	for _, e := range entries {
+		record, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, record...), '\n')
+	}
+	if _, err := m.file.Write(data); err != nil {
+		if terr := m.file.Truncate(m.size); terr != nil {
+			log.Errorf("Failed to truncate spool manifest back to %v bytes: %v", m.size, terr)
+		}
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.size += int64(len(data))
+	for _, e := range entries {
+		m.apply(e)
+	}
+	return nil
+}
+
+// lookup returns the latest live record of filePath, or nil if there is none
+func (m *manifest) lookup(filePath string) *ManifestEntry {
+	e, ok := m.objects[cleanPath(filePath)]
+	if !ok {
+		return nil
+	}
+	return &e
+}
+
+// getPartial returns the number of partial file of key, opening a new one
+// if there is none
+func (m *manifest) getPartial(key string) int {
+	file, ok := m.partials[key]
+	if !ok {
+		file = m.next
+		m.next++
+		m.partials[key] = file
+	}
+	return file
+}
+
+func (m *manifest) livePaths() []string {
+	result := []string{}
+	for path := range m.objects {
+		result = append(result, path)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func cleanPath(path string) string {
+	return strings.Trim(filepath.Clean("/"+path), "/")
+}
+
+// isBackupConfig tells if path is the config of a backup, which completes it
+func isBackupConfig(path string) bool {
+	name := filepath.Base(path)
+	return filepath.Base(filepath.Dir(path)) == "backups" &&
+		strings.HasPrefix(name, objectstore.BACKUP_CONFIG_PREFIX) &&
+		strings.HasSuffix(name, objectstore.CFG_SUFFIX)
+}
+
+func (s *SpoolObjectStoreDriver) Kind() string {
+	return KIND
+}
+
+func (s *SpoolObjectStoreDriver) GetURL() string {
+	return s.destURL
+}
+
+func (s *SpoolObjectStoreDriver) Sequential() bool {
+	return true
+}
+
+func (s *SpoolObjectStoreDriver) FileSize(filePath string) int64 {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	m, err := s.getManifest()
+	if err != nil {
+		return -1
+	}
+	e := m.lookup(filePath)
+	if e == nil {
+		return -1
+	}
+	return e.Size
+}
+
+func (s *SpoolObjectStoreDriver) FileExists(filePath string) bool {
+	return s.FileSize(filePath) >= 0
+}
+
+func (s *SpoolObjectStoreDriver) Remove(names ...string) error {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	m, err := s.getManifest()
+	if err != nil {
+		return err
+	}
+	// Behavior like "rm -rf", so remove everything under the names as well
+	removed := []ManifestEntry{}
+	for _, name := range names {
+		name = cleanPath(name)
+		for path := range m.objects {
+			if path != name && !strings.HasPrefix(path, name+"/") {
+				continue
+			}
+			removed = append(removed, ManifestEntry{
+				Path:      path,
+				File:      -1,
+				Size:      -1,
+				CreatedAt: util.Now(),
+				Removed:   true,
+			})
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	return m.append(removed...)
+}
+
+/*
+cursor is a reader streaming through a spool file. Objects of a backup are
+read in the order they were written, e.g. blocks by restore, so every read
+continues from where the last one stopped, and the file is only read again
+from the beginning for an object before the cursor. Only one object is read
+by a cursor at a time. The file is closed once the cursor is idle for
+CURSOR_IDLE_TIMEOUT.
+*/
+type cursor struct {
+	lock     sync.Mutex
+	driver   *SpoolObjectStoreDriver
+	path     string
+	number   int
+	file     *os.File
+	offset   int64
+	tr       *tar.Reader
+	lastUsed time.Time
+	idle     *time.Timer
+}
+
+func (c *cursor) Read(p []byte) (int, error) {
+	n, err := c.file.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
+
+func (s *SpoolObjectStoreDriver) getCursor(file int) *cursor {
+	path := filepath.Join(s.path, getSpoolFileName(file))
+	cursorsLock.Lock()
+	defer cursorsLock.Unlock()
+	c := cursors[path]
+	if c == nil {
+		c = &cursor{driver: s, path: path, number: file}
+		cursors[path] = c
+	}
+	return c
+}
+
+// release unlocks the cursor once an object is read, and closes its file
+// if it's not used again for a while. Caller must hold c.lock.
+func (c *cursor) release() {
+	c.lastUsed = time.Now()
+	if c.idle == nil {
+		c.idle = time.AfterFunc(CURSOR_IDLE_TIMEOUT, c.closeIfIdle)
+	} else {
+		c.idle.Reset(CURSOR_IDLE_TIMEOUT)
+	}
+	c.lock.Unlock()
+}
+
+func (c *cursor) closeIfIdle() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.lastUsed) < CURSOR_IDLE_TIMEOUT {
+		return
+	}
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	cursorsLock.Lock()
+	if cursors[c.path] == c {
+		delete(cursors, c.path)
+	}
+	cursorsLock.Unlock()
+}
+
+// seek moves the cursor to the content of the record at offset, skipping
+// the records before it
+func (c *cursor) seek(offset int64) error {
+	if c.file == nil || c.offset > offset {
+		if c.file != nil {
+			c.file.Close()
+		}
+		f, err := os.Open(c.driver.spoolFilePath(c.number))
+		if err != nil {
+			c.file = nil
+			return err
+		}
+		c.file = f
+		c.offset = 0
+		c.tr = tar.NewReader(c)
+	}
+	for c.offset < offset {
+		if _, err := c.tr.Next(); err != nil {
+			c.file.Close()
+			c.file = nil
+			if err == io.EOF {
+				return fmt.Errorf("Cannot find record at %v of spool file %v", offset, getSpoolFileName(c.number))
+			}
+			return err
+		}
+	}
+	if c.offset != offset {
+		c.file.Close()
+		c.file = nil
+		return fmt.Errorf("BUG: No record at %v of spool file %v", offset, getSpoolFileName(c.number))
+	}
+	return nil
+}
+
+type spoolReader struct {
+	io.Reader
+	cursor *cursor
+	closed bool
+}
+
+func (r *spoolReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.cursor.release()
+	}
+	return nil
+}
+
+func (s *SpoolObjectStoreDriver) Read(src string) (io.ReadCloser, error) {
+	spoolLock.Lock()
+	m, err := s.getManifest()
+	if err != nil {
+		spoolLock.Unlock()
+		return nil, err
+	}
+	e := m.lookup(src)
+	if e == nil {
+		spoolLock.Unlock()
+		return nil, fmt.Errorf("Cannot find %v in spool %v", src, s.path)
+	}
+	file, offset, size := e.File, e.Offset, e.Size
+	spoolLock.Unlock()
+
+	c := s.getCursor(file)
+	c.lock.Lock()
+	if err := c.seek(offset); err != nil {
+		c.release()
+		return nil, err
+	}
+	return &spoolReader{
+		Reader: io.LimitReader(c.tr, size),
+		cursor: c,
+	}, nil
+}
+
+func (s *SpoolObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
+	size, err := rs.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	return s.appendRecord(dst, rs, size)
+}
+
+/*
+appendRecord appends the content of r to the open spool file. A failed write
+truncates the file back to where it was, so no partial record is left in
+the middle. A record written but not in manifest, e.g. when the daemon
+crashed before saving the manifest, is skipped by reads, since records are
+identified by their offset. Writing the config of a backup seals the spool
+file.
+*/
+func (s *SpoolObjectStoreDriver) appendRecord(dst string, r io.Reader, size int64) (err error) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	m, err := s.getManifest()
+	if err != nil {
+		return err
+	}
+
+	key := getPartialKey(dst)
+	file := m.getPartial(key)
+	path := filepath.Join(s.path, getSpoolFileName(file)+PARTIAL_SUFFIX)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if terr := f.Truncate(start); terr != nil {
+				log.Errorf("Failed to truncate spool file %v back to %v bytes: %v", path, start, terr)
+			}
+		}
+	}()
+
+	tw := tar.NewWriter(f)
+	hdr := &tar.Header{
+		Name:    cleanPath(dst),
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return err
+	}
+	// Flush instead of Close, the file stays open for further appending
+	// and won't carry the end-of-archive trailer in the middle
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	end, err := f.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	padded := (size + TAR_BLOCK_SIZE - 1) / TAR_BLOCK_SIZE * TAR_BLOCK_SIZE
+	if err := m.append(ManifestEntry{
+		Path:      cleanPath(dst),
+		File:      file,
+		Offset:    end - padded,
+		Size:      size,
+		CreatedAt: util.Now(),
+	}); err != nil {
+		return err
+	}
+
+	if isBackupConfig(dst) {
+		// The backup is in the manifest, failing to seal only leaves the
+		// file open for the next one
+		if err := s.seal(f, path, file); err != nil {
+			log.Errorf("Failed to seal spool file %v: %v", path, err)
+		} else {
+			delete(m.partials, key)
+		}
+		// Objects shared by the backup may be in the shared partial file,
+		// which is sealed as well, so the backup is complete in sealed ones
+		if shared, ok := m.partials[""]; ok && key != "" {
+			if err := s.sealPartial(shared); err != nil {
+				log.Errorf("Failed to seal shared spool file %v: %v", getSpoolFileName(shared), err)
+			} else {
+				delete(m.partials, "")
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SpoolObjectStoreDriver) sealPartial(file int) error {
+	path := filepath.Join(s.path, getSpoolFileName(file)+PARTIAL_SUFFIX)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.seal(f, path, file)
+}
+
+// seal ends the spool file with the end-of-archive trailer and drops its
+// partial suffix, so it's complete for the tape system
+func (s *SpoolObjectStoreDriver) seal(f *os.File, path string, file int) error {
+	if err := tar.NewWriter(f).Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(s.path, getSpoolFileName(file))); err != nil {
+		return err
+	}
+	log.Debugf("Sealed spool file %v", getSpoolFileName(file))
+	return nil
+}
+
+func (s *SpoolObjectStoreDriver) List(path string) ([]string, error) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	m, err := s.getManifest()
+	if err != nil {
+		return nil, err
+	}
+	prefix := cleanPath(path)
+	if prefix != "" {
+		prefix += "/"
+	}
+	found := make(map[string]bool)
+	result := []string{}
+	for _, p := range m.livePaths() {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		name := strings.Split(strings.TrimPrefix(p, prefix), "/")[0]
+		if name == "" || found[name] {
+			continue
+		}
+		found[name] = true
+		result = append(result, name)
+	}
+	if len(result) == 0 && prefix != "" {
+		return nil, fmt.Errorf("Cannot find %v in spool %v", path, s.path)
+	}
+	return result, nil
+}
+
+func (s *SpoolObjectStoreDriver) Upload(src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return s.appendRecord(dst, file, st.Size())
+}
+
+func (s *SpoolObjectStoreDriver) Download(src, dst string) error {
+	rc, err := s.Read(src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, rc); err != nil {
+		return err
+	}
+	return nil
+}
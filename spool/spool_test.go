@@ -0,0 +1,346 @@
+package spool
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher/convoy/objectstore"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	spoolDir string
+	workDir  string
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.spoolDir, err = ioutil.TempDir("", "convoy-spool")
+	c.Assert(err, IsNil)
+	s.workDir, err = ioutil.TempDir("", "convoy-spool-work")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	spoolLock.Lock()
+	if m, ok := manifests[s.spoolDir]; ok {
+		m.file.Close()
+		delete(manifests, s.spoolDir)
+	}
+	spoolLock.Unlock()
+	c.Assert(os.RemoveAll(s.spoolDir), IsNil)
+	c.Assert(os.RemoveAll(s.workDir), IsNil)
+}
+
+func (s *TestSuite) TestDriverFuncs(c *C) {
+	driver, err := initFunc("spool://" + s.spoolDir)
+	c.Assert(err, IsNil)
+
+	body1 := []byte("this is only a test file")
+	body2 := []byte("this is another test file")
+
+	c.Assert(driver.Write("dir/dir1/file1", bytes.NewReader(body1)), IsNil)
+	c.Assert(driver.Write("dir/dir2/file2", bytes.NewReader(body2)), IsNil)
+	c.Assert(driver.FileSize("dir/dir1/file1"), Equals, int64(len(body1)))
+	c.Assert(driver.FileExists("dir/dir3/file3"), Equals, false)
+
+	names, err := driver.List("dir")
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"dir1", "dir2"})
+
+	// Overwrite should return the latest content
+	c.Assert(driver.Write("dir/dir1/file1", bytes.NewReader(body2)), IsNil)
+	rc, err := driver.Read("dir/dir1/file1")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, body2)
+
+	c.Assert(driver.Remove("dir/dir1"), IsNil)
+	c.Assert(driver.FileExists("dir/dir1/file1"), Equals, false)
+	c.Assert(driver.FileExists("dir/dir2/file2"), Equals, true)
+	_, err = driver.List("dir/dir1")
+	c.Assert(err, NotNil)
+
+	// Removal never rewrites the sequential file
+	spoolFile, err := ioutil.ReadFile(filepath.Join(s.spoolDir, getSpoolFileName(0)+PARTIAL_SUFFIX))
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(spoolFile, body1), Equals, true)
+}
+
+func (s *TestSuite) TestManifest(c *C) {
+	driver, err := initFunc("spool://" + s.spoolDir)
+	c.Assert(err, IsNil)
+	manifestFile := filepath.Join(s.spoolDir, MANIFEST_FILE)
+
+	body := []byte("this is only a test file")
+	c.Assert(driver.Write("dir/file1", bytes.NewReader(body)), IsNil)
+	c.Assert(driver.Write("dir/file2", bytes.NewReader(body)), IsNil)
+	st, err := os.Stat(manifestFile)
+	c.Assert(err, IsNil)
+	size := st.Size()
+
+	// Records are appended, earlier ones are never rewritten
+	c.Assert(driver.Remove("dir/file1"), IsNil)
+	data, err := ioutil.ReadFile(manifestFile)
+	c.Assert(err, IsNil)
+	c.Assert(int64(len(data)) > size, Equals, true)
+	c.Assert(bytes.Count(data, []byte("\n")), Equals, 3)
+
+	// A torn record left by a crash is dropped when the manifest is read
+	f, err := os.OpenFile(manifestFile, os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, IsNil)
+	_, err = f.Write([]byte(`{"Path":"dir/file3","Fi`))
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+	spoolLock.Lock()
+	manifests[s.spoolDir].file.Close()
+	delete(manifests, s.spoolDir)
+	spoolLock.Unlock()
+
+	c.Assert(driver.FileExists("dir/file1"), Equals, false)
+	c.Assert(driver.FileExists("dir/file2"), Equals, true)
+	c.Assert(driver.FileExists("dir/file3"), Equals, false)
+	st, err = os.Stat(manifestFile)
+	c.Assert(err, IsNil)
+	c.Assert(st.Size(), Equals, int64(len(data)))
+	c.Assert(driver.Write("dir/file3", bytes.NewReader(body)), IsNil)
+	names, err := driver.List("dir")
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"file2", "file3"})
+}
+
+func (s *TestSuite) readSpoolFile(c *C, name string) []string {
+	f, err := os.Open(filepath.Join(s.spoolDir, name))
+	c.Assert(err, IsNil)
+	defer f.Close()
+	names := []string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, hdr.Name)
+	}
+	return names
+}
+
+func (s *TestSuite) TestInterleavedBackups(c *C) {
+	driver, err := initFunc("spool://" + s.spoolDir)
+	c.Assert(err, IsNil)
+
+	body := []byte("this is only a test file")
+	vol1 := "convoy-objectstore/volumes/vo/l1/vol1/"
+	vol2 := "convoy-objectstore/volumes/vo/l2/vol2/"
+	shared := "convoy-objectstore/blocks/aa/bb/aabbcc"
+	for _, path := range []string{
+		vol1 + "blocks/11/11/1111",
+		vol2 + "blocks/22/22/2222",
+		shared,
+		vol1 + "backups/backup_1.cfg",
+	} {
+		c.Assert(driver.Write(path, bytes.NewReader(body)), IsNil)
+	}
+
+	// The backup of vol1 seals its own file and the shared one, while the
+	// backup of vol2 is still being written
+	c.Assert(s.readSpoolFile(c, getSpoolFileName(0)), DeepEquals, []string{vol1 + "blocks/11/11/1111", vol1 + "backups/backup_1.cfg"})
+	c.Assert(s.readSpoolFile(c, getSpoolFileName(2)), DeepEquals, []string{shared})
+	c.Assert(s.readSpoolFile(c, getSpoolFileName(1)+PARTIAL_SUFFIX), DeepEquals, []string{vol2 + "blocks/22/22/2222"})
+
+	// Partial files are found again after restart
+	spoolLock.Lock()
+	manifests[s.spoolDir].file.Close()
+	delete(manifests, s.spoolDir)
+	spoolLock.Unlock()
+
+	c.Assert(driver.Write(vol2+"backups/backup_2.cfg", bytes.NewReader(body)), IsNil)
+	c.Assert(driver.Write(vol1+"volume.cfg", bytes.NewReader(body)), IsNil)
+	c.Assert(s.readSpoolFile(c, getSpoolFileName(1)), DeepEquals, []string{vol2 + "blocks/22/22/2222", vol2 + "backups/backup_2.cfg"})
+	c.Assert(s.readSpoolFile(c, getSpoolFileName(3)+PARTIAL_SUFFIX), DeepEquals, []string{vol1 + "volume.cfg"})
+}
+
+func (s *TestSuite) TestIdleCursor(c *C) {
+	driver, err := initFunc("spool://" + s.spoolDir)
+	c.Assert(err, IsNil)
+	c.Assert(driver.(objectstore.SequentialDriver).Sequential(), Equals, true)
+
+	body := []byte("this is only a test file")
+	c.Assert(driver.Write("file1", bytes.NewReader(body)), IsNil)
+	read := func() {
+		rc, err := driver.Read("file1")
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(rc)
+		c.Assert(err, IsNil)
+		c.Assert(rc.Close(), IsNil)
+		c.Assert(data, DeepEquals, body)
+	}
+	read()
+
+	path := filepath.Join(s.spoolDir, getSpoolFileName(0))
+	cursorsLock.Lock()
+	cur := cursors[path]
+	cursorsLock.Unlock()
+	c.Assert(cur, NotNil)
+	c.Assert(cur.file, NotNil)
+
+	// Cursor used recently is kept open
+	cur.closeIfIdle()
+	cursorsLock.Lock()
+	c.Assert(cursors[path], Equals, cur)
+	cursorsLock.Unlock()
+
+	cur.lock.Lock()
+	cur.lastUsed = time.Now().Add(-CURSOR_IDLE_TIMEOUT)
+	cur.lock.Unlock()
+	cur.closeIfIdle()
+	c.Assert(cur.file, IsNil)
+	cursorsLock.Lock()
+	_, ok := cursors[path]
+	cursorsLock.Unlock()
+	c.Assert(ok, Equals, false)
+
+	read()
+}
+
+// failingReader fails after reading half of the content
+type failingReader struct {
+	data []byte
+	read int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.read >= len(r.data)/2 {
+		return 0, fmt.Errorf("read failure")
+	}
+	n := copy(p, r.data[r.read:len(r.data)/2])
+	r.read += n
+	return n, nil
+}
+
+func (r *failingReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == os.SEEK_END {
+		return int64(len(r.data)), nil
+	}
+	r.read = int(offset)
+	return offset, nil
+}
+
+func (s *TestSuite) TestWriteFailure(c *C) {
+	driver, err := initFunc("spool://" + s.spoolDir)
+	c.Assert(err, IsNil)
+	spoolFile := filepath.Join(s.spoolDir, getSpoolFileName(0)+PARTIAL_SUFFIX)
+
+	body1 := bytes.Repeat([]byte("1"), 1000)
+	body2 := bytes.Repeat([]byte("2"), 3000)
+	c.Assert(driver.Write("file1", bytes.NewReader(body1)), IsNil)
+	st, err := os.Stat(spoolFile)
+	c.Assert(err, IsNil)
+	size := st.Size()
+
+	// Failed write leaves nothing behind
+	c.Assert(driver.Write("file2", &failingReader{data: body2}), ErrorMatches, "read failure")
+	st, err = os.Stat(spoolFile)
+	c.Assert(err, IsNil)
+	c.Assert(st.Size(), Equals, size)
+	c.Assert(driver.FileExists("file2"), Equals, false)
+
+	// Record written by a daemon crashed before saving manifest is skipped
+	f, err := os.OpenFile(spoolFile, os.O_WRONLY|os.O_APPEND, 0600)
+	c.Assert(err, IsNil)
+	tw := tar.NewWriter(f)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "file2", Mode: 0600, Size: int64(len(body1))}), IsNil)
+	_, err = tw.Write(body1)
+	c.Assert(err, IsNil)
+	c.Assert(tw.Flush(), IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	c.Assert(driver.Write("file2", bytes.NewReader(body2)), IsNil)
+	for _, t := range []struct {
+		path string
+		body []byte
+	}{{"file1", body1}, {"file2", body2}, {"file1", body1}} {
+		rc, err := driver.Read(t.path)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(rc)
+		c.Assert(err, IsNil)
+		c.Assert(rc.Close(), IsNil)
+		c.Assert(data, DeepEquals, t.body)
+	}
+}
+
+func (s *TestSuite) TestBackupRoundTrip(c *C) {
+	destURL := "spool://" + s.spoolDir
+	content := []byte("content of the snapshot to be archived")
+
+	snapshotFile := filepath.Join(s.workDir, "snapshot.tar.gz")
+	c.Assert(ioutil.WriteFile(snapshotFile, content, 0600), IsNil)
+
+	volume := &objectstore.Volume{
+		Name:   "volume1",
+		Driver: "vfs",
+	}
+	snapshot := &objectstore.Snapshot{
+		Name: "snapshot1",
+	}
+	backupURL, err := objectstore.CreateSingleFileBackup(volume, snapshot, snapshotFile, destURL)
+	c.Assert(err, IsNil)
+
+	list, err := objectstore.List("volume1", destURL, "vfs")
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[backupURL]["SnapshotName"], Equals, "snapshot1")
+
+	restoreDir := filepath.Join(s.workDir, "restore")
+	c.Assert(os.Mkdir(restoreDir, 0700), IsNil)
+	restoredFile, err := objectstore.RestoreSingleFileBackup(backupURL, restoreDir)
+	c.Assert(err, IsNil)
+	restored, err := ioutil.ReadFile(restoredFile)
+	c.Assert(err, IsNil)
+	c.Assert(restored, DeepEquals, content)
+
+	// The backup is sealed in its own spool file, readable by tar
+	f, err := os.Open(filepath.Join(s.spoolDir, getSpoolFileName(0)))
+	c.Assert(err, IsNil)
+	names := []string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, filepath.Base(hdr.Name))
+	}
+	f.Close()
+	c.Assert(names[len(names)-1], Matches, "backup_.*\\.cfg")
+	_, err = os.Stat(filepath.Join(s.spoolDir, getSpoolFileName(1)+PARTIAL_SUFFIX))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// The next backup goes to the next spool file
+	backupURL2, err := objectstore.CreateSingleFileBackup(volume, snapshot, snapshotFile, destURL)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(filepath.Join(s.spoolDir, getSpoolFileName(1)))
+	c.Assert(err, IsNil)
+	c.Assert(objectstore.DeleteSingleFileBackup(backupURL2), IsNil)
+
+	c.Assert(objectstore.DeleteSingleFileBackup(backupURL), IsNil)
+	list, err = objectstore.List("volume1", destURL, "vfs")
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
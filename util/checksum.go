@@ -0,0 +1,66 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+const (
+	CHECKSUM_SHA512 = "sha512"
+	CHECKSUM_SHA256 = "sha256"
+	CHECKSUM_BLAKE3 = "blake3"
+	CHECKSUM_XXH3   = "xxh3"
+
+	// Blocks checksummed before the algorithm was recorded use SHA-512
+	DEFAULT_CHECKSUM = CHECKSUM_SHA512
+)
+
+// checksumFuncs return the checksum of data in hex. SHA-256 uses the SHA
+// extensions of CPU and BLAKE3 uses AVX2 when available. XXH3 is the fastest
+// but not cryptographic, so blocks could be forged to collide.
+var checksumFuncs = map[string]func(data []byte) string{
+	CHECKSUM_SHA512: func(data []byte) string {
+		sum := sha512.Sum512(data)
+		// Truncated to keep the names of existing blocks
+		return hex.EncodeToString(sum[:])[:PRESERVED_CHECKSUM_LENGTH]
+	},
+	CHECKSUM_SHA256: func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	},
+	CHECKSUM_BLAKE3: func(data []byte) string {
+		sum := blake3.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	},
+	CHECKSUM_XXH3: func(data []byte) string {
+		sum := xxh3.Hash128(data).Bytes()
+		return hex.EncodeToString(sum[:])
+	},
+}
+
+// GetChecksumAlgorithm returns algorithm, or the default one if it's empty
+func GetChecksumAlgorithm(algorithm string) string {
+	if algorithm == "" {
+		return DEFAULT_CHECKSUM
+	}
+	return algorithm
+}
+
+func ValidateChecksumAlgorithm(algorithm string) error {
+	if _, exists := checksumFuncs[GetChecksumAlgorithm(algorithm)]; !exists {
+		return fmt.Errorf("Invalid checksum algorithm %v, must be %v, %v, %v or %v",
+			algorithm, CHECKSUM_SHA512, CHECKSUM_SHA256, CHECKSUM_BLAKE3, CHECKSUM_XXH3)
+	}
+	return nil
+}
+
+// ComputeChecksum returns the checksum of data by algorithm, which must be
+// valid
+func ComputeChecksum(data []byte, algorithm string) string {
+	return checksumFuncs[GetChecksumAlgorithm(algorithm)](data)
+}
@@ -0,0 +1,387 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+	COMPRESSION_LZ4  = "lz4"
+	COMPRESSION_NONE = "none"
+
+	// Data compressed before the algorithm was recorded is gzipped
+	DEFAULT_COMPRESSION = COMPRESSION_GZIP
+)
+
+// compressionPrograms are the commands used to compress with each
+// algorithm, which decompress with "-d"
+var compressionPrograms = map[string]string{
+	COMPRESSION_GZIP: "gzip",
+	COMPRESSION_ZSTD: "zstd",
+	COMPRESSION_LZ4:  "lz4",
+}
+
+// GetCompression returns compression, or the default one if it's empty
+func GetCompression(compression string) string {
+	if compression == "" {
+		return DEFAULT_COMPRESSION
+	}
+	return compression
+}
+
+func ValidateCompression(compression string) error {
+	compression = GetCompression(compression)
+	if _, exists := compressionPrograms[compression]; !exists && compression != COMPRESSION_NONE {
+		return fmt.Errorf("Invalid compression %v, must be %v, %v, %v or %v",
+			compression, COMPRESSION_GZIP, COMPRESSION_ZSTD, COMPRESSION_LZ4, COMPRESSION_NONE)
+	}
+	return nil
+}
+
+// CompressionExt returns the file extension of a tarball compressed with
+// compression
+func CompressionExt(compression string) string {
+	switch GetCompression(compression) {
+	case COMPRESSION_ZSTD:
+		return ".tar.zst"
+	case COMPRESSION_LZ4:
+		return ".tar.lz4"
+	case COMPRESSION_NONE:
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+func getCompressionProgram(compression string) (string, error) {
+	if err := ValidateCompression(compression); err != nil {
+		return "", err
+	}
+	return compressionPrograms[GetCompression(compression)], nil
+}
+
+// tarArgs returns the arguments of tar to process archive compressed with
+// compression
+func tarArgs(compression string, args ...string) ([]string, error) {
+	program, err := getCompressionProgram(compression)
+	if err != nil {
+		return nil, err
+	}
+	if program == "" {
+		return args, nil
+	}
+	return append([]string{"--use-compress-program", program}, args...), nil
+}
+
+// pipeProgram runs program with src as its input and dst as its output.
+// Unlike Execute(), there is no timeout since the time it takes depends on
+// the size of data.
+func pipeProgram(program string, args []string, src io.Reader, dst io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(program, args...)
+	cmd.Stdin = src
+	cmd.Stdout = dst
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to execute: %v %v, output %v, error %v", program, args, stderr.String(), err)
+	}
+	return nil
+}
+
+func CompressStream(dst io.Writer, src io.Reader, compression string) error {
+	program, err := getCompressionProgram(compression)
+	if err != nil {
+		return err
+	}
+	if program == "" {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	return pipeProgram(program, []string{"-q", "-c"}, src, dst)
+}
+
+func DecompressStream(dst io.Writer, src io.Reader, compression string) error {
+	program, err := getCompressionProgram(compression)
+	if err != nil {
+		return err
+	}
+	if program == "" {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	return pipeProgram(program, []string{"-q", "-d", "-c"}, src, dst)
+}
+
+// CompressData compresses a block of data. Gzip is done in process, since
+// starting a program for every block would be slower.
+func CompressData(data []byte, compression string) (io.ReadSeeker, error) {
+	var b bytes.Buffer
+	if GetCompression(compression) == COMPRESSION_GZIP {
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.Close()
+	} else if err := CompressStream(&b, bytes.NewReader(data), compression); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b.Bytes()), nil
+}
+
+func DecompressAndVerify(src io.Reader, checksum, compression string) (io.Reader, error) {
+	return DecompressAndVerifyChecksum(src, checksum, DEFAULT_CHECKSUM, compression)
+}
+
+// DecompressAndVerifyChecksum is DecompressAndVerify for block checksummed
+// by checksumAlgorithm
+func DecompressAndVerifyChecksum(src io.Reader, checksum, checksumAlgorithm, compression string) (io.Reader, error) {
+	var block []byte
+	if GetCompression(compression) == COMPRESSION_GZIP {
+		r, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		if block, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	} else {
+		var b bytes.Buffer
+		if err := DecompressStream(&b, src, compression); err != nil {
+			return nil, err
+		}
+		block = b.Bytes()
+	}
+	if ComputeChecksum(block, checksumAlgorithm) != checksum {
+		return nil, fmt.Errorf("Checksum verification failed for block!")
+	}
+	return bytes.NewReader(block), nil
+}
+
+func CompressDir(sourceDir, targetFile, compression string) error {
+	tmpFile := targetFile + ".tmp"
+	args, err := tarArgs(compression, "-cf", tmpFile, "-C", sourceDir, ".")
+	if err != nil {
+		return err
+	}
+	if _, err := Execute("tar", args); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if _, err := Execute("mv", []string{"-f", tmpFile, targetFile}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TarDirStream writes the tarball of sourceDir compressed with compression to
+// dst, without a file in between
+func TarDirStream(dst io.Writer, sourceDir, compression string) error {
+	args, err := tarArgs(compression, "-cf", "-", "-C", sourceDir, ".")
+	if err != nil {
+		return err
+	}
+	return pipeProgram("tar", args, nil, dst)
+}
+
+// If sourceFile is inside targetDir, it would be deleted automatically
+func DecompressDir(sourceFile, targetDir, compression string) error {
+	tmpDir := targetDir + ".tmp"
+	if _, err := Execute("rm", []string{"-rf", tmpDir}); err != nil {
+		return err
+	}
+	if err := os.Mkdir(tmpDir, os.ModeDir|0700); err != nil {
+		return err
+	}
+	if err := ExtractDir(sourceFile, tmpDir, compression); err != nil {
+		return err
+	}
+	if _, err := Execute("rm", []string{"-rf", targetDir}); err != nil {
+		return err
+	}
+	if _, err := Execute("mv", []string{"-f", tmpDir, targetDir}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ExtractDir extracts sourceFile into the existing targetDir, unlike
+// DecompressDir the content of targetDir would be kept
+func ExtractDir(sourceFile, targetDir, compression string) error {
+	args, err := tarArgs(compression, "-xf", sourceFile, "-C", targetDir)
+	if err != nil {
+		return err
+	}
+	if _, err := Execute("tar", args); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CleanRelativePath returns the cleaned path if it's inside the directory it's
+// relative to, e.g. a path in the volume
+func CleanRelativePath(path string) (string, error) {
+	cleaned := filepath.Clean(path)
+	if filepath.IsAbs(cleaned) || cleaned == "." || cleaned == ".." ||
+		strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("Invalid path %v, must be relative and inside the volume", path)
+	}
+	return cleaned, nil
+}
+
+// tarMembers returns the names of paths in tarball created by CompressDir,
+// which are relative to "."
+func tarMembers(paths []string) []string {
+	members := []string{}
+	for _, path := range paths {
+		members = append(members, "./"+path)
+	}
+	return members
+}
+
+// CompressPaths creates a tarball of only paths in sourceDir, without the
+// content of directories, in the same layout as the one created by
+// CompressDir. Paths are relative to sourceDir, "." for sourceDir itself.
+func CompressPaths(sourceDir string, paths []string, targetFile, compression string) error {
+	tmpFile := targetFile + ".tmp"
+	args, err := tarArgs(compression, "-cf", tmpFile, "-C", sourceDir, "--no-recursion", "--null", "-T", "-")
+	if err != nil {
+		return err
+	}
+	members := []string{}
+	for _, path := range paths {
+		if path == "." {
+			members = append(members, ".")
+			continue
+		}
+		members = append(members, "./"+path)
+	}
+	if err := pipeProgram("tar", args, strings.NewReader(strings.Join(members, "\x00")), nil); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, targetFile)
+}
+
+// TarPaths returns the paths in the tarball created by CompressDir or
+// CompressPaths, relative to the directory it was created from
+func TarPaths(sourceFile, compression string) ([]string, error) {
+	f, err := os.Open(sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := DecompressStream(w, f, compression)
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+	paths, err := readTarPaths(r)
+	if err == nil {
+		// Padding after the end of archive is left unread
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	// Unblock the decompression if reading failed
+	r.CloseWithError(io.ErrClosedPipe)
+	if decompressErr := <-errCh; err == nil {
+		err = decompressErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read tarball %v: %v", sourceFile, err)
+	}
+	return paths, nil
+}
+
+func readTarPaths(r io.Reader) ([]string, error) {
+	paths := []string{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return paths, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path.Clean(header.Name))
+	}
+}
+
+// ExtractPathsStream extracts only paths, along with the content of
+// directories, from the tarball created by CompressDir read from src into
+// the existing targetDir. It fails if any of paths is not in the tarball.
+func ExtractPathsStream(src io.Reader, targetDir, compression string, paths []string) error {
+	args, err := tarArgs(compression, append([]string{"-xf", "-", "-C", targetDir}, tarMembers(paths)...)...)
+	if err != nil {
+		return err
+	}
+	return pipeProgram("tar", args, src, nil)
+}
+
+// CopyPaths copies paths in sourceDir, along with the content of
+// directories, to the same paths in the existing targetDir
+func CopyPaths(sourceDir string, paths []string, targetDir string) error {
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := pipeProgram("tar", append([]string{"-cf", "-", "-C", sourceDir}, tarMembers(paths)...), nil, w)
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+	err := pipeProgram("tar", []string{"-xf", "-", "-C", targetDir}, r, nil)
+	// Unblock the archiving if extracting failed
+	r.CloseWithError(io.ErrClosedPipe)
+	if archiveErr := <-errCh; archiveErr != nil {
+		return archiveErr
+	}
+	return err
+}
+
+// RecompressFile writes the content of sourceFile compressed with
+// sourceCompression to targetFile compressed with targetCompression
+func RecompressFile(sourceFile, sourceCompression, targetFile, targetCompression string) error {
+	src, err := os.Open(sourceFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(targetFile)
+	if err != nil {
+		return err
+	}
+
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := DecompressStream(w, src, sourceCompression)
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+	err = CompressStream(dst, r, targetCompression)
+	// Unblock the decompression if compression failed
+	r.CloseWithError(io.ErrClosedPipe)
+	if decompressErr := <-errCh; err == nil {
+		err = decompressErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(targetFile)
+		return err
+	}
+	return nil
+}
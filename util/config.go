@@ -32,31 +32,54 @@ func LoadConfig(fileName string, v interface{}) error {
 	return nil
 }
 
+// SaveConfig replaces fileName with v encoded in JSON, see WriteFileAtomic
 func SaveConfig(fileName string, v interface{}) error {
-	tmpFileName := fileName + ".tmp"
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// Same as the output of json.Encoder
+	return WriteFileAtomic(fileName, append(data, '\n'))
+}
 
-	f, err := os.Create(tmpFileName)
+// WriteFileAtomic replaces fileName by renaming a complete temporary file
+// over it, so a crash leaves either the old or the new content, never a
+// partial one or none
+func WriteFileAtomic(fileName string, data []byte) error {
+	tmpFileName := fileName + "." + GenerateName("tmp")
+
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmpFileName)
 
-	if err := json.NewEncoder(f).Encode(v); err != nil {
+	if _, err := f.Write(data); err != nil {
 		f.Close()
 		return err
 	}
-	f.Close()
-
-	if _, err = os.Stat(fileName); err == nil {
-		if err = os.Remove(fileName); err != nil {
-			return err
-		}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
 	}
 
 	if err := os.Rename(tmpFileName, fileName); err != nil {
 		return err
 	}
+	return syncDir(filepath.Dir(fileName))
+}
 
-	return nil
+// syncDir makes renames in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 func ConfigExists(fileName string) bool {
@@ -2,10 +2,13 @@ package fs
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os/exec"
 	"strings"
+
+	"github.com/rancher/convoy/util"
 )
 
 var (
@@ -15,25 +18,32 @@ var (
 )
 
 func FormatDevice(devicePath string, fsType string) error {
+	return FormatDeviceWithContext(context.Background(), devicePath, fsType)
+}
+
+// FormatDeviceWithContext would kill mkfs once ctx is done
+func FormatDeviceWithContext(ctx context.Context, devicePath string, fsType string) error {
 	switch fsType {
 	case "btrfs", "ext2", "ext3", "ext4", "minix", "xfs":
 	default:
 		return ErrUnrecognizedFilesystemType
 	}
-	cmd, err := sudoCmd("sh", "-c", fmt.Sprintf("set -e && yes | mkfs.%v %v", fsType, devicePath))
-	if err != nil {
-		return err
-	}
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("FormatDevice: %v: %s", string(output), err)
-	}
-	return nil
+	return util.Retry(ctx, "mkfs."+fsType, func() error {
+		cmd, err := sudoCmd(ctx, "sh", "-c", fmt.Sprintf("set -e && yes | mkfs.%v %v", fsType, devicePath))
+		if err != nil {
+			return err
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("FormatDevice: %v: %s", string(output), err)
+		}
+		return nil
+	})
 }
 
 // Detect determines the filesystem type for the given device.
 // An empty-string return indicates an unformatted device.
 func Detect(devicePath string) (string, error) {
-	cmd, err := sudoCmd("blkid", "-s", "TYPE", "-o", "value", devicePath)
+	cmd, err := sudoCmd(context.Background(), "blkid", "-s", "TYPE", "-o", "value", devicePath)
 	if err != nil {
 		return "", err
 	}
@@ -54,6 +64,11 @@ func Detect(devicePath string) (string, error) {
 // resize2fs only runs a resize when it is
 // required on the device; otherwise, it just exits with a code 0 and a message.
 func Resize(devicePath string) error {
+	return ResizeWithContext(context.Background(), devicePath)
+}
+
+// ResizeWithContext would kill resize2fs once ctx is done
+func ResizeWithContext(ctx context.Context, devicePath string) error {
 	fsType, err := Detect(devicePath)
 	if err != nil {
 		return err
@@ -65,25 +80,28 @@ func Resize(devicePath string) error {
 		return ErrResizeNotAvailable
 	}
 
-	cmd, err := sudoCmd("resize2fs", "-f", devicePath)
-	if err != nil {
-		return err
-	}
-	output, err := cmd.CombinedOutput()
-	output = bytes.Trim(output, "\r\n \t")
-	if err != nil {
-		return fmt.Errorf("Resize: %v: %v", devicePath, string(output))
-	}
-	return nil
+	return util.Retry(ctx, "resize2fs", func() error {
+		cmd, err := sudoCmd(ctx, "resize2fs", "-f", devicePath)
+		if err != nil {
+			return err
+		}
+		output, err := cmd.CombinedOutput()
+		output = bytes.Trim(output, "\r\n \t")
+		if err != nil {
+			return fmt.Errorf("Resize: %v: %v", devicePath, string(output))
+		}
+		return nil
+	})
 }
 
-func sudoCmd(name string, args ...string) (*exec.Cmd, error) {
+func sudoCmd(ctx context.Context, name string, args ...string) (*exec.Cmd, error) {
 	prefix, err := sudoCmdPrefix()
 	if err != nil {
 		return nil, err
 	}
 	args = append(prefix, append([]string{name}, args...)...)
-	cmd := exec.Command(args[0], args[1:]...)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	util.KillProcessGroupOnCancel(cmd)
 	return cmd, nil
 }
 
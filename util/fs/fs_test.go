@@ -2,6 +2,7 @@ package fs
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -138,7 +139,7 @@ func makeFakeDevice(path string) error {
 }
 
 func hasRoot() bool {
-	cmd, err := sudoCmd("true")
+	cmd, err := sudoCmd(context.Background(), "true")
 	if err != nil {
 		panic(err)
 	}
@@ -53,3 +53,15 @@ func (idx *Index) Get(key string) string {
 
 	return idx.data[key]
 }
+
+// Entries returns a copy of the index
+func (idx *Index) Entries() map[string]string {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	result := make(map[string]string, len(idx.data))
+	for key, value := range idx.data {
+		result[key] = value
+	}
+	return result
+}
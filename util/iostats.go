@@ -0,0 +1,153 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	DISKSTATS_FILE = "/proc/diskstats"
+	// Sectors of /proc/diskstats are always 512 bytes, regardless of the
+	// sector size of the device
+	DISKSTATS_SECTOR_SIZE = 512
+
+	FILE_STAT_FORMAT_DEVICE = "%d"
+	FILE_TYPE_BLOCK_DEVICE  = "block special file"
+)
+
+var diskStatsFile = DISKSTATS_FILE
+
+// DiskStats is the IO of a block device since it's created, as counted by
+// the kernel in /proc/diskstats. Times are in milliseconds.
+type DiskStats struct {
+	Major        int
+	Minor        int
+	Name         string
+	Reads        uint64
+	ReadSectors  uint64
+	ReadTime     uint64
+	Writes       uint64
+	WriteSectors uint64
+	WriteTime    uint64
+	InProgress   uint64
+	IOTime       uint64
+}
+
+func parseDiskStats(data string) ([]DiskStats, error) {
+	result := []DiskStats{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// Kernels before 4.18 have 14 fields, later ones add discard and
+		// flush stats after them
+		if len(fields) < 14 {
+			return nil, fmt.Errorf("Invalid line of %v: %v", diskStatsFile, line)
+		}
+		values := make([]uint64, 11)
+		for i := range values {
+			value, err := strconv.ParseUint(fields[i+3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid line of %v: %v", diskStatsFile, line)
+			}
+			values[i] = value
+		}
+		major, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid line of %v: %v", diskStatsFile, line)
+		}
+		minor, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid line of %v: %v", diskStatsFile, line)
+		}
+		result = append(result, DiskStats{
+			Major:        major,
+			Minor:        minor,
+			Name:         fields[2],
+			Reads:        values[0],
+			ReadSectors:  values[2],
+			ReadTime:     values[3],
+			Writes:       values[4],
+			WriteSectors: values[6],
+			WriteTime:    values[7],
+			InProgress:   values[8],
+			IOTime:       values[9],
+		})
+	}
+	return result, nil
+}
+
+// ListDiskStats returns the stats of all the block devices of the host
+func ListDiskStats() ([]DiskStats, error) {
+	data, err := ioutil.ReadFile(diskStatsFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseDiskStats(string(data))
+}
+
+// GetDiskStats returns the stats of block device major:minor
+func GetDiskStats(major, minor int) (*DiskStats, error) {
+	list, err := ListDiskStats()
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if list[i].Major == major && list[i].Minor == minor {
+			return &list[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Cannot find IO stats of device %v:%v in %v", major, minor, diskStatsFile)
+}
+
+// decodeDevice splits dev_t of Linux into major and minor
+func decodeDevice(dev uint64) (int, int) {
+	major := (dev>>8)&0xfff | (dev>>32)&^uint64(0xfff)
+	minor := dev&0xff | (dev>>12)&^uint64(0xff)
+	return int(major), int(minor)
+}
+
+/*
+GetBlockDeviceNumber returns the major and minor of path if it's a block
+device, or of the device of the filesystem path is in otherwise, e.g. a
+mount point. Filesystems which are not on a block device, e.g. NFS or tmpfs,
+have major 0. path is looked up in the mount namespace of the host.
+*/
+func GetBlockDeviceNumber(path string) (int, int, error) {
+	fileType, err := getFileType(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if fileType == FILE_TYPE_BLOCK_DEVICE {
+		output, err := getDevMajorMinor(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		fields := strings.Fields(output)
+		if len(fields) != 2 {
+			return 0, 0, fmt.Errorf("Unexpected major and minor of %v: %v", path, output)
+		}
+		major, err := strconv.ParseInt(fields[0], 16, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		minor, err := strconv.ParseInt(fields[1], 16, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		return int(major), int(minor), nil
+	}
+	output, err := getFileStat(path, FILE_STAT_FORMAT_DEVICE)
+	if err != nil {
+		return 0, 0, err
+	}
+	dev, err := strconv.ParseUint(output, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unexpected device of %v: %v", path, output)
+	}
+	major, minor := decodeDevice(dev)
+	return major, minor, nil
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestDiskStats(c *C) {
+	data := `   7       0 loop0 0 0 0 0 0 0 0 0 0 0 0
+ 253       3 dm-3 120 4 2048 36 300 10 4096 150 2 180 190 0 0 0 0
+`
+	list, err := parseDiskStats(data)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[1], DeepEquals, DiskStats{
+		Major:        253,
+		Minor:        3,
+		Name:         "dm-3",
+		Reads:        120,
+		ReadSectors:  2048,
+		ReadTime:     36,
+		Writes:       300,
+		WriteSectors: 4096,
+		WriteTime:    150,
+		InProgress:   2,
+		IOTime:       180,
+	})
+
+	_, err = parseDiskStats("8 0 sda 1 2 3")
+	c.Assert(err, ErrorMatches, "Invalid line of .*")
+
+	dir, err := ioutil.TempDir("", "diskstats")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "diskstats")
+	c.Assert(ioutil.WriteFile(file, []byte(data), 0644), IsNil)
+	diskStatsFile = file
+	defer func() {
+		diskStatsFile = DISKSTATS_FILE
+	}()
+	stats, err := GetDiskStats(253, 3)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Name, Equals, "dm-3")
+	_, err = GetDiskStats(8, 0)
+	c.Assert(err, ErrorMatches, "Cannot find IO stats of device 8:0 in .*")
+}
+
+func (s *TestSuite) TestBlockDeviceNumber(c *C) {
+	major, minor := decodeDevice(0xfd03)
+	c.Assert(major, Equals, 253)
+	c.Assert(minor, Equals, 3)
+	major, minor = decodeDevice(0x10010301)
+	c.Assert(major, Equals, 259)
+	c.Assert(minor, Equals, 65537)
+
+	st := syscall.Stat_t{}
+	c.Assert(syscall.Stat(testRoot, &st), IsNil)
+	expectedMajor, expectedMinor := decodeDevice(uint64(st.Dev))
+	major, minor, err := GetBlockDeviceNumber(testRoot)
+	c.Assert(err, IsNil)
+	c.Assert(major, Equals, expectedMajor)
+	c.Assert(minor, Equals, expectedMinor)
+}
@@ -0,0 +1,208 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_CMD_RETRIES       = 2
+	DEFAULT_CMD_RETRY_BACKOFF = time.Second
+	// Backoff doubles for every retry up to this
+	MAX_CMD_RETRY_BACKOFF = 30 * time.Second
+)
+
+// defaultRetryableErrors match the errors of commands which are likely to
+// succeed if tried again a bit later, e.g. device still being released
+var defaultRetryableErrors = []string{
+	"(?i)device or resource busy",
+	"(?i)target is busy",
+	"(?i)resource temporarily unavailable",
+	"(?i)try again",
+	"(?i)stale (nfs )?file handle",
+	"(?i)connection (timed out|refused|reset)",
+	"(?i)no route to host",
+}
+
+/*
+RetryPolicy retries the external commands failed by transient errors, with
+exponential backoff. Commands timed out are never retried, since they would
+likely hang again, e.g. against a dead NFS server.
+*/
+type RetryPolicy struct {
+	// Retries after the first attempt
+	Retries int
+	// Backoff before the first retry
+	Backoff time.Duration
+	// Retryable matches the errors worth retrying, including the output
+	Retryable []*regexp.Regexp
+}
+
+/*
+ExecError is the error of an external command, with its output. Timeout is
+true if the command was killed at the timeout or by cancelling the context.
+*/
+type ExecError struct {
+	Binary  string
+	Args    []string
+	Output  string
+	Err     error
+	Timeout bool
+}
+
+func (e *ExecError) Error() string {
+	if e.Timeout {
+		return fmt.Sprintf("Timeout executing: %v %v, output %v, error %v", e.Binary, e.Args, e.Output, e.Err)
+	}
+	return fmt.Sprintf("Failed to execute: %v %v, output %v, error %v", e.Binary, e.Args, e.Output, e.Err)
+}
+
+var (
+	retryPolicy = mustRetryPolicy(DEFAULT_CMD_RETRIES, DEFAULT_CMD_RETRY_BACKOFF, nil)
+	// cmdTimeouts overrides cmdTimeout for commands by name
+	cmdTimeouts = map[string]time.Duration{}
+)
+
+// NewRetryPolicy returns the policy retrying errors matching retryable, or
+// the default matchers if it's empty
+func NewRetryPolicy(retries int, backoff time.Duration, retryable []string) (*RetryPolicy, error) {
+	if retries < 0 {
+		return nil, fmt.Errorf("Invalid command retries %v, must not be negative", retries)
+	}
+	if backoff <= 0 {
+		return nil, fmt.Errorf("Invalid command retry backoff %v, must be positive", backoff)
+	}
+	if len(retryable) == 0 {
+		retryable = defaultRetryableErrors
+	}
+	policy := &RetryPolicy{
+		Retries: retries,
+		Backoff: backoff,
+	}
+	for _, pattern := range retryable {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retryable error pattern %v: %v", pattern, err)
+		}
+		policy.Retryable = append(policy.Retryable, re)
+	}
+	return policy, nil
+}
+
+func mustRetryPolicy(retries int, backoff time.Duration, retryable []string) *RetryPolicy {
+	policy, err := NewRetryPolicy(retries, backoff, retryable)
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
+
+// InitRetryPolicy sets the policy of ExecuteWithRetry(). Empty backoff is
+// the default one.
+func InitRetryPolicy(retries int, backoff string, retryable []string) error {
+	duration := DEFAULT_CMD_RETRY_BACKOFF
+	if backoff != "" {
+		var err error
+		if duration, err = time.ParseDuration(backoff); err != nil {
+			return fmt.Errorf("Invalid command retry backoff %v: %v", backoff, err)
+		}
+	}
+	policy, err := NewRetryPolicy(retries, duration, retryable)
+	if err != nil {
+		return err
+	}
+	retryPolicy = policy
+	return nil
+}
+
+// InitCommandTimeouts sets the timeouts of commands by "<command>=<duration>",
+// e.g. "mount=30s", which take precedence over the command timeout
+func InitCommandTimeouts(timeouts []string) error {
+	result := map[string]time.Duration{}
+	for _, timeout := range timeouts {
+		parts := strings.SplitN(timeout, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Invalid command timeout %v, must be <command>=<duration>", timeout)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("Invalid timeout %v of command %v", parts[1], parts[0])
+		}
+		result[parts[0]] = duration
+	}
+	cmdTimeouts = result
+	return nil
+}
+
+// commandName returns the name of command, which is the one executed by
+// nsenter if it's executed in another mount namespace
+func commandName(binary string, args []string) string {
+	if binary == NSENTER_BINARY && len(args) > 1 && strings.HasPrefix(args[0], "--mount=") {
+		return args[1]
+	}
+	return binary
+}
+
+func commandTimeout(binary string, args []string) time.Duration {
+	if timeout, exists := cmdTimeouts[commandName(binary, args)]; exists {
+		return timeout
+	}
+	return cmdTimeout
+}
+
+func (p *RetryPolicy) isRetryable(err error) bool {
+	if e, ok := err.(*ExecError); ok && e.Timeout {
+		return false
+	}
+	for _, re := range p.Retryable {
+		if re.MatchString(err.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Do calls f until it succeeds, fails by an error not retryable, or the
+// retries run out. It stops waiting for the next retry once ctx is done.
+func (p *RetryPolicy) Do(ctx context.Context, description string, f func() error) error {
+	backoff := p.Backoff
+	for retry := 0; ; retry++ {
+		err := f()
+		if err == nil || retry >= p.Retries || !p.isRetryable(err) {
+			return err
+		}
+		log.Warnf("Retrying %v in %v, retry %v of %v, since it failed: %v", description, backoff, retry+1, p.Retries, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > MAX_CMD_RETRY_BACKOFF {
+			backoff = MAX_CMD_RETRY_BACKOFF
+		}
+	}
+}
+
+// Retry calls f by the policy set by InitRetryPolicy()
+func Retry(ctx context.Context, description string, f func() error) error {
+	return retryPolicy.Do(ctx, description, f)
+}
+
+// ExecuteWithRetry is Execute() retrying transient failures, for commands
+// which are safe to be executed again, like mount or mkfs
+func ExecuteWithRetry(binary string, args []string) (string, error) {
+	return ExecuteWithRetryContext(context.Background(), binary, args)
+}
+
+func ExecuteWithRetryContext(ctx context.Context, binary string, args []string) (string, error) {
+	var output string
+	err := Retry(ctx, commandName(binary, args), func() error {
+		var err error
+		output, err = ExecuteWithContext(ctx, binary, args)
+		return err
+	})
+	return output, err
+}
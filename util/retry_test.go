@@ -0,0 +1,107 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestRetryPolicy(c *C) {
+	policy, err := NewRetryPolicy(2, time.Millisecond, nil)
+	c.Assert(err, IsNil)
+
+	calls := 0
+	err = policy.Do(context.Background(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("mount: /dev/xvdf: Device or resource busy")
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(calls, Equals, 3)
+
+	// Retries run out
+	calls = 0
+	err = policy.Do(context.Background(), "test", func() error {
+		calls++
+		return fmt.Errorf("umount: /mnt: target is busy")
+	})
+	c.Assert(err, ErrorMatches, "umount: /mnt: target is busy")
+	c.Assert(calls, Equals, 3)
+
+	// Errors not matched are not retried
+	calls = 0
+	err = policy.Do(context.Background(), "test", func() error {
+		calls++
+		return fmt.Errorf("mount: wrong fs type")
+	})
+	c.Assert(err, NotNil)
+	c.Assert(calls, Equals, 1)
+
+	// Neither are timed out commands
+	calls = 0
+	err = policy.Do(context.Background(), "test", func() error {
+		calls++
+		return &ExecError{Binary: "mount", Output: "device or resource busy", Err: context.DeadlineExceeded, Timeout: true}
+	})
+	c.Assert(err, ErrorMatches, "Timeout executing: mount .*")
+	c.Assert(calls, Equals, 1)
+
+	// Waiting for retry stops once context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	err = policy.Do(ctx, "test", func() error {
+		calls++
+		return fmt.Errorf("resource temporarily unavailable")
+	})
+	c.Assert(err, NotNil)
+	c.Assert(calls, Equals, 1)
+
+	policy, err = NewRetryPolicy(1, time.Millisecond, []string{"^custom"})
+	c.Assert(err, IsNil)
+	calls = 0
+	err = policy.Do(context.Background(), "test", func() error {
+		calls++
+		return fmt.Errorf("custom error")
+	})
+	c.Assert(err, NotNil)
+	c.Assert(calls, Equals, 2)
+
+	_, err = NewRetryPolicy(-1, time.Second, nil)
+	c.Assert(err, NotNil)
+	_, err = NewRetryPolicy(1, 0, nil)
+	c.Assert(err, NotNil)
+	_, err = NewRetryPolicy(1, time.Second, []string{"("})
+	c.Assert(err, NotNil)
+	c.Assert(InitRetryPolicy(1, "invalid", nil), NotNil)
+}
+
+func (s *TestSuite) TestCommandTimeouts(c *C) {
+	defer InitCommandTimeouts(nil)
+
+	c.Assert(InitCommandTimeouts([]string{"mount=30s", "mkfs=10m"}), IsNil)
+	c.Assert(commandTimeout("mount", []string{"/dev/xvdf", "/mnt"}), Equals, 30*time.Second)
+	c.Assert(commandTimeout(NSENTER_BINARY, []string{"--mount=/host/proc/1/ns/mnt", "mkfs", "-t", "ext4"}), Equals, 10*time.Minute)
+	c.Assert(commandTimeout("umount", []string{"/mnt"}), Equals, cmdTimeout)
+
+	c.Assert(InitCommandTimeouts([]string{"mount"}), ErrorMatches, "Invalid command timeout mount, .*")
+	c.Assert(InitCommandTimeouts([]string{"mount=soon"}), ErrorMatches, "Invalid timeout soon of command mount")
+	c.Assert(InitCommandTimeouts([]string{"=1s"}), NotNil)
+}
+
+func (s *TestSuite) TestExecuteError(c *C) {
+	_, err := ExecuteWithRetry("false", []string{})
+	c.Assert(err, FitsTypeOf, &ExecError{})
+	c.Assert(err, ErrorMatches, "Failed to execute: false .*")
+	c.Assert(err.(*ExecError).Timeout, Equals, false)
+
+	c.Assert(InitCommandTimeouts([]string{"sleep=10ms"}), IsNil)
+	defer InitCommandTimeouts(nil)
+	_, err = ExecuteWithRetry("sleep", []string{"1"})
+	c.Assert(err, ErrorMatches, "Timeout executing: sleep .*")
+	c.Assert(err.(*ExecError).Timeout, Equals, true)
+}
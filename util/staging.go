@@ -0,0 +1,121 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Everything staged by the daemon is named with the prefix, so the
+	// leftovers can be told apart from the other files in the directory
+	STAGING_PREFIX = "convoy-"
+)
+
+var (
+	stagingMutex sync.RWMutex
+	stagingDir   string
+)
+
+// SetStagingDir sets the directory where archives are staged for snapshots,
+// backups and restores, which is created if it doesn't exist. Empty for the
+// temporary directory of the system.
+func SetStagingDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("Cannot create staging directory %v: %v", dir, err)
+		}
+		if err := CheckPathWritable(dir); err != nil {
+			return fmt.Errorf("Staging directory %v is not writable: %v", dir, err)
+		}
+	}
+	stagingMutex.Lock()
+	stagingDir = dir
+	stagingMutex.Unlock()
+	return nil
+}
+
+func GetStagingDir() string {
+	stagingMutex.RLock()
+	defer stagingMutex.RUnlock()
+	if stagingDir == "" {
+		return os.TempDir()
+	}
+	return stagingDir
+}
+
+// StagingPath returns the path of name in the staging directory, for
+// callers which create the file themselves
+func StagingPath(name string) string {
+	return filepath.Join(GetStagingDir(), STAGING_PREFIX+name)
+}
+
+// CreateStagingFile creates a new temporary file in the staging directory,
+// caller should remove it when done
+func CreateStagingFile(prefix string) (*os.File, error) {
+	return ioutil.TempFile(GetStagingDir(), STAGING_PREFIX+prefix)
+}
+
+// CreateStagingDir creates a new temporary directory in the staging
+// directory, caller should remove it when done
+func CreateStagingDir(prefix string) (string, error) {
+	return ioutil.TempDir(GetStagingDir(), STAGING_PREFIX+prefix)
+}
+
+// GetFreeSpace returns the bytes available to unprivileged users in the
+// filesystem of path
+func GetFreeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// CheckFreeSpace fails if the filesystem of path doesn't have size bytes
+// available for what is about to be written there, rather than running out
+// of space in the middle of it
+func CheckFreeSpace(path string, size int64, what string) error {
+	free, err := GetFreeSpace(path)
+	if err != nil {
+		return err
+	}
+	if size > free {
+		return fmt.Errorf("Not enough space in %v for %v, %v bytes needed but %v bytes available",
+			path, what, size, free)
+	}
+	return nil
+}
+
+// CheckStagingSpace fails if the staging directory doesn't have size bytes
+// available for what
+func CheckStagingSpace(size int64, what string) error {
+	return CheckFreeSpace(GetStagingDir(), size, what)
+}
+
+// CleanupStaging removes everything staged in the staging directory, which
+// is left by crashed daemons. It must only be called before anything is
+// staged, and only for a staging directory not shared by other daemons.
+func CleanupStaging() ([]string, error) {
+	dir := GetStagingDir()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), STAGING_PREFIX) {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
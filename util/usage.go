@@ -0,0 +1,79 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Volumes are listed frequently, e.g. by Docker, while the usage
+	// doesn't need to be accurate to the second
+	DEFAULT_USAGE_CACHE_TTL = 30 * time.Second
+)
+
+type usageEntry struct {
+	value   int64
+	expires time.Time
+}
+
+// UsageCache keeps the results of expensive usage queries, e.g. du of a
+// large directory, for a while
+type UsageCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]usageEntry
+}
+
+func NewUsageCache(ttl time.Duration) *UsageCache {
+	return &UsageCache{
+		ttl:     ttl,
+		entries: map[string]usageEntry{},
+	}
+}
+
+// Get returns the cached value of key, or the one returned by get if it's
+// not cached or expired. Errors are not cached.
+func (c *UsageCache) Get(key string, get func() (int64, error)) (int64, error) {
+	c.mutex.Lock()
+	entry, exists := c.entries[key]
+	c.mutex.Unlock()
+	if exists && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	value, err := get()
+	if err != nil {
+		return 0, err
+	}
+	c.mutex.Lock()
+	c.entries[key] = usageEntry{
+		value:   value,
+		expires: time.Now().Add(c.ttl),
+	}
+	c.mutex.Unlock()
+	return value, nil
+}
+
+// Invalidate drops the cached value of key, e.g. when the volume is deleted
+func (c *UsageCache) Invalidate(key string) {
+	c.mutex.Lock()
+	delete(c.entries, key)
+	c.mutex.Unlock()
+}
+
+// GetDirUsage returns the bytes of disk space used by files in path,
+// without crossing into other filesystems mounted in it
+func GetDirUsage(path string) (int64, error) {
+	output, err := Execute("du", []string{"-s", "-x", "-B1", path})
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Unexpected output of du for %v: %v", path, output)
+	}
+	return strconv.ParseInt(fields[0], 10, 64)
+}
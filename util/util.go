@@ -2,20 +2,19 @@ package util
 
 import (
 	"bytes"
-	"compress/gzip"
-	"crypto/sha512"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -33,6 +32,8 @@ var (
 	log = logrus.WithFields(logrus.Fields{"pkg": "util"})
 
 	cmdTimeout time.Duration = time.Minute // one minute by default
+	// Wait for the output of killed command for at most this long
+	killWaitDelay = 5 * time.Second
 )
 
 func InitTimeout(timeout string) {
@@ -72,9 +73,7 @@ func MkdirIfNotExists(path string) error {
 }
 
 func GetChecksum(data []byte) string {
-	checksumBytes := sha512.Sum512(data)
-	checksum := hex.EncodeToString(checksumBytes[:])[:PRESERVED_CHECKSUM_LENGTH]
-	return checksum
+	return ComputeChecksum(data, DEFAULT_CHECKSUM)
 }
 
 func LockFile(fileName string) (*os.File, error) {
@@ -112,6 +111,37 @@ func SliceToMap(slices []string) map[string]string {
 	return result
 }
 
+// ParseTags parses tags in "key1=value1,key2=value2" format, so neither keys
+// nor values can contain ",". Value may contain "=".
+func ParseTags(tags string) (map[string]string, error) {
+	result := map[string]string{}
+	if tags == "" {
+		return result, nil
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		pair := strings.SplitN(tag, "=", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("Invalid tag %v, must be in key=value format", tag)
+		}
+		result[pair[0]] = pair[1]
+	}
+	return result, nil
+}
+
+// FormatTags formats tags for ParseTags(), sorted by keys
+func FormatTags(tags map[string]string) string {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
 func GetFileChecksum(filePath string) (string, error) {
 	output, err := Execute("sha512sum", []string{"-b", filePath})
 	if err != nil {
@@ -134,41 +164,6 @@ func DecompressFile(filePath string) error {
 	return nil
 }
 
-func CompressDir(sourceDir, targetFile string) error {
-	tmpFile := targetFile + ".tmp"
-	if _, err := Execute("tar", []string{"cf", tmpFile, "-C", sourceDir, "."}); err != nil {
-		return err
-	}
-	if _, err := Execute("gzip", []string{tmpFile}); err != nil {
-		return err
-	}
-	if _, err := Execute("mv", []string{"-f", tmpFile + ".gz", targetFile}); err != nil {
-		return err
-	}
-	return nil
-}
-
-// If sourceFile is inside targetDir, it would be deleted automatically
-func DecompressDir(sourceFile, targetDir string) error {
-	tmpDir := targetDir + ".tmp"
-	if _, err := Execute("rm", []string{"-rf", tmpDir}); err != nil {
-		return err
-	}
-	if err := os.Mkdir(tmpDir, os.ModeDir|0700); err != nil {
-		return err
-	}
-	if _, err := Execute("tar", []string{"xf", sourceFile, "-C", tmpDir}); err != nil {
-		return err
-	}
-	if _, err := Execute("rm", []string{"-rf", targetDir}); err != nil {
-		return err
-	}
-	if _, err := Execute("mv", []string{"-f", tmpDir, targetDir}); err != nil {
-		return err
-	}
-	return nil
-}
-
 func Copy(src, dst string) error {
 	if _, err := Execute("cp", []string{src, dst}); err != nil {
 		return err
@@ -302,61 +297,66 @@ func CheckBinaryVersion(binaryName, minVersion string, args []string) error {
 }
 
 func Execute(binary string, args []string) (string, error) {
-	var output []byte
-	var err error
-	cmd := exec.Command(binary, args...)
-	done := make(chan struct{})
-
-	go func() {
-		output, err = cmd.CombinedOutput()
-		done <- struct{}{}
-	}()
-
-	select {
-	case <-done:
-	case <-time.After(cmdTimeout):
-		if cmd.Process != nil {
-			if err := cmd.Process.Kill(); err != nil {
-				log.Warnf("Problem killing process pid=%v: %s", cmd.Process.Pid, err)
-			}
-		}
-		return "", fmt.Errorf("Timeout executing: %v %v, output %v, error %v", binary, args, string(output), err)
-	}
+	return ExecuteWithContext(context.Background(), binary, args)
+}
+
+/*
+ExecuteWithContext would kill the command once ctx is done, or the command
+timeout is reached, whichever comes first. The timeout of command set by
+InitCommandTimeouts() is used if there is one. Errors are *ExecError.
+
+The command runs in its own process group, which is killed as a whole, so
+the processes started by it, e.g. the helpers of mount, are killed as well.
+*/
+func ExecuteWithContext(ctx context.Context, binary string, args []string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout(binary, args))
+	defer cancel()
 
+	cmd := exec.CommandContext(ctx, binary, args...)
+	KillProcessGroupOnCancel(cmd)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return "", &ExecError{Binary: binary, Args: args, Output: string(output), Err: ctx.Err(), Timeout: true}
+	}
 	if err != nil {
-		return "", fmt.Errorf("Failed to execute: %v %v, output %v, error %v", binary, args, string(output), err)
+		return "", &ExecError{Binary: binary, Args: args, Output: string(output), Err: err}
 	}
 	return string(output), nil
 }
 
-func Now() string {
-	return time.Now().Format(time.RubyDate)
-}
-
-func CompressData(data []byte) (io.ReadSeeker, error) {
-	var b bytes.Buffer
-	w := gzip.NewWriter(&b)
-	if _, err := w.Write(data); err != nil {
-		w.Close()
-		return nil, err
+/*
+KillProcessGroupOnCancel makes cmd started by exec.CommandContext() run in its
+own process group, and kills the whole group once the context is done. Wait()
+returns shortly after that even if the descendants still hold the output.
+*/
+func KillProcessGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
-	w.Close()
-	return bytes.NewReader(b.Bytes()), nil
+	cmd.WaitDelay = killWaitDelay
 }
 
-func DecompressAndVerify(src io.Reader, checksum string) (io.Reader, error) {
-	r, err := gzip.NewReader(src)
-	if err != nil {
-		return nil, err
-	}
-	block, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
+/*
+ContextWithTimeout parses timeout in the format of time.ParseDuration, and
+returns a context of parent would be cancelled after that. Empty timeout
+means no timeout other than the one of parent and the command timeout.
+*/
+func ContextWithTimeout(parent context.Context, timeout string) (context.Context, context.CancelFunc, error) {
+	if timeout == "" {
+		ctx, cancel := context.WithCancel(parent)
+		return ctx, cancel, nil
 	}
-	if GetChecksum(block) != checksum {
-		return nil, fmt.Errorf("Checksum verification failed for block!")
+	duration, err := time.ParseDuration(timeout)
+	if err != nil || duration <= 0 {
+		return nil, nil, fmt.Errorf("Invalid timeout value %v", timeout)
 	}
-	return bytes.NewReader(block), nil
+	ctx, cancel := context.WithTimeout(parent, duration)
+	return ctx, cancel, nil
+}
+
+func Now() string {
+	return time.Now().Format(time.RubyDate)
 }
 
 func GetName(v interface{}, key string, required bool, err error) (string, error) {
@@ -461,3 +461,14 @@ func GenerateName(prefix string) string {
 func NewUUID() string {
 	return uuid.NewV4().String()
 }
+
+// CheckPathWritable makes sure a file can be created in directory path, e.g.
+// the NFS server behind it is reachable
+func CheckPathWritable(path string) error {
+	f, err := ioutil.TempFile(path, ".convoy-health-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -1,13 +1,17 @@
 package util
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -131,6 +135,33 @@ func (s *TestSuite) TestChecksum(c *C) {
 		"cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e")
 }
 
+func (s *TestSuite) TestChecksumAlgorithms(c *C) {
+	for algorithm, checksum := range map[string]string{
+		"":              "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce",
+		CHECKSUM_SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		CHECKSUM_BLAKE3: "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+		CHECKSUM_XXH3:   "99aa06d3014798d86001c324468d497f",
+	} {
+		c.Assert(ValidateChecksumAlgorithm(algorithm), IsNil)
+		c.Assert(ComputeChecksum([]byte{}, algorithm), Equals, checksum, Commentf(algorithm))
+	}
+	c.Assert(ValidateChecksumAlgorithm("md5"), ErrorMatches, "Invalid checksum algorithm md5.*")
+
+	data := []byte("Some random string")
+	checksum := ComputeChecksum(data, CHECKSUM_BLAKE3)
+	compressed, err := CompressData(data, COMPRESSION_ZSTD)
+	c.Assert(err, IsNil)
+	decompressed, err := DecompressAndVerifyChecksum(compressed, checksum, CHECKSUM_BLAKE3, COMPRESSION_ZSTD)
+	c.Assert(err, IsNil)
+	result, err := ioutil.ReadAll(decompressed)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, data)
+	compressed, err = CompressData(data, COMPRESSION_ZSTD)
+	c.Assert(err, IsNil)
+	_, err = DecompressAndVerifyChecksum(compressed, checksum, CHECKSUM_XXH3, COMPRESSION_ZSTD)
+	c.Assert(err, ErrorMatches, "Checksum verification failed for block!")
+}
+
 func (s *TestSuite) TestLoopDevice(c *C) {
 	var err error
 
@@ -258,16 +289,26 @@ func (s *TestSuite) TestCompress(c *C) {
 	data := []byte("Some random string")
 	checksum := GetChecksum(data)
 
-	compressed, err := CompressData(data)
-	c.Assert(err, IsNil)
+	for _, compression := range []string{"", COMPRESSION_GZIP, COMPRESSION_ZSTD, COMPRESSION_LZ4, COMPRESSION_NONE} {
+		compressed, err := CompressData(data, compression)
+		c.Assert(err, IsNil)
 
-	decompressed, err := DecompressAndVerify(compressed, checksum)
-	c.Assert(err, IsNil)
+		decompressed, err := DecompressAndVerify(compressed, checksum, compression)
+		c.Assert(err, IsNil)
 
-	result, err := ioutil.ReadAll(decompressed)
+		result, err := ioutil.ReadAll(decompressed)
+		c.Assert(err, IsNil)
+
+		c.Assert(result, DeepEquals, data)
+	}
+
+	compressed, err := CompressData(data, COMPRESSION_ZSTD)
 	c.Assert(err, IsNil)
+	_, err = DecompressAndVerify(compressed, checksum, COMPRESSION_GZIP)
+	c.Assert(err, NotNil)
 
-	c.Assert(result, DeepEquals, data)
+	_, err = CompressData(data, "bzip2")
+	c.Assert(err, ErrorMatches, "Invalid compression bzip2.*")
 }
 
 func (s *TestSuite) TestCompressDir(c *C) {
@@ -300,11 +341,19 @@ func (s *TestSuite) TestCompressDir(c *C) {
 	c.Assert(err, IsNil)
 
 	tarFile := filepath.Join(tmpdir, "test.tar.gz")
-	err = CompressDir(path, tarFile)
+	err = CompressDir(path, tarFile, COMPRESSION_GZIP)
 	c.Assert(err, IsNil)
+
+	// Recompressed archive should have the same content
+	zstdFile := filepath.Join(tmpdir, "test.tar.zst")
+	err = RecompressFile(tarFile, COMPRESSION_GZIP, zstdFile, COMPRESSION_ZSTD)
+	c.Assert(err, IsNil)
+	err = RecompressFile(tarFile, COMPRESSION_LZ4, filepath.Join(tmpdir, "test.tar.lz4"), COMPRESSION_NONE)
+	c.Assert(err, NotNil)
+
 	err = os.RemoveAll(path)
 	c.Assert(err, IsNil)
-	err = DecompressDir(tarFile, path)
+	err = DecompressDir(zstdFile, path, COMPRESSION_ZSTD)
 	c.Assert(err, IsNil)
 
 	file1, err = os.Open(filename1)
@@ -373,3 +422,127 @@ func (s *TestSuite) TestExtractNames(c *C) {
 	result, err = ExtractNames(files, "prefix_", ".suffix")
 	c.Assert(err, ErrorMatches, "Invalid name.*")
 }
+
+func (s *TestSuite) TestUsageCache(c *C) {
+	cache := NewUsageCache(time.Hour)
+	calls := 0
+	get := func() (int64, error) {
+		calls++
+		return int64(calls * 100), nil
+	}
+
+	value, err := cache.Get("vol1", get)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(100))
+	value, err = cache.Get("vol1", get)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(100))
+	c.Assert(calls, Equals, 1)
+
+	cache.Invalidate("vol1")
+	value, err = cache.Get("vol1", get)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(200))
+
+	_, err = cache.Get("vol2", func() (int64, error) {
+		return 0, fmt.Errorf("failed")
+	})
+	c.Assert(err, ErrorMatches, "failed")
+	value, err = cache.Get("vol2", get)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(300))
+
+	expired := NewUsageCache(0)
+	expired.Get("vol1", get)
+	value, err = expired.Get("vol1", get)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, int64(500))
+}
+
+func (s *TestSuite) TestGetDirUsage(c *C) {
+	dir, err := ioutil.TempDir("", "convoy-usage")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	empty, err := GetDirUsage(dir)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "data"), make([]byte, 1<<20), 0644), IsNil)
+	used, err := GetDirUsage(dir)
+	c.Assert(err, IsNil)
+	c.Assert(used-empty >= 1<<20, Equals, true)
+
+	_, err = GetDirUsage(filepath.Join(dir, "nonexistent"))
+	c.Assert(err, NotNil)
+}
+
+func (s *TestSuite) TestStaging(c *C) {
+	root, err := ioutil.TempDir("", "convoy-staging-test")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(root)
+	defer SetStagingDir("")
+
+	c.Assert(GetStagingDir(), Equals, os.TempDir())
+	dir := filepath.Join(root, "staging")
+	c.Assert(SetStagingDir(dir), IsNil)
+	c.Assert(GetStagingDir(), Equals, dir)
+	c.Assert(StagingPath("vol1_snap1.tar.gz"), Equals, filepath.Join(dir, "convoy-vol1_snap1.tar.gz"))
+
+	f, err := CreateStagingFile("sftp-read")
+	c.Assert(err, IsNil)
+	f.Close()
+	c.Assert(filepath.Dir(f.Name()), Equals, dir)
+	tmpDir, err := CreateStagingDir("restore-")
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, "backup.bak"), []byte("backup"), 0600), IsNil)
+	other := filepath.Join(dir, "other")
+	c.Assert(ioutil.WriteFile(other, []byte("other"), 0600), IsNil)
+
+	// Only the artifacts staged are removed
+	removed, err := CleanupStaging()
+	c.Assert(err, IsNil)
+	sort.Strings(removed)
+	expected := []string{f.Name(), tmpDir}
+	sort.Strings(expected)
+	c.Assert(removed, DeepEquals, expected)
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 1)
+	c.Assert(infos[0].Name(), Equals, "other")
+
+	free, err := GetFreeSpace(dir)
+	c.Assert(err, IsNil)
+	c.Assert(free > 0, Equals, true)
+	c.Assert(CheckStagingSpace(1, "backup"), IsNil)
+	err = CheckStagingSpace(free+(1<<40), "backup of snapshot snap1")
+	c.Assert(err, ErrorMatches, "Not enough space in "+dir+" for backup of snapshot snap1, .* bytes needed but .* bytes available")
+
+	c.Assert(SetStagingDir(filepath.Join(other, "staging")), ErrorMatches, "Cannot create staging directory .*")
+}
+
+func (s *TestSuite) TestExecuteKillsProcessGroup(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The background sleep keeps the output open if only sh is killed
+	start := time.Now()
+	_, err := ExecuteWithContext(ctx, "sh", []string{"-c", "sleep 10 & wait"})
+	c.Assert(err, ErrorMatches, "Timeout executing: sh .*")
+	c.Assert(time.Since(start) < killWaitDelay, Equals, true)
+}
+
+func (s *TestSuite) TestParseTags(c *C) {
+	tags, err := ParseTags("CostCenter=storage,Query=a=b")
+	c.Assert(err, IsNil)
+	c.Assert(tags, DeepEquals, map[string]string{"CostCenter": "storage", "Query": "a=b"})
+	c.Assert(FormatTags(tags), Equals, "CostCenter=storage,Query=a=b")
+
+	tags, err = ParseTags("")
+	c.Assert(err, IsNil)
+	c.Assert(tags, HasLen, 0)
+	c.Assert(FormatTags(nil), Equals, "")
+
+	_, err = ParseTags("CostCenter")
+	c.Assert(err, ErrorMatches, "Invalid tag CostCenter, .*")
+	_, err = ParseTags("=storage")
+	c.Assert(err, NotNil)
+}
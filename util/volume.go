@@ -1,18 +1,26 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 const (
-	MOUNT_BINARY   = "mount"
-	UMOUNT_BINARY  = "umount"
-	NSENTER_BINARY = "nsenter"
+	MOUNT_BINARY    = "mount"
+	UMOUNT_BINARY   = "umount"
+	NSENTER_BINARY  = "nsenter"
+	FSTRIM_BINARY   = "fstrim"
+	FUSER_BINARY    = "fuser"
+	READLINK_BINARY = "readlink"
+
+	MOUNTS_FILE = "/proc/mounts"
 
 	IMAGE_FILE_NAME = "disk.img"
 	BLOCK_DEV_NAME  = "disk.dev"
@@ -28,6 +36,8 @@ const (
 
 var (
 	mountNamespaceFD = ""
+
+	mountBinary = MOUNT_BINARY
 )
 
 /* Caller must implement VolumeHelper interface, and must have fields "Name" and "MountPoint" */
@@ -128,6 +138,15 @@ func isMounted(mountPoint string) bool {
 }
 
 func VolumeMount(v interface{}, mountPoint string, remount bool) (string, error) {
+	return VolumeMountWithContext(context.Background(), v, mountPoint, remount)
+}
+
+/*
+VolumeMountWithContext would abort the mount once ctx is done. The mount point
+directory created for the mount, and the mount itself if it completed
+after all, would be cleaned up in that case.
+*/
+func VolumeMountWithContext(ctx context.Context, v interface{}, mountPoint string, remount bool) (string, error) {
 	vol, err := getVolumeOps(v)
 	if err != nil {
 		return "", err
@@ -150,7 +169,7 @@ func VolumeMount(v interface{}, mountPoint string, remount bool) (string, error)
 	}
 	if remount && isMounted(mountPoint) {
 		log.Debugf("Umount existing mountpoint %v", mountPoint)
-		if err := callUmount([]string{mountPoint}); err != nil {
+		if err := callUmountWithContext(ctx, []string{mountPoint}); err != nil {
 			return "", err
 		}
 	}
@@ -161,8 +180,11 @@ func VolumeMount(v interface{}, mountPoint string, remount bool) (string, error)
 	}
 	if !isMounted(mountPoint) {
 		log.Debugf("Volume %v is being mounted it to %v, with option %v", getVolumeName(vol), mountPoint, opts)
-		_, err = callMount(opts, []string{dev, mountPoint})
+		_, err = callMountWithContext(ctx, opts, []string{dev, mountPoint})
 		if err != nil {
+			if ctx.Err() != nil {
+				cleanupAbortedMount(mountPoint, createMountpoint)
+			}
 			return "", err
 		}
 	}
@@ -171,6 +193,11 @@ func VolumeMount(v interface{}, mountPoint string, remount bool) (string, error)
 }
 
 func VolumeUmount(v interface{}) error {
+	return VolumeUmountWithContext(context.Background(), v)
+}
+
+// VolumeUmountWithContext would abort the umount once ctx is done
+func VolumeUmountWithContext(ctx context.Context, v interface{}) error {
 	vol, err := getVolumeOps(v)
 	if err != nil {
 		return err
@@ -180,7 +207,7 @@ func VolumeUmount(v interface{}) error {
 		log.Debugf("Umount a umounted volume %v", getVolumeName(vol))
 		return nil
 	}
-	if err := callUmount([]string{mountPoint}); err != nil {
+	if err := callUmountWithContext(ctx, []string{mountPoint}); err != nil {
 		return err
 	}
 	if mountPoint == vol.GenerateDefaultMountPoint() {
@@ -192,6 +219,501 @@ func VolumeUmount(v interface{}) error {
 	return nil
 }
 
+/*
+VolumeForceUmount umounts the volume lazily, so it returns right away even if
+the filesystem is busy or its storage is unreachable, and the filesystem is
+detached once nothing uses it. The processes using the filesystem are killed
+first if kill is true. The mount point is forgotten either way.
+*/
+func VolumeForceUmount(ctx context.Context, v interface{}, kill bool) error {
+	vol, err := getVolumeOps(v)
+	if err != nil {
+		return err
+	}
+	mountPoint := getVolumeMountPoint(vol)
+	if mountPoint == "" {
+		log.Debugf("Force umount a umounted volume %v", getVolumeName(vol))
+		return nil
+	}
+	if err := ForceUmount(ctx, mountPoint, kill); err != nil {
+		return err
+	}
+	if mountPoint == vol.GenerateDefaultMountPoint() {
+		if err := os.Remove(mountPoint); err != nil {
+			log.Warnf("Cannot cleanup mount point directory %v due to %v", mountPoint, err)
+		}
+	}
+	setVolumeMountPoint(vol, "")
+	return nil
+}
+
+// ForceUmount lazily umounts the filesystem mounted at mountPoint, in the
+// mount namespace of volumes, see VolumeForceUmount()
+func ForceUmount(ctx context.Context, mountPoint string, kill bool) error {
+	if !isMounted(mountPoint) {
+		log.Debugf("Nothing is mounted at %v to force umount", mountPoint)
+		return nil
+	}
+	if kill {
+		if err := killMountUsers(ctx, mountPoint); err != nil {
+			return err
+		}
+	}
+	return callUmountWithContext(ctx, []string{"-l", mountPoint})
+}
+
+// killMountUsers kills the processes using the filesystem mounted at
+// mountPoint. -M makes sure fuser never kills the users of the filesystem
+// containing mountPoint instead, if it's no longer a mount point.
+func killMountUsers(ctx context.Context, mountPoint string) error {
+	cmdName, cmdArgs := updateMountNamespace(FUSER_BINARY, []string{"-k", "-M", "-m", mountPoint})
+	output, err := ExecuteWithContext(ctx, cmdName, cmdArgs)
+	if err != nil {
+		// fuser exits with 1 if no process is using it
+		if execErr, ok := err.(*ExecError); ok && !execErr.Timeout {
+			if exitErr, ok := execErr.Err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+				return nil
+			}
+		}
+		return err
+	}
+	log.Infof("Killed processes using %v: %v", mountPoint, strings.TrimSpace(output))
+	return nil
+}
+
+/*
+VolumeTrim discards the blocks unused by the filesystem of mounted volume, so
+thin provisioned storage can reclaim them. It returns the output of fstrim,
+e.g. "/mnt: 1 GiB (1073741824 bytes) trimmed".
+*/
+func VolumeTrim(ctx context.Context, v interface{}) (string, error) {
+	vol, err := getVolumeOps(v)
+	if err != nil {
+		return "", err
+	}
+	mountPoint := getVolumeMountPoint(vol)
+	if mountPoint == "" {
+		return "", fmt.Errorf("Volume %v is not mounted", getVolumeName(vol))
+	}
+	cmdName, cmdArgs := updateMountNamespace(FSTRIM_BINARY, []string{"-v", mountPoint})
+	output, err := ExecuteWithContext(ctx, cmdName, cmdArgs)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+type mountEntry struct {
+	Device     string
+	MountPoint string
+}
+
+// unescapeMountField reverts the octal escaping of space, tab, newline and
+// backslash used by the kernel in /proc/mounts
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	result := ""
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				result += string(byte(c))
+				i += 3
+				continue
+			}
+		}
+		result += string(field[i])
+	}
+	return result
+}
+
+func parseMounts(output string) []mountEntry {
+	result := []mountEntry{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		result = append(result, mountEntry{
+			Device:     unescapeMountField(fields[0]),
+			MountPoint: unescapeMountField(fields[1]),
+		})
+	}
+	return result
+}
+
+func listMounts() ([]mountEntry, error) {
+	cmdName := "cat"
+	cmdArgs := []string{MOUNTS_FILE}
+	cmdName, cmdArgs = updateMountNamespace(cmdName, cmdArgs)
+	output, err := Execute(cmdName, cmdArgs)
+	if err != nil {
+		return nil, err
+	}
+	return parseMounts(output), nil
+}
+
+// IsMountPoint returns true if a filesystem is mounted at path, e.g. to check
+// a share is still mounted before writing to it
+func IsMountPoint(path string) (bool, error) {
+	mounts, err := listMounts()
+	if err != nil {
+		return false, err
+	}
+	return isMountPoint(filepath.Clean(path), mounts), nil
+}
+
+func isMountPoint(path string, mounts []mountEntry) bool {
+	for _, m := range mounts {
+		if m.MountPoint == path {
+			return true
+		}
+	}
+	return false
+}
+
+// MountedPaths returns the paths which a filesystem is mounted at, e.g. to
+// check which of the recorded users of a volume are still there
+func MountedPaths(paths []string) ([]string, error) {
+	mounts, err := listMounts()
+	if err != nil {
+		return nil, err
+	}
+	return mountedPaths(paths, mounts), nil
+}
+
+func mountedPaths(paths []string, mounts []mountEntry) []string {
+	result := []string{}
+	for _, path := range paths {
+		if isMountPoint(filepath.Clean(path), mounts) {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+/*
+resolveDevice follows symlinks such as /dev/mapper/xxx -> /dev/dm-0, so the
+device recorded by the driver can be compared with the one in mount table.
+The mount table is the one of the mount namespace of host, so are the links,
+which are followed there as well if the daemon runs in another one, e.g. in a
+container with --mnt-ns.
+*/
+func resolveDevice(dev string) string {
+	if !filepath.IsAbs(dev) {
+		return dev
+	}
+	if mountNamespaceFD == "" {
+		if resolved, err := filepath.EvalSymlinks(dev); err == nil {
+			return resolved
+		}
+		return dev
+	}
+	cmdName, cmdArgs := updateMountNamespace(READLINK_BINARY, []string{"-e", dev})
+	output, err := Execute(cmdName, cmdArgs)
+	if err != nil || strings.TrimSpace(output) == "" {
+		return dev
+	}
+	return strings.TrimSpace(output)
+}
+
+/*
+VolumeMountRefresh would check the kernel mount table for the device of
+volume, and correct the recorded mount point of volume if it has been
+mounted or umounted outside of Convoy. The recorded mount point would be kept
+if it's still one of the places the device is mounted at.
+*/
+func VolumeMountRefresh(v interface{}) (string, error) {
+	mounts, err := listMounts()
+	if err != nil {
+		return "", err
+	}
+	return volumeMountRefresh(v, mounts)
+}
+
+func volumeMountRefresh(v interface{}, mounts []mountEntry) (string, error) {
+	vol, err := getVolumeOps(v)
+	if err != nil {
+		return "", err
+	}
+	dev, err := vol.GetDevice()
+	if err != nil {
+		return "", err
+	}
+	dev = resolveDevice(dev)
+
+	// Devices are resolved once, since it takes a command in namespace of host
+	resolved := map[string]string{}
+	existMount := getVolumeMountPoint(vol)
+	mountPoint := ""
+	for _, m := range mounts {
+		mountDev, exists := resolved[m.Device]
+		if !exists {
+			mountDev = resolveDevice(m.Device)
+			resolved[m.Device] = mountDev
+		}
+		if mountDev != dev {
+			continue
+		}
+		if m.MountPoint == existMount {
+			mountPoint = existMount
+			break
+		}
+		if mountPoint == "" {
+			mountPoint = m.MountPoint
+		}
+	}
+	if mountPoint != existMount {
+		log.Warnf("Volume %v was recorded as mounted at %q, but found mounted at %q, correcting",
+			getVolumeName(vol), existMount, mountPoint)
+		setVolumeMountPoint(vol, mountPoint)
+	}
+	return mountPoint, nil
+}
+
+/*
+CleanupOrphanMounts umounts the filesystems mounted under mountsDir, which is
+where a driver mounts volumes by default, except the ones at mountPoints
+recorded for its volumes. Such mounts are left behind if the daemon or host
+crashed in the middle of mount or umount. The umounted mount points are
+returned, along with the error of the first one failed to umount.
+*/
+func CleanupOrphanMounts(mountsDir string, mountPoints map[string]bool) ([]string, error) {
+	mounts, err := listMounts()
+	if err != nil {
+		return nil, err
+	}
+	mountsDir, err = filepath.Abs(mountsDir)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, mountPoint := range findOrphanMounts(mountsDir, mountPoints, mounts) {
+		log.Warnf("Umounting orphan mount %v", mountPoint)
+		if err := callUmount([]string{mountPoint}); err != nil {
+			return result, fmt.Errorf("Cannot umount orphan mount %v: %v", mountPoint, err)
+		}
+		if err := os.Remove(mountPoint); err != nil {
+			log.Warnf("Cannot cleanup mount point directory %v due to %v", mountPoint, err)
+		}
+		result = append(result, mountPoint)
+	}
+	return result, nil
+}
+
+func findOrphanMounts(mountsDir string, mountPoints map[string]bool, mounts []mountEntry) []string {
+	result := []string{}
+	found := map[string]bool{}
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.MountPoint, mountsDir+"/") || mountPoints[m.MountPoint] || found[m.MountPoint] {
+			continue
+		}
+		found[m.MountPoint] = true
+		result = append(result, m.MountPoint)
+	}
+	return result
+}
+
+// ValidateMountOptions checks the comma separated options to be passed to
+// "mount -o", e.g. "noatime,nodiscard"
+func ValidateMountOptions(options string) error {
+	if options == "" {
+		return nil
+	}
+	if strings.ContainsAny(options, " \t\n") {
+		return fmt.Errorf("Invalid mount options %v, cannot contain space", options)
+	}
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" || strings.HasPrefix(opt, "-") {
+			return fmt.Errorf("Invalid mount options %v", options)
+		}
+	}
+	return nil
+}
+
+var (
+	bindMountFlags = map[string]bool{
+		"nodev":  true,
+		"nosuid": true,
+		"noexec": true,
+	}
+	mountPropagations = map[string]bool{
+		"shared":   true,
+		"rshared":  true,
+		"slave":    true,
+		"rslave":   true,
+		"private":  true,
+		"rprivate": true,
+	}
+)
+
+/*
+ParseBindMountOptions splits the comma separated options of bind mount into
+the flags, which can be nodev, nosuid and noexec, and the propagation type,
+which can be shared, slave, private, or the recursive ones prefixed by "r".
+At most one propagation type can be specified.
+*/
+func ParseBindMountOptions(options string) ([]string, string, error) {
+	flags := []string{}
+	propagation := ""
+	if options == "" {
+		return flags, propagation, nil
+	}
+	if err := ValidateMountOptions(options); err != nil {
+		return nil, "", err
+	}
+	for _, opt := range strings.Split(options, ",") {
+		switch {
+		case bindMountFlags[opt]:
+			flags = append(flags, opt)
+		case mountPropagations[opt]:
+			if propagation != "" {
+				return nil, "", fmt.Errorf("Invalid mount options %v, only one propagation type can be specified", options)
+			}
+			propagation = opt
+		default:
+			return nil, "", fmt.Errorf("Unsupported bind mount option %v, must be one of nodev, nosuid, noexec, or a propagation type like rshared or rslave", opt)
+		}
+	}
+	return flags, propagation, nil
+}
+
+/*
+BindMountWithContext bind mounts source at mountPoint with the options, see
+ParseBindMountOptions. Flags are applied by remount and the propagation is
+changed afterwards, since neither takes effect along with --bind on every
+version of mount. The bind mount is undone if either of them fails.
+*/
+func BindMountWithContext(ctx context.Context, source, mountPoint, options string) error {
+	flags, propagation, err := ParseBindMountOptions(options)
+	if err != nil {
+		return err
+	}
+	if _, err := callMountWithContext(ctx, []string{"--bind"}, []string{source, mountPoint}); err != nil {
+		if ctx.Err() != nil {
+			cleanupAbortedMount(mountPoint, false)
+		}
+		return err
+	}
+	if len(flags) != 0 {
+		_, err = callMountWithContext(ctx, []string{"-o", "remount,bind," + strings.Join(flags, ",")}, []string{mountPoint})
+	}
+	if err == nil && propagation != "" {
+		_, err = callMountWithContext(ctx, []string{"--make-" + propagation}, []string{mountPoint})
+	}
+	if err != nil {
+		if umountErr := callUmount([]string{mountPoint}); umountErr != nil {
+			log.Warnf("Cannot umount %v after failed bind mount due to %v", mountPoint, umountErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// RemountBindReadOnlyWithContext makes the bind mount at mountPoint
+// read-only, the filesystem bound stays writable elsewhere
+func RemountBindReadOnlyWithContext(ctx context.Context, mountPoint string) error {
+	_, err := callMountWithContext(ctx, []string{"-o", "remount,bind,ro"}, []string{mountPoint})
+	return err
+}
+
+// UmountWithContext umounts the filesystem mounted at mountPoint, in the
+// mount namespace of volumes
+func UmountWithContext(ctx context.Context, mountPoint string) error {
+	return callUmountWithContext(ctx, []string{mountPoint})
+}
+
+// MountOptionsArgs returns the arguments of mount command for the comma
+// separated options
+func MountOptionsArgs(options string) []string {
+	if options == "" {
+		return []string{}
+	}
+	return []string{"-o", options}
+}
+
+// ReadOnlyMountOptions returns the comma separated options with "ro" in
+// place of "rw" if readOnly
+func ReadOnlyMountOptions(options string, readOnly bool) string {
+	if !readOnly {
+		return options
+	}
+	opts := []string{}
+	for _, opt := range strings.Split(options, ",") {
+		if opt == "" || opt == "rw" || opt == "ro" {
+			continue
+		}
+		opts = append(opts, opt)
+	}
+	return strings.Join(append(opts, "ro"), ",")
+}
+
+// CheckMountMode fails if a volume already mounted at mountPoint is asked to
+// be mounted in another mode, since it wouldn't be remounted
+func CheckMountMode(volumeName, mountPoint string, mountedReadOnly, readOnly bool) error {
+	if mountPoint == "" || mountedReadOnly == readOnly {
+		return nil
+	}
+	mode := "read-write"
+	if mountedReadOnly {
+		mode = "read-only"
+	}
+	return fmt.Errorf("Volume %v is already mounted %v at %v, umount it first", volumeName, mode, mountPoint)
+}
+
+// VolumeOwnership is the owner and permission of the root directory of
+// volume, -1 to keep the current one
+type VolumeOwnership struct {
+	UID  int
+	GID  int
+	Mode int64
+}
+
+// ParseVolumeOwnership parses the numeric uid, gid and octal mode, e.g. 1000,
+// 1000 and 2775. It returns nil if none of them is specified.
+func ParseVolumeOwnership(uid, gid, mode string) (*VolumeOwnership, error) {
+	if uid == "" && gid == "" && mode == "" {
+		return nil, nil
+	}
+	o := &VolumeOwnership{UID: -1, GID: -1, Mode: -1}
+	var err error
+	if uid != "" {
+		if o.UID, err = strconv.Atoi(uid); err != nil || o.UID < 0 {
+			return nil, fmt.Errorf("Invalid uid %v, must be a non-negative number", uid)
+		}
+	}
+	if gid != "" {
+		if o.GID, err = strconv.Atoi(gid); err != nil || o.GID < 0 {
+			return nil, fmt.Errorf("Invalid gid %v, must be a non-negative number", gid)
+		}
+	}
+	if mode != "" {
+		if o.Mode, err = strconv.ParseInt(mode, 8, 64); err != nil || o.Mode < 0 || o.Mode > 07777 {
+			return nil, fmt.Errorf("Invalid mode %v, must be an octal number like 0775", mode)
+		}
+	}
+	return o, nil
+}
+
+// Apply changes the owner and permission of path, which should be done
+// again after the content of volume is restored, since the root directory
+// of backup or snapshot would replace them
+func (o *VolumeOwnership) Apply(path string) error {
+	if o.UID != -1 || o.GID != -1 {
+		if err := os.Chown(path, o.UID, o.GID); err != nil {
+			return err
+		}
+	}
+	if o.Mode != -1 {
+		// os.Chmod() drops the setuid, setgid and sticky bits in octal
+		if err := syscall.Chmod(path, uint32(o.Mode)); err != nil {
+			return &os.PathError{Op: "chmod", Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
 func callMkdirIfNotExists(dirName string) error {
 	cmdName := "mkdir"
 	cmdArgs := []string{"-p", dirName}
@@ -203,12 +725,31 @@ func callMkdirIfNotExists(dirName string) error {
 	return nil
 }
 
+func cleanupAbortedMount(mountPoint string, removeMountPoint bool) {
+	if isMounted(mountPoint) {
+		log.Warnf("Mount to %v completed after being aborted, umount it", mountPoint)
+		if err := callUmount([]string{mountPoint}); err != nil {
+			log.Warnf("Cannot umount %v after aborted mount due to %v", mountPoint, err)
+			return
+		}
+	}
+	if removeMountPoint {
+		if err := os.Remove(mountPoint); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Cannot cleanup mount point directory %v due to %v", mountPoint, err)
+		}
+	}
+}
+
 func callMount(opts, args []string) (string, error) {
-	cmdName := MOUNT_BINARY
+	return callMountWithContext(context.Background(), opts, args)
+}
+
+func callMountWithContext(ctx context.Context, opts, args []string) (string, error) {
+	cmdName := mountBinary
 	cmdArgs := opts
 	cmdArgs = append(cmdArgs, args...)
 	cmdName, cmdArgs = updateMountNamespace(cmdName, cmdArgs)
-	output, err := Execute(cmdName, cmdArgs)
+	output, err := ExecuteWithRetryContext(ctx, cmdName, cmdArgs)
 	if err != nil {
 		return "", err
 	}
@@ -216,10 +757,14 @@ func callMount(opts, args []string) (string, error) {
 }
 
 func callUmount(args []string) error {
+	return callUmountWithContext(context.Background(), args)
+}
+
+func callUmountWithContext(ctx context.Context, args []string) error {
 	cmdName := UMOUNT_BINARY
 	cmdArgs := args
 	cmdName, cmdArgs = updateMountNamespace(cmdName, cmdArgs)
-	if _, err := Execute(cmdName, cmdArgs); err != nil {
+	if _, err := ExecuteWithRetryContext(ctx, cmdName, cmdArgs); err != nil {
 		return err
 	}
 	return nil
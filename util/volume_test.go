@@ -1,8 +1,13 @@
 package util
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -76,6 +81,10 @@ func (s *TestSuite) TestVolumeHelper(c *C) {
 
 	testVolumeVMSupport(r, s, c)
 
+	output, err := VolumeTrim(context.Background(), r)
+	c.Assert(err, IsNil)
+	c.Assert(output, Matches, newMountPoint+": .* trimmed")
+
 	err = VolumeMountPointDirectoryRemove(r, "test_dir")
 	c.Assert(err, IsNil)
 
@@ -86,6 +95,9 @@ func (s *TestSuite) TestVolumeHelper(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(r.MountPoint, Equals, "")
 
+	_, err = VolumeTrim(context.Background(), r)
+	c.Assert(err, ErrorMatches, "Volume testabc is not mounted")
+
 	err = DetachLoopbackDevice(s.imageFile, dev)
 	c.Assert(err, IsNil)
 }
@@ -97,6 +109,102 @@ func (s *TestSuite) TestVolumeHelperWithNamespace(c *C) {
 	s.TestVolumeHelper(c)
 }
 
+func (s *TestSuite) TestVolumeMountRefresh(c *C) {
+	dev, err := AttachLoopbackDevice(s.imageFile, false)
+	c.Assert(err, IsNil)
+
+	r := &HelperVolume{
+		Name:   "testrefresh",
+		Device: dev,
+	}
+	mountPoint := filepath.Join(testMountPath, r.Name)
+	c.Assert(callMkdirIfNotExists(mountPoint), IsNil)
+
+	// Mount outside of Convoy
+	_, err = callMount([]string{}, []string{dev, mountPoint})
+	c.Assert(err, IsNil)
+	c.Assert(r.MountPoint, Equals, "")
+
+	m, err := VolumeMountRefresh(r)
+	c.Assert(err, IsNil)
+	c.Assert(m, Equals, mountPoint)
+	c.Assert(r.MountPoint, Equals, mountPoint)
+
+	// Umount outside of Convoy
+	c.Assert(callUmount([]string{mountPoint}), IsNil)
+
+	m, err = VolumeMountRefresh(r)
+	c.Assert(err, IsNil)
+	c.Assert(m, Equals, "")
+	c.Assert(r.MountPoint, Equals, "")
+
+	err = DetachLoopbackDevice(s.imageFile, dev)
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TestVolumeMountRefreshWithMountTable(c *C) {
+	mounts := parseMounts(`/dev/sda1 / ext4 rw,relatime 0 0
+/dev/loop7 /tmp/util/mnt\040a ext4 rw,relatime 0 0
+/dev/loop7 /tmp/util/mnt/b ext4 rw,relatime 0 0
+`)
+	c.Assert(mounts, HasLen, 3)
+	c.Assert(mounts[1].MountPoint, Equals, "/tmp/util/mnt a")
+
+	// Recorded mount point is still valid
+	r := &HelperVolume{
+		Name:       "testrefresh",
+		Device:     "/dev/loop7",
+		MountPoint: "/tmp/util/mnt/b",
+	}
+	m, err := volumeMountRefresh(r, mounts)
+	c.Assert(err, IsNil)
+	c.Assert(m, Equals, "/tmp/util/mnt/b")
+
+	// Recorded mount point was umounted, but volume was mounted elsewhere
+	r.MountPoint = "/tmp/util/mnt/c"
+	m, err = volumeMountRefresh(r, mounts)
+	c.Assert(err, IsNil)
+	c.Assert(m, Equals, "/tmp/util/mnt a")
+	c.Assert(r.MountPoint, Equals, "/tmp/util/mnt a")
+
+	// Volume is not mounted anywhere
+	r.Device = "/dev/loop8"
+	m, err = volumeMountRefresh(r, mounts)
+	c.Assert(err, IsNil)
+	c.Assert(m, Equals, "")
+	c.Assert(r.MountPoint, Equals, "")
+}
+
+func (s *TestSuite) TestFindOrphanMounts(c *C) {
+	mounts := parseMounts(`/dev/sda1 / ext4 rw,relatime 0 0
+/dev/dm-1 /var/lib/convoy/mounts/vol1 ext4 rw,relatime 0 0
+/dev/dm-2 /var/lib/convoy/mounts/vol2 ext4 rw,relatime 0 0
+/dev/dm-2 /var/lib/convoy/mounts/vol2 ext4 rw,relatime 0 0
+/dev/dm-3 /mnt/vol3 ext4 rw,relatime 0 0
+/dev/dm-4 /var/lib/convoy/mounts2/vol4 ext4 rw,relatime 0 0
+`)
+	orphans := findOrphanMounts("/var/lib/convoy/mounts", map[string]bool{
+		"/var/lib/convoy/mounts/vol1": true,
+		"/mnt/vol3":                   true,
+	}, mounts)
+	c.Assert(orphans, DeepEquals, []string{"/var/lib/convoy/mounts/vol2"})
+
+	orphans = findOrphanMounts("/var/lib/convoy/mounts", map[string]bool{
+		"/var/lib/convoy/mounts/vol1": true,
+		"/var/lib/convoy/mounts/vol2": true,
+	}, mounts)
+	c.Assert(orphans, HasLen, 0)
+}
+
+func (s *TestSuite) TestIsMountPoint(c *C) {
+	mounts := parseMounts(`/dev/sda1 / ext4 rw,relatime 0 0
+nfs1:/export /var/lib/convoy/vfs nfs4 rw,relatime 0 0
+`)
+	c.Assert(isMountPoint("/var/lib/convoy/vfs", mounts), Equals, true)
+	c.Assert(isMountPoint("/var/lib/convoy", mounts), Equals, false)
+	c.Assert(isMountPoint("/var/lib/convoy/vfs/vol1", mounts), Equals, false)
+}
+
 func testVolumeVMSupport(r *HelperVolume, s *TestSuite, c *C) {
 	var err error
 
@@ -134,3 +242,135 @@ func testVolumeVMSupport(r *HelperVolume, s *TestSuite, c *C) {
 	c.Assert(err, IsNil)
 
 }
+
+func (s *TestSuite) TestVolumeMountTimeout(c *C) {
+	// Fake mount which hangs on mounting, but still lists the mount table
+	fakeMount := filepath.Join(testRoot, "fake-mount")
+	script := "#!/bin/sh\nif [ $# -ne 0 ]; then exec sleep 10; fi\nexec mount\n"
+	c.Assert(ioutil.WriteFile(fakeMount, []byte(script), 0755), IsNil)
+	mountBinary = fakeMount
+	defer func() {
+		mountBinary = MOUNT_BINARY
+	}()
+
+	r := &HelperVolume{
+		Name:   "testtimeout",
+		Device: "/dev/convoy-nonexistent",
+	}
+	ctx, cancel, err := ContextWithTimeout(context.Background(), "200ms")
+	c.Assert(err, IsNil)
+	defer cancel()
+
+	start := time.Now()
+	_, err = VolumeMountWithContext(ctx, r, "", false)
+	c.Assert(err, ErrorMatches, "Timeout executing.*")
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+
+	c.Assert(r.MountPoint, Equals, "")
+	_, err = os.Stat(r.GenerateDefaultMountPoint())
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestSuite) TestMountOptions(c *C) {
+	c.Assert(ValidateMountOptions(""), IsNil)
+	c.Assert(MountOptionsArgs(""), HasLen, 0)
+	c.Assert(ValidateMountOptions("noatime,nodiscard"), IsNil)
+	c.Assert(MountOptionsArgs("noatime,nodiscard"), DeepEquals, []string{"-o", "noatime,nodiscard"})
+
+	for _, options := range []string{"noatime, ro", "noatime,,ro", "-t,ext4", "ro,"} {
+		c.Assert(ValidateMountOptions(options), ErrorMatches, "Invalid mount options.*")
+	}
+}
+
+func (s *TestSuite) TestBindMountOptions(c *C) {
+	flags, propagation, err := ParseBindMountOptions("")
+	c.Assert(err, IsNil)
+	c.Assert(flags, HasLen, 0)
+	c.Assert(propagation, Equals, "")
+
+	flags, propagation, err = ParseBindMountOptions("nodev,rshared,nosuid")
+	c.Assert(err, IsNil)
+	c.Assert(flags, DeepEquals, []string{"nodev", "nosuid"})
+	c.Assert(propagation, Equals, "rshared")
+
+	_, _, err = ParseBindMountOptions("rshared,rslave")
+	c.Assert(err, ErrorMatches, ".*only one propagation type can be specified")
+	_, _, err = ParseBindMountOptions("noatime")
+	c.Assert(err, ErrorMatches, "Unsupported bind mount option noatime.*")
+	_, _, err = ParseBindMountOptions("nodev,")
+	c.Assert(err, ErrorMatches, "Invalid mount options.*")
+
+	// Fake mount which records the commands
+	fakeMount := filepath.Join(testRoot, "fake-mount")
+	record := filepath.Join(testRoot, "mount-commands")
+	script := "#!/bin/sh\necho \"$@\" >> " + record + "\n"
+	c.Assert(ioutil.WriteFile(fakeMount, []byte(script), 0755), IsNil)
+	mountBinary = fakeMount
+	defer func() {
+		mountBinary = MOUNT_BINARY
+	}()
+
+	c.Assert(BindMountWithContext(context.Background(), "/data/vol1", "/mnt/vol1", "noexec,nodev,rslave"), IsNil)
+	output, err := ioutil.ReadFile(record)
+	c.Assert(err, IsNil)
+	c.Assert(string(output), Equals, "--bind /data/vol1 /mnt/vol1\n"+
+		"-o remount,bind,noexec,nodev /mnt/vol1\n"+
+		"--make-rslave /mnt/vol1\n")
+}
+
+func (s *TestSuite) TestVolumeOwnership(c *C) {
+	o, err := ParseVolumeOwnership("", "", "")
+	c.Assert(err, IsNil)
+	c.Assert(o, IsNil)
+
+	o, err = ParseVolumeOwnership("", "1000", "2775")
+	c.Assert(err, IsNil)
+	c.Assert(*o, DeepEquals, VolumeOwnership{UID: -1, GID: 1000, Mode: 02775})
+
+	_, err = ParseVolumeOwnership("nobody", "", "")
+	c.Assert(err, ErrorMatches, "Invalid uid nobody.*")
+	_, err = ParseVolumeOwnership("", "-1", "")
+	c.Assert(err, ErrorMatches, "Invalid gid -1.*")
+	_, err = ParseVolumeOwnership("", "", "0789")
+	c.Assert(err, ErrorMatches, "Invalid mode 0789.*")
+	_, err = ParseVolumeOwnership("", "", "17777")
+	c.Assert(err, ErrorMatches, "Invalid mode 17777.*")
+
+	dir := filepath.Join(testRoot, "ownership")
+	c.Assert(os.Mkdir(dir, 0700), IsNil)
+	defer os.RemoveAll(dir)
+	o, err = ParseVolumeOwnership("1000", "1001", "2775")
+	c.Assert(err, IsNil)
+	c.Assert(o.Apply(dir), IsNil)
+	st, err := os.Stat(dir)
+	c.Assert(err, IsNil)
+	c.Assert(st.Mode()&os.ModePerm, Equals, os.FileMode(0775))
+	c.Assert(st.Mode()&os.ModeSetgid, Not(Equals), os.FileMode(0))
+	c.Assert(st.Sys().(*syscall.Stat_t).Uid, Equals, uint32(1000))
+	c.Assert(st.Sys().(*syscall.Stat_t).Gid, Equals, uint32(1001))
+}
+
+func (s *TestSuite) TestReadOnlyMountOptions(c *C) {
+	c.Assert(ReadOnlyMountOptions("", false), Equals, "")
+	c.Assert(ReadOnlyMountOptions("noatime", false), Equals, "noatime")
+	c.Assert(ReadOnlyMountOptions("", true), Equals, "ro")
+	c.Assert(ReadOnlyMountOptions("noatime", true), Equals, "noatime,ro")
+	c.Assert(ReadOnlyMountOptions("rw,noatime", true), Equals, "noatime,ro")
+	c.Assert(ReadOnlyMountOptions("ro,noatime", true), Equals, "noatime,ro")
+
+	c.Assert(CheckMountMode("vol", "", false, true), IsNil)
+	c.Assert(CheckMountMode("vol", "/mnt/vol", true, true), IsNil)
+	c.Assert(CheckMountMode("vol", "/mnt/vol", false, true), ErrorMatches, "Volume vol is already mounted read-write at /mnt/vol.*")
+	c.Assert(CheckMountMode("vol", "/mnt/vol", true, false), ErrorMatches, "Volume vol is already mounted read-only at /mnt/vol.*")
+}
+
+func (s *TestSuite) TestMountedPaths(c *C) {
+	mounts := parseMounts(`/dev/sda1 / ext4 rw,relatime 0 0
+/dev/dm-1 /var/lib/kubelet/pods/pod1/mount ext4 rw,relatime 0 0
+`)
+	paths := mountedPaths([]string{
+		"/var/lib/kubelet/pods/pod1/mount/",
+		"/var/lib/kubelet/pods/pod2/mount",
+	}, mounts)
+	c.Assert(paths, DeepEquals, []string{"/var/lib/kubelet/pods/pod1/mount/"})
+}
@@ -0,0 +1,161 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+const (
+	VFS_BACKUP_MODE = "vfs.backupmode"
+
+	BACKUP_MODE_FULL        = "full"
+	BACKUP_MODE_INCREMENTAL = "incremental"
+)
+
+func validateBackupMode(mode string) error {
+	if mode != BACKUP_MODE_FULL && mode != BACKUP_MODE_INCREMENTAL {
+		return fmt.Errorf("Invalid backup mode %v, must be %v or %v",
+			mode, BACKUP_MODE_FULL, BACKUP_MODE_INCREMENTAL)
+	}
+	return nil
+}
+
+// parentBackup returns the last backup of volume in destURL and its
+// snapshot, if the next backup can be incremental to it, i.e. the snapshot
+// is still there to tell what has changed since. Both are nil otherwise.
+func parentBackup(volume *Volume, destURL string) (*objectstore.Backup, *Snapshot, error) {
+	backup, err := objectstore.LoadLastBackup(volume.Name, destURL)
+	if err != nil || backup == nil {
+		return nil, nil, err
+	}
+	snapshot, exists := volume.Snapshots[backup.SnapshotName]
+	// The volume may have been deleted and created again with the same name
+	if !exists || snapshot.CreatedTime != backup.SnapshotCreatedAt {
+		log.Debugf("Snapshot %v of last backup %v is not available, would create full backup", backup.SnapshotName, backup.Name)
+		return nil, nil, nil
+	}
+	if backup.Format != objectstore.BACKUP_FORMAT_FILES {
+		log.Debugf("Last backup %v is not in %v format, would create full backup", backup.Name, objectstore.BACKUP_FORMAT_FILES)
+		return nil, nil, nil
+	}
+	return backup, &snapshot, nil
+}
+
+/*
+backupChanges returns the paths in a snapshot which are added or modified
+since an earlier snapshot, and the paths deleted since, both sorted. A path
+replaced by another type of file is deleted as well, so a directory can be
+replaced by a file when the backup is restored. Only the topmost deleted
+directory is returned, rather than everything in it.
+*/
+func backupChanges(from, to map[string]fileEntry) ([]string, []string) {
+	changed := []string{}
+	deleted := map[string]bool{}
+	for _, change := range diffFiles(from, to).Files {
+		if change.Change == FILE_CHANGE_DELETED {
+			deleted[change.Path] = true
+			continue
+		}
+		changed = append(changed, change.Path)
+		if fromEntry, exists := from[change.Path]; exists && fromEntry.Mode.Type() != to[change.Path].Mode.Type() {
+			deleted[change.Path] = true
+		}
+	}
+	topmost := []string{}
+	for p := range deleted {
+		parentDeleted := false
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if deleted[dir] {
+				parentDeleted = true
+				break
+			}
+		}
+		if !parentDeleted {
+			topmost = append(topmost, p)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(topmost)
+	return changed, topmost
+}
+
+// snapshotDir returns the directory with the files of snapshot. Snapshot in
+// full mode is extracted to a temporary directory, which is removed by
+// calling the returned function.
+func (d *Driver) snapshotDir(snapshot *Snapshot, volumeID string) (string, func(), error) {
+	if snapshot.Incremental {
+		return snapshot.FilePath, func() {}, nil
+	}
+	dir := util.StagingPath(volumeID + "_" + snapshot.Name + ".backup")
+	if err := util.DecompressDir(snapshot.FilePath, dir, snapshot.Compression); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return dir, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warnf("Failed to remove temporary directory %v: %v", dir, err)
+		}
+	}, nil
+}
+
+// createIncrementalBackup uploads the files of snapshot changed since the
+// snapshot of parent as a backup incremental to parent
+func (d *Driver) createIncrementalBackup(volume *Volume, snapshot, parentSnapshot *Snapshot, parent *objectstore.Backup,
+	objVolume *objectstore.Volume, objSnapshot *objectstore.Snapshot, destURL string) (string, error) {
+	fromFiles, err := snapshotFiles(parentSnapshot)
+	if err != nil {
+		return "", err
+	}
+	dir, cleanup, err := d.snapshotDir(snapshot, volume.Name)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	toFiles, err := dirFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	changed, deleted := backupChanges(fromFiles, toFiles)
+	log.Debugf("Creating backup of snapshot %v incremental to backup %v of snapshot %v, %v paths changed and %v deleted",
+		snapshot.Name, parent.Name, parentSnapshot.Name, len(changed), len(deleted))
+
+	var size int64
+	for _, path := range changed {
+		size += toFiles[path].Size
+	}
+	if err := util.CheckStagingSpace(size, "backup of snapshot "+snapshot.Name); err != nil {
+		return "", err
+	}
+	tarFile := d.getStagingFilePath(snapshot.Name+"_incremental", volume.Name, objSnapshot.Compression)
+	if err := util.CompressPaths(dir, changed, tarFile, objSnapshot.Compression); err != nil {
+		return "", err
+	}
+	defer os.Remove(tarFile)
+	return objectstore.CreateIncrementalFilesBackup(objVolume, objSnapshot, tarFile, deleted, parent.Name, destURL)
+}
+
+// restoreBackup replaces the content of volumePath with the files of backup
+func restoreBackup(backupURL, volumePath string) error {
+	tmpDir := volumePath + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(tmpDir, 0700); err != nil {
+		return err
+	}
+	if err := objectstore.RestoreFilesBackup(backupURL, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := os.RemoveAll(volumePath); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, volumePath)
+}
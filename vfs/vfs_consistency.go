@@ -0,0 +1,167 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	VFS_SNAPSHOT_CONSISTENCY = "vfs.snapshotconsistency"
+
+	SNAPSHOT_CONSISTENCY_NONE     = "none"
+	SNAPSHOT_CONSISTENCY_FSFREEZE = "fsfreeze"
+	SNAPSHOT_CONSISTENCY_RSYNC    = "rsync"
+
+	STAGING_PATH = "staging"
+)
+
+func validateSnapshotConsistency(mode string) error {
+	if mode != SNAPSHOT_CONSISTENCY_NONE && mode != SNAPSHOT_CONSISTENCY_FSFREEZE && mode != SNAPSHOT_CONSISTENCY_RSYNC {
+		return fmt.Errorf("Invalid snapshot consistency %v, must be %v, %v or %v",
+			mode, SNAPSHOT_CONSISTENCY_NONE, SNAPSHOT_CONSISTENCY_FSFREEZE, SNAPSHOT_CONSISTENCY_RSYNC)
+	}
+	return nil
+}
+
+func getDevice(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
+
+// getMountPoint returns the mount point of the filesystem containing path
+func getMountPoint(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dev, err := getDevice(path)
+	if err != nil {
+		return "", err
+	}
+	for path != "/" {
+		parent := filepath.Dir(path)
+		parentDev, err := getDevice(parent)
+		if err != nil {
+			return "", err
+		}
+		if parentDev != dev {
+			break
+		}
+		path = parent
+	}
+	return path, nil
+}
+
+func freezeFS(ctx context.Context, mountPoint string) error {
+	log.Debugf("Freezing filesystem at %v", mountPoint)
+	_, err := util.ExecuteWithContext(ctx, "fsfreeze", []string{"-f", mountPoint})
+	return err
+}
+
+func thawFS(mountPoint string) {
+	log.Debugf("Thawing filesystem at %v", mountPoint)
+	if _, err := util.Execute("fsfreeze", []string{"-u", mountPoint}); err != nil {
+		log.Errorf("Failed to thaw filesystem at %v: %v", mountPoint, err)
+	}
+}
+
+func syncDir(ctx context.Context, srcDir, dstDir string) error {
+	_, err := util.ExecuteWithRetryContext(ctx, "rsync", []string{"-a", "--delete", srcDir + "/", dstDir + "/"})
+	return err
+}
+
+// checkNotFrozen makes sure files can still be written to path when
+// mountPoint is frozen, otherwise the snapshot would never complete
+func checkNotFrozen(path, mountPoint string) error {
+	if err := util.MkdirIfNotExists(path); err != nil {
+		return err
+	}
+	pathMountPoint, err := getMountPoint(path)
+	if err != nil {
+		return err
+	}
+	if pathMountPoint == mountPoint {
+		return fmt.Errorf("%v must not be on the filesystem at %v, which would be frozen during snapshot", path, mountPoint)
+	}
+	return nil
+}
+
+/*
+prepareSnapshotSource returns the directory to create snapshot of volume
+from, and the function to call once the snapshot is created. Mounted volumes
+are quiesced according to SnapshotConsistency:
+
+fsfreeze: The volume directory must be the mount point of its own filesystem,
+which would be frozen until the snapshot is created.
+
+rsync: The volume directory is copied to a staging directory twice while
+it's in use, then the filesystem containing it is frozen for a final copy,
+which only transfers the files changed since the second copy. The snapshot
+is created from the staging directory.
+
+The copies and the freeze are aborted once ctx is done, while the thaw never
+is.
+*/
+func (d *Driver) prepareSnapshotSource(ctx context.Context, volume *Volume) (string, func(), error) {
+	if volume.MountPoint == "" || d.SnapshotConsistency == SNAPSHOT_CONSISTENCY_NONE {
+		return volume.Path, func() {}, nil
+	}
+
+	mountPoint, err := getMountPoint(volume.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	switch d.SnapshotConsistency {
+	case SNAPSHOT_CONSISTENCY_FSFREEZE:
+		path, err := filepath.Abs(volume.Path)
+		if err != nil {
+			return "", nil, err
+		}
+		if mountPoint != path {
+			return "", nil, fmt.Errorf("Cannot freeze volume %v, %v is not the mount point of its own filesystem", volume.Name, volume.Path)
+		}
+		if err := checkNotFrozen(filepath.Join(d.Root, SNAPSHOT_PATH), mountPoint); err != nil {
+			return "", nil, err
+		}
+		if err := freezeFS(ctx, mountPoint); err != nil {
+			return "", nil, err
+		}
+		return volume.Path, func() { thawFS(mountPoint) }, nil
+	case SNAPSHOT_CONSISTENCY_RSYNC:
+		stagingDir := filepath.Join(d.Root, STAGING_PATH, volume.Name)
+		if err := checkNotFrozen(stagingDir, mountPoint); err != nil {
+			return "", nil, err
+		}
+		cleanup := func() {
+			if err := os.RemoveAll(stagingDir); err != nil {
+				log.Warnf("Failed to remove staging directory %v: %v", stagingDir, err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if err := syncDir(ctx, volume.Path, stagingDir); err != nil {
+				cleanup()
+				return "", nil, err
+			}
+		}
+		if err := freezeFS(ctx, mountPoint); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		err := syncDir(ctx, volume.Path, stagingDir)
+		thawFS(mountPoint)
+		if err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		return stagingDir, cleanup, nil
+	}
+	return "", nil, fmt.Errorf("BUG: Unknown snapshot consistency %v", d.SnapshotConsistency)
+}
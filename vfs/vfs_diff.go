@@ -0,0 +1,214 @@
+package vfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+)
+
+// fileEntry is the metadata of a file in snapshot, which tells whether it
+// has changed. ModTime is in seconds, since tarballs may not keep more.
+type fileEntry struct {
+	Mode     os.FileMode
+	Size     int64
+	ModTime  int64
+	Uid      int
+	Gid      int
+	Linkname string
+}
+
+func (e fileEntry) changed(other fileEntry) bool {
+	if e.Mode.IsDir() && other.Mode.IsDir() {
+		// Modification time and size of directory change with its
+		// content, which is reported by itself
+		return e.Mode != other.Mode || e.Uid != other.Uid || e.Gid != other.Gid
+	}
+	return e != other
+}
+
+// snapshotFiles indexes the files of snapshot by their paths relative to
+// the root of volume
+func snapshotFiles(snapshot *Snapshot) (map[string]fileEntry, error) {
+	if snapshot.Incremental {
+		return dirFiles(snapshot.FilePath)
+	}
+	return tarballFiles(snapshot.FilePath, snapshot.Compression)
+}
+
+func dirFiles(dir string) (map[string]fileEntry, error) {
+	files := map[string]fileEntry{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		entry := fileEntry{
+			Mode:    info.Mode(),
+			Size:    info.Size(),
+			ModTime: info.ModTime().Unix(),
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.Uid, entry.Gid = int(st.Uid), int(st.Gid)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if entry.Linkname, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		files[rel] = entry
+		return nil
+	})
+	return files, err
+}
+
+func tarballFiles(file, compression string) (map[string]fileEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := util.DecompressStream(w, f, compression)
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+	files, err := readTarFiles(r)
+	if err == nil {
+		// Padding after the end of archive is left unread
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	// Unblock the decompression if reading failed
+	r.CloseWithError(io.ErrClosedPipe)
+	if decompressErr := <-errCh; err == nil {
+		err = decompressErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read snapshot file %v: %v", file, err)
+	}
+	return files, nil
+}
+
+func readTarFiles(r io.Reader) (map[string]fileEntry, error) {
+	files := map[string]fileEntry{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rel := path.Clean(header.Name)
+		if rel == "." {
+			continue
+		}
+		info := header.FileInfo()
+		entry := fileEntry{
+			Mode:    info.Mode(),
+			Size:    info.Size(),
+			ModTime: header.ModTime.Unix(),
+			Uid:     header.Uid,
+			Gid:     header.Gid,
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			entry.Linkname = header.Linkname
+		}
+		if header.Typeflag == tar.TypeLink {
+			// Hard links in tarball have the content of the file linked
+			// to, which is listed before it
+			if target, exists := files[path.Clean(header.Linkname)]; exists {
+				entry.Mode, entry.Size = target.Mode, target.Size
+			}
+		}
+		files[rel] = entry
+	}
+}
+
+// diffFiles returns the change from the files of a snapshot to the ones of a
+// later snapshot, ordered by path
+func diffFiles(from, to map[string]fileEntry) *SnapshotDiff {
+	diff := &SnapshotDiff{
+		Files: []FileChange{},
+	}
+	add := func(path, change string, entry fileEntry) {
+		size := int64(0)
+		if change != FILE_CHANGE_DELETED && entry.Mode.IsRegular() {
+			size = entry.Size
+			diff.ChangedBytes += size
+		}
+		diff.Files = append(diff.Files, FileChange{
+			Path:   path,
+			Change: change,
+			Size:   size,
+		})
+	}
+	for path, entry := range to {
+		fromEntry, exists := from[path]
+		if !exists {
+			add(path, FILE_CHANGE_ADDED, entry)
+		} else if entry.changed(fromEntry) {
+			add(path, FILE_CHANGE_MODIFIED, entry)
+		}
+	}
+	for path, entry := range from {
+		if _, exists := to[path]; !exists {
+			add(path, FILE_CHANGE_DELETED, entry)
+		}
+	}
+	sort.Slice(diff.Files, func(i, j int) bool {
+		return diff.Files[i].Path < diff.Files[j].Path
+	})
+	return diff
+}
+
+func (d *Driver) DiffSnapshot(req Request) (*SnapshotDiff, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volumeID, err := util.GetFieldFromOpts(OPT_VOLUME_NAME, req.Options)
+	if err != nil {
+		return nil, err
+	}
+	compareID, err := util.GetFieldFromOpts(OPT_COMPARE_SNAPSHOT_NAME, req.Options)
+	if err != nil {
+		return nil, err
+	}
+	from, err := d.getSnapshot(compareID, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	to, err := d.getSnapshot(req.Name, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	fromFiles, err := snapshotFiles(from)
+	if err != nil {
+		return nil, err
+	}
+	toFiles, err := snapshotFiles(to)
+	if err != nil {
+		return nil, err
+	}
+	return diffFiles(fromFiles, toFiles), nil
+}
@@ -0,0 +1,82 @@
+package vfs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	VFS_NFS_EXPORT       = "vfs.nfsexport"
+	VFS_NFS_OPTIONS      = "vfs.nfsoptions"
+	VFS_REMOVE_ON_DELETE = "vfs.removeondelete"
+
+	NFS_FS_TYPE = "nfs"
+)
+
+// nfsExport is the root export of NFS server mounted at the VFS path, in
+// which the driver creates a directory for every volume
+type nfsExport struct {
+	// Export in the form of "<server>:<path>"
+	Name       string
+	Options    string
+	MountPoint string
+}
+
+func (e *nfsExport) GetDevice() (string, error) {
+	return e.Name, nil
+}
+
+func (e *nfsExport) GetMountOpts() []string {
+	return append([]string{"-t", NFS_FS_TYPE}, util.MountOptionsArgs(e.Options)...)
+}
+
+func (e *nfsExport) GenerateDefaultMountPoint() string {
+	// Always mounted at the VFS path
+	return ""
+}
+
+func validateNFSExport(export string) error {
+	parts := strings.SplitN(export, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || !strings.HasPrefix(parts[1], "/") {
+		return fmt.Errorf("Invalid NFS export %v, must be <server>:<path>", export)
+	}
+	return nil
+}
+
+// mountNFSExport mounts the NFS export at the VFS path if the driver manages
+// it, unless it's mounted already
+func (dev *Device) mountNFSExport() error {
+	if dev.NFSExport == "" {
+		return nil
+	}
+	if err := util.MkdirIfNotExists(dev.Path); err != nil {
+		return err
+	}
+	export := &nfsExport{
+		Name:    dev.NFSExport,
+		Options: dev.NFSOptions,
+	}
+	log.Debugf("Mounting NFS export %v at %v", dev.NFSExport, dev.Path)
+	if _, err := util.VolumeMount(export, dev.Path, false); err != nil {
+		return fmt.Errorf("Failed to mount NFS export %v at %v: %v", dev.NFSExport, dev.Path, err)
+	}
+	return nil
+}
+
+// checkNFSExport fails if the NFS export is no longer mounted, otherwise
+// volumes would be written to the local disk below it
+func (dev *Device) checkNFSExport() error {
+	if dev.NFSExport == "" {
+		return nil
+	}
+	mounted, err := util.IsMountPoint(dev.Path)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		return fmt.Errorf("NFS export %v is not mounted at %v", dev.NFSExport, dev.Path)
+	}
+	return nil
+}
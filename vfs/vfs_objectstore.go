@@ -3,10 +3,12 @@ package vfs
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/convoy/objectstore"
@@ -127,32 +129,57 @@ func (v *VfsObjectStoreDriver) Read(src string) (io.ReadCloser, error) {
 	return file, nil
 }
 
+// tempPath returns a unique temporary file next to dst, so daemons sharing
+// the path don't write into the same one
+func tempPath(dst string) string {
+	return dst + "." + util.GenerateName("tmp")
+}
+
+// Write replaces dst by renaming a temporary file over it, so readers see
+// either the old or the new content, even on another host
 func (v *VfsObjectStoreDriver) Write(dst string, rs io.ReadSeeker) error {
-	tmpFile := dst + ".tmp"
-	if v.FileExists(tmpFile) {
-		v.Remove(tmpFile)
-	}
+	return v.writeFile(dst, rs)
+}
+
+// UploadStream writes src to dst the same way as Write, the content is
+// visible only if it's read to the end
+func (v *VfsObjectStoreDriver) UploadStream(src io.Reader, dst string) error {
+	return v.writeFile(dst, src)
+}
+
+func (v *VfsObjectStoreDriver) writeFile(dst string, src io.Reader) error {
 	if err := v.preparePath(dst); err != nil {
 		return err
 	}
-	file, err := os.Create(v.updatePath(tmpFile))
+	tmpFile := v.updatePath(tempPath(dst))
+	file, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	_, err = io.Copy(file, rs)
-	if err != nil {
+	if _, err := io.Copy(file, src); err != nil {
+		file.Close()
+		os.Remove(tmpFile)
 		return err
 	}
-
-	if v.FileExists(dst) {
-		v.Remove(dst)
+	// Make sure the content is on the server before it's visible
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, v.updatePath(dst)); err != nil {
+		os.Remove(tmpFile)
+		return err
 	}
-	return os.Rename(v.updatePath(tmpFile), v.updatePath(dst))
+	return nil
 }
 
 func (v *VfsObjectStoreDriver) List(path string) ([]string, error) {
-	out, err := util.Execute("ls", []string{"-1", v.updatePath(path)})
+	out, err := util.ExecuteWithRetry("ls", []string{"-1", v.updatePath(path)})
 	if err != nil {
 		return nil, err
 	}
@@ -164,27 +191,59 @@ func (v *VfsObjectStoreDriver) List(path string) ([]string, error) {
 	return result, nil
 }
 
-func (v *VfsObjectStoreDriver) Upload(src, dst string) error {
-	tmpDst := dst + ".tmp"
-	if v.FileExists(tmpDst) {
-		v.Remove(tmpDst)
+// ListVersions versions files by their modification time and size
+func (v *VfsObjectStoreDriver) ListVersions(path string) (map[string]string, error) {
+	result := map[string]string{}
+	infos, err := ioutil.ReadDir(v.updatePath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			result[info.Name()] = fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return result, nil
+}
+
+func (v *VfsObjectStoreDriver) ListModTimes(path string) (map[string]time.Time, error) {
+	result := map[string]time.Time{}
+	infos, err := ioutil.ReadDir(v.updatePath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			result[info.Name()] = info.ModTime()
+		}
 	}
+	return result, nil
+}
+
+func (v *VfsObjectStoreDriver) Upload(src, dst string) error {
 	if err := v.preparePath(dst); err != nil {
 		return err
 	}
-	_, err := util.Execute("cp", []string{src, v.updatePath(tmpDst)})
-	if err != nil {
+	tmpDst := v.updatePath(tempPath(dst))
+	if _, err := util.ExecuteWithRetry("cp", []string{src, tmpDst}); err != nil {
+		os.Remove(tmpDst)
 		return err
 	}
-	_, err = util.Execute("mv", []string{v.updatePath(tmpDst), v.updatePath(dst)})
-	if err != nil {
+	if err := os.Rename(tmpDst, v.updatePath(dst)); err != nil {
+		os.Remove(tmpDst)
 		return err
 	}
 	return nil
 }
 
 func (v *VfsObjectStoreDriver) Download(src, dst string) error {
-	_, err := util.Execute("cp", []string{v.updatePath(src), dst})
+	_, err := util.ExecuteWithRetry("cp", []string{v.updatePath(src), dst})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,187 @@
+package vfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/convoy/util"
+)
+
+var (
+	// Lock which hasn't been refreshed by its holder for lockTTL is stale,
+	// e.g. the host of holder crashed, and would be broken by the next
+	// one. It's well above the attribute cache timeout of NFS clients.
+	lockTTL             = 5 * time.Minute
+	lockRefreshInterval = 30 * time.Second
+	lockRetryInterval   = time.Second
+	lockTimeout         = 2 * lockTTL
+)
+
+/*
+Lock acquires the lock of name by creating the lock file exclusively, which is
+atomic on local filesystems and NFSv3 or later, so daemons of all the hosts
+sharing the path are serialized. The holder keeps touching the lock file, and
+a waiter breaks the lock once it sees the modification time of the file
+unchanged for lockTTL by its own clock, so clocks of the hosts don't need to
+agree.
+*/
+func (v *VfsObjectStoreDriver) Lock(name string) (func(), error) {
+	file := v.updatePath(name)
+	token := lockToken()
+
+	deadline := time.Now().Add(lockTimeout)
+	var lastModTime, lastChanged time.Time
+	for {
+		err := createLockFile(file, token)
+		if err == nil {
+			break
+		}
+		if os.IsNotExist(err) {
+			// Directory was cleaned up by the previous holder
+			continue
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		st, err := os.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Released just now
+				continue
+			}
+			return nil, err
+		}
+		now := time.Now()
+		if !st.ModTime().Equal(lastModTime) {
+			lastModTime, lastChanged = st.ModTime(), now
+		} else if now.Sub(lastChanged) >= lockTTL {
+			log.Warnf("Breaking stale lock %v held by %v", file, readLockHolder(file))
+			if err := breakLock(file, lastModTime); err != nil {
+				return nil, err
+			}
+			lastModTime = time.Time{}
+			continue
+		}
+		if now.After(deadline) {
+			return nil, fmt.Errorf("Timeout waiting for lock %v held by %v", file, readLockHolder(file))
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	log.Debugf("Acquired lock %v", file)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		refreshLock(file, token, stop)
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			wg.Wait()
+			// The lock file may have been removed along with its
+			// directory, or broken while the holder was stuck
+			if readLockHolder(file) != token {
+				log.Warnf("Lock %v is no longer held by %v", file, token)
+				return
+			}
+			if err := v.Remove(name); err != nil {
+				log.Warnf("Failed to release lock %v: %v", file, err)
+				return
+			}
+			log.Debugf("Released lock %v", file)
+		})
+	}, nil
+}
+
+// lockToken identifies the holder of lock, for checking the ownership and
+// for humans looking at a stuck lock
+func lockToken() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%v:%v:%v", hostname, os.Getpid(), util.NewUUID())
+}
+
+func createLockFile(file, token string) error {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModeDir|0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(token); err != nil {
+		f.Close()
+		os.Remove(file)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(file)
+		return err
+	}
+	return nil
+}
+
+func readLockHolder(file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// breakLock removes the stale lock file last modified at modTime. It's moved
+// away first, so only one of the waiters breaks it, and it's put back if it
+// turns out to be refreshed meanwhile.
+func breakLock(file string, modTime time.Time) error {
+	staleFile := file + "." + util.GenerateName("stale")
+	if err := os.Rename(file, staleFile); err != nil {
+		if os.IsNotExist(err) {
+			// Broken by another waiter
+			return nil
+		}
+		return err
+	}
+	st, err := os.Stat(staleFile)
+	if err != nil {
+		return err
+	}
+	if !st.ModTime().Equal(modTime) {
+		if err := os.Link(staleFile, file); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return os.Remove(staleFile)
+}
+
+// refreshLock touches the lock file until stop is closed, so waiters know
+// the holder is alive
+func refreshLock(file, token string, stop chan struct{}) {
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if readLockHolder(file) != token {
+				log.Warnf("Lock %v is no longer held by %v", file, token)
+				return
+			}
+			now := time.Now()
+			if err := os.Chtimes(file, now, now); err != nil {
+				log.Warnf("Failed to refresh lock %v: %v", file, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package vfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) initObjectStoreDriver(c *C) *VfsObjectStoreDriver {
+	dest := filepath.Join(s.root, "dest")
+	c.Assert(os.MkdirAll(dest, 0700), IsNil)
+	driver, err := initFunc("vfs://" + dest)
+	c.Assert(err, IsNil)
+	return driver.(*VfsObjectStoreDriver)
+}
+
+func (s *TestSuite) TestObjectStoreWrite(c *C) {
+	driver := s.initObjectStoreDriver(c)
+
+	c.Assert(driver.Write("dir/volume.cfg", bytes.NewReader([]byte("old"))), IsNil)
+	c.Assert(driver.Write("dir/volume.cfg", bytes.NewReader([]byte("new"))), IsNil)
+	src := filepath.Join(s.root, "upload")
+	c.Assert(ioutil.WriteFile(src, []byte("uploaded"), 0600), IsNil)
+	c.Assert(driver.Upload(src, "dir/backup.cfg"), IsNil)
+
+	// Temporary files are renamed over the destination
+	names, err := driver.List("dir")
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"backup.cfg", "volume.cfg"})
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "dest", "dir", "volume.cfg"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "new")
+}
+
+func (s *TestSuite) TestObjectStoreLock(c *C) {
+	defer func(retry time.Duration) { lockRetryInterval = retry }(lockRetryInterval)
+	lockRetryInterval = 10 * time.Millisecond
+	driver := s.initObjectStoreDriver(c)
+	lockFile := filepath.Join(s.root, "dest", "dir", "volume.lock")
+
+	unlock, err := driver.Lock("dir/volume.lock")
+	c.Assert(err, IsNil)
+	holder := readLockHolder(lockFile)
+	c.Assert(holder, Not(Equals), "")
+
+	acquired := make(chan func())
+	go func() {
+		unlock, err := driver.Lock("dir/volume.lock")
+		c.Check(err, IsNil)
+		acquired <- unlock
+	}()
+	select {
+	case <-acquired:
+		c.Fatal("Lock is acquired twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	// Releasing twice is harmless
+	unlock()
+	unlock2 := <-acquired
+	c.Assert(readLockHolder(lockFile), Not(Equals), holder)
+	unlock2()
+
+	// The lock file and the directory created for it are cleaned up
+	_, err = os.Stat(filepath.Join(s.root, "dest", "dir"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestSuite) TestObjectStoreStaleLock(c *C) {
+	defer func(ttl, retry time.Duration) {
+		lockTTL, lockRetryInterval = ttl, retry
+	}(lockTTL, lockRetryInterval)
+	lockTTL = 200 * time.Millisecond
+	lockRetryInterval = 10 * time.Millisecond
+	driver := s.initObjectStoreDriver(c)
+
+	// Left by a crashed daemon, with a modification time far in the
+	// future by the clock of its host
+	lockFile := filepath.Join(s.root, "dest", "dir", "volume.lock")
+	c.Assert(os.MkdirAll(filepath.Dir(lockFile), 0700), IsNil)
+	c.Assert(ioutil.WriteFile(lockFile, []byte("crashed"), 0644), IsNil)
+	future := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(lockFile, future, future), IsNil)
+
+	start := time.Now()
+	unlock, err := driver.Lock("dir/volume.lock")
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) >= lockTTL, Equals, true)
+	c.Assert(readLockHolder(lockFile), Not(Equals), "crashed")
+	unlock()
+
+	// Lock of a live holder is refreshed, so it's never broken
+	defer func(refresh, timeout time.Duration) {
+		lockRefreshInterval, lockTimeout = refresh, timeout
+	}(lockRefreshInterval, lockTimeout)
+	lockRefreshInterval = 20 * time.Millisecond
+	lockTimeout = 3 * lockTTL
+	unlock, err = driver.Lock("dir/volume.lock")
+	c.Assert(err, IsNil)
+	_, err = driver.Lock("dir/volume.lock")
+	c.Assert(err, ErrorMatches, "Timeout waiting for lock .*")
+	unlock()
+}
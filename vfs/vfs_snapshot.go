@@ -0,0 +1,186 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rancher/convoy/util"
+)
+
+const (
+	SNAPSHOT_MODE_FULL        = "full"
+	SNAPSHOT_MODE_INCREMENTAL = "incremental"
+)
+
+func validateSnapshotMode(mode string) error {
+	if mode != SNAPSHOT_MODE_FULL && mode != SNAPSHOT_MODE_INCREMENTAL {
+		return fmt.Errorf("Invalid snapshot mode %v, must be %v or %v",
+			mode, SNAPSHOT_MODE_FULL, SNAPSHOT_MODE_INCREMENTAL)
+	}
+	return nil
+}
+
+func (d *Driver) getSnapshotDirPath(snapshotID, volumeID string) string {
+	return filepath.Join(d.Root, SNAPSHOT_PATH, volumeID+"_"+snapshotID)
+}
+
+// latestIncrementalSnapshot returns the newest incremental snapshot of the
+// volume, which would be used as the base of the next one
+func latestIncrementalSnapshot(volume *Volume) *Snapshot {
+	var (
+		latest     *Snapshot
+		latestTime time.Time
+	)
+	for id := range volume.Snapshots {
+		snapshot := volume.Snapshots[id]
+		if !snapshot.Incremental {
+			continue
+		}
+		t, err := time.Parse(time.RubyDate, snapshot.CreatedTime)
+		if err != nil {
+			continue
+		}
+		if latest == nil || t.After(latestTime) {
+			latest = &snapshot
+			latestTime = t
+		}
+	}
+	return latest
+}
+
+/*
+linkCopyDir copies srcDir to dstDir, in the same way as "rsync --link-dest".
+A regular file would be hard linked from baseDir instead of copying, if the
+file at the same relative path in baseDir has the same size, mode and
+modification time. So unchanged files won't take any space or time to
+snapshot. baseDir can be empty if there is no base.
+*/
+func linkCopyDir(srcDir, baseDir, dstDir string) error {
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstDir, rel)
+
+		switch {
+		case info.IsDir():
+			if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dst); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if baseDir != "" && sameFile(info, filepath.Join(baseDir, rel)) {
+				if err := os.Link(filepath.Join(baseDir, rel), dst); err == nil {
+					return nil
+				}
+				// Fall back to copy, e.g. when link count limit is reached
+			}
+			if err := copyFile(path, dst, info); err != nil {
+				return err
+			}
+		default:
+			log.Warnf("Skip special file %v when creating snapshot", path)
+			return nil
+		}
+		copyOwner(dst, info)
+		return nil
+	})
+}
+
+func sameFile(info os.FileInfo, basePath string) bool {
+	baseInfo, err := os.Lstat(basePath)
+	if err != nil || !baseInfo.Mode().IsRegular() {
+		return false
+	}
+	if baseInfo.Size() != info.Size() || baseInfo.Mode() != info.Mode() ||
+		!baseInfo.ModTime().Equal(info.ModTime()) {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	baseSt, baseOK := baseInfo.Sys().(*syscall.Stat_t)
+	if ok && baseOK && (st.Uid != baseSt.Uid || st.Gid != baseSt.Gid) {
+		return false
+	}
+	return true
+}
+
+func copyFile(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	// Keep modification time, so the next snapshot can tell it's unchanged
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func copyOwner(dst string, info os.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+		log.Debugf("Cannot preserve owner of %v: %v", dst, err)
+	}
+}
+
+// createIncrementalSnapshot creates snapshot of volume with the content of
+// srcDir, which is the volume directory or a copy of it
+func (d *Driver) createIncrementalSnapshot(id string, volume *Volume, srcDir string) (string, error) {
+	snapDir := d.getSnapshotDirPath(id, volume.Name)
+	if err := util.MkdirIfNotExists(filepath.Dir(snapDir)); err != nil {
+		return "", err
+	}
+	baseDir := ""
+	if base := latestIncrementalSnapshot(volume); base != nil {
+		baseDir = base.FilePath
+		log.Debugf("Creating snapshot %v of volume %v based on snapshot %v", id, volume.Name, base.Name)
+	}
+
+	tmpDir := snapDir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return "", err
+	}
+	if err := linkCopyDir(srcDir, baseDir, tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	if err := os.Rename(tmpDir, snapDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+	return snapDir, nil
+}
@@ -21,13 +21,18 @@ const (
 	CFG_POSTFIX       = ".json"
 
 	SNAPSHOT_PATH = "snapshots"
+	MOUNTS_DIR    = "mounts"
 
 	VFS_DEFAULT_VOLUME_SIZE = "vfs.defaultvolumesize"
 	DEFAULT_VOLUME_SIZE     = "100G"
+
+	VFS_SNAPSHOT_MODE = "vfs.snapshotmode"
+	VFS_COMPRESSION   = "vfs.compression"
 )
 
 type Driver struct {
 	mutex *sync.RWMutex
+	usage *util.UsageCache
 	Device
 }
 
@@ -46,6 +51,21 @@ type Device struct {
 	Path              string
 	ConfigPath        string
 	DefaultVolumeSize int64
+	SnapshotMode      string
+	// How mounted volumes are quiesced when creating snapshot
+	SnapshotConsistency string
+	// Default compression of snapshots in full mode and backups, see
+	// util.COMPRESSION_*
+	Compression string
+	// Whether backups only have the files changed since the last backup
+	BackupMode string
+	// NFS export mounted at Path by the driver, if it's managed by the
+	// driver rather than mounted by user
+	NFSExport  string
+	NFSOptions string
+	// Remove the directory of volume even if only the reference is asked
+	// to be deleted, e.g. by Docker
+	RemoveOnDelete bool
 }
 
 func (dev *Device) ConfigFile() (string, error) {
@@ -60,6 +80,10 @@ type Snapshot struct {
 	CreatedTime string
 	VolumeUUID  string
 	FilePath    string
+	Incremental bool
+	// Compression of the snapshot file, empty for gzip. Not used by
+	// incremental snapshots.
+	Compression string `json:",omitempty"`
 }
 
 type Volume struct {
@@ -70,6 +94,9 @@ type Volume struct {
 	PrepareForVM bool
 	CreatedTime  string
 	Snapshots    map[string]Snapshot
+	// Comma separated options of bind mount, see
+	// util.ParseBindMountOptions(). Volume is used in place without them.
+	MountOptions string
 
 	configPath string
 }
@@ -100,6 +127,9 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 		if err := util.ObjectLoad(dev); err != nil {
 			return nil, err
 		}
+		if err := dev.mountNFSExport(); err != nil {
+			return nil, err
+		}
 	} else {
 		if err := util.MkdirIfNotExists(root); err != nil {
 			return nil, err
@@ -110,17 +140,39 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 		if path == "" {
 			return nil, fmt.Errorf("VFS driver base path unspecified")
 		}
-		if err := util.MkdirIfNotExists(path); err != nil {
-			return nil, err
-		}
-		if err := util.MkdirIfNotExists(configPath); err != nil {
-			return nil, err
-		}
 
 		dev = &Device{
 			Root:       root,
 			Path:       path,
 			ConfigPath: configPath,
+			NFSExport:  config[VFS_NFS_EXPORT],
+			NFSOptions: config[VFS_NFS_OPTIONS],
+		}
+		if dev.NFSExport != "" {
+			if err := validateNFSExport(dev.NFSExport); err != nil {
+				return nil, err
+			}
+		} else if dev.NFSOptions != "" {
+			return nil, fmt.Errorf("%v requires %v", VFS_NFS_OPTIONS, VFS_NFS_EXPORT)
+		}
+		if err := util.ValidateMountOptions(dev.NFSOptions); err != nil {
+			return nil, err
+		}
+		if config[VFS_REMOVE_ON_DELETE] != "" {
+			if dev.RemoveOnDelete, err = strconv.ParseBool(config[VFS_REMOVE_ON_DELETE]); err != nil {
+				return nil, fmt.Errorf("Invalid %v %v", VFS_REMOVE_ON_DELETE, config[VFS_REMOVE_ON_DELETE])
+			}
+		}
+
+		// Config of volumes is in the export as well
+		if err := dev.mountNFSExport(); err != nil {
+			return nil, err
+		}
+		if err := util.MkdirIfNotExists(path); err != nil {
+			return nil, err
+		}
+		if err := util.MkdirIfNotExists(configPath); err != nil {
+			return nil, err
 		}
 
 		if _, exists := config[VFS_DEFAULT_VOLUME_SIZE]; !exists {
@@ -131,6 +183,35 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 			return nil, fmt.Errorf("Illegal default volume size specified")
 		}
 		dev.DefaultVolumeSize = volumeSize
+
+		dev.SnapshotMode = config[VFS_SNAPSHOT_MODE]
+		if dev.SnapshotMode == "" {
+			dev.SnapshotMode = SNAPSHOT_MODE_FULL
+		}
+		if err := validateSnapshotMode(dev.SnapshotMode); err != nil {
+			return nil, err
+		}
+
+		dev.SnapshotConsistency = config[VFS_SNAPSHOT_CONSISTENCY]
+		if dev.SnapshotConsistency == "" {
+			dev.SnapshotConsistency = SNAPSHOT_CONSISTENCY_NONE
+		}
+		if err := validateSnapshotConsistency(dev.SnapshotConsistency); err != nil {
+			return nil, err
+		}
+
+		dev.Compression = util.GetCompression(config[VFS_COMPRESSION])
+		if err := util.ValidateCompression(dev.Compression); err != nil {
+			return nil, err
+		}
+
+		dev.BackupMode = config[VFS_BACKUP_MODE]
+		if dev.BackupMode == "" {
+			dev.BackupMode = BACKUP_MODE_FULL
+		}
+		if err := validateBackupMode(dev.BackupMode); err != nil {
+			return nil, err
+		}
 	}
 
 	// For upgrade case
@@ -141,11 +222,26 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 		}
 	}
 
+	// For upgrade case
+	if dev.SnapshotMode == "" {
+		dev.SnapshotMode = SNAPSHOT_MODE_FULL
+	}
+	if dev.SnapshotConsistency == "" {
+		dev.SnapshotConsistency = SNAPSHOT_CONSISTENCY_NONE
+	}
+	if dev.Compression == "" {
+		dev.Compression = util.DEFAULT_COMPRESSION
+	}
+	if dev.BackupMode == "" {
+		dev.BackupMode = BACKUP_MODE_FULL
+	}
+
 	if err := util.ObjectSave(dev); err != nil {
 		return nil, err
 	}
 	d := &Driver{
 		mutex:  &sync.RWMutex{},
+		usage:  util.NewUsageCache(util.DEFAULT_USAGE_CACHE_TTL),
 		Device: *dev,
 	}
 
@@ -154,12 +250,36 @@ func Init(root string, config map[string]string) (ConvoyDriver, error) {
 
 func (d *Driver) Info() (map[string]string, error) {
 	return map[string]string{
-		"Root":              d.Root,
-		"Path":              d.Path,
-		"DefaultVolumeSize": strconv.FormatInt(d.DefaultVolumeSize, 10),
+		"Root":                d.Root,
+		"Path":                d.Path,
+		"DefaultVolumeSize":   strconv.FormatInt(d.DefaultVolumeSize, 10),
+		"SnapshotMode":        d.SnapshotMode,
+		"SnapshotConsistency": d.SnapshotConsistency,
+		"Compression":         d.Compression,
+		"BackupMode":          d.BackupMode,
+		"NFSExport":           d.NFSExport,
+		"RemoveOnDelete":      strconv.FormatBool(d.RemoveOnDelete),
 	}, nil
 }
 
+func (d *Driver) CheckHealth() []HealthCheck {
+	checks := []HealthCheck{}
+	if d.NFSExport != "" {
+		checks = append(checks, HealthCheck{
+			Name:  "nfs",
+			Error: d.checkNFSExport(),
+		})
+	}
+	return append(checks, HealthCheck{
+		Name:  "path",
+		Error: util.CheckPathWritable(d.Path),
+	})
+}
+
+func (d *Driver) GetFreeSpace() (int64, error) {
+	return util.GetFreeSpace(d.Path)
+}
+
 func (d *Driver) VolumeOps() (VolumeOperations, error) {
 	return d, nil
 }
@@ -187,20 +307,51 @@ func (d *Driver) CreateVolume(req Request) error {
 	opts := req.Options
 	volume := d.blankVolume(id)
 
+	// Volumes are directories, they're only bind mounted for the mount
+	// options
+	if _, _, err := util.ParseBindMountOptions(opts[OPT_MOUNT_OPTIONS]); err != nil {
+		return err
+	}
+	if opts[OPT_READ_ONLY] == "true" {
+		return fmt.Errorf("Read-only mount is not supported by %v", d.Name())
+	}
+	ownership, err := util.ParseVolumeOwnership(opts[OPT_UID], opts[OPT_GID], opts[OPT_MODE])
+	if err != nil {
+		return err
+	}
+
 	lockFile, err := flock(volume)
 	if err != nil {
 		return fmt.Errorf("Coudln't get flock. Error: %v", err)
 	}
 	defer util.UnlockFile(lockFile)
 
+	var snapshot *Snapshot
 	backupURL := opts[OPT_BACKUP_URL]
+	snapshotName := opts[OPT_SNAPSHOT_NAME]
+	if backupURL != "" && snapshotName != "" {
+		return fmt.Errorf("Cannot create volume from both backup and snapshot")
+	}
+	if snapshotName != "" {
+		snapshot, err = d.getSnapshot(snapshotName, opts[OPT_SNAPSHOT_VOLUME_NAME])
+		if err != nil {
+			return err
+		}
+	}
 	if backupURL != "" {
 		objVolume, err := objectstore.LoadVolume(backupURL)
 		if err != nil {
 			return err
 		}
 		if objVolume.Driver != d.Name() {
-			return fmt.Errorf("Cannot restore backup of %v to %v", objVolume.Driver, d.Name())
+			// Content of backup would be extracted to the volume anyway
+			format, err := objectstore.GetBackupFormat(backupURL)
+			if err != nil {
+				return err
+			}
+			if format != objectstore.BACKUP_FORMAT_FILES {
+				return fmt.Errorf("Cannot restore backup of %v to %v", objVolume.Driver, d.Name())
+			}
 		}
 	}
 
@@ -223,6 +374,9 @@ func (d *Driver) CreateVolume(req Request) error {
 		}
 	}
 
+	if err := d.checkNFSExport(); err != nil {
+		return err
+	}
 	volumePath := filepath.Join(d.Path, id)
 	if err := util.MkdirIfNotExists(volumePath); err != nil {
 		return err
@@ -231,20 +385,134 @@ func (d *Driver) CreateVolume(req Request) error {
 	volume.CreatedTime = util.Now()
 	volume.Snapshots = make(map[string]Snapshot)
 	volume.Name = id
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
 
 	if backupURL != "" {
-		file, err := objectstore.RestoreSingleFileBackup(backupURL, volumePath)
-		if err != nil {
+		if err := restoreBackup(backupURL, volumePath); err != nil {
 			return err
 		}
-		// file would be removed after this because it's under volumePath
-		if err := util.DecompressDir(file, volumePath); err != nil {
+	}
+	if snapshot != nil {
+		if err := d.restoreSnapshot(snapshot, volumePath); err != nil {
+			return err
+		}
+	}
+	// Applied after restoring, which replaces the ones of volume directory
+	if ownership != nil {
+		if err := ownership.Apply(volumePath); err != nil {
 			return err
 		}
 	}
 	return util.ObjectSave(volume)
 }
 
+// ImportVolume adopts an existing directory as the volume, which may be out
+// of the VFS path
+func (d *Driver) ImportVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	opts := req.Options
+	if _, _, err := util.ParseBindMountOptions(opts[OPT_MOUNT_OPTIONS]); err != nil {
+		return err
+	}
+	if opts[OPT_READ_ONLY] == "true" {
+		return fmt.Errorf("Read-only mount is not supported by %v", d.Name())
+	}
+	source := opts[OPT_IMPORT_SOURCE]
+	if !filepath.IsAbs(source) {
+		return fmt.Errorf("Invalid directory %v to import, must be an absolute path", source)
+	}
+	st, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("Cannot import %v, it's not a directory", source)
+	}
+
+	volume := d.blankVolume(id)
+	lockFile, err := flock(volume)
+	if err != nil {
+		return fmt.Errorf("Coudln't get flock. Error: %v", err)
+	}
+	defer util.UnlockFile(lockFile)
+
+	exists, err := util.ObjectExists(volume)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Volume %v already exists", id)
+	}
+	volume.Path = filepath.Clean(source)
+	volume.CreatedTime = util.Now()
+	volume.Snapshots = make(map[string]Snapshot)
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	return util.ObjectSave(volume)
+}
+
+/*
+CloneVolume creates the volume with a copy of the current content of volume
+req.Options[OPT_CLONE_SOURCE]. The source is quiesced like for snapshot if
+it's mounted, and files are reflinked rather than copied where the
+filesystem supports it.
+*/
+func (d *Driver) CloneVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	source := d.blankVolume(req.Options[OPT_CLONE_SOURCE])
+	if err := util.ObjectLoad(source); err != nil {
+		return err
+	}
+
+	volume := d.blankVolume(id)
+	lockFile, err := flock(volume)
+	if err != nil {
+		return fmt.Errorf("Coudln't get flock. Error: %v", err)
+	}
+	defer util.UnlockFile(lockFile)
+
+	exists, err := util.ObjectExists(volume)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Volume %v already exists", id)
+	}
+	if err := d.checkNFSExport(); err != nil {
+		return err
+	}
+	volumePath := filepath.Join(d.Path, id)
+	if err := util.MkdirIfNotExists(volumePath); err != nil {
+		return err
+	}
+
+	srcDir, release, err := d.prepareSnapshotSource(req.Context(), source)
+	if err != nil {
+		return err
+	}
+	_, err = util.ExecuteWithContext(req.Context(), "cp", []string{"-a", "--reflink=auto", srcDir + "/.", volumePath})
+	release()
+	if err != nil {
+		if err := os.RemoveAll(volumePath); err != nil {
+			log.Warnf("Failed to clean up %v of volume %v: %v", volumePath, id, err)
+		}
+		return err
+	}
+
+	volume.Path = volumePath
+	volume.Size = source.Size
+	volume.PrepareForVM = source.PrepareForVM
+	volume.MountOptions = source.MountOptions
+	volume.CreatedTime = util.Now()
+	volume.Snapshots = make(map[string]Snapshot)
+	return util.ObjectSave(volume)
+}
+
 func (d *Driver) DeleteVolume(req Request) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -268,12 +536,13 @@ func (d *Driver) DeleteVolume(req Request) error {
 		return fmt.Errorf("Cannot delete volume %v. It is still mounted", id)
 	}
 	referenceOnly, _ := strconv.ParseBool(opts[OPT_REFERENCE_ONLY])
-	if !referenceOnly {
+	if !referenceOnly || d.RemoveOnDelete {
 		log.Debugf("Cleaning up %v for volume %v", volume.Path, id)
-		if out, err := util.Execute("rm", []string{"-rf", volume.Path}); err != nil {
+		if out, err := util.ExecuteWithContext(req.Context(), "rm", []string{"-rf", volume.Path}); err != nil {
 			return fmt.Errorf("Fail to cleanup the volume, output: %v, error: %v", out, err.Error())
 		}
 	}
+	d.usage.Invalidate(id)
 	return util.ObjectDelete(volume)
 }
 
@@ -284,6 +553,10 @@ func (d *Driver) MountVolume(req Request) (string, error) {
 	id := req.Name
 	opts := req.Options
 
+	if opts[OPT_READ_ONLY] == "true" {
+		return "", fmt.Errorf("Read-only mount is not supported by %v", d.Name())
+	}
+
 	volume := d.blankVolume(id)
 	if err := util.ObjectLoad(volume); err != nil {
 		return "", err
@@ -294,7 +567,23 @@ func (d *Driver) MountVolume(req Request) (string, error) {
 		return "", fmt.Errorf("VFS doesn't support specified mount point")
 	}
 	if volume.MountPoint == "" {
-		volume.MountPoint = volume.Path
+		if volume.MountOptions == "" {
+			volume.MountPoint = volume.Path
+		} else {
+			mountPoint := d.getMountPoint(id)
+			if err := util.MkdirIfNotExists(mountPoint); err != nil {
+				return "", err
+			}
+			ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+			if err != nil {
+				return "", err
+			}
+			defer cancel()
+			if err := util.BindMountWithContext(ctx, volume.Path, mountPoint, volume.MountOptions); err != nil {
+				return "", err
+			}
+			volume.MountPoint = mountPoint
+		}
 	}
 	if volume.PrepareForVM {
 		if err := util.MountPointPrepareImageFile(volume.MountPoint, volume.Size); err != nil {
@@ -325,9 +614,43 @@ func (d *Driver) UmountVolume(req Request) error {
 		return err
 	}
 
-	if volume.MountPoint != "" {
-		volume.MountPoint = ""
+	if volume.MountPoint != "" && volume.MountPoint != volume.Path {
+		if err := util.UmountWithContext(req.Context(), volume.MountPoint); err != nil {
+			return err
+		}
+		if err := os.Remove(volume.MountPoint); err != nil {
+			log.Warnf("Cannot cleanup mount point directory %v due to %v", volume.MountPoint, err)
+		}
+	}
+	volume.MountPoint = ""
+
+	lockFile, err := flock(volume)
+	if err != nil {
+		return fmt.Errorf("Coudln't get flock. Error: %v", err)
+	}
+	defer util.UnlockFile(lockFile)
+	return util.ObjectSave(volume)
+}
+
+// ForceUmountVolume only umounts the volumes mounted with options, the
+// directory of other volumes cannot be umounted by itself
+func (d *Driver) ForceUmountVolume(req Request) error {
+	id := req.Name
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+
+	if volume.MountPoint != "" && volume.MountPoint != volume.Path {
+		if err := util.ForceUmount(req.Context(), volume.MountPoint, req.Options[OPT_KILL] == "true"); err != nil {
+			return err
+		}
+		if err := os.Remove(volume.MountPoint); err != nil {
+			log.Warnf("Cannot cleanup mount point directory %v due to %v", volume.MountPoint, err)
+		}
 	}
+	volume.MountPoint = ""
 
 	lockFile, err := flock(volume)
 	if err != nil {
@@ -372,14 +695,30 @@ func (d *Driver) getVolumeInfo(name string) (map[string]string, error) {
 	if volume.PrepareForVM {
 		size = strconv.FormatInt(volume.Size, 10)
 	}
-	return map[string]string{
+	info := map[string]string{
 		"Path":                  volume.Path,
 		OPT_MOUNT_POINT:         volume.MountPoint,
 		OPT_SIZE:                size,
 		OPT_PREPARE_FOR_VM:      prepareForVM,
+		OPT_MOUNT_OPTIONS:       volume.MountOptions,
 		OPT_VOLUME_NAME:         volume.Name,
 		OPT_VOLUME_CREATED_TIME: volume.CreatedTime,
-	}, nil
+	}
+	used, err := d.usage.Get(volume.Name, func() (int64, error) {
+		return util.GetDirUsage(volume.Path)
+	})
+	if err != nil {
+		log.Warnf("Failed to get usage of volume %v: %v", volume.Name, err)
+		return info, nil
+	}
+	// Nothing is reserved for volume without fixed size
+	allocated := used
+	if volume.PrepareForVM && volume.Size > used {
+		allocated = volume.Size
+	}
+	info[OPT_USED_SIZE] = strconv.FormatInt(used, 10)
+	info[OPT_ALLOCATED_SIZE] = strconv.FormatInt(allocated, 10)
+	return info, nil
 }
 
 func (d *Driver) MountPoint(req Request) (string, error) {
@@ -395,12 +734,77 @@ func (d *Driver) MountPoint(req Request) (string, error) {
 	return volume.MountPoint, nil
 }
 
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	// Only bind mounts have kernel mount state to reconcile with, volumes
+	// without mount options are used in place
+	if volume.MountPoint == "" || volume.MountPoint == volume.Path {
+		return volume.MountPoint, nil
+	}
+	mounted, err := util.IsMountPoint(volume.MountPoint)
+	if err != nil || mounted {
+		return volume.MountPoint, err
+	}
+	log.Warnf("Volume %v was recorded as mounted at %v, but it's not mounted, correcting", volume.Name, volume.MountPoint)
+	volume.MountPoint = ""
+
+	lockFile, err := flock(volume)
+	if err != nil {
+		return "", fmt.Errorf("Coudln't get flock. Error: %v", err)
+	}
+	defer util.UnlockFile(lockFile)
+	return "", util.ObjectSave(volume)
+}
+
+func (d *Driver) getMountPoint(id string) string {
+	return filepath.Join(d.Root, MOUNTS_DIR, id)
+}
+
+// CleanupOrphanMounts umounts the bind mounts of volumes left behind, e.g.
+// after a crash in the middle of mount
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	names, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, name := range names {
+		volume := d.blankVolume(name)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, MOUNTS_DIR), mountPoints)
+}
+
+func (d *Driver) ResizeVolume(req Request) error {
+	return fmt.Errorf("VFS volumes are directories without size limit, resize is not supported")
+}
+
 func (d *Driver) SnapshotOps() (SnapshotOperations, error) {
 	return d, nil
 }
 
-func (d *Driver) getSnapshotFilePath(snapshotID, volumeID string) string {
-	return filepath.Join(d.Root, SNAPSHOT_PATH, volumeID+"_"+snapshotID+".tar.gz")
+func (d *Driver) getSnapshotFilePath(snapshotID, volumeID, compression string) string {
+	return filepath.Join(d.Root, SNAPSHOT_PATH, volumeID+"_"+snapshotID+util.CompressionExt(compression))
+}
+
+// getStagingFilePath returns the path of the tarball of snapshot staged for
+// backup, which is removed once uploaded
+func (d *Driver) getStagingFilePath(snapshotID, volumeID, compression string) string {
+	return util.StagingPath(volumeID + "_" + snapshotID + util.CompressionExt(compression))
 }
 
 func (d *Driver) CreateSnapshot(req Request) error {
@@ -420,11 +824,29 @@ func (d *Driver) CreateSnapshot(req Request) error {
 	if _, exists := volume.Snapshots[id]; exists {
 		return fmt.Errorf("Snapshot %v already exists for volume %v", id, volumeID)
 	}
-	snapFile := d.getSnapshotFilePath(id, volumeID)
-	if err := util.MkdirIfNotExists(filepath.Dir(snapFile)); err != nil {
+	incremental := d.SnapshotMode == SNAPSHOT_MODE_INCREMENTAL
+	compression := ""
+	if !incremental {
+		compression = d.getCompression(req.Options)
+		if err := util.ValidateCompression(compression); err != nil {
+			return err
+		}
+	}
+	srcDir, release, err := d.prepareSnapshotSource(req.Context(), volume)
+	if err != nil {
 		return err
 	}
-	if err := util.CompressDir(volume.Path, snapFile); err != nil {
+	snapFile := ""
+	if incremental {
+		snapFile, err = d.createIncrementalSnapshot(id, volume, srcDir)
+	} else {
+		snapFile = d.getSnapshotFilePath(id, volumeID, compression)
+		if err = util.MkdirIfNotExists(filepath.Dir(snapFile)); err == nil {
+			err = util.CompressDir(srcDir, snapFile, compression)
+		}
+	}
+	release()
+	if err != nil {
 		return err
 	}
 	volume.Snapshots[id] = Snapshot{
@@ -432,6 +854,8 @@ func (d *Driver) CreateSnapshot(req Request) error {
 		CreatedTime: util.Now(),
 		VolumeUUID:  volumeID,
 		FilePath:    snapFile,
+		Incremental: incremental,
+		Compression: compression,
 	}
 
 	lockFile, err := flock(volume)
@@ -462,7 +886,9 @@ func (d *Driver) deleteSnapshot(id, volumeID string) error {
 	if !exists {
 		return fmt.Errorf("Snapshot %v doesn't exists for volume %v", id, volumeID)
 	}
-	if err := os.Remove(snapshot.FilePath); err != nil {
+	// Files of incremental snapshot are hard links, removing them won't
+	// affect other snapshots
+	if err := os.RemoveAll(snapshot.FilePath); err != nil {
 		return err
 	}
 	delete(volume.Snapshots, id)
@@ -475,6 +901,39 @@ func (d *Driver) deleteSnapshot(id, volumeID string) error {
 	return util.ObjectSave(volume)
 }
 
+func (d *Driver) getSnapshot(id, volumeID string) (*Snapshot, error) {
+	if volumeID == "" {
+		return nil, fmt.Errorf("Cannot find volume of snapshot %v", id)
+	}
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, err
+	}
+	snapshot, exists := volume.Snapshots[id]
+	if !exists {
+		return nil, fmt.Errorf("Snapshot %v doesn't exists for volume %v", id, volumeID)
+	}
+	return &snapshot, nil
+}
+
+// restoreSnapshot fills volumePath with the content of snapshot. Files are
+// always copied, so changes to the volume won't affect the snapshot.
+func (d *Driver) restoreSnapshot(snapshot *Snapshot, volumePath string) error {
+	if snapshot.Incremental {
+		return linkCopyDir(snapshot.FilePath, "", volumePath)
+	}
+	return util.DecompressDir(snapshot.FilePath, volumePath, snapshot.Compression)
+}
+
+// getCompression returns the compression specified by opts, or the default
+// of driver
+func (d *Driver) getCompression(opts map[string]string) string {
+	if opts[OPT_COMPRESSION] != "" {
+		return opts[OPT_COMPRESSION]
+	}
+	return d.Compression
+}
+
 func (d *Driver) GetSnapshotInfo(req Request) (map[string]string, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -488,20 +947,21 @@ func (d *Driver) GetSnapshotInfo(req Request) (map[string]string, error) {
 }
 
 func (d *Driver) getSnapshotInfo(id, volumeID string) (map[string]string, error) {
-	volume := d.blankVolume(volumeID)
-	if err := util.ObjectLoad(volume); err != nil {
+	snapshot, err := d.getSnapshot(id, volumeID)
+	if err != nil {
 		return nil, err
 	}
-	snapshot, exists := volume.Snapshots[id]
-	if !exists {
-		return nil, fmt.Errorf("Snapshot %v doesn't exists for volume %v", id, volumeID)
-	}
-	return map[string]string{
+	info := map[string]string{
 		OPT_SNAPSHOT_NAME:         snapshot.Name,
 		OPT_SNAPSHOT_CREATED_TIME: snapshot.CreatedTime,
 		"VolumeUUID":              snapshot.VolumeUUID,
 		"FilePath":                snapshot.FilePath,
-	}, nil
+		"Incremental":             strconv.FormatBool(snapshot.Incremental),
+	}
+	if !snapshot.Incremental {
+		info[OPT_COMPRESSION] = util.GetCompression(snapshot.Compression)
+	}
+	return info, nil
 }
 
 func (d *Driver) ListSnapshot(opts map[string]string) (map[string]map[string]string, error) {
@@ -558,10 +1018,67 @@ func (d *Driver) CreateBackup(snapshotID, volumeID, destURL string, opts map[str
 		CreatedTime: opts[OPT_VOLUME_CREATED_TIME],
 	}
 	objSnapshot := &objectstore.Snapshot{
-		Name:        snapshotID,
-		CreatedTime: opts[OPT_SNAPSHOT_CREATED_TIME],
+		Name:            snapshotID,
+		CreatedTime:     opts[OPT_SNAPSHOT_CREATED_TIME],
+		EncryptionKeyID: opts[OPT_ENCRYPTION_KEY_ID],
+		Compression:     util.GetCompression(d.getCompression(opts)),
+	}
+	if err := util.ValidateCompression(objSnapshot.Compression); err != nil {
+		return "", err
 	}
-	return objectstore.CreateSingleFileBackup(objVolume, objSnapshot, snapshot.FilePath, destURL)
+	if d.BackupMode == BACKUP_MODE_INCREMENTAL {
+		parent, parentSnapshot, err := parentBackup(volume, destURL)
+		if err != nil {
+			return "", err
+		}
+		if parent != nil {
+			return d.createIncrementalBackup(volume, &snapshot, parentSnapshot, parent, objVolume, objSnapshot, destURL)
+		}
+	}
+	if !snapshot.Incremental {
+		// Snapshot file is uploaded as is unless another compression is
+		// specified for backup
+		snapCompression := util.GetCompression(snapshot.Compression)
+		if opts[OPT_COMPRESSION] == "" || opts[OPT_COMPRESSION] == snapCompression {
+			objSnapshot.Compression = snapCompression
+			return objectstore.CreateFilesBackup(objVolume, objSnapshot, snapshot.FilePath, destURL)
+		}
+		st, err := os.Stat(snapshot.FilePath)
+		if err != nil {
+			return "", err
+		}
+		snapFile := d.getStagingFilePath(snapshotID, volumeID, objSnapshot.Compression)
+		if err := util.CheckStagingSpace(st.Size(), "backup of snapshot "+snapshotID); err != nil {
+			return "", err
+		}
+		if err := util.RecompressFile(snapshot.FilePath, snapCompression, snapFile, objSnapshot.Compression); err != nil {
+			return "", err
+		}
+		defer os.Remove(snapFile)
+		return objectstore.CreateFilesBackup(objVolume, objSnapshot, snapFile, destURL)
+	}
+
+	// Backup is always a compressed tarball, so it can be restored
+	// regardless of the snapshot mode. It's streamed to the objectstore if
+	// possible, rather than staged in a file as large as the snapshot.
+	if objectstore.StreamUploadSupported(destURL) {
+		return objectstore.CreateFilesBackupFromDir(objVolume, objSnapshot, snapshot.FilePath, destURL)
+	}
+	// Compressed size is not known in advance, uncompressed size is the
+	// upper bound
+	size, err := util.GetDirUsage(snapshot.FilePath)
+	if err != nil {
+		return "", err
+	}
+	if err := util.CheckStagingSpace(size, "backup of snapshot "+snapshotID); err != nil {
+		return "", err
+	}
+	snapFile := d.getStagingFilePath(snapshotID, volumeID, objSnapshot.Compression)
+	if err := util.CompressDir(snapshot.FilePath, snapFile, objSnapshot.Compression); err != nil {
+		return "", err
+	}
+	defer os.Remove(snapFile)
+	return objectstore.CreateFilesBackup(objVolume, objSnapshot, snapFile, destURL)
 }
 
 func (d *Driver) DeleteBackup(backupURL string) error {
@@ -572,7 +1089,7 @@ func (d *Driver) DeleteBackup(backupURL string) error {
 	if objVolume.Driver != d.Name() {
 		return fmt.Errorf("BUG: Wrong driver handling DeleteBackup(), driver should be %v but is %v", objVolume.Driver, d.Name())
 	}
-	return objectstore.DeleteSingleFileBackup(backupURL)
+	return objectstore.DeleteFilesBackup(backupURL)
 }
 
 func (d *Driver) GetBackupInfo(backupURL string) (map[string]string, error) {
@@ -587,7 +1104,11 @@ func (d *Driver) GetBackupInfo(backupURL string) (map[string]string, error) {
 }
 
 func (d *Driver) ListBackup(destURL string, opts map[string]string) (map[string]map[string]string, error) {
-	return objectstore.List(opts[OPT_VOLUME_NAME], destURL, d.Name())
+	listOpts, err := objectstore.ParseListOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return objectstore.ListWithOptions(destURL, d.Name(), listOpts)
 }
 
 func flock(volume *Volume) (*os.File, error) {
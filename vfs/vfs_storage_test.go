@@ -0,0 +1,564 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	root string
+}
+
+var _ = Suite(&TestSuite{})
+
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.root, err = ioutil.TempDir("", "convoy-vfs")
+	c.Assert(err, IsNil)
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	c.Assert(os.RemoveAll(s.root), IsNil)
+}
+
+func (s *TestSuite) initDriver(c *C, mode string) *Driver {
+	driver, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		VFS_PATH:          filepath.Join(s.root, "volumes"),
+		VFS_SNAPSHOT_MODE: mode,
+	})
+	c.Assert(err, IsNil)
+	return driver.(*Driver)
+}
+
+func (s *TestSuite) createVolume(c *C, d *Driver, name string) string {
+	c.Assert(d.CreateVolume(Request{
+		Name: name,
+		Options: map[string]string{
+			OPT_PREPARE_FOR_VM: "false",
+		},
+	}), IsNil)
+	return filepath.Join(s.root, "volumes", name)
+}
+
+func (s *TestSuite) createSnapshot(c *C, d *Driver, name, volumeName string) string {
+	c.Assert(d.CreateSnapshot(Request{
+		Name: name,
+		Options: map[string]string{
+			OPT_VOLUME_NAME: volumeName,
+		},
+	}), IsNil)
+	info, err := d.getSnapshotInfo(name, volumeName)
+	c.Assert(err, IsNil)
+	return info["FilePath"]
+}
+
+func sameInode(c *C, file1, file2 string) bool {
+	st1, err := os.Stat(file1)
+	c.Assert(err, IsNil)
+	st2, err := os.Stat(file2)
+	c.Assert(err, IsNil)
+	return os.SameFile(st1, st2)
+}
+
+func (s *TestSuite) TestInvalidSnapshotMode(c *C) {
+	_, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		VFS_PATH:          filepath.Join(s.root, "volumes"),
+		VFS_SNAPSHOT_MODE: "differential",
+	})
+	c.Assert(err, ErrorMatches, "Invalid snapshot mode.*")
+}
+
+func (s *TestSuite) TestIncrementalSnapshot(c *C) {
+	d := s.initDriver(c, SNAPSHOT_MODE_INCREMENTAL)
+	volumePath := s.createVolume(c, d, "vol1")
+
+	c.Assert(os.Mkdir(filepath.Join(volumePath, "dir"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volumePath, "dir", "unchanged"), []byte("unchanged"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volumePath, "changed"), []byte("version 1"), 0644), IsNil)
+	c.Assert(os.Symlink("dir/unchanged", filepath.Join(volumePath, "link")), IsNil)
+
+	snap1 := s.createSnapshot(c, d, "snap1", "vol1")
+	c.Assert(ioutil.WriteFile(filepath.Join(volumePath, "changed"), []byte("version 2"), 0644), IsNil)
+	snap2 := s.createSnapshot(c, d, "snap2", "vol1")
+
+	// Unchanged file is shared between snapshots, but never with the volume
+	c.Assert(sameInode(c, filepath.Join(snap1, "dir", "unchanged"), filepath.Join(snap2, "dir", "unchanged")), Equals, true)
+	c.Assert(sameInode(c, filepath.Join(snap1, "dir", "unchanged"), filepath.Join(volumePath, "dir", "unchanged")), Equals, false)
+	c.Assert(sameInode(c, filepath.Join(snap1, "changed"), filepath.Join(snap2, "changed")), Equals, false)
+
+	data, err := ioutil.ReadFile(filepath.Join(snap1, "changed"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "version 1")
+	target, err := os.Readlink(filepath.Join(snap2, "link"))
+	c.Assert(err, IsNil)
+	c.Assert(target, Equals, "dir/unchanged")
+
+	// Deleting the base snapshot doesn't affect the later one
+	c.Assert(d.DeleteSnapshot(Request{
+		Name:    "snap1",
+		Options: map[string]string{OPT_VOLUME_NAME: "vol1"},
+	}), IsNil)
+	_, err = os.Stat(snap1)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	data, err = ioutil.ReadFile(filepath.Join(snap2, "dir", "unchanged"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "unchanged")
+}
+
+func (s *TestSuite) TestIncrementalSnapshotBackup(c *C) {
+	d := s.initDriver(c, SNAPSHOT_MODE_INCREMENTAL)
+	volumePath := s.createVolume(c, d, "vol1")
+	c.Assert(ioutil.WriteFile(filepath.Join(volumePath, "file"), []byte("content"), 0644), IsNil)
+	s.createSnapshot(c, d, "snap1", "vol1")
+
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	backupURL, err := d.CreateBackup("snap1", "vol1", "vfs://"+dest, map[string]string{})
+	c.Assert(err, IsNil)
+
+	c.Assert(d.CreateVolume(Request{
+		Name: "restored",
+		Options: map[string]string{
+			OPT_BACKUP_URL:     backupURL,
+			OPT_PREPARE_FOR_VM: "false",
+		},
+	}), IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "volumes", "restored", "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "content")
+}
+
+func (s *TestSuite) TestCompressedSnapshotBackup(c *C) {
+	d := s.initDriver(c, SNAPSHOT_MODE_FULL)
+	volumePath := s.createVolume(c, d, "vol1")
+	c.Assert(ioutil.WriteFile(filepath.Join(volumePath, "file"), []byte("content"), 0644), IsNil)
+
+	err := d.CreateSnapshot(Request{
+		Name: "snap0",
+		Options: map[string]string{
+			OPT_VOLUME_NAME: "vol1",
+			OPT_COMPRESSION: "bzip2",
+		},
+	})
+	c.Assert(err, ErrorMatches, "Invalid compression bzip2.*")
+
+	c.Assert(d.CreateSnapshot(Request{
+		Name: "snap1",
+		Options: map[string]string{
+			OPT_VOLUME_NAME: "vol1",
+			OPT_COMPRESSION: "zstd",
+		},
+	}), IsNil)
+	info, err := d.getSnapshotInfo("snap1", "vol1")
+	c.Assert(err, IsNil)
+	c.Assert(info[OPT_COMPRESSION], Equals, "zstd")
+	c.Assert(strings.HasSuffix(info["FilePath"], ".tar.zst"), Equals, true)
+
+	// Backup keeps the compression of snapshot unless specified
+	dest := filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	for _, compression := range []string{"", "lz4"} {
+		backupURL, err := d.CreateBackup("snap1", "vol1", "vfs://"+dest, map[string]string{
+			OPT_COMPRESSION: compression,
+		})
+		c.Assert(err, IsNil)
+
+		volumeName := "restored-" + compression
+		c.Assert(d.CreateVolume(Request{
+			Name: volumeName,
+			Options: map[string]string{
+				OPT_BACKUP_URL:     backupURL,
+				OPT_PREPARE_FOR_VM: "false",
+			},
+		}), IsNil)
+		data, err := ioutil.ReadFile(filepath.Join(s.root, "volumes", volumeName, "file"))
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "content")
+	}
+}
+
+func (s *TestSuite) testCreateVolumeFromSnapshot(c *C, mode string) {
+	d := s.initDriver(c, mode)
+	volPath := s.createVolume(c, d, "vol")
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "file"), []byte("snapshot"), 0644), IsNil)
+	snapPath := s.createSnapshot(c, d, "snap", "vol")
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "file"), []byte("changed"), 0644), IsNil)
+
+	c.Assert(d.CreateVolume(Request{
+		Name: "clone",
+		Options: map[string]string{
+			OPT_PREPARE_FOR_VM:       "false",
+			OPT_SNAPSHOT_NAME:        "snap",
+			OPT_SNAPSHOT_VOLUME_NAME: "vol",
+		},
+	}), IsNil)
+	clonePath := filepath.Join(s.root, "volumes", "clone")
+	data, err := ioutil.ReadFile(filepath.Join(clonePath, "file"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "snapshot")
+
+	// Files of incremental snapshot must be copied rather than linked
+	if mode == SNAPSHOT_MODE_INCREMENTAL {
+		c.Assert(sameInode(c, filepath.Join(snapPath, "file"), filepath.Join(clonePath, "file")), Equals, false)
+	}
+
+	err = d.CreateVolume(Request{
+		Name: "clone-missing",
+		Options: map[string]string{
+			OPT_PREPARE_FOR_VM:       "false",
+			OPT_SNAPSHOT_NAME:        "nonexistent",
+			OPT_SNAPSHOT_VOLUME_NAME: "vol",
+		},
+	})
+	c.Assert(err, ErrorMatches, "Snapshot nonexistent doesn't exists.*")
+}
+
+func (s *TestSuite) TestCreateVolumeFromFullSnapshot(c *C) {
+	s.testCreateVolumeFromSnapshot(c, SNAPSHOT_MODE_FULL)
+}
+
+func (s *TestSuite) TestCreateVolumeFromIncrementalSnapshot(c *C) {
+	s.testCreateVolumeFromSnapshot(c, SNAPSHOT_MODE_INCREMENTAL)
+}
+
+func (s *TestSuite) testDiffSnapshot(c *C, mode string) {
+	d := s.initDriver(c, mode)
+	volPath := s.createVolume(c, d, "vol")
+	c.Assert(os.Mkdir(filepath.Join(volPath, "dir"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "dir", "unchanged"), []byte("unchanged"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "changed"), []byte("version 1"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "deleted"), []byte("deleted"), 0644), IsNil)
+	s.createSnapshot(c, d, "snap1", "vol")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "changed"), []byte("version 10"), 0644), IsNil)
+	c.Assert(os.Remove(filepath.Join(volPath, "deleted")), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "dir", "added"), []byte("added"), 0644), IsNil)
+	s.createSnapshot(c, d, "snap2", "vol")
+
+	diff, err := d.DiffSnapshot(Request{
+		Name: "snap2",
+		Options: map[string]string{
+			OPT_VOLUME_NAME:           "vol",
+			OPT_COMPARE_SNAPSHOT_NAME: "snap1",
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(diff.Files, DeepEquals, []FileChange{
+		{Path: "changed", Change: FILE_CHANGE_MODIFIED, Size: 10},
+		{Path: "deleted", Change: FILE_CHANGE_DELETED},
+		{Path: "dir/added", Change: FILE_CHANGE_ADDED, Size: 5},
+	})
+	c.Assert(diff.ChangedBytes, Equals, int64(15))
+
+	_, err = d.DiffSnapshot(Request{
+		Name: "snap2",
+		Options: map[string]string{
+			OPT_VOLUME_NAME:           "vol",
+			OPT_COMPARE_SNAPSHOT_NAME: "nonexistent",
+		},
+	})
+	c.Assert(err, ErrorMatches, "Snapshot nonexistent doesn't exists.*")
+}
+
+func (s *TestSuite) TestDiffFullSnapshot(c *C) {
+	s.testDiffSnapshot(c, SNAPSHOT_MODE_FULL)
+}
+
+func (s *TestSuite) TestDiffIncrementalSnapshot(c *C) {
+	s.testDiffSnapshot(c, SNAPSHOT_MODE_INCREMENTAL)
+}
+
+func (s *TestSuite) testIncrementalBackup(c *C, mode string) {
+	driver, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		VFS_PATH:          filepath.Join(s.root, "volumes"),
+		VFS_SNAPSHOT_MODE: mode,
+		VFS_BACKUP_MODE:   BACKUP_MODE_INCREMENTAL,
+	})
+	c.Assert(err, IsNil)
+	d := driver.(*Driver)
+	volPath := s.createVolume(c, d, "vol")
+	c.Assert(os.Mkdir(filepath.Join(volPath, "dir"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "dir", "unchanged"), []byte("unchanged"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "changed"), []byte("version 1"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "replaced"), []byte("file"), 0644), IsNil)
+	s.createSnapshot(c, d, "snap1", "vol")
+
+	dest := "vfs://" + filepath.Join(s.root, "backups")
+	c.Assert(os.Mkdir(filepath.Join(s.root, "backups"), 0700), IsNil)
+	// Created time of snapshot is passed by the daemon
+	backupOpts := func(snapshotName string) map[string]string {
+		info, err := d.getSnapshotInfo(snapshotName, "vol")
+		c.Assert(err, IsNil)
+		return map[string]string{
+			OPT_SNAPSHOT_CREATED_TIME: info[OPT_SNAPSHOT_CREATED_TIME],
+		}
+	}
+	url1, err := d.CreateBackup("snap1", "vol", dest, backupOpts("snap1"))
+	c.Assert(err, IsNil)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "changed"), []byte("version 10"), 0644), IsNil)
+	c.Assert(os.Remove(filepath.Join(volPath, "replaced")), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(volPath, "replaced"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(volPath, "replaced", "added"), []byte("added"), 0644), IsNil)
+	s.createSnapshot(c, d, "snap2", "vol")
+	url2, err := d.CreateBackup("snap2", "vol", dest, backupOpts("snap2"))
+	c.Assert(err, IsNil)
+	info, err := d.GetBackupInfo(url2)
+	c.Assert(err, IsNil)
+	c.Assert(info["ParentBackupURL"], Equals, url1)
+
+	// Full backup without the snapshot of the last backup
+	c.Assert(d.DeleteSnapshot(Request{
+		Name:    "snap2",
+		Options: map[string]string{OPT_VOLUME_NAME: "vol"},
+	}), IsNil)
+	url3, err := d.CreateBackup("snap1", "vol", dest, backupOpts("snap1"))
+	c.Assert(err, IsNil)
+	info, err = d.GetBackupInfo(url3)
+	c.Assert(err, IsNil)
+	c.Assert(info["ParentBackupURL"], Equals, "")
+
+	// Incremental backup is still restorable once its parent is deleted
+	c.Assert(d.DeleteBackup(url1), IsNil)
+	c.Assert(d.CreateVolume(Request{
+		Name: "restored",
+		Options: map[string]string{
+			OPT_BACKUP_URL:     url2,
+			OPT_PREPARE_FOR_VM: "false",
+		},
+	}), IsNil)
+	restored := filepath.Join(s.root, "volumes", "restored")
+	for path, content := range map[string]string{
+		"dir/unchanged":  "unchanged",
+		"changed":        "version 10",
+		"replaced/added": "added",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(restored, path))
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, content)
+	}
+}
+
+func (s *TestSuite) TestIncrementalBackupOfFullSnapshots(c *C) {
+	s.testIncrementalBackup(c, SNAPSHOT_MODE_FULL)
+}
+
+func (s *TestSuite) TestIncrementalBackupOfIncrementalSnapshots(c *C) {
+	s.testIncrementalBackup(c, SNAPSHOT_MODE_INCREMENTAL)
+}
+
+func (s *TestSuite) TestInvalidSnapshotConsistency(c *C) {
+	_, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		VFS_PATH:                 filepath.Join(s.root, "volumes"),
+		VFS_SNAPSHOT_CONSISTENCY: "sync",
+	})
+	c.Assert(err, ErrorMatches, "Invalid snapshot consistency sync.*")
+}
+
+func (s *TestSuite) TestGetMountPoint(c *C) {
+	mountPoint, err := getMountPoint(s.root)
+	c.Assert(err, IsNil)
+	rootMountPoint, err := getMountPoint("/")
+	c.Assert(err, IsNil)
+	c.Assert(rootMountPoint, Equals, "/")
+	// The temporary directory is on the same filesystem as its parent
+	// directory, or the mount point itself
+	c.Assert(strings.HasPrefix(s.root, mountPoint), Equals, true)
+}
+
+func (s *TestSuite) TestFreezeRequiresOwnFilesystem(c *C) {
+	driver, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		VFS_PATH:                 filepath.Join(s.root, "volumes"),
+		VFS_SNAPSHOT_CONSISTENCY: SNAPSHOT_CONSISTENCY_FSFREEZE,
+	})
+	c.Assert(err, IsNil)
+	d := driver.(*Driver)
+	s.createVolume(c, d, "vol")
+
+	// Unmounted volume is not quiesced
+	s.createSnapshot(c, d, "snap1", "vol")
+
+	_, err = d.MountVolume(Request{Name: "vol", Options: map[string]string{}})
+	c.Assert(err, IsNil)
+	err = d.CreateSnapshot(Request{
+		Name: "snap2",
+		Options: map[string]string{
+			OPT_VOLUME_NAME: "vol",
+		},
+	})
+	c.Assert(err, ErrorMatches, "Cannot freeze volume vol, .* is not the mount point of its own filesystem")
+}
+
+func (s *TestSuite) TestVolumeUsage(c *C) {
+	d := s.initDriver(c, SNAPSHOT_MODE_FULL)
+	volumePath := s.createVolume(c, d, "vol")
+
+	info, err := d.GetVolumeInfo("vol")
+	c.Assert(err, IsNil)
+	emptyUsed, err := strconv.ParseInt(info[OPT_USED_SIZE], 10, 64)
+	c.Assert(err, IsNil)
+	c.Assert(info[OPT_ALLOCATED_SIZE], Equals, info[OPT_USED_SIZE])
+
+	// Usage is cached
+	c.Assert(ioutil.WriteFile(filepath.Join(volumePath, "data"), make([]byte, 1<<20), 0644), IsNil)
+	info, err = d.GetVolumeInfo("vol")
+	c.Assert(err, IsNil)
+	c.Assert(info[OPT_USED_SIZE], Equals, strconv.FormatInt(emptyUsed, 10))
+
+	d.usage.Invalidate("vol")
+	info, err = d.GetVolumeInfo("vol")
+	c.Assert(err, IsNil)
+	used, err := strconv.ParseInt(info[OPT_USED_SIZE], 10, 64)
+	c.Assert(err, IsNil)
+	c.Assert(used-emptyUsed >= 1<<20, Equals, true)
+}
+
+func (s *TestSuite) TestInvalidNFSExport(c *C) {
+	for _, t := range []struct {
+		key, value, message string
+	}{
+		{VFS_NFS_EXPORT, "nfs1", "Invalid NFS export nfs1.*"},
+		{VFS_NFS_EXPORT, "nfs1:export", "Invalid NFS export nfs1:export.*"},
+		{VFS_NFS_OPTIONS, "vers=4", "vfs.nfsoptions requires vfs.nfsexport"},
+		{VFS_REMOVE_ON_DELETE, "sometimes", "Invalid vfs.removeondelete sometimes"},
+	} {
+		_, err := Init(filepath.Join(s.root, "root"), map[string]string{
+			VFS_PATH: filepath.Join(s.root, "volumes"),
+			t.key:    t.value,
+		})
+		c.Assert(err, ErrorMatches, t.message)
+	}
+}
+
+func (s *TestSuite) TestRemoveOnDelete(c *C) {
+	driver, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		VFS_PATH:             filepath.Join(s.root, "volumes"),
+		VFS_REMOVE_ON_DELETE: "true",
+	})
+	c.Assert(err, IsNil)
+	d := driver.(*Driver)
+	c.Assert(d.CheckHealth(), HasLen, 1)
+
+	volumePath := s.createVolume(c, d, "vol1")
+	c.Assert(d.DeleteVolume(Request{
+		Name:    "vol1",
+		Options: map[string]string{OPT_REFERENCE_ONLY: "true"},
+	}), IsNil)
+	_, err = os.Stat(volumePath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TestSuite) TestBindMount(c *C) {
+	d := s.initDriver(c, SNAPSHOT_MODE_FULL)
+	c.Assert(d.CreateVolume(Request{
+		Name: "vol1",
+		Options: map[string]string{
+			OPT_PREPARE_FOR_VM: "false",
+			OPT_MOUNT_OPTIONS:  "noatime",
+		},
+	}), ErrorMatches, "Unsupported bind mount option noatime.*")
+
+	c.Assert(d.CreateVolume(Request{
+		Name: "vol1",
+		Options: map[string]string{
+			OPT_PREPARE_FOR_VM: "false",
+			OPT_MOUNT_OPTIONS:  "nosuid,rprivate",
+		},
+	}), IsNil)
+	volumePath := filepath.Join(s.root, "volumes", "vol1")
+	c.Assert(ioutil.WriteFile(filepath.Join(volumePath, "data"), []byte("data"), 0644), IsNil)
+
+	// Volume with mount options is bind mounted rather than used in place
+	mountPoint, err := d.MountVolume(Request{Name: "vol1", Options: map[string]string{}})
+	c.Assert(err, IsNil)
+	c.Assert(mountPoint, Equals, filepath.Join(s.root, "root", MOUNTS_DIR, "vol1"))
+	mounted, err := util.IsMountPoint(mountPoint)
+	c.Assert(err, IsNil)
+	c.Assert(mounted, Equals, true)
+	data, err := ioutil.ReadFile(filepath.Join(mountPoint, "data"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "data")
+
+	// Mount point is corrected if it's umounted outside
+	_, err = util.Execute("umount", []string{mountPoint})
+	c.Assert(err, IsNil)
+	mountPoint, err = d.RefreshMountPoint(Request{Name: "vol1"})
+	c.Assert(err, IsNil)
+	c.Assert(mountPoint, Equals, "")
+
+	_, err = d.MountVolume(Request{Name: "vol1", Options: map[string]string{OPT_MOUNT_TIMEOUT: "invalid"}})
+	c.Assert(err, ErrorMatches, "Invalid timeout value invalid")
+
+	mountPoint, err = d.MountVolume(Request{Name: "vol1", Options: map[string]string{OPT_MOUNT_TIMEOUT: "30s"}})
+	c.Assert(err, IsNil)
+	c.Assert(d.UmountVolume(Request{Name: "vol1"}), IsNil)
+	mounted, err = util.IsMountPoint(mountPoint)
+	c.Assert(err, IsNil)
+	c.Assert(mounted, Equals, false)
+	_, err = os.Stat(mountPoint)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// Volume without mount options is used in place
+	volumePath = s.createVolume(c, d, "vol2")
+	mountPoint, err = d.MountVolume(Request{Name: "vol2", Options: map[string]string{}})
+	c.Assert(err, IsNil)
+	c.Assert(mountPoint, Equals, volumePath)
+	c.Assert(d.UmountVolume(Request{Name: "vol2"}), IsNil)
+}
+
+func (s *TestSuite) TestVolumeOwnership(c *C) {
+	d := s.initDriver(c, SNAPSHOT_MODE_FULL)
+	c.Assert(d.CreateVolume(Request{
+		Name: "vol1",
+		Options: map[string]string{
+			OPT_PREPARE_FOR_VM: "false",
+			OPT_UID:            "root",
+		},
+	}), ErrorMatches, "Invalid uid root.*")
+
+	c.Assert(d.CreateVolume(Request{
+		Name: "vol1",
+		Options: map[string]string{
+			OPT_PREPARE_FOR_VM: "false",
+			OPT_UID:            "1000",
+			OPT_GID:            "1000",
+			OPT_MODE:           "0770",
+		},
+	}), IsNil)
+	volumePath := filepath.Join(s.root, "volumes", "vol1")
+	assertOwnership(c, volumePath, 1000, 1000, 0770)
+
+	// Restored snapshot has the owner and permission of the original volume
+	s.createSnapshot(c, d, "snap1", "vol1")
+	c.Assert(d.CreateVolume(Request{
+		Name: "vol2",
+		Options: map[string]string{
+			OPT_PREPARE_FOR_VM:       "false",
+			OPT_SNAPSHOT_NAME:        "snap1",
+			OPT_SNAPSHOT_VOLUME_NAME: "vol1",
+			OPT_GID:                  "2000",
+			OPT_MODE:                 "2775",
+		},
+	}), IsNil)
+	assertOwnership(c, filepath.Join(s.root, "volumes", "vol2"), 1000, 2000, 0775|os.ModeSetgid)
+}
+
+func assertOwnership(c *C, path string, uid, gid uint32, mode os.FileMode) {
+	st, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(st.Mode()&(os.ModePerm|os.ModeSetgid), Equals, mode)
+	c.Assert(st.Sys().(*syscall.Stat_t).Uid, Equals, uid)
+	c.Assert(st.Sys().(*syscall.Stat_t).Gid, Equals, gid)
+}
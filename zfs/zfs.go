@@ -0,0 +1,1069 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "github.com/rancher/convoy/logging"
+)
+
+const (
+	DRIVER_NAME        = "zfs"
+	DRIVER_CONFIG_FILE = "zfs.cfg"
+
+	VOLUME_CFG_PREFIX = "volume_"
+	DRIVER_CFG_PREFIX = DRIVER_NAME + "_"
+	CFG_POSTFIX       = ".json"
+
+	MOUNTS_DIR = "mounts"
+
+	ZFS_DATASET             = "zfs.dataset"
+	ZFS_DEFAULT_VOLUME_SIZE = "zfs.defaultvolumesize"
+
+	// Snapshots taken for cloning volumes are named by the clone, with a
+	// prefix which cannot be in the names of Convoy
+	CLONE_SNAPSHOT_PREFIX = "clone:"
+
+	ZFS_BINARY = "zfs"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "zfs"})
+
+	zfsBinary = ZFS_BINARY
+)
+
+type Driver struct {
+	mutex *sync.RWMutex
+	Device
+}
+
+func init() {
+	if err := Register(DRIVER_NAME, Init); err != nil {
+		panic(err)
+	}
+}
+
+func (d *Driver) Name() string {
+	return DRIVER_NAME
+}
+
+type Device struct {
+	Root string
+	// Parent dataset of the volumes, e.g. tank/convoy
+	Dataset string
+	// Quota of volumes created without --size, 0 for no quota
+	DefaultVolumeSize int64
+}
+
+func (dev *Device) ConfigFile() (string, error) {
+	if dev.Root == "" {
+		return "", fmt.Errorf("BUG: Invalid empty device config path")
+	}
+	return filepath.Join(dev.Root, DRIVER_CONFIG_FILE), nil
+}
+
+type Volume struct {
+	Name    string
+	Dataset string
+	// Quota of the dataset, 0 for no quota
+	Size int64
+	// Snapshot the dataset is cloned from, e.g. tank/convoy/vol1@snap1,
+	// which is destroyed with the volume if OwnsOrigin is set
+	Origin      string
+	OwnsOrigin  bool
+	MountPoint  string
+	CreatedTime string
+	Snapshots   map[string]Snapshot
+	// Comma separated options used when mounting the volume
+	MountOptions string
+	// Always mount the volume read-only
+	ReadOnly bool
+	// Whether the current mount is read-only
+	MountedReadOnly bool
+
+	configPath string
+}
+
+type Snapshot struct {
+	Name        string
+	CreatedTime string
+}
+
+func (v *Volume) ConfigFile() (string, error) {
+	if v.Name == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume name")
+	}
+	if v.configPath == "" {
+		return "", fmt.Errorf("BUG: Invalid empty volume config path")
+	}
+	return filepath.Join(v.configPath, DRIVER_CFG_PREFIX+VOLUME_CFG_PREFIX+v.Name+CFG_POSTFIX), nil
+}
+
+// GetDevice returns the dataset, which is mounted by mount -t zfs since its
+// mountpoint is legacy
+func (v *Volume) GetDevice() (string, error) {
+	return v.Dataset, nil
+}
+
+func (v *Volume) GetMountOpts() []string {
+	options := util.ReadOnlyMountOptions(v.MountOptions, v.MountedReadOnly)
+	return append([]string{"-t", "zfs"}, util.MountOptionsArgs(options)...)
+}
+
+func (v *Volume) GenerateDefaultMountPoint() string {
+	return filepath.Join(v.configPath, MOUNTS_DIR, v.Name)
+}
+
+func (v *Volume) snapshotName(name string) string {
+	return v.Dataset + "@" + name
+}
+
+// checkName fails if name of volume or snapshot isn't allowed in ZFS, which
+// doesn't allow "~" in names of datasets and snapshots
+func checkName(name string) error {
+	if strings.Contains(name, "~") {
+		return util.NewConvoyDriverErr(fmt.Errorf("Invalid name %v, %v doesn't support ~ in names", name, DRIVER_NAME), util.ErrInvalidRequestCode)
+	}
+	return nil
+}
+
+func (device *Device) listVolumeNames() ([]string, error) {
+	return util.ListConfigIDs(device.Root, DRIVER_CFG_PREFIX+VOLUME_CFG_PREFIX, CFG_POSTFIX)
+}
+
+// parseConfig sets the options of dev by config, keeping the current ones if
+// they're not specified
+func parseConfig(dev *Device, config map[string]string) error {
+	if value, exists := config[ZFS_DATASET]; exists {
+		dev.Dataset = strings.Trim(value, "/")
+	}
+	if dev.Dataset == "" {
+		return fmt.Errorf("Missing required parameter: %v", ZFS_DATASET)
+	}
+	if value, exists := config[ZFS_DEFAULT_VOLUME_SIZE]; exists {
+		size, err := util.ParseSize(value)
+		if err != nil || size < 0 {
+			return fmt.Errorf("Invalid %v %v", ZFS_DEFAULT_VOLUME_SIZE, value)
+		}
+		dev.DefaultVolumeSize = size
+	}
+	return nil
+}
+
+func Init(root string, config map[string]string) (ConvoyDriver, error) {
+	dev := &Device{
+		Root: root,
+	}
+	exists, err := util.ObjectExists(dev)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if err := util.ObjectLoad(dev); err != nil {
+			return nil, err
+		}
+	} else if err := util.MkdirIfNotExists(root); err != nil {
+		return nil, err
+	}
+	if err := parseConfig(dev, config); err != nil {
+		return nil, err
+	}
+	d := &Driver{
+		mutex:  &sync.RWMutex{},
+		Device: *dev,
+	}
+	if _, err := d.getProperty(context.Background(), dev.Dataset, "available"); err != nil {
+		return nil, fmt.Errorf("Cannot find dataset %v: %v", dev.Dataset, err)
+	}
+	if err := util.ObjectSave(dev); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Driver) zfs(ctx context.Context, args ...string) (string, error) {
+	return util.ExecuteWithContext(ctx, zfsBinary, args)
+}
+
+// getProperty returns the value of a numeric property of dataset or snapshot
+func (d *Driver) getProperty(ctx context.Context, name, property string) (int64, error) {
+	output, err := d.zfs(ctx, "list", "-Hp", "-o", property, name)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unexpected %v of %v: %v", property, name, output)
+	}
+	return value, nil
+}
+
+func (d *Driver) Info() (map[string]string, error) {
+	info := map[string]string{
+		"Root":              d.Root,
+		"Dataset":           d.Dataset,
+		"DefaultVolumeSize": strconv.FormatInt(d.DefaultVolumeSize, 10),
+	}
+	available, err := d.getProperty(context.Background(), d.Dataset, "available")
+	if err != nil {
+		log.Warnf("Failed to get available space of dataset %v: %v", d.Dataset, err)
+		return info, nil
+	}
+	info["AvailableSize"] = strconv.FormatInt(available, 10)
+	return info, nil
+}
+
+func (d *Driver) CheckHealth() []HealthCheck {
+	_, err := d.getProperty(context.Background(), d.Dataset, "available")
+	return []HealthCheck{{
+		Name:  "dataset " + d.Dataset,
+		Error: err,
+	}}
+}
+
+func (d *Driver) GetFreeSpace() (int64, error) {
+	return d.getProperty(context.Background(), d.Dataset, "available")
+}
+
+func (d *Driver) VolumeOps() (VolumeOperations, error) {
+	return d, nil
+}
+
+func (d *Driver) blankVolume(name string) *Volume {
+	return &Volume{
+		configPath: d.Root,
+		Name:       name,
+	}
+}
+
+func (d *Driver) getSize(opts map[string]string, defaultVolumeSize int64) (int64, error) {
+	size := opts[OPT_SIZE]
+	if size == "" || size == "0" {
+		size = strconv.FormatInt(defaultVolumeSize, 10)
+	}
+	return util.ParseSize(size)
+}
+
+func quotaOption(size int64) []string {
+	if size == 0 {
+		return nil
+	}
+	return []string{"-o", "refquota=" + strconv.FormatInt(size, 10)}
+}
+
+/*
+CreateVolume creates a dataset under the dataset of driver. Volume of
+snapshot is a ZFS clone of it, and so is the clone of volume, of a snapshot
+taken for it. Backups of zfs are received from the objectstore, and backups
+of files from other drivers are extracted to a new dataset.
+*/
+func (d *Driver) CreateVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	opts := req.Options
+
+	if opts[OPT_UID] != "" || opts[OPT_GID] != "" || opts[OPT_MODE] != "" {
+		return fmt.Errorf("Owner and permission of volume are not supported by %v", d.Name())
+	}
+	if err := checkName(id); err != nil {
+		return err
+	}
+	volume := d.blankVolume(id)
+	exists, err := util.ObjectExists(volume)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Volume %v already exists", id)
+	}
+	volume.Dataset = d.Dataset + "/" + id
+	volume.CreatedTime = util.Now()
+	volume.Snapshots = map[string]Snapshot{}
+	volume.MountOptions = opts[OPT_MOUNT_OPTIONS]
+	volume.ReadOnly = opts[OPT_READ_ONLY] == "true"
+
+	ctx := req.Context()
+	backupURL := opts[OPT_BACKUP_URL]
+	snapshotName := opts[OPT_SNAPSHOT_NAME]
+	cloneSource := opts[OPT_CLONE_SOURCE]
+	switch {
+	case cloneSource != "":
+		if backupURL != "" || snapshotName != "" {
+			return fmt.Errorf("Cannot clone volume from backup or snapshot")
+		}
+		err = d.cloneVolume(ctx, volume, cloneSource, opts)
+	case snapshotName != "":
+		if backupURL != "" {
+			return fmt.Errorf("Cannot create volume from both backup and snapshot")
+		}
+		err = d.createVolumeFromSnapshot(ctx, volume, snapshotName, opts)
+	case backupURL != "":
+		err = d.restoreVolume(ctx, volume, backupURL, opts)
+	default:
+		if volume.Size, err = d.getSize(opts, d.DefaultVolumeSize); err != nil {
+			return err
+		}
+		args := append([]string{"create", "-o", "mountpoint=legacy"}, quotaOption(volume.Size)...)
+		_, err = d.zfs(ctx, append(args, volume.Dataset)...)
+	}
+	if err != nil {
+		return err
+	}
+	return util.ObjectSave(volume)
+}
+
+// CloneVolume creates the volume as a ZFS clone of a snapshot of the volume
+// req.Options[OPT_CLONE_SOURCE], which is taken for it and destroyed with it
+func (d *Driver) CloneVolume(req Request) error {
+	return d.CreateVolume(req)
+}
+
+func (d *Driver) cloneVolume(ctx context.Context, volume *Volume, sourceID string, opts map[string]string) error {
+	source := d.blankVolume(sourceID)
+	if err := util.ObjectLoad(source); err != nil {
+		return err
+	}
+	volume.Size = source.Size
+	if volume.MountOptions == "" {
+		volume.MountOptions = source.MountOptions
+	}
+	volume.Origin = source.snapshotName(CLONE_SNAPSHOT_PREFIX + volume.Name)
+	volume.OwnsOrigin = true
+	if _, err := d.zfs(ctx, "snapshot", volume.Origin); err != nil {
+		return err
+	}
+	if err := d.clone(ctx, volume); err != nil {
+		if _, destroyErr := d.zfs(ctx, "destroy", volume.Origin); destroyErr != nil {
+			log.Warnf("Failed to destroy snapshot %v for failed clone %v: %v", volume.Origin, volume.Name, destroyErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *Driver) createVolumeFromSnapshot(ctx context.Context, volume *Volume, snapshotName string, opts map[string]string) error {
+	source := d.blankVolume(opts[OPT_SNAPSHOT_VOLUME_NAME])
+	if err := util.ObjectLoad(source); err != nil {
+		return err
+	}
+	if _, exists := source.Snapshots[snapshotName]; !exists {
+		return fmt.Errorf("Cannot find snapshot %v of volume %v", snapshotName, source.Name)
+	}
+	var err error
+	if volume.Size, err = d.getSize(opts, source.Size); err != nil {
+		return err
+	}
+	volume.Origin = source.snapshotName(snapshotName)
+	return d.clone(ctx, volume)
+}
+
+func (d *Driver) clone(ctx context.Context, volume *Volume) error {
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: volume.Name,
+	}).Debugf("Cloning %v to %v", volume.Origin, volume.Dataset)
+	args := append([]string{"clone", "-o", "mountpoint=legacy"}, quotaOption(volume.Size)...)
+	_, err := d.zfs(ctx, append(args, volume.Origin, volume.Dataset)...)
+	return err
+}
+
+// restoreVolume receives the streams of zfs backup into the dataset of
+// volume, or extracts the files of backup of other drivers to a new one
+func (d *Driver) restoreVolume(ctx context.Context, volume *Volume, backupURL string, opts map[string]string) error {
+	objVolume, err := objectstore.LoadVolume(backupURL)
+	if err != nil {
+		return err
+	}
+	if objVolume.Driver != d.Name() {
+		format, err := objectstore.GetBackupFormat(backupURL)
+		if err != nil {
+			return err
+		}
+		if format != objectstore.BACKUP_FORMAT_FILES {
+			return fmt.Errorf("Cannot restore backup of %v to %v", objVolume.Driver, d.Name())
+		}
+		if volume.Size, err = d.getSize(opts, d.DefaultVolumeSize); err != nil {
+			return err
+		}
+		args := append([]string{"create", "-o", "mountpoint=legacy"}, quotaOption(volume.Size)...)
+		if _, err := d.zfs(ctx, append(args, volume.Dataset)...); err != nil {
+			return err
+		}
+		if err := restoreFilesBackup(volume, backupURL); err != nil {
+			d.destroyFailedVolume(volume)
+			return err
+		}
+		return nil
+	}
+
+	if volume.Size, err = d.getSize(opts, objVolume.Size); err != nil {
+		return err
+	}
+	if err := objectstore.RestoreStreamBackup(backupURL, func(stream io.Reader) error {
+		return d.receive(ctx, volume, stream)
+	}); err != nil {
+		d.destroyFailedVolume(volume)
+		return err
+	}
+	// Snapshots in the streams are not the ones of the new volume
+	output, err := d.zfs(ctx, "list", "-H", "-o", "name", "-t", "snapshot", "-d", "1", volume.Dataset)
+	if err == nil {
+		for _, snapshot := range strings.Fields(output) {
+			if _, err = d.zfs(ctx, "destroy", snapshot); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil && volume.Size != 0 {
+		_, err = d.zfs(ctx, "set", "refquota="+strconv.FormatInt(volume.Size, 10), volume.Dataset)
+	}
+	if err != nil {
+		d.destroyFailedVolume(volume)
+		return err
+	}
+	return nil
+}
+
+// receive receives a send stream into the dataset of volume, which is
+// created by the first full stream and updated by the incremental ones. The
+// dataset is never mounted by ZFS since its mountpoint is legacy.
+func (d *Driver) receive(ctx context.Context, volume *Volume, stream io.Reader) error {
+	args := []string{"receive", "-u", "-F", volume.Dataset}
+	if _, err := d.zfs(ctx, "list", "-H", "-o", "name", volume.Dataset); err != nil {
+		args = []string{"receive", "-u", "-o", "mountpoint=legacy", volume.Dataset}
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, zfsBinary, args...)
+	util.KillProcessGroupOnCancel(cmd)
+	cmd.Stdin = stream
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Failed to execute: %v %v, output %v, error %v", zfsBinary, args, stderr.String(), err)
+	}
+	return nil
+}
+
+// restoreFilesBackup mounts the volume temporarily to extract the backup
+func restoreFilesBackup(volume *Volume, backupURL string) error {
+	mountPoint, err := util.VolumeMount(volume, "", false)
+	if err != nil {
+		return err
+	}
+	restoreErr := objectstore.RestoreFilesBackup(backupURL, mountPoint)
+	if err := util.VolumeUmount(volume); err != nil {
+		return err
+	}
+	return restoreErr
+}
+
+func (d *Driver) destroyFailedVolume(volume *Volume) {
+	if _, err := d.zfs(context.Background(), "destroy", "-r", volume.Dataset); err != nil {
+		log.Warnf("Failed to destroy dataset %v of failed volume %v: %v", volume.Dataset, volume.Name, err)
+	}
+}
+
+// ResizeVolume raises the quota of volume to req.Options[OPT_SIZE], the
+// filesystem has the new size immediately
+func (d *Driver) ResizeVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	size, err := util.ParseSize(req.Options[OPT_SIZE])
+	if err != nil {
+		return err
+	}
+	if size <= volume.Size {
+		return fmt.Errorf("New size %v must be larger than current size %v of volume %v", size, volume.Size, id)
+	}
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_RESIZE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: id,
+		LOG_FIELD_SIZE:   size,
+	}).Debugf("Setting quota of dataset %v", volume.Dataset)
+	if _, err := d.zfs(req.Context(), "set", "refquota="+strconv.FormatInt(size, 10), volume.Dataset); err != nil {
+		return err
+	}
+	volume.Size = size
+	return util.ObjectSave(volume)
+}
+
+// cloneOf returns the volume cloned from the origin snapshot, if any. Caller
+// must hold the lock of driver.
+func (d *Driver) cloneOf(origin string) (string, error) {
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return "", err
+	}
+	for _, id := range volumeIDs {
+		volume := d.blankVolume(id)
+		if err := util.ObjectLoad(volume); err != nil {
+			return "", err
+		}
+		if volume.Origin == origin || (origin[len(origin)-1] == '@' && strings.HasPrefix(volume.Origin, origin)) {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+// DeleteVolume destroys the dataset with its snapshots. Volumes cloned from
+// the volume or its snapshots have to be deleted first.
+func (d *Driver) DeleteVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if volume.MountPoint != "" {
+		return fmt.Errorf("Cannot delete volume %v. It is still mounted", id)
+	}
+	clone, err := d.cloneOf(volume.Dataset + "@")
+	if err != nil {
+		return err
+	}
+	if clone != "" {
+		return fmt.Errorf("Cannot delete volume %v, volume %v is cloned from it", id, clone)
+	}
+
+	ctx := req.Context()
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON: LOG_REASON_START,
+		LOG_FIELD_EVENT:  LOG_EVENT_REMOVE,
+		LOG_FIELD_OBJECT: LOG_OBJECT_VOLUME,
+		LOG_FIELD_VOLUME: id,
+	}).Debugf("Destroying dataset %v", volume.Dataset)
+	if _, err := d.zfs(ctx, "destroy", "-r", volume.Dataset); err != nil {
+		return err
+	}
+	if volume.OwnsOrigin {
+		if _, err := d.zfs(ctx, "destroy", volume.Origin); err != nil {
+			log.Warnf("Failed to destroy snapshot %v taken for clone %v: %v", volume.Origin, id, err)
+		}
+	}
+	return util.ObjectDelete(volume)
+}
+
+func (d *Driver) MountVolume(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	opts := req.Options
+
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+
+	ctx, cancel, err := util.ContextWithTimeout(req.Context(), opts[OPT_MOUNT_TIMEOUT])
+	if err != nil {
+		return "", err
+	}
+	defer cancel()
+
+	readOnly := volume.ReadOnly || opts[OPT_READ_ONLY] == "true"
+	if err := util.CheckMountMode(id, volume.MountPoint, volume.MountedReadOnly, readOnly); err != nil {
+		return "", err
+	}
+	volume.MountedReadOnly = readOnly
+
+	mountPoint, err := util.VolumeMountWithContext(ctx, volume, opts[OPT_MOUNT_POINT], false)
+	if err != nil {
+		return "", err
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+func (d *Driver) UmountVolume(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeUmountWithContext(req.Context(), volume); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) ForceUmountVolume(req Request) error {
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if err := util.VolumeForceUmount(req.Context(), volume, req.Options[OPT_KILL] == "true"); err != nil {
+		return err
+	}
+	volume.MountedReadOnly = false
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) MountPoint(req Request) (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	return volume.MountPoint, nil
+}
+
+func (d *Driver) RefreshMountPoint(req Request) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volume := d.blankVolume(req.Name)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	mountPoint, err := util.VolumeMountRefresh(volume)
+	if err != nil {
+		return "", err
+	}
+	if mountPoint == "" {
+		volume.MountedReadOnly = false
+	}
+	if err := util.ObjectSave(volume); err != nil {
+		return "", err
+	}
+	return mountPoint, nil
+}
+
+func (d *Driver) CleanupOrphanMounts() ([]string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	mountPoints := map[string]bool{}
+	for _, id := range volumeIDs {
+		volume := d.blankVolume(id)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		if volume.MountPoint != "" {
+			mountPoints[volume.MountPoint] = true
+		}
+	}
+	return util.CleanupOrphanMounts(filepath.Join(d.Root, MOUNTS_DIR), mountPoints)
+}
+
+func (d *Driver) ListVolume(opts map[string]string) (map[string]map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volumeIDs, err := d.listVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]map[string]string{}
+	for _, id := range volumeIDs {
+		result[id], err = d.getVolumeInfo(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (d *Driver) GetVolumeInfo(id string) (map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.getVolumeInfo(id)
+}
+
+func (d *Driver) getVolumeInfo(id string) (map[string]string, error) {
+	volume := d.blankVolume(id)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, err
+	}
+	info := map[string]string{
+		OPT_VOLUME_NAME:         volume.Name,
+		"Dataset":               volume.Dataset,
+		"Origin":                volume.Origin,
+		OPT_MOUNT_POINT:         volume.MountPoint,
+		OPT_VOLUME_CREATED_TIME: volume.CreatedTime,
+		OPT_SIZE:                strconv.FormatInt(volume.Size, 10),
+		OPT_MOUNT_OPTIONS:       volume.MountOptions,
+		OPT_READ_ONLY:           strconv.FormatBool(volume.ReadOnly),
+		"MountedReadOnly":       strconv.FormatBool(volume.MountedReadOnly),
+	}
+	if volume.Size != 0 {
+		info[OPT_ALLOCATED_SIZE] = info[OPT_SIZE]
+	}
+	used, err := d.getProperty(context.Background(), volume.Dataset, "used")
+	if err != nil {
+		log.Warnf("Failed to get usage of volume %v: %v", volume.Name, err)
+		return info, nil
+	}
+	info[OPT_USED_SIZE] = strconv.FormatInt(used, 10)
+	return info, nil
+}
+
+func (d *Driver) SnapshotOps() (SnapshotOperations, error) {
+	return d, nil
+}
+
+func (d *Driver) CreateSnapshot(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volumeID, err := util.GetFieldFromOpts(OPT_VOLUME_NAME, req.Options)
+	if err != nil {
+		return err
+	}
+	if err := checkName(id); err != nil {
+		return err
+	}
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if _, exists := volume.Snapshots[id]; exists {
+		return fmt.Errorf("Snapshot %v of volume %v already exists", id, volumeID)
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_CREATE,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_SNAPSHOT: id,
+		LOG_FIELD_VOLUME:   volumeID,
+	}).Debugf("Creating snapshot %v", volume.snapshotName(id))
+	if _, err := d.zfs(req.Context(), "snapshot", volume.snapshotName(id)); err != nil {
+		return err
+	}
+	volume.Snapshots[id] = Snapshot{
+		Name:        id,
+		CreatedTime: util.Now(),
+	}
+	return util.ObjectSave(volume)
+}
+
+// DeleteSnapshot destroys the snapshot, unless a volume is created from it
+func (d *Driver) DeleteSnapshot(req Request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	id := req.Name
+	volumeID, err := util.GetFieldFromOpts(OPT_VOLUME_NAME, req.Options)
+	if err != nil {
+		return err
+	}
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return err
+	}
+	if _, exists := volume.Snapshots[id]; !exists {
+		return fmt.Errorf("Cannot find snapshot %v of volume %v", id, volumeID)
+	}
+	clone, err := d.cloneOf(volume.snapshotName(id))
+	if err != nil {
+		return err
+	}
+	if clone != "" {
+		return fmt.Errorf("Cannot delete snapshot %v, volume %v is created from it", id, clone)
+	}
+
+	log.WithFields(logrus.Fields{
+		LOG_FIELD_REASON:   LOG_REASON_START,
+		LOG_FIELD_EVENT:    LOG_EVENT_REMOVE,
+		LOG_FIELD_OBJECT:   LOG_OBJECT_SNAPSHOT,
+		LOG_FIELD_SNAPSHOT: id,
+		LOG_FIELD_VOLUME:   volumeID,
+	}).Debugf("Destroying snapshot %v", volume.snapshotName(id))
+	if _, err := d.zfs(req.Context(), "destroy", volume.snapshotName(id)); err != nil {
+		return err
+	}
+	delete(volume.Snapshots, id)
+	return util.ObjectSave(volume)
+}
+
+func (d *Driver) GetSnapshotInfo(req Request) (map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volumeID, err := util.GetFieldFromOpts(OPT_VOLUME_NAME, req.Options)
+	if err != nil {
+		return nil, err
+	}
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return nil, err
+	}
+	return d.getSnapshotInfo(req.Name, volume)
+}
+
+func (d *Driver) getSnapshotInfo(id string, volume *Volume) (map[string]string, error) {
+	snapshot, exists := volume.Snapshots[id]
+	if !exists {
+		return nil, fmt.Errorf("Cannot find snapshot %v of volume %v", id, volume.Name)
+	}
+	info := map[string]string{
+		OPT_SNAPSHOT_NAME:         snapshot.Name,
+		OPT_SNAPSHOT_CREATED_TIME: snapshot.CreatedTime,
+		"VolumeUUID":              volume.Name,
+		"Snapshot":                volume.snapshotName(id),
+	}
+	// Space only referenced by the snapshot, freed once it's destroyed
+	used, err := d.getProperty(context.Background(), volume.snapshotName(id), "used")
+	if err != nil {
+		log.Warnf("Failed to get usage of snapshot %v: %v", id, err)
+		return info, nil
+	}
+	info[OPT_USED_SIZE] = strconv.FormatInt(used, 10)
+	return info, nil
+}
+
+func (d *Driver) ListSnapshot(opts map[string]string) (map[string]map[string]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var (
+		volumeIDs []string
+		err       error
+	)
+	if volumeID := opts[OPT_VOLUME_NAME]; volumeID != "" {
+		volumeIDs = []string{volumeID}
+	} else {
+		volumeIDs, err = d.listVolumeNames()
+		if err != nil {
+			return nil, err
+		}
+	}
+	snapshots := map[string]map[string]string{}
+	for _, volumeID := range volumeIDs {
+		volume := d.blankVolume(volumeID)
+		if err := util.ObjectLoad(volume); err != nil {
+			return nil, err
+		}
+		for snapshotID := range volume.Snapshots {
+			snapshots[snapshotID], err = d.getSnapshotInfo(snapshotID, volume)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return snapshots, nil
+}
+
+func (d *Driver) BackupOps() (BackupOperations, error) {
+	return d, nil
+}
+
+/*
+CreateBackup uploads the send stream of snapshot. The stream is incremental
+from the snapshot of the last backup of volume in destURL if it still exists
+and is older, so only the blocks changed since then are uploaded.
+*/
+func (d *Driver) CreateBackup(snapshotID, volumeID, destURL string, opts map[string]string) (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	volume := d.blankVolume(volumeID)
+	if err := util.ObjectLoad(volume); err != nil {
+		return "", err
+	}
+	if _, exists := volume.Snapshots[snapshotID]; !exists {
+		return "", fmt.Errorf("Cannot find snapshot %v for volume %v", snapshotID, volumeID)
+	}
+	objVolume := &objectstore.Volume{
+		Name:        volume.Name,
+		Driver:      d.Name(),
+		Size:        volume.Size,
+		CreatedTime: opts[OPT_VOLUME_CREATED_TIME],
+	}
+	objSnapshot := &objectstore.Snapshot{
+		Name:            snapshotID,
+		CreatedTime:     opts[OPT_SNAPSHOT_CREATED_TIME],
+		EncryptionKeyID: opts[OPT_ENCRYPTION_KEY_ID],
+		Compression:     util.GetCompression(opts[OPT_COMPRESSION]),
+	}
+	if err := util.ValidateCompression(objSnapshot.Compression); err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	parentBackup, err := d.parentBackup(ctx, volume, snapshotID, destURL)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"send", volume.snapshotName(snapshotID)}
+	if parentBackup != "" {
+		args = []string{"send", "-i", volume.snapshotName(parentSnapshot(parentBackup)), volume.snapshotName(snapshotID)}
+	}
+
+	// Compressed size is not known in advance, the size of stream is the
+	// upper bound
+	size, err := d.estimateSendSize(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	if err := util.CheckStagingSpace(size, "backup of snapshot "+snapshotID); err != nil {
+		return "", err
+	}
+	streamFile, err := util.CreateStagingFile(volume.Name + "-" + snapshotID + ".stream")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(streamFile.Name())
+	sendErr := d.send(ctx, args, streamFile, objSnapshot.Compression)
+	if err := streamFile.Close(); err != nil && sendErr == nil {
+		sendErr = err
+	}
+	if sendErr != nil {
+		return "", sendErr
+	}
+	return objectstore.CreateStreamBackup(objVolume, objSnapshot, streamFile.Name(), parentBackupName(parentBackup), destURL)
+}
+
+// estimateSendSize returns the estimated size of the stream sent by zfs with
+// args, by a dry run of the send
+func (d *Driver) estimateSendSize(ctx context.Context, args []string) (int64, error) {
+	output, err := d.zfs(ctx, append([]string{"send", "-n", "-P"}, args[1:]...)...)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "size" {
+			if size, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return size, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Unexpected output of estimating send %v: %v", args, output)
+}
+
+// parentBackup returns the last backup of volume in destURL and its snapshot
+// as "<backup>@<snapshot>", if the backup of snapshotID can be incremental to
+// it, or empty string otherwise
+func (d *Driver) parentBackup(ctx context.Context, volume *Volume, snapshotID, destURL string) (string, error) {
+	backupName, snapshotName, err := objectstore.GetLastBackup(volume.Name, destURL)
+	if err != nil || backupName == "" {
+		return "", err
+	}
+	if _, exists := volume.Snapshots[snapshotName]; !exists || snapshotName == snapshotID {
+		log.Debugf("Snapshot %v of last backup %v is not available, would create full backup", snapshotName, backupName)
+		return "", nil
+	}
+	// Incremental stream must be from an earlier snapshot
+	lastTxg, err := d.getProperty(ctx, volume.snapshotName(snapshotName), "createtxg")
+	if err != nil {
+		return "", err
+	}
+	txg, err := d.getProperty(ctx, volume.snapshotName(snapshotID), "createtxg")
+	if err != nil {
+		return "", err
+	}
+	if lastTxg >= txg {
+		log.Debugf("Snapshot %v of last backup %v is newer than %v, would create full backup", snapshotName, backupName, snapshotID)
+		return "", nil
+	}
+	return backupName + "@" + snapshotName, nil
+}
+
+func parentBackupName(parent string) string {
+	return strings.SplitN(parent, "@", 2)[0]
+}
+
+func parentSnapshot(parent string) string {
+	return strings.SplitN(parent, "@", 2)[1]
+}
+
+// send writes the output of zfs send with args to dst, compressed with
+// compression
+func (d *Driver) send(ctx context.Context, args []string, dst io.Writer, compression string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, zfsBinary, args...)
+	util.KillProcessGroupOnCancel(cmd)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	compressErr := util.CompressStream(dst, stdout, compression)
+	if compressErr != nil {
+		// zfs send would be blocked on the output otherwise
+		cancel()
+	}
+	if err := cmd.Wait(); err != nil && compressErr == nil {
+		return fmt.Errorf("Failed to execute: %v %v, output %v, error %v", zfsBinary, args, stderr.String(), err)
+	}
+	return compressErr
+}
+
+// DeleteBackup deletes the backup, unless other backups are incremental to it
+func (d *Driver) DeleteBackup(backupURL string) error {
+	objVolume, err := objectstore.LoadVolume(backupURL)
+	if err != nil {
+		return err
+	}
+	if objVolume.Driver != d.Name() {
+		return fmt.Errorf("BUG: Wrong driver handling DeleteBackup(), driver should be %v but is %v", objVolume.Driver, d.Name())
+	}
+	return objectstore.DeleteStreamBackup(backupURL)
+}
+
+func (d *Driver) GetBackupInfo(backupURL string) (map[string]string, error) {
+	objVolume, err := objectstore.LoadVolume(backupURL)
+	if err != nil {
+		return nil, err
+	}
+	if objVolume.Driver != d.Name() {
+		return nil, fmt.Errorf("BUG: Wrong driver handling GetBackupInfo(), driver should be %v but is %v", objVolume.Driver, d.Name())
+	}
+	return objectstore.GetBackupInfo(backupURL)
+}
+
+func (d *Driver) ListBackup(destURL string, opts map[string]string) (map[string]map[string]string, error) {
+	listOpts, err := objectstore.ParseListOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return objectstore.ListWithOptions(destURL, d.Name(), listOpts)
+}
@@ -0,0 +1,322 @@
+package zfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher/convoy/objectstore"
+	"github.com/rancher/convoy/util"
+
+	// Involve VFS objectstore driver for registeration
+	_ "github.com/rancher/convoy/vfs"
+
+	. "github.com/rancher/convoy/convoydriver"
+	. "gopkg.in/check.v1"
+)
+
+const (
+	testDataset = "tank/convoy"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type TestSuite struct {
+	root   string
+	state  string
+	record string
+}
+
+var _ = Suite(&TestSuite{})
+
+/*
+SetUpTest fakes zfs, which records the commands, and emulates datasets by
+directories under s.state and snapshots by files next to them holding their
+createtxg. Send streams are the descriptions of the sends, dry runs of send
+estimate a fixed size, and received streams are appended to
+<dataset>.received.
+*/
+func (s *TestSuite) SetUpTest(c *C) {
+	var err error
+	s.root, err = ioutil.TempDir("", "convoy-zfs")
+	c.Assert(err, IsNil)
+
+	s.state = filepath.Join(s.root, "state")
+	c.Assert(os.MkdirAll(filepath.Join(s.state, testDataset), 0755), IsNil)
+	s.record = filepath.Join(s.root, "zfs-commands")
+	script := `#!/bin/sh
+echo "$@" >> ` + s.record + `
+state=` + s.state + `
+cmd=$1
+shift
+while [ $# -gt 0 ]; do
+	case $1 in
+	-o) prop=$2; shift;;
+	-t) type=$2; shift;;
+	-i) from=$2; shift;;
+	-d) shift;;
+	-r) recursive=1;;
+	-n) dryrun=1;;
+	-*) ;;
+	*) source=$target; target=$1;;
+	esac
+	shift
+done
+case $cmd in
+list)
+	if [ ! -e "$state/$target" ]; then
+		echo "cannot open '$target': dataset does not exist" >&2
+		exit 1
+	fi
+	if [ "$type" = snapshot ]; then
+		for f in "$state/$target"@*; do
+			[ -e "$f" ] && echo "${f#$state/}"
+		done
+		exit 0
+	fi
+	case $prop in
+	available) echo 1073741824;;
+	used) echo 4096;;
+	createtxg) cat "$state/$target";;
+	*) echo "$target";;
+	esac;;
+create)
+	mkdir "$state/$target";;
+clone)
+	[ -e "$state/$source" ] || exit 1
+	mkdir "$state/$target";;
+snapshot)
+	txg=$(( $(cat $state/txg 2>/dev/null || echo 0) + 1 ))
+	echo $txg > $state/txg
+	echo $txg > "$state/$target";;
+destroy)
+	[ -e "$state/$target" ] || exit 1
+	if [ -n "$recursive" ]; then
+		rm -rf "$state/$target" "$state/$target"@*
+	else
+		rm -r "$state/$target"
+	fi;;
+send)
+	if [ -n "$dryrun" ]; then
+		printf "full\t$target\t1024\nsize\t1024\n"
+		exit 0
+	fi
+	echo "stream $from $target";;
+receive)
+	mkdir -p "$state/$target"
+	cat >> "$state/$target.received"
+	echo 0 > "$state/$target@received";;
+esac
+`
+	fakeBinary := filepath.Join(s.root, "fake-zfs")
+	c.Assert(ioutil.WriteFile(fakeBinary, []byte(script), 0755), IsNil)
+	zfsBinary = fakeBinary
+}
+
+func (s *TestSuite) TearDownTest(c *C) {
+	zfsBinary = ZFS_BINARY
+	c.Assert(os.RemoveAll(s.root), IsNil)
+}
+
+func (s *TestSuite) readCommands(c *C) []string {
+	output, err := ioutil.ReadFile(s.record)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(s.record), IsNil)
+	return strings.Split(strings.TrimSpace(string(output)), "\n")
+}
+
+func (s *TestSuite) initDriver(c *C) *Driver {
+	driver, err := Init(filepath.Join(s.root, "root"), map[string]string{
+		ZFS_DATASET: testDataset,
+	})
+	c.Assert(err, IsNil)
+	s.readCommands(c)
+	return driver.(*Driver)
+}
+
+func (s *TestSuite) TestInit(c *C) {
+	root := filepath.Join(s.root, "root")
+	_, err := Init(root, map[string]string{})
+	c.Assert(err, ErrorMatches, "Missing required parameter: zfs.dataset")
+	_, err = Init(root, map[string]string{ZFS_DATASET: "tank/other"})
+	c.Assert(err, ErrorMatches, "(?s)Cannot find dataset tank/other: .*dataset does not exist.*")
+	_, err = Init(root, map[string]string{
+		ZFS_DATASET:             testDataset,
+		ZFS_DEFAULT_VOLUME_SIZE: "1X",
+	})
+	c.Assert(err, ErrorMatches, "Invalid zfs.defaultvolumesize 1X")
+
+	_, err = Init(root, map[string]string{
+		ZFS_DATASET:             "/" + testDataset + "/",
+		ZFS_DEFAULT_VOLUME_SIZE: "1G",
+	})
+	c.Assert(err, IsNil)
+
+	// Options are kept unless they're specified again
+	driver, err := Init(root, map[string]string{})
+	c.Assert(err, IsNil)
+	info, err := driver.Info()
+	c.Assert(err, IsNil)
+	c.Assert(info["Dataset"], Equals, testDataset)
+	c.Assert(info["DefaultVolumeSize"], Equals, "1073741824")
+	c.Assert(info["AvailableSize"], Equals, "1073741824")
+	c.Assert(driver.(*Driver).CheckHealth(), DeepEquals, []HealthCheck{{Name: "dataset " + testDataset}})
+}
+
+func (s *TestSuite) TestVolumeAndSnapshot(c *C) {
+	d := s.initDriver(c)
+
+	c.Assert(d.CreateVolume(Request{Name: "vol~1", Options: map[string]string{}}), ErrorMatches,
+		"Invalid name vol~1, zfs doesn't support ~ in names")
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{OPT_UID: "1000"}}), ErrorMatches,
+		"Owner and permission of volume are not supported by zfs")
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{
+		OPT_SIZE:          "1G",
+		OPT_MOUNT_OPTIONS: "noatime",
+	}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"create -o mountpoint=legacy -o refquota=1073741824 " + testDataset + "/vol1",
+	})
+	volume := d.blankVolume("vol1")
+	c.Assert(util.ObjectLoad(volume), IsNil)
+	c.Assert(volume.GetMountOpts(), DeepEquals, []string{"-t", "zfs", "-o", "noatime"})
+
+	info, err := d.GetVolumeInfo("vol1")
+	c.Assert(err, IsNil)
+	c.Assert(info["Dataset"], Equals, testDataset+"/vol1")
+	c.Assert(info[OPT_SIZE], Equals, "1073741824")
+	c.Assert(info[OPT_USED_SIZE], Equals, "4096")
+
+	c.Assert(d.ResizeVolume(Request{Name: "vol1", Options: map[string]string{OPT_SIZE: "1G"}}), ErrorMatches,
+		"New size 1073741824 must be larger than current size 1073741824 of volume vol1")
+	s.readCommands(c)
+	c.Assert(d.ResizeVolume(Request{Name: "vol1", Options: map[string]string{OPT_SIZE: "2G"}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"set refquota=2147483648 " + testDataset + "/vol1",
+	})
+
+	c.Assert(d.CreateSnapshot(Request{Name: "snap1", Options: map[string]string{OPT_VOLUME_NAME: "vol1"}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"snapshot " + testDataset + "/vol1@snap1",
+	})
+	c.Assert(d.CreateSnapshot(Request{Name: "snap1", Options: map[string]string{OPT_VOLUME_NAME: "vol1"}}), ErrorMatches,
+		"Snapshot snap1 of volume vol1 already exists")
+	snapshots, err := d.ListSnapshot(map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(snapshots, HasLen, 1)
+	c.Assert(snapshots["snap1"]["Snapshot"], Equals, testDataset+"/vol1@snap1")
+	s.readCommands(c)
+
+	// Volumes of snapshots and clones of volumes are ZFS clones
+	c.Assert(d.CreateVolume(Request{Name: "vol2", Options: map[string]string{
+		OPT_SNAPSHOT_NAME:        "snap1",
+		OPT_SNAPSHOT_VOLUME_NAME: "vol1",
+	}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"clone -o mountpoint=legacy -o refquota=2147483648 " + testDataset + "/vol1@snap1 " + testDataset + "/vol2",
+	})
+	c.Assert(d.CloneVolume(Request{Name: "vol3", Options: map[string]string{OPT_CLONE_SOURCE: "vol1"}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"snapshot " + testDataset + "/vol1@clone:vol3",
+		"clone -o mountpoint=legacy -o refquota=2147483648 " + testDataset + "/vol1@clone:vol3 " + testDataset + "/vol3",
+	})
+	info, err = d.GetVolumeInfo("vol3")
+	c.Assert(err, IsNil)
+	c.Assert(info["Origin"], Equals, testDataset+"/vol1@clone:vol3")
+	c.Assert(info[OPT_MOUNT_OPTIONS], Equals, "noatime")
+	s.readCommands(c)
+
+	c.Assert(d.DeleteSnapshot(Request{Name: "snap1", Options: map[string]string{OPT_VOLUME_NAME: "vol1"}}), ErrorMatches,
+		"Cannot delete snapshot snap1, volume vol2 is created from it")
+	c.Assert(d.DeleteVolume(Request{Name: "vol1", Options: map[string]string{}}), ErrorMatches,
+		"Cannot delete volume vol1, volume vol[23] is cloned from it")
+
+	// Snapshot taken for the clone is destroyed with it
+	c.Assert(d.DeleteVolume(Request{Name: "vol3", Options: map[string]string{}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"destroy -r " + testDataset + "/vol3",
+		"destroy " + testDataset + "/vol1@clone:vol3",
+	})
+	c.Assert(d.DeleteVolume(Request{Name: "vol2", Options: map[string]string{}}), IsNil)
+	c.Assert(d.DeleteSnapshot(Request{Name: "snap1", Options: map[string]string{OPT_VOLUME_NAME: "vol1"}}), IsNil)
+	c.Assert(d.DeleteVolume(Request{Name: "vol1", Options: map[string]string{}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"destroy -r " + testDataset + "/vol2",
+		"destroy " + testDataset + "/vol1@snap1",
+		"destroy -r " + testDataset + "/vol1",
+	})
+	volumes, err := d.ListVolume(map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(volumes, HasLen, 0)
+}
+
+func (s *TestSuite) TestBackup(c *C) {
+	d := s.initDriver(c)
+	dest := filepath.Join(s.root, "dest")
+	c.Assert(os.Mkdir(dest, 0700), IsNil)
+	destURL := "vfs://" + dest
+
+	c.Assert(d.CreateVolume(Request{Name: "vol1", Options: map[string]string{OPT_SIZE: "1G"}}), IsNil)
+	for _, snapshot := range []string{"snap1", "snap2"} {
+		c.Assert(d.CreateSnapshot(Request{Name: snapshot, Options: map[string]string{OPT_VOLUME_NAME: "vol1"}}), IsNil)
+	}
+	s.readCommands(c)
+
+	// First backup is full, and the next one incremental to it
+	url1, err := d.CreateBackup("snap1", "vol1", destURL, map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"send -n -P " + testDataset + "/vol1@snap1",
+		"send " + testDataset + "/vol1@snap1",
+	})
+	url2, err := d.CreateBackup("snap2", "vol1", destURL, map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"list -Hp -o createtxg " + testDataset + "/vol1@snap1",
+		"list -Hp -o createtxg " + testDataset + "/vol1@snap2",
+		"send -n -P -i " + testDataset + "/vol1@snap1 " + testDataset + "/vol1@snap2",
+		"send -i " + testDataset + "/vol1@snap1 " + testDataset + "/vol1@snap2",
+	})
+	info, err := d.GetBackupInfo(url2)
+	c.Assert(err, IsNil)
+	c.Assert(info["ParentBackupURL"], Equals, url1)
+
+	// Backup of older snapshot cannot be incremental
+	url3, err := d.CreateBackup("snap1", "vol1", destURL, map[string]string{})
+	c.Assert(err, IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"list -Hp -o createtxg " + testDataset + "/vol1@snap2",
+		"list -Hp -o createtxg " + testDataset + "/vol1@snap1",
+		"send -n -P " + testDataset + "/vol1@snap1",
+		"send " + testDataset + "/vol1@snap1",
+	})
+	c.Assert(d.DeleteBackup(url3), IsNil)
+
+	// Streams are received from the full one, without the snapshots
+	c.Assert(d.CreateVolume(Request{Name: "vol2", Options: map[string]string{OPT_BACKUP_URL: url2}}), IsNil)
+	c.Assert(s.readCommands(c), DeepEquals, []string{
+		"list -H -o name " + testDataset + "/vol2",
+		"receive -u -o mountpoint=legacy " + testDataset + "/vol2",
+		"list -H -o name " + testDataset + "/vol2",
+		"receive -u -F " + testDataset + "/vol2",
+		"list -H -o name -t snapshot -d 1 " + testDataset + "/vol2",
+		"destroy " + testDataset + "/vol2@received",
+		"set refquota=1073741824 " + testDataset + "/vol2",
+	})
+	received, err := ioutil.ReadFile(filepath.Join(s.state, testDataset, "vol2.received"))
+	c.Assert(err, IsNil)
+	c.Assert(string(received), Equals,
+		"stream  "+testDataset+"/vol1@snap1\nstream "+testDataset+"/vol1@snap1 "+testDataset+"/vol1@snap2\n")
+	info, err = d.GetVolumeInfo("vol2")
+	c.Assert(err, IsNil)
+	c.Assert(info[OPT_SIZE], Equals, "1073741824")
+
+	c.Assert(d.DeleteBackup(url1), ErrorMatches, "Cannot delete backup .*, backup .* is incremental to it")
+	c.Assert(d.DeleteBackup(url2), IsNil)
+	c.Assert(d.DeleteBackup(url1), IsNil)
+	backupName, _, err := objectstore.GetLastBackup("vol1", destURL)
+	c.Assert(err, IsNil)
+	c.Assert(backupName, Equals, "")
+}